@@ -1,31 +1,45 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Mattddixo/dsp/config"
 	"github.com/Mattddixo/dsp/internal/commands"
+	"github.com/Mattddixo/dsp/internal/commands/auditcmd"
+	"github.com/Mattddixo/dsp/internal/commands/configcmd"
 	"github.com/Mattddixo/dsp/internal/commands/cryptocmd"
+	"github.com/Mattddixo/dsp/internal/commands/ctlcmd"
+	"github.com/Mattddixo/dsp/internal/commands/doctorcmd"
 	"github.com/Mattddixo/dsp/internal/commands/exportcmd"
 	"github.com/Mattddixo/dsp/internal/commands/help"
 	"github.com/Mattddixo/dsp/internal/commands/hostcmd"
+	"github.com/Mattddixo/dsp/internal/commands/importcmd"
+	"github.com/Mattddixo/dsp/internal/commands/migratehashcmd"
+	"github.com/Mattddixo/dsp/internal/commands/notifycmd"
+	"github.com/Mattddixo/dsp/internal/commands/profilecmd"
+	"github.com/Mattddixo/dsp/internal/commands/pullcmd"
+	"github.com/Mattddixo/dsp/internal/commands/pushcmd"
+	"github.com/Mattddixo/dsp/internal/commands/selfupdatecmd"
+	"github.com/Mattddixo/dsp/internal/commands/statscmd"
+	"github.com/Mattddixo/dsp/internal/commands/synccmd"
 	"github.com/Mattddixo/dsp/internal/commands/usecmd"
+	"github.com/Mattddixo/dsp/internal/commands/versioncmd"
+	"github.com/Mattddixo/dsp/internal/exitcode"
+	"github.com/Mattddixo/dsp/internal/release"
 	"github.com/urfave/cli/v2"
 )
 
 func main() {
-	// Load configuration
-	cfg, err := config.New()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
-		os.Exit(1)
-	}
-
 	// Create app
 	app := &cli.App{
-		Name:  "dsp",
-		Usage: "Disconnected Sync Protocol",
+		Name:                 "dsp",
+		Usage:                "Disconnected Sync Protocol",
+		Version:              release.Version,
+		EnableBashCompletion: true,
 		Description: `A tool for managing disconnected synchronization of files.
 DSP allows you to track, snapshot, and sync files across different systems.
 Each project can have its own DSP repository, and you can manage multiple repositories.
@@ -39,6 +53,16 @@ Basic workflow:
   6. Create bundles: dsp bundle
   7. Apply changes: dsp apply
 
+Exit codes:
+  0  success
+  1  any other error
+  3  network: a peer could not be reached or failed temporarily; retry later
+  4  authentication: credentials refused or host not trusted
+  5  verification: a certificate, signature, checksum or bundle check failed
+  6  configuration: no usable repository or invalid configuration
+  7  conflicts: finished, but changes conflict with local edits
+  8  partial: some of the work was done and some failed
+
 For more information about a command, use: dsp <command> -h`,
 		Commands: []*cli.Command{
 			commands.InitCommand,
@@ -50,21 +74,61 @@ For more information about a command, use: dsp <command> -h`,
 			commands.ApplyCommand,
 			commands.StatusCommand,
 			commands.HistoryCommand,
+			commands.LogCommand,
 			commands.RepoCommand,
 			usecmd.Command,
 			cryptocmd.Command(),
 			hostcmd.Command,
 			exportcmd.Command,
+			importcmd.Command,
+			pushcmd.Command,
+			pullcmd.Command,
+			doctorcmd.Command,
+			synccmd.Command,
+			profilecmd.Command,
+			configcmd.Command,
+			migratehashcmd.Command,
+			ctlcmd.Command,
+			auditcmd.Command,
+			notifycmd.Command,
+			statscmd.Command,
+			versioncmd.Command,
+			selfupdatecmd.Command,
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "global-dir",
+				Usage:   "Global DSP directory holding keys, hosts and registered repositories (default ~/.dsp-global)",
+				EnvVars: []string{config.GlobalDirEnv},
+			},
+			&cli.StringFlag{
+				Name:    "profile",
+				Usage:   "Profile to use for this command (see 'dsp profile')",
+				EnvVars: []string{config.ProfileEnv},
+			},
 		},
 		Before: func(c *cli.Context) error {
-			// Add config to context
-			c.Context = cfg.WithContext(c.Context)
+			// Point every manager at the chosen global directory
+			if c.IsSet("profile") {
+				if err := os.Setenv(config.ProfileEnv, c.String("profile")); err != nil {
+					return fmt.Errorf("failed to set profile: %w", err)
+				}
+			}
+			if c.IsSet("global-dir") {
+				if err := os.Setenv(config.GlobalDirEnv, c.String("global-dir")); err != nil {
+					return fmt.Errorf("failed to set global directory: %w", err)
+				}
+			}
+
+			// Add config to context, loaded only by commands that use it, so
+			// help, version and completion work even with a broken config
+			c.Context = config.WithLazyContext(c.Context)
 			return nil
 		},
 		ExitErrHandler: func(c *cli.Context, err error) {
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-				os.Exit(1)
+				os.Exit(exitcode.Code(err))
 			}
 		},
 	}
@@ -72,9 +136,22 @@ For more information about a command, use: dsp <command> -h`,
 	// Setup custom help template
 	help.SetupHelp(app)
 
+	// Cancel the command's context on Ctrl+C or SIGTERM so it can stop cleanly.
+	// A second signal exits at once.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		fmt.Fprintln(os.Stderr, "\nInterrupted; stopping (press Ctrl+C again to exit now)")
+		cancel()
+	}()
+
 	// Run app
-	if err := app.Run(os.Args); err != nil {
+	if err := app.RunContext(ctx, os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "Error running command: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitcode.Code(err))
 	}
 }
@@ -7,7 +7,9 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/Mattddixo/dsp/internal/exitcode"
 	"gopkg.in/yaml.v3"
 )
 
@@ -30,6 +32,50 @@ type Config struct {
 
 	// CompressionLevel is the compression level for bundles (1-9)
 	CompressionLevel int `yaml:"compression_level"`
+
+	// BackupRetention is the number of apply backups to keep (0 uses the default)
+	BackupRetention int `yaml:"backup_retention,omitempty"`
+
+	// KeepSnapshots is the number of snapshots to keep (0 keeps all)
+	KeepSnapshots int `yaml:"keep_snapshots,omitempty"`
+
+	// KeepBundlesDays is how many days bundles are kept in <dsp_dir>/bundles (0 keeps all)
+	KeepBundlesDays int `yaml:"keep_bundles_days,omitempty"`
+
+	// ContentStoreMB is the size limit in MiB of the file contents kept at
+	// snapshot time (0 uses the default, -1 disables the store)
+	ContentStoreMB int `yaml:"content_store_mb,omitempty"`
+
+	// AutoTrack adds new entries of the repository root to tracking at
+	// snapshot time
+	AutoTrack bool `yaml:"auto_track,omitempty"`
+
+	// AutoTrackInclude limits auto-track to root entries matching these
+	// patterns (empty matches every entry not starting with a dot)
+	AutoTrackInclude []string `yaml:"auto_track_include,omitempty"`
+
+	// Size and type policy for files found in tracked directories. Files it
+	// rejects are left out of snapshots.
+	MaxFileSize    string   `yaml:"max_file_size,omitempty"`   // Largest file size, such as 500MB (empty for no limit)
+	SkipBinary     bool     `yaml:"skip_binary,omitempty"`     // Leave out binary files
+	OnlyExtensions []string `yaml:"only_extensions,omitempty"` // Only keep files with these extensions (empty keeps all)
+
+	// EncryptAtRest encrypts the file contents the repository keeps with the
+	// local age key: <data_dir>/objects, the bundles in <dsp_dir>/bundles,
+	// deferred bundle copies and apply backups. A copy of the repository
+	// data then does not leak the tracked files' history.
+	EncryptAtRest bool `yaml:"encrypt_at_rest,omitempty"`
+
+	// FollowSymlinks records what symlinks point to instead of the links themselves
+	FollowSymlinks bool `yaml:"follow_symlinks,omitempty"`
+
+	// LongPaths controls paths of 260 characters or more on Windows: "auto"
+	// (or empty) writes them with the \\?\ prefix, "off" treats them as path issues
+	LongPaths string `yaml:"long_paths,omitempty"`
+
+	// UnicodeNormalization is the Unicode form applied to paths from bundles:
+	// "none" (or empty), "nfc" or "nfd"
+	UnicodeNormalization string `yaml:"unicode_normalization,omitempty"`
 }
 
 // normalizePath converts a path to the OS-specific format and cleans it
@@ -70,6 +116,9 @@ func NewWithRepo(repoPath, dspDir string) (*Config, error) {
 				cfg = repoCfg
 			}
 		}
+
+		// Load the key of the keyed hash algorithm, if the repository has one
+		useHashKey(filepath.Join(repoPath, dspDir))
 	}
 
 	// Override with environment variables if they exist
@@ -84,10 +133,59 @@ func NewWithRepo(repoPath, dspDir string) (*Config, error) {
 			cfg.CompressionLevel = level
 		}
 	}
+	if envRetention := os.Getenv("DSP_BACKUP_RETENTION"); envRetention != "" {
+		if retention, err := strconv.Atoi(envRetention); err == nil {
+			cfg.BackupRetention = retention
+		}
+	}
+	if envKeep := os.Getenv("DSP_KEEP_SNAPSHOTS"); envKeep != "" {
+		if keep, err := strconv.Atoi(envKeep); err == nil {
+			cfg.KeepSnapshots = keep
+		}
+	}
+	if envDays := os.Getenv("DSP_KEEP_BUNDLES_DAYS"); envDays != "" {
+		if days, err := strconv.Atoi(envDays); err == nil {
+			cfg.KeepBundlesDays = days
+		}
+	}
+	if envStore := os.Getenv("DSP_CONTENT_STORE_MB"); envStore != "" {
+		if mb, err := strconv.Atoi(envStore); err == nil {
+			cfg.ContentStoreMB = mb
+		}
+	}
+	if envAuto := os.Getenv("DSP_AUTO_TRACK"); envAuto != "" {
+		if auto, err := strconv.ParseBool(envAuto); err == nil {
+			cfg.AutoTrack = auto
+		}
+	}
+	if envMax := os.Getenv("DSP_MAX_FILE_SIZE"); envMax != "" {
+		cfg.MaxFileSize = envMax
+	}
+	if envSkip := os.Getenv("DSP_SKIP_BINARY"); envSkip != "" {
+		if skip, err := strconv.ParseBool(envSkip); err == nil {
+			cfg.SkipBinary = skip
+		}
+	}
+	if envEncrypt := os.Getenv("DSP_ENCRYPT_AT_REST"); envEncrypt != "" {
+		if encrypt, err := strconv.ParseBool(envEncrypt); err == nil {
+			cfg.EncryptAtRest = encrypt
+		}
+	}
+	if envFollow := os.Getenv("DSP_FOLLOW_SYMLINKS"); envFollow != "" {
+		if follow, err := strconv.ParseBool(envFollow); err == nil {
+			cfg.FollowSymlinks = follow
+		}
+	}
+	if envLong := os.Getenv("DSP_LONG_PATHS"); envLong != "" {
+		cfg.LongPaths = envLong
+	}
+	if envNorm := os.Getenv("DSP_UNICODE_NORMALIZATION"); envNorm != "" {
+		cfg.UnicodeNormalization = envNorm
+	}
 
 	// Validate configuration
 	if err := cfg.validate(); err != nil {
-		return nil, fmt.Errorf("invalid configuration: %w", err)
+		return nil, exitcode.ConfigError(fmt.Errorf("invalid configuration: %w", err))
 	}
 
 	return &cfg, nil
@@ -100,7 +198,7 @@ func (c *Config) Save(path string) error {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
 
-	if err := os.WriteFile(path, data, 0644); err != nil {
+	if err := WriteFileAtomic(path, data, 0644); err != nil {
 		return fmt.Errorf("failed to write config file: %w", err)
 	}
 
@@ -128,9 +226,105 @@ func (c *Config) validate() error {
 			c.CompressionLevel, MinCompressionLevel, MaxCompressionLevel)
 	}
 
+	// Validate backup retention
+	if c.BackupRetention < 0 {
+		return fmt.Errorf("invalid backup retention: %d, must be 0 or greater", c.BackupRetention)
+	}
+
+	// Validate snapshot and bundle retention
+	if c.KeepSnapshots < 0 {
+		return fmt.Errorf("invalid keep_snapshots: %d, must be 0 or greater", c.KeepSnapshots)
+	}
+	if c.KeepBundlesDays < 0 {
+		return fmt.Errorf("invalid keep_bundles_days: %d, must be 0 or greater", c.KeepBundlesDays)
+	}
+
+	// Validate content store quota
+	if c.ContentStoreMB < -1 {
+		return fmt.Errorf("invalid content_store_mb: %d, must be -1 (disabled) or greater", c.ContentStoreMB)
+	}
+
+	// Validate auto-track patterns
+	for _, pattern := range c.AutoTrackInclude {
+		if _, err := filepath.Match(pattern, ""); err != nil || strings.ContainsAny(pattern, `/\`) {
+			return fmt.Errorf("invalid auto_track_include pattern: %s, must match a name in the repository root", pattern)
+		}
+	}
+
+	// Validate file policy
+	if c.MaxFileSize != "" {
+		if _, err := ParseSize(c.MaxFileSize); err != nil {
+			return fmt.Errorf("invalid max_file_size: %w", err)
+		}
+	}
+
+	// Validate path handling
+	if c.LongPaths != "" && !contains(ValidLongPaths, c.LongPaths) {
+		return fmt.Errorf("invalid long_paths: %s, must be one of: %s",
+			c.LongPaths, strings.Join(ValidLongPaths, ", "))
+	}
+	if c.UnicodeNormalization != "" && !contains(ValidUnicodeNormalizations, c.UnicodeNormalization) {
+		return fmt.Errorf("invalid unicode_normalization: %s, must be one of: %s",
+			c.UnicodeNormalization, strings.Join(ValidUnicodeNormalizations, ", "))
+	}
+
 	return nil
 }
 
+// LongPathsEnabled reports whether long paths are written with the \\?\
+// prefix on Windows
+func (c *Config) LongPathsEnabled() bool {
+	return c.LongPaths != LongPathsOff
+}
+
+// contains reports whether a list holds a value
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// GetBackupRetention returns the number of apply backups to keep
+func (c *Config) GetBackupRetention() int {
+	if c.BackupRetention == 0 {
+		return DefaultBackupRetention
+	}
+	return c.BackupRetention
+}
+
+// GetContentStoreQuota returns the size limit of the content store in bytes,
+// or 0 if the store is disabled
+func (c *Config) GetContentStoreQuota() int64 {
+	switch {
+	case c.ContentStoreMB < 0:
+		return 0
+	case c.ContentStoreMB == 0:
+		return DefaultContentStoreMB << 20
+	}
+	return int64(c.ContentStoreMB) << 20
+}
+
+// GetMaxFileSize returns the largest file size snapshots keep, or 0 for no
+// limit
+func (c *Config) GetMaxFileSize() int64 {
+	size, err := ParseSize(c.MaxFileSize)
+	if c.MaxFileSize == "" || err != nil {
+		return 0
+	}
+	return size
+}
+
+// DataDirIn returns the data directory of the repository at repoPath
+func (c *Config) DataDirIn(repoPath string) string {
+	if filepath.IsAbs(c.DataDir) {
+		return c.DataDir
+	}
+	return filepath.Join(repoPath, c.DataDir)
+}
+
 // GetDataDirPath returns the absolute path to the data directory
 func (c *Config) GetDataDirPath() (string, error) {
 	// If DataDir is absolute, return it as is
@@ -168,6 +362,7 @@ func (c *Config) String() string {
 	sb.WriteString(fmt.Sprintf("  Data Directory: %s\n", c.DataDir))
 	sb.WriteString(fmt.Sprintf("  Hash Algorithm: %s\n", c.HashAlgorithm))
 	sb.WriteString(fmt.Sprintf("  Compression Level: %d\n", c.CompressionLevel))
+	sb.WriteString(fmt.Sprintf("  Backup Retention: %d\n", c.GetBackupRetention()))
 	return sb.String()
 }
 
@@ -176,10 +371,32 @@ func (c *Config) WithContext(ctx context.Context) context.Context {
 	return context.WithValue(ctx, ConfigKey, c)
 }
 
+// lazyConfig is a config loaded on first use
+type lazyConfig struct {
+	once sync.Once
+	cfg  *Config
+	err  error
+}
+
+// WithLazyContext adds to the context a config that is loaded with New the
+// first time it is retrieved, so commands that do not need it never read
+// or fail on the configuration
+func WithLazyContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ConfigKey, &lazyConfig{})
+}
+
 // GetConfigFromContext retrieves the config from a context
 func GetConfigFromContext(ctx context.Context) (*Config, error) {
-	if cfg, ok := ctx.Value(ConfigKey).(*Config); ok {
-		return cfg, nil
+	switch v := ctx.Value(ConfigKey).(type) {
+	case *Config:
+		return v, nil
+	case *lazyConfig:
+		v.once.Do(func() {
+			if v.cfg, v.err = New(); v.err != nil {
+				v.err = exitcode.ConfigError(fmt.Errorf("failed to load configuration: %w", v.err))
+			}
+		})
+		return v.cfg, v.err
 	}
 	return nil, fmt.Errorf("no config found in context")
 }
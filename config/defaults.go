@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 // Default configuration values
 const (
 	// DefaultDataDir is the default directory for DSP metadata
@@ -12,6 +14,39 @@ const (
 	// DefaultCompressionLevel is the default compression level (1-9)
 	DefaultCompressionLevel = 6
 
+	// DefaultBackupRetention is the default number of apply backups to keep
+	DefaultBackupRetention = 5
+
+	// DefaultContentStoreMB is the default size limit of the content store in MiB
+	DefaultContentStoreMB = 1024
+
+	// DefaultTrustPolicy is the default policy for hosts met during a key exchange
+	DefaultTrustPolicy = TrustPolicyTOFU
+
+	// DefaultCertExpiryWarningDays is how many days before expiry a pinned certificate is warned about
+	DefaultCertExpiryWarningDays = 30
+
+	// DefaultStaleHostDays is how many days without use make a host stale
+	DefaultStaleHostDays = 90
+
+	// DefaultPortRange is the range of ports export tries when --port is not given
+	DefaultPortRange = "8080-8089"
+
+	// DefaultRetries is how often import retries a request that failed on the network
+	DefaultRetries = 3
+
+	// DefaultRetryDelay is the wait before the first retry of a failed request
+	DefaultRetryDelay = time.Second
+
+	// DefaultMaxClientConnections is how many connections one client may hold open to export
+	DefaultMaxClientConnections = 8
+
+	// DefaultBanAfter is how many authentication failures in a row get a client banned from export
+	DefaultBanAfter = 20
+
+	// DefaultBanDuration is how long a client banned from export stays banned
+	DefaultBanDuration = time.Hour
+
 	// DefaultSigningEnabled determines if signing is enabled by default
 	DefaultSigningEnabled = false
 )
@@ -19,10 +54,30 @@ const (
 // ValidHashAlgorithms contains the list of supported hash algorithms
 var ValidHashAlgorithms = []string{
 	"blake3",
+	"blake3-keyed",
 	"sha256",
 	"sha512",
 }
 
+// Long path handling on Windows
+const (
+	LongPathsAuto = "auto"
+	LongPathsOff  = "off"
+)
+
+// ValidLongPaths contains the accepted long_paths values
+var ValidLongPaths = []string{LongPathsAuto, LongPathsOff}
+
+// Unicode normalization forms for paths
+const (
+	NormalizationNone = "none"
+	NormalizationNFC  = "nfc"
+	NormalizationNFD  = "nfd"
+)
+
+// ValidUnicodeNormalizations contains the accepted unicode_normalization values
+var ValidUnicodeNormalizations = []string{NormalizationNone, NormalizationNFC, NormalizationNFD}
+
 // ValidCompressionLevels defines the valid range for compression levels
 const (
 	MinCompressionLevel = 1
@@ -18,6 +18,49 @@ hash_algorithm: blake3
 # 1 = fastest, 9 = best compression
 compression_level: 6
 
+# Number of apply backups to keep in <dsp_dir>/backups
+backup_retention: 5
+
+# Retention of snapshots and bundles, enforced after each new snapshot or
+# bundle. 0 keeps everything.
+# keep_snapshots: 30
+# keep_bundles_days: 90
+
+# Size limit in MiB of the file contents kept in <data_dir>/objects at
+# snapshot time; the oldest are dropped first. -1 disables the store.
+# content_store_mb: 1024
+
+# Track new entries of the repository root at snapshot time, optionally only
+# those matching auto_track_include
+# auto_track: false
+# auto_track_include: ["data-*", "reports"]
+
+# Size and type policy for files in tracked directories; files it rejects are
+# left out of snapshots and reported
+# max_file_size: 500MB
+# skip_binary: false
+# only_extensions: [".csv", ".txt"]
+
+# Encrypt the file contents kept in <data_dir>/objects, the bundles in
+# <dsp_dir>/bundles, deferred bundle copies and apply backups with the local
+# age key (see 'dsp crypto init'), so a stolen disk does not leak their history.
+# Export, push and large bundle reads still need the plain archive: it is
+# decrypted to a hidden .tmp file next to the bundle and removed (wiped with
+# secure_delete) afterwards, so a crash can leave one behind until
+# 'dsp repo doctor' reports it
+# encrypt_at_rest: false
+
+# Snapshot the files and directories symlinks point to instead of recording
+# the links themselves
+# follow_symlinks: false
+
+# Paths of 260 characters or more on Windows: auto writes them with the \\?\
+# prefix, off reports them as path issues on apply
+# long_paths: auto
+
+# Unicode form applied to paths from bundles (none, nfc or nfd)
+# unicode_normalization: none
+
 # Enable signing for bundles
 signing_enabled: false
 
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Key derivation functions for password-protected exports
+const (
+	KDFScrypt   = "scrypt"
+	KDFArgon2id = "argon2id"
+)
+
+// ValidKDFs lists the key derivation functions exports can use
+var ValidKDFs = []string{KDFScrypt, KDFArgon2id}
+
+// EncryptionConfig holds the key derivation settings of password-protected
+// exports. Exporters record them in the export info, so importers need no
+// matching settings. Zero values use the defaults.
+type EncryptionConfig struct {
+	// KDF derives keys from passwords: scrypt (the default) or argon2id
+	KDF string `yaml:"kdf,omitempty"`
+	// ScryptWorkFactor is log2 of the scrypt cost (18 by default)
+	ScryptWorkFactor int `yaml:"scrypt_work_factor,omitempty"`
+	// Argon2Time is the number of Argon2id passes over memory
+	Argon2Time int `yaml:"argon2_time,omitempty"`
+	// Argon2MemoryMB is the memory Argon2id uses, in MiB
+	Argon2MemoryMB int `yaml:"argon2_memory_mb,omitempty"`
+	// Argon2Threads is the parallelism of Argon2id
+	Argon2Threads int `yaml:"argon2_threads,omitempty"`
+}
+
+// validate checks if the encryption configuration is valid. The limits on
+// work factors are checked by the crypto package when they are used.
+func (e *EncryptionConfig) validate() error {
+	if e.KDF != "" && e.KDF != KDFScrypt && e.KDF != KDFArgon2id {
+		return fmt.Errorf("invalid kdf: %s, must be one of: %s", e.KDF, strings.Join(ValidKDFs, ", "))
+	}
+	if e.ScryptWorkFactor < 0 || e.Argon2Time < 0 || e.Argon2MemoryMB < 0 {
+		return fmt.Errorf("invalid encryption work factor: must not be negative")
+	}
+	if e.Argon2Threads < 0 || e.Argon2Threads > 255 {
+		return fmt.Errorf("invalid argon2_threads: must be between 0 and 255")
+	}
+	return nil
+}
+
+// GetKDF returns the key derivation function of password-protected exports
+func (c *GlobalConfig) GetKDF() string {
+	if c.Encryption.KDF == "" {
+		return KDFScrypt
+	}
+	return c.Encryption.KDF
+}
@@ -0,0 +1,231 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// GlobalConfigFile is the configuration file in the global DSP directory
+const GlobalConfigFile = "config.yaml"
+
+// Trust policies for hosts met during a key exchange
+const (
+	// TrustPolicyManual parks new hosts as untrusted until 'dsp host trust'
+	TrustPolicyManual = "manual"
+	// TrustPolicyTOFU trusts new hosts on first use and refuses changed keys
+	TrustPolicyTOFU = "tofu"
+	// TrustPolicyOpen trusts every host, accepting changed keys
+	TrustPolicyOpen = "open"
+)
+
+// ValidTrustPolicies contains the supported trust policies
+var ValidTrustPolicies = []string{
+	TrustPolicyManual,
+	TrustPolicyTOFU,
+	TrustPolicyOpen,
+}
+
+// GlobalConfig holds settings shared by all repositories of a user
+type GlobalConfig struct {
+	// TrustPolicy decides whether hosts met during a key exchange are trusted
+	TrustPolicy string `yaml:"trust_policy,omitempty"`
+	// CertExpiryWarningDays is how long before a pinned certificate expires
+	// that export and import start warning about it
+	CertExpiryWarningDays int `yaml:"cert_expiry_warning_days,omitempty"`
+	// Network holds the ports and addresses export serves bundles on
+	Network NetworkConfig `yaml:"network,omitempty"`
+	// Encryption holds the key derivation settings of password-protected exports
+	Encryption EncryptionConfig `yaml:"encryption,omitempty"`
+	// UserName is recorded as the author of snapshots, bundles and applies
+	// instead of the account name
+	UserName string `yaml:"user_name,omitempty"`
+	// SecureDelete overwrites temporary files that held bundles before
+	// removing them
+	SecureDelete bool `yaml:"secure_delete,omitempty"`
+	// Notifications are the commands and webhooks told about snapshots,
+	// exports, applies and conflicts
+	Notifications []NotifyTarget `yaml:"notifications,omitempty"`
+}
+
+// GlobalDirEnv names the environment variable that overrides the global DSP
+// directory
+const GlobalDirEnv = "DSP_GLOBAL_DIR"
+
+// GlobalDir returns the global DSP directory: $DSP_GLOBAL_DIR if set,
+// otherwise the directory of the active profile (~/.dsp-global by default)
+func GlobalDir() (string, error) {
+	if dir := os.Getenv(GlobalDirEnv); dir != "" {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve %s: %w", GlobalDirEnv, err)
+		}
+		return absDir, nil
+	}
+
+	profile, err := ActiveProfile()
+	if err != nil {
+		return "", err
+	}
+	dir, err := ProfileDir(profile)
+	if err != nil {
+		return "", err
+	}
+
+	// Named profiles are created explicitly, never as a side effect
+	if profile != DefaultProfile {
+		if _, err := os.Stat(dir); err != nil {
+			return "", fmt.Errorf("profile %s does not exist; create it with 'dsp profile create %s'", profile, profile)
+		}
+	}
+	return dir, nil
+}
+
+// LoadGlobal loads the global configuration. A missing file uses defaults.
+func LoadGlobal() (*GlobalConfig, error) {
+	var cfg GlobalConfig
+
+	globalDir, err := GlobalDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(globalDir, GlobalConfigFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read global config: %w", err)
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse global config: %w", err)
+		}
+	}
+
+	// Override with environment variables if they exist
+	if envPolicy := os.Getenv("DSP_TRUST_POLICY"); envPolicy != "" {
+		cfg.TrustPolicy = envPolicy
+	}
+	if envDays := os.Getenv("DSP_CERT_EXPIRY_WARNING_DAYS"); envDays != "" {
+		days, err := strconv.Atoi(envDays)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DSP_CERT_EXPIRY_WARNING_DAYS: %w", err)
+		}
+		cfg.CertExpiryWarningDays = days
+	}
+	if envRange := os.Getenv("DSP_PORT_RANGE"); envRange != "" {
+		cfg.Network.PortRange = envRange
+	}
+	if envBind := os.Getenv("DSP_BIND_ADDRESS"); envBind != "" {
+		cfg.Network.BindAddress = envBind
+	}
+	if envHost := os.Getenv("DSP_EXTERNAL_HOST"); envHost != "" {
+		cfg.Network.ExternalHost = envHost
+	}
+	if envRetries := os.Getenv("DSP_NETWORK_RETRIES"); envRetries != "" {
+		retries, err := strconv.Atoi(envRetries)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DSP_NETWORK_RETRIES: %w", err)
+		}
+		cfg.Network.Retries = retries
+	}
+	if envDelay := os.Getenv("DSP_NETWORK_RETRY_DELAY"); envDelay != "" {
+		cfg.Network.RetryDelay = envDelay
+	}
+	if envConns := os.Getenv("DSP_MAX_CLIENT_CONNECTIONS"); envConns != "" {
+		conns, err := strconv.Atoi(envConns)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DSP_MAX_CLIENT_CONNECTIONS: %w", err)
+		}
+		cfg.Network.MaxClientConnections = conns
+	}
+	if envBanAfter := os.Getenv("DSP_BAN_AFTER"); envBanAfter != "" {
+		banAfter, err := strconv.Atoi(envBanAfter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DSP_BAN_AFTER: %w", err)
+		}
+		cfg.Network.BanAfter = banAfter
+	}
+	if envBan := os.Getenv("DSP_BAN_DURATION"); envBan != "" {
+		cfg.Network.BanDuration = envBan
+	}
+	if envUser := os.Getenv("DSP_USER_NAME"); envUser != "" {
+		cfg.UserName = envUser
+	}
+	if envSecure := os.Getenv("DSP_SECURE_DELETE"); envSecure != "" {
+		secure, err := strconv.ParseBool(envSecure)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DSP_SECURE_DELETE: %w", err)
+		}
+		cfg.SecureDelete = secure
+	}
+	if envKDF := os.Getenv("DSP_KDF"); envKDF != "" {
+		cfg.Encryption.KDF = envKDF
+	}
+	for _, env := range []struct {
+		name  string
+		value *int
+	}{
+		{"DSP_SCRYPT_WORK_FACTOR", &cfg.Encryption.ScryptWorkFactor},
+		{"DSP_ARGON2_TIME", &cfg.Encryption.Argon2Time},
+		{"DSP_ARGON2_MEMORY_MB", &cfg.Encryption.Argon2MemoryMB},
+		{"DSP_ARGON2_THREADS", &cfg.Encryption.Argon2Threads},
+	} {
+		if envValue := os.Getenv(env.name); envValue != "" {
+			value, err := strconv.Atoi(envValue)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", env.name, err)
+			}
+			*env.value = value
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid global configuration: %w", err)
+	}
+	return &cfg, nil
+}
+
+// validate checks if the global configuration is valid
+func (c *GlobalConfig) validate() error {
+	if c.CertExpiryWarningDays < 0 {
+		return fmt.Errorf("cert_expiry_warning_days must not be negative")
+	}
+	if err := c.Network.validate(); err != nil {
+		return err
+	}
+	if err := c.Encryption.validate(); err != nil {
+		return err
+	}
+	if err := c.validateNotifications(); err != nil {
+		return err
+	}
+	if c.TrustPolicy == "" {
+		return nil
+	}
+	for _, policy := range ValidTrustPolicies {
+		if c.TrustPolicy == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid trust policy: %s, must be one of: %s",
+		c.TrustPolicy, strings.Join(ValidTrustPolicies, ", "))
+}
+
+// GetTrustPolicy returns the trust policy
+func (c *GlobalConfig) GetTrustPolicy() string {
+	if c.TrustPolicy == "" {
+		return DefaultTrustPolicy
+	}
+	return c.TrustPolicy
+}
+
+// GetCertExpiryWarningDays returns how many days before expiry a pinned
+// certificate is warned about
+func (c *GlobalConfig) GetCertExpiryWarningDays() int {
+	if c.CertExpiryWarningDays == 0 {
+		return DefaultCertExpiryWarningDays
+	}
+	return c.CertExpiryWarningDays
+}
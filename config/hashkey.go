@@ -0,0 +1,84 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// HashKeyFileName holds the key of the blake3-keyed hash algorithm in the DSP
+// directory. Peers syncing the repository need the same key.
+const HashKeyFileName = "hash.key"
+
+// HashKeyPath returns the location of the hash key of a DSP directory
+func HashKeyPath(dspDir string) string {
+	return filepath.Join(dspDir, HashKeyFileName)
+}
+
+// LoadHashKey reads the hash key of a DSP directory, or returns nil if it
+// has none
+func LoadHashKey(dspDir string) ([]byte, error) {
+	data, err := os.ReadFile(HashKeyPath(dspDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hash key: %w", err)
+	}
+	key, err := ParseHashKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hash key in %s: %w", HashKeyPath(dspDir), err)
+	}
+	return key, nil
+}
+
+// ParseHashKey parses a hash key written in hex
+func ParseHashKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("not a hex string")
+	}
+	if len(key) != utils.HashKeySize {
+		return nil, fmt.Errorf("must be %d bytes (%d hex digits), not %d", utils.HashKeySize, 2*utils.HashKeySize, len(key))
+	}
+	return key, nil
+}
+
+// SaveHashKey writes the hash key of a DSP directory, readable only by the
+// owner, and uses it in this process
+func SaveHashKey(dspDir string, key []byte) error {
+	if err := utils.SetHashKey(key); err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(HashKeyPath(dspDir), []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to save hash key: %w", err)
+	}
+	return nil
+}
+
+// GenerateHashKey creates a random hash key for a DSP directory
+func GenerateHashKey(dspDir string) ([]byte, error) {
+	key := make([]byte, utils.HashKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate hash key: %w", err)
+	}
+	return key, SaveHashKey(dspDir, key)
+}
+
+// useHashKey makes the hash key of a DSP directory available to the keyed
+// hash algorithm. A missing key is reported when something is hashed.
+func useHashKey(dspDir string) {
+	key, err := LoadHashKey(dspDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		return
+	}
+	if key != nil {
+		utils.SetHashKey(key)
+	}
+}
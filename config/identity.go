@@ -0,0 +1,33 @@
+package config
+
+import (
+	"os"
+	"os/user"
+	"strings"
+)
+
+// UnknownUser is recorded when no user name can be determined
+const UnknownUser = "unknown"
+
+// CurrentUser returns the name recorded as the author of snapshots, bundles
+// and other changes: the user_name global setting (or DSP_USER_NAME), then
+// the account running the command, then the USER or USERNAME environment
+// variable. Windows account names are returned without their domain.
+func CurrentUser() string {
+	if global, err := LoadGlobal(); err == nil && global.UserName != "" {
+		return global.UserName
+	}
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		name := u.Username
+		if i := strings.LastIndex(name, `\`); i >= 0 {
+			name = name[i+1:]
+		}
+		return name
+	}
+	for _, env := range []string{"USER", "USERNAME"} {
+		if name := strings.TrimSpace(os.Getenv(env)); name != "" {
+			return name
+		}
+	}
+	return UnknownUser
+}
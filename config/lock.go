@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Locks on the stores in the global DSP directory
+const (
+	ReposLock  = "repos"  // repos.yaml
+	HostsLock  = "hosts"  // hosts/ and host groups
+	KeysLock   = "keys"   // keys/ and the local certificate
+	NotifyLock = "notify" // Queued notifications
+)
+
+// LockGlobal takes an exclusive lock on a store in the global DSP directory,
+// waiting while another process holds it. Locks are advisory: every process
+// that changes the store must take the same lock around its
+// read-modify-write. The returned function releases the lock.
+func LockGlobal(name string) (func(), error) {
+	globalDir, err := GlobalDir()
+	if err != nil {
+		return nil, err
+	}
+	locksDir := filepath.Join(globalDir, "locks")
+	if err := os.MkdirAll(locksDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create locks directory: %w", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(locksDir, name+".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s lock: %w", name, err)
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", name, err)
+	}
+
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
+
+// WriteFileAtomic writes a file through a temporary file and a rename, so
+// readers that do not take a lock never see a partly written file
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
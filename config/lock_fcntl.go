@@ -0,0 +1,30 @@
+//go:build aix || solaris
+
+package config
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile takes an exclusive fcntl lock on a file, blocking until it is
+// free. These platforms have no flock; fcntl locks belong to the process, so
+// they keep other dsp processes out of the store but not other goroutines
+// of this one.
+func lockFile(file *os.File) error {
+	lock := unix.Flock_t{Type: unix.F_WRLCK, Whence: io.SeekStart}
+	for {
+		err := unix.FcntlFlock(file.Fd(), unix.F_SETLKW, &lock)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+// unlockFile releases a lock taken by lockFile
+func unlockFile(file *os.File) error {
+	lock := unix.Flock_t{Type: unix.F_UNLCK, Whence: io.SeekStart}
+	return unix.FcntlFlock(file.Fd(), unix.F_SETLK, &lock)
+}
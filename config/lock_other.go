@@ -0,0 +1,16 @@
+//go:build !windows && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !zos && !aix && !solaris
+
+package config
+
+import "os"
+
+// lockFile does nothing on platforms without file locks; the lock file is
+// still created, but concurrent updates to the store are not serialized
+func lockFile(file *os.File) error {
+	return nil
+}
+
+// unlockFile releases a lock taken by lockFile
+func unlockFile(file *os.File) error {
+	return nil
+}
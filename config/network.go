@@ -0,0 +1,171 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NetworkConfig holds the settings export uses to serve bundles
+type NetworkConfig struct {
+	// PortRange is the range of ports export tries in order, such as "8080-8089"
+	PortRange string `yaml:"port_range,omitempty"`
+	// BindAddress is the address export listens on; empty listens on all interfaces
+	BindAddress string `yaml:"bind_address,omitempty"`
+	// ExternalHost is the host name importers are told to connect to, for
+	// exporters behind NAT or with several interfaces
+	ExternalHost string `yaml:"external_host,omitempty"`
+	// Retries is how often import retries a request that failed on the
+	// network; 0 uses the default and -1 disables retries
+	Retries int `yaml:"retries,omitempty"`
+	// RetryDelay is the wait before the first retry, such as "1s". It doubles
+	// after each attempt.
+	RetryDelay string `yaml:"retry_delay,omitempty"`
+	// MaxClientConnections caps the connections one client may hold open to
+	// export; 0 uses the default and -1 disables the cap
+	MaxClientConnections int `yaml:"max_client_connections,omitempty"`
+	// BanAfter is how many authentication failures in a row get a client
+	// banned from export; 0 uses the default and -1 disables bans
+	BanAfter int `yaml:"ban_after,omitempty"`
+	// BanDuration is how long a ban lasts, such as "1h"
+	BanDuration string `yaml:"ban_duration,omitempty"`
+}
+
+// ParsePortRange parses a port range such as "8080-8089". A single port is
+// a range of one.
+func ParsePortRange(s string) (first, last int, err error) {
+	firstStr, lastStr, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	if !isRange {
+		lastStr = firstStr
+	}
+
+	first, err = strconv.Atoi(strings.TrimSpace(firstStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %s is not a number", s, firstStr)
+	}
+	last, err = strconv.Atoi(strings.TrimSpace(lastStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %s is not a number", s, lastStr)
+	}
+	if first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("invalid port range %q: must be ascending ports between 1 and 65535", s)
+	}
+	return first, last, nil
+}
+
+// validate checks if the network configuration is valid
+func (n *NetworkConfig) validate() error {
+	if n.PortRange != "" {
+		if _, _, err := ParsePortRange(n.PortRange); err != nil {
+			return err
+		}
+	}
+	if n.BindAddress != "" && net.ParseIP(n.BindAddress) == nil {
+		return fmt.Errorf("invalid bind_address: %s is not an IP address", n.BindAddress)
+	}
+	if n.Retries < -1 {
+		return fmt.Errorf("invalid retries: must be -1 or more")
+	}
+	if n.RetryDelay != "" {
+		if delay, err := time.ParseDuration(n.RetryDelay); err != nil || delay <= 0 {
+			return fmt.Errorf("invalid retry_delay: %s is not a positive duration such as 2s", n.RetryDelay)
+		}
+	}
+	if n.MaxClientConnections < -1 {
+		return fmt.Errorf("invalid max_client_connections: must be -1 or more")
+	}
+	if n.BanAfter < -1 {
+		return fmt.Errorf("invalid ban_after: must be -1 or more")
+	}
+	if n.BanDuration != "" {
+		if ban, err := time.ParseDuration(n.BanDuration); err != nil || ban <= 0 {
+			return fmt.Errorf("invalid ban_duration: %s is not a positive duration such as 1h", n.BanDuration)
+		}
+	}
+	if strings.ContainsAny(n.ExternalHost, " /:") && net.ParseIP(n.ExternalHost) == nil {
+		return fmt.Errorf("invalid external_host: %s", n.ExternalHost)
+	}
+	return nil
+}
+
+// GetPortRange returns the first and last port export tries
+func (c *GlobalConfig) GetPortRange() (first, last int) {
+	if c.Network.PortRange != "" {
+		if first, last, err := ParsePortRange(c.Network.PortRange); err == nil {
+			return first, last
+		}
+	}
+	first, last, _ = ParsePortRange(DefaultPortRange)
+	return first, last
+}
+
+// GetDefaultPort returns the port importers connect to when an address has
+// no port: the first port of the range
+func (c *GlobalConfig) GetDefaultPort() int {
+	first, _ := c.GetPortRange()
+	return first
+}
+
+// GetBindAddress returns the address export listens on, empty for all interfaces
+func (c *GlobalConfig) GetBindAddress() string {
+	return c.Network.BindAddress
+}
+
+// GetExternalHost returns the host name advertised to importers, empty to
+// use the bind address or the machine's hostname
+func (c *GlobalConfig) GetExternalHost() string {
+	return c.Network.ExternalHost
+}
+
+// GetRetries returns how often a request that failed on the network is retried
+func (c *GlobalConfig) GetRetries() int {
+	switch {
+	case c.Network.Retries < 0:
+		return 0
+	case c.Network.Retries == 0:
+		return DefaultRetries
+	}
+	return c.Network.Retries
+}
+
+// GetRetryDelay returns the wait before the first retry
+func (c *GlobalConfig) GetRetryDelay() time.Duration {
+	if delay, err := time.ParseDuration(c.Network.RetryDelay); err == nil && delay > 0 {
+		return delay
+	}
+	return DefaultRetryDelay
+}
+
+// GetMaxClientConnections returns how many connections one client may hold
+// open to export, 0 for no cap
+func (c *GlobalConfig) GetMaxClientConnections() int {
+	switch {
+	case c.Network.MaxClientConnections < 0:
+		return 0
+	case c.Network.MaxClientConnections == 0:
+		return DefaultMaxClientConnections
+	}
+	return c.Network.MaxClientConnections
+}
+
+// GetBanAfter returns how many authentication failures in a row get a
+// client banned from export, 0 for no bans
+func (c *GlobalConfig) GetBanAfter() int {
+	switch {
+	case c.Network.BanAfter < 0:
+		return 0
+	case c.Network.BanAfter == 0:
+		return DefaultBanAfter
+	}
+	return c.Network.BanAfter
+}
+
+// GetBanDuration returns how long a client banned from export stays banned
+func (c *GlobalConfig) GetBanDuration() time.Duration {
+	if ban, err := time.ParseDuration(c.Network.BanDuration); err == nil && ban > 0 {
+		return ban
+	}
+	return DefaultBanDuration
+}
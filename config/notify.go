@@ -0,0 +1,124 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Events notification targets can be told about
+const (
+	EventSnapshotCreated  = "snapshot-created"
+	EventBundleExported   = "bundle-exported"
+	EventBundleApplied    = "bundle-applied"
+	EventConflictDetected = "conflict-detected"
+)
+
+// NotifyEvents lists the events notification targets can subscribe to
+var NotifyEvents = []string{
+	EventSnapshotCreated,
+	EventBundleExported,
+	EventBundleApplied,
+	EventConflictDetected,
+}
+
+// NotifyTarget is a command run or a webhook posted to when events happen.
+// Exactly one of Command and Webhook is set.
+type NotifyTarget struct {
+	Name    string   `yaml:"name"`
+	Command string   `yaml:"command,omitempty"` // Run through the shell with the event on stdin
+	Webhook string   `yaml:"webhook,omitempty"` // http(s) URL the event is posted to as JSON
+	Events  []string `yaml:"events,omitempty"`  // Events to notify about (empty for all)
+}
+
+// Wants reports whether the target subscribes to an event
+func (t *NotifyTarget) Wants(event string) bool {
+	if len(t.Events) == 0 {
+		return true
+	}
+	for _, e := range t.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks if a notification target is valid
+func (t *NotifyTarget) validate() error {
+	if strings.TrimSpace(t.Name) == "" {
+		return fmt.Errorf("notification target without a name")
+	}
+	if (t.Command == "") == (t.Webhook == "") {
+		return fmt.Errorf("notification target %s needs either a command or a webhook", t.Name)
+	}
+	if t.Webhook != "" {
+		u, err := url.Parse(t.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook of notification target %s: must be an http or https URL", t.Name)
+		}
+	}
+	for _, event := range t.Events {
+		valid := false
+		for _, e := range NotifyEvents {
+			valid = valid || e == event
+		}
+		if !valid {
+			return fmt.Errorf("invalid event %s of notification target %s, must be one of: %s",
+				event, t.Name, strings.Join(NotifyEvents, ", "))
+		}
+	}
+	return nil
+}
+
+// FindNotifyTarget returns the notification target with a name
+func (c *GlobalConfig) FindNotifyTarget(name string) (*NotifyTarget, bool) {
+	for i := range c.Notifications {
+		if c.Notifications[i].Name == name {
+			return &c.Notifications[i], true
+		}
+	}
+	return nil, false
+}
+
+// validateNotifications checks the notification targets and that their
+// names are unique
+func (c *GlobalConfig) validateNotifications() error {
+	names := make(map[string]bool)
+	for i := range c.Notifications {
+		target := &c.Notifications[i]
+		if err := target.validate(); err != nil {
+			return err
+		}
+		if names[target.Name] {
+			return fmt.Errorf("duplicate notification target %s", target.Name)
+		}
+		names[target.Name] = true
+	}
+	return nil
+}
+
+// AddNotifyTarget adds a notification target. The configuration is left
+// unchanged if the target is invalid or its name is taken.
+func (c *GlobalConfig) AddNotifyTarget(target NotifyTarget) error {
+	if _, exists := c.FindNotifyTarget(target.Name); exists {
+		return fmt.Errorf("notification target %s already exists", target.Name)
+	}
+	if err := target.validate(); err != nil {
+		return err
+	}
+	c.Notifications = append(c.Notifications, target)
+	return nil
+}
+
+// RemoveNotifyTarget removes the notification target with a name and
+// reports whether there was one
+func (c *GlobalConfig) RemoveNotifyTarget(name string) bool {
+	for i := range c.Notifications {
+		if c.Notifications[i].Name == name {
+			c.Notifications = append(c.Notifications[:i], c.Notifications[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
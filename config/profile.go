@@ -0,0 +1,153 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Profiles keep separate global directories, each with its own keys, hosts
+// and registered repositories. The default profile is ~/.dsp-global; named
+// profiles live in ~/.dsp-profiles/<name>.
+const (
+	// DefaultProfile names the profile that uses ~/.dsp-global
+	DefaultProfile = "default"
+	// ProfileEnv names the environment variable that selects a profile
+	ProfileEnv = "DSP_PROFILE"
+	// activeProfileFile records the profile chosen with 'dsp profile use'.
+	// Profile names cannot start with a dot, so it never clashes with one.
+	activeProfileFile = ".active"
+)
+
+// ProfilesDir returns the directory holding named profiles
+func ProfilesDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(home, ".dsp-profiles"), nil
+}
+
+// ProfileDir returns the global directory of a profile
+func ProfileDir(name string) (string, error) {
+	if err := validateProfileName(name); err != nil {
+		return "", err
+	}
+	if name == DefaultProfile {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get home directory: %w", err)
+		}
+		return filepath.Join(home, ".dsp-global"), nil
+	}
+
+	profilesDir, err := ProfilesDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(profilesDir, name), nil
+}
+
+// ActiveProfile returns the profile in use: $DSP_PROFILE if set, otherwise
+// the one chosen with 'dsp profile use', otherwise the default profile
+func ActiveProfile() (string, error) {
+	if name := os.Getenv(ProfileEnv); name != "" {
+		return name, nil
+	}
+
+	profilesDir, err := ProfilesDir()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(filepath.Join(profilesDir, activeProfileFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return DefaultProfile, nil
+		}
+		return "", fmt.Errorf("failed to read active profile: %w", err)
+	}
+	if name := strings.TrimSpace(string(data)); name != "" {
+		return name, nil
+	}
+	return DefaultProfile, nil
+}
+
+// UseProfile makes a profile the active one for later commands
+func UseProfile(name string) error {
+	dir, err := ProfileDir(name)
+	if err != nil {
+		return err
+	}
+	if name != DefaultProfile {
+		if _, err := os.Stat(dir); err != nil {
+			return fmt.Errorf("profile %s does not exist; create it with 'dsp profile create %s'", name, name)
+		}
+	}
+
+	profilesDir, err := ProfilesDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(profilesDir, 0755); err != nil {
+		return fmt.Errorf("failed to create profiles directory: %w", err)
+	}
+	if err := WriteFileAtomic(filepath.Join(profilesDir, activeProfileFile), []byte(name+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to save active profile: %w", err)
+	}
+	return nil
+}
+
+// CreateProfile creates an empty profile and returns its global directory
+func CreateProfile(name string) (string, error) {
+	if name == DefaultProfile {
+		return "", fmt.Errorf("the %s profile always exists", DefaultProfile)
+	}
+	dir, err := ProfileDir(name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return "", fmt.Errorf("profile %s already exists", name)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create profile directory: %w", err)
+	}
+	return dir, nil
+}
+
+// ListProfiles returns the default profile and all named profiles, sorted
+func ListProfiles() ([]string, error) {
+	profiles := []string{DefaultProfile}
+
+	profilesDir, err := ProfilesDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(profilesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return profiles, nil
+		}
+		return nil, fmt.Errorf("failed to read profiles directory: %w", err)
+	}
+
+	var named []string
+	for _, entry := range entries {
+		if entry.IsDir() && validateProfileName(entry.Name()) == nil && entry.Name() != DefaultProfile {
+			named = append(named, entry.Name())
+		}
+	}
+	sort.Strings(named)
+	return append(profiles, named...), nil
+}
+
+// validateProfileName checks that a profile name is safe to use as a
+// directory name
+func validateProfileName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid profile name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,374 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Setting is a configuration key that 'dsp config' can read and change
+type Setting struct {
+	Key         string
+	Description string
+	Env         string // Environment variable that overrides the setting
+	ReadOnly    bool   // Shown but not changeable
+}
+
+// RepoSettings are the keys of a repository configuration
+var RepoSettings = []Setting{
+	{Key: "dsp_dir", Description: "Name of the DSP metadata directory", ReadOnly: true},
+	{Key: "data_dir", Description: "Directory for DSP data, relative to the repository", Env: "DSP_DATA_DIR"},
+	{Key: "hash_algorithm", Description: "Algorithm for file hashing (blake3, blake3-keyed, sha256 or sha512)", Env: "DSP_HASH_ALGORITHM"},
+	{Key: "compression_level", Description: "Compression level for bundles (1-9)", Env: "DSP_COMPRESSION_LEVEL"},
+	{Key: "backup_retention", Description: "Number of apply backups to keep (0 uses the default)", Env: "DSP_BACKUP_RETENTION"},
+	{Key: "keep_snapshots", Description: "Number of snapshots to keep; older ones are removed after each snapshot (0 keeps all)", Env: "DSP_KEEP_SNAPSHOTS"},
+	{Key: "keep_bundles_days", Description: "Days to keep bundles; older ones are removed after each bundle (0 keeps all)", Env: "DSP_KEEP_BUNDLES_DAYS"},
+	{Key: "content_store_mb", Description: "Size limit in MiB of file contents kept at snapshot time (0 uses the default, -1 disables)", Env: "DSP_CONTENT_STORE_MB"},
+	{Key: "auto_track", Description: "Track new entries of the repository root at snapshot time (true or false)", Env: "DSP_AUTO_TRACK"},
+	{Key: "auto_track_include", Description: "Comma-separated patterns of root entries auto_track adds (empty for all not starting with a dot)"},
+	{Key: "max_file_size", Description: "Largest file kept from tracked directories, such as 500MB (empty for no limit)", Env: "DSP_MAX_FILE_SIZE"},
+	{Key: "skip_binary", Description: "Leave binary files in tracked directories out of snapshots (true or false)", Env: "DSP_SKIP_BINARY"},
+	{Key: "only_extensions", Description: "Comma-separated extensions of the files kept from tracked directories (empty keeps all)"},
+	{Key: "encrypt_at_rest", Description: "Encrypt stored file contents, bundles and apply backups with the local age key (true or false)", Env: "DSP_ENCRYPT_AT_REST"},
+	{Key: "follow_symlinks", Description: "Snapshot the files and directories symlinks point to instead of the links (true or false)", Env: "DSP_FOLLOW_SYMLINKS"},
+	{Key: "long_paths", Description: "Handling of paths of 260 characters or more on Windows (auto or off)", Env: "DSP_LONG_PATHS"},
+	{Key: "unicode_normalization", Description: "Unicode form applied to paths from bundles (none, nfc or nfd)", Env: "DSP_UNICODE_NORMALIZATION"},
+}
+
+// GlobalSettings are the keys of the global configuration
+var GlobalSettings = []Setting{
+	{Key: "trust_policy", Description: "Trust policy for hosts met during key exchange (manual, tofu or open)", Env: "DSP_TRUST_POLICY"},
+	{Key: "cert_expiry_warning_days", Description: "Days before a pinned certificate expires to start warning (0 uses the default)", Env: "DSP_CERT_EXPIRY_WARNING_DAYS"},
+	{Key: "network.port_range", Description: "Ports export tries in order, such as 8080-8089", Env: "DSP_PORT_RANGE"},
+	{Key: "network.bind_address", Description: "IP address export listens on (empty for all interfaces)", Env: "DSP_BIND_ADDRESS"},
+	{Key: "network.external_host", Description: "Host name importers are told to connect to (empty for the hostname)", Env: "DSP_EXTERNAL_HOST"},
+	{Key: "network.retries", Description: "Retries of import requests that fail on the network (0 uses the default, -1 disables)", Env: "DSP_NETWORK_RETRIES"},
+	{Key: "network.retry_delay", Description: "Wait before the first retry, doubled after each one, such as 1s (empty uses the default)", Env: "DSP_NETWORK_RETRY_DELAY"},
+	{Key: "network.max_client_connections", Description: "Connections one client may hold open to export (0 uses the default of 8, -1 disables)", Env: "DSP_MAX_CLIENT_CONNECTIONS"},
+	{Key: "network.ban_after", Description: "Authentication failures in a row that ban a client from export (0 uses the default of 20, -1 disables)", Env: "DSP_BAN_AFTER"},
+	{Key: "network.ban_duration", Description: "How long a client banned from export stays banned, such as 1h (empty uses the default)", Env: "DSP_BAN_DURATION"},
+	{Key: "user_name", Description: "Name recorded as the author of snapshots, bundles and applies (empty for the account name)", Env: "DSP_USER_NAME"},
+	{Key: "encryption.kdf", Description: "Key derivation for password-protected exports (scrypt or argon2id)", Env: "DSP_KDF"},
+	{Key: "encryption.scrypt_work_factor", Description: "log2 of the scrypt cost of password-protected exports (0 uses the default of 18)", Env: "DSP_SCRYPT_WORK_FACTOR"},
+	{Key: "encryption.argon2_time", Description: "Argon2id passes of password-protected exports (0 uses the default of 3)", Env: "DSP_ARGON2_TIME"},
+	{Key: "encryption.argon2_memory_mb", Description: "Argon2id memory in MiB of password-protected exports (0 uses the default of 64)", Env: "DSP_ARGON2_MEMORY_MB"},
+	{Key: "encryption.argon2_threads", Description: "Argon2id parallelism of password-protected exports (0 uses the default of 4)", Env: "DSP_ARGON2_THREADS"},
+	{Key: "secure_delete", Description: "Overwrite temporary files that held bundles before removing them (true or false)", Env: "DSP_SECURE_DELETE"},
+}
+
+// FindSetting looks up a key in a list of settings
+func FindSetting(settings []Setting, key string) (Setting, bool) {
+	for _, s := range settings {
+		if s.Key == key {
+			return s, true
+		}
+	}
+	return Setting{}, false
+}
+
+// LoadFile loads a repository configuration file as written, without
+// defaults or environment overrides, for editing
+func LoadFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	return &cfg, nil
+}
+
+// Get returns the value of a repository setting
+func (c *Config) Get(key string) (string, error) {
+	switch key {
+	case "dsp_dir":
+		return c.DSPDir, nil
+	case "data_dir":
+		return c.DataDir, nil
+	case "hash_algorithm":
+		return c.HashAlgorithm, nil
+	case "compression_level":
+		return strconv.Itoa(c.CompressionLevel), nil
+	case "backup_retention":
+		return strconv.Itoa(c.BackupRetention), nil
+	case "keep_snapshots":
+		return strconv.Itoa(c.KeepSnapshots), nil
+	case "keep_bundles_days":
+		return strconv.Itoa(c.KeepBundlesDays), nil
+	case "content_store_mb":
+		return strconv.Itoa(c.ContentStoreMB), nil
+	case "auto_track":
+		return strconv.FormatBool(c.AutoTrack), nil
+	case "auto_track_include":
+		return strings.Join(c.AutoTrackInclude, ","), nil
+	case "max_file_size":
+		return c.MaxFileSize, nil
+	case "skip_binary":
+		return strconv.FormatBool(c.SkipBinary), nil
+	case "only_extensions":
+		return strings.Join(c.OnlyExtensions, ","), nil
+	case "encrypt_at_rest":
+		return strconv.FormatBool(c.EncryptAtRest), nil
+	case "follow_symlinks":
+		return strconv.FormatBool(c.FollowSymlinks), nil
+	case "long_paths":
+		return c.LongPaths, nil
+	case "unicode_normalization":
+		return c.UnicodeNormalization, nil
+	}
+	return "", fmt.Errorf("unknown repository setting: %s", key)
+}
+
+// Set changes a repository setting. The configuration is left unchanged if
+// the new value is invalid.
+func (c *Config) Set(key, value string) error {
+	setting, ok := FindSetting(RepoSettings, key)
+	if !ok {
+		return fmt.Errorf("unknown repository setting: %s", key)
+	}
+	if setting.ReadOnly {
+		return fmt.Errorf("%s cannot be changed", key)
+	}
+
+	updated := *c
+	var err error
+	switch key {
+	case "data_dir":
+		if value == "" {
+			return fmt.Errorf("data_dir cannot be empty")
+		}
+		updated.DataDir = normalizePath(value)
+	case "hash_algorithm":
+		updated.HashAlgorithm = value
+	case "compression_level":
+		updated.CompressionLevel, err = strconv.Atoi(value)
+	case "backup_retention":
+		updated.BackupRetention, err = strconv.Atoi(value)
+	case "keep_snapshots":
+		updated.KeepSnapshots, err = strconv.Atoi(value)
+	case "keep_bundles_days":
+		updated.KeepBundlesDays, err = strconv.Atoi(value)
+	case "content_store_mb":
+		updated.ContentStoreMB, err = strconv.Atoi(value)
+	case "auto_track":
+		if updated.AutoTrack, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid value for %s: %s is not true or false", key, value)
+		}
+	case "auto_track_include":
+		updated.AutoTrackInclude = splitList(value)
+	case "max_file_size":
+		updated.MaxFileSize = strings.TrimSpace(value)
+	case "skip_binary":
+		if updated.SkipBinary, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid value for %s: %s is not true or false", key, value)
+		}
+	case "only_extensions":
+		updated.OnlyExtensions = splitList(value)
+	case "encrypt_at_rest":
+		if updated.EncryptAtRest, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid value for %s: %s is not true or false", key, value)
+		}
+	case "follow_symlinks":
+		if updated.FollowSymlinks, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid value for %s: %s is not true or false", key, value)
+		}
+	case "long_paths":
+		updated.LongPaths = value
+	case "unicode_normalization":
+		updated.UnicodeNormalization = value
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %s is not a number", key, value)
+	}
+	if err := updated.validate(); err != nil {
+		return err
+	}
+
+	*c = updated
+	return nil
+}
+
+// splitList splits a comma-separated setting value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// GlobalConfigPath returns the path of the global configuration file
+func GlobalConfigPath() (string, error) {
+	globalDir, err := GlobalDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(globalDir, GlobalConfigFile), nil
+}
+
+// LoadGlobalFile loads the global configuration file as written, without
+// environment overrides, for editing. A missing file is empty.
+func LoadGlobalFile() (*GlobalConfig, error) {
+	var cfg GlobalConfig
+
+	path, err := GlobalConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &cfg, nil
+		}
+		return nil, fmt.Errorf("failed to read global config: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse global config: %w", err)
+	}
+	return &cfg, nil
+}
+
+// Save writes the global configuration file
+func (c *GlobalConfig) Save() error {
+	path, err := GlobalConfigPath()
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to marshal global config: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create global directory: %w", err)
+	}
+	if err := WriteFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write global config: %w", err)
+	}
+	return nil
+}
+
+// Get returns the effective value of a global setting, including defaults
+func (c *GlobalConfig) Get(key string) (string, error) {
+	switch key {
+	case "trust_policy":
+		return c.GetTrustPolicy(), nil
+	case "cert_expiry_warning_days":
+		return strconv.Itoa(c.GetCertExpiryWarningDays()), nil
+	case "network.port_range":
+		first, last := c.GetPortRange()
+		return fmt.Sprintf("%d-%d", first, last), nil
+	case "network.bind_address":
+		return c.GetBindAddress(), nil
+	case "network.external_host":
+		return c.GetExternalHost(), nil
+	case "network.retries":
+		return strconv.Itoa(c.GetRetries()), nil
+	case "network.retry_delay":
+		return c.GetRetryDelay().String(), nil
+	case "network.max_client_connections":
+		return strconv.Itoa(c.GetMaxClientConnections()), nil
+	case "network.ban_after":
+		return strconv.Itoa(c.GetBanAfter()), nil
+	case "network.ban_duration":
+		return c.GetBanDuration().String(), nil
+	case "user_name":
+		return c.UserName, nil
+	case "secure_delete":
+		return strconv.FormatBool(c.SecureDelete), nil
+	case "encryption.kdf":
+		return c.GetKDF(), nil
+	case "encryption.scrypt_work_factor":
+		return strconv.Itoa(c.Encryption.ScryptWorkFactor), nil
+	case "encryption.argon2_time":
+		return strconv.Itoa(c.Encryption.Argon2Time), nil
+	case "encryption.argon2_memory_mb":
+		return strconv.Itoa(c.Encryption.Argon2MemoryMB), nil
+	case "encryption.argon2_threads":
+		return strconv.Itoa(c.Encryption.Argon2Threads), nil
+	}
+	return "", fmt.Errorf("unknown global setting: %s", key)
+}
+
+// Set changes a global setting. The configuration is left unchanged if the
+// new value is invalid.
+func (c *GlobalConfig) Set(key, value string) error {
+	updated := *c
+	switch key {
+	case "trust_policy":
+		updated.TrustPolicy = value
+	case "cert_expiry_warning_days":
+		days, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s is not a number", key, value)
+		}
+		updated.CertExpiryWarningDays = days
+	case "network.port_range":
+		updated.Network.PortRange = value
+	case "network.bind_address":
+		updated.Network.BindAddress = value
+	case "network.external_host":
+		updated.Network.ExternalHost = value
+	case "network.retries":
+		retries, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s is not a number", key, value)
+		}
+		updated.Network.Retries = retries
+	case "network.retry_delay":
+		updated.Network.RetryDelay = value
+	case "network.max_client_connections", "network.ban_after":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s is not a number", key, value)
+		}
+		switch key {
+		case "network.max_client_connections":
+			updated.Network.MaxClientConnections = n
+		case "network.ban_after":
+			updated.Network.BanAfter = n
+		}
+	case "network.ban_duration":
+		updated.Network.BanDuration = value
+	case "user_name":
+		updated.UserName = strings.TrimSpace(value)
+	case "secure_delete":
+		secure, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s is not true or false", key, value)
+		}
+		updated.SecureDelete = secure
+	case "encryption.kdf":
+		updated.Encryption.KDF = strings.TrimSpace(value)
+	case "encryption.scrypt_work_factor", "encryption.argon2_time", "encryption.argon2_memory_mb", "encryption.argon2_threads":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s is not a number", key, value)
+		}
+		switch key {
+		case "encryption.scrypt_work_factor":
+			updated.Encryption.ScryptWorkFactor = n
+		case "encryption.argon2_time":
+			updated.Encryption.Argon2Time = n
+		case "encryption.argon2_memory_mb":
+			updated.Encryption.Argon2MemoryMB = n
+		case "encryption.argon2_threads":
+			updated.Encryption.Argon2Threads = n
+		}
+	default:
+		return fmt.Errorf("unknown global setting: %s", key)
+	}
+	if err := updated.validate(); err != nil {
+		return err
+	}
+
+	*c = updated
+	return nil
+}
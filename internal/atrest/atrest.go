@@ -0,0 +1,270 @@
+// Package atrest encrypts the repository files that hold file contents
+// outside the content store: bundles under <dsp_dir>/bundles, the bundle
+// copies kept for deferred changes and the originals apply backs up. With
+// encrypt_at_rest they are encrypted with the local age key, as the content
+// store encrypts its objects (see internal/objects).
+//
+// Sealed and plain files are told apart by their header, so a repository can
+// hold both while the setting changes. Readers go through Open or Plain and
+// never need to know which kind a file is. A sealed file can only be read
+// back on the host holding the age key that sealed it.
+package atrest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// ageHeader starts every binary age-encrypted file
+const ageHeader = "age-encryption.org/v1\n"
+
+// IsSealed reports whether the file at path is encrypted
+func IsSealed(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(ageHeader))
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return crypto.IsEncrypted(header[:n]), nil
+}
+
+// CheckKey checks that the local age key is available for sealing
+func CheckKey() error {
+	keys, err := crypto.NewKeyManager()
+	if err != nil {
+		return err
+	}
+	if _, err := keys.GetPublicKey(); err != nil {
+		return fmt.Errorf("encrypt_at_rest needs the local age key (run 'dsp crypto init'): %w", err)
+	}
+	return nil
+}
+
+// Seal encrypts the file at path in place. A file already sealed is left
+// alone.
+func Seal(path string) error {
+	sealed, err := IsSealed(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if sealed {
+		return nil
+	}
+
+	tmp := path + ".sealing"
+	if err := SealCopy(path, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
+
+// SealCopy writes a copy of the file src encrypted with the local age key to
+// dst
+func SealCopy(src, dst string) error {
+	keys, err := crypto.NewKeyManager()
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	buffered := bufio.NewWriter(out)
+	encrypted, err := keys.EncryptStreamForSelf(buffered)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := utils.CopyBuffered(encrypted, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to encrypt %s: %w", src, err)
+	}
+	if err := encrypted.Close(); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to finalize encryption: %w", err)
+	}
+	if err := buffered.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// OpenSealed opens a file known to be sealed, decrypting it
+func OpenSealed(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := crypto.NewKeyManager()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	decrypted, err := keys.DecryptStreamWithPrivateKey(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to decrypt %s: %w", path, err)
+	}
+	return &decrypter{Reader: decrypted, file: f}, nil
+}
+
+// decrypter closes the sealed file under a decrypting reader
+type decrypter struct {
+	io.Reader
+	file *os.File
+}
+
+func (d *decrypter) Close() error {
+	return d.file.Close()
+}
+
+// Open opens the file at path for reading, decrypting it if it is sealed.
+// Whether it is sealed is told by its header, which suits bundles; files
+// whose plain contents may themselves be age-encrypted use OpenSealed.
+func Open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(ageHeader))
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !crypto.IsEncrypted(header[:n]) {
+		return f, nil
+	}
+	f.Close()
+	return OpenSealed(path)
+}
+
+// ReadFile reads the file at path, decrypting it if it is sealed
+func ReadFile(path string) ([]byte, error) {
+	r, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var buf bytes.Buffer
+	if _, err := utils.CopyBuffered(&buf, r); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// CopyPlain writes the contents of src to dst, decrypting them if src is
+// sealed
+func CopyPlain(src, dst string) error {
+	in, err := Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return utils.WriteFileFrom(dst, in, 0600)
+}
+
+// UnsealCopy writes the decrypted contents of the sealed file src to dst
+func UnsealCopy(src, dst string) error {
+	in, err := OpenSealed(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return utils.WriteFileFrom(dst, in, 0600)
+}
+
+// Plain returns a path holding the plain contents of the file at path, for
+// callers that hash, serve or upload the file as it is. A plain file is
+// returned as it is; a sealed one is decrypted to a hidden temporary file
+// next to it, which cleanup removes, wiping it first if wipe is set. The
+// copy stays inside the DSP directory rather than the system temporary
+// directory, but it is on disk until cleanup runs: a crash leaves it
+// behind, and 'dsp repo doctor' reports it.
+func Plain(path string, wipe bool) (string, func(), error) {
+	sealed, err := IsSealed(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if !sealed {
+		return path, func() {}, nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".plain-*.tmp")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	cleanup := func() { utils.RemoveTemp(tmpPath, wipe) }
+	if err := CopyPlain(path, tmpPath); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to decrypt %s: %w", path, err)
+	}
+	return tmpPath, cleanup, nil
+}
+
+// SealGlob seals the plain files matching pattern with seal and returns the
+// number of files sealed. Files are told to be plain by their header, so the
+// pattern must only match files whose plain contents are never age-encrypted.
+func SealGlob(pattern string, seal func(path string) error) (int, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return 0, err
+	}
+
+	sealed := 0
+	for _, path := range matches {
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		already, err := IsSealed(path)
+		if err != nil {
+			return sealed, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if already {
+			continue
+		}
+		if err := seal(path); err != nil {
+			return sealed, err
+		}
+		sealed++
+	}
+	return sealed, nil
+}
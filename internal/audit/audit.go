@@ -0,0 +1,191 @@
+// Package audit keeps an append-only log of security-relevant events, such
+// as key exchanges, trust changes and failed authentications, in the audit
+// directory of the global DSP directory.
+//
+// Events are JSON lines in one file per month (audit-2006-01.log). Files are
+// only ever appended to; nothing in DSP rewrites or rotates them.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+)
+
+// Dir is the audit directory in the global DSP directory
+const Dir = "audit"
+
+// Event types
+const (
+	KeyExchange       = "key-exchange"
+	TrustChange       = "trust-change"
+	AuthFailure       = "auth-failure"
+	ClientBanned      = "client-banned"
+	ConnectionLimit   = "connection-limit"
+	TokenIssued       = "token-issued"
+	SignatureVerified = "signature-verified"
+	SignatureRejected = "signature-rejected"
+	Apply             = "apply"
+	RepoLifecycle     = "repo-lifecycle"
+	CertRotation      = "cert-rotation"
+)
+
+// EventTypes lists the event types in the order they are documented
+var EventTypes = []string{
+	KeyExchange,
+	TrustChange,
+	AuthFailure,
+	ClientBanned,
+	ConnectionLimit,
+	TokenIssued,
+	SignatureVerified,
+	SignatureRejected,
+	Apply,
+	RepoLifecycle,
+	CertRotation,
+}
+
+// Event is an entry of the audit log
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	User    string    `json:"user,omitempty"`    // Local user running the command
+	Subject string    `json:"subject,omitempty"` // Host, bundle or file concerned
+	Outcome string    `json:"outcome,omitempty"` // Such as trusted, refused or applied
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// fileLayout is the name of the log file of a month
+const fileLayout = "audit-2006-01.log"
+
+// mu serializes writes from one process; O_APPEND keeps lines of concurrent
+// processes whole
+var mu sync.Mutex
+
+// Record appends an event to the audit log, filling in the time and user.
+// Auditing never fails the operation being audited; a failure to record is
+// reported on stderr.
+func Record(e Event) {
+	if err := record(e); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record audit event %s: %v\n", e.Type, err)
+	}
+}
+
+func record(e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	if e.User == "" {
+		e.User = config.CurrentUser()
+	}
+
+	globalDir, err := config.GlobalDir()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(globalDir, Dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create audit directory: %w", err)
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(dir, e.Time.Format(fileLayout)), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return f.Close()
+}
+
+// Read returns the events recorded at or after since, oldest first
+func Read(since time.Time) ([]Event, error) {
+	globalDir, err := config.GlobalDir()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(globalDir, Dir)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read audit directory: %w", err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		month, err := time.Parse(fileLayout, entry.Name())
+		if err != nil {
+			continue
+		}
+		// Skip months that ended before since
+		if !since.IsZero() && month.AddDate(0, 1, 0).Before(since) {
+			continue
+		}
+		files = append(files, entry.Name())
+	}
+	sort.Strings(files)
+
+	var events []Event
+	for _, name := range files {
+		fileEvents, err := readFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range fileEvents {
+			if !e.Time.Before(since) {
+				events = append(events, e)
+			}
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events, nil
+}
+
+// readFile reads the events of one log file. Lines that cannot be parsed,
+// such as one cut short by a crash, are skipped with a warning.
+func readFile(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipped unreadable line %d of %s\n", lineNo, filepath.Base(path))
+			continue
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return events, nil
+}
@@ -1,19 +1,60 @@
 package bundle
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/chunk"
+	"github.com/Mattddixo/dsp/internal/ledger"
+	"github.com/Mattddixo/dsp/internal/migrations"
+	"github.com/Mattddixo/dsp/internal/objects"
+	"github.com/Mattddixo/dsp/internal/protocol"
 	"github.com/Mattddixo/dsp/internal/snapshot"
 	"github.com/Mattddixo/dsp/pkg/utils"
 )
 
+// FormatVersion is the current bundle archive format. Version 2 stores each
+// file's compressed content as its own uncompressed zip entry and records a
+// content index in the metadata, so single files can be read without
+// extracting the whole archive.
+const FormatVersion = migrations.BundleVersion
+
+// CheckFormat returns an error if the bundle was written in a format newer
+// than this build of DSP understands
+func (b *Bundle) CheckFormat() error {
+	return migrations.Bundle.Check(b.Format, b.ID)
+}
+
+// Archive entry names
+const (
+	MetadataEntry = "metadata.json"
+	ContentsDir   = "contents"
+)
+
+// MaxBaseSize is the largest file whose base version is included in a bundle
+// for three-way merging on apply
+const MaxBaseSize = 1 << 20
+
+// IndexEntry locates the content of a file inside the bundle archive
+type IndexEntry struct {
+	Entry      string `json:"entry"`       // Zip entry name
+	StoredSize int64  `json:"stored_size"` // Compressed size in the archive
+}
+
 // Bundle represents a bundle of changes
 type Bundle struct {
+	// Archive format version (0 for bundles created before versioning)
+	Format int `json:"format,omitempty"`
+
 	// Metadata about the bundle
 	ID          string    `json:"id"`
 	CreatedAt   time.Time `json:"created_at"`
@@ -25,6 +66,10 @@ type Bundle struct {
 	SourceSnapshot string `json:"source_snapshot,omitempty"` // Optional for initial bundles
 	TargetSnapshot string `json:"target_snapshot"`
 
+	// Root digest of the target snapshot's tree, which proofs that files
+	// are part of the target snapshot are checked against
+	TargetTree string `json:"target_tree,omitempty"`
+
 	// Repository information
 	Repository struct {
 		// Basic repository info
@@ -42,11 +87,53 @@ type Bundle struct {
 		TrackingConfig *snapshot.TrackingConfig `json:"tracking_config"`
 	} `json:"repository"`
 
+	// Lineage of the sending repository when the bundle was created
+	Lineage *ledger.Lineage `json:"lineage,omitempty"`
+
+	// Paths the bundle was restricted to; empty for full bundles
+	SelectedPaths []string `json:"selected_paths,omitempty"`
+
+	// Files left out of the bundle by redaction patterns; nil if none were
+	// given
+	Redacted *Redaction `json:"redacted,omitempty"`
+
+	// Whether directory changes are recorded. Bundles made from snapshots
+	// that do not record directories have emptied directories removed on apply.
+	RecordsDirs bool `json:"records_dirs,omitempty"`
+
 	// Changes in this bundle
 	Changes []Change `json:"changes"`
 
+	// Content index mapping file paths to archive entries
+	Index map[string]IndexEntry `json:"index,omitempty"`
+
+	// Chunk index mapping chunk hashes to archive entries
+	ChunkIndex map[string]IndexEntry `json:"chunk_index,omitempty"`
+
+	// Hashes of the file versions and chunks a delta bundle leaves out
+	// because the receiver already has them. Empty for complete bundles.
+	Omitted []string `json:"omitted,omitempty"`
+
+	// Set on partial bundles salvaged from a damaged archive
+	Repaired *RepairInfo `json:"repaired,omitempty"`
+
 	// File contents for new and modified files
 	FileContents map[string][]byte `json:"-"` // Not serialized to JSON
+
+	// Source snapshot contents of modified text files, used as merge base
+	BaseContents map[string][]byte `json:"-"` // Not serialized to JSON
+
+	// Compressed chunks of modified large files, by chunk hash
+	ChunkContents map[string][]byte `json:"-"` // Not serialized to JSON
+
+	// Contents kept at snapshot time, read in preference to the working tree
+	objects *objects.Store
+
+	// Compressed contents read from the working tree, spooled to a temporary
+	// file in spoolDir until the bundle is saved
+	spoolDir string
+	spool    *os.File
+	spooled  map[string]spoolEntry
 }
 
 // Change represents a single change in the bundle
@@ -59,10 +146,39 @@ type Change struct {
 	IsSymlink     bool      `json:"is_symlink"`
 	SymlinkTarget string    `json:"symlink_target,omitempty"`
 	ContentHash   string    `json:"content_hash,omitempty"` // Hash of the file content in the bundle
+
+	// Hard link and sparse file metadata from the snapshot. Hard links also
+	// carry their content, which is used if the linked file is not in place.
+	LinkTo string `json:"link_to,omitempty"`
+	Sparse bool   `json:"sparse,omitempty"`
+
+	// Modified large files carry the chunks of the new version instead of
+	// content. Chunks not in the bundle are read from the local file, which
+	// holds the base version.
+	Chunks     []chunk.Chunk `json:"chunks,omitempty"`
+	BaseChunks []chunk.Chunk `json:"base_chunks,omitempty"`
+
+	// Directory changes carry no content; modify changes the mode
+	IsDir bool        `json:"is_dir,omitempty"`
+	Mode  os.FileMode `json:"mode,omitempty"`
+
+	// Source snapshot version of modified files
+	BaseHash        string `json:"base_hash,omitempty"`         // File hash in the source snapshot
+	BaseContentHash string `json:"base_content_hash,omitempty"` // Hash of the base content in the bundle, if included
 }
 
 // New creates a new bundle from the given snapshots
-func New(sourceSnapshot, targetSnapshot string) (*Bundle, error) {
+func New(ctx context.Context, sourceSnapshot, targetSnapshot string) (*Bundle, error) {
+	return NewForPaths(ctx, sourceSnapshot, targetSnapshot, nil, nil)
+}
+
+// NewForPaths creates a new bundle from the given snapshots, restricted to
+// changes at or below the given absolute paths. An empty list includes all
+// changes. Files matching a redaction pattern are left out, their contents
+// never read, and the redaction is recorded in the bundle. It stops with the
+// context's error if ctx is cancelled. Close the bundle once it is saved to
+// remove the contents spooled for it.
+func NewForPaths(ctx context.Context, sourceSnapshot, targetSnapshot string, paths, redact []string) (_ *Bundle, err error) {
 	// Generate bundle ID (timestamp-based)
 	bundleID := time.Now().Format("20060102150405")
 
@@ -74,27 +190,59 @@ func New(sourceSnapshot, targetSnapshot string) (*Bundle, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to load target snapshot: %w", err)
 	}
+	targetTree := target.Root()
+	target.Files = filterFiles(target.Files, paths)
+	target.Dirs = filterDirs(target.Dirs, paths)
 
-	// Get repository information
-	repoPath := filepath.Dir(filepath.Dir(targetSnapshot)) // Go up two levels from snapshot to repo root
-	cfg, err := config.NewWithRepo(repoPath, "")
+	// Get repository information from <repo>/<dsp-dir>/snapshots/<id>/snapshot.json
+	dspDir := filepath.Dir(filepath.Dir(filepath.Dir(targetSnapshot)))
+	repoPath := filepath.Dir(dspDir)
+
+	// Leave out redacted files before any content is read
+	var redacted *Redaction
+	if len(redact) > 0 {
+		for _, pattern := range redact {
+			if err := utils.ValidatePathPattern(pattern); err != nil {
+				return nil, fmt.Errorf("invalid redaction: %w", err)
+			}
+		}
+		var left []string
+		target.Files, left = redactFiles(target.Files, repoPath, redact)
+		target.Dirs = redactDirs(target.Dirs, repoPath, redact)
+		redacted = &Redaction{Patterns: redact, Files: len(left)}
+	}
+	cfg, err := config.NewWithRepo(repoPath, filepath.Base(dspDir))
 	if err != nil {
 		return nil, fmt.Errorf("failed to load repository config: %w", err)
 	}
 
 	// Create bundle
 	bundle := &Bundle{
+		Format:         FormatVersion,
 		ID:             bundleID,
 		CreatedAt:      time.Now(),
-		CreatedBy:      os.Getenv("USERNAME"),
+		CreatedBy:      config.CurrentUser(),
 		IsInitial:      isInitial,
-		TargetSnapshot: filepath.Base(targetSnapshot),
+		TargetSnapshot: snapshotID(targetSnapshot),
+		TargetTree:     targetTree,
+		SelectedPaths:  paths,
+		Redacted:       redacted,
+		RecordsDirs:    target.RecordsDirs(),
 		FileContents:   make(map[string][]byte),
+		BaseContents:   make(map[string][]byte),
+		ChunkContents:  make(map[string][]byte),
+		objects:        objects.ForRepo(repoPath, cfg),
+		spoolDir:       dspDir,
 	}
+	defer func() {
+		if err != nil {
+			bundle.Close()
+		}
+	}()
 
 	// Set source snapshot if not initial
 	if !isInitial {
-		bundle.SourceSnapshot = filepath.Base(sourceSnapshot)
+		bundle.SourceSnapshot = snapshotID(sourceSnapshot)
 	}
 
 	// Set repository information
@@ -105,23 +253,19 @@ func New(sourceSnapshot, targetSnapshot string) (*Bundle, error) {
 	bundle.Repository.Config.CompressionLevel = cfg.CompressionLevel
 
 	// Load tracking configuration
-	trackingConfig, err := snapshot.LoadTrackingConfig(filepath.Join(repoPath, cfg.DSPDir))
+	trackingConfig, err := snapshot.LoadTrackingConfig(dspDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load tracking config: %w", err)
 	}
-	bundle.Repository.TrackingConfig = trackingConfig
+	bundle.Repository.TrackingConfig = selectTrackedPaths(trackingConfig, paths)
 
 	// For initial bundle, treat all files as additions
 	if isInitial {
 		for _, f := range target.Files {
-			// Read and compress file content
-			content, err := readAndCompressFile(f.Path, cfg.CompressionLevel)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read file %s: %w", f.Path, err)
+			if err := ctx.Err(); err != nil {
+				return nil, err
 			}
-
-			// Add to bundle
-			bundle.Changes = append(bundle.Changes, Change{
+			change := Change{
 				Path:          f.Path,
 				Type:          "add",
 				Hash:          f.Hash,
@@ -129,10 +273,17 @@ func New(sourceSnapshot, targetSnapshot string) (*Bundle, error) {
 				ModifiedTime:  f.ModifiedTime,
 				IsSymlink:     f.IsSymlink,
 				SymlinkTarget: f.SymlinkTarget,
-				ContentHash:   utils.HashBytes(content),
-			})
-			bundle.FileContents[f.Path] = content
+				LinkTo:        f.LinkTo,
+				Sparse:        f.Sparse,
+			}
+
+			// Read and compress file content
+			if err := bundle.addContent(&change, cfg.CompressionLevel); err != nil {
+				return nil, fmt.Errorf("failed to read file %s: %w", f.Path, err)
+			}
+			bundle.Changes = append(bundle.Changes, change)
 		}
+		bundle.Changes = append(bundle.Changes, dirChanges(nil, target.Dirs)...)
 		return bundle, nil
 	}
 
@@ -141,34 +292,139 @@ func New(sourceSnapshot, targetSnapshot string) (*Bundle, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to load source snapshot: %w", err)
 	}
+	source.Files = filterFiles(source.Files, paths)
+	source.Dirs = filterDirs(source.Dirs, paths)
+	if redacted != nil {
+		source.Files, _ = redactFiles(source.Files, repoPath, redact)
+		source.Dirs = redactDirs(source.Dirs, repoPath, redact)
+	}
 
-	// Compute changes between snapshots
-	if err := bundle.computeChanges(source, target, cfg.CompressionLevel); err != nil {
+	// Compute changes between snapshots. Base versions of modified files are
+	// taken from earlier bundles of this repository where available.
+	store := NewContentStore(cfg.HashAlgorithm, filepath.Join(dspDir, "bundles"))
+	store.UseObjects(bundle.objects)
+	defer store.Close()
+	if err := bundle.computeChanges(ctx, source, target, cfg, store); err != nil {
 		return nil, fmt.Errorf("failed to compute changes: %w", err)
 	}
 
 	return bundle, nil
 }
 
-// readAndCompressFile reads and compresses a file
-func readAndCompressFile(path string, compressionLevel int) ([]byte, error) {
-	// Read file
-	content, err := os.ReadFile(path)
+// snapshotID returns the snapshot ID (directory name) for a snapshot file path
+func snapshotID(snapshotPath string) string {
+	return filepath.Base(filepath.Dir(snapshotPath))
+}
+
+// spoolEntry locates the compressed content of a file in the spool
+type spoolEntry struct {
+	offset int64
+	size   int64
+}
+
+// spoolFile compresses a file from the working tree onto the end of the
+// spool, hashing it in the same pass, so the bundle never holds the content
+// in memory. It fails if the file no longer has the hash of the change.
+func (b *Bundle) spoolFile(change *Change, compressionLevel int) error {
+	file, err := os.Open(change.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	defer file.Close()
+
+	if b.spool == nil {
+		b.spool, err = os.CreateTemp(b.spoolDir, ".bundle-*.tmp")
+		if err != nil {
+			return fmt.Errorf("failed to create spool file: %w", err)
+		}
+		b.spooled = make(map[string]spoolEntry)
+	}
+	offset, err := b.spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to write spool file: %w", err)
+	}
+	content, err := utils.CompressStream(b.spool, file, compressionLevel, b.Repository.Config.HashAlgorithm)
+	if err != nil {
+		return err
+	}
+	if content.Hash != change.Hash {
+		return fmt.Errorf("file changed since the snapshot was taken; take a new snapshot first")
+	}
+	change.ContentHash = content.CompressedHash
+	b.spooled[change.Path] = spoolEntry{offset: offset, size: content.CompressedSize}
+	return nil
+}
+
+// Close removes the temporary file holding the contents of a new bundle.
+// The bundle cannot be saved afterwards.
+func (b *Bundle) Close() error {
+	if b.spool == nil {
+		return nil
+	}
+	b.spool.Close()
+	err := os.Remove(b.spool.Name())
+	b.spool, b.spooled = nil, nil
+	return err
+}
+
+// addContent compresses the content of a new or modified file into the
+// bundle. Symlinks carry no content; apply recreates them from their target.
+func (b *Bundle) addContent(change *Change, compressionLevel int) error {
+	if change.IsSymlink {
+		return nil
+	}
+
+	// Prefer the content kept when the file was snapshotted, which matches
+	// the snapshot even if the working tree has changed since
+	if b.objects != nil {
+		if content, err := b.objects.GetRaw(change.Hash); err == nil {
+			change.ContentHash = utils.HashBytes(content)
+			b.FileContents[change.Path] = content
+			return nil
+		}
+	}
+
+	return b.spoolFile(change, compressionLevel)
+}
+
+// addChunks splits a modified large file into chunks and adds those not in
+// its base version to the bundle
+func (b *Bundle) addChunks(change *Change, base []chunk.Chunk, cfg *config.Config) error {
+	known := make(map[string]bool, len(base))
+	for _, c := range base {
+		known[c.Hash] = true
+	}
+
+	file, err := os.Open(change.Path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
+		return fmt.Errorf("failed to read file: %w", err)
 	}
+	defer file.Close()
 
-	// Compress content
-	compressed, err := utils.Compress(content, compressionLevel)
+	chunks, err := chunk.Split(file, cfg.HashAlgorithm, func(c chunk.Chunk, data []byte) error {
+		if known[c.Hash] || b.ChunkContents[c.Hash] != nil {
+			return nil
+		}
+		compressed, err := utils.Compress(data, cfg.CompressionLevel)
+		if err != nil {
+			return fmt.Errorf("failed to compress chunk: %w", err)
+		}
+		b.ChunkContents[c.Hash] = compressed
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to compress file: %w", err)
+		return err
 	}
 
-	return compressed, nil
+	change.Chunks = chunks
+	change.BaseChunks = base
+	return nil
 }
 
 // computeChanges computes the changes between two snapshots
-func (b *Bundle) computeChanges(source, target *snapshot.Snapshot, compressionLevel int) error {
+func (b *Bundle) computeChanges(ctx context.Context, source, target *snapshot.Snapshot, cfg *config.Config, store *ContentStore) error {
+	compressionLevel := cfg.CompressionLevel
+
 	// Create maps for quick lookup
 	sourceFiles := make(map[string]snapshot.File)
 	targetFiles := make(map[string]snapshot.File)
@@ -180,18 +436,16 @@ func (b *Bundle) computeChanges(source, target *snapshot.Snapshot, compressionLe
 
 	// Add target files to map and compute changes
 	for _, f := range target.Files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		targetFiles[f.Path] = f
 
 		// Check if file exists in source
 		sourceFile, exists := sourceFiles[f.Path]
 		if !exists {
 			// File was added, read and compress content
-			content, err := readAndCompressFile(f.Path, compressionLevel)
-			if err != nil {
-				return fmt.Errorf("failed to read new file %s: %w", f.Path, err)
-			}
-
-			b.Changes = append(b.Changes, Change{
+			change := Change{
 				Path:          f.Path,
 				Type:          "add",
 				Hash:          f.Hash,
@@ -199,21 +453,20 @@ func (b *Bundle) computeChanges(source, target *snapshot.Snapshot, compressionLe
 				ModifiedTime:  f.ModifiedTime,
 				IsSymlink:     f.IsSymlink,
 				SymlinkTarget: f.SymlinkTarget,
-				ContentHash:   utils.HashBytes(content),
-			})
-			b.FileContents[f.Path] = content
+				LinkTo:        f.LinkTo,
+				Sparse:        f.Sparse,
+			}
+			if err := b.addContent(&change, compressionLevel); err != nil {
+				return fmt.Errorf("failed to read new file %s: %w", f.Path, err)
+			}
+			b.Changes = append(b.Changes, change)
 			continue
 		}
 
 		// File exists in both, check if modified
-		if sourceFile.Hash != f.Hash {
+		if !snapshot.SameContent(sourceFile, f) {
 			// File was modified, read and compress new content
-			content, err := readAndCompressFile(f.Path, compressionLevel)
-			if err != nil {
-				return fmt.Errorf("failed to read modified file %s: %w", f.Path, err)
-			}
-
-			b.Changes = append(b.Changes, Change{
+			change := Change{
 				Path:          f.Path,
 				Type:          "modify",
 				Hash:          f.Hash,
@@ -221,9 +474,35 @@ func (b *Bundle) computeChanges(source, target *snapshot.Snapshot, compressionLe
 				ModifiedTime:  f.ModifiedTime,
 				IsSymlink:     f.IsSymlink,
 				SymlinkTarget: f.SymlinkTarget,
-				ContentHash:   utils.HashBytes(content),
-			})
-			b.FileContents[f.Path] = content
+				LinkTo:        f.LinkTo,
+				Sparse:        f.Sparse,
+				BaseHash:      sourceFile.Hash,
+			}
+			// Large files only carry the chunks that changed
+			if f.Chunks != nil && sourceFile.Chunks != nil && !f.IsSymlink && !sourceFile.IsSymlink {
+				if err := b.addChunks(&change, sourceFile.Chunks, cfg); err != nil {
+					return fmt.Errorf("failed to read modified file %s: %w", f.Path, err)
+				}
+				b.Changes = append(b.Changes, change)
+				continue
+			}
+
+			if err := b.addContent(&change, compressionLevel); err != nil {
+				return fmt.Errorf("failed to read modified file %s: %w", f.Path, err)
+			}
+
+			// Include the base version of text files for merging
+			if !f.IsSymlink && !sourceFile.IsSymlink && sourceFile.Size <= MaxBaseSize && store != nil {
+				if base, ok := store.Find(f.Path, sourceFile.Hash); ok && !utils.IsBinary(base) {
+					compressed, err := utils.Compress(base, compressionLevel)
+					if err != nil {
+						return fmt.Errorf("failed to compress base of %s: %w", f.Path, err)
+					}
+					change.BaseContentHash = utils.HashBytes(compressed)
+					b.BaseContents[f.Path] = compressed
+				}
+			}
+			b.Changes = append(b.Changes, change)
 		}
 	}
 
@@ -242,135 +521,255 @@ func (b *Bundle) computeChanges(source, target *snapshot.Snapshot, compressionLe
 		}
 	}
 
+	// Directories are compared only if the target records them
+	if target.RecordsDirs() {
+		b.Changes = append(b.Changes, dirChanges(source.Dirs, target.Dirs)...)
+	}
+
 	return nil
 }
 
-// Save saves the bundle to a file
-func (b *Bundle) Save(path string) error {
-	// Create the bundle directory if it doesn't exist
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-		return fmt.Errorf("failed to create bundle directory: %w", err)
+// dirChanges computes the directory changes between two snapshots. Changes
+// are ordered deepest first, so they follow the file changes that create or
+// empty the directories and a directory is removed before its parent.
+func dirChanges(source, target []snapshot.Directory) []Change {
+	sourceDirs := make(map[string]snapshot.Directory)
+	for _, d := range source {
+		sourceDirs[d.Path] = d
+	}
+
+	var changes []Change
+	for _, d := range target {
+		sourceDir, exists := sourceDirs[d.Path]
+		delete(sourceDirs, d.Path)
+		switch {
+		case !exists:
+			changes = append(changes, Change{Path: d.Path, Type: "add", IsDir: true, Mode: d.Mode})
+		case sourceDir.Mode != d.Mode:
+			changes = append(changes, Change{Path: d.Path, Type: "modify", IsDir: true, Mode: d.Mode})
+		}
+	}
+	for _, d := range sourceDirs {
+		changes = append(changes, Change{Path: d.Path, Type: "delete", IsDir: true, Mode: d.Mode})
 	}
 
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path > changes[j].Path })
+	return changes
+}
+
+// contentEntryName returns the archive entry name for a content hash
+func contentEntryName(contentHash string) string {
+	return ContentsDir + "/" + contentHash
+}
+
+// Save saves the bundle to a file. A cancelled ctx stops the write and leaves
+// any existing file at path untouched.
+func (b *Bundle) Save(ctx context.Context, path string) error {
 	// Ensure path has .zip extension
 	if filepath.Ext(path) != ".zip" {
 		path = path[:len(path)-len(filepath.Ext(path))] + ".zip"
 	}
 
-	// Create a temporary directory for file contents
-	tempDir, err := os.MkdirTemp("", "dsp-bundle-*")
+	// Stream the archive to a temporary file next to the destination
+	zw, err := utils.NewZipWriter(path, b.CreatedAt)
 	if err != nil {
-		return fmt.Errorf("failed to create temp directory: %w", err)
-	}
-	defer os.RemoveAll(tempDir)
-
-	// Create contents directory
-	contentsDir := filepath.Join(tempDir, "contents")
-	if err := os.MkdirAll(contentsDir, 0755); err != nil {
-		return fmt.Errorf("failed to create contents directory: %w", err)
+		return err
+	}
+	defer zw.Close()
+
+	// Write file contents. Contents are already zstd-compressed, so they are
+	// stored without further compression which keeps each entry seekable.
+	// Identical contents are stored once.
+	b.Format = FormatVersion
+	b.Index = make(map[string]IndexEntry, len(b.FileContents)+len(b.spooled))
+	for _, change := range b.Changes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if spooled, ok := b.spooled[change.Path]; ok {
+			name := contentEntryName(change.ContentHash)
+			b.Index[change.Path] = IndexEntry{Entry: name, StoredSize: spooled.size}
+			if zw.Has(name) {
+				continue
+			}
+			entry, err := zw.Create(name, zip.Store)
+			if err != nil {
+				return err
+			}
+			if _, err := utils.CopyBuffered(entry, io.NewSectionReader(b.spool, spooled.offset, spooled.size)); err != nil {
+				return fmt.Errorf("failed to write file content: %w", err)
+			}
+			continue
+		}
+		content, ok := b.FileContents[change.Path]
+		if !ok {
+			continue
+		}
+		name := contentEntryName(utils.HashBytes(content))
+		b.Index[change.Path] = IndexEntry{Entry: name, StoredSize: int64(len(content))}
+		if zw.Has(name) {
+			continue
+		}
+		if err := zw.WriteEntry(name, zip.Store, content); err != nil {
+			return fmt.Errorf("failed to write file content: %w", err)
+		}
 	}
 
-	// Save file contents
-	for _, content := range b.FileContents {
-		contentPath := filepath.Join(contentsDir, utils.HashBytes(content))
-		if err := os.WriteFile(contentPath, content, 0644); err != nil {
-			return fmt.Errorf("failed to write file content: %w", err)
+	// Write base contents of modified files
+	for _, change := range b.Changes {
+		content, ok := b.BaseContents[change.Path]
+		if !ok || change.BaseContentHash == "" {
+			continue
+		}
+		name := contentEntryName(change.BaseContentHash)
+		if zw.Has(name) {
+			continue
+		}
+		if err := zw.WriteEntry(name, zip.Store, content); err != nil {
+			return fmt.Errorf("failed to write base content: %w", err)
 		}
 	}
 
-	// Create a zip archive containing metadata and file contents
-	if err := utils.CreateZipArchive(path, map[string]string{
-		"metadata.json": "",                // Empty initially
-		"contents":      contentsDir + "/", // Add trailing slash to indicate directory
-	}); err != nil {
-		return fmt.Errorf("failed to create bundle archive: %w", err)
+	// Write chunks of modified large files
+	b.ChunkIndex = make(map[string]IndexEntry, len(b.ChunkContents))
+	for _, change := range b.Changes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, c := range change.Chunks {
+			content, ok := b.ChunkContents[c.Hash]
+			if !ok {
+				continue
+			}
+			name := contentEntryName(utils.HashBytes(content))
+			b.ChunkIndex[c.Hash] = IndexEntry{Entry: name, StoredSize: int64(len(content))}
+			if zw.Has(name) {
+				continue
+			}
+			if err := zw.WriteEntry(name, zip.Store, content); err != nil {
+				return fmt.Errorf("failed to write chunk: %w", err)
+			}
+		}
 	}
 
-	// Marshal the bundle metadata
+	// Write the metadata last, once the index is complete
 	metadata, err := json.MarshalIndent(b, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal bundle metadata: %w", err)
 	}
+	if err := zw.WriteEntry(MetadataEntry, zip.Deflate, metadata); err != nil {
+		return fmt.Errorf("failed to write bundle metadata: %w", err)
+	}
 
-	// Update the metadata in the zip file
-	if err := utils.UpdateZipFile(path, "metadata.json", metadata); err != nil {
-		return fmt.Errorf("failed to update bundle metadata: %w", err)
+	if err := zw.Commit(); err != nil {
+		return fmt.Errorf("failed to save bundle archive: %w", err)
 	}
 
 	return nil
 }
 
-// Load loads a bundle from a file
-func Load(path string) (*Bundle, error) {
-	// Create a temporary directory for extraction
-	tempDir, err := os.MkdirTemp("", "dsp-bundle-*")
+// Load loads a bundle from a file, including all file contents. Use
+// OpenReader to read individual files without loading the whole bundle.
+func Load(ctx context.Context, path string) (*Bundle, error) {
+	r, err := OpenReader(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+		return nil, err
 	}
-	defer os.RemoveAll(tempDir)
+	defer r.Close()
 
-	// Extract the bundle archive
-	if err := utils.ExtractZipArchive(path, tempDir); err != nil {
-		return nil, fmt.Errorf("failed to extract bundle: %w", err)
+	bundle, err := loadContents(ctx, r)
+	if err != nil {
+		return nil, err
 	}
 
-	// Read and parse metadata
-	metadataPath := filepath.Join(tempDir, "metadata.json")
-	metadata, err := os.ReadFile(metadataPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read bundle metadata: %w", err)
+	// Validate bundle
+	if err := bundle.Verify(); err != nil {
+		return nil, fmt.Errorf("bundle verification failed: %w", err)
 	}
 
-	var bundle Bundle
-	if err := json.Unmarshal(metadata, &bundle); err != nil {
-		return nil, fmt.Errorf("failed to parse bundle: %w", err)
+	return bundle, nil
+}
+
+// loadContents reads all contents of an open bundle into memory. Contents
+// left out of a delta bundle are skipped.
+func loadContents(ctx context.Context, r *Reader) (*Bundle, error) {
+	bundle := r.Bundle
+	omitted := make(map[string]bool, len(bundle.Omitted))
+	for _, hash := range bundle.Omitted {
+		omitted[hash] = true
 	}
 
 	// Load file contents
 	bundle.FileContents = make(map[string][]byte)
-	contentsDir := filepath.Join(tempDir, "contents")
-	entries, err := os.ReadDir(contentsDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read contents directory: %w", err)
+	for _, change := range bundle.Changes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if change.Type == "delete" || change.ContentHash == "" || omitted[change.Hash] {
+			continue
+		}
+		raw, err := r.OpenRaw(change.Path)
+		if err != nil {
+			// Older bundles may not carry content for every change
+			if bundle.Format < FormatVersion {
+				continue
+			}
+			return nil, err
+		}
+		content, err := io.ReadAll(raw)
+		raw.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file content: %w", err)
+		}
+		bundle.FileContents[change.Path] = content
 	}
 
-	for _, entry := range entries {
-		if entry.IsDir() {
+	// Load base contents
+	bundle.BaseContents = make(map[string][]byte)
+	for _, change := range bundle.Changes {
+		if change.BaseContentHash == "" {
 			continue
 		}
-		contentPath := filepath.Join(contentsDir, entry.Name())
-		content, err := os.ReadFile(contentPath)
+		raw, err := r.OpenRawBase(change.Path)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read file content: %w", err)
+			return nil, err
 		}
-		// Find the change that uses this content
-		for _, change := range bundle.Changes {
-			if change.ContentHash == entry.Name() {
-				bundle.FileContents[change.Path] = content
-				break
-			}
+		content, err := io.ReadAll(raw)
+		raw.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read base content: %w", err)
 		}
+		bundle.BaseContents[change.Path] = content
 	}
 
-	// Validate bundle
-	if err := bundle.Verify(); err != nil {
-		return nil, fmt.Errorf("bundle verification failed: %w", err)
+	// Load chunks
+	bundle.ChunkContents = make(map[string][]byte)
+	for hash := range bundle.ChunkIndex {
+		raw, err := r.OpenRawChunk(hash)
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(raw)
+		raw.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk: %w", err)
+		}
+		bundle.ChunkContents[hash] = content
 	}
 
-	return &bundle, nil
+	return bundle, nil
 }
 
-// LoadFromBytes loads a bundle from raw bytes
-func LoadFromBytes(data []byte) (*Bundle, error) {
-	var b Bundle
-	if err := json.Unmarshal(data, &b); err != nil {
-		return nil, fmt.Errorf("failed to parse bundle: %w", err)
+// Verify checks the bundle's integrity. Its errors are verification errors.
+func (b *Bundle) Verify() error {
+	if err := b.verify(); err != nil {
+		return protocol.VerificationError(err)
 	}
-	return &b, nil
+	return nil
 }
 
-// Verify checks the bundle's integrity
-func (b *Bundle) Verify() error {
+// verify checks the bundle's integrity for Verify
+func (b *Bundle) verify() error {
 	// Check required fields
 	if b.ID == "" {
 		return fmt.Errorf("bundle has no ID")
@@ -385,8 +784,18 @@ func (b *Bundle) Verify() error {
 		return fmt.Errorf("bundle has no target snapshot")
 	}
 
-	// Source snapshot is only required for non-initial bundles
-	if !b.IsInitial && b.SourceSnapshot == "" {
+	// Initial bundles have no source snapshot and only add files; other
+	// bundles must record the snapshot they start from
+	if b.IsInitial {
+		if b.SourceSnapshot != "" {
+			return fmt.Errorf("initial bundle has a source snapshot: %s", b.SourceSnapshot)
+		}
+		for i, change := range b.Changes {
+			if change.Type != "add" {
+				return fmt.Errorf("change %d (%s) of initial bundle is a %s; initial bundles only add files", i, change.Path, change.Type)
+			}
+		}
+	} else if b.SourceSnapshot == "" {
 		return fmt.Errorf("bundle has no source snapshot")
 	}
 
@@ -410,6 +819,49 @@ func (b *Bundle) Verify() error {
 		return fmt.Errorf("bundle has no tracking configuration")
 	}
 
+	// Tracked paths must be absolute and unique, and files added or
+	// modified must lie below one of them
+	tracked := make([]string, 0, len(b.Repository.TrackingConfig.Paths))
+	seen := make(map[string]bool)
+	for _, p := range b.Repository.TrackingConfig.Paths {
+		if p.Path == "" || !filepath.IsAbs(p.Path) {
+			return fmt.Errorf("tracked path %q is not absolute", p.Path)
+		}
+		if seen[p.Path] {
+			return fmt.Errorf("tracked path %s is listed more than once", p.Path)
+		}
+		seen[p.Path] = true
+		tracked = append(tracked, p.Path)
+	}
+	if len(tracked) > 0 {
+		for i, change := range b.Changes {
+			if change.Type != "delete" && !isUnderAny(change.Path, tracked) {
+				return fmt.Errorf("change %d (%s) is not below a tracked path", i, change.Path)
+			}
+			if change.LinkTo != "" && !isUnderAny(change.LinkTo, tracked) {
+				return fmt.Errorf("change %d (%s) links to %s, which is not below a tracked path", i, change.Path, change.LinkTo)
+			}
+		}
+	}
+
+	// Partial bundles carry a subset of the source tracking configuration
+	// and may only contain changes below the selected paths
+	if len(b.SelectedPaths) > 0 {
+		for _, tracked := range b.Repository.TrackingConfig.Paths {
+			if !isUnderAny(tracked.Path, b.SelectedPaths) {
+				return fmt.Errorf("tracked path %s is outside the selected paths", tracked.Path)
+			}
+		}
+		for i, change := range b.Changes {
+			if !isUnderAny(change.Path, b.SelectedPaths) {
+				return fmt.Errorf("change %d (%s) is outside the selected paths", i, change.Path)
+			}
+			if change.LinkTo != "" && !isUnderAny(change.LinkTo, b.SelectedPaths) {
+				return fmt.Errorf("change %d (%s) links to %s, outside the selected paths", i, change.Path, change.LinkTo)
+			}
+		}
+	}
+
 	// Check changes
 	if len(b.Changes) == 0 {
 		return fmt.Errorf("bundle has no changes")
@@ -426,7 +878,10 @@ func (b *Bundle) Verify() error {
 		if change.Type != "add" && change.Type != "modify" && change.Type != "delete" {
 			return fmt.Errorf("change %d has invalid type: %s", i, change.Type)
 		}
-		if change.Hash == "" {
+		if change.IsDir && change.IsSymlink {
+			return fmt.Errorf("change %d is both a directory and a symlink", i)
+		}
+		if change.Hash == "" && !change.IsDir {
 			return fmt.Errorf("change %d has no hash", i)
 		}
 		if change.Size < 0 {
@@ -435,7 +890,89 @@ func (b *Bundle) Verify() error {
 		if change.IsSymlink && change.SymlinkTarget == "" {
 			return fmt.Errorf("change %d is a symlink but has no target", i)
 		}
+		if change.LinkTo != "" && (!filepath.IsAbs(change.LinkTo) || filepath.Clean(change.LinkTo) != change.LinkTo) {
+			return fmt.Errorf("change %d links to %q, which is not a clean absolute path", i, change.LinkTo)
+		}
+		for _, c := range change.Chunks {
+			if c.Hash == "" || c.Size <= 0 {
+				return fmt.Errorf("change %d has an invalid chunk", i)
+			}
+		}
+	}
+
+	// Delta bundles must be completed from the receiver's contents first
+	if len(b.Omitted) > 0 {
+		return fmt.Errorf("delta bundle is missing %d contents", len(b.Omitted))
+	}
+
+	// Check loaded contents against the recorded hashes and sizes
+	if b.FileContents != nil {
+		return b.verifyContents()
+	}
+
+	return nil
+}
+
+// verifyContents checks every loaded content blob: the stored bytes against
+// their content hash, and the decompressed file against its hash and size
+func (b *Bundle) verifyContents() error {
+	algorithm := b.Repository.Config.HashAlgorithm
+	for _, change := range b.Changes {
+		if change.ContentHash != "" {
+			content, ok := b.FileContents[change.Path]
+			if !ok {
+				// Older bundles may not carry content for every change
+				if b.Format < FormatVersion {
+					continue
+				}
+				return fmt.Errorf("bundle has no content for %s", change.Path)
+			}
+			if err := verifyBlob(content, change.ContentHash, change.Hash, change.Size, algorithm); err != nil {
+				return fmt.Errorf("content of %s: %w", change.Path, err)
+			}
+		}
+		if change.BaseContentHash != "" {
+			base, ok := b.BaseContents[change.Path]
+			if !ok {
+				return fmt.Errorf("bundle has no base content for %s", change.Path)
+			}
+			if err := verifyBlob(base, change.BaseContentHash, change.BaseHash, -1, algorithm); err != nil {
+				return fmt.Errorf("base content of %s: %w", change.Path, err)
+			}
+		}
 	}
 
+	// Chunks are stored compressed and named by the hash of their data
+	for hash, content := range b.ChunkContents {
+		if err := verifyBlob(content, "", hash, -1, algorithm); err != nil {
+			return fmt.Errorf("chunk %s: %w", hash, err)
+		}
+	}
+	return nil
+}
+
+// verifyBlob checks a compressed blob: the stored bytes against contentHash,
+// and the decompressed data against hash and size. Empty hashes and a
+// negative size are not checked.
+func verifyBlob(stored []byte, contentHash, hash string, size int64, algorithm string) error {
+	if contentHash != "" && utils.HashBytes(stored) != contentHash {
+		return fmt.Errorf("stored content does not match its recorded hash")
+	}
+	data, err := utils.Decompress(stored)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && int64(len(data)) != size {
+		return fmt.Errorf("decompressed size is %d bytes, expected %d", len(data), size)
+	}
+	if hash != "" {
+		actual, err := utils.HashReader(bytes.NewReader(data), algorithm)
+		if err != nil {
+			return err
+		}
+		if actual != hash {
+			return fmt.Errorf("decompressed content does not match the file hash")
+		}
+	}
 	return nil
 }
@@ -0,0 +1,44 @@
+package bundle
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/snapshot"
+)
+
+// linkBundle returns a valid bundle whose one change is a hard link to linkTo
+func linkBundle(linkTo string) *Bundle {
+	b := &Bundle{
+		ID:             "test-bundle",
+		CreatedAt:      time.Now(),
+		CreatedBy:      "test",
+		IsInitial:      true,
+		TargetSnapshot: "target",
+		Changes: []Change{
+			{Path: "/repo/a.txt", Type: "add", Hash: "hash-a", Size: 1, LinkTo: linkTo},
+		},
+	}
+	b.Repository.Name = "repo"
+	b.Repository.DSPDir = ".dsp"
+	b.Repository.DataDir = "data"
+	b.Repository.Config.HashAlgorithm = "sha256"
+	b.Repository.Config.CompressionLevel = 3
+	b.Repository.TrackingConfig = &snapshot.TrackingConfig{
+		Paths: []snapshot.TrackedPath{{Path: "/repo", IsDir: true}},
+	}
+	return b
+}
+
+func TestVerifyLinkTo(t *testing.T) {
+	if err := linkBundle("/repo/b.txt").Verify(); err != nil {
+		t.Fatalf("link inside the tracked paths refused: %v", err)
+	}
+	for _, linkTo := range []string{"../outside", "/repo/../outside", "/outside"} {
+		err := linkBundle(linkTo).Verify()
+		if err == nil || !strings.Contains(err.Error(), "links to") {
+			t.Errorf("link to %s: got %v, want it refused", linkTo, err)
+		}
+	}
+}
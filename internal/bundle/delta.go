@@ -0,0 +1,108 @@
+package bundle
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// MakeDelta writes a delta of the bundle at src to dst: the same bundle
+// without the file contents and chunks whose hashes are in have, for a
+// receiver that already holds them. It returns the number of contents left
+// out; if there are none, nothing is written.
+func MakeDelta(ctx context.Context, src, dst string, have map[string]bool) (int, error) {
+	b, err := Load(ctx, src)
+	if err != nil {
+		return 0, err
+	}
+
+	omitted := make(map[string]bool)
+	for _, change := range b.Changes {
+		if _, ok := b.FileContents[change.Path]; ok && have[change.Hash] {
+			delete(b.FileContents, change.Path)
+			omitted[change.Hash] = true
+		}
+	}
+	for hash := range b.ChunkContents {
+		if have[hash] {
+			delete(b.ChunkContents, hash)
+			omitted[hash] = true
+		}
+	}
+	if len(omitted) == 0 {
+		return 0, nil
+	}
+
+	b.Omitted = make([]string, 0, len(omitted))
+	for hash := range omitted {
+		b.Omitted = append(b.Omitted, hash)
+	}
+	sort.Strings(b.Omitted)
+	if err := b.Save(ctx, dst); err != nil {
+		return 0, err
+	}
+	return len(b.Omitted), nil
+}
+
+// CompleteDelta fills in the contents a delta bundle at path left out from
+// store and rewrites it as a complete bundle, which is then verified like
+// any other. Delta bundles are left as they are.
+func CompleteDelta(ctx context.Context, path string, store *ContentStore) error {
+	r, err := OpenReader(path)
+	if err != nil {
+		return err
+	}
+	b, err := loadContents(ctx, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if len(b.Omitted) == 0 {
+		return nil
+	}
+
+	omitted := make(map[string]bool, len(b.Omitted))
+	for _, hash := range b.Omitted {
+		omitted[hash] = true
+	}
+
+	// File contents, compressed the way the bundle records them
+	for i := range b.Changes {
+		change := &b.Changes[i]
+		if !omitted[change.Hash] || change.ContentHash == "" || change.Type == "delete" {
+			continue
+		}
+		data, ok := store.FindHash(change.Hash)
+		if !ok {
+			return fmt.Errorf("content of %s (%s) is not available locally", change.Path, change.Hash)
+		}
+		compressed, err := utils.Compress(data, b.Repository.Config.CompressionLevel)
+		if err != nil {
+			return fmt.Errorf("failed to compress %s: %w", change.Path, err)
+		}
+		b.FileContents[change.Path] = compressed
+		change.ContentHash = utils.HashBytes(compressed)
+	}
+
+	// Chunks of large files
+	for _, change := range b.Changes {
+		for _, c := range change.Chunks {
+			if !omitted[c.Hash] || b.ChunkContents[c.Hash] != nil {
+				continue
+			}
+			data, ok := store.FindChunk(c.Hash)
+			if !ok {
+				return fmt.Errorf("chunk %s of %s is not available locally", c.Hash, change.Path)
+			}
+			b.ChunkContents[c.Hash] = data
+		}
+	}
+
+	b.Omitted = nil
+	if err := b.Verify(); err != nil {
+		return fmt.Errorf("completed bundle verification failed: %w", err)
+	}
+	return b.Save(ctx, path)
+}
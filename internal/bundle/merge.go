@@ -0,0 +1,220 @@
+package bundle
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+)
+
+// Merge squashes a chain of bundles into a single bundle. The bundles must be
+// given in order, each starting at the snapshot the previous one ended at.
+// Later changes win: a file added and then modified is a single add, and a
+// file added and then deleted is dropped entirely.
+func Merge(bundles []*Bundle) (*Bundle, error) {
+	if len(bundles) < 2 {
+		return nil, fmt.Errorf("at least two bundles are required to merge")
+	}
+
+	// Validate the chain
+	first := bundles[0]
+	for i := 1; i < len(bundles); i++ {
+		prev, next := bundles[i-1], bundles[i]
+		if next.Repository.Name != first.Repository.Name {
+			return nil, fmt.Errorf("bundle %s is from repository '%s', expected '%s'", next.ID, next.Repository.Name, first.Repository.Name)
+		}
+		if next.IsInitial {
+			return nil, fmt.Errorf("bundle %s is an initial bundle and can only be first in the chain", next.ID)
+		}
+		if !isSnapshotID(prev.TargetSnapshot) || !isSnapshotID(next.SourceSnapshot) {
+			return nil, fmt.Errorf("bundles %s and %s do not record snapshot IDs; re-create them to merge", prev.ID, next.ID)
+		}
+		if next.SourceSnapshot != prev.TargetSnapshot {
+			return nil, fmt.Errorf("bundles are not contiguous: %s ends at snapshot %s but %s starts at %s",
+				prev.ID, prev.TargetSnapshot, next.ID, next.SourceSnapshot)
+		}
+	}
+	last := bundles[len(bundles)-1]
+
+	// Squash changes, keeping the order in which paths first appear
+	var order []string
+	changes := make(map[string]Change)
+	contents := make(map[string][]byte)
+	baseContents := make(map[string][]byte)
+	chunks := make(map[string][]byte)
+	for _, b := range bundles {
+		for hash, content := range b.ChunkContents {
+			chunks[hash] = content
+		}
+		for _, change := range b.Changes {
+			prev, seen := changes[change.Path]
+			if !seen {
+				order = append(order, change.Path)
+			}
+
+			switch change.Type {
+			case "add", "modify":
+				base := b.BaseContents[change.Path]
+				if len(change.Chunks) > 0 && seen && prev.Type != "modify" {
+					// Unchanged chunks would have to come from a file
+					// that does not exist at the start of the chain
+					return nil, fmt.Errorf("bundle %s changes chunks of %s, which is added or deleted earlier in the chain; bundle the snapshots directly instead of merging",
+						b.ID, change.Path)
+				}
+				switch {
+				case seen && prev.Type == "add":
+					// Still new relative to the start of the chain
+					change.Type = "add"
+					change.BaseHash, change.BaseContentHash, base = "", "", nil
+				case seen && prev.Type == "delete":
+					// Existed at the start of the chain, deleted and recreated.
+					// A delete merged from a modify carries the version at the
+					// start of the chain as its base.
+					change.Type = "modify"
+					change.BaseHash, change.BaseContentHash, base = prev.Hash, "", nil
+					if prev.BaseHash != "" {
+						change.BaseHash, change.BaseContentHash = prev.BaseHash, prev.BaseContentHash
+						base = baseContents[change.Path]
+					}
+				case seen && prev.Type == "modify":
+					// The base is the version at the start of the chain
+					change.BaseHash, change.BaseContentHash = prev.BaseHash, prev.BaseContentHash
+					base = baseContents[change.Path]
+					if len(change.Chunks) > 0 {
+						change.BaseChunks = prev.BaseChunks
+					}
+				}
+				changes[change.Path] = change
+				contents[change.Path] = b.FileContents[change.Path]
+				baseContents[change.Path] = base
+			case "delete":
+				delete(contents, change.Path)
+				if seen && prev.Type == "add" {
+					// Added and deleted within the chain: cancels out
+					delete(changes, change.Path)
+					delete(baseContents, change.Path)
+					continue
+				}
+				if seen && prev.Type == "modify" {
+					// What is deleted is the version at the start of the
+					// chain, not the one the modify left
+					change.BaseHash, change.BaseContentHash = prev.BaseHash, prev.BaseContentHash
+				} else {
+					delete(baseContents, change.Path)
+				}
+				change.ContentHash = ""
+				changes[change.Path] = change
+			}
+		}
+	}
+
+	// Build merged bundle
+	merged := &Bundle{
+		Format:         FormatVersion,
+		ID:             time.Now().Format("20060102150405"),
+		CreatedAt:      time.Now(),
+		CreatedBy:      config.CurrentUser(),
+		IsInitial:      first.IsInitial,
+		SourceSnapshot: first.SourceSnapshot,
+		TargetSnapshot: last.TargetSnapshot,
+		SelectedPaths:  mergeSelectedPaths(bundles),
+		Redacted:       mergeRedactions(bundles),
+		RecordsDirs:    last.RecordsDirs,
+		FileContents:   make(map[string][]byte),
+		BaseContents:   make(map[string][]byte),
+		ChunkContents:  make(map[string][]byte),
+	}
+	merged.Repository = last.Repository
+	merged.Lineage = last.Lineage
+
+	ids := make([]string, len(bundles))
+	for i, b := range bundles {
+		ids[i] = b.ID
+	}
+	merged.Description = fmt.Sprintf("Merged from bundles %s", strings.Join(ids, ", "))
+
+	for _, path := range order {
+		change, ok := changes[path]
+		if !ok {
+			continue
+		}
+		merged.Changes = append(merged.Changes, change)
+		if content, ok := contents[path]; ok && content != nil {
+			merged.FileContents[path] = content
+		}
+		if base, ok := baseContents[path]; ok && base != nil {
+			merged.BaseContents[path] = base
+		}
+
+		// Carry the chunks that are not in the version at the start of the chain
+		local := make(map[string]bool, len(change.BaseChunks))
+		for _, c := range change.BaseChunks {
+			local[c.Hash] = true
+		}
+		for _, c := range change.Chunks {
+			if local[c.Hash] {
+				continue
+			}
+			content, ok := chunks[c.Hash]
+			if !ok {
+				return nil, fmt.Errorf("no bundle in the chain carries chunk %s of %s", c.Hash, path)
+			}
+			merged.ChunkContents[c.Hash] = content
+		}
+	}
+
+	if len(merged.Changes) == 0 {
+		return nil, fmt.Errorf("the changes in these bundles cancel out; nothing to merge")
+	}
+
+	return merged, nil
+}
+
+// mergeRedactions returns the union of the redaction patterns of the
+// bundles, counting the files each left out, or nil if none was redacted
+func mergeRedactions(bundles []*Bundle) *Redaction {
+	var merged *Redaction
+	seen := make(map[string]bool)
+	for _, b := range bundles {
+		if b.Redacted == nil {
+			continue
+		}
+		if merged == nil {
+			merged = &Redaction{}
+		}
+		merged.Files += b.Redacted.Files
+		for _, pattern := range b.Redacted.Patterns {
+			if !seen[pattern] {
+				seen[pattern] = true
+				merged.Patterns = append(merged.Patterns, pattern)
+			}
+		}
+	}
+	return merged
+}
+
+// mergeSelectedPaths returns the union of the selected paths if every bundle
+// is partial, or nil if any bundle covers the whole repository
+func mergeSelectedPaths(bundles []*Bundle) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, b := range bundles {
+		if len(b.SelectedPaths) == 0 {
+			return nil
+		}
+		for _, p := range b.SelectedPaths {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths
+}
+
+// isSnapshotID reports whether a recorded snapshot reference is a snapshot ID.
+// Older bundles recorded the snapshot file name instead.
+func isSnapshotID(id string) bool {
+	return id != "" && id != "snapshot.json"
+}
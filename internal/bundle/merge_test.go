@@ -0,0 +1,69 @@
+package bundle
+
+import (
+	"bytes"
+	"testing"
+)
+
+// chainBundle returns a bundle of a chain going from snapshot source to
+// target with the given changes
+func chainBundle(id, source, target string, changes ...Change) *Bundle {
+	b := linkBundle("")
+	b.ID = id
+	b.IsInitial = source == ""
+	b.SourceSnapshot = source
+	b.TargetSnapshot = target
+	b.Changes = changes
+	b.FileContents = make(map[string][]byte)
+	b.BaseContents = make(map[string][]byte)
+	return b
+}
+
+func TestMergeModifyDelete(t *testing.T) {
+	base := []byte("compressed base")
+	modify := chainBundle("1", "s1", "s2", Change{
+		Path: "/repo/a.txt", Type: "modify", Hash: "hash-2",
+		BaseHash: "hash-1", BaseContentHash: "base-1",
+	})
+	modify.BaseContents["/repo/a.txt"] = base
+	del := chainBundle("2", "s2", "s3", Change{Path: "/repo/a.txt", Type: "delete", Hash: "hash-2"})
+	add := chainBundle("3", "s3", "s4", Change{Path: "/repo/a.txt", Type: "add", Hash: "hash-4"})
+
+	// The delete removes the version at the start of the chain
+	merged, err := Merge([]*Bundle{modify, del})
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if len(merged.Changes) != 1 {
+		t.Fatalf("merged %d changes, want 1", len(merged.Changes))
+	}
+	change := merged.Changes[0]
+	if change.Type != "delete" || change.BaseHash != "hash-1" || change.BaseContentHash != "base-1" {
+		t.Fatalf("merged %s with base %q (%q), want a delete of hash-1", change.Type, change.BaseHash, change.BaseContentHash)
+	}
+	if !bytes.Equal(merged.BaseContents["/repo/a.txt"], base) {
+		t.Fatalf("merged bundle lost the base content")
+	}
+
+	// Recreated afterwards, the file is modified from the same version
+	merged, err = Merge([]*Bundle{modify, del, add})
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	change = merged.Changes[0]
+	if change.Type != "modify" || change.Hash != "hash-4" || change.BaseHash != "hash-1" || change.BaseContentHash != "base-1" {
+		t.Fatalf("merged %s to %s from %q (%q), want a modify from hash-1", change.Type, change.Hash, change.BaseHash, change.BaseContentHash)
+	}
+	if !bytes.Equal(merged.BaseContents["/repo/a.txt"], base) {
+		t.Fatalf("merged bundle lost the base content")
+	}
+
+	// A delete at the start of the chain keeps its own hash as the base
+	merged, err = Merge([]*Bundle{del, add})
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if change := merged.Changes[0]; change.Type != "modify" || change.BaseHash != "hash-2" || change.BaseContentHash != "" {
+		t.Fatalf("merged %s from %q (%q), want a modify from hash-2", change.Type, change.BaseHash, change.BaseContentHash)
+	}
+}
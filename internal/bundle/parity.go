@@ -0,0 +1,339 @@
+package bundle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// ParitySuffix is appended to the name of a file to name its parity file
+const ParitySuffix = ".parity"
+
+// Parity files hold Reed-Solomon parity blocks for groups of up to
+// parityGroupSize data blocks, followed by a JSON trailer describing the
+// protected file, the trailer length and parityMagic
+const (
+	parityFormat    = 1
+	parityMagic     = "DSPPAR01"
+	parityGroupSize = 100
+	maxParityBlock  = 64 << 10
+	minParityBlock  = 4 << 10
+)
+
+var parityTable = crc32.MakeTable(crc32.Castagnoli)
+
+// parityTrailer describes the file a parity file protects
+type parityTrailer struct {
+	Format          int      `json:"format"`
+	Percent         int      `json:"percent"`
+	Size            int64    `json:"size"`
+	SHA256          string   `json:"sha256"`
+	BlockSize       int      `json:"block_size"`
+	DataShards      int      `json:"data_shards"`
+	ParityShards    int      `json:"parity_shards"`
+	Checksums       []uint32 `json:"checksums"`        // CRC-32C of each data block
+	ParityChecksums []uint32 `json:"parity_checksums"` // CRC-32C of each parity block
+}
+
+// groups returns the number of block groups of the protected file
+func (t *parityTrailer) groups() int {
+	return (len(t.Checksums) + t.DataShards - 1) / t.DataShards
+}
+
+// block returns the data block in slot i of a group. Groups are interleaved,
+// so a run of damaged blocks is spread over many groups.
+func (t *parityTrailer) block(group, i int) int {
+	return i*t.groups() + group
+}
+
+// readBlock reads a data block into shard, which must be cleared, and
+// reports whether all of it could be read
+func (t *parityTrailer) readBlock(r io.ReaderAt, shard []byte, block int) bool {
+	offset := int64(block) * int64(t.BlockSize)
+	want := min(int64(t.BlockSize), t.Size-offset)
+	n, _ := r.ReadAt(shard[:want], offset)
+	return int64(n) == want
+}
+
+// ParseParity parses a parity setting such as "10%" into a percentage
+func ParseParity(s string) (int, error) {
+	percent, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "%")))
+	if err != nil || percent < 1 || percent > 100 {
+		return 0, fmt.Errorf("invalid parity %q: use a percentage from 1%% to 100%%", s)
+	}
+	return percent, nil
+}
+
+// WriteParity writes the parity file of the file at path, with parity blocks
+// adding about percent of its size. Up to that share of the blocks of each
+// group of blocks can then be repaired with RepairWithParity.
+func WriteParity(path string, percent int) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	// Small files use small blocks, so their parity stays small too
+	trailer := parityTrailer{Format: parityFormat, Percent: percent, Size: info.Size(), BlockSize: maxParityBlock}
+	for trailer.BlockSize > minParityBlock && int64(trailer.BlockSize)*parityGroupSize > info.Size() {
+		trailer.BlockSize /= 2
+	}
+	blocks := int((info.Size() + int64(trailer.BlockSize) - 1) / int64(trailer.BlockSize))
+	trailer.DataShards = min(max(blocks, 1), parityGroupSize)
+	trailer.ParityShards = (trailer.DataShards*percent + 99) / 100
+	encoder, err := reedsolomon.New(trailer.DataShards, trailer.ParityShards)
+	if err != nil {
+		return fmt.Errorf("failed to create parity encoder: %w", err)
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+ParitySuffix+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create parity file: %w", err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	trailer.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+
+	// Encode each group of blocks
+	trailer.Checksums = make([]uint32, blocks)
+	shards := newShards(trailer.DataShards+trailer.ParityShards, trailer.BlockSize)
+	for group := 0; group < trailer.groups(); group++ {
+		for i := 0; i < trailer.DataShards; i++ {
+			clear(shards[i])
+			block := trailer.block(group, i)
+			if block >= blocks {
+				continue // Padding
+			}
+			if !trailer.readBlock(file, shards[i], block) {
+				return fmt.Errorf("failed to read %s: it changed while its parity was computed", path)
+			}
+			trailer.Checksums[block] = crc32.Checksum(shards[i], parityTable)
+		}
+		if err := encoder.Encode(shards); err != nil {
+			return fmt.Errorf("failed to compute parity: %w", err)
+		}
+		for _, shard := range shards[trailer.DataShards:] {
+			trailer.ParityChecksums = append(trailer.ParityChecksums, crc32.Checksum(shard, parityTable))
+			if _, err := out.Write(shard); err != nil {
+				return fmt.Errorf("failed to write parity file: %w", err)
+			}
+		}
+	}
+
+	// Append the trailer
+	data, err := json.Marshal(trailer)
+	if err != nil {
+		return fmt.Errorf("failed to marshal parity trailer: %w", err)
+	}
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(data)))
+	data = append(data, parityMagic...)
+	if _, err := out.Write(data); err != nil {
+		return fmt.Errorf("failed to write parity file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write parity file: %w", err)
+	}
+	if err := os.Rename(out.Name(), path+ParitySuffix); err != nil {
+		return fmt.Errorf("failed to save parity file: %w", err)
+	}
+	return nil
+}
+
+// RepairWithParity checks the file at path against its parity file and, if
+// it was damaged, rewrites it with the damaged blocks reconstructed. It
+// returns the number of blocks repaired. Files without a parity file are
+// left alone.
+func RepairWithParity(path string) (int, error) {
+	parity, err := os.Open(path + ParitySuffix)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open parity file: %w", err)
+	}
+	defer parity.Close()
+	trailer, err := readParityTrailer(parity)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	// Most files are intact
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) == trailer.SHA256 {
+		return 0, nil
+	}
+
+	encoder, err := reedsolomon.New(trailer.DataShards, trailer.ParityShards)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create parity decoder: %w", err)
+	}
+	out, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create repaired file: %w", err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	// Reconstruct the damaged blocks of each group
+	repaired, parityDamaged := 0, false
+	blocks := len(trailer.Checksums)
+	shards := newShards(trailer.DataShards+trailer.ParityShards, trailer.BlockSize)
+	for group := 0; group < trailer.groups(); group++ {
+		damaged := 0
+		work := make([][]byte, len(shards))
+		for i := range shards {
+			clear(shards[i])
+			work[i] = shards[i]
+			var ok bool
+			var sum uint32
+			if i < trailer.DataShards {
+				block := trailer.block(group, i)
+				if block >= blocks {
+					continue // Padding
+				}
+				ok, sum = trailer.readBlock(file, shards[i], block), trailer.Checksums[block]
+			} else {
+				index := group*trailer.ParityShards + i - trailer.DataShards
+				n, _ := parity.ReadAt(shards[i], int64(index)*int64(trailer.BlockSize))
+				ok, sum = n == trailer.BlockSize, trailer.ParityChecksums[index]
+			}
+			if !ok || crc32.Checksum(shards[i], parityTable) != sum {
+				work[i] = nil
+				damaged++
+				if i < trailer.DataShards {
+					repaired++
+				} else {
+					parityDamaged = true
+				}
+			}
+		}
+		if damaged > trailer.ParityShards {
+			return 0, fmt.Errorf("%s has %d damaged blocks in block group %d, more than its %d parity blocks can repair",
+				path, damaged, group+1, trailer.ParityShards)
+		}
+		if damaged > 0 {
+			if err := encoder.ReconstructData(work); err != nil {
+				return 0, fmt.Errorf("failed to repair %s: %w", path, err)
+			}
+		}
+
+		// Write the data blocks in place, the last one without its padding
+		for i := 0; i < trailer.DataShards; i++ {
+			block := trailer.block(group, i)
+			if block >= blocks {
+				continue
+			}
+			offset := int64(block) * int64(trailer.BlockSize)
+			if _, err := out.WriteAt(work[i][:min(int64(trailer.BlockSize), trailer.Size-offset)], offset); err != nil {
+				return 0, fmt.Errorf("failed to write repaired file: %w", err)
+			}
+		}
+	}
+
+	// Check the result as a whole
+	hasher.Reset()
+	if _, err := io.Copy(hasher, io.NewSectionReader(out, 0, trailer.Size)); err != nil {
+		return 0, fmt.Errorf("failed to read repaired file: %w", err)
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != trailer.SHA256 {
+		return 0, fmt.Errorf("failed to repair %s: the result does not match its parity file", path)
+	}
+
+	if err := out.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write repaired file: %w", err)
+	}
+	if info, err := file.Stat(); err == nil {
+		os.Chmod(out.Name(), info.Mode().Perm())
+	}
+	if err := os.Rename(out.Name(), path); err != nil {
+		return 0, fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+
+	// Renew parity blocks that were damaged too
+	if parityDamaged {
+		parity.Close()
+		if err := WriteParity(path, trailer.Percent); err != nil {
+			return repaired, err
+		}
+	}
+	return repaired, nil
+}
+
+// readParityTrailer reads the trailer at the end of a parity file
+func readParityTrailer(parity *os.File) (*parityTrailer, error) {
+	info, err := parity.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat parity file: %w", err)
+	}
+	tail := make([]byte, 8+len(parityMagic))
+	if info.Size() < int64(len(tail)) {
+		return nil, fmt.Errorf("parity file is damaged: too short")
+	}
+	if _, err := parity.ReadAt(tail, info.Size()-int64(len(tail))); err != nil {
+		return nil, fmt.Errorf("failed to read parity file: %w", err)
+	}
+	if !bytes.Equal(tail[8:], []byte(parityMagic)) {
+		return nil, fmt.Errorf("parity file is damaged or not a parity file")
+	}
+	length := int64(binary.LittleEndian.Uint64(tail))
+	if length <= 0 || length > info.Size()-int64(len(tail)) {
+		return nil, fmt.Errorf("parity file is damaged: invalid trailer length")
+	}
+	data := make([]byte, length)
+	if _, err := parity.ReadAt(data, info.Size()-int64(len(tail))-length); err != nil {
+		return nil, fmt.Errorf("failed to read parity file: %w", err)
+	}
+
+	var trailer parityTrailer
+	if err := json.Unmarshal(data, &trailer); err != nil {
+		return nil, fmt.Errorf("parity file is damaged: %w", err)
+	}
+	if trailer.Format != parityFormat {
+		return nil, fmt.Errorf("unsupported parity file format %d", trailer.Format)
+	}
+	if trailer.BlockSize <= 0 || trailer.DataShards <= 0 || trailer.ParityShards <= 0 ||
+		int64(len(trailer.Checksums)) != (trailer.Size+int64(trailer.BlockSize)-1)/int64(trailer.BlockSize) ||
+		len(trailer.ParityChecksums) != trailer.groups()*trailer.ParityShards {
+		return nil, fmt.Errorf("parity file is damaged: inconsistent trailer")
+	}
+	return &trailer, nil
+}
+
+// newShards allocates n shards of size bytes
+func newShards(n, size int) [][]byte {
+	shards := make([][]byte, n)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+	}
+	return shards
+}
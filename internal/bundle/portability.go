@@ -0,0 +1,198 @@
+package bundle
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/pkg/utils"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Kinds of path portability issues
+const (
+	IssueCaseCollision = "case-collision" // Differs from another path only in case
+	IssueReservedName  = "reserved-name"  // Reserved device name on Windows
+	IssueInvalidName   = "invalid-name"   // Characters or endings Windows does not allow
+	IssueNormalization = "normalization"  // Differs from another path only in Unicode normalization
+	IssueTooLong       = "too-long"       // Too long for Windows without the \\?\ prefix
+)
+
+// PathIssue describes a path that cannot be created as-is on some systems
+type PathIssue struct {
+	Path   string
+	Kind   string
+	Detail string
+}
+
+// windowsReserved are the device names Windows reserves, with or without an
+// extension
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// windowsInvalidChars are the characters Windows does not allow in names
+const windowsInvalidChars = `<>:"|?*\`
+
+// CaseInsensitive reports whether the default filesystem of an operating
+// system (a runtime.GOOS value) ignores case
+func CaseInsensitive(goos string) bool {
+	return goos == "windows" || goos == "darwin"
+}
+
+// CheckPaths returns the issues of paths that could not be created as-is on
+// the given operating system, a runtime.GOOS value. An empty goos checks for
+// every system, as when a bundle is created.
+func CheckPaths(paths []string, goos string) []PathIssue {
+	var issues []PathIssue
+
+	// Paths differing only in case collide on case-insensitive filesystems,
+	// which also treat composed and decomposed forms of a name as the same
+	if goos == "" || CaseInsensitive(goos) {
+		seen := make(map[string]string, len(paths))
+		for _, p := range paths {
+			key := strings.ToLower(norm.NFC.String(p))
+			if first, ok := seen[key]; ok && first != p {
+				kind, detail := IssueCaseCollision, fmt.Sprintf("differs from %s only in case", first)
+				if norm.NFC.String(first) == norm.NFC.String(p) {
+					kind, detail = IssueNormalization, fmt.Sprintf("differs from %s only in Unicode normalization", first)
+				}
+				issues = append(issues, PathIssue{Path: p, Kind: kind, Detail: detail})
+				continue
+			}
+			seen[key] = p
+		}
+	}
+
+	// Windows reserves device names and some characters
+	if goos == "" || goos == "windows" {
+		for _, p := range paths {
+			for _, name := range nameComponents(p) {
+				if detail := windowsNameProblem(name); detail != "" {
+					kind := IssueInvalidName
+					if windowsReserved[reservedStem(name)] {
+						kind = IssueReservedName
+					}
+					issues = append(issues, PathIssue{Path: p, Kind: kind, Detail: detail})
+					break
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].Path < issues[j].Path })
+	return issues
+}
+
+// LongPathIssues returns the issues of paths too long for Windows to open
+// without the \\?\ prefix, for when long_paths is off
+func LongPathIssues(paths []string) []PathIssue {
+	var issues []PathIssue
+	for _, p := range paths {
+		if len(p) >= utils.WindowsMaxPath {
+			issues = append(issues, PathIssue{
+				Path:   p,
+				Kind:   IssueTooLong,
+				Detail: fmt.Sprintf("is %d characters long, over the Windows limit of %d (long_paths is off)", len(p), utils.WindowsMaxPath-1),
+			})
+		}
+	}
+	return issues
+}
+
+// Normalize returns path in a Unicode normalization form, a
+// unicode_normalization value. Other forms leave the path unchanged.
+func Normalize(path, form string) string {
+	switch form {
+	case config.NormalizationNFC:
+		return norm.NFC.String(path)
+	case config.NormalizationNFD:
+		return norm.NFD.String(path)
+	}
+	return path
+}
+
+// nameComponents returns the names making up a path, without the volume
+func nameComponents(path string) []string {
+	path = strings.TrimPrefix(path, filepath.VolumeName(path))
+	return strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == filepath.Separator
+	})
+}
+
+// reservedStem returns the part of a name Windows compares with device names
+func reservedStem(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	return strings.ToUpper(strings.TrimRight(name, " "))
+}
+
+// windowsNameProblem describes why Windows cannot create a name, or returns ""
+func windowsNameProblem(name string) string {
+	if windowsReserved[reservedStem(name)] {
+		return fmt.Sprintf("%s is a reserved device name on Windows", name)
+	}
+	for _, r := range name {
+		if r < 32 || strings.ContainsRune(windowsInvalidChars, r) {
+			return fmt.Sprintf("%s contains %q, which Windows does not allow", name, r)
+		}
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return fmt.Sprintf("%s ends in a dot or space, which Windows drops", name)
+	}
+	return ""
+}
+
+// PortablePath returns a variant of path that avoids an issue: reserved and
+// invalid names get a safe name, and case and normalization collisions get a
+// numbered suffix that is not in taken (compared case-insensitively). The
+// result is added to taken.
+func PortablePath(issue PathIssue, taken map[string]bool) string {
+	dir, name := filepath.Split(issue.Path)
+
+	if issue.Kind != IssueCaseCollision && issue.Kind != IssueNormalization {
+		// Rename every offending component so files keep their directory
+		volume := filepath.VolumeName(dir)
+		var parts []string
+		for _, part := range strings.Split(dir[len(volume):], string(filepath.Separator)) {
+			parts = append(parts, portableName(part))
+		}
+		dir = volume + strings.Join(parts, string(filepath.Separator))
+		name = portableName(name)
+	}
+
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	candidate := dir + name
+	for n := 2; taken[strings.ToLower(candidate)]; n++ {
+		candidate = fmt.Sprintf("%s%s~%d%s", dir, stem, n, ext)
+	}
+	taken[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// portableName replaces what Windows does not allow in a name
+func portableName(name string) string {
+	if name == "" || windowsNameProblem(name) == "" {
+		return name
+	}
+	var b strings.Builder
+	for _, r := range name {
+		if r < 32 || strings.ContainsRune(windowsInvalidChars, r) {
+			r = '_'
+		}
+		b.WriteRune(r)
+	}
+	name = strings.TrimRight(b.String(), ". ")
+	if name == "" || windowsReserved[reservedStem(name)] {
+		name = "_" + name
+	}
+	return name
+}
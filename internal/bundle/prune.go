@@ -0,0 +1,59 @@
+package bundle
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Prune removes bundles in <dsp-dir>/bundles last modified before cutoff,
+// along with their encrypted copies, parity files and email messages, and
+// returns the paths it removed. The newest bundle is always kept.
+func Prune(dspDir string, cutoff time.Time) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dspDir, "bundles", "*.zip"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bundles: %w", err)
+	}
+
+	type bundleFile struct {
+		path    string
+		modTime time.Time
+	}
+	var files []bundleFile
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, bundleFile{path: path, modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	var removed []string
+	for i := 0; i < len(files)-1; i++ {
+		if !files[i].modTime.Before(cutoff) {
+			break
+		}
+		if err := os.Remove(files[i].path); err != nil {
+			return removed, fmt.Errorf("failed to remove bundle %s: %w", filepath.Base(files[i].path), err)
+		}
+		if err := os.Remove(files[i].path + ".age"); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to remove encrypted bundle %s: %w", filepath.Base(files[i].path), err)
+		}
+		for _, parity := range []string{files[i].path + ParitySuffix, files[i].path + ".age" + ParitySuffix} {
+			if err := os.Remove(parity); err != nil && !os.IsNotExist(err) {
+				return removed, fmt.Errorf("failed to remove parity file %s: %w", filepath.Base(parity), err)
+			}
+		}
+		messages, _ := filepath.Glob(files[i].path + "*.eml")
+		for _, message := range messages {
+			if err := os.Remove(message); err != nil {
+				return removed, fmt.Errorf("failed to remove email message %s: %w", filepath.Base(message), err)
+			}
+		}
+		removed = append(removed, files[i].path)
+	}
+	return removed, nil
+}
@@ -0,0 +1,320 @@
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Mattddixo/dsp/internal/atrest"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// Reader provides random access to the contents of a bundle archive. Only the
+// metadata is read when the bundle is opened; file contents are decompressed
+// on demand, one file at a time.
+type Reader struct {
+	Bundle  *Bundle
+	zip     io.Closer
+	entries map[string]*zip.File
+}
+
+// OpenReader opens a bundle archive for random access. A bundle sealed with
+// encrypt_at_rest is decrypted first: into memory when it is small, and
+// otherwise to a temporary file next to it, which Close wipes and removes.
+func OpenReader(path string) (*Reader, error) {
+	zr, closer, err := openArchive(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bundle: %w", err)
+	}
+
+	r := &Reader{
+		zip:     closer,
+		entries: make(map[string]*zip.File, len(zr.File)),
+	}
+	for _, f := range zr.File {
+		r.entries[f.Name] = f
+	}
+
+	// Read metadata
+	metadataFile, ok := r.entries[MetadataEntry]
+	if !ok {
+		closer.Close()
+		return nil, fmt.Errorf("bundle has no %s", MetadataEntry)
+	}
+	rc, err := metadataFile.Open()
+	if err != nil {
+		closer.Close()
+		return nil, fmt.Errorf("failed to open bundle metadata: %w", err)
+	}
+	defer rc.Close()
+
+	var b Bundle
+	if err := json.NewDecoder(rc).Decode(&b); err != nil {
+		closer.Close()
+		return nil, fmt.Errorf("failed to parse bundle metadata: %w", err)
+	}
+	if err := b.CheckFormat(); err != nil {
+		closer.Close()
+		return nil, err
+	}
+	r.Bundle = &b
+
+	return r, nil
+}
+
+// maxSealedInMemory is the size up to which sealed bundles are decrypted
+// into memory. Larger ones are decrypted to a temporary file, so opening
+// many bundles does not hold them all in memory.
+var maxSealedInMemory int64 = 8 << 20
+
+// openArchive opens the zip archive at path, decrypting it first if it is
+// sealed
+func openArchive(path string) (*zip.Reader, io.Closer, error) {
+	sealed, err := atrest.IsSealed(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sealed && info.Size() <= maxSealedInMemory {
+		data, err := atrest.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			utils.Wipe(data)
+			return nil, nil, err
+		}
+		return zr, wipeCloser(data), nil
+	}
+
+	plain, cleanup := path, func() {}
+	if sealed {
+		if plain, cleanup, err = atrest.Plain(path, true); err != nil {
+			return nil, nil, err
+		}
+	}
+	zr, err := zip.OpenReader(plain)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return &zr.Reader, &plainCloser{zr, cleanup}, nil
+}
+
+// wipeCloser wipes a decrypted archive when its reader is closed
+type wipeCloser []byte
+
+func (w wipeCloser) Close() error {
+	utils.Wipe(w)
+	return nil
+}
+
+// plainCloser closes an archive and removes its decrypted copy, if any
+type plainCloser struct {
+	zip     *zip.ReadCloser
+	cleanup func()
+}
+
+func (p *plainCloser) Close() error {
+	err := p.zip.Close()
+	p.cleanup()
+	return err
+}
+
+// Close closes the underlying archive
+func (r *Reader) Close() error {
+	return r.zip.Close()
+}
+
+// Changes returns the changes whose path equals prefix or lies below it. An
+// empty prefix returns all changes.
+func (r *Reader) Changes(prefix string) []Change {
+	if prefix == "" {
+		return r.Bundle.Changes
+	}
+
+	prefix = filepath.Clean(prefix)
+	var changes []Change
+	for _, change := range r.Bundle.Changes {
+		if change.Path == prefix || strings.HasPrefix(change.Path, prefix+string(filepath.Separator)) {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// entryFor returns the archive entry holding the content for a path
+func (r *Reader) entryFor(path string) (*zip.File, error) {
+	// Prefer the content index, fall back to the content hash for older bundles
+	name := ""
+	if entry, ok := r.Bundle.Index[path]; ok {
+		name = entry.Entry
+	} else {
+		for _, change := range r.Bundle.Changes {
+			if change.Path == path && change.ContentHash != "" {
+				name = contentEntryName(change.ContentHash)
+				break
+			}
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("bundle has no content for %s", path)
+	}
+
+	f, ok := r.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("bundle content %s for %s is missing", name, path)
+	}
+	return f, nil
+}
+
+// OpenRaw returns a reader for the compressed content of a path as stored in
+// the bundle
+func (r *Reader) OpenRaw(path string) (io.ReadCloser, error) {
+	f, err := r.entryFor(path)
+	if err != nil {
+		return nil, err
+	}
+	return f.Open()
+}
+
+// Open returns a reader for the decompressed content of a path
+func (r *Reader) Open(path string) (io.ReadCloser, error) {
+	raw, err := r.OpenRaw(path)
+	if err != nil {
+		return nil, err
+	}
+
+	decompressed, err := utils.NewDecompressReader(raw)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return &contentReader{ReadCloser: decompressed, raw: raw}, nil
+}
+
+// ReadFile returns the decompressed content of a path
+func (r *Reader) ReadFile(path string) ([]byte, error) {
+	rc, err := r.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content for %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// OpenRawChunk returns a reader for a compressed chunk as stored in the bundle
+func (r *Reader) OpenRawChunk(hash string) (io.ReadCloser, error) {
+	entry, ok := r.Bundle.ChunkIndex[hash]
+	if !ok {
+		return nil, fmt.Errorf("bundle has no chunk %s", hash)
+	}
+	f, ok := r.entries[entry.Entry]
+	if !ok {
+		return nil, fmt.Errorf("bundle chunk %s is missing", hash)
+	}
+	return f.Open()
+}
+
+// ReadChunk returns the decompressed content of a chunk, or an error if the
+// bundle does not carry it
+func (r *Reader) ReadChunk(hash string) ([]byte, error) {
+	raw, err := r.OpenRawChunk(hash)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := io.ReadAll(raw)
+	raw.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s: %w", hash, err)
+	}
+	if utils.HashBytes(compressed) != strings.TrimPrefix(r.Bundle.ChunkIndex[hash].Entry, ContentsDir+"/") {
+		return nil, fmt.Errorf("chunk %s does not match its archive entry", hash)
+	}
+	return utils.Decompress(compressed)
+}
+
+// OpenRawBase returns a reader for the compressed base content of a path
+func (r *Reader) OpenRawBase(path string) (io.ReadCloser, error) {
+	for _, change := range r.Bundle.Changes {
+		if change.Path != path || change.BaseContentHash == "" {
+			continue
+		}
+		f, ok := r.entries[contentEntryName(change.BaseContentHash)]
+		if !ok {
+			return nil, fmt.Errorf("bundle base content for %s is missing", path)
+		}
+		return f.Open()
+	}
+	return nil, fmt.Errorf("bundle has no base content for %s", path)
+}
+
+// ReadBase returns the decompressed base content of a path, the version in
+// the bundle's source snapshot
+func (r *Reader) ReadBase(path string) ([]byte, error) {
+	raw, err := r.OpenRawBase(path)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := io.ReadAll(raw)
+	raw.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base content for %s: %w", path, err)
+	}
+
+	for _, change := range r.Bundle.Changes {
+		if change.Path == path && utils.HashBytes(compressed) != change.BaseContentHash {
+			return nil, fmt.Errorf("base content hash mismatch for %s", path)
+		}
+	}
+	return utils.Decompress(compressed)
+}
+
+// ExtractFile writes the decompressed content of a path to dest
+func (r *Reader) ExtractFile(path, dest string) error {
+	rc, err := r.Open(path)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create parent directory: %w", err)
+	}
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	if _, err := io.Copy(out, rc); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to extract %s: %w", path, err)
+	}
+	return out.Close()
+}
+
+// contentReader closes both the decompressor and the archive entry
+type contentReader struct {
+	io.ReadCloser
+	raw io.ReadCloser
+}
+
+// Close closes the decompressor and the underlying archive entry
+func (c *contentReader) Close() error {
+	c.ReadCloser.Close()
+	return c.raw.Close()
+}
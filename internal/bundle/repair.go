@@ -0,0 +1,230 @@
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// RepairInfo marks a bundle salvaged from a damaged archive
+type RepairInfo struct {
+	RepairedAt time.Time `json:"repaired_at"`
+	Lost       []string  `json:"lost"` // Paths of the changes left out
+}
+
+// DamagedEntry is an archive entry that could not be read intact
+type DamagedEntry struct {
+	Name   string
+	Reason string
+}
+
+// LostChange is a change whose contents were damaged
+type LostChange struct {
+	Change
+	Reason string
+}
+
+// RepairReport describes what a bundle archive still holds
+type RepairReport struct {
+	Entries     int            // Entries found in the archive
+	Scanned     bool           // The central directory was unreadable; entries were found by scanning
+	Damaged     []DamagedEntry // Entries cut off or failing their checks
+	Bundle      *Bundle        // Metadata of the bundle, nil if it was lost
+	Salvageable []Change       // Changes whose contents are intact
+	Lost        []LostChange   // Changes that cannot be applied from this archive
+}
+
+// Intact reports whether the archive has no damage
+func (r *RepairReport) Intact() bool {
+	return !r.Scanned && len(r.Damaged) == 0
+}
+
+// Repair checks every entry of the bundle archive at src against its CRC-32,
+// and contents also against the hash they are named by. If the central
+// directory is damaged the entries are found by scanning the archive. If the
+// bundle is damaged and dst is not empty, the changes whose contents are
+// intact are written to dst as a partial bundle.
+func Repair(ctx context.Context, src, dst string) (*RepairReport, error) {
+	z, err := utils.OpenRecoveredZip(src)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+
+	report := &RepairReport{Entries: len(z.Entries), Scanned: z.Scanned}
+	for _, name := range z.Truncated {
+		report.Damaged = append(report.Damaged, DamagedEntry{Name: name, Reason: "cut off"})
+	}
+
+	// Check the entries
+	intact := make(map[string]*utils.RecoveredEntry, len(z.Entries))
+	var metadata bytes.Buffer
+	for _, entry := range z.Entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var err error
+		switch name := path.Base(entry.Name); {
+		case entry.Name == MetadataEntry:
+			err = entry.Check(&metadata)
+		case path.Dir(entry.Name) == ContentsDir && len(name) == sha256.Size*2:
+			hasher := sha256.New()
+			if err = entry.Check(hasher); err == nil && hex.EncodeToString(hasher.Sum(nil)) != name {
+				err = fmt.Errorf("content does not match its hash")
+			}
+		default:
+			err = entry.Check(nil)
+		}
+		if err != nil {
+			report.Damaged = append(report.Damaged, DamagedEntry{Name: entry.Name, Reason: err.Error()})
+			continue
+		}
+		intact[entry.Name] = entry
+	}
+
+	if intact[MetadataEntry] == nil {
+		return report, fmt.Errorf("bundle metadata is lost; no changes can be recovered")
+	}
+	var b Bundle
+	if err := json.Unmarshal(metadata.Bytes(), &b); err != nil {
+		return report, fmt.Errorf("failed to parse bundle metadata: %w", err)
+	}
+	if err := b.CheckFormat(); err != nil {
+		return report, err
+	}
+	report.Bundle = &b
+
+	// Sort the changes by whether their contents survived
+	omitted := make(map[string]bool, len(b.Omitted))
+	for _, hash := range b.Omitted {
+		omitted[hash] = true
+	}
+	for _, change := range b.Changes {
+		if reason := b.damage(change, intact, omitted); reason != "" {
+			report.Lost = append(report.Lost, LostChange{Change: change, Reason: reason})
+			continue
+		}
+		// The base version only helps merging; apply does without it
+		if change.BaseContentHash != "" && intact[contentEntryName(change.BaseContentHash)] == nil {
+			change.BaseContentHash = ""
+		}
+		report.Salvageable = append(report.Salvageable, change)
+	}
+
+	if dst == "" || report.Intact() {
+		return report, nil
+	}
+	if len(report.Salvageable) == 0 {
+		return report, fmt.Errorf("none of the %d changes of bundle %s can be recovered", len(b.Changes), b.ID)
+	}
+	return report, b.savePartial(ctx, dst, report, intact, omitted)
+}
+
+// damage returns why a change cannot be applied from the intact entries, or
+// "" if it can
+func (b *Bundle) damage(change Change, intact map[string]*utils.RecoveredEntry, omitted map[string]bool) string {
+	if change.ContentHash != "" && !omitted[change.Hash] {
+		if name := b.contentEntry(change); intact[name] == nil {
+			return "content damaged"
+		}
+	}
+	for _, c := range change.Chunks {
+		if entry, ok := b.ChunkIndex[c.Hash]; ok && !omitted[c.Hash] && intact[entry.Entry] == nil {
+			return fmt.Sprintf("chunk %s damaged", c.Hash)
+		}
+	}
+	return ""
+}
+
+// contentEntry returns the archive entry holding the content of a change
+func (b *Bundle) contentEntry(change Change) string {
+	if entry, ok := b.Index[change.Path]; ok {
+		return entry.Entry
+	}
+	return contentEntryName(change.ContentHash)
+}
+
+// savePartial writes the salvageable changes of a repair to dst, copying
+// their contents from the intact entries
+func (b *Bundle) savePartial(ctx context.Context, dst string, report *RepairReport, intact map[string]*utils.RecoveredEntry, omitted map[string]bool) error {
+	partial := *b
+	partial.Changes = report.Salvageable
+	partial.Index = make(map[string]IndexEntry)
+	partial.ChunkIndex = make(map[string]IndexEntry)
+	partial.Repaired = &RepairInfo{RepairedAt: time.Now()}
+	for _, lost := range report.Lost {
+		partial.Repaired.Lost = append(partial.Repaired.Lost, lost.Path)
+	}
+	var names []string
+	for _, change := range partial.Changes {
+		if change.ContentHash != "" && !omitted[change.Hash] {
+			name := b.contentEntry(change)
+			names = append(names, name)
+			if entry, ok := b.Index[change.Path]; ok {
+				partial.Index[change.Path] = entry
+			}
+		}
+		if change.BaseContentHash != "" {
+			names = append(names, contentEntryName(change.BaseContentHash))
+		}
+		for _, c := range change.Chunks {
+			if entry, ok := b.ChunkIndex[c.Hash]; ok && !omitted[c.Hash] {
+				names = append(names, entry.Entry)
+				partial.ChunkIndex[c.Hash] = entry
+			}
+		}
+	}
+	// Contents left out of delta bundles are filled in on import
+	check := partial
+	check.Omitted = nil
+	if err := check.Verify(); err != nil {
+		return fmt.Errorf("salvaged bundle is not valid: %w", err)
+	}
+
+	zw, err := utils.NewZipWriter(dst, b.CreatedAt)
+	if err != nil {
+		return err
+	}
+	defer zw.Close()
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if zw.Has(name) {
+			continue
+		}
+		w, err := zw.Create(name, zip.Store)
+		if err != nil {
+			return err
+		}
+		rc, err := intact[name].Open()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		_, err = utils.CopyBuffered(w, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy %s: %w", name, err)
+		}
+	}
+
+	metadata, err := json.MarshalIndent(&partial, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal bundle metadata: %w", err)
+	}
+	if err := zw.WriteEntry(MetadataEntry, zip.Deflate, metadata); err != nil {
+		return fmt.Errorf("failed to write bundle metadata: %w", err)
+	}
+	if err := zw.Commit(); err != nil {
+		return fmt.Errorf("failed to save bundle archive: %w", err)
+	}
+	return nil
+}
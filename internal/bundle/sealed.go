@@ -0,0 +1,83 @@
+package bundle
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Mattddixo/dsp/internal/atrest"
+)
+
+// Seal encrypts the bundle at path with the local age key for
+// encrypt_at_rest (see internal/atrest). A parity file next to the bundle is
+// rewritten to protect the sealed bundle, so bit rot can still be repaired
+// without the key.
+func Seal(path string) error {
+	sealed, err := atrest.IsSealed(path)
+	if err != nil {
+		return fmt.Errorf("failed to read bundle: %w", err)
+	}
+	if sealed {
+		return nil
+	}
+
+	percent, err := parityPercent(path)
+	if err != nil {
+		return err
+	}
+	if percent > 0 {
+		// Sealing reads the whole bundle, so repair it first
+		if _, err := RepairWithParity(path); err != nil {
+			return err
+		}
+	}
+	if err := atrest.Seal(path); err != nil {
+		return fmt.Errorf("failed to encrypt bundle: %w", err)
+	}
+	if percent > 0 {
+		return WriteParity(path, percent)
+	}
+	return nil
+}
+
+// Plain returns a path holding the plain bundle at path, for callers that
+// hash, serve or upload the archive itself. A sealed bundle is decrypted to a
+// temporary file, with a parity file next to it if the bundle has one;
+// cleanup removes both, wiping them first if wipe is set.
+func Plain(path string, wipe bool) (string, func(), error) {
+	plain, cleanup, err := atrest.Plain(path, wipe)
+	if err != nil || plain == path {
+		return plain, cleanup, err
+	}
+
+	percent, err := parityPercent(path)
+	if err != nil || percent == 0 {
+		return plain, cleanup, err
+	}
+	removeAll := func() {
+		cleanup()
+		os.Remove(plain + ParitySuffix)
+	}
+	if err := WriteParity(plain, percent); err != nil {
+		removeAll()
+		return "", nil, err
+	}
+	return plain, removeAll, nil
+}
+
+// parityPercent returns the parity percentage of the parity file of the file
+// at path, or 0 if it has none
+func parityPercent(path string) (int, error) {
+	parity, err := os.Open(path + ParitySuffix)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open parity file: %w", err)
+	}
+	defer parity.Close()
+	trailer, err := readParityTrailer(parity)
+	if err != nil {
+		return 0, err
+	}
+	return trailer.Percent, nil
+}
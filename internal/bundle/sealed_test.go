@@ -0,0 +1,155 @@
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/atrest"
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+func TestSealedBundle(t *testing.T) {
+	t.Setenv(config.GlobalDirEnv, t.TempDir())
+	keyManager, err := crypto.NewKeyManager()
+	if err != nil {
+		t.Fatalf("key manager: %v", err)
+	}
+	if err := keyManager.GenerateKeyPair(); err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "bundle.zip")
+	if err := linkBundle("").Save(context.Background(), path); err != nil {
+		t.Fatalf("save bundle: %v", err)
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteParity(path, 20); err != nil {
+		t.Fatalf("write parity: %v", err)
+	}
+
+	if err := Seal(path); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if sealed, err := atrest.IsSealed(path); err != nil || !sealed {
+		t.Fatalf("bundle not sealed: %v", err)
+	}
+
+	// The parity file protects the sealed bundle
+	sealedData, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := bytes.Clone(sealedData)
+	damaged[len(damaged)/2] ^= 0xff
+	if err := os.WriteFile(path, damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if repaired, err := RepairWithParity(path); err != nil || repaired == 0 {
+		t.Fatalf("repair sealed bundle: repaired %d, %v", repaired, err)
+	}
+
+	// Readers see the plain bundle
+	r, err := OpenReader(path)
+	if err != nil {
+		t.Fatalf("open sealed bundle: %v", err)
+	}
+	if r.Bundle.ID != "test-bundle" {
+		t.Fatalf("read bundle %q", r.Bundle.ID)
+	}
+	r.Close()
+
+	plain, cleanup, err := Plain(path, false)
+	if err != nil {
+		t.Fatalf("plain copy: %v", err)
+	}
+	defer cleanup()
+	got, err := os.ReadFile(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("plain copy differs from the bundle as saved")
+	}
+	if _, err := os.Stat(plain + ParitySuffix); err != nil {
+		t.Fatalf("plain copy has no parity file: %v", err)
+	}
+}
+
+func TestContentStoreSealed(t *testing.T) {
+	t.Setenv(config.GlobalDirEnv, t.TempDir())
+	keyManager, err := crypto.NewKeyManager()
+	if err != nil {
+		t.Fatalf("key manager: %v", err)
+	}
+	if err := keyManager.GenerateKeyPair(); err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	dir := t.TempDir()
+	contents := map[string]string{"first": "first contents", "second": "second contents"}
+	for name, data := range contents {
+		compressed, err := utils.Compress([]byte(data), 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := linkBundle("")
+		b.ID = name
+		b.Changes[0].Hash = "hash-" + name
+		b.FileContents = map[string][]byte{"/repo/a.txt": compressed}
+		path := filepath.Join(dir, name+".zip")
+		if err := b.Save(context.Background(), path); err != nil {
+			t.Fatalf("save bundle: %v", err)
+		}
+		if err := Seal(path); err != nil {
+			t.Fatalf("seal: %v", err)
+		}
+	}
+
+	// Both the in-memory and the temporary file decryption, the latter
+	// leaving no plain copy behind once closed
+	for _, limit := range []int64{maxSealedInMemory, 0} {
+		defer func(saved int64) { maxSealedInMemory = saved }(maxSealedInMemory)
+		maxSealedInMemory = limit
+
+		store := NewContentStore("sha256", dir)
+		for name, want := range contents {
+			got, ok := store.Find("/repo/a.txt", "hash-"+name)
+			if !ok || string(got) != want {
+				t.Fatalf("limit %d: found %q, %v; want %q", limit, got, ok, want)
+			}
+		}
+		open := 0
+		for _, b := range store.bundles {
+			if b.reader != nil {
+				open++
+			}
+		}
+		if open != 1 {
+			t.Fatalf("limit %d: %d sealed bundles open, want 1", limit, open)
+		}
+		plainCopies, err := filepath.Glob(filepath.Join(dir, ".*.plain-*.tmp"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limit == 0 && len(plainCopies) != 1 {
+			t.Fatalf("limit %d: %d decrypted copies while open, want 1", limit, len(plainCopies))
+		}
+		store.Close()
+
+		leftover, err := filepath.Glob(filepath.Join(dir, ".*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(leftover) > 0 {
+			t.Fatalf("limit %d: decrypted copies left behind: %v", limit, leftover)
+		}
+	}
+}
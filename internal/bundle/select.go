@@ -0,0 +1,177 @@
+package bundle
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// isUnder reports whether path equals prefix or lies below it
+func isUnder(path, prefix string) bool {
+	path = filepath.Clean(path)
+	prefix = filepath.Clean(prefix)
+	if path == prefix {
+		return true
+	}
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, prefix)
+}
+
+// isUnderAny reports whether path equals or lies below any of the prefixes
+func isUnderAny(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if isUnder(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterFiles returns the snapshot files at or below the given paths. Hard
+// links to files outside them are dropped; those files carry their own
+// content. An empty list returns all files.
+func filterFiles(files []snapshot.File, paths []string) []snapshot.File {
+	if len(paths) == 0 {
+		return files
+	}
+
+	var filtered []snapshot.File
+	for _, f := range files {
+		if isUnderAny(f.Path, paths) {
+			if f.LinkTo != "" && !isUnderAny(f.LinkTo, paths) {
+				f.LinkTo = ""
+			}
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered
+}
+
+// filterDirs returns the snapshot directories at or below the given paths,
+// keeping nil for snapshots that do not record directories. An empty list
+// returns all directories.
+func filterDirs(dirs []snapshot.Directory, paths []string) []snapshot.Directory {
+	if len(paths) == 0 || dirs == nil {
+		return dirs
+	}
+
+	filtered := make([]snapshot.Directory, 0)
+	for _, d := range dirs {
+		if isUnderAny(d.Path, paths) {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+// selectTrackedPaths returns a copy of the tracking configuration narrowed to
+// the given paths. Tracked paths below a selected path are kept as-is; a
+// selected path below a tracked directory is tracked on its own, inheriting
+// the directory's excludes. An empty list returns the configuration unchanged.
+func selectTrackedPaths(config *snapshot.TrackingConfig, paths []string) *snapshot.TrackingConfig {
+	if len(paths) == 0 {
+		return config
+	}
+
+	selected := &snapshot.TrackingConfig{State: config.State}
+	seen := make(map[string]bool)
+	add := func(tp snapshot.TrackedPath) {
+		if !seen[tp.Path] {
+			seen[tp.Path] = true
+			selected.Paths = append(selected.Paths, tp)
+		}
+	}
+
+	for _, tracked := range config.Paths {
+		if isUnderAny(tracked.Path, paths) {
+			add(tracked)
+			continue
+		}
+		if !tracked.IsDir {
+			continue
+		}
+		for _, p := range paths {
+			if isUnder(p, tracked.Path) {
+				add(snapshot.TrackedPath{
+					Path:     filepath.Clean(p),
+					IsDir:    isDir(p),
+					Excludes: tracked.Excludes,
+				})
+			}
+		}
+	}
+	return selected
+}
+
+// isDir reports whether a path is an existing directory
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// Redaction records the files left out of a bundle when it was created
+type Redaction struct {
+	Patterns []string `json:"patterns"` // Patterns relative to the repository root
+	Files    int      `json:"files"`    // Files of the target snapshot left out
+}
+
+// isRedacted reports whether a path below root matches a redaction pattern.
+// Patterns without a slash match a name at any depth, like *.pem; others are
+// relative to root, and a pattern matching a directory covers its contents.
+func isRedacted(path, root string, patterns []string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "/") {
+			pattern = "**/" + pattern
+		}
+		if utils.MatchPathPattern(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactFiles returns the snapshot files that match none of the redaction
+// patterns and the paths of those that do
+func redactFiles(files []snapshot.File, root string, patterns []string) ([]snapshot.File, []string) {
+	if len(patterns) == 0 {
+		return files, nil
+	}
+
+	var kept []snapshot.File
+	var redacted []string
+	for _, f := range files {
+		if isRedacted(f.Path, root, patterns) {
+			redacted = append(redacted, f.Path)
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept, redacted
+}
+
+// redactDirs returns the snapshot directories that match none of the
+// redaction patterns, keeping nil for snapshots that do not record
+// directories
+func redactDirs(dirs []snapshot.Directory, root string, patterns []string) []snapshot.Directory {
+	if len(patterns) == 0 || dirs == nil {
+		return dirs
+	}
+
+	kept := make([]snapshot.Directory, 0, len(dirs))
+	for _, d := range dirs {
+		if !isRedacted(d.Path, root, patterns) {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,244 @@
+package bundle
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Mattddixo/dsp/internal/atrest"
+	"github.com/Mattddixo/dsp/internal/objects"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// ContentStore reconstructs file contents for a given hash. Snapshots only
+// record hashes, so content comes from the working tree when it still
+// matches, from the repository's object store, or from bundle archives in
+// the given directories.
+type ContentStore struct {
+	hashAlgorithm string
+	dirs          []string
+	objects       *objects.Store
+	bundles       []*storedBundle
+	opened        bool
+	unsealed      *storedBundle // The sealed bundle currently decrypted
+}
+
+// storedBundle is a bundle the store searches. Plain bundles stay open;
+// sealed ones are decrypted only while their contents are read, one at a
+// time, so the store never holds every stored bundle in memory.
+type storedBundle struct {
+	path   string
+	bundle *Bundle
+	reader *Reader // nil while a sealed bundle is closed
+}
+
+// NewContentStore creates a content store searching bundles in dirs
+func NewContentStore(hashAlgorithm string, dirs ...string) *ContentStore {
+	return &ContentStore{hashAlgorithm: hashAlgorithm, dirs: dirs}
+}
+
+// UseObjects makes the store look up contents kept at snapshot time. A nil
+// store is ignored.
+func (s *ContentStore) UseObjects(store *objects.Store) {
+	s.objects = store
+}
+
+// openBundles reads the metadata of all readable bundles once
+func (s *ContentStore) openBundles() {
+	if s.opened {
+		return
+	}
+	s.opened = true
+
+	for _, dir := range s.dirs {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.zip"))
+		for _, path := range matches {
+			sealed, err := atrest.IsSealed(path)
+			if err != nil {
+				continue
+			}
+			r, err := OpenReader(path)
+			if err != nil {
+				continue // Skip unreadable bundles
+			}
+			stored := &storedBundle{path: path, bundle: r.Bundle, reader: r}
+			if sealed {
+				r.Close()
+				stored.reader = nil
+			}
+			s.bundles = append(s.bundles, stored)
+		}
+	}
+}
+
+// reader returns the open reader of a stored bundle, decrypting a sealed
+// bundle again and closing the one decrypted before it
+func (s *ContentStore) reader(b *storedBundle) (*Reader, error) {
+	if b.reader != nil {
+		return b.reader, nil
+	}
+	if s.unsealed != nil {
+		s.unsealed.reader.Close()
+		s.unsealed.reader = nil
+		s.unsealed = nil
+	}
+	r, err := OpenReader(b.path)
+	if err != nil {
+		return nil, err
+	}
+	b.reader = r
+	s.unsealed = b
+	return r, nil
+}
+
+// Close closes any open bundles
+func (s *ContentStore) Close() {
+	for _, b := range s.bundles {
+		if b.reader != nil {
+			b.reader.Close()
+		}
+	}
+	s.bundles = nil
+	s.unsealed = nil
+}
+
+// Find returns the content of a file version, or false if it is not available
+func (s *ContentStore) Find(path, hash string) ([]byte, bool) {
+	// Use the working tree if it still holds this version
+	if current, err := utils.HashFile(path, s.hashAlgorithm); err == nil && current == hash {
+		if data, err := os.ReadFile(path); err == nil {
+			return data, true
+		}
+	}
+
+	// Use the contents kept at snapshot time
+	if s.objects != nil {
+		if data, err := s.objects.Get(hash); err == nil {
+			return data, true
+		}
+	}
+
+	// Look for a bundle that carries this version, as new or base content
+	s.openBundles()
+	for _, b := range s.bundles {
+		for _, change := range b.bundle.Changes {
+			if change.Path != path {
+				continue
+			}
+			if change.Hash == hash && change.Type != "delete" {
+				if data, ok := s.read(b, path, false); ok {
+					return data, true
+				}
+			}
+			if change.BaseHash == hash && change.BaseContentHash != "" {
+				if data, ok := s.read(b, path, true); ok {
+					return data, true
+				}
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// Hashes returns the hashes of the file versions and chunks the store can
+// provide without the working tree: those kept at snapshot time and those
+// carried by bundles
+func (s *ContentStore) Hashes() map[string]bool {
+	hashes := make(map[string]bool)
+	if s.objects != nil {
+		if stored, err := s.objects.Hashes(); err == nil {
+			for _, hash := range stored {
+				hashes[hash] = true
+			}
+		}
+	}
+
+	s.openBundles()
+	for _, b := range s.bundles {
+		if len(b.bundle.Omitted) > 0 {
+			continue
+		}
+		for _, change := range b.bundle.Changes {
+			if change.Type != "delete" && change.ContentHash != "" {
+				hashes[change.Hash] = true
+			}
+			if change.BaseContentHash != "" {
+				hashes[change.BaseHash] = true
+			}
+		}
+		for hash := range b.bundle.ChunkIndex {
+			hashes[hash] = true
+		}
+	}
+	return hashes
+}
+
+// FindHash returns the content of a file version wherever it was recorded,
+// or false if it is not available. Unlike Find it does not look at the
+// working tree.
+func (s *ContentStore) FindHash(hash string) ([]byte, bool) {
+	if s.objects != nil {
+		if data, err := s.objects.Get(hash); err == nil {
+			return data, true
+		}
+	}
+
+	s.openBundles()
+	for _, b := range s.bundles {
+		for _, change := range b.bundle.Changes {
+			if change.Hash == hash && change.Type != "delete" && change.ContentHash != "" {
+				if data, ok := s.read(b, change.Path, false); ok {
+					return data, true
+				}
+			}
+			if change.BaseHash == hash && change.BaseContentHash != "" {
+				if data, ok := s.read(b, change.Path, true); ok {
+					return data, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// FindChunk returns a chunk as stored in a bundle, compressed, or false if
+// no bundle carries it
+func (s *ContentStore) FindChunk(hash string) ([]byte, bool) {
+	s.openBundles()
+	for _, b := range s.bundles {
+		if _, ok := b.bundle.ChunkIndex[hash]; !ok {
+			continue
+		}
+		r, err := s.reader(b)
+		if err != nil {
+			continue
+		}
+		raw, err := r.OpenRawChunk(hash)
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(raw)
+		raw.Close()
+		if err == nil {
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+// read returns the new or, with base set, the base content of path carried by
+// a stored bundle
+func (s *ContentStore) read(b *storedBundle, path string, base bool) ([]byte, bool) {
+	r, err := s.reader(b)
+	if err != nil {
+		return nil, false
+	}
+	var data []byte
+	if base {
+		data, err = r.ReadBase(path)
+	} else {
+		data, err = r.ReadFile(path)
+	}
+	return data, err == nil
+}
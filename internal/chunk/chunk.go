@@ -0,0 +1,131 @@
+// Package chunk splits large files into content-defined chunks. Chunk
+// boundaries depend on the bytes around them rather than their offset, so an
+// edit in the middle of a file only changes the chunks it touches and the
+// rest can be reused from an earlier version.
+//
+// Boundaries are found with a gear rolling hash and normalized chunking as
+// described for FastCDC: a stricter mask before the average size and a looser
+// one after it keep chunk sizes close to the average.
+package chunk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// Chunk sizes
+const (
+	MinSize = 256 << 10
+	AvgSize = 1 << 20
+	MaxSize = 4 << 20
+)
+
+// Threshold is the size from which files are chunked
+const Threshold = 8 << 20
+
+// Masks for normalized chunking around the 20-bit average size. Bits are
+// taken from the top of the hash, which depends on the last 64 bytes.
+const (
+	maskSmall = uint64(1<<22-1) << (64 - 22)
+	maskLarge = uint64(1<<18-1) << (64 - 18)
+)
+
+// Chunk is a piece of a file, identified by the hash of its content
+type Chunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// gear maps each byte to a random value for the rolling hash. The table is
+// generated from a fixed seed, so boundaries are the same on every host.
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x6473702d63646300) // "dsp-cdc"
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// cut returns the length of the chunk at the start of data
+func cut(data []byte) int {
+	n := len(data)
+	if n <= MinSize {
+		return n
+	}
+	if n > MaxSize {
+		n = MaxSize
+	}
+	normal := AvgSize
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Split reads r to the end and returns its chunks, hashed with the given
+// algorithm. If fn is not nil it is called with each chunk and its data; the
+// data is only valid during the call.
+func Split(r io.Reader, algorithm string, fn func(c Chunk, data []byte) error) ([]Chunk, error) {
+	var chunks []Chunk
+	buf := make([]byte, 2*MaxSize)
+	start, end := 0, 0
+	eof := false
+
+	for {
+		// Keep at least one maximum chunk buffered
+		if !eof && end-start < MaxSize {
+			copy(buf, buf[start:end])
+			end -= start
+			start = 0
+			n, err := io.ReadFull(r, buf[end:])
+			end += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to read data: %w", err)
+			}
+		}
+		if start == end {
+			return chunks, nil
+		}
+
+		length := cut(buf[start:end])
+		data := buf[start : start+length]
+		hash, err := utils.HashReader(bytes.NewReader(data), algorithm)
+		if err != nil {
+			return nil, err
+		}
+		c := Chunk{Hash: hash, Size: int64(length)}
+		if fn != nil {
+			if err := fn(c, data); err != nil {
+				return nil, err
+			}
+		}
+		chunks = append(chunks, c)
+		start += length
+	}
+}
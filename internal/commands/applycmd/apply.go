@@ -4,8 +4,17 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/audit"
+	"github.com/Mattddixo/dsp/internal/bundle"
 	"github.com/Mattddixo/dsp/internal/commands/flags"
+	"github.com/Mattddixo/dsp/internal/exitcode"
+	"github.com/Mattddixo/dsp/internal/hooks"
+	"github.com/Mattddixo/dsp/internal/ledger"
+	"github.com/Mattddixo/dsp/internal/notify"
+	"github.com/Mattddixo/dsp/internal/objects"
 	"github.com/Mattddixo/dsp/internal/repo"
 	"github.com/Mattddixo/dsp/internal/snapshot"
 	"github.com/urfave/cli/v2"
@@ -17,15 +26,110 @@ var Command = &cli.Command{
 	Description: `Apply a bundle of changes to the current state.
 This will apply all the changes contained in the specified bundle file.
 If the bundle contains new tracked paths, they will be added to the local tracking configuration.
-If the paths don't exist locally, they will be created.`,
+If the paths don't exist locally, they will be created.
+
+Files that changed locally since the latest snapshot are not overwritten
+unless --force is given. Local edits to text files are merged with the
+bundle's changes, using the version the bundle was created from as the base;
+overlapping edits are written with conflict markers. Changes that cannot be
+merged are deferred instead.
+
+Once the changes are applied, every written file is hashed again and
+compared with the bundle's hash; files that do not match are reported as
+failed. --progress prints each change as it is applied, with its size and
+outcome, such as:
+
+  [12/340] M configs/app.yaml (2.1 KB): verified
+
+Partial apply:
+  Use --path to apply only part of a bundle. The remaining changes are
+  recorded as deferred changes that can be applied later with --deferred
+  or dropped with --discard-deferred.
+
+Examples:
+  # Apply a bundle
+  dsp apply -b bundle.zip
+
+  # Apply only configuration changes, defer the rest
+  dsp apply -b bundle.zip --path configs/ --path scripts/deploy.sh
+
+  # Choose the changes to apply from a list, deferring the rest
+  dsp apply -b bundle.zip --interactive
+
+  # Follow a large apply file by file
+  dsp apply -b bundle.zip --progress
+
+  # List deferred changes
+  dsp apply --list-deferred
+
+  # Apply deferred changes from a bundle (optionally limited with --path)
+  dsp apply --deferred 20240101120000
+
+  # Discard deferred changes from a bundle
+  dsp apply --discard-deferred 20240101120000
+
+  # Undo an apply, restoring the files it changed
+  dsp apply --undo 20240101120000
+
+Path issues:
+  Paths that differ only in case collide on Windows and macOS, and Windows
+  does not allow reserved names such as CON or aux, or characters such as
+  ':' and '?'. Such paths refuse the apply unless --path-issues is rename,
+  which writes them to a safe name, or skip, which defers them.
+
+  Paths of 260 characters or more are written on Windows with the \\?\
+  prefix. With long_paths set to off in config.yaml they are path issues
+  instead, which rename handles by skipping them.
+
+  Names from macOS are often in decomposed Unicode (NFD), and may reach a
+  bundle next to the composed (NFC) form of the same name. Set
+  unicode_normalization to nfc or nfd in config.yaml to write every path in
+  one form; a bundle whose paths would then clash is refused.
+
+Symlinks:
+  Symlinks are recreated with the target recorded in the bundle. Links that
+  would point outside the repository, following the links already on disk,
+  are refused and reported as failed unless --allow-external-symlinks is
+  given. Files and directories are never written through links that lead
+  outside the repository.
+
+Path policy:
+  <dsp-dir>/policy constrains what bundles may do to parts of the
+  repository, even with --force. Each line maps a pattern, relative to the
+  repository root, to comma-separated rules:
+
+    configs/** : never-delete
+    secrets/** : skip
+    data/**    : prefer-newer-mtime
+
+  skip leaves matching paths alone, never-delete refuses deletes, and
+  prefer-newer-mtime keeps local files modified after the incoming version
+  while letting newer incoming versions replace local edits. ** matches any
+  number of directories, and a pattern matching a directory covers what is
+  below it. Refused changes are listed after the apply and not deferred.
+
+Backups:
+  Before a file is modified or deleted, the original is copied to
+  <dsp-dir>/backups/<bundle-id>/. Use --undo to restore them; files changed
+  again since the apply are skipped unless --force is given. The newest
+  backup_retention backups (config.yaml, default 5) are kept.
+
+Ledger:
+  Every apply and undo is recorded in <dsp-dir>/applied.yaml. Applying a
+  bundle that is already recorded as applied is refused unless --reapply
+  is given.
+
+Hooks:
+  If <dsp-dir>/hooks/pre-apply exists it runs before the bundle is applied;
+  a non-zero exit aborts the apply. <dsp-dir>/hooks/post-apply runs afterwards
+  with DSP_BUNDLE_PATH set. Use --no-hooks to skip them.`,
 	Flags: []cli.Flag{
 		flags.VerboseFlag,
 		flags.QuietFlag,
 		&cli.StringFlag{
-			Name:     "bundle",
-			Aliases:  []string{"b"},
-			Usage:    "Path to the bundle file",
-			Required: true,
+			Name:    "bundle",
+			Aliases: []string{"b"},
+			Usage:   "Path to the bundle file",
 		},
 		&cli.BoolFlag{
 			Name:    "force",
@@ -33,6 +137,59 @@ If the paths don't exist locally, they will be created.`,
 			Usage:   "Force apply even if there are conflicts",
 			Value:   false,
 		},
+		&cli.BoolFlag{
+			Name:  "reapply",
+			Usage: "Apply the bundle even if it was already applied",
+		},
+		&cli.StringFlag{
+			Name:  "path-issues",
+			Usage: "How to handle paths this system cannot create as-is: fail, skip (defer them) or rename",
+			Value: pathIssuesFail,
+		},
+		&cli.BoolFlag{
+			Name:    "interactive",
+			Aliases: []string{"i"},
+			Usage:   "Review the changes and choose which to apply; the others are deferred",
+		},
+		&cli.BoolFlag{
+			Name:  "progress",
+			Usage: "Print each change as it is applied, with its size and whether it verified",
+		},
+		&cli.BoolFlag{
+			Name:  "allow-external-symlinks",
+			Usage: "Create symlinks that point outside the repository",
+		},
+		&cli.StringSliceFlag{
+			Name:    "path",
+			Aliases: []string{"p"},
+			Usage:   "Only apply changes at or below this path (can be repeated)",
+		},
+		&cli.StringFlag{
+			Name:  "deferred",
+			Usage: "Apply deferred changes from the bundle with this ID",
+		},
+		&cli.StringFlag{
+			Name:  "discard-deferred",
+			Usage: "Discard deferred changes from the bundle with this ID",
+		},
+		&cli.BoolFlag{
+			Name:  "list-deferred",
+			Usage: "List deferred changes",
+		},
+		&cli.StringFlag{
+			Name:  "undo",
+			Usage: "Restore the files changed by applying the bundle with this ID",
+		},
+		&cli.BoolFlag{
+			Name:  "list-backups",
+			Usage: "List backups that can be restored with --undo",
+		},
+		&cli.StringFlag{
+			Name:    "repo",
+			Aliases: []string{"r"},
+			Usage:   "Path to the repository (default: nearest repository)",
+		},
+		flags.NoHooksFlag,
 	},
 	Action: func(c *cli.Context) error {
 		verbose := c.Bool("verbose")
@@ -40,12 +197,22 @@ If the paths don't exist locally, they will be created.`,
 		bundlePath := c.String("bundle")
 		force := c.Bool("force")
 
-		if verbose {
-			fmt.Println("Applying bundle...")
-			if force {
-				fmt.Println("Force mode enabled")
+		// Count actions
+		actions := 0
+		for _, set := range []bool{
+			bundlePath != "", c.String("deferred") != "", c.String("discard-deferred") != "",
+			c.Bool("list-deferred"), c.String("undo") != "", c.Bool("list-backups"),
+		} {
+			if set {
+				actions++
 			}
 		}
+		if actions == 0 {
+			return fmt.Errorf("no bundle specified. Usage: dsp apply -b <bundle> [--path PATH...], or use --deferred, --discard-deferred, --list-deferred, --undo or --list-backups")
+		}
+		if actions > 1 {
+			return fmt.Errorf("--bundle, --deferred, --discard-deferred, --list-deferred, --undo and --list-backups cannot be combined")
+		}
 
 		// Create repository manager
 		manager, err := repo.NewManager()
@@ -53,11 +220,6 @@ If the paths don't exist locally, they will be created.`,
 			return fmt.Errorf("failed to create repository manager: %w", err)
 		}
 
-		// Verify bundle file exists
-		if _, err := os.Stat(bundlePath); os.IsNotExist(err) {
-			return fmt.Errorf("bundle file does not exist: %s", bundlePath)
-		}
-
 		// Get current repository context
 		currentRepo, err := manager.GetCurrentRepo(c.String("repo"))
 		if err != nil {
@@ -67,73 +229,573 @@ If the paths don't exist locally, they will be created.`,
 		// Get DSP directory path from repository config
 		dspDir := filepath.Join(currentRepo.Path, currentRepo.DSPDir)
 
-		// Load local tracking configuration
-		localTracking, err := snapshot.LoadTrackingConfig(dspDir)
-		if err != nil {
-			return fmt.Errorf("failed to load local tracking config: %w", err)
+		// Resolve selected paths
+		var selected []string
+		for _, p := range c.StringSlice("path") {
+			absPath, err := filepath.Abs(p)
+			if err != nil {
+				return fmt.Errorf("failed to get absolute path for %s: %w", p, err)
+			}
+			selected = append(selected, absPath)
 		}
 
-		// TODO: Extract bundle and get its tracking configuration
-		// This would involve:
-		// 1. Reading the bundle file
-		// 2. Extracting the tracking configuration
-		// 3. Comparing with local tracking configuration
-		// 4. Adding any new tracked paths
+		// Handle list-deferred action
+		if c.Bool("list-deferred") {
+			return listDeferredChanges(dspDir, verbose)
+		}
+
+		// Handle discard-deferred action
+		if id := c.String("discard-deferred"); id != "" {
+			return discardDeferredChanges(dspDir, id, selected, quiet)
+		}
+
+		// Handle list-backups action
+		if c.Bool("list-backups") {
+			return listBackupChanges(dspDir, verbose)
+		}
+
+		// Handle undo action
+		if id := c.String("undo"); id != "" {
+			return undoApply(dspDir, id, force, verbose, quiet)
+		}
+
+		// Determine the bundle to apply and which of its changes are eligible
+		var record *deferredRecord
+		if id := c.String("deferred"); id != "" {
+			record, err = loadDeferred(dspDir, id)
+			if err != nil {
+				return err
+			}
+			bundlePath = record.bundlePath(dspDir)
+		} else if _, err := os.Stat(bundlePath); os.IsNotExist(err) {
+			return fmt.Errorf("bundle file does not exist: %s", bundlePath)
+		}
+
+		// Repair bit rot with the parity file of the bundle, if it has one
+		if repaired, err := bundle.RepairWithParity(bundlePath); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to check %s against its parity file: %v\n", bundlePath, err)
+		} else if repaired > 0 {
+			fmt.Printf("Repaired %d damaged blocks of %s with its parity file\n", repaired, bundlePath)
+		}
 
 		if verbose {
 			fmt.Printf("Reading bundle from: %s\n", bundlePath)
+			if force {
+				fmt.Println("Force mode enabled")
+			}
 		}
 
-		// For each tracked path in the bundle:
-		// 1. Check if it exists locally
-		// 2. If not, create the directory structure
-		// 3. Apply the changes from the bundle
-		// 4. Update the local tracking configuration
-
-		// Example of how this would work:
-		/*
-			for _, path := range bundleTracking.Paths {
-				// Check if path exists
-				if _, err := os.Stat(path.Path); os.IsNotExist(err) {
-					if verbose {
-						fmt.Printf("Creating directory structure for: %s\n", path.Path)
-					}
-
-					// Create directory if it doesn't exist
-					if err := os.MkdirAll(filepath.Dir(path.Path), 0755); err != nil {
-						return fmt.Errorf("failed to create directory: %w", err)
-					}
-				}
+		// Load repository configuration
+		repoConfig, err := config.NewWithRepo(currentRepo.Path, currentRepo.DSPDir)
+		if err != nil {
+			return fmt.Errorf("failed to load repository configuration: %w", err)
+		}
+
+		// Open bundle
+		reader, err := bundle.OpenReader(bundlePath)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		if err := reader.Bundle.Verify(); err != nil {
+			return fmt.Errorf("bundle verification failed: %w", err)
+		}
+		bundleID := reader.Bundle.ID
+		if repaired := reader.Bundle.Repaired; repaired != nil && len(repaired.Lost) > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: bundle %s was salvaged from a damaged archive and lacks %d changes; apply an intact copy with --reapply for them\n",
+				bundleID, len(repaired.Lost))
+		}
+		if r := reader.Bundle.Redacted; r != nil && !quiet {
+			fmt.Printf("Bundle %s was redacted: %d files matching %s were left out\n",
+				bundleID, r.Files, strings.Join(r.Patterns, ", "))
+		}
 
-				// Add to local tracking if not already tracked
-				found := false
-				for _, localPath := range localTracking.Paths {
-					if localPath.Path == path.Path {
-						found = true
-						break
-					}
+		// Refuse bundles that were already applied
+		applied, err := ledger.Load(dspDir)
+		if err != nil {
+			return err
+		}
+		if record == nil && applied.IsApplied(bundleID) && !c.Bool("reapply") {
+			last := applied.Last(bundleID)
+			msg := fmt.Sprintf("bundle %s was already applied on %s (%s)",
+				bundleID, last.AppliedAt.Format("2006-01-02 15:04:05"), last.Result)
+			if last.Result == ledger.ResultPartial {
+				msg += fmt.Sprintf("; use 'dsp apply --deferred %s' for the remaining changes", bundleID)
+			}
+			return fmt.Errorf("%s; use --reapply to apply it again", msg)
+		}
+
+		// Check the bundle extends the history seen here
+		lineage, err := ledger.LoadLineage(dspDir)
+		if err != nil {
+			return err
+		}
+		if b := reader.Bundle; b.Lineage != nil && record == nil {
+			switch relation, peers := lineage.Compare(b.Lineage); relation {
+			case ledger.Diverged:
+				fmt.Fprintf(os.Stderr, "Warning: histories have diverged: this repository has bundles from %s that %s had not seen when bundle %s was created. Local changes may be overwritten; run 'dsp sync plan -b %s' to review.\n",
+					lineage.Describe(peers), b.Repository.Name, bundleID, bundlePath)
+			case ledger.Stale:
+				fmt.Fprintf(os.Stderr, "Warning: bundle %s contains no history newer than this repository's\n", bundleID)
+			}
+		}
+
+		if b := reader.Bundle; record == nil && !b.IsInitial {
+			if last := applied.LastTarget(b.Repository.Name); last != "" && last != b.SourceSnapshot {
+				fmt.Fprintf(os.Stderr, "Warning: bundle %s starts at snapshot %s, but the last bundle applied from %s ended at %s; earlier bundles may be missing\n",
+					bundleID, b.SourceSnapshot, b.Repository.Name, last)
+			}
+		}
+
+		// Run pre-apply hook
+		hookCtx := hooks.Context{
+			RepoName: currentRepo.Name,
+			RepoPath: currentRepo.Path,
+			DSPDir:   dspDir,
+			Disabled: c.Bool("no-hooks"),
+		}
+		absBundlePath, err := filepath.Abs(bundlePath)
+		if err != nil {
+			return fmt.Errorf("failed to get absolute path: %w", err)
+		}
+		hookVars := map[string]string{"BUNDLE_PATH": absBundlePath, "BUNDLE_ID": bundleID}
+		if err := hooks.Run(hookCtx, hooks.PreApply, hookVars); err != nil {
+			return fmt.Errorf("apply aborted: %w", err)
+		}
+
+		// Split changes into those to apply now and those to defer
+		var eligible map[string]bool
+		if record != nil {
+			eligible = make(map[string]bool, len(record.Paths))
+			for _, p := range record.Paths {
+				eligible[p] = true
+			}
+		}
+		var toApply []bundle.Change
+		var toDefer []string
+		normalized := make(map[string]string) // Bundle paths by normalized path
+		for _, change := range reader.Bundle.Changes {
+			// Bring paths to the configured Unicode form, refusing paths
+			// that become the same. Content is still read under the
+			// bundle path.
+			if form := repoConfig.UnicodeNormalization; form != "" && form != config.NormalizationNone {
+				original := change.Path
+				change.Path = bundle.Normalize(change.Path, form)
+				if other, ok := normalized[change.Path]; ok && other != original {
+					return fmt.Errorf("bundle paths %s and %s are the same after %s normalization; set unicode_normalization to none to apply them as recorded",
+						other, original, strings.ToUpper(form))
 				}
-				if !found {
-					if err := snapshot.AddTrackedPath(localTracking, path.Path, "bundle-import"); err != nil {
-						return fmt.Errorf("failed to add path to tracking: %w", err)
-					}
+				normalized[change.Path] = original
+			}
+
+			if eligible != nil && !eligible[change.Path] {
+				continue
+			}
+			if len(selected) > 0 && !isUnderAny(change.Path, selected) {
+				toDefer = append(toDefer, change.Path)
+				continue
+			}
+			toApply = append(toApply, change)
+		}
+		if len(toApply) == 0 {
+			return fmt.Errorf("no changes in bundle %s match the selected paths", bundleID)
+		}
+
+		// Set up the applier
+		applier := newApplier(reader, dspDir, force, verbose)
+		defer applier.Close()
+		applier.backup = newBackup(dspDir, bundleID, applier.hashAlgorithm, repoConfig.EncryptAtRest)
+		applier.root = currentRepo.Path
+		applier.protected = []string{dspDir}
+		if dataDir := repoConfig.DataDirIn(currentRepo.Path); filepath.Clean(dataDir) != filepath.Clean(currentRepo.Path) {
+			applier.protected = append(applier.protected, dataDir)
+		}
+		applier.bundlePaths = normalized
+		applier.store.UseObjects(objects.ForRepo(currentRepo.Path, repoConfig))
+		applier.allowExternalSymlinks = c.Bool("allow-external-symlinks")
+		if c.Bool("progress") && !quiet {
+			// Progress lines replace the verbose list of changes
+			applier.progress, applier.verbose = true, false
+		}
+		applier.longPathsOff = !repoConfig.LongPathsEnabled()
+		if applier.policy, err = loadPolicy(dspDir, currentRepo.Path); err != nil {
+			return err
+		}
+
+		// Let the user choose the changes to apply now; the others are deferred
+		if c.Bool("interactive") {
+			var deferred []string
+			toApply, deferred, err = reviewChanges(applier, toApply, os.Stdin, os.Stdout)
+			if err != nil {
+				return err
+			}
+			toDefer = append(toDefer, deferred...)
+		}
+
+		// Handle paths this system cannot create as-is
+		toApply, skipped, err := resolvePathIssues(toApply, c.String("path-issues"), repoConfig.LongPathsEnabled(), quiet, applier.bundlePaths)
+		if err != nil {
+			return err
+		}
+		toDefer = append(toDefer, skipped...)
+
+		// Apply changes
+		if verbose {
+			fmt.Printf("Applying %d changes...\n", len(toApply))
+		}
+		result := applier.apply(c.Context, toApply)
+
+		// Save the backup and drop old ones
+		if err := applier.backup.save(dspDir); err != nil {
+			return err
+		}
+		if err := pruneBackups(dspDir, repoConfig.GetBackupRetention()); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+		if repoConfig.EncryptAtRest {
+			if sealed, err := sealBackups(dspDir); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			} else if sealed > 0 && !quiet {
+				fmt.Printf("Encrypted %d backed up files (encrypt_at_rest)\n", sealed)
+			}
+		}
+
+		// Record deferred changes, including those an interrupt left unapplied
+		for _, changes := range [][]bundle.Change{result.Conflicts, result.Interrupted} {
+			for _, change := range changes {
+				toDefer = append(toDefer, change.Path)
+			}
+		}
+		if record != nil {
+			done := make(map[string]bool)
+			for _, changes := range [][]bundle.Change{result.Applied, result.UpToDate, result.Merged, result.Unmerged} {
+				for _, change := range changes {
+					done[change.Path] = true
 				}
+			}
+			removeDeferredPaths(record, done)
+			if err := saveDeferred(dspDir, record); err != nil {
+				return err
+			}
+		} else if err := deferChanges(dspDir, bundleID, bundlePath, toDefer, repoConfig.EncryptAtRest); err != nil {
+			return err
+		}
 
-				// Apply changes from bundle
-				// TODO: Implement actual file application logic
+		// Record the apply in the ledger
+		entry := ledger.Entry{
+			BundleID:       bundleID,
+			SourceRepo:     reader.Bundle.Repository.Name,
+			SourceSnapshot: reader.Bundle.SourceSnapshot,
+			TargetSnapshot: reader.Bundle.TargetSnapshot,
+			AppliedBy:      config.CurrentUser(),
+			Applied:        len(result.Applied) + len(result.Merged) + len(result.Unmerged),
+			Conflicts:      len(result.Unmerged),
+			Deferred:       len(toDefer),
+			Failed:         len(result.Failed),
+		}
+		if record != nil {
+			entry.Deferred = len(record.Paths)
+		}
+		switch {
+		case entry.Failed > 0:
+			entry.Result = ledger.ResultFailed
+		case entry.Conflicts > 0:
+			entry.Result = ledger.ResultConflicts
+		case entry.Deferred > 0:
+			entry.Result = ledger.ResultPartial
+		default:
+			entry.Result = ledger.ResultApplied
+		}
+		applied.Record(entry)
+		if err := applied.Save(dspDir); err != nil {
+			return err
+		}
+		audit.Record(audit.Event{
+			Type:    audit.Apply,
+			Subject: bundleID,
+			Outcome: entry.Result,
+			Detail: fmt.Sprintf("from %s into %s: %d applied, %d conflicts, %d deferred, %d failed",
+				entry.SourceRepo, dspDir, entry.Applied, entry.Conflicts, entry.Deferred, entry.Failed),
+		})
+
+		// Advance the lineage unless nothing could be applied
+		if reader.Bundle.Lineage != nil && entry.Result != ledger.ResultFailed {
+			lineage.Merge(reader.Bundle.Lineage)
+			if err := lineage.Save(dspDir); err != nil {
+				return err
 			}
-		*/
+		}
 
-		// Save updated tracking configuration
-		if err := snapshot.SaveTrackingConfig(dspDir, localTracking); err != nil {
-			return fmt.Errorf("failed to save tracking config: %w", err)
+		// Add tracked paths from the bundle
+		if err := addTrackedPaths(dspDir, reader.Bundle, result.Applied); err != nil {
+			return err
 		}
 
 		if !quiet {
-			fmt.Println("Bundle applied successfully")
-			fmt.Println("Tracking configuration updated")
+			printSummary(bundleID, result, len(toDefer)-len(result.Conflicts), record != nil)
+		}
+		if len(result.Interrupted) > 0 {
+			return exitcode.PartialError(fmt.Errorf("apply interrupted; %d changes were deferred, use 'dsp apply --deferred %s' to apply them", len(result.Interrupted), bundleID))
+		}
+
+		// Run post-apply hook
+		hooks.RunPost(hookCtx, hooks.PostApply, hookVars)
+		notify.Send(notify.Event{
+			Event:      config.EventBundleApplied,
+			Repository: currentRepo.Name,
+			Subject:    bundleID,
+			Detail:     fmt.Sprintf("from %s: %s", entry.SourceRepo, entry.Result),
+		})
+		if conflicts := len(result.Conflicts) + len(result.Unmerged); conflicts > 0 {
+			notify.Send(notify.Event{
+				Event:      config.EventConflictDetected,
+				Repository: currentRepo.Name,
+				Subject:    bundleID,
+				Detail:     fmt.Sprintf("%d changes from %s conflict with local edits", conflicts, entry.SourceRepo),
+			})
 		}
 
+		if len(result.Failed) > 0 {
+			err := fmt.Errorf("%d changes could not be applied", len(result.Failed))
+			if entry.Applied > 0 {
+				return exitcode.PartialError(err)
+			}
+			return err
+		}
+		if conflicts := len(result.Conflicts) + len(result.Unmerged); conflicts > 0 {
+			return exitcode.ConflictsError(fmt.Errorf("%d changes conflict with local edits", conflicts))
+		}
 		return nil
 	},
 }
+
+// addTrackedPaths adds tracked paths from the bundle that cover applied
+// changes and are not yet tracked locally
+func addTrackedPaths(dspDir string, b *bundle.Bundle, applied []bundle.Change) error {
+	if len(applied) == 0 || b.Repository.TrackingConfig == nil {
+		return nil
+	}
+
+	localTracking, err := snapshot.LoadTrackingConfig(dspDir)
+	if err != nil {
+		return fmt.Errorf("failed to load local tracking config: %w", err)
+	}
+
+	added := 0
+	for _, tracked := range b.Repository.TrackingConfig.Paths {
+		covers := false
+		for _, change := range applied {
+			if isUnderAny(change.Path, []string{tracked.Path}) {
+				covers = true
+				break
+			}
+		}
+		if !covers {
+			continue
+		}
+		if err := snapshot.AddTrackedPathWithExcludes(localTracking, tracked); err == nil {
+			added++
+		}
+	}
+
+	if added == 0 {
+		return nil
+	}
+	if err := snapshot.SaveTrackingConfig(dspDir, localTracking); err != nil {
+		return fmt.Errorf("failed to save tracking config: %w", err)
+	}
+	return nil
+}
+
+// printSummary prints the outcome of an apply
+func printSummary(bundleID string, result *applyResult, deferred int, fromDeferred bool) {
+	fmt.Printf("Applied bundle %s: %d changes applied, %d already up to date\n",
+		bundleID, len(result.Applied), len(result.UpToDate))
+
+	if len(result.Merged) > 0 {
+		fmt.Printf("Merged %d changes with local edits\n", len(result.Merged))
+	}
+
+	if result.Verified > 0 || result.VerifyFailed > 0 {
+		fmt.Printf("Verified %d applied files against the bundle's hashes", result.Verified)
+		if result.VerifyFailed > 0 {
+			fmt.Printf(", %d failed", result.VerifyFailed)
+		}
+		fmt.Println()
+	}
+
+	if deferred > 0 {
+		fmt.Printf("Deferred %d changes not selected\n", deferred)
+	}
+
+	if len(result.Refused) > 0 {
+		fmt.Printf("\n%d changes were refused by the path policy:\n", len(result.Refused))
+		for _, change := range result.Refused {
+			fmt.Printf("  - %s (%s)\n", change.Path, result.RefusedBy[change.Path])
+		}
+	}
+
+	if len(result.Conflicts) > 0 {
+		fmt.Printf("\n%d changes conflict with local edits and were deferred:\n", len(result.Conflicts))
+		for _, change := range result.Conflicts {
+			fmt.Printf("  ! %s\n", change.Path)
+		}
+		fmt.Printf("Review them, then run 'dsp apply --deferred %s --force' to overwrite.\n", bundleID)
+	}
+
+	if len(result.Unmerged) > 0 {
+		fmt.Printf("\n%d files have merge conflicts; edit them to resolve the conflict markers:\n", len(result.Unmerged))
+		for _, change := range result.Unmerged {
+			fmt.Printf("  C %s\n", change.Path)
+		}
+	}
+
+	if len(result.Failed) > 0 {
+		fmt.Printf("\n%d changes failed:\n", len(result.Failed))
+		for _, change := range result.Failed {
+			fmt.Printf("  x %s: %v\n", change.Path, result.Errors[change.Path])
+		}
+	}
+
+	if (deferred > 0 || len(result.Conflicts) > 0) && !fromDeferred {
+		fmt.Printf("\nApply deferred changes later with 'dsp apply --deferred %s' or drop them with 'dsp apply --discard-deferred %s'\n",
+			bundleID, bundleID)
+	}
+}
+
+// listBackupChanges prints the backups available for undo
+func listBackupChanges(dspDir string, verbose bool) error {
+	manifests, err := listBackups(dspDir)
+	if err != nil {
+		return err
+	}
+	if len(manifests) == 0 {
+		fmt.Println("No backups")
+		return nil
+	}
+
+	for _, manifest := range manifests {
+		fmt.Printf("Bundle %s: %d files (applied %s)\n",
+			manifest.BundleID, len(manifest.Entries), manifest.CreatedAt.Format("2006-01-02 15:04:05"))
+		if verbose {
+			for _, entry := range manifest.Entries {
+				state := "modified"
+				if !entry.Existed {
+					state = "created"
+				} else if entry.AppliedHash == "" {
+					state = "deleted"
+				}
+				fmt.Printf("  %-8s %s\n", state, entry.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// undoApply restores the files changed by applying a bundle
+func undoApply(dspDir, bundleID string, force, verbose, quiet bool) error {
+	restored, skipped, err := restoreBackup(dspDir, bundleID, force, verbose)
+	if err != nil {
+		return err
+	}
+
+	// Record the undo once every file is restored
+	if len(skipped) == 0 {
+		applied, err := ledger.Load(dspDir)
+		if err != nil {
+			return err
+		}
+		applied.Record(ledger.Entry{
+			BundleID:  bundleID,
+			AppliedBy: config.CurrentUser(),
+			Result:    ledger.ResultUndone,
+			Applied:   restored,
+		})
+		if err := applied.Save(dspDir); err != nil {
+			return err
+		}
+		audit.Record(audit.Event{
+			Type:    audit.Apply,
+			Subject: bundleID,
+			Outcome: ledger.ResultUndone,
+			Detail:  fmt.Sprintf("%d files restored in %s", restored, dspDir),
+		})
+	}
+
+	if !quiet {
+		fmt.Printf("Restored %d files changed by bundle %s\n", restored, bundleID)
+	}
+	if len(skipped) > 0 {
+		fmt.Printf("\n%d files changed since the apply and were not restored:\n", len(skipped))
+		for _, path := range skipped {
+			fmt.Printf("  ! %s\n", path)
+		}
+		return fmt.Errorf("undo incomplete, re-run with --force to overwrite these files")
+	}
+	return nil
+}
+
+// listDeferredChanges prints all deferred changes
+func listDeferredChanges(dspDir string, verbose bool) error {
+	records, err := listDeferred(dspDir)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		fmt.Println("No deferred changes")
+		return nil
+	}
+
+	for _, record := range records {
+		fmt.Printf("Bundle %s: %d deferred changes (deferred %s)\n",
+			record.BundleID, len(record.Paths), record.DeferredAt.Format("2006-01-02 15:04:05"))
+		if verbose {
+			for _, p := range record.Paths {
+				fmt.Printf("  %s\n", p)
+			}
+		}
+	}
+	return nil
+}
+
+// discardDeferredChanges drops deferred changes for a bundle, optionally
+// limited to selected paths
+func discardDeferredChanges(dspDir, bundleID string, selected []string, quiet bool) error {
+	record, err := loadDeferred(dspDir, bundleID)
+	if err != nil {
+		return err
+	}
+
+	var remove map[string]bool
+	if len(selected) > 0 {
+		remove = make(map[string]bool)
+		for _, p := range record.Paths {
+			if isUnderAny(p, selected) {
+				remove[p] = true
+			}
+		}
+	}
+
+	before := len(record.Paths)
+	removeDeferredPaths(record, remove)
+	if err := saveDeferred(dspDir, record); err != nil {
+		return err
+	}
+
+	if !quiet {
+		fmt.Printf("Discarded %d deferred changes from bundle %s (%d remaining)\n",
+			before-len(record.Paths), bundleID, len(record.Paths))
+	}
+	return nil
+}
+
+// isUnderAny reports whether path equals or lies below any of the prefixes
+func isUnderAny(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		prefix = filepath.Clean(prefix)
+		if path == prefix || strings.HasPrefix(path, prefix+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,349 @@
+package applycmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/atrest"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+const (
+	// backupsDirName is the directory under the DSP directory holding apply backups
+	backupsDirName = "backups"
+
+	// backupManifestName is the manifest file inside a backup directory
+	backupManifestName = "manifest.json"
+
+	// backupFilesDir holds copies of the original files inside a backup directory
+	backupFilesDir = "files"
+)
+
+// backupEntry records the state of a file before apply changed it
+type backupEntry struct {
+	Path          string      `json:"path"`
+	Existed       bool        `json:"existed"`
+	IsSymlink     bool        `json:"is_symlink,omitempty"`
+	SymlinkTarget string      `json:"symlink_target,omitempty"`
+	Mode          os.FileMode `json:"mode,omitempty"`
+	ModifiedTime  time.Time   `json:"modified_time,omitempty"`
+	Stored        string      `json:"stored,omitempty"`       // Copy of the original under files/
+	Sealed        bool        `json:"sealed,omitempty"`       // The copy is encrypted with the local age key
+	AppliedHash   string      `json:"applied_hash,omitempty"` // Hash written by apply, empty if the file was removed
+}
+
+// backupManifest describes the backup taken for a bundle
+type backupManifest struct {
+	BundleID      string        `json:"bundle_id"`
+	CreatedAt     time.Time     `json:"created_at"`
+	HashAlgorithm string        `json:"hash_algorithm"`
+	Entries       []backupEntry `json:"entries"`
+}
+
+// backup collects original files while a bundle is applied
+type backup struct {
+	dir      string
+	manifest *backupManifest
+	index    map[string]int
+	seal     bool // Encrypt the copies at rest (encrypt_at_rest)
+}
+
+// backupsDir returns the backups directory
+func backupsDir(dspDir string) string {
+	return filepath.Join(dspDir, backupsDirName)
+}
+
+// backupDir returns the backup directory for a bundle
+func backupDir(dspDir, bundleID string) string {
+	return filepath.Join(backupsDir(dspDir), bundleID)
+}
+
+// loadBackupManifest loads the backup manifest for a bundle
+func loadBackupManifest(dspDir, bundleID string) (*backupManifest, error) {
+	data, err := os.ReadFile(filepath.Join(backupDir(dspDir, bundleID), backupManifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no backup for bundle %s (see 'dsp apply --list-backups')", bundleID)
+		}
+		return nil, fmt.Errorf("failed to read backup manifest: %w", err)
+	}
+
+	var manifest backupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse backup manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// saveBackupManifest writes the backup manifest for a bundle
+func saveBackupManifest(dspDir string, manifest *backupManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal backup manifest: %w", err)
+	}
+	path := filepath.Join(backupDir(dspDir, manifest.BundleID), backupManifestName)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write backup manifest: %w", err)
+	}
+	return nil
+}
+
+// newBackup starts or continues the backup for a bundle. Files already backed
+// up by an earlier apply of the same bundle keep their original copy. With
+// seal the copies are encrypted with the local age key.
+func newBackup(dspDir, bundleID, hashAlgorithm string, seal bool) *backup {
+	b := &backup{
+		dir:   backupDir(dspDir, bundleID),
+		index: make(map[string]int),
+		seal:  seal,
+	}
+	if manifest, err := loadBackupManifest(dspDir, bundleID); err == nil {
+		b.manifest = manifest
+		for i, entry := range manifest.Entries {
+			b.index[entry.Path] = i
+		}
+	} else {
+		b.manifest = &backupManifest{BundleID: bundleID, HashAlgorithm: hashAlgorithm}
+	}
+	b.manifest.CreatedAt = time.Now()
+	return b
+}
+
+// add records the current state of a file before it is changed
+func (b *backup) add(path string) error {
+	if _, ok := b.index[path]; ok {
+		return nil
+	}
+
+	entry := backupEntry{Path: path}
+	info, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+		// Nothing to keep, undo removes the file
+	case err != nil:
+		return fmt.Errorf("failed to stat file: %w", err)
+	case info.IsDir():
+		return fmt.Errorf("cannot back up directory %s", path)
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink: %w", err)
+		}
+		entry.Existed = true
+		entry.IsSymlink = true
+		entry.SymlinkTarget = target
+	default:
+		if err := os.MkdirAll(filepath.Join(b.dir, backupFilesDir), 0755); err != nil {
+			return fmt.Errorf("failed to create backup directory: %w", err)
+		}
+		entry.Existed = true
+		entry.Mode = info.Mode().Perm()
+		entry.ModifiedTime = info.ModTime()
+		entry.Stored = strconv.Itoa(len(b.manifest.Entries))
+		keep := utils.CopyFile
+		if b.seal {
+			keep = atrest.SealCopy
+			entry.Sealed = true
+		}
+		if err := keep(path, filepath.Join(b.dir, backupFilesDir, entry.Stored)); err != nil {
+			return fmt.Errorf("failed to copy file: %w", err)
+		}
+	}
+
+	b.index[path] = len(b.manifest.Entries)
+	b.manifest.Entries = append(b.manifest.Entries, entry)
+	return nil
+}
+
+// setApplied records the hash apply left at a path
+func (b *backup) setApplied(path, hash string) {
+	if i, ok := b.index[path]; ok {
+		b.manifest.Entries[i].AppliedHash = hash
+	}
+}
+
+// save writes the manifest if any files were backed up
+func (b *backup) save(dspDir string) error {
+	if len(b.manifest.Entries) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	return saveBackupManifest(dspDir, b.manifest)
+}
+
+// listBackups returns all backup manifests, newest first
+func listBackups(dspDir string) ([]*backupManifest, error) {
+	dirEntries, err := os.ReadDir(backupsDir(dspDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read backups directory: %w", err)
+	}
+
+	var manifests []*backupManifest
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() {
+			continue
+		}
+		manifest, err := loadBackupManifest(dspDir, dirEntry.Name())
+		if err != nil {
+			continue // Skip incomplete backups
+		}
+		manifests = append(manifests, manifest)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].CreatedAt.After(manifests[j].CreatedAt) })
+	return manifests, nil
+}
+
+// pruneBackups removes all but the newest keep backups
+func pruneBackups(dspDir string, keep int) error {
+	manifests, err := listBackups(dspDir)
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(manifests); i++ {
+		if err := os.RemoveAll(backupDir(dspDir, manifests[i].BundleID)); err != nil {
+			return fmt.Errorf("failed to remove old backup: %w", err)
+		}
+	}
+	return nil
+}
+
+// sealBackups encrypts the copies of backups taken before encrypt_at_rest was
+// turned on and returns the number of copies encrypted. Each copy is sealed
+// under a new name and the manifest saved before the plain copy is removed,
+// so an interrupted sweep never leaves a manifest naming the wrong copy.
+func sealBackups(dspDir string) (int, error) {
+	manifests, err := listBackups(dspDir)
+	if err != nil {
+		return 0, err
+	}
+
+	sealed := 0
+	for _, manifest := range manifests {
+		dir := filepath.Join(backupDir(dspDir, manifest.BundleID), backupFilesDir)
+		var plain []string
+		for i := range manifest.Entries {
+			entry := &manifest.Entries[i]
+			if entry.Stored == "" || entry.Sealed {
+				continue
+			}
+			stored := entry.Stored + ".age"
+			if err := atrest.SealCopy(filepath.Join(dir, entry.Stored), filepath.Join(dir, stored)); err != nil {
+				return sealed, fmt.Errorf("failed to encrypt backup of %s: %w", entry.Path, err)
+			}
+			plain = append(plain, filepath.Join(dir, entry.Stored))
+			entry.Stored = stored
+			entry.Sealed = true
+		}
+		if len(plain) == 0 {
+			continue
+		}
+		if err := saveBackupManifest(dspDir, manifest); err != nil {
+			return sealed, err
+		}
+		for _, path := range plain {
+			os.Remove(path)
+		}
+		sealed += len(plain)
+	}
+	return sealed, nil
+}
+
+// restoreBackup restores the files changed by applying a bundle. Files changed
+// again since the apply are skipped unless force is set. The backup is
+// removed once every file has been restored.
+func restoreBackup(dspDir, bundleID string, force, verbose bool) (restored int, skipped []string, err error) {
+	manifest, err := loadBackupManifest(dspDir, bundleID)
+	if err != nil {
+		return 0, nil, err
+	}
+	dir := backupDir(dspDir, bundleID)
+
+	var remaining []backupEntry
+	for i := len(manifest.Entries) - 1; i >= 0; i-- {
+		entry := manifest.Entries[i]
+
+		// Check the file still holds what apply wrote
+		current := ""
+		if _, err := os.Lstat(entry.Path); err == nil {
+			if current, err = utils.HashPath(entry.Path, manifest.HashAlgorithm); err != nil {
+				return restored, skipped, fmt.Errorf("failed to hash %s: %w", entry.Path, err)
+			}
+		}
+		if current != entry.AppliedHash && !force {
+			skipped = append(skipped, entry.Path)
+			remaining = append([]backupEntry{entry}, remaining...)
+			continue
+		}
+
+		if err := restoreEntry(dir, entry); err != nil {
+			return restored, skipped, fmt.Errorf("failed to restore %s: %w", entry.Path, err)
+		}
+		if verbose {
+			fmt.Printf("  restored %s\n", entry.Path)
+		}
+		restored++
+	}
+
+	// Keep entries that were not restored so undo can be retried
+	if len(remaining) > 0 {
+		manifest.Entries = remaining
+		return restored, skipped, saveBackupManifest(dspDir, manifest)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return restored, skipped, fmt.Errorf("failed to remove backup: %w", err)
+	}
+	return restored, skipped, nil
+}
+
+// restoreEntry puts a single file back into its backed up state
+func restoreEntry(dir string, entry backupEntry) error {
+	// Files created by apply are removed
+	if !entry.Existed {
+		if err := os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(entry.Path), 0755); err != nil {
+		return fmt.Errorf("failed to create parent directory: %w", err)
+	}
+
+	if entry.IsSymlink {
+		if err := os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Symlink(entry.SymlinkTarget, entry.Path)
+	}
+
+	// Copy next to the target, decrypting a sealed copy, and rename into place
+	tmp := entry.Path + ".dsp-restore"
+	restore := utils.CopyFile
+	if entry.Sealed {
+		restore = atrest.UnsealCopy
+	}
+	if err := restore(filepath.Join(dir, backupFilesDir, entry.Stored), tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, entry.Mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, entry.Path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	os.Chtimes(entry.Path, entry.ModifiedTime, entry.ModifiedTime)
+	return nil
+}
@@ -0,0 +1,99 @@
+package applycmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/crypto"
+)
+
+func TestSealedBackupRestore(t *testing.T) {
+	t.Setenv(config.GlobalDirEnv, t.TempDir())
+	keyManager, err := crypto.NewKeyManager()
+	if err != nil {
+		t.Fatalf("key manager: %v", err)
+	}
+	if err := keyManager.GenerateKeyPair(); err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	dspDir := t.TempDir()
+	root := t.TempDir()
+
+	// A tracked file may itself be age-encrypted; its backup must still be
+	// restored as it was
+	contents := map[string][]byte{
+		filepath.Join(root, "plain.txt"):   []byte("plain contents"),
+		filepath.Join(root, "secret.age"):  []byte("age-encryption.org/v1\nnot ours"),
+		filepath.Join(root, "earlier.txt"): []byte("backed up before encrypt_at_rest"),
+	}
+	for path, data := range contents {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One backup taken without encrypt_at_rest, then sealed by the sweep
+	earlier := newBackup(dspDir, "bundle-1", "sha256", false)
+	if err := earlier.add(filepath.Join(root, "earlier.txt")); err != nil {
+		t.Fatalf("back up: %v", err)
+	}
+	if err := earlier.save(dspDir); err != nil {
+		t.Fatalf("save backup: %v", err)
+	}
+	if sealed, err := sealBackups(dspDir); err != nil || sealed != 1 {
+		t.Fatalf("seal backups: sealed %d, %v", sealed, err)
+	}
+
+	b := newBackup(dspDir, "bundle-2", "sha256", true)
+	for _, name := range []string{"plain.txt", "secret.age"} {
+		if err := b.add(filepath.Join(root, name)); err != nil {
+			t.Fatalf("back up %s: %v", name, err)
+		}
+	}
+	if err := b.save(dspDir); err != nil {
+		t.Fatalf("save backup: %v", err)
+	}
+
+	// No copy holds the original contents
+	for _, id := range []string{"bundle-1", "bundle-2"} {
+		files, err := filepath.Glob(filepath.Join(backupDir(dspDir, id), backupFilesDir, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range contents {
+				if bytes.Contains(data, want) {
+					t.Fatalf("backup copy %s holds plain contents", file)
+				}
+			}
+		}
+	}
+
+	for path := range contents {
+		if err := os.WriteFile(path, []byte("changed by apply"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"bundle-1", "bundle-2"} {
+		if _, _, err := restoreBackup(dspDir, id, true, false); err != nil {
+			t.Fatalf("restore %s: %v", id, err)
+		}
+	}
+	for path, want := range contents {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s restored as %q, want %q", path, got, want)
+		}
+	}
+}
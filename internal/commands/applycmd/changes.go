@@ -0,0 +1,794 @@
+package applycmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// applyResult summarizes the outcome of applying a set of changes
+type applyResult struct {
+	Applied   []bundle.Change // Changes written to disk
+	UpToDate  []bundle.Change // Changes already present locally
+	Conflicts []bundle.Change // Changes skipped because the local file changed
+	Merged    []bundle.Change // Local edits merged cleanly with the change
+	Unmerged  []bundle.Change // Merged with conflict markers left to resolve
+	Failed    []bundle.Change // Changes that could not be applied
+	Errors    map[string]error
+	Refused   []bundle.Change   // Changes the path policy does not allow
+	RefusedBy map[string]string // Rule that refused each change, by path
+
+	Interrupted []bundle.Change // Changes not reached before the apply was cancelled
+
+	Verified     int // Applied files that match the bundle's hashes
+	VerifyFailed int // Applied files that did not, moved to Failed
+}
+
+// applier applies bundle changes to the working tree
+type applier struct {
+	reader        *bundle.Reader
+	hashAlgorithm string
+	base          map[string]string // Local hashes from the latest snapshot
+	backup        *backup           // Originals of changed files, nil to skip backups
+	store         *bundle.ContentStore
+	force         bool
+	verbose       bool
+
+	// Symlinks pointing outside root are refused unless allowExternalSymlinks is set
+	root                  string
+	allowExternalSymlinks bool
+
+	// The DSP and data directories, which no change may write to or link into
+	protected []string
+
+	// Long paths are written with the \\?\ prefix on Windows unless longPathsOff is set
+	longPathsOff bool
+
+	// Rules of the policy file for paths, applied even with force
+	policy *pathPolicy
+
+	// Bundle paths of changes written under another path, by the path
+	// written. Content is looked up in the bundle under the bundle path.
+	bundlePaths map[string]string
+
+	// Print each change and its outcome as it is applied
+	progress    bool
+	total, done int
+}
+
+// newApplier creates an applier for a bundle. The local latest snapshot is
+// used as the base for conflict detection.
+func newApplier(r *bundle.Reader, dspDir string, force, verbose bool) *applier {
+	a := &applier{
+		reader:        r,
+		hashAlgorithm: r.Bundle.Repository.Config.HashAlgorithm,
+		base:          make(map[string]string),
+		bundlePaths:   make(map[string]string),
+		store: bundle.NewContentStore(r.Bundle.Repository.Config.HashAlgorithm,
+			filepath.Join(dspDir, "bundles"), deferredDir(dspDir)),
+		force:   force,
+		verbose: verbose,
+	}
+	if _, latest, err := snapshot.LoadLatest(dspDir); err == nil {
+		for _, f := range latest.Files {
+			a.base[f.Path] = f.Hash
+		}
+	}
+	return a
+}
+
+// Close releases bundles opened to look up merge bases
+func (a *applier) Close() {
+	a.store.Close()
+}
+
+// bundlePath returns the path a change is recorded under in the bundle
+func (a *applier) bundlePath(path string) string {
+	if original, ok := a.bundlePaths[path]; ok {
+		return original
+	}
+	return path
+}
+
+// fsPath returns the path to use for filesystem calls on a change path
+func (a *applier) fsPath(path string) string {
+	if a.longPathsOff {
+		return path
+	}
+	return utils.LongPath(path)
+}
+
+// currentHash returns the hash of a local file, or "" if it does not exist
+func (a *applier) currentHash(path string) string {
+	path = a.fsPath(path)
+	if _, err := os.Lstat(path); err != nil {
+		return ""
+	}
+	hash, err := utils.HashPath(path, a.hashAlgorithm)
+	if err != nil {
+		return ""
+	}
+	return hash
+}
+
+// isConflict reports whether applying a change would overwrite local edits.
+// A file conflicts if it differs from the version the bundle was made from.
+// For changes that do not record that version, a file conflicts if it changed
+// since the latest local snapshot, or if it exists locally but was never
+// snapshotted and differs from the bundle.
+func (a *applier) isConflict(change bundle.Change, current string) bool {
+	if current == "" {
+		return false
+	}
+	if change.BaseHash != "" {
+		// Compare with the version the bundle was made from
+		return current != change.BaseHash
+	}
+	baseHash, known := a.base[change.Path]
+	if known {
+		return current != baseHash
+	}
+	return change.Type != "delete"
+}
+
+// apply applies a list of changes. Directory changes are applied after the
+// file changes, once the files they contain have been written or removed.
+// If ctx is cancelled, the changes not yet reached are left as Interrupted.
+// Applied files are verified against the bundle's hashes at the end.
+func (a *applier) apply(ctx context.Context, changes []bundle.Change) *applyResult {
+	result := &applyResult{Errors: make(map[string]error), RefusedBy: make(map[string]string)}
+	a.total, a.done = len(changes), 0
+
+	var dirs []bundle.Change
+	for i, change := range changes {
+		if ctx.Err() != nil {
+			result.Interrupted = append(append(result.Interrupted, changes[i:]...), dirs...)
+			a.verify(result)
+			return result
+		}
+		if change.IsDir {
+			dirs = append(dirs, change)
+			continue
+		}
+		a.report(change, a.applyFile(change, result))
+	}
+
+	a.applyDirs(dirs, result)
+	a.verify(result)
+	return result
+}
+
+// applyFile applies a file change, recording it in result, and returns the
+// outcome to report
+func (a *applier) applyFile(change bundle.Change, result *applyResult) string {
+	current := a.currentHash(change.Path)
+
+	// Skip changes that are already present
+	if (change.Type == "delete" && current == "") || (change.Type != "delete" && current == change.Hash) {
+		result.UpToDate = append(result.UpToDate, change)
+		return "up to date"
+	}
+
+	if rule := a.refused(change, result); rule != "" {
+		return "refused by " + rule
+	}
+	if err := a.checkNotProtected(change.Path); err != nil {
+		result.Failed = append(result.Failed, change)
+		result.Errors[change.Path] = err
+		return "failed: " + err.Error()
+	}
+
+	// Under prefer-newer-mtime an incoming version the policy let
+	// through is newer than the local file, so it replaces local edits
+	preferIncoming := a.policy.has(change.Path, rulePreferNewerMtime)
+	if a.isConflict(change, current) && !a.force && !preferIncoming {
+		// Try to merge local edits with the change
+		merged, conflicts, ok := a.merge(change)
+		if !ok {
+			result.Conflicts = append(result.Conflicts, change)
+			return "conflict, deferred"
+		}
+		if err := a.write(change, merged); err != nil {
+			result.Failed = append(result.Failed, change)
+			result.Errors[change.Path] = err
+			return "failed: " + err.Error()
+		}
+		if conflicts > 0 {
+			result.Unmerged = append(result.Unmerged, change)
+			return "merged with conflicts"
+		}
+		result.Merged = append(result.Merged, change)
+		if a.verbose {
+			fmt.Printf("  %s %s (merged)\n", changeSymbol(change.Type), change.Path)
+		}
+		return "merged"
+	}
+
+	// Keep the original so the apply can be undone
+	if a.backup != nil {
+		if err := a.backup.add(change.Path); err != nil {
+			result.Failed = append(result.Failed, change)
+			result.Errors[change.Path] = fmt.Errorf("failed to back up file: %w", err)
+			return "failed: " + result.Errors[change.Path].Error()
+		}
+	}
+
+	err := a.applyChange(change)
+	written := a.currentHash(change.Path)
+	if a.backup != nil {
+		a.backup.setApplied(change.Path, written)
+	}
+	if err != nil {
+		result.Failed = append(result.Failed, change)
+		result.Errors[change.Path] = err
+		return "failed: " + err.Error()
+	}
+
+	// Bundles that do not record directories leave emptied ones behind
+	if change.Type == "delete" && !a.reader.Bundle.RecordsDirs {
+		a.removeEmptyParents(change.Path)
+	}
+
+	if a.verbose {
+		fmt.Printf("  %s %s\n", changeSymbol(change.Type), change.Path)
+	}
+	result.Applied = append(result.Applied, change)
+	if !matchesBundle(change, written) {
+		return "verification failed"
+	}
+	return "verified"
+}
+
+// report prints the outcome of a change with --progress
+func (a *applier) report(change bundle.Change, outcome string) {
+	a.done++
+	if !a.progress {
+		return
+	}
+	path := change.Path
+	if change.IsDir {
+		path += "/"
+	}
+	if change.Type == "delete" || change.IsDir {
+		fmt.Printf("[%d/%d] %s %s: %s\n", a.done, a.total, changeSymbol(change.Type), path, outcome)
+		return
+	}
+	fmt.Printf("[%d/%d] %s %s (%s): %s\n", a.done, a.total, changeSymbol(change.Type), path, utils.FormatSize(change.Size), outcome)
+}
+
+// verify checks the applied files against the bundle's hashes once all
+// changes are applied. Files that do not match are moved to Failed.
+func (a *applier) verify(result *applyResult) {
+	var applied []bundle.Change
+	for _, change := range result.Applied {
+		if change.IsDir || matchesBundle(change, a.currentHash(change.Path)) {
+			if !change.IsDir {
+				result.Verified++
+			}
+			applied = append(applied, change)
+			continue
+		}
+		result.Failed = append(result.Failed, change)
+		result.Errors[change.Path] = fmt.Errorf("does not match the bundle's hash after applying")
+		result.VerifyFailed++
+	}
+	result.Applied = applied
+}
+
+// matchesBundle reports whether the hash of a path after applying a change
+// is what the bundle records: the change's hash, or none for a delete
+func matchesBundle(change bundle.Change, hash string) bool {
+	if change.Type == "delete" {
+		return hash == ""
+	}
+	return hash == change.Hash
+}
+
+// refused returns the rule of the path policy that refuses a change,
+// recording it in result, or "" if the policy allows the change. Deletes
+// carry no modification time, so the bundle's creation time stands for when
+// they were made.
+func (a *applier) refused(change bundle.Change, result *applyResult) string {
+	incoming := change.ModifiedTime
+	if change.Type == "delete" || incoming.IsZero() {
+		incoming = a.reader.Bundle.CreatedAt
+	}
+	rule := a.policy.refuses(change, a.fsPath(change.Path), incoming)
+	if rule == "" {
+		return ""
+	}
+	result.Refused = append(result.Refused, change)
+	result.RefusedBy[change.Path] = rule
+	if a.verbose {
+		fmt.Printf("  - %s (refused by %s)\n", change.Path, rule)
+	}
+	return rule
+}
+
+// applyDirs creates, updates and removes directories, deepest first so a
+// directory is emptied before its parent is removed. A directory still
+// holding local files is not removed and counts as a conflict.
+func (a *applier) applyDirs(changes []bundle.Change, result *applyResult) {
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path > changes[j].Path })
+
+	for _, change := range changes {
+		a.report(change, a.applyDir(change, result))
+	}
+}
+
+// applyDir applies a directory change, recording it in result, and returns
+// the outcome to report
+func (a *applier) applyDir(change bundle.Change, result *applyResult) string {
+	path := a.fsPath(change.Path)
+	info, err := os.Lstat(path)
+	exists := err == nil && info.IsDir()
+
+	// Skip changes that are already present
+	if (change.Type == "delete" && os.IsNotExist(err)) ||
+		(change.Type != "delete" && exists && info.Mode().Perm() == change.Mode) {
+		result.UpToDate = append(result.UpToDate, change)
+		return "up to date"
+	}
+	if rule := a.refused(change, result); rule != "" {
+		return "refused by " + rule
+	}
+	if err := a.checkInsideRoot(change.Path); err != nil {
+		result.Failed = append(result.Failed, change)
+		result.Errors[change.Path] = err
+		return "failed: " + err.Error()
+	}
+	if err := a.checkNotProtected(change.Path); err != nil {
+		result.Failed = append(result.Failed, change)
+		result.Errors[change.Path] = err
+		return "failed: " + err.Error()
+	}
+
+	if change.Type == "delete" {
+		if err := os.Remove(path); err != nil {
+			if entries, readErr := os.ReadDir(path); readErr == nil && len(entries) > 0 && !a.force {
+				result.Conflicts = append(result.Conflicts, change)
+				return "not empty, deferred"
+			}
+			result.Failed = append(result.Failed, change)
+			result.Errors[change.Path] = fmt.Errorf("failed to remove directory: %w", err)
+			return "failed: " + result.Errors[change.Path].Error()
+		}
+	} else {
+		if err := os.MkdirAll(path, change.Mode); err != nil {
+			result.Failed = append(result.Failed, change)
+			result.Errors[change.Path] = fmt.Errorf("failed to create directory: %w", err)
+			return "failed: " + result.Errors[change.Path].Error()
+		}
+		if err := os.Chmod(path, change.Mode); err != nil {
+			result.Failed = append(result.Failed, change)
+			result.Errors[change.Path] = fmt.Errorf("failed to set directory mode: %w", err)
+			return "failed: " + result.Errors[change.Path].Error()
+		}
+	}
+
+	if a.verbose {
+		fmt.Printf("  %s %s/\n", changeSymbol(change.Type), change.Path)
+	}
+	result.Applied = append(result.Applied, change)
+	return "done"
+}
+
+// removeEmptyParents removes the directories left empty by deleting path, up
+// to but not including the tracked directory that contains it
+func (a *applier) removeEmptyParents(path string) {
+	tracking := a.reader.Bundle.Repository.TrackingConfig
+	if tracking == nil {
+		return
+	}
+
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		below := false
+		for _, tracked := range tracking.Paths {
+			if tracked.IsDir && dir != filepath.Clean(tracked.Path) && isUnderAny(dir, []string{tracked.Path}) {
+				below = true
+				break
+			}
+		}
+		// Remove fails on directories that still hold files
+		if !below || os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// merge three-way merges local edits of a text file with a modify change,
+// using the bundle's source snapshot version as the base. It returns false if
+// the file cannot be merged.
+func (a *applier) merge(change bundle.Change) ([]byte, int, bool) {
+	if change.Type != "modify" || change.IsSymlink || change.BaseHash == "" {
+		return nil, 0, false
+	}
+	if info, err := os.Lstat(a.fsPath(change.Path)); err != nil || !info.Mode().IsRegular() {
+		return nil, 0, false
+	}
+
+	// Find the base version in the bundle or in local bundles
+	base, err := a.reader.ReadBase(a.bundlePath(change.Path))
+	if err != nil {
+		var ok bool
+		if base, ok = a.store.Find(change.Path, change.BaseHash); !ok {
+			return nil, 0, false
+		}
+	}
+	if hash, err := utils.HashReader(bytes.NewReader(base), a.hashAlgorithm); err != nil || hash != change.BaseHash {
+		return nil, 0, false
+	}
+
+	ours, err := os.ReadFile(a.fsPath(change.Path))
+	if err != nil {
+		return nil, 0, false
+	}
+	theirs, err := a.content(change)
+	if err != nil {
+		return nil, 0, false
+	}
+	if utils.IsBinary(base) || utils.IsBinary(ours) || utils.IsBinary(theirs) {
+		return nil, 0, false
+	}
+
+	merged, conflicts, err := utils.Merge3(string(base), string(ours), string(theirs),
+		"local", "bundle "+a.reader.Bundle.ID)
+	if err != nil {
+		return nil, 0, false
+	}
+	return []byte(merged), conflicts, true
+}
+
+// write replaces a file with merged content, backing up the original
+func (a *applier) write(change bundle.Change, data []byte) error {
+	if err := a.checkInsideRoot(filepath.Dir(change.Path)); err != nil {
+		return err
+	}
+	if a.backup != nil {
+		if err := a.backup.add(change.Path); err != nil {
+			return fmt.Errorf("failed to back up file: %w", err)
+		}
+	}
+
+	// Merged content is new, so it keeps the current time
+	change.ModifiedTime = time.Time{}
+	err := writeFileAtomic(a.fsPath(change.Path), data, change)
+	if a.backup != nil {
+		a.backup.setApplied(change.Path, a.currentHash(change.Path))
+	}
+	return err
+}
+
+// applyChange writes or removes a single file
+func (a *applier) applyChange(change bundle.Change) error {
+	path := a.fsPath(change.Path)
+	if err := a.checkInsideRoot(filepath.Dir(change.Path)); err != nil {
+		return err
+	}
+
+	// Handle deletes
+	if change.Type == "delete" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete file: %w", err)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create parent directory: %w", err)
+	}
+
+	// Handle symlinks
+	if change.IsSymlink {
+		if !a.allowExternalSymlinks && !a.symlinkInsideRoot(change) {
+			return fmt.Errorf("symlink target %s is outside the repository; use --allow-external-symlinks to create it", change.SymlinkTarget)
+		}
+		if target, err := a.symlinkTarget(change); err != nil {
+			return fmt.Errorf("failed to resolve symlink target %s: %w", change.SymlinkTarget, err)
+		} else if err := a.checkNotProtected(target); err != nil {
+			return fmt.Errorf("refusing symlink to %s: %w", change.SymlinkTarget, err)
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to replace symlink: %w", err)
+		}
+		if err := os.Symlink(change.SymlinkTarget, path); err != nil {
+			return fmt.Errorf("failed to create symlink: %w", err)
+		}
+		return nil
+	}
+
+	// Recreate hard links to files already in place
+	if change.LinkTo != "" && a.link(change) {
+		return nil
+	}
+
+	data, err := a.content(change)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, change)
+}
+
+// link hard links a file to the file it was linked to in the bundle. It
+// returns false if that file is outside the repository, in the DSP or data
+// directory, or does not hold the expected content, in which case the change
+// is written from its own content.
+func (a *applier) link(change bundle.Change) bool {
+	if a.checkInsideRoot(change.LinkTo) != nil || a.checkNotProtected(change.LinkTo) != nil {
+		return false
+	}
+	if a.currentHash(change.LinkTo) != change.Hash {
+		return false
+	}
+
+	// Link next to the target and rename into place
+	tmp := a.fsPath(change.Path + ".dsp-link")
+	os.Remove(tmp)
+	if err := os.Link(a.fsPath(change.LinkTo), tmp); err != nil {
+		return false
+	}
+	if err := os.Rename(tmp, a.fsPath(change.Path)); err != nil {
+		os.Remove(tmp)
+		return false
+	}
+	return true
+}
+
+// symlinkInsideRoot reports whether a symlink change points at or below the
+// repository root. Relative targets are resolved from the link's directory,
+// following the links already on disk as the filesystem would.
+func (a *applier) symlinkInsideRoot(change bundle.Change) bool {
+	if a.root == "" {
+		return true
+	}
+	resolved, err := a.symlinkTarget(change)
+	if err != nil {
+		return false
+	}
+	root, err := utils.ResolveExisting(a.root)
+	if err != nil {
+		return false
+	}
+	return isUnderAny(resolved, []string{root})
+}
+
+// symlinkTarget returns the path a symlink change points to, with the links
+// already on disk resolved
+func (a *applier) symlinkTarget(change bundle.Change) (string, error) {
+	target := change.SymlinkTarget
+	if !filepath.IsAbs(target) {
+		dir, err := utils.ResolveExisting(filepath.Dir(change.Path))
+		if err != nil {
+			return "", err
+		}
+		target = dir + string(filepath.Separator) + target
+	}
+	return utils.ResolveExisting(target)
+}
+
+// checkNotProtected refuses a path in the DSP or data directory. Snapshots
+// never record them, so no legitimate bundle writes there; a bundle that did
+// could plant hooks that run at the end of the apply or rewrite the
+// repository's configuration, ledger and snapshots. Links on disk are
+// resolved up to the path itself, which a write replaces.
+func (a *applier) checkNotProtected(path string) error {
+	if len(a.protected) == 0 {
+		return nil
+	}
+	dir, err := utils.ResolveExisting(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", path, err)
+	}
+	resolved := filepath.Join(dir, filepath.Base(path))
+	for _, protected := range a.protected {
+		resolvedProtected, err := utils.ResolveExisting(protected)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", protected, err)
+		}
+		if isUnderAny(resolved, []string{resolvedProtected}) {
+			return fmt.Errorf("refusing to write %s: it is inside %s, which holds the repository's own data", path, protected)
+		}
+	}
+	return nil
+}
+
+// checkInsideRoot refuses to write in a directory that symlinks on disk lead
+// outside the repository root
+func (a *applier) checkInsideRoot(dir string) error {
+	if a.root == "" {
+		return nil
+	}
+	resolved, err := utils.ResolveExisting(dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", dir, err)
+	}
+	root, err := utils.ResolveExisting(a.root)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", a.root, err)
+	}
+	if !isUnderAny(resolved, []string{root}) {
+		return fmt.Errorf("refusing to write through %s: symlinks lead it outside the repository to %s", dir, resolved)
+	}
+	return nil
+}
+
+// content reads and verifies the content of a change from the bundle
+func (a *applier) content(change bundle.Change) ([]byte, error) {
+	data, err := a.rawContent(change)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the file hash
+	hash, err := utils.HashReader(bytes.NewReader(data), a.hashAlgorithm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash content: %w", err)
+	}
+	if hash != change.Hash {
+		return nil, fmt.Errorf("file hash mismatch: bundle content does not match recorded hash")
+	}
+
+	return data, nil
+}
+
+// rawContent returns the decompressed content of a change, assembling it from
+// chunks for large files
+func (a *applier) rawContent(change bundle.Change) ([]byte, error) {
+	if len(change.Chunks) > 0 {
+		return a.assemble(change)
+	}
+
+	raw, err := a.reader.OpenRaw(a.bundlePath(change.Path))
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := io.ReadAll(raw)
+	raw.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content: %w", err)
+	}
+
+	// Verify the stored content before decompressing it
+	if change.ContentHash != "" && utils.HashBytes(compressed) != change.ContentHash {
+		return nil, fmt.Errorf("content hash mismatch in bundle")
+	}
+
+	return utils.Decompress(compressed)
+}
+
+// assemble rebuilds a chunked file from the chunks in the bundle and the
+// unchanged chunks of the local file, which must hold the base version
+func (a *applier) assemble(change bundle.Change) ([]byte, error) {
+	// Locate the chunks of the base version
+	offsets := make(map[string]int64, len(change.BaseChunks))
+	var offset int64
+	for _, c := range change.BaseChunks {
+		if _, ok := offsets[c.Hash]; !ok {
+			offsets[c.Hash] = offset
+		}
+		offset += c.Size
+	}
+
+	var local *os.File
+	if a.currentHash(change.Path) == change.BaseHash {
+		if f, err := os.Open(a.fsPath(change.Path)); err == nil {
+			local = f
+			defer local.Close()
+		}
+	}
+
+	var data bytes.Buffer
+	data.Grow(int(change.Size))
+	for _, c := range change.Chunks {
+		content, err := a.reader.ReadChunk(c.Hash)
+		if err != nil {
+			offset, ok := offsets[c.Hash]
+			if !ok || local == nil {
+				return nil, fmt.Errorf("chunk %s is not in the bundle and the local file is not the base version", c.Hash)
+			}
+			content = make([]byte, c.Size)
+			if _, err := local.ReadAt(content, offset); err != nil {
+				return nil, fmt.Errorf("failed to read chunk from local file: %w", err)
+			}
+		}
+
+		// Verify each chunk, wherever it came from
+		hash, err := utils.HashReader(bytes.NewReader(content), a.hashAlgorithm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash chunk: %w", err)
+		}
+		if hash != c.Hash {
+			return nil, fmt.Errorf("chunk hash mismatch for %s", c.Hash)
+		}
+		data.Write(content)
+	}
+	return data.Bytes(), nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, preserving the existing file mode and the bundle's modification time
+func writeFileAtomic(path string, data []byte, change bundle.Change) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".dsp-apply-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	write := writeAll
+	if change.Sparse {
+		write = writeSparse
+	}
+	if err := write(tmp, data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return fmt.Errorf("failed to set file mode: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+	if !change.ModifiedTime.IsZero() {
+		os.Chtimes(path, change.ModifiedTime, change.ModifiedTime)
+	}
+	return nil
+}
+
+// sparseBlockSize is the granularity at which zeros are left as holes
+const sparseBlockSize = 4096
+
+// writeAll writes data to f
+func writeAll(f *os.File, data []byte) error {
+	_, err := f.Write(data)
+	return err
+}
+
+// writeSparse writes data to f, seeking over blocks of zeros so the
+// filesystem leaves them as holes instead of allocating them
+func writeSparse(f *os.File, data []byte) error {
+	zeros := make([]byte, sparseBlockSize)
+	for offset := 0; offset < len(data); offset += sparseBlockSize {
+		block := data[offset:min(offset+sparseBlockSize, len(data))]
+		if bytes.Equal(block, zeros[:len(block)]) {
+			if _, err := f.Seek(int64(len(block)), io.SeekCurrent); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := f.Write(block); err != nil {
+			return err
+		}
+	}
+
+	// Set the size in case the file ends in a hole
+	return f.Truncate(int64(len(data)))
+}
+
+// changeSymbol returns the display symbol for a change type
+func changeSymbol(changeType string) string {
+	switch changeType {
+	case "add":
+		return "+"
+	case "delete":
+		return "-"
+	default:
+		return "M"
+	}
+}
@@ -0,0 +1,129 @@
+package applycmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+func TestLinkRefusesTargetOutsideRoot(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "repo")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(dir, "outside")
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := utils.HashPath(outside, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &applier{hashAlgorithm: "sha256", root: root}
+	change := bundle.Change{
+		Path:   filepath.Join(root, "a.txt"),
+		Type:   "add",
+		Hash:   hash,
+		LinkTo: filepath.Join(root, "../outside"),
+	}
+	if a.link(change) {
+		t.Fatalf("linked %s to a file outside the repository", change.Path)
+	}
+	if _, err := os.Lstat(change.Path); !os.IsNotExist(err) {
+		t.Fatalf("%s was created: %v", change.Path, err)
+	}
+
+	// A link to a file inside the repository is recreated
+	inside := filepath.Join(root, "b.txt")
+	if err := os.WriteFile(inside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	change.LinkTo = inside
+	if !a.link(change) {
+		t.Fatalf("did not link %s to %s", change.Path, inside)
+	}
+}
+
+func TestApplyRefusesDSPDir(t *testing.T) {
+	root := t.TempDir()
+	dspDir := filepath.Join(root, ".dsp")
+	hook := filepath.Join(dspDir, "hooks", "post-apply")
+	if err := os.MkdirAll(filepath.Dir(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+	original := []byte("#!/bin/sh\n")
+	if err := os.WriteFile(hook, original, 0755); err != nil {
+		t.Fatal(err)
+	}
+	hookHash, err := utils.HashPath(hook, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A bundle that overwrites the hook and links to it
+	payload := []byte("#!/bin/sh\necho pwned\n")
+	compressed, err := utils.Compress(payload, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &bundle.Bundle{
+		ID:             "test-bundle",
+		CreatedAt:      time.Now(),
+		CreatedBy:      "test",
+		IsInitial:      true,
+		TargetSnapshot: "target",
+		Changes: []bundle.Change{
+			{Path: hook, Type: "modify", Hash: utils.HashBytes(payload), Size: int64(len(payload)), Mode: 0755},
+			{Path: filepath.Join(root, "run"), Type: "add", Hash: "hash-link", IsSymlink: true, SymlinkTarget: ".dsp/hooks/post-apply"},
+			{Path: filepath.Join(root, "copy"), Type: "add", Hash: hookHash, Size: int64(len(original)), LinkTo: hook},
+		},
+		FileContents: map[string][]byte{hook: compressed},
+	}
+	b.Repository.Name = "repo"
+	b.Repository.DSPDir = ".dsp"
+	b.Repository.DataDir = ".dsp"
+	b.Repository.Config.HashAlgorithm = "sha256"
+	b.Repository.Config.CompressionLevel = 3
+	b.Repository.TrackingConfig = &snapshot.TrackingConfig{
+		Paths: []snapshot.TrackedPath{{Path: root, IsDir: true}},
+	}
+	path := filepath.Join(t.TempDir(), "bundle.zip")
+	if err := b.Save(context.Background(), path); err != nil {
+		t.Fatalf("save bundle: %v", err)
+	}
+	reader, err := bundle.OpenReader(path)
+	if err != nil {
+		t.Fatalf("open bundle: %v", err)
+	}
+	defer reader.Close()
+
+	a := newApplier(reader, dspDir, true, false)
+	defer a.Close()
+	a.root = root
+	a.protected = []string{dspDir}
+	result := a.apply(context.Background(), reader.Bundle.Changes)
+
+	if len(result.Applied) != 0 || len(result.Failed) != 3 {
+		t.Fatalf("applied %d and failed %d changes, want every change refused", len(result.Applied), len(result.Failed))
+	}
+	data, err := os.ReadFile(hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(original) {
+		t.Fatalf("hook was overwritten with %q", data)
+	}
+	for _, name := range []string{"run", "copy"} {
+		if _, err := os.Lstat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s was created: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package applycmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/atrest"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// deferredDirName is the directory under the DSP directory holding deferred changes
+const deferredDirName = "deferred"
+
+// deferredRecord lists changes from a bundle that were not applied yet. A copy
+// of the bundle is kept next to the record so the changes can be applied
+// after the original bundle file is gone.
+type deferredRecord struct {
+	BundleID   string    `json:"bundle_id"`
+	BundleFile string    `json:"bundle_file"` // Name of the bundle copy in the deferred directory
+	DeferredAt time.Time `json:"deferred_at"`
+	Paths      []string  `json:"paths"`
+}
+
+// deferredDir returns the deferred changes directory
+func deferredDir(dspDir string) string {
+	return filepath.Join(dspDir, deferredDirName)
+}
+
+// deferredRecordPath returns the record path for a bundle
+func deferredRecordPath(dspDir, bundleID string) string {
+	return filepath.Join(deferredDir(dspDir), bundleID+".json")
+}
+
+// bundlePath returns the path of the bundle copy for a record
+func (d *deferredRecord) bundlePath(dspDir string) string {
+	return filepath.Join(deferredDir(dspDir), d.BundleFile)
+}
+
+// loadDeferred loads the deferred record for a bundle
+func loadDeferred(dspDir, bundleID string) (*deferredRecord, error) {
+	data, err := os.ReadFile(deferredRecordPath(dspDir, bundleID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no deferred changes for bundle %s (see 'dsp apply --list-deferred')", bundleID)
+		}
+		return nil, fmt.Errorf("failed to read deferred changes: %w", err)
+	}
+
+	var record deferredRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to parse deferred changes: %w", err)
+	}
+	return &record, nil
+}
+
+// listDeferred returns all deferred records
+func listDeferred(dspDir string) ([]*deferredRecord, error) {
+	matches, err := filepath.Glob(filepath.Join(deferredDir(dspDir), "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deferred changes: %w", err)
+	}
+
+	var records []*deferredRecord
+	for _, match := range matches {
+		record, err := loadDeferred(dspDir, strings.TrimSuffix(filepath.Base(match), ".json"))
+		if err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].DeferredAt.Before(records[j].DeferredAt) })
+	return records, nil
+}
+
+// saveDeferred writes a deferred record, or removes it and the bundle copy
+// when no paths remain
+func saveDeferred(dspDir string, record *deferredRecord) error {
+	if len(record.Paths) == 0 {
+		os.Remove(record.bundlePath(dspDir))
+		if err := os.Remove(deferredRecordPath(dspDir, record.BundleID)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove deferred changes: %w", err)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(deferredDir(dspDir), 0755); err != nil {
+		return fmt.Errorf("failed to create deferred directory: %w", err)
+	}
+
+	sort.Strings(record.Paths)
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal deferred changes: %w", err)
+	}
+	if err := os.WriteFile(deferredRecordPath(dspDir, record.BundleID), data, 0644); err != nil {
+		return fmt.Errorf("failed to write deferred changes: %w", err)
+	}
+	return nil
+}
+
+// deferChanges records paths from a bundle as deferred, keeping a copy of the
+// bundle, encrypted at rest if seal is set. Paths already deferred for the
+// same bundle are merged.
+func deferChanges(dspDir, bundleID, bundlePath string, paths []string, seal bool) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	record, err := loadDeferred(dspDir, bundleID)
+	if err != nil {
+		record = &deferredRecord{
+			BundleID:   bundleID,
+			BundleFile: bundleID + ".zip",
+		}
+	}
+	record.DeferredAt = time.Now()
+
+	// Keep a copy of the bundle unless we are applying from the copy itself
+	if err := os.MkdirAll(deferredDir(dspDir), 0755); err != nil {
+		return fmt.Errorf("failed to create deferred directory: %w", err)
+	}
+	copyPath := record.bundlePath(dspDir)
+	if absBundle, _ := filepath.Abs(bundlePath); absBundle != copyPath {
+		keep := utils.CopyFile
+		if sealed, err := atrest.IsSealed(bundlePath); err == nil && seal && !sealed {
+			keep = atrest.SealCopy
+		}
+		if err := keep(bundlePath, copyPath); err != nil {
+			return fmt.Errorf("failed to keep a copy of the bundle: %w", err)
+		}
+	}
+
+	existing := make(map[string]bool)
+	for _, p := range record.Paths {
+		existing[p] = true
+	}
+	for _, p := range paths {
+		if !existing[p] {
+			record.Paths = append(record.Paths, p)
+			existing[p] = true
+		}
+	}
+
+	return saveDeferred(dspDir, record)
+}
+
+// removeDeferredPaths removes paths from a record. An empty selection removes all.
+func removeDeferredPaths(record *deferredRecord, remove map[string]bool) {
+	if remove == nil {
+		record.Paths = nil
+		return
+	}
+	var remaining []string
+	for _, p := range record.Paths {
+		if !remove[p] {
+			remaining = append(remaining, p)
+		}
+	}
+	record.Paths = remaining
+}
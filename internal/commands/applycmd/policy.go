@@ -0,0 +1,153 @@
+package applycmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// policyFile is the file in the DSP directory that constrains what applied
+// bundles may do to paths
+const policyFile = "policy"
+
+// Path policy rules
+const (
+	ruleSkip             = "skip"               // Leave matching paths alone
+	ruleNeverDelete      = "never-delete"       // Refuse deletes of matching paths
+	rulePreferNewerMtime = "prefer-newer-mtime" // Keep local files modified after the incoming version
+)
+
+// policyRules lists the rules a policy file may use
+var policyRules = []string{ruleSkip, ruleNeverDelete, rulePreferNewerMtime}
+
+// policyEntry maps a path pattern to rules
+type policyEntry struct {
+	pattern string // Relative to the repository root, with forward slashes
+	rules   []string
+}
+
+// pathPolicy holds the rules of a policy file. A path is subject to the
+// rules of every pattern that matches it or one of its parent directories.
+type pathPolicy struct {
+	root    string
+	entries []policyEntry
+}
+
+// loadPolicy reads the policy file of a DSP directory. It returns nil if
+// there is none. Each line maps a pattern to comma-separated rules:
+//
+//	configs/** : never-delete
+//	secrets/** : skip
+//	data/**    : prefer-newer-mtime
+//
+// Patterns use path.Match syntax relative to the repository root, where **
+// matches any number of directories. Blank lines and lines starting with #
+// are ignored.
+func loadPolicy(dspDir, root string) (*pathPolicy, error) {
+	policyPath := filepath.Join(dspDir, policyFile)
+	file, err := os.Open(policyPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read path policy: %w", err)
+	}
+	defer file.Close()
+
+	policy := &pathPolicy{root: root}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry, err := parsePolicyLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path policy %s, line %d: %w", policyPath, lineNo, err)
+		}
+		policy.entries = append(policy.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read path policy: %w", err)
+	}
+	return policy, nil
+}
+
+// parsePolicyLine parses a "pattern : rule[, rule...]" line
+func parsePolicyLine(line string) (policyEntry, error) {
+	i := strings.LastIndex(line, ":")
+	if i < 0 {
+		return policyEntry{}, fmt.Errorf("expected 'pattern : rule'")
+	}
+	pattern := strings.Trim(strings.TrimSpace(line[:i]), "/")
+	if pattern == "" {
+		return policyEntry{}, fmt.Errorf("missing pattern")
+	}
+	if err := utils.ValidatePathPattern(pattern); err != nil {
+		return policyEntry{}, err
+	}
+
+	entry := policyEntry{pattern: pattern}
+	for _, rule := range strings.Split(line[i+1:], ",") {
+		rule = strings.TrimSpace(rule)
+		valid := false
+		for _, r := range policyRules {
+			valid = valid || r == rule
+		}
+		if !valid {
+			return policyEntry{}, fmt.Errorf("unknown rule %q, must be one of: %s", rule, strings.Join(policyRules, ", "))
+		}
+		entry.rules = append(entry.rules, rule)
+	}
+	return entry, nil
+}
+
+// has reports whether a rule applies to a path
+func (p *pathPolicy) has(filePath, rule string) bool {
+	if p == nil {
+		return false
+	}
+	rel, err := filepath.Rel(p.root, filePath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	for _, entry := range p.entries {
+		applies := false
+		for _, r := range entry.rules {
+			applies = applies || r == rule
+		}
+		if !applies {
+			continue
+		}
+		// A pattern matching a parent directory covers everything below it
+		if utils.MatchPathPattern(entry.pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// refuses returns the rule that keeps a change from being applied, or "" if
+// the policy allows it. incomingTime is when the incoming version was
+// modified, for prefer-newer-mtime.
+func (p *pathPolicy) refuses(change bundle.Change, localPath string, incomingTime time.Time) string {
+	switch {
+	case p.has(change.Path, ruleSkip):
+		return ruleSkip
+	case change.Type == "delete" && p.has(change.Path, ruleNeverDelete):
+		return ruleNeverDelete
+	case !change.IsDir && p.has(change.Path, rulePreferNewerMtime):
+		info, err := os.Lstat(localPath)
+		if err == nil && info.ModTime().After(incomingTime) {
+			return rulePreferNewerMtime
+		}
+	}
+	return ""
+}
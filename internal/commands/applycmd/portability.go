@@ -0,0 +1,138 @@
+package applycmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/Mattddixo/dsp/internal/bundle"
+)
+
+// Strategies for paths that cannot be created as-is on this system
+const (
+	pathIssuesFail   = "fail"
+	pathIssuesSkip   = "skip"
+	pathIssuesRename = "rename"
+)
+
+// resolvePathIssues checks the paths of changes against this system: case
+// collisions on case-insensitive filesystems, reserved or invalid names on
+// Windows, and paths too long for Windows when longPaths is false. With
+// skip, changes with issues are left out and their paths returned to be
+// deferred; with rename, they are written to a portable path instead, except
+// paths that are too long, which are skipped, and the bundle path of each
+// renamed change is added to bundlePaths by its new path. fail refuses the
+// apply and lists the issues.
+func resolvePathIssues(changes []bundle.Change, strategy string, longPaths, quiet bool, bundlePaths map[string]string) ([]bundle.Change, []string, error) {
+	switch strategy {
+	case pathIssuesFail, pathIssuesSkip, pathIssuesRename:
+	default:
+		return nil, nil, fmt.Errorf("invalid --path-issues value %q, must be fail, skip or rename", strategy)
+	}
+
+	var paths []string
+	for _, change := range changes {
+		if change.Type != "delete" {
+			paths = append(paths, change.Path)
+		}
+	}
+	issues := bundle.CheckPaths(paths, runtime.GOOS)
+	if runtime.GOOS == "windows" && !longPaths {
+		issues = append(issues, bundle.LongPathIssues(paths)...)
+	}
+	if bundle.CaseInsensitive(runtime.GOOS) {
+		issues = append(issues, localCaseCollisions(changes)...)
+	}
+	if len(issues) == 0 {
+		return changes, nil, nil
+	}
+
+	byPath := make(map[string]bundle.PathIssue, len(issues))
+	for _, issue := range issues {
+		if _, ok := byPath[issue.Path]; !ok {
+			byPath[issue.Path] = issue
+		}
+	}
+
+	if strategy == pathIssuesFail {
+		var lines []string
+		for _, issue := range issues {
+			lines = append(lines, fmt.Sprintf("  %s: %s", issue.Path, issue.Detail))
+		}
+		return nil, nil, fmt.Errorf("%d paths cannot be created as-is on this system:\n%s\nUse --path-issues rename or --path-issues skip to apply the bundle",
+			len(issues), strings.Join(lines, "\n"))
+	}
+
+	taken := make(map[string]bool, len(changes))
+	for _, change := range changes {
+		taken[strings.ToLower(change.Path)] = true
+	}
+
+	var kept []bundle.Change
+	var skipped []string
+	for _, change := range changes {
+		issue, ok := byPath[change.Path]
+		if !ok || change.Type == "delete" {
+			kept = append(kept, change)
+			continue
+		}
+		if strategy == pathIssuesSkip || issue.Kind == bundle.IssueTooLong {
+			skipped = append(skipped, change.Path)
+			if !quiet {
+				fmt.Printf("Skipped %s: %s\n", change.Path, issue.Detail)
+			}
+			continue
+		}
+		renamed := bundle.PortablePath(issue, taken)
+		if !quiet {
+			fmt.Printf("Renamed %s to %s: %s\n", change.Path, renamed, issue.Detail)
+		}
+		original := change.Path
+		if p, ok := bundlePaths[original]; ok {
+			original = p
+		}
+		bundlePaths[renamed] = original
+		change.Path = renamed
+		kept = append(kept, change)
+	}
+	return kept, skipped, nil
+}
+
+// localCaseCollisions returns the added paths that exist locally under a name
+// differing only in case, which a case-insensitive filesystem would overwrite
+func localCaseCollisions(changes []bundle.Change) []bundle.PathIssue {
+	var issues []bundle.PathIssue
+	for _, change := range changes {
+		if change.Type != "add" {
+			continue
+		}
+		if _, err := os.Lstat(change.Path); err != nil {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Dir(change.Path))
+		if err != nil {
+			continue
+		}
+		name := filepath.Base(change.Path)
+		existing := ""
+		for _, entry := range entries {
+			if entry.Name() == name {
+				existing = ""
+				break
+			}
+			if strings.EqualFold(entry.Name(), name) {
+				existing = entry.Name()
+			}
+		}
+		if existing != "" {
+			issues = append(issues, bundle.PathIssue{
+				Path:   change.Path,
+				Kind:   bundle.IssueCaseCollision,
+				Detail: fmt.Sprintf("differs from local %s only in case", existing),
+			})
+		}
+	}
+	return issues
+}
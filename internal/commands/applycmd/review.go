@@ -0,0 +1,54 @@
+package applycmd
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/commands/review"
+)
+
+// reviewChanges lets the user choose which changes to apply. Changes that
+// would overwrite local edits start deselected. It returns the chosen
+// changes and the paths of the others, to be deferred.
+func reviewChanges(a *applier, changes []bundle.Change, in io.Reader, out io.Writer) ([]bundle.Change, []string, error) {
+	items := make([]review.Item, len(changes))
+	for i, change := range changes {
+		items[i] = review.Item{
+			Label:    fmt.Sprintf("%s %s", changeSymbol(change.Type), change.Path),
+			Selected: true,
+		}
+		if change.IsDir {
+			items[i].Label += "/"
+		}
+		current := a.currentHash(change.Path)
+		if current != change.Hash && a.isConflict(change, current) {
+			items[i].Note = "local changes"
+			items[i].Selected = false
+		}
+	}
+
+	title := fmt.Sprintf("Bundle %s has %d changes to review. Selected changes are applied; the others are deferred.",
+		a.reader.Bundle.ID, len(changes))
+	confirmed, err := review.Run(in, out, title, items)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !confirmed {
+		return nil, nil, fmt.Errorf("apply cancelled; nothing was changed")
+	}
+	if review.Selected(items) == 0 {
+		return nil, nil, fmt.Errorf("no changes selected; nothing was changed")
+	}
+
+	var chosen []bundle.Change
+	var deferred []string
+	for i, change := range changes {
+		if items[i].Selected {
+			chosen = append(chosen, change)
+		} else {
+			deferred = append(deferred, change.Path)
+		}
+	}
+	return chosen, deferred, nil
+}
@@ -0,0 +1,143 @@
+package auditcmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/audit"
+	"github.com/urfave/cli/v2"
+)
+
+var Command = &cli.Command{
+	Name:  "audit",
+	Usage: "Review the audit log of security-relevant events",
+	Description: `DSP records security-relevant events in an append-only audit log under
+<global-dir>/audit (~/.dsp-global/audit by default), one file per month:
+
+  key-exchange        keys exchanged during export and import, and the outcome
+  trust-change        hosts trusted, untrusted or removed
+  auth-failure        export requests refused for bad credentials or tokens
+  client-banned       clients banned from an export after repeated auth failures
+  connection-limit    connections refused for exceeding the per-client limit
+  token-issued        one-time download tokens handed out by export
+  signature-verified  signed host archives that verified
+  signature-rejected  signed host archives that failed verification
+  apply               bundles applied or undone
+  repo-lifecycle      repositories closed or reopened
+  cert-rotation       the local certificate rotated, or a peer's rotation followed
+
+Examples:
+  # Show the events of the last week
+  dsp audit show --since 7d
+
+  # Show failed authentications since a date
+  dsp audit show --since 2024-01-01 --type auth-failure`,
+	Subcommands: []*cli.Command{
+		{
+			Name:  "show",
+			Usage: "Show audit events",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "since",
+					Aliases: []string{"s"},
+					Usage:   "Show events since a duration ago (such as 12h or 7d) or a date (2006-01-02 or RFC 3339)",
+				},
+				&cli.StringSliceFlag{
+					Name:    "type",
+					Aliases: []string{"t"},
+					Usage:   "Show only events of this type (can be repeated)",
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print events as JSON lines, as stored",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				var since time.Time
+				if value := c.String("since"); value != "" {
+					var err error
+					since, err = parseSince(value, time.Now())
+					if err != nil {
+						return err
+					}
+				}
+
+				types := make(map[string]bool)
+				for _, t := range c.StringSlice("type") {
+					if !validType(t) {
+						return fmt.Errorf("unknown event type %q, must be one of: %s", t, strings.Join(audit.EventTypes, ", "))
+					}
+					types[t] = true
+				}
+
+				events, err := audit.Read(since)
+				if err != nil {
+					return err
+				}
+
+				var shown []audit.Event
+				for _, e := range events {
+					if len(types) == 0 || types[e.Type] {
+						shown = append(shown, e)
+					}
+				}
+
+				if c.Bool("json") {
+					encoder := json.NewEncoder(os.Stdout)
+					for _, e := range shown {
+						if err := encoder.Encode(e); err != nil {
+							return fmt.Errorf("failed to encode event: %w", err)
+						}
+					}
+					return nil
+				}
+
+				if len(shown) == 0 {
+					fmt.Println("No audit events")
+					return nil
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "TIME\tTYPE\tUSER\tSUBJECT\tOUTCOME\tDETAIL")
+				for _, e := range shown {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+						e.Time.Local().Format("2006-01-02 15:04:05"), e.Type, e.User, e.Subject, e.Outcome, e.Detail)
+				}
+				return w.Flush()
+			},
+		},
+	},
+}
+
+// parseSince parses a duration ago, with d for days, or a date
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since value %q: use a duration such as 12h or 7d, or a date such as 2006-01-02", value)
+}
+
+// validType reports whether t is a known event type
+func validType(t string) bool {
+	for _, known := range audit.EventTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
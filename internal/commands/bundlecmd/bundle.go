@@ -4,10 +4,19 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/Mattddixo/dsp/config"
 	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/commands/flags"
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/internal/eml"
+	"github.com/Mattddixo/dsp/internal/hooks"
+	"github.com/Mattddixo/dsp/internal/host"
+	"github.com/Mattddixo/dsp/internal/ledger"
 	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/snapshot"
 	"github.com/urfave/cli/v2"
 )
 
@@ -18,6 +27,19 @@ var Command = &cli.Command{
 The bundle contains the changes between the source and target snapshots.
 If only one snapshot exists, an initial bundle will be created.
 
+Files of 8 MiB or more are split into content-defined chunks when
+snapshotted. When such a file is modified, the bundle only carries the chunks
+that changed; apply reads the others from the local copy of the file.
+
+If keep_bundles_days is set in the repository config.yaml, bundles in
+<dsp-dir>/bundles older than that are removed after the new bundle is saved.
+With encrypt_at_rest, bundles saved in <dsp-dir>/bundles are encrypted with
+the local age key once written; bundles written elsewhere with --output stay
+plain, as they are meant to be carried to other hosts. Commands that need the
+plain archive (export, push, and reading large bundles) decrypt it to a hidden
+.tmp file next to the bundle while they run; a crash can leave that copy
+behind, which 'dsp repo doctor' reports.
+
 Examples:
   # Create a bundle between the latest and previous snapshots
   dsp bundle
@@ -26,7 +48,61 @@ Examples:
   dsp bundle -s 20240101-120000 -t 20240102-150000
 
   # Create an initial bundle (automatic when only one snapshot exists)
-  dsp bundle`,
+  dsp bundle
+
+  # Bundle every file of the latest snapshot, as an initial bundle
+  dsp bundle --full
+
+  # Only include changes under src/ and to docs/README.md
+  dsp bundle --path src/ --path docs/README.md
+
+  # Leave secrets and keys out of a bundle for a less trusted recipient
+  dsp bundle --redact "secrets/*" --redact "*.pem"
+
+  # Also write a copy encrypted for a host group (<bundle>.zip.age)
+  dsp bundle --to field-team
+
+  # Package the encrypted copy as email messages of at most 5 MB each
+  dsp bundle --to field-team --format eml --max-size 5MB --mail-to field@example.org
+
+  # Add 10% parity for a bundle carried on an SD card
+  dsp bundle --parity 10%
+
+  # Merge a chain of bundles into one
+  dsp bundle merge -o combined.zip a.zip b.zip
+
+  # Salvage the intact changes of a damaged bundle
+  dsp bundle repair 20240101120000.zip
+
+Email packaging:
+  With --format eml the bundle is also written as signed MIME messages next to
+  it, ready to send over email or other store-and-forward links. If --to is
+  given the encrypted copy is packaged instead of the plain bundle. Bundles
+  larger than --max-size (default 10MB) are split across several messages,
+  named <bundle>.<part>-of-<parts>.eml. Import them on the other side with
+  'dsp import --from-eml'.
+
+Redaction:
+  With --redact, files matching a pattern are left out of the bundle and
+  their contents are never read, so one repository can produce bundles for
+  recipients with different clearance without changing what is tracked.
+  Patterns use filepath.Match syntax with forward slashes; those without a
+  slash match a name at any depth (*.pem), the others are relative to the
+  repository root (secrets/*), ** matches any number of directories, and a
+  pattern matching a directory covers its contents. The patterns and the
+  number of files left out are recorded in the bundle, and 'dsp apply' reports
+  them. Redacted bundles are not chained by 'dsp sync plan'.
+
+Parity:
+  With --parity the bundle, and its encrypted copy, get a <bundle>.parity
+  file of Reed-Solomon parity blocks, for bundles that sit on removable media
+  for a long time. Damage to up to that share of the blocks of a bundle is
+  repaired automatically by 'dsp apply' and 'dsp pull'. 'dsp push' uploads
+  parity files along with their bundles.
+
+Hooks:
+  If <dsp-dir>/hooks/post-bundle exists it runs after the bundle is written,
+  with DSP_BUNDLE_PATH and DSP_BUNDLE_ID set. Use --no-hooks to skip it.`,
 	Flags: []cli.Flag{
 		&cli.StringFlag{
 			Name:    "source",
@@ -38,6 +114,10 @@ Examples:
 			Aliases: []string{"t"},
 			Usage:   "Target snapshot ID (default: latest snapshot)",
 		},
+		&cli.BoolFlag{
+			Name:  "full",
+			Usage: "Bundle every file of the target snapshot, as an initial bundle, instead of the changes since a source",
+		},
 		&cli.StringFlag{
 			Name:    "output",
 			Aliases: []string{"o"},
@@ -48,11 +128,50 @@ Examples:
 			Aliases: []string{"d"},
 			Usage:   "Description of the bundle",
 		},
+		&cli.StringSliceFlag{
+			Name:    "path",
+			Aliases: []string{"p"},
+			Usage:   "Only include changes at or below this path (can be repeated)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "redact",
+			Usage: "Leave out files matching this pattern, such as secrets/* or *.pem (can be repeated)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "to",
+			Usage: "Also write a copy encrypted for this host, alias or host group (can be repeated)",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "Also package the bundle as: eml (signed email messages)",
+		},
+		&cli.StringFlag{
+			Name:  "max-size",
+			Usage: "Largest email message for --format eml; larger bundles are split",
+			Value: "10MB",
+		},
+		&cli.StringFlag{
+			Name:  "mail-from",
+			Usage: "From address of the email messages (default: dsp@<hostname>)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "mail-to",
+			Usage: "To address of the email messages (can be repeated)",
+		},
+		&cli.StringFlag{
+			Name:  "parity",
+			Usage: "Also write Reed-Solomon parity adding this share of the bundle size (e.g. 10%)",
+		},
 		&cli.StringFlag{
 			Name:    "repo",
 			Aliases: []string{"r"},
 			Usage:   "Path to the repository (default: nearest repository)",
 		},
+		flags.NoHooksFlag,
+	},
+	Subcommands: []*cli.Command{
+		mergeCommand,
+		repairCommand,
 	},
 	Action: func(c *cli.Context) error {
 		// Create repository manager
@@ -70,17 +189,85 @@ Examples:
 		// Get DSP directory path from repository
 		dspDir := currentRepo.GetDSPDir()
 
+		// Check the packaging options before doing any work
+		var messageOptions eml.Options
+		switch format := c.String("format"); format {
+		case "", "zip":
+		case "eml":
+			maxSize, err := config.ParseSize(c.String("max-size"))
+			if err != nil {
+				return fmt.Errorf("invalid --max-size: %w", err)
+			}
+			if maxSize < eml.MinMessageSize {
+				return fmt.Errorf("--max-size must be at least %d bytes", eml.MinMessageSize)
+			}
+			messageOptions = eml.Options{
+				From:    c.String("mail-from"),
+				To:      c.StringSlice("mail-to"),
+				MaxSize: maxSize,
+			}
+		default:
+			return fmt.Errorf("unknown format %q: use zip or eml", format)
+		}
+		parity := 0
+		if c.IsSet("parity") {
+			if parity, err = bundle.ParseParity(c.String("parity")); err != nil {
+				return err
+			}
+		}
+
+		// Resolve encryption recipients before doing any work
+		var recipientKeys []string
+		if targets := c.StringSlice("to"); len(targets) > 0 {
+			hostManager, err := host.NewManager()
+			if err != nil {
+				return fmt.Errorf("failed to create host manager: %w", err)
+			}
+			recipientKeys, err = hostManager.RecipientKeys(targets)
+			if err != nil {
+				return fmt.Errorf("failed to resolve recipients: %w", err)
+			}
+		}
+
 		// Get source and target snapshots
-		sourceSnapshot, targetSnapshot, err := getSnapshots(dspDir, c.String("source"), c.String("target"))
+		if c.Bool("full") && c.IsSet("source") {
+			return fmt.Errorf("--full and --source cannot be used together")
+		}
+		sourceSnapshot, targetSnapshot, err := getSnapshots(dspDir, c.String("source"), c.String("target"), c.Bool("full"))
 		if err != nil {
 			return fmt.Errorf("failed to get snapshots: %w", err)
 		}
 
+		// Resolve selected paths
+		var selectedPaths []string
+		for _, p := range c.StringSlice("path") {
+			absPath, err := filepath.Abs(p)
+			if err != nil {
+				return fmt.Errorf("failed to get absolute path for %s: %w", p, err)
+			}
+			selectedPaths = append(selectedPaths, absPath)
+		}
+
+		// Resolve redaction patterns, relative to the repository root
+		var redact []string
+		for _, pattern := range c.StringSlice("redact") {
+			if pattern = strings.Trim(filepath.ToSlash(pattern), "/"); pattern != "" {
+				redact = append(redact, pattern)
+			}
+		}
+
 		// Create bundle
-		bundle, err := bundle.New(sourceSnapshot, targetSnapshot)
+		bundle, err := bundle.NewForPaths(c.Context, sourceSnapshot, targetSnapshot, selectedPaths, redact)
 		if err != nil {
 			return fmt.Errorf("failed to create bundle: %w", err)
 		}
+		defer bundle.Close()
+		if len(selectedPaths) > 0 && len(bundle.Changes) == 0 {
+			return fmt.Errorf("no changes found under the selected paths")
+		}
+		if len(redact) > 0 && len(bundle.Changes) == 0 {
+			return fmt.Errorf("no changes are left after redaction")
+		}
 
 		// Set bundle description if provided
 		if desc := c.String("description"); desc != "" {
@@ -103,115 +290,243 @@ Examples:
 			outputPath = outputPath[:len(outputPath)-len(filepath.Ext(outputPath))] + ".zip"
 		}
 
+		// Record the bundle in the repository lineage
+		lineage, err := ledger.LoadLineage(dspDir)
+		if err != nil {
+			return err
+		}
+		bundle.Lineage = lineage.Stamp(bundle.ID, bundle.Repository.Name)
+
 		// Save bundle
-		if err := bundle.Save(outputPath); err != nil {
+		if err := bundle.Save(c.Context, outputPath); err != nil {
 			return fmt.Errorf("failed to save bundle: %w", err)
 		}
+		if err := lineage.Save(dspDir); err != nil {
+			return err
+		}
 
-		// Print success message
-		fmt.Printf("Created bundle: %s\n", outputPath)
-		fmt.Printf("Source snapshot: %s\n", filepath.Base(sourceSnapshot))
-		fmt.Printf("Target snapshot: %s\n", filepath.Base(targetSnapshot))
-		fmt.Printf("Changes: %d\n", len(bundle.Changes))
-
-		return nil
-	},
-}
+		// Write the encrypted copy
+		encryptedPath := ""
+		if len(recipientKeys) > 0 {
+			data, err := os.ReadFile(outputPath)
+			if err != nil {
+				return fmt.Errorf("failed to read bundle: %w", err)
+			}
+			encrypted, err := crypto.EncryptForPublicKeys(data, recipientKeys)
+			if err != nil {
+				return fmt.Errorf("failed to encrypt bundle: %w", err)
+			}
+			encryptedPath = outputPath + ".age"
+			if err := os.WriteFile(encryptedPath, encrypted, 0644); err != nil {
+				return fmt.Errorf("failed to write encrypted bundle: %w", err)
+			}
+		}
 
-// getSnapshots returns the source and target snapshot paths
-func getSnapshots(dspDir, sourceID, targetID string) (string, string, error) {
-	snapshotsDir := filepath.Join(dspDir, "snapshots")
+		// Protect the bundle and its encrypted copy against bit rot
+		var parityPaths []string
+		if parity > 0 {
+			if parityPaths, err = writeParity(parity, outputPath, encryptedPath); err != nil {
+				return err
+			}
+		}
 
-	// Get target snapshot
-	var targetSnapshot string
-	if targetID != "" {
-		targetSnapshot = filepath.Join(snapshotsDir, targetID, "snapshot.json")
-		if _, err := os.Stat(targetSnapshot); err != nil {
-			return "", "", fmt.Errorf("target snapshot not found: %w", err)
+		// Package the bundle, or its encrypted copy, as email messages
+		var messages []string
+		if c.String("format") == "eml" {
+			payload := outputPath
+			if encryptedPath != "" {
+				payload = encryptedPath
+			}
+			keyManager, err := crypto.NewKeyManager()
+			if err != nil {
+				return fmt.Errorf("failed to create key manager: %w", err)
+			}
+			messages, err = eml.Write(keyManager, payload, bundle.ID, filepath.Dir(outputPath), messageOptions)
+			if err != nil {
+				return fmt.Errorf("failed to package bundle as email: %w", err)
+			}
 		}
-	} else {
-		// Find latest snapshot
-		entries, err := os.ReadDir(snapshotsDir)
+
+		// Encrypt a bundle kept in the repository at rest
+		repoConfig, err := config.NewWithRepo(currentRepo.Path, currentRepo.DSPDir)
 		if err != nil {
-			return "", "", fmt.Errorf("failed to read snapshots directory: %w", err)
+			return fmt.Errorf("failed to load repository configuration: %w", err)
 		}
-
-		var latestTime int64
-		for _, entry := range entries {
-			if !entry.IsDir() {
-				continue
-			}
-			snapshotPath := filepath.Join(snapshotsDir, entry.Name(), "snapshot.json")
-			if info, err := os.Stat(snapshotPath); err == nil {
-				if t := info.ModTime().UnixNano(); t > latestTime {
-					latestTime = t
-					targetSnapshot = snapshotPath
-				}
+		if repoConfig.EncryptAtRest {
+			if err := sealInRepo(outputPath, dspDir); err != nil {
+				return err
 			}
 		}
 
-		if targetSnapshot == "" {
-			return "", "", fmt.Errorf("no snapshots found")
+		// Print success message
+		fmt.Printf("Created bundle: %s\n", outputPath)
+		if encryptedPath != "" {
+			fmt.Printf("Encrypted for %d hosts: %s\n", len(recipientKeys), encryptedPath)
 		}
-	}
+		for _, p := range parityPaths {
+			fmt.Printf("Parity (%d%%): %s\n", parity, p)
+		}
+		if len(messages) > 0 {
+			fmt.Printf("Email messages (%d):\n", len(messages))
+			for _, m := range messages {
+				fmt.Printf("  %s\n", m)
+			}
+		}
+		if bundle.IsInitial {
+			fmt.Printf("Source snapshot: (none, initial bundle)\n")
+		} else {
+			fmt.Printf("Source snapshot: %s\n", bundle.SourceSnapshot)
+		}
+		fmt.Printf("Target snapshot: %s\n", bundle.TargetSnapshot)
+		fmt.Printf("Changes: %d\n", len(bundle.Changes))
+		if len(selectedPaths) > 0 {
+			fmt.Printf("Selected paths: %s\n", strings.Join(selectedPaths, ", "))
+		}
+		if r := bundle.Redacted; r != nil {
+			fmt.Printf("Redacted: %d files matching %s\n", r.Files, strings.Join(r.Patterns, ", "))
+		}
+		warnPathIssues(bundle.Changes)
 
-	// If source ID is specified, use it
-	if sourceID != "" {
-		sourceSnapshot := filepath.Join(snapshotsDir, sourceID, "snapshot.json")
-		if _, err := os.Stat(sourceSnapshot); err != nil {
-			return "", "", fmt.Errorf("source snapshot not found: %w", err)
+		// Enforce the bundle retention policy
+		pruneBundles(dspDir, repoConfig.KeepBundlesDays)
+
+		// Run post-bundle hook
+		hooks.RunPost(hooks.Context{
+			RepoName: currentRepo.Name,
+			RepoPath: currentRepo.Path,
+			DSPDir:   dspDir,
+			Disabled: c.Bool("no-hooks"),
+		}, hooks.PostBundle, map[string]string{
+			"BUNDLE_ID":      bundle.ID,
+			"BUNDLE_PATH":    outputPath,
+			"BUNDLE_CHANGES": fmt.Sprintf("%d", len(bundle.Changes)),
+		})
+
+		return nil
+	},
+}
+
+// writeParity writes the parity files of the given bundle files, skipping
+// empty paths, and returns their paths
+func writeParity(percent int, paths ...string) ([]string, error) {
+	var written []string
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := bundle.WriteParity(path, percent); err != nil {
+			return written, fmt.Errorf("failed to write parity for %s: %w", filepath.Base(path), err)
 		}
-		return sourceSnapshot, targetSnapshot, nil
+		written = append(written, path+bundle.ParitySuffix)
 	}
+	return written, nil
+}
 
-	// Count snapshots to determine if this is an initial bundle
-	entries, err := os.ReadDir(snapshotsDir)
+// sealInRepo encrypts a bundle saved in the bundles directory of the
+// repository at rest. Bundles written elsewhere are meant to be carried to
+// other hosts and stay plain.
+func sealInRepo(path, dspDir string) error {
+	absPath, err := filepath.Abs(path)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to read snapshots directory: %w", err)
+		return fmt.Errorf("failed to get absolute path: %w", err)
 	}
+	bundlesDir, err := filepath.Abs(filepath.Join(dspDir, "bundles"))
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	if filepath.Dir(absPath) != bundlesDir {
+		return nil
+	}
+	return bundle.Seal(path)
+}
 
-	snapshotCount := 0
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
-		snapshotPath := filepath.Join(snapshotsDir, entry.Name(), "snapshot.json")
-		if _, err := os.Stat(snapshotPath); err == nil {
-			snapshotCount++
+// warnPathIssues warns about paths in the bundle that cannot be created as-is
+// on other operating systems
+func warnPathIssues(changes []bundle.Change) {
+	var paths []string
+	for _, change := range changes {
+		if change.Type != "delete" {
+			paths = append(paths, change.Path)
 		}
 	}
+	issues := bundle.CheckPaths(paths, "")
+	if len(issues) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %d paths cannot be created as-is on some systems; 'dsp apply --path-issues' can rename or skip them:\n", len(issues))
+	for _, issue := range issues {
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", issue.Path, issue.Detail)
+	}
+}
 
-	// If only one snapshot exists, treat as initial bundle
-	if snapshotCount == 1 {
-		return "", targetSnapshot, nil
+// pruneBundles removes bundles older than keep_bundles_days
+func pruneBundles(dspDir string, days int) {
+	if days <= 0 {
+		return
+	}
+	removed, err := bundle.Prune(dspDir, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
 	}
+	if len(removed) > 0 {
+		fmt.Printf("Removed %d bundles older than %d days (keep_bundles_days)\n", len(removed), days)
+	}
+}
 
-	// Find previous snapshot
-	var prevTime int64
-	targetTimeStr := filepath.Base(filepath.Dir(targetSnapshot))
-	targetTime, err := time.Parse("20060102-150405", targetTimeStr)
+// getSnapshots returns the source and target snapshot paths. Snapshot IDs
+// may be given in full or as a unique prefix. An empty source path means an
+// initial bundle.
+func getSnapshots(dspDir, sourceID, targetID string, full bool) (string, string, error) {
+	entries, err := snapshot.List(dspDir)
 	if err != nil {
-		return "", "", fmt.Errorf("invalid target snapshot timestamp: %w", err)
+		return "", "", err
+	}
+	if len(entries) == 0 {
+		return "", "", fmt.Errorf("no snapshots found")
 	}
-	targetTimeUnix := targetTime.UnixNano()
 
-	var sourceSnapshot string
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
+	// Get target snapshot (default: latest)
+	targetIndex := len(entries) - 1
+	if targetID != "" {
+		id, err := snapshot.Resolve(dspDir, targetID)
+		if err != nil {
+			return "", "", fmt.Errorf("target snapshot: %w", err)
 		}
-		snapshotPath := filepath.Join(snapshotsDir, entry.Name(), "snapshot.json")
-		if info, err := os.Stat(snapshotPath); err == nil {
-			if t := info.ModTime().UnixNano(); t < targetTimeUnix && t > prevTime {
-				prevTime = t
-				sourceSnapshot = snapshotPath
-			}
+		targetIndex = indexOf(entries, id)
+		if targetIndex < 0 {
+			return "", "", fmt.Errorf("target snapshot %s is not readable", id)
 		}
 	}
+	targetSnapshot := snapshot.FilePath(dspDir, entries[targetIndex].ID)
 
-	if sourceSnapshot == "" {
+	// If source ID is specified, use it
+	if sourceID != "" {
+		id, err := snapshot.Resolve(dspDir, sourceID)
+		if err != nil {
+			return "", "", fmt.Errorf("source snapshot: %w", err)
+		}
+		return snapshot.FilePath(dspDir, id), targetSnapshot, nil
+	}
+
+	// If only one snapshot exists, or all files are asked for, treat as
+	// initial bundle
+	if full || len(entries) == 1 {
+		return "", targetSnapshot, nil
+	}
+
+	// Use the snapshot before the target
+	if targetIndex == 0 {
 		return "", "", fmt.Errorf("no previous snapshot found")
 	}
+	return snapshot.FilePath(dspDir, entries[targetIndex-1].ID), targetSnapshot, nil
+}
 
-	return sourceSnapshot, targetSnapshot, nil
+// indexOf returns the position of a snapshot ID in a list, or -1
+func indexOf(entries []snapshot.Entry, id string) int {
+	for i, entry := range entries {
+		if entry.ID == id {
+			return i
+		}
+	}
+	return -1
 }
@@ -0,0 +1,89 @@
+package bundlecmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/urfave/cli/v2"
+)
+
+var mergeCommand = &cli.Command{
+	Name:      "merge",
+	Usage:     "Merge a chain of bundles into one consolidated bundle",
+	ArgsUsage: "<bundle> <bundle> [bundle...]",
+	Description: `Merge bundles that form a contiguous chain into a single bundle.
+Bundles must be given in order, each starting at the snapshot the previous
+one ended at. Changes are squashed so that later changes win: a file added
+and then modified becomes a single add, and a file added and then deleted
+is dropped.
+
+Examples:
+  # Merge two bundles
+  dsp bundle merge -o combined.zip a.zip b.zip`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Output bundle file path (default: <id>.zip in the current directory)",
+		},
+		&cli.StringFlag{
+			Name:    "description",
+			Aliases: []string{"d"},
+			Usage:   "Description of the merged bundle",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() < 2 {
+			return fmt.Errorf("at least two bundles are required. Usage: dsp bundle merge [-o <output>] <bundle> <bundle> [bundle...]")
+		}
+
+		// Load bundles in the given order
+		var bundles []*bundle.Bundle
+		for _, path := range c.Args().Slice() {
+			if strings.HasPrefix(path, "-") {
+				return fmt.Errorf("flags must come before the bundle paths: dsp bundle merge %s <bundle>...", path)
+			}
+			b, err := bundle.Load(c.Context, path)
+			if err != nil {
+				return fmt.Errorf("failed to load bundle %s: %w", path, err)
+			}
+			bundles = append(bundles, b)
+		}
+
+		// Merge
+		merged, err := bundle.Merge(bundles)
+		if err != nil {
+			return fmt.Errorf("failed to merge bundles: %w", err)
+		}
+		if desc := c.String("description"); desc != "" {
+			merged.Description = desc
+		}
+
+		// Determine output path
+		outputPath := c.String("output")
+		if outputPath == "" {
+			outputPath = fmt.Sprintf("%s.zip", merged.ID)
+		} else if filepath.Ext(outputPath) != ".zip" {
+			outputPath = outputPath[:len(outputPath)-len(filepath.Ext(outputPath))] + ".zip"
+		}
+
+		// Save merged bundle
+		if err := merged.Save(c.Context, outputPath); err != nil {
+			return fmt.Errorf("failed to save bundle: %w", err)
+		}
+
+		input := 0
+		for _, b := range bundles {
+			input += len(b.Changes)
+		}
+
+		fmt.Printf("Created merged bundle: %s\n", outputPath)
+		fmt.Printf("Source snapshot: %s\n", merged.SourceSnapshot)
+		fmt.Printf("Target snapshot: %s\n", merged.TargetSnapshot)
+		fmt.Printf("Changes: %d (from %d across %d bundles)\n", len(merged.Changes), input, len(bundles))
+
+		return nil
+	},
+}
@@ -0,0 +1,141 @@
+package bundlecmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/atrest"
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/exitcode"
+	"github.com/Mattddixo/dsp/internal/protocol"
+	"github.com/urfave/cli/v2"
+)
+
+var repairCommand = &cli.Command{
+	Name:      "repair",
+	Usage:     "Check a bundle for damage and salvage the changes that survived",
+	ArgsUsage: "<bundle>",
+	Description: `Check every entry of a bundle archive against its CRC-32, and file
+contents also against their hashes. If the archive is damaged, the changes
+whose contents are intact are written to a partial bundle that can be
+applied like any other.
+
+If the central directory at the end of the archive is lost, for example
+because the bundle was cut off in transfer, the entries are found by
+scanning the archive instead. The bundle metadata is written last, so a
+bundle cut off before it cannot be salvaged.
+
+The partial bundle keeps the ID of the damaged one. Once the changes it
+lost arrive in an intact copy, apply that copy with --reapply.
+
+Examples:
+  # Check a bundle without writing anything
+  dsp bundle repair --check 20240101120000.zip
+
+  # Salvage what is left of a damaged bundle
+  dsp bundle repair -o salvaged.zip 20240101120000.zip`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Partial bundle file path (default: <bundle>.repaired.zip next to the bundle)",
+		},
+		&cli.BoolFlag{
+			Name:  "check",
+			Usage: "Only report the damage, without writing a partial bundle",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return fmt.Errorf("exactly one bundle is required. Usage: dsp bundle repair [-o <output>] <bundle>")
+		}
+		bundlePath := c.Args().First()
+
+		// Determine output path
+		outputPath := ""
+		if !c.Bool("check") {
+			outputPath = c.String("output")
+			if outputPath == "" {
+				outputPath = strings.TrimSuffix(bundlePath, filepath.Ext(bundlePath)) + ".repaired.zip"
+			} else if filepath.Ext(outputPath) != ".zip" {
+				outputPath = outputPath[:len(outputPath)-len(filepath.Ext(outputPath))] + ".zip"
+			}
+			if abs, err := filepath.Abs(outputPath); err == nil {
+				if src, err := filepath.Abs(bundlePath); err == nil && abs == src {
+					return fmt.Errorf("the partial bundle cannot replace the damaged one; choose another --output")
+				}
+			}
+		}
+
+		// A bundle sealed with encrypt_at_rest is checked through a decrypted
+		// copy, and its partial bundle is sealed too
+		sealed, err := atrest.IsSealed(bundlePath)
+		if err != nil {
+			return fmt.Errorf("failed to read bundle: %w", err)
+		}
+		globalConfig, err := config.LoadGlobal()
+		if err != nil {
+			return err
+		}
+		plainPath, cleanup, err := bundle.Plain(bundlePath, globalConfig.SecureDelete)
+		if err != nil {
+			return fmt.Errorf("%w; a sealed bundle can only be repaired with its parity file ('dsp apply' uses it)", err)
+		}
+		defer cleanup()
+
+		report, err := bundle.Repair(c.Context, plainPath, outputPath)
+		if report != nil {
+			printRepairReport(bundlePath, report)
+		}
+		if err != nil {
+			return err
+		}
+		if sealed && outputPath != "" && !report.Intact() {
+			if err := bundle.Seal(outputPath); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case report.Intact():
+			fmt.Println("Bundle is intact; nothing to repair")
+		case outputPath == "":
+			return protocol.VerificationError(fmt.Errorf("bundle %s is damaged; run without --check to salvage %d of its changes", bundlePath, len(report.Salvageable)))
+		case len(report.Lost) == 0:
+			fmt.Printf("Created repaired bundle with all changes: %s\n", outputPath)
+		default:
+			fmt.Printf("Created partial bundle: %s\n", outputPath)
+			fmt.Printf("Apply an intact copy of bundle %s with --reapply for the %d lost changes\n", report.Bundle.ID, len(report.Lost))
+			return exitcode.PartialError(fmt.Errorf("%d changes of bundle %s could not be salvaged", len(report.Lost), report.Bundle.ID))
+		}
+		return nil
+	},
+}
+
+// printRepairReport shows the damage found in a bundle and the changes it
+// affects
+func printRepairReport(bundlePath string, report *bundle.RepairReport) {
+	fmt.Printf("Checked %d entries of %s\n", report.Entries, bundlePath)
+	if report.Scanned {
+		fmt.Println("The central directory is damaged; entries were found by scanning the archive")
+	}
+	if len(report.Damaged) > 0 {
+		fmt.Printf("Damaged entries: %d\n", len(report.Damaged))
+		for _, d := range report.Damaged {
+			fmt.Printf("  %s: %s\n", d.Name, d.Reason)
+		}
+	}
+	if report.Bundle == nil {
+		return
+	}
+
+	fmt.Printf("Salvageable changes: %d of %d\n", len(report.Salvageable), len(report.Bundle.Changes))
+	if len(report.Lost) > 0 {
+		fmt.Println("Lost changes:")
+		for _, lost := range report.Lost {
+			fmt.Printf("  %s %s (%s)\n", lost.Type, lost.Path, lost.Reason)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/Mattddixo/dsp/internal/commands/diffcmd"
 	"github.com/Mattddixo/dsp/internal/commands/historycmd"
 	"github.com/Mattddixo/dsp/internal/commands/initcmd"
+	"github.com/Mattddixo/dsp/internal/commands/logcmd"
 	"github.com/Mattddixo/dsp/internal/commands/repocmd"
 	"github.com/Mattddixo/dsp/internal/commands/snapshotcmd"
 	"github.com/Mattddixo/dsp/internal/commands/statuscmd"
@@ -43,6 +44,7 @@ var (
 	ApplyCommand    = applycmd.Command
 	StatusCommand   = statuscmd.Command
 	HistoryCommand  = historycmd.Command
+	LogCommand      = logcmd.Command
 	TrackCommand    = trackcmd.Command
 	UntrackCommand  = untrackcmd.Command
 	RepoCommand     = repocmd.Command
@@ -0,0 +1,274 @@
+package configcmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+// Configuration scopes
+const (
+	scopeRepo   = "repo"
+	scopeGlobal = "global"
+)
+
+var scopeFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "global",
+		Usage: "Use the global configuration (~/.dsp-global/config.yaml)",
+	},
+	&cli.BoolFlag{
+		Name:  "repo",
+		Usage: "Use the configuration of the current repository",
+	},
+}
+
+var Command = &cli.Command{
+	Name:  "config",
+	Usage: "View and change configuration",
+	Description: `View and change repository and global configuration.
+
+Repository settings live in <dsp-dir>/config.yaml of the current repository
+(the working repository, or the nearest one). Global settings live in
+config.yaml of the global DSP directory and apply to every repository.
+Settings are known by name, so --global and --repo are only needed to
+restrict 'dsp config list' to one scope.
+
+Values are validated before they are saved. Environment variables such as
+DSP_HASH_ALGORITHM still override the saved values.
+
+Setting hash_algorithm to blake3-keyed generates a secret hash key for the
+repository; 'dsp config hash-key' shows it for peers and sets theirs.
+
+Examples:
+  # Show all settings
+  dsp config list
+
+  # Read and change a repository setting
+  dsp config get compression_level
+  dsp config set compression_level 9
+
+  # Change a global setting
+  dsp config set trust_policy manual`,
+	Subcommands: []*cli.Command{
+		{
+			Name:  "list",
+			Usage: "List settings and their values",
+			Flags: scopeFlags,
+			Action: func(c *cli.Context) error {
+				showRepo := !c.Bool("global") || c.Bool("repo")
+				showGlobal := !c.Bool("repo") || c.Bool("global")
+
+				if showRepo {
+					cfg, path, err := loadRepoConfig()
+					if err != nil {
+						if c.Bool("repo") {
+							return err
+						}
+						fmt.Printf("Repository: %v\n", err)
+					} else {
+						fmt.Printf("Repository (%s):\n", path)
+						for _, s := range config.RepoSettings {
+							value, _ := cfg.Get(s.Key)
+							printSetting(s, value)
+						}
+					}
+				}
+
+				if showGlobal {
+					if showRepo {
+						fmt.Println()
+					}
+					cfg, err := config.LoadGlobalFile()
+					if err != nil {
+						return err
+					}
+					path, err := config.GlobalConfigPath()
+					if err != nil {
+						return err
+					}
+					fmt.Printf("Global (%s):\n", path)
+					for _, s := range config.GlobalSettings {
+						value, _ := cfg.Get(s.Key)
+						printSetting(s, value)
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "get",
+			Usage:     "Print the value of a setting",
+			ArgsUsage: "<key>",
+			Flags:     scopeFlags,
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return fmt.Errorf("expected exactly one setting name")
+				}
+				key := c.Args().First()
+
+				scope, err := scopeOf(c, key)
+				if err != nil {
+					return err
+				}
+
+				var value string
+				if scope == scopeGlobal {
+					cfg, err := config.LoadGlobalFile()
+					if err != nil {
+						return err
+					}
+					value, err = cfg.Get(key)
+					if err != nil {
+						return err
+					}
+				} else {
+					cfg, _, err := loadRepoConfig()
+					if err != nil {
+						return err
+					}
+					value, err = cfg.Get(key)
+					if err != nil {
+						return err
+					}
+				}
+
+				fmt.Println(value)
+				return nil
+			},
+		},
+		{
+			Name:      "set",
+			Usage:     "Change a setting",
+			ArgsUsage: "<key> <value>",
+			Flags:     scopeFlags,
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 2 {
+					return fmt.Errorf("expected a setting name and a value")
+				}
+				key, value := c.Args().Get(0), c.Args().Get(1)
+
+				scope, err := scopeOf(c, key)
+				if err != nil {
+					return err
+				}
+
+				if scope == scopeGlobal {
+					cfg, err := config.LoadGlobalFile()
+					if err != nil {
+						return err
+					}
+					if err := cfg.Set(key, value); err != nil {
+						return fmt.Errorf("failed to set %s: %w", key, err)
+					}
+					if err := cfg.Save(); err != nil {
+						return err
+					}
+					setting, _ := config.FindSetting(config.GlobalSettings, key)
+					warnOverride(setting)
+					fmt.Printf("Set global %s to %s\n", key, value)
+					return nil
+				}
+
+				cfg, path, err := loadRepoConfig()
+				if err != nil {
+					return err
+				}
+				old := *cfg
+				if err := cfg.Set(key, value); err != nil {
+					return fmt.Errorf("failed to set %s: %w", key, err)
+				}
+				if err := cfg.Save(path); err != nil {
+					return err
+				}
+
+				// Warn about consequences for existing data
+				dspDir := filepath.Dir(path)
+				switch {
+				case key == "hash_algorithm" && old.HashAlgorithm != cfg.HashAlgorithm:
+					warnRehash(dspDir, fmt.Sprintf("%s hashes do not match %s hashes", old.HashAlgorithm, cfg.HashAlgorithm))
+					if cfg.HashAlgorithm == utils.KeyedBlake3 {
+						if err := ensureHashKey(dspDir); err != nil {
+							return err
+						}
+					}
+				case key == "data_dir" && old.DataDir != cfg.DataDir:
+					fmt.Fprintf(os.Stderr, "Warning: existing data in %s is not moved to %s\n", old.DataDir, cfg.DataDir)
+				}
+				setting, _ := config.FindSetting(config.RepoSettings, key)
+				warnOverride(setting)
+
+				fmt.Printf("Set %s to %s\n", key, value)
+				return nil
+			},
+		},
+		hashKeyCommand,
+	},
+}
+
+// scopeOf returns the scope a key belongs to, checking it against the
+// --global and --repo flags
+func scopeOf(c *cli.Context, key string) (string, error) {
+	if c.Bool("global") && c.Bool("repo") {
+		return "", fmt.Errorf("--global and --repo cannot be used together")
+	}
+
+	scope := ""
+	if _, ok := config.FindSetting(config.RepoSettings, key); ok {
+		scope = scopeRepo
+	} else if _, ok := config.FindSetting(config.GlobalSettings, key); ok {
+		scope = scopeGlobal
+	} else {
+		return "", fmt.Errorf("unknown setting: %s (see 'dsp config list')", key)
+	}
+
+	if c.Bool("global") && scope != scopeGlobal {
+		return "", fmt.Errorf("%s is a repository setting", key)
+	}
+	if c.Bool("repo") && scope != scopeRepo {
+		return "", fmt.Errorf("%s is a global setting", key)
+	}
+	return scope, nil
+}
+
+// loadRepoConfig loads the configuration file of the current repository
+func loadRepoConfig() (*config.Config, string, error) {
+	manager, err := repo.NewManager()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create repository manager: %w", err)
+	}
+	currentRepo, err := manager.GetCurrentRepo("")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get repository context: %w", err)
+	}
+
+	path := filepath.Join(currentRepo.GetDSPDir(), "config.yaml")
+	cfg, err := config.LoadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return cfg, path, nil
+}
+
+// printSetting prints one line of 'dsp config list'
+func printSetting(s config.Setting, value string) {
+	line := fmt.Sprintf("  %-26s %s", s.Key, value)
+	if s.Env != "" {
+		if env := os.Getenv(s.Env); env != "" {
+			line += fmt.Sprintf(" (overridden by %s=%s)", s.Env, env)
+		}
+	}
+	fmt.Println(line)
+}
+
+// warnOverride warns when an environment variable hides a saved setting
+func warnOverride(s config.Setting) {
+	if s.Env != "" && os.Getenv(s.Env) != "" {
+		fmt.Fprintf(os.Stderr, "Warning: %s is set and overrides this setting\n", s.Env)
+	}
+}
@@ -0,0 +1,112 @@
+package configcmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/Mattddixo/dsp/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+var hashKeyCommand = &cli.Command{
+	Name:  "hash-key",
+	Usage: "Show, set or generate the key of the blake3-keyed hash algorithm",
+	Description: `Show, set or generate the key of the blake3-keyed hash algorithm.
+
+With hash_algorithm set to blake3-keyed, file and chunk hashes in snapshots,
+bundles and delta requests are keyed BLAKE3 hashes. Without the key they
+cannot be compared with the hashes of known files, so intermediaries that see
+them cannot tell which files a repository holds. The key is kept in
+<dsp-dir>/hash.key and is generated when the algorithm is selected.
+
+Every peer syncing the repository needs the same key to verify and apply its
+bundles. Show it on one peer and set it on the others, over a channel you
+trust:
+
+  dsp config hash-key
+  dsp config hash-key --set <key>
+
+A different key changes every hash, so the next snapshot after --set or
+--generate reports every tracked file as modified.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "set",
+			Usage: "Use this key, in hex, such as one shown by a peer",
+		},
+		&cli.BoolFlag{
+			Name:  "generate",
+			Usage: "Generate a new random key",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.IsSet("set") && c.Bool("generate") {
+			return fmt.Errorf("--set and --generate cannot be used together")
+		}
+		cfg, path, err := loadRepoConfig()
+		if err != nil {
+			return err
+		}
+		dspDir := filepath.Dir(path)
+		old, err := config.LoadHashKey(dspDir)
+		if err != nil {
+			return err
+		}
+
+		var key []byte
+		switch {
+		case c.IsSet("set"):
+			if key, err = config.ParseHashKey(c.String("set")); err != nil {
+				return fmt.Errorf("invalid hash key: %w", err)
+			}
+			if err := config.SaveHashKey(dspDir, key); err != nil {
+				return err
+			}
+			fmt.Println("Hash key set")
+		case c.Bool("generate"):
+			if key, err = config.GenerateHashKey(dspDir); err != nil {
+				return err
+			}
+			fmt.Printf("Generated hash key %s\n", hex.EncodeToString(key))
+		default:
+			if old == nil {
+				return fmt.Errorf("the repository has no hash key; generate one with --generate or set a peer's with --set")
+			}
+			fmt.Println(hex.EncodeToString(old))
+			if cfg.HashAlgorithm != utils.KeyedBlake3 {
+				fmt.Fprintf(os.Stderr, "Warning: hash_algorithm is %s, so the key is not used\n", cfg.HashAlgorithm)
+			}
+			return nil
+		}
+
+		if old != nil && hex.EncodeToString(old) != hex.EncodeToString(key) && cfg.HashAlgorithm == utils.KeyedBlake3 {
+			warnRehash(dspDir, "the hash key changed")
+		}
+		return nil
+	},
+}
+
+// warnRehash warns that the next snapshot reports every tracked file as
+// modified, if the repository has snapshots
+func warnRehash(dspDir, reason string) {
+	if entries, err := snapshot.List(dspDir); err == nil && len(entries) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: the repository has %d snapshots; %s, so the next snapshot will report every tracked file as modified\n",
+			len(entries), reason)
+	}
+}
+
+// ensureHashKey generates a hash key for a repository that has none
+func ensureHashKey(dspDir string) error {
+	key, err := config.LoadHashKey(dspDir)
+	if err != nil || key != nil {
+		return err
+	}
+	if _, err := config.GenerateHashKey(dspDir); err != nil {
+		return err
+	}
+	fmt.Printf("Generated a hash key in %s; peers syncing this repository need it too (see 'dsp config hash-key')\n", config.HashKeyPath(dspDir))
+	return nil
+}
@@ -0,0 +1,165 @@
+package cryptocmd
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/audit"
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/internal/host"
+	"github.com/urfave/cli/v2"
+)
+
+// certCommand returns the command managing the local TLS certificate
+func certCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "cert",
+		Usage: "Show or rotate the local TLS certificate",
+		Description: `Show or rotate the local TLS certificate, which export serves and import
+presents as its client certificate. Peers pin it by fingerprint.`,
+		Subcommands: []*cli.Command{
+			{
+				Name:  "show",
+				Usage: "Show the local certificate",
+				Action: func(c *cli.Context) error {
+					manager, err := crypto.NewKeyManager()
+					if err != nil {
+						return fmt.Errorf("failed to create key manager: %w", err)
+					}
+					cert, err := localCertificate(manager)
+					if err != nil {
+						return err
+					}
+					fingerprint, err := manager.GetCertificateFingerprint()
+					if err != nil {
+						return err
+					}
+					rotations, err := manager.CertRotations()
+					if err != nil {
+						return err
+					}
+
+					fmt.Printf("Fingerprint: %s\n", fingerprint)
+					fmt.Printf("Subject: %s\n", cert.Subject.CommonName)
+					fmt.Printf("Valid: %s to %s\n", cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+					fmt.Printf("DNS names: %s\n", strings.Join(cert.DNSNames, ", "))
+					var ips []string
+					for _, ip := range cert.IPAddresses {
+						ips = append(ips, ip.String())
+					}
+					fmt.Printf("IP addresses: %s\n", strings.Join(ips, ", "))
+					if len(rotations) > 0 {
+						fmt.Printf("Rotated: %d times, last on %s\n", len(rotations), rotations[len(rotations)-1].RotatedAt.Format(time.RFC3339))
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "rotate",
+				Usage: "Regenerate the local certificate",
+				Description: `Regenerate the local certificate for the current hostname, for example after
+renaming the machine or changing its addresses. --san adds IP addresses or
+DNS names to the certificate, besides the hostname, localhost and *.local;
+names given to earlier rotations are not kept.
+
+The rotation is signed with the key of the old certificate and recorded in
+the global directory. Exporters send the recorded rotations with their
+export information and importers send them at key exchange, so peers that
+pinned the old certificate verify the signature and pin the new one at the
+next transfer, without 'dsp host remove'. Host entries of this machine
+pinned to the old certificate are updated here.`,
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "san",
+						Usage: "IP address or DNS name to add to the certificate (comma-separated or repeated)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					var sans []string
+					for _, value := range c.StringSlice("san") {
+						for _, san := range strings.Split(value, ",") {
+							if san = strings.TrimSpace(san); san != "" {
+								sans = append(sans, san)
+							}
+						}
+					}
+
+					manager, err := crypto.NewKeyManager()
+					if err != nil {
+						return fmt.Errorf("failed to create key manager: %w", err)
+					}
+					rotation, err := manager.RotateCertificate(sans)
+					if err != nil {
+						return fmt.Errorf("failed to rotate certificate: %w", err)
+					}
+					cert, err := localCertificate(manager)
+					if err != nil {
+						return err
+					}
+					audit.Record(audit.Event{Type: audit.CertRotation, Subject: cert.Subject.CommonName, Outcome: "rotated",
+						Detail: fmt.Sprintf("%s -> %s", rotation.OldFingerprint, rotation.NewFingerprint)})
+
+					updated, err := repinLocalHosts(rotation, cert)
+					if err != nil {
+						return err
+					}
+
+					fmt.Println("Rotated the local certificate")
+					fmt.Printf("Old fingerprint: %s\n", rotation.OldFingerprint)
+					fmt.Printf("New fingerprint: %s\n", rotation.NewFingerprint)
+					if updated > 0 {
+						fmt.Printf("Updated %d host entries pinned to the old certificate\n", updated)
+					}
+					fmt.Println("Peers that pinned the old certificate pin the new one at their next transfer or key exchange with this host.")
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// localCertificate returns the parsed local certificate
+func localCertificate(manager *crypto.KeyManager) (*x509.Certificate, error) {
+	pair, err := manager.GetCertificate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// repinLocalHosts updates the host entries that pinned the certificate this
+// machine rotated away from, such as entries for itself, and returns how
+// many changed
+func repinLocalHosts(rotation *crypto.CertRotation, cert *x509.Certificate) (int, error) {
+	manager, err := host.NewManager()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create host manager: %w", err)
+	}
+	updated := 0
+	for _, h := range manager.ListHosts() {
+		pinnedServer := h.CertInfo != nil && h.CertInfo.Fingerprint == rotation.OldFingerprint
+		if !pinnedServer && h.ClientCert != rotation.OldFingerprint {
+			continue
+		}
+		err := manager.Modify(h.Name, func(h *host.Host) error {
+			if pinnedServer {
+				h.UpdateCertificate(rotation.NewFingerprint, cert.NotBefore, cert.NotAfter)
+			}
+			if h.ClientCert == rotation.OldFingerprint {
+				h.ClientCert = rotation.NewFingerprint
+			}
+			return nil
+		})
+		if err != nil {
+			return updated, fmt.Errorf("failed to update host %s: %w", h.Name, err)
+		}
+		updated++
+	}
+	return updated, nil
+}
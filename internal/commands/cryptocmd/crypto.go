@@ -2,8 +2,12 @@ package cryptocmd
 
 import (
 	"fmt"
+	"os"
+	"strings"
 
+	"github.com/Mattddixo/dsp/internal/audit"
 	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/internal/host"
 	"github.com/urfave/cli/v2"
 )
 
@@ -23,6 +27,8 @@ Commands:
   list-recipients List all registered recipients
   remove-recipient Remove a recipient
   export-key      Export your public key
+  decrypt         Decrypt a bundle encrypted for you
+  cert            Show or rotate the local TLS certificate
 
 Examples:
   # Initialize the crypto system
@@ -40,6 +46,12 @@ Examples:
   # Export your public key
   dsp crypto export-key
 
+  # Decrypt a bundle created with 'dsp bundle --to'
+  dsp crypto decrypt 20240101120000.zip.age
+
+  # Regenerate the certificate after renaming the machine
+  dsp crypto cert rotate --san 192.168.1.20,nas.lan
+
 For more information about a specific command, use:
   dsp crypto <command> --help`,
 		Subcommands: []*cli.Command{
@@ -82,8 +94,9 @@ The generated keys will be used for encrypting bundles when encryption is enable
 				Usage: "Add a new recipient",
 				Description: `Add a new recipient's public key to the system.
 
-This command adds a recipient's public key to your list of trusted recipients.
-When encryption is enabled, bundles can be encrypted for specific recipients.
+Recipients are hosts: this is a shortcut for 'dsp host add --trust', and the
+recipient can be managed with the 'dsp host' commands afterwards. Bundles can
+be encrypted for it with 'dsp bundle --to <name>'.
 
 The recipient's public key should be in age format (starts with "age1...").`,
 				Flags: []cli.Flag{
@@ -99,15 +112,25 @@ The recipient's public key should be in age format (starts with "age1...").`,
 					},
 				},
 				Action: func(c *cli.Context) error {
-					manager, err := crypto.NewKeyManager()
+					if _, err := crypto.ParsePublicKeys([]string{c.String("key")}); err != nil {
+						return fmt.Errorf("failed to add recipient: %w", err)
+					}
+
+					manager, err := host.NewManager()
 					if err != nil {
-						return fmt.Errorf("failed to create key manager: %w", err)
+						return fmt.Errorf("failed to create host manager: %w", err)
 					}
 
-					if err := manager.AddRecipient(c.String("name"), c.String("key")); err != nil {
+					h := &host.Host{
+						Name:      c.String("name"),
+						PublicKey: c.String("key"),
+						Trusted:   true,
+					}
+					if err := manager.AddHost(h); err != nil {
 						return fmt.Errorf("failed to add recipient: %w", err)
 					}
 
+					audit.Record(audit.Event{Type: audit.TrustChange, Subject: h.Name, Outcome: "trusted", Detail: "added as recipient"})
 					fmt.Printf("Added recipient '%s' successfully!\n", c.String("name"))
 					return nil
 				},
@@ -117,16 +140,20 @@ The recipient's public key should be in age format (starts with "age1...").`,
 				Usage: "List all recipients",
 				Description: `List all registered recipients and their public keys.
 
-This command displays all recipients that have been added to your system,
-including their names and public keys. Use this to verify your recipients
-or to share your list of trusted recipients.`,
+Recipients are the known hosts that have a public key; 'dsp host list' shows
+the same hosts with more detail.`,
 				Action: func(c *cli.Context) error {
-					manager, err := crypto.NewKeyManager()
+					manager, err := host.NewManager()
 					if err != nil {
-						return fmt.Errorf("failed to create key manager: %w", err)
+						return fmt.Errorf("failed to create host manager: %w", err)
 					}
 
-					recipients := manager.ListRecipients()
+					var recipients []*host.Host
+					for _, h := range manager.ListHosts() {
+						if host.NormalizeKey(h.PublicKey) != "" {
+							recipients = append(recipients, h)
+						}
+					}
 					if len(recipients) == 0 {
 						fmt.Println("No recipients found.")
 						return nil
@@ -135,7 +162,10 @@ or to share your list of trusted recipients.`,
 					fmt.Println("Recipients:")
 					for _, r := range recipients {
 						fmt.Printf("\nName: %s\n", r.Name)
-						fmt.Printf("Key: %s\n", r.Key)
+						fmt.Printf("Key: %s\n", host.NormalizeKey(r.PublicKey))
+						if !r.Trusted {
+							fmt.Println("Trusted: false")
+						}
 					}
 					return nil
 				},
@@ -145,7 +175,7 @@ or to share your list of trusted recipients.`,
 				Usage: "Remove a recipient",
 				Description: `Remove a recipient from your list of trusted recipients.
 
-This command removes a recipient's public key from your system.
+Recipients are hosts, so this removes the host entirely, like 'dsp host remove'.
 After removal, you will no longer be able to encrypt bundles for this recipient.`,
 				Flags: []cli.Flag{
 					&cli.StringFlag{
@@ -155,15 +185,16 @@ After removal, you will no longer be able to encrypt bundles for this recipient.
 					},
 				},
 				Action: func(c *cli.Context) error {
-					manager, err := crypto.NewKeyManager()
+					manager, err := host.NewManager()
 					if err != nil {
-						return fmt.Errorf("failed to create key manager: %w", err)
+						return fmt.Errorf("failed to create host manager: %w", err)
 					}
 
-					if err := manager.RemoveRecipient(c.String("name")); err != nil {
+					if err := manager.RemoveHost(c.String("name")); err != nil {
 						return fmt.Errorf("failed to remove recipient: %w", err)
 					}
 
+					audit.Record(audit.Event{Type: audit.TrustChange, Subject: c.String("name"), Outcome: "removed"})
 					fmt.Printf("Removed recipient '%s' successfully!\n", c.String("name"))
 					return nil
 				},
@@ -193,6 +224,55 @@ add-recipient command.`,
 					return nil
 				},
 			},
+			{
+				Name:      "decrypt",
+				Usage:     "Decrypt a bundle encrypted for you",
+				ArgsUsage: "<file.age>",
+				Description: `Decrypt a file encrypted for your public key, such as a bundle written by
+'dsp bundle --to'. The output defaults to the input path without '.age'.`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Output file path (default: input without .age)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("expected exactly one file argument")
+					}
+					input := c.Args().First()
+
+					output := c.String("output")
+					if output == "" {
+						if !strings.HasSuffix(input, ".age") {
+							return fmt.Errorf("input does not end in .age; use --output to name the decrypted file")
+						}
+						output = strings.TrimSuffix(input, ".age")
+					}
+
+					manager, err := crypto.NewKeyManager()
+					if err != nil {
+						return fmt.Errorf("failed to create key manager: %w", err)
+					}
+
+					data, err := os.ReadFile(input)
+					if err != nil {
+						return fmt.Errorf("failed to read %s: %w", input, err)
+					}
+					decrypted, err := manager.DecryptWithPrivateKey(data)
+					if err != nil {
+						return fmt.Errorf("failed to decrypt %s: %w", input, err)
+					}
+					if err := os.WriteFile(output, decrypted, 0644); err != nil {
+						return fmt.Errorf("failed to write %s: %w", output, err)
+					}
+
+					fmt.Printf("Decrypted to %s\n", output)
+					return nil
+				},
+			},
+			certCommand(),
 		},
 	}
 }
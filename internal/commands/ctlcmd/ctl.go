@@ -0,0 +1,199 @@
+package ctlcmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/control"
+	"github.com/urfave/cli/v2"
+)
+
+// nameFlag selects the running command to talk to
+var nameFlag = &cli.StringFlag{
+	Name:    "name",
+	Aliases: []string{"n"},
+	Usage:   "Running command to control, as shown by 'dsp ctl list' (default: the only one)",
+}
+
+// jsonFlag prints the raw response for scripts
+var jsonFlag = &cli.BoolFlag{
+	Name:  "json",
+	Usage: "Print the response as JSON",
+}
+
+var Command = &cli.Command{
+	Name:  "ctl",
+	Usage: "Control running DSP commands",
+	Description: `Query and control long-running DSP commands, such as 'dsp export', through
+their local control sockets in <global-dir>/run. Supervision scripts and user
+interfaces can use this instead of parsing output; --json prints responses as
+JSON.
+
+Commands that do not support a request, such as trigger-snapshot for an
+export, answer with an error.
+
+Examples:
+  # List running commands
+  dsp ctl list
+
+  # Show the status of the running export
+  dsp ctl status
+
+  # List downloads in progress as JSON
+  dsp ctl transfers --json
+
+  # Stop a specific export
+  dsp ctl stop --name export-12345`,
+	Subcommands: []*cli.Command{
+		{
+			Name:  "list",
+			Usage: "List running commands with a control socket",
+			Action: func(c *cli.Context) error {
+				names, err := control.List()
+				if err != nil {
+					return err
+				}
+				if len(names) == 0 {
+					fmt.Println("No running commands")
+					return nil
+				}
+				for _, name := range names {
+					fmt.Println(name)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "status",
+			Usage: "Show the status of a running command",
+			Flags: []cli.Flag{nameFlag, jsonFlag},
+			Action: func(c *cli.Context) error {
+				name, err := target(c)
+				if err != nil {
+					return err
+				}
+				var status control.Status
+				if err := control.Call(name, control.CommandStatus, &status); err != nil {
+					return err
+				}
+				if c.Bool("json") {
+					return printJSON(status)
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintf(w, "Command:\t%s\n", status.Command)
+				fmt.Fprintf(w, "PID:\t%d\n", status.PID)
+				fmt.Fprintf(w, "Started:\t%s (%s ago)\n", status.Started.Format(time.RFC3339), time.Since(status.Started).Round(time.Second))
+				if status.Address != "" {
+					fmt.Fprintf(w, "Address:\t%s\n", status.Address)
+				}
+				if status.Bundle != "" {
+					fmt.Fprintf(w, "Bundle:\t%s\n", status.Bundle)
+				}
+				if status.MaxDownloads > 0 {
+					fmt.Fprintf(w, "Downloads:\t%d of %d\n", status.Downloads, status.MaxDownloads)
+				} else {
+					fmt.Fprintf(w, "Downloads:\t%d\n", status.Downloads)
+				}
+				if status.Expires != "" {
+					fmt.Fprintf(w, "Expires:\t%s\n", status.Expires)
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:  "transfers",
+			Usage: "List transfers in progress",
+			Flags: []cli.Flag{nameFlag, jsonFlag},
+			Action: func(c *cli.Context) error {
+				name, err := target(c)
+				if err != nil {
+					return err
+				}
+				var transfers []control.Transfer
+				if err := control.Call(name, control.CommandListTransfers, &transfers); err != nil {
+					return err
+				}
+				if c.Bool("json") {
+					return printJSON(transfers)
+				}
+
+				if len(transfers) == 0 {
+					fmt.Println("No transfers in progress")
+					return nil
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "ID\tCLIENT\tSTARTED\tBYTES")
+				for _, t := range transfers {
+					fmt.Fprintf(w, "%d\t%s\t%s\t%d\n", t.ID, t.Client, t.Started.Format(time.RFC3339), t.Bytes)
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:  "trigger-snapshot",
+			Usage: "Ask a running command to take a snapshot now",
+			Flags: []cli.Flag{nameFlag},
+			Action: func(c *cli.Context) error {
+				name, err := target(c)
+				if err != nil {
+					return err
+				}
+				if err := control.Call(name, control.CommandTriggerSnapshot, nil); err != nil {
+					return err
+				}
+				fmt.Printf("Snapshot triggered in %s\n", name)
+				return nil
+			},
+		},
+		{
+			Name:  "stop",
+			Usage: "Stop a running command",
+			Flags: []cli.Flag{nameFlag},
+			Action: func(c *cli.Context) error {
+				name, err := target(c)
+				if err != nil {
+					return err
+				}
+				if err := control.Call(name, control.CommandStop, nil); err != nil {
+					return err
+				}
+				fmt.Printf("Stopped %s\n", name)
+				return nil
+			},
+		},
+	},
+}
+
+// target returns the running command selected with --name, or the only
+// running command
+func target(c *cli.Context) (string, error) {
+	if name := c.String("name"); name != "" {
+		return name, nil
+	}
+	names, err := control.List()
+	if err != nil {
+		return "", err
+	}
+	switch len(names) {
+	case 0:
+		return "", fmt.Errorf("no running commands with a control socket")
+	case 1:
+		return names[0], nil
+	}
+	return "", fmt.Errorf("several commands are running (%s); choose one with --name", strings.Join(names, ", "))
+}
+
+// printJSON prints a response as indented JSON
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,103 @@
+package diffcmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// diffContextLines is the number of unchanged lines shown around each change
+const diffContextLines = 3
+
+// displayContentDiff prints unified diffs for changed text files
+func displayContentDiff(diff *Diff, source *bundle.ContentStore, repoRoot string, maxSize int64) {
+	type entry struct {
+		path     string
+		old, new *snapshot.File
+	}
+
+	var entries []entry
+	for i := range diff.Added {
+		entries = append(entries, entry{path: diff.Added[i].Path, new: &diff.Added[i]})
+	}
+	for i := range diff.Modified {
+		prev := diff.Previous[diff.Modified[i].Path]
+		entries = append(entries, entry{path: diff.Modified[i].Path, old: &prev, new: &diff.Modified[i]})
+	}
+	for i := range diff.Deleted {
+		entries = append(entries, entry{path: diff.Deleted[i].Path, old: &diff.Deleted[i]})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+
+	for _, e := range entries {
+		rel, err := filepath.Rel(repoRoot, e.path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			rel = e.path
+		}
+		rel = filepath.ToSlash(rel)
+
+		fmt.Printf("\ndiff %s\n", rel)
+
+		// Symlinks are compared by target
+		if (e.old != nil && e.old.IsSymlink) || (e.new != nil && e.new.IsSymlink) {
+			oldTarget, newTarget := "", ""
+			if e.old != nil {
+				oldTarget = e.old.SymlinkTarget
+			}
+			if e.new != nil {
+				newTarget = e.new.SymlinkTarget
+			}
+			fmt.Printf("Symlink target: %q -> %q\n", oldTarget, newTarget)
+			continue
+		}
+
+		// Apply size cap
+		if (e.old != nil && e.old.Size > maxSize) || (e.new != nil && e.new.Size > maxSize) {
+			fmt.Printf("Diff skipped: file larger than %d bytes\n", maxSize)
+			continue
+		}
+
+		// Reconstruct both versions
+		var oldData, newData []byte
+		if e.old != nil {
+			data, ok := source.Find(e.old.Path, e.old.Hash)
+			if !ok {
+				fmt.Println("Previous content not available (not in the working tree or any local bundle)")
+				continue
+			}
+			oldData = data
+		}
+		if e.new != nil {
+			data, ok := source.Find(e.new.Path, e.new.Hash)
+			if !ok {
+				fmt.Println("New content not available (not in the working tree or any local bundle)")
+				continue
+			}
+			newData = data
+		}
+
+		if utils.IsBinary(oldData) || utils.IsBinary(newData) {
+			fmt.Println("Binary files differ")
+			continue
+		}
+
+		oldLabel, newLabel := "a/"+rel, "b/"+rel
+		if e.old == nil {
+			oldLabel = "/dev/null"
+		}
+		if e.new == nil {
+			newLabel = "/dev/null"
+		}
+		text, err := utils.UnifiedDiff(oldLabel, newLabel, string(oldData), string(newData), diffContextLines)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Print(text)
+	}
+}
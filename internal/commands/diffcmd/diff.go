@@ -3,11 +3,13 @@ package diffcmd
 import (
 	"fmt"
 	"os"
-	"os/user"
 	"path/filepath"
 
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/bundle"
 	"github.com/Mattddixo/dsp/internal/commands/common"
 	"github.com/Mattddixo/dsp/internal/commands/flags"
+	"github.com/Mattddixo/dsp/internal/objects"
 	"github.com/Mattddixo/dsp/internal/repo"
 	"github.com/Mattddixo/dsp/internal/snapshot"
 	"github.com/urfave/cli/v2"
@@ -32,11 +34,26 @@ Examples:
   # Compare two snapshots
   dsp diff 20240101-120000 20240102-120000
 
+  # Snapshot IDs can be shortened to any unique prefix
+  dsp diff 20240101-12
+
   # Show only summary of changes
   dsp diff --summary
 
-  # Filter changes to specific path
-  dsp diff --path "src/"
+  # Show line-level changes for text files
+  dsp diff --content
+
+  # Machine-readable output for scripts
+  dsp diff --format json
+  dsp diff --format name-only
+  dsp diff --format stat
+
+  # Filter changes to a directory, a glob, or several paths
+  dsp diff --path src/
+  dsp diff --path "src/*.go" --path docs/
+
+  # Exclude paths (patterns are relative to the repository root)
+  dsp diff --exclude "*.log" --exclude "build"
 
   # Show changes in a specific repository
   dsp diff --repo /path/to/repo`,
@@ -46,22 +63,45 @@ Examples:
 			Aliases: []string{"r"},
 			Usage:   "Path to the repository (default: nearest repository)",
 		},
-		&cli.StringFlag{
+		&cli.StringSliceFlag{
 			Name:    "path",
 			Aliases: []string{"p"},
-			Usage:   "Filter changes to specific path",
+			Usage:   "Only show changes at or below this path or matching this glob (can be repeated)",
+		},
+		&cli.StringSliceFlag{
+			Name:    "exclude",
+			Aliases: []string{"e"},
+			Usage:   "Pattern to exclude, relative to the repository root (can be repeated)",
 		},
 		&cli.BoolFlag{
 			Name:    "summary",
 			Aliases: []string{"s"},
 			Usage:   "Show only summary of changes",
 		},
+		&cli.BoolFlag{
+			Name:    "content",
+			Aliases: []string{"c"},
+			Usage:   "Show unified diffs for changed text files",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "Output format: text, json, name-only or stat",
+			Value: formatText,
+		},
+		&cli.Int64Flag{
+			Name:  "max-size",
+			Usage: "Skip content diffs for files larger than this many bytes",
+			Value: 1024 * 1024,
+		},
 		flags.VerboseFlag,
 		flags.QuietFlag,
 	},
 	Action: func(c *cli.Context) error {
-		pathFilter := c.String("path")
 		summaryOnly := c.Bool("summary")
+		format := c.String("format")
+		if err := validateFormat(format, summaryOnly, c.Bool("content")); err != nil {
+			return err
+		}
 
 		// Create repository manager
 		manager, err := repo.NewManager()
@@ -78,6 +118,12 @@ Examples:
 		// Get DSP directory path from repository config
 		dspDir := filepath.Join(currentRepo.Path, currentRepo.DSPDir)
 
+		// Build path filter
+		filter, err := newPathFilter(currentRepo.Path, c.StringSlice("path"), c.StringSlice("exclude"))
+		if err != nil {
+			return err
+		}
+
 		// Get config
 		cfg, err := common.GetConfig(c)
 		if err != nil {
@@ -86,63 +132,70 @@ Examples:
 
 		var snap1, snap2 *snapshot.Snapshot
 
+		// Labels for the compared states, used by machine-readable formats
+		fromLabel, toLabel := "", workingTreeLabel
+
 		// Handle different snapshot comparison modes
+		if c.NArg() > 2 {
+			return fmt.Errorf("too many arguments: expected at most two snapshot IDs (flags must come before snapshot IDs)")
+		}
+
 		if c.NArg() == 0 {
 			// Compare latest snapshot with current state
-			snap1, err = getLatestSnapshot(dspDir)
+			fromLabel, snap1, err = snapshot.LoadLatest(dspDir)
 			if err != nil {
 				return fmt.Errorf("failed to get latest snapshot: %w", err)
 			}
 			// Create current state snapshot
-			currentUser, err := user.Current()
-			if err != nil {
-				return fmt.Errorf("failed to get current user: %w", err)
-			}
 			trackingConfig, err := snapshot.LoadTrackingConfig(dspDir)
 			if err != nil {
 				return fmt.Errorf("failed to load tracking config: %w", err)
 			}
-			snap2, err = snapshot.CreateSnapshot(trackingConfig.Paths, currentUser.Username, "", cfg)
+			snap2, _, err = snapshot.ScanWorkingState(c.Context, dspDir, trackingConfig.Paths, config.CurrentUser(), cfg)
 			if err != nil {
 				return fmt.Errorf("failed to create current state snapshot: %w", err)
 			}
 		} else if c.NArg() == 1 {
 			// Compare specified snapshot with current state
-			snap1, err = loadSnapshot(dspDir, c.Args().Get(0))
+			fromLabel, snap1, err = snapshot.LoadByID(dspDir, c.Args().Get(0))
 			if err != nil {
 				return fmt.Errorf("failed to load snapshot: %w", err)
 			}
 			// Create current state snapshot
-			currentUser, err := user.Current()
-			if err != nil {
-				return fmt.Errorf("failed to get current user: %w", err)
-			}
 			trackingConfig, err := snapshot.LoadTrackingConfig(dspDir)
 			if err != nil {
 				return fmt.Errorf("failed to load tracking config: %w", err)
 			}
-			snap2, err = snapshot.CreateSnapshot(trackingConfig.Paths, currentUser.Username, "", cfg)
+			snap2, _, err = snapshot.ScanWorkingState(c.Context, dspDir, trackingConfig.Paths, config.CurrentUser(), cfg)
 			if err != nil {
 				return fmt.Errorf("failed to create current state snapshot: %w", err)
 			}
 		} else if c.NArg() == 2 {
 			// Compare two specified snapshots
-			snap1, err = loadSnapshot(dspDir, c.Args().Get(0))
+			fromLabel, snap1, err = snapshot.LoadByID(dspDir, c.Args().Get(0))
 			if err != nil {
 				return fmt.Errorf("failed to load first snapshot: %w", err)
 			}
-			snap2, err = loadSnapshot(dspDir, c.Args().Get(1))
+			toLabel, snap2, err = snapshot.LoadByID(dspDir, c.Args().Get(1))
 			if err != nil {
 				return fmt.Errorf("failed to load second snapshot: %w", err)
 			}
 		}
 
 		// Compare snapshots
-		diff, err := calculateDiff(snap1, snap2, pathFilter)
+		diff, err := calculateDiff(snap1, snap2, filter)
 		if err != nil {
 			return fmt.Errorf("failed to calculate differences: %w", err)
 		}
 
+		// Print machine-readable formats
+		if format != formatText {
+			if !c.Bool("quiet") {
+				return displayDiffFormat(os.Stdout, diff, format, fromLabel, toLabel, currentRepo.Path)
+			}
+			return nil
+		}
+
 		// Print results
 		if !c.Bool("quiet") {
 			if summaryOnly {
@@ -150,100 +203,56 @@ Examples:
 			} else {
 				displayDiff(diff, c.Bool("verbose"))
 			}
+
+			if c.Bool("content") {
+				// Use the repository's hash algorithm to match working tree files
+				hashAlgorithm := cfg.HashAlgorithm
+				var stored *objects.Store
+				if repoConfig, err := config.NewWithRepo(currentRepo.Path, currentRepo.DSPDir); err == nil {
+					hashAlgorithm = repoConfig.HashAlgorithm
+					stored = objects.ForRepo(currentRepo.Path, repoConfig)
+				}
+				source := bundle.NewContentStore(hashAlgorithm, filepath.Join(dspDir, "bundles"))
+				source.UseObjects(stored)
+				defer source.Close()
+				displayContentDiff(diff, source, currentRepo.Path, c.Int64("max-size"))
+			}
 		}
 
 		return nil
 	},
 }
 
-// getLatestSnapshot returns the most recent snapshot
-func getLatestSnapshot(dspDir string) (*snapshot.Snapshot, error) {
-	snapshotsDir := filepath.Join(dspDir, "snapshots")
-	entries, err := os.ReadDir(snapshotsDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read snapshots directory: %w", err)
-	}
-
-	var latestSnapshot *snapshot.Snapshot
-	var latestTime int64
-
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
-		snapshotPath := filepath.Join(snapshotsDir, entry.Name(), "snapshot.json")
-		snap, err := snapshot.Load(snapshotPath)
-		if err != nil {
-			continue // Skip invalid snapshots
-		}
-		if snap.Timestamp.UnixNano() > latestTime {
-			latestTime = snap.Timestamp.UnixNano()
-			latestSnapshot = snap
-		}
-	}
-
-	if latestSnapshot == nil {
-		return nil, fmt.Errorf("no snapshots found")
-	}
-
-	return latestSnapshot, nil
-}
-
-// loadSnapshot loads a snapshot by ID
-func loadSnapshot(dspDir, snapshotID string) (*snapshot.Snapshot, error) {
-	snapshotPath := filepath.Join(dspDir, "snapshots", snapshotID, "snapshot.json")
-	return snapshot.Load(snapshotPath)
-}
-
 // Diff represents the differences between two snapshots
 type Diff struct {
-	Added     []snapshot.File
-	Modified  []snapshot.File
-	Deleted   []snapshot.File
-	Unchanged []snapshot.File
+	Added    []snapshot.File
+	Modified []snapshot.File
+	Deleted  []snapshot.File
+	Previous map[string]snapshot.File // Old versions of modified files, by path
 }
 
-// calculateDiff calculates the differences between two snapshots
-func calculateDiff(snap1, snap2 *snapshot.Snapshot, pathFilter string) (*Diff, error) {
+// calculateDiff calculates the differences between two snapshots. Unchanged
+// directories are skipped by their digests.
+func calculateDiff(snap1, snap2 *snapshot.Snapshot, filter *pathFilter) (*Diff, error) {
 	diff := &Diff{
-		Added:     make([]snapshot.File, 0),
-		Modified:  make([]snapshot.File, 0),
-		Deleted:   make([]snapshot.File, 0),
-		Unchanged: make([]snapshot.File, 0),
-	}
-
-	// Create maps for faster lookup
-	snap1Files := make(map[string]snapshot.File)
-	snap2Files := make(map[string]snapshot.File)
-
-	for _, f := range snap1.Files {
-		snap1Files[f.Path] = f
-	}
-	for _, f := range snap2.Files {
-		snap2Files[f.Path] = f
-	}
-
-	// Find added and modified files
-	for path, file2 := range snap2Files {
-		if pathFilter != "" && path != pathFilter {
-			continue
-		}
-		if file1, exists := snap1Files[path]; !exists {
-			diff.Added = append(diff.Added, file2)
-		} else if file1.Hash != file2.Hash {
-			diff.Modified = append(diff.Modified, file2)
-		} else {
-			diff.Unchanged = append(diff.Unchanged, file2)
-		}
+		Added:    make([]snapshot.File, 0),
+		Modified: make([]snapshot.File, 0),
+		Deleted:  make([]snapshot.File, 0),
+		Previous: make(map[string]snapshot.File),
 	}
 
-	// Find deleted files
-	for path, file1 := range snap1Files {
-		if pathFilter != "" && path != pathFilter {
+	for _, change := range snapshot.Compare(snap1, snap2) {
+		if !filter.matches(change.Path()) {
 			continue
 		}
-		if _, exists := snap2Files[path]; !exists {
-			diff.Deleted = append(diff.Deleted, file1)
+		switch {
+		case change.Old == nil:
+			diff.Added = append(diff.Added, *change.New)
+		case change.New == nil:
+			diff.Deleted = append(diff.Deleted, *change.Old)
+		default:
+			diff.Modified = append(diff.Modified, *change.New)
+			diff.Previous[change.New.Path] = *change.Old
 		}
 	}
 
@@ -0,0 +1,118 @@
+package diffcmd
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// pathFilter selects which files are included in a diff. Include paths match
+// by prefix (a directory includes everything below it) or by glob pattern.
+// Exclude patterns follow the track command: they use filepath.Match syntax,
+// are relative to the repository root, and excluding a directory excludes its
+// contents.
+type pathFilter struct {
+	repoRoot string
+	includes []string // Absolute paths or glob patterns
+	excludes []string // Patterns relative to the repository root, with forward slashes
+}
+
+// newPathFilter builds a filter from --path and --exclude values. Relative
+// include paths are resolved against the current directory.
+func newPathFilter(repoRoot string, includes, excludes []string) (*pathFilter, error) {
+	filter := &pathFilter{repoRoot: repoRoot}
+
+	for _, include := range includes {
+		absPath, err := filepath.Abs(include)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get absolute path for %s: %w", include, err)
+		}
+		if hasGlob(include) {
+			if _, err := filepath.Match(absPath, ""); err != nil {
+				return nil, fmt.Errorf("invalid path pattern '%s': %w", include, err)
+			}
+		}
+		filter.includes = append(filter.includes, absPath)
+	}
+
+	for _, pattern := range excludes {
+		// Remove leading slashes to ensure patterns are relative
+		pattern = strings.TrimLeft(pattern, "/\\")
+		if strings.Contains(pattern, "\\") {
+			return nil, fmt.Errorf("invalid exclude pattern '%s': use forward slashes (/) instead of backslashes (\\)", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern '%s': %w", pattern, err)
+		}
+		filter.excludes = append(filter.excludes, pattern)
+	}
+
+	return filter, nil
+}
+
+// hasGlob reports whether a path contains glob metacharacters
+func hasGlob(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// matches reports whether a file path passes the filter
+func (f *pathFilter) matches(filePath string) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.includes) > 0 {
+		included := false
+		for _, include := range f.includes {
+			if matchInclude(include, filePath) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	if len(f.excludes) > 0 {
+		rel, err := filepath.Rel(f.repoRoot, filePath)
+		if err != nil {
+			return true
+		}
+		rel = filepath.ToSlash(rel)
+
+		// Check the path and each parent directory against the patterns
+		parts := strings.Split(rel, "/")
+		for i := range parts {
+			candidate := strings.Join(parts[:i+1], "/")
+			for _, pattern := range f.excludes {
+				if matched, _ := path.Match(pattern, candidate); matched {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// matchInclude reports whether a file path matches an include path or pattern
+func matchInclude(include, filePath string) bool {
+	if !hasGlob(include) {
+		include = filepath.Clean(include)
+		return filePath == include || strings.HasPrefix(filePath, include+string(filepath.Separator))
+	}
+
+	// A pattern matching a parent directory includes everything below it
+	for p := filePath; ; {
+		if matched, _ := filepath.Match(include, p); matched {
+			return true
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return false
+		}
+		p = parent
+	}
+}
@@ -0,0 +1,155 @@
+package diffcmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Output formats
+const (
+	formatText     = "text"
+	formatJSON     = "json"
+	formatNameOnly = "name-only"
+	formatStat     = "stat"
+)
+
+// workingTreeLabel identifies the current state of tracked files
+const workingTreeLabel = "working-tree"
+
+// fileDiff is a single changed file in machine-readable output
+type fileDiff struct {
+	Path         string `json:"path"`
+	RelativePath string `json:"relative_path"`
+	Status       string `json:"status"` // "added", "modified", "deleted"
+	OldHash      string `json:"old_hash,omitempty"`
+	NewHash      string `json:"new_hash,omitempty"`
+	OldSize      int64  `json:"old_size"`
+	NewSize      int64  `json:"new_size"`
+	SizeDelta    int64  `json:"size_delta"`
+}
+
+// diffReport is the JSON representation of a diff
+type diffReport struct {
+	From    string     `json:"from"`
+	To      string     `json:"to"`
+	Changes []fileDiff `json:"changes"`
+	Summary struct {
+		Added     int   `json:"added"`
+		Modified  int   `json:"modified"`
+		Deleted   int   `json:"deleted"`
+		Total     int   `json:"total"`
+		SizeDelta int64 `json:"size_delta"`
+	} `json:"summary"`
+}
+
+// validateFormat checks the --format value and conflicting flags
+func validateFormat(format string, summaryOnly, content bool) error {
+	switch format {
+	case formatText:
+		return nil
+	case formatJSON, formatNameOnly, formatStat:
+		if summaryOnly {
+			return fmt.Errorf("--summary cannot be combined with --format %s", format)
+		}
+		if content {
+			return fmt.Errorf("--content cannot be combined with --format %s", format)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format '%s': use text, json, name-only or stat", format)
+	}
+}
+
+// buildReport converts a diff into a sorted list of file changes
+func buildReport(diff *Diff, from, to, repoRoot string) *diffReport {
+	report := &diffReport{From: from, To: to, Changes: make([]fileDiff, 0)}
+
+	relative := func(path string) string {
+		rel, err := filepath.Rel(repoRoot, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return path
+		}
+		return filepath.ToSlash(rel)
+	}
+
+	for _, f := range diff.Added {
+		report.Changes = append(report.Changes, fileDiff{
+			Path: f.Path, RelativePath: relative(f.Path), Status: "added",
+			NewHash: f.Hash, NewSize: f.Size, SizeDelta: f.Size,
+		})
+	}
+	for _, f := range diff.Modified {
+		prev := diff.Previous[f.Path]
+		report.Changes = append(report.Changes, fileDiff{
+			Path: f.Path, RelativePath: relative(f.Path), Status: "modified",
+			OldHash: prev.Hash, NewHash: f.Hash, OldSize: prev.Size, NewSize: f.Size, SizeDelta: f.Size - prev.Size,
+		})
+	}
+	for _, f := range diff.Deleted {
+		report.Changes = append(report.Changes, fileDiff{
+			Path: f.Path, RelativePath: relative(f.Path), Status: "deleted",
+			OldHash: f.Hash, OldSize: f.Size, SizeDelta: -f.Size,
+		})
+	}
+	sort.Slice(report.Changes, func(i, j int) bool { return report.Changes[i].Path < report.Changes[j].Path })
+
+	report.Summary.Added = len(diff.Added)
+	report.Summary.Modified = len(diff.Modified)
+	report.Summary.Deleted = len(diff.Deleted)
+	report.Summary.Total = len(report.Changes)
+	for _, change := range report.Changes {
+		report.Summary.SizeDelta += change.SizeDelta
+	}
+	return report
+}
+
+// displayDiffFormat writes the diff in a machine-readable format
+func displayDiffFormat(w io.Writer, diff *Diff, format, from, to, repoRoot string) error {
+	report := buildReport(diff, from, to, repoRoot)
+
+	switch format {
+	case formatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return fmt.Errorf("failed to encode diff: %w", err)
+		}
+
+	case formatNameOnly:
+		for _, change := range report.Changes {
+			fmt.Fprintln(w, change.Path)
+		}
+
+	case formatStat:
+		width := 0
+		for _, change := range report.Changes {
+			if len(change.RelativePath) > width {
+				width = len(change.RelativePath)
+			}
+		}
+		for _, change := range report.Changes {
+			fmt.Fprintf(w, " %c %-*s | %d -> %d bytes (%+d)\n",
+				statusLetter(change.Status), width, change.RelativePath, change.OldSize, change.NewSize, change.SizeDelta)
+		}
+		fmt.Fprintf(w, " %d files changed, %d added, %d modified, %d deleted, %+d bytes\n",
+			report.Summary.Total, report.Summary.Added, report.Summary.Modified, report.Summary.Deleted, report.Summary.SizeDelta)
+	}
+
+	return nil
+}
+
+// statusLetter returns the single-letter code for a change status
+func statusLetter(status string) byte {
+	switch status {
+	case "added":
+		return 'A'
+	case "deleted":
+		return 'D'
+	default:
+		return 'M'
+	}
+}
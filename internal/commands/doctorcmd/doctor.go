@@ -0,0 +1,461 @@
+package doctorcmd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/commands/flags"
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/internal/protocol"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/pkg/utils"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Check result statuses
+const (
+	statusOK   = "ok"
+	statusWarn = "warn"
+	statusFail = "fail"
+)
+
+// certExpiryWarning is how close to expiry a certificate must be to be reported
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// checkResult is a single line of the environment report
+type checkResult struct {
+	Section string
+	Name    string
+	Status  string
+	Detail  string
+}
+
+// report collects check results
+type report struct {
+	results []checkResult
+	section string
+	home    string
+}
+
+// add records a check result in the current section
+func (r *report) add(status, name, format string, args ...interface{}) {
+	detail := fmt.Sprintf(format, args...)
+	// Keep reports shareable by not exposing the user's home directory
+	if r.home != "" {
+		detail = strings.ReplaceAll(detail, r.home, "~")
+	}
+	r.results = append(r.results, checkResult{
+		Section: r.section,
+		Name:    name,
+		Status:  status,
+		Detail:  detail,
+	})
+}
+
+var Command = &cli.Command{
+	Name:  "doctor",
+	Usage: "Check the local DSP environment and print a report",
+	Description: `Run a self-test of the local DSP installation and print an environment report.
+
+The report covers:
+  - Layout of the global DSP directory (~/.dsp-global, or $DSP_GLOBAL_DIR)
+  - Validity of the age, signing and TLS key material
+  - TLS certificate expiry
+  - Writable temporary space
+  - zstd compression round trip
+  - Clock skew hints
+  - Whether the export port can be bound
+
+Home directory paths are replaced with ~ so the report can be attached to
+bug reports as-is. Use 'dsp repo doctor' to check individual repositories.
+
+Examples:
+  # Print the report
+  dsp doctor
+
+  # Write the report to a file
+  dsp doctor -o dsp-report.txt
+
+  # Check a different export port
+  dsp doctor --port 9443`,
+	Flags: []cli.Flag{
+		flags.VerboseFlag,
+		flags.QuietFlag,
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Write the report to a file",
+		},
+		&cli.IntFlag{
+			Name:  "port",
+			Usage: "Export port to check (default: the ports of network.port_range)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("failed to get home directory: %w", err)
+		}
+		globalDir, err := config.GlobalDir()
+		if err != nil {
+			return err
+		}
+
+		r := &report{home: home}
+
+		// Run checks
+		checkEnvironment(r)
+		checkGlobalLayout(r, globalDir)
+		checkKeys(r)
+		checkTempSpace(r)
+		checkCompression(r)
+		checkClock(r, globalDir)
+		checkPort(r, c.Int("port"))
+
+		// Render report
+		var buf bytes.Buffer
+		failures, warnings := render(&buf, r, c.Bool("verbose"))
+
+		if output := c.String("output"); output != "" {
+			if err := os.WriteFile(output, buf.Bytes(), 0644); err != nil {
+				return fmt.Errorf("failed to write report: %w", err)
+			}
+			if !c.Bool("quiet") {
+				fmt.Printf("Report written to %s\n", output)
+			}
+		} else if !c.Bool("quiet") || failures > 0 {
+			fmt.Print(buf.String())
+		}
+
+		if failures > 0 {
+			return fmt.Errorf("doctor found %d failures and %d warnings", failures, warnings)
+		}
+		return nil
+	},
+}
+
+// render writes the report and returns the number of failures and warnings
+func render(w io.Writer, r *report, verbose bool) (int, int) {
+	failures, warnings := 0, 0
+
+	fmt.Fprintf(w, "DSP environment report (%s)\n", time.Now().UTC().Format(time.RFC3339))
+	section := ""
+	for _, result := range r.results {
+		switch result.Status {
+		case statusFail:
+			failures++
+		case statusWarn:
+			warnings++
+		}
+
+		// Only show passing checks in verbose mode, except for informational sections
+		if result.Status == statusOK && !verbose && result.Section != "Environment" {
+			continue
+		}
+
+		if result.Section != section {
+			section = result.Section
+			fmt.Fprintf(w, "\n%s:\n", section)
+		}
+		fmt.Fprintf(w, "  [%-4s] %s: %s\n", strings.ToUpper(result.Status), result.Name, result.Detail)
+	}
+
+	fmt.Fprintf(w, "\nSummary: %d checks, %d failures, %d warnings\n", len(r.results), failures, warnings)
+	return failures, warnings
+}
+
+// checkEnvironment records basic information about the system
+func checkEnvironment(r *report) {
+	r.section = "Environment"
+	r.add(statusOK, "platform", "%s/%s", runtime.GOOS, runtime.GOARCH)
+	r.add(statusOK, "go runtime", "%s", runtime.Version())
+	r.add(statusOK, "protocol", "v%d (min v%d)", protocol.Version, protocol.MinVersion)
+	if hostname, err := os.Hostname(); err == nil {
+		r.add(statusOK, "hostname", "%s", hostname)
+	}
+	if os.Getenv(config.GlobalDirEnv) != "" {
+		r.add(statusOK, "profile", "overridden by %s", config.GlobalDirEnv)
+	} else if profile, err := config.ActiveProfile(); err == nil {
+		r.add(statusOK, "profile", "%s", profile)
+	}
+}
+
+// checkGlobalLayout verifies the structure of the global DSP directory
+func checkGlobalLayout(r *report, globalDir string) {
+	r.section = "Global directory"
+
+	info, err := os.Stat(globalDir)
+	if err != nil {
+		r.add(statusFail, "global directory", "%s does not exist; run 'dsp crypto init' or 'dsp init'", globalDir)
+		return
+	}
+	if !info.IsDir() {
+		r.add(statusFail, "global directory", "%s is not a directory", globalDir)
+		return
+	}
+	r.add(statusOK, "global directory", "%s", globalDir)
+
+	// Check expected subdirectories
+	for _, dir := range []string{
+		filepath.Join(globalDir, "keys", "private"),
+		filepath.Join(globalDir, "keys", "public"),
+	} {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			r.add(statusWarn, "directory", "%s is missing; run 'dsp crypto init'", dir)
+		} else {
+			r.add(statusOK, "directory", "%s", dir)
+		}
+	}
+
+	// The hosts directory is created on first use
+	hostsDir := filepath.Join(globalDir, "hosts")
+	if info, err := os.Stat(hostsDir); err == nil && !info.IsDir() {
+		r.add(statusFail, "directory", "%s is not a directory", hostsDir)
+	} else if err != nil {
+		r.add(statusOK, "directory", "%s not created yet", hostsDir)
+	} else {
+		r.add(statusOK, "directory", "%s", hostsDir)
+	}
+
+	// Private keys must not be readable by other users
+	privateDir := filepath.Join(globalDir, "keys", "private")
+	if info, err := os.Stat(privateDir); err == nil && runtime.GOOS != "windows" {
+		if info.Mode().Perm()&0077 != 0 {
+			r.add(statusWarn, "permissions", "%s has mode %o; run 'chmod 700 %s'", privateDir, info.Mode().Perm(), privateDir)
+		} else {
+			r.add(statusOK, "permissions", "%s has mode %o", privateDir, info.Mode().Perm())
+		}
+	}
+
+	// Check configuration files parse
+	for _, file := range []string{
+		filepath.Join(globalDir, "repos.yaml"),
+		filepath.Join(globalDir, config.GlobalConfigFile),
+	} {
+		data, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			r.add(statusOK, "config", "%s not created yet", file)
+			continue
+		}
+		if err != nil {
+			r.add(statusFail, "config", "cannot read %s: %v", file, err)
+			continue
+		}
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			r.add(statusFail, "config", "cannot parse %s: %v", file, err)
+			continue
+		}
+		r.add(statusOK, "config", "%s", file)
+	}
+
+	// Recipients moved into the host registry; the old store is migrated on first use
+	if _, err := os.Stat(filepath.Join(globalDir, "keys", "recipients.yaml")); err == nil {
+		r.add(statusWarn, "config", "recipients.yaml has not been migrated to hosts; run 'dsp host list' to migrate it")
+	}
+
+	// Report registered repositories
+	if manager, err := repo.NewManager(); err == nil {
+		r.add(statusOK, "repositories", "%d registered (run 'dsp repo doctor' for details)", len(manager.Repos))
+	}
+}
+
+// checkKeys verifies that key material exists and can be parsed
+func checkKeys(r *report) {
+	r.section = "Keys"
+
+	keyManager, err := crypto.NewKeyManager()
+	if err != nil {
+		r.add(statusFail, "key store", "cannot open key store: %v", err)
+		return
+	}
+
+	// age identity
+	if data, err := os.ReadFile(keyManager.GetPrivateKeyPath()); err != nil {
+		r.add(statusFail, "age private key", "missing; run 'dsp crypto init'")
+	} else if identities, err := age.ParseIdentities(bytes.NewReader(data)); err != nil || len(identities) == 0 {
+		r.add(statusFail, "age private key", "cannot be parsed; delete %s and run 'dsp crypto init'", keyManager.GetPrivateKeyPath())
+	} else {
+		r.add(statusOK, "age private key", "valid")
+	}
+
+	if publicKey, err := keyManager.GetPublicKey(); err != nil {
+		r.add(statusFail, "age public key", "missing; run 'dsp crypto init'")
+	} else if _, err := age.ParseRecipients(strings.NewReader(publicKey)); err != nil {
+		r.add(statusFail, "age public key", "cannot be parsed: %v", err)
+	} else {
+		r.add(statusOK, "age public key", "valid")
+	}
+
+	// Signing keys
+	checkPEMKey(r, "signing private key", keyManager.GetSigningKeyPath(), func(der []byte) error {
+		_, err := x509.ParsePKCS8PrivateKey(der)
+		return err
+	})
+	checkPEMKey(r, "signing public key", keyManager.GetSigningPublicKeyPath(), func(der []byte) error {
+		_, err := x509.ParsePKIXPublicKey(der)
+		return err
+	})
+
+	// TLS certificate
+	cert, err := keyManager.GetCertificate()
+	if err != nil {
+		r.add(statusFail, "TLS certificate", "cannot be loaded; run 'dsp crypto init': %v", err)
+		return
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		r.add(statusFail, "TLS certificate", "cannot be parsed: %v", err)
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case now.After(leaf.NotAfter):
+		r.add(statusFail, "TLS certificate", "expired on %s; delete %s and run 'dsp crypto init'",
+			leaf.NotAfter.Format("2006-01-02"), keyManager.GetCertificatePath())
+	case leaf.NotAfter.Sub(now) < certExpiryWarning:
+		r.add(statusWarn, "TLS certificate", "expires on %s", leaf.NotAfter.Format("2006-01-02"))
+	default:
+		r.add(statusOK, "TLS certificate", "valid until %s", leaf.NotAfter.Format("2006-01-02"))
+	}
+	if fingerprint, err := keyManager.GetCertificateFingerprint(); err == nil {
+		r.add(statusOK, "TLS fingerprint", "%s", fingerprint)
+	}
+}
+
+// checkPEMKey verifies that a PEM-encoded key file exists and parses
+func checkPEMKey(r *report, name, path string, parse func([]byte) error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		r.add(statusFail, name, "missing; run 'dsp crypto init'")
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		r.add(statusFail, name, "no PEM block found in %s", path)
+		return
+	}
+	if err := parse(block.Bytes); err != nil {
+		r.add(statusFail, name, "cannot be parsed: %v", err)
+		return
+	}
+	r.add(statusOK, name, "valid")
+}
+
+// checkTempSpace verifies that the temporary directory is writable
+func checkTempSpace(r *report) {
+	r.section = "Temporary space"
+
+	tmpFile, err := os.CreateTemp("", "dsp-doctor-*")
+	if err != nil {
+		r.add(statusFail, "temp directory", "%s is not writable: %v", os.TempDir(), err)
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	// Write a small block to catch full or read-only filesystems
+	if _, err := tmpFile.Write(make([]byte, 1<<20)); err != nil {
+		r.add(statusFail, "temp directory", "cannot write to %s: %v", os.TempDir(), err)
+		return
+	}
+	r.add(statusOK, "temp directory", "%s is writable", os.TempDir())
+}
+
+// checkCompression verifies that zstd compression round-trips
+func checkCompression(r *report) {
+	r.section = "Compression"
+
+	sample := bytes.Repeat([]byte("dsp doctor zstd check "), 256)
+	compressed, err := utils.Compress(sample, 3)
+	if err != nil {
+		r.add(statusFail, "zstd", "compression failed: %v", err)
+		return
+	}
+	decompressed, err := utils.Decompress(compressed)
+	if err != nil {
+		r.add(statusFail, "zstd", "decompression failed: %v", err)
+		return
+	}
+	if !bytes.Equal(sample, decompressed) {
+		r.add(statusFail, "zstd", "round trip produced different data")
+		return
+	}
+	r.add(statusOK, "zstd", "round trip ok (%d -> %d bytes)", len(sample), len(compressed))
+}
+
+// checkClock looks for signs that the system clock is wrong. Timestamps are
+// compared in bundles, snapshots and certificate validity, so a skewed clock
+// causes confusing failures.
+func checkClock(r *report, globalDir string) {
+	r.section = "Clock"
+
+	now := time.Now()
+	r.add(statusOK, "local time", "%s (UTC %s)", now.Format(time.RFC3339), now.UTC().Format(time.RFC3339))
+
+	// Files modified in the future suggest the clock was moved backwards
+	var newest time.Time
+	var newestPath string
+	filepath.Walk(globalDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+			newestPath = path
+		}
+		return nil
+	})
+	if newest.After(now.Add(5 * time.Minute)) {
+		r.add(statusWarn, "clock skew", "%s was modified %s in the future; check the system clock",
+			newestPath, newest.Sub(now).Round(time.Second))
+	} else {
+		r.add(statusOK, "clock skew", "no files in the global directory have future timestamps")
+	}
+}
+
+// checkPort verifies that the export port can be bound. Without a port, any
+// free port of the configured range will do.
+func checkPort(r *report, port int) {
+	r.section = "Network"
+
+	first, last := port, port
+	if port == 0 {
+		globalConfig, err := config.LoadGlobal()
+		if err != nil {
+			r.add(statusFail, "export port", "cannot load global config: %v", err)
+			return
+		}
+		first, last = globalConfig.GetPortRange()
+	}
+
+	var lastErr error
+	for p := first; p <= last; p++ {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", p))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		listener.Close()
+		r.add(statusOK, "export port", "port %d is available", p)
+		return
+	}
+	if first == last {
+		r.add(statusWarn, "export port", "port %d cannot be bound (%v); use 'dsp export --port' with a free port", first, lastErr)
+		return
+	}
+	r.add(statusWarn, "export port", "no port in range %d-%d can be bound; export will use any free port", first, last)
+}
@@ -0,0 +1,86 @@
+package exportcmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listen opens a TCP listener on port, or when port is 0 on the first free
+// port between first and last. If the whole range is taken, the system picks
+// a free port. TLS or Noise is layered on top by the caller.
+func listen(bindAddress string, port, first, last int) (net.Listener, error) {
+	listenAddr := func(addr string) (net.Listener, error) {
+		return net.Listen("tcp", addr)
+	}
+	if port != 0 {
+		return listenAddr(net.JoinHostPort(bindAddress, strconv.Itoa(port)))
+	}
+
+	for p := first; p <= last; p++ {
+		listener, err := listenAddr(net.JoinHostPort(bindAddress, strconv.Itoa(p)))
+		if err == nil {
+			return listener, nil
+		}
+	}
+
+	listener, err := listenAddr(net.JoinHostPort(bindAddress, "0"))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Warning: no free port in range %d-%d; using port %d\n", first, last, listener.Addr().(*net.TCPAddr).Port)
+	return listener, nil
+}
+
+// advertisedHost returns the host name importers are told to connect to:
+// the configured external host, a specific bind address, or the hostname
+func advertisedHost(externalHost, bindAddress string) (string, error) {
+	if externalHost != "" {
+		return externalHost, nil
+	}
+	if ip := net.ParseIP(bindAddress); ip != nil && !ip.IsUnspecified() {
+		return bindAddress, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get hostname: %w", err)
+	}
+	return hostname, nil
+}
+
+// lanAddresses lists the addresses importers can try to reach the server
+// on, IPv4 before IPv6. A specific bind address is the only candidate;
+// 0.0.0.0 limits the candidates to IPv4. Loopback and IPv6 link-local
+// addresses are left out since they are not reachable from other machines
+// (the latter would need the importer's interface zone).
+func lanAddresses(bindAddress string) ([]string, error) {
+	bindIP := net.ParseIP(bindAddress)
+	if bindIP != nil && !bindIP.IsUnspecified() {
+		return []string{bindIP.String()}, nil
+	}
+	ipv4Only := bindIP != nil && bindIP.To4() != nil
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network addresses: %w", err)
+	}
+
+	var v4, v6 []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP
+		if ip.IsLoopback() || ip.IsLinkLocalMulticast() {
+			continue
+		}
+		if ip.To4() != nil {
+			v4 = append(v4, ip.String())
+		} else if !ipv4Only && !ip.IsLinkLocalUnicast() {
+			v6 = append(v6, ip.String())
+		}
+	}
+	return append(v4, v6...), nil
+}
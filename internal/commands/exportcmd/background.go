@@ -0,0 +1,220 @@
+package exportcmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/control"
+	"github.com/Mattddixo/dsp/internal/secret"
+	"github.com/urfave/cli/v2"
+)
+
+// Environment variables passed to a background export
+const (
+	detachedEnv         = "DSP_EXPORT_DETACHED"  // Set in the background process
+	infoFileEnv         = "DSP_EXPORT_INFO_FILE" // Where it writes the export information
+	detachedPasswordEnv = "DSP_EXPORT_PASSWORD"  // The password, when it was not given by -p
+)
+
+// detachWait is how long --detach waits for the background export to start
+const detachWait = 30 * time.Second
+
+// isDetached reports whether this process is a background export
+func isDetached() bool {
+	return os.Getenv(detachedEnv) != ""
+}
+
+// runDetached starts this export again as a background process, waits until
+// it has written its export information and prints it
+func runDetached(password string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the dsp executable: %w", err)
+	}
+	globalDir, err := config.GlobalDir()
+	if err != nil {
+		return err
+	}
+	runDir := filepath.Join(globalDir, control.RunDir)
+	if err := os.MkdirAll(runDir, 0700); err != nil {
+		return fmt.Errorf("failed to create run directory: %w", err)
+	}
+
+	// Name the log and info files after the start time
+	base := filepath.Join(runDir, fmt.Sprintf("export-%s", time.Now().Format("20060102-150405.000000")))
+	logPath, infoPath := base+".log", base+".json"
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create export log: %w", err)
+	}
+	defer logFile.Close()
+
+	// Start the background export with the same arguments
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), detachedEnv+"=1", infoFileEnv+"="+infoPath)
+	if password != "" {
+		// A prompted password is passed on without showing it in the
+		// process list
+		cmd.Env = append(cmd.Env, detachedPasswordEnv+"="+password)
+	}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = detachAttr()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start background export: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// Wait for the export information, or for the export to fail
+	deadline := time.After(detachWait)
+	for {
+		select {
+		case <-exited:
+			return fmt.Errorf("background export failed:\n%s", secret.Redact(tail(logPath, 10), password))
+		case <-deadline:
+			return fmt.Errorf("background export (PID %d) did not start within %s; see %s", cmd.Process.Pid, detachWait, logPath)
+		case <-time.After(100 * time.Millisecond):
+		}
+		data, err := os.ReadFile(infoPath)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+
+		var info ExportInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			continue // Still being written
+		}
+		printed, err := printableInfo(info)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Export information:\n%s\n", printed)
+		fmt.Printf("\nExport running in the background as export-%d (PID %d)\n", cmd.Process.Pid, cmd.Process.Pid)
+		fmt.Printf("Export information: %s\n", infoPath)
+		fmt.Printf("Log: %s\n", logPath)
+		fmt.Println("Use 'dsp export status' to follow it and 'dsp export stop' to stop it.")
+		return cmd.Process.Release()
+	}
+}
+
+// tail returns the last lines of a file
+func tail(path string, lines int) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err.Error()
+	}
+	all := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+	return strings.Join(all, "\n")
+}
+
+// exportNameFlag selects a running export
+var exportNameFlag = &cli.StringFlag{
+	Name:    "name",
+	Aliases: []string{"N"},
+	Usage:   "Export to use, such as export-12345 (default: the only running export)",
+}
+
+// statusCommand shows running exports
+var statusCommand = &cli.Command{
+	Name:  "status",
+	Usage: "Show running exports and their transfers",
+	Flags: []cli.Flag{exportNameFlag},
+	Action: func(c *cli.Context) error {
+		names, err := runningExports()
+		if err != nil {
+			return err
+		}
+		if name := c.String("name"); name != "" {
+			names = []string{name}
+		}
+		if len(names) == 0 {
+			fmt.Println("No running exports")
+			return nil
+		}
+
+		for i, name := range names {
+			var status control.Status
+			if err := control.Call(name, control.CommandStatus, &status); err != nil {
+				return err
+			}
+			var transfers []control.Transfer
+			if err := control.Call(name, control.CommandListTransfers, &transfers); err != nil {
+				return err
+			}
+
+			if i > 0 {
+				fmt.Println()
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(w, "Export:\t%s\n", name)
+			fmt.Fprintf(w, "Started:\t%s (%s ago)\n", status.Started.Format(time.RFC3339), time.Since(status.Started).Round(time.Second))
+			fmt.Fprintf(w, "Address:\t%s\n", status.Address)
+			fmt.Fprintf(w, "Bundle:\t%s\n", status.Bundle)
+			fmt.Fprintf(w, "Downloads:\t%d of %d\n", status.Downloads, status.MaxDownloads)
+			fmt.Fprintf(w, "Expires:\t%s\n", status.Expires)
+			fmt.Fprintf(w, "Transfers:\t%d in progress\n", len(transfers))
+			for _, t := range transfers {
+				fmt.Fprintf(w, "  %s\tsince %s, %d bytes sent\n", t.Client, t.Started.Format(time.RFC3339), t.Bytes)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// stopCommand stops a running export
+var stopCommand = &cli.Command{
+	Name:  "stop",
+	Usage: "Stop a running export",
+	Flags: []cli.Flag{exportNameFlag},
+	Action: func(c *cli.Context) error {
+		name := c.String("name")
+		if name == "" {
+			names, err := runningExports()
+			if err != nil {
+				return err
+			}
+			switch len(names) {
+			case 0:
+				return fmt.Errorf("no running exports")
+			case 1:
+				name = names[0]
+			default:
+				return fmt.Errorf("several exports are running (%s); choose one with --name", strings.Join(names, ", "))
+			}
+		}
+		if err := control.Call(name, control.CommandStop, nil); err != nil {
+			return err
+		}
+		fmt.Printf("Stopped %s\n", name)
+		return nil
+	},
+}
+
+// runningExports returns the control socket names of running exports
+func runningExports() ([]string, error) {
+	names, err := control.List()
+	if err != nil {
+		return nil, err
+	}
+	var exports []string
+	for _, name := range names {
+		if strings.HasPrefix(name, "export-") {
+			exports = append(exports, name)
+		}
+	}
+	return exports, nil
+}
@@ -0,0 +1,86 @@
+package exportcmd
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/control"
+)
+
+// countingWriter counts the bytes of a download sent so far, for the
+// transfer and the export metrics
+type countingWriter struct {
+	http.ResponseWriter
+	transfer *control.Transfer
+	metrics  *exportMetrics
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(&w.transfer.Bytes, int64(n))
+	w.metrics.bytesServed.Add(int64(n))
+	return n, err
+}
+
+// startTransfer records a download in progress. It returns a writer that
+// counts the bytes sent and a function to call when the download ends.
+func (s *ExportServer) startTransfer(w http.ResponseWriter, clientIP string) (http.ResponseWriter, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextTransfer++
+	transfer := &control.Transfer{
+		ID:      s.nextTransfer,
+		Client:  clientIP,
+		Started: time.Now(),
+	}
+	s.transfers[transfer.ID] = transfer
+
+	return &countingWriter{ResponseWriter: w, transfer: transfer, metrics: s.metrics}, func() {
+		s.mu.Lock()
+		delete(s.transfers, transfer.ID)
+		s.mu.Unlock()
+	}
+}
+
+// controlHandlers returns the commands the export control socket answers
+func (s *ExportServer) controlHandlers() map[string]control.Handler {
+	return map[string]control.Handler{
+		control.CommandStatus: func() (interface{}, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return control.Status{
+				Command:      "export",
+				PID:          os.Getpid(),
+				Started:      s.started,
+				Address:      s.listener.Addr().String(),
+				Bundle:       s.storedPath,
+				Downloads:    s.downloads,
+				MaxDownloads: s.maxDownloads,
+				Expires:      s.exportInfo.Expires,
+			}, nil
+		},
+		control.CommandListTransfers: func() (interface{}, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			transfers := make([]control.Transfer, 0, len(s.transfers))
+			for _, t := range s.transfers {
+				transfers = append(transfers, control.Transfer{
+					ID:      t.ID,
+					Client:  t.Client,
+					Started: t.Started,
+					Bytes:   atomic.LoadInt64(&t.Bytes),
+				})
+			}
+			sort.Slice(transfers, func(i, j int) bool { return transfers[i].ID < transfers[j].ID })
+			return transfers, nil
+		},
+		control.CommandStop: func() (interface{}, error) {
+			s.shutdown()
+			return nil, nil
+		},
+	}
+}
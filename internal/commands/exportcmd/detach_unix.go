@@ -0,0 +1,11 @@
+//go:build !windows
+
+package exportcmd
+
+import "syscall"
+
+// detachAttr starts the background export in a new session, so it outlives
+// the terminal it was started from
+func detachAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,17 @@
+//go:build windows
+
+package exportcmd
+
+import "syscall"
+
+// Process creation flags for a process without a console
+const (
+	createNewProcessGroup = 0x00000200
+	detachedProcess       = 0x00000008
+)
+
+// detachAttr starts the background export without a console, so it outlives
+// the terminal it was started from
+func detachAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: createNewProcessGroup | detachedProcess}
+}
@@ -2,40 +2,78 @@ package exportcmd
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"filippo.io/age"
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/audit"
 	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/control"
 	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/internal/exitcode"
 	hostpkg "github.com/Mattddixo/dsp/internal/host"
+	"github.com/Mattddixo/dsp/internal/noise"
+	"github.com/Mattddixo/dsp/internal/notify"
+	"github.com/Mattddixo/dsp/internal/protocol"
+	"github.com/Mattddixo/dsp/internal/secret"
+	"github.com/Mattddixo/dsp/pkg/utils"
 	"github.com/urfave/cli/v2"
 )
 
+// maxDeltaRequestSize bounds the list of hashes an importer may post
+const maxDeltaRequestSize = 64 << 20
+
 // ExportServer handles the HTTP server for bundle distribution
 type ExportServer struct {
 	server          *http.Server
 	listener        net.Listener
-	bundlePath      string
+	bundlePath      string // Plain archive served
+	storedPath      string // Bundle as stored, sealed with encrypt_at_rest if bundlePath is a decrypted copy
 	outputPath      string
 	auth            *ExportAuth
 	downloads       int
 	maxDownloads    int
 	mu              sync.Mutex
 	done            chan struct{}
-	encrypted       bool // Only true for password auth
+	encrypted       bool                // Only true for password auth
+	recipientKeys   []string            // Host public keys to encrypt for, overriding password encryption
+	userKeys        map[string][]string // Host public keys of each user under user auth
+	trustPolicy     string              // Trust policy for hosts met during key exchange
+	trustNew        bool                // Trust new hosts even under a manual trust policy
+	certWarningDays int                 // Warn about pinned certificates expiring within this many days
 	exportInfo      ExportInfo
-	certFingerprint string // Store certificate fingerprint for export info
+	certFingerprint string   // Store certificate fingerprint for export info
+	signingKey      string   // Signing public key (PEM) status responses are signed with
+	bundleHash      string   // SHA-256 of the bundle file, sent with unencrypted downloads
+	encodings       []string // Encodings downloads may be compressed with, preferred first
+	started         time.Time
+	transfers       map[int]*control.Transfer // Downloads in progress, by ID
+	nextTransfer    int
+	stopOnce        sync.Once
+	metrics         *exportMetrics
+	files           *fileExport       // Set when serving a repository's files instead of a bundle
+	receiptDir      string            // Data directory receipts of completed downloads are written to
+	secureDelete    bool              // Wipe delta bundles before removing them
+	kdf             *crypto.KDFParams // Key derivation of password encryption
+	mtls            bool              // Only serve importers presenting a pinned client certificate
+	noise           bool              // Serve over Noise channels keyed by host identities instead of TLS
+	failures        authFailures      // Consecutive authentication failures by client, for lockouts and bans
 }
 
 // ExportAuth handles authentication for the export server
@@ -54,6 +92,7 @@ type TokenInfo struct {
 	Token      string
 	Expiry     time.Time
 	Used       bool
+	InUse      bool      // A download with this token is in progress
 	ClientIP   string    // IP address of the client that received this token
 	AssignedAt time.Time // When the token was assigned
 }
@@ -62,6 +101,7 @@ type TokenInfo struct {
 type ExportInfo struct {
 	Host            string    `json:"host"`
 	Port            int       `json:"port"`
+	Addresses       []string  `json:"addresses,omitempty"` // Addresses of this machine importers can try in order
 	BundleID        string    `json:"bundle_id"`
 	Auth            string    `json:"auth_method"`
 	Users           []string  `json:"users,omitempty"`
@@ -69,9 +109,24 @@ type ExportInfo struct {
 	Signature       string    `json:"signature"`
 	Expires         string    `json:"expires"`
 	Encrypted       bool      `json:"encrypted"`
+	KeyEncrypted    bool      `json:"key_encrypted,omitempty"` // Encrypted for the importers' host keys
 	OneTimeToken    string    `json:"one_time_token"`
 	TokenExpiry     time.Time `json:"token_expiry"`
-	CertFingerprint string    `json:"cert_fingerprint"` // Add certificate fingerprint
+	CertFingerprint string    `json:"cert_fingerprint"`    // Add certificate fingerprint
+	ProtocolVersion int       `json:"protocol_version"`    // Transfer protocol version spoken by the exporter
+	Files           bool      `json:"files,omitempty"`     // Serves the files of a repository rather than a bundle
+	Transport       string    `json:"transport,omitempty"` // "noise" when served over Noise channels instead of TLS
+
+	// Key derivation of password encryption, so importers derive the same key
+	KDF *crypto.KDFParams `json:"kdf,omitempty"`
+
+	// Rotations of the exporter's certificate, so importers that pinned an
+	// older one can follow them
+	CertRotations []crypto.CertRotation `json:"cert_rotations,omitempty"`
+
+	// Fingerprint of the key status responses are signed with, to compare
+	// with the one recorded for this host
+	SigningKeyFingerprint string `json:"signing_key_fingerprint,omitempty"`
 
 	// Key exchange information
 	KeyExchange struct {
@@ -88,21 +143,137 @@ var Command = &cli.Command{
 	Description: `Export a bundle for distribution with optional encryption.
 The command starts a server to distribute the bundle and provides import information.
 When using password authentication, the bundle will be encrypted using the password.
+The password is taken from -p, the first line of standard input with
+--password-stdin, or DSP_PASSWORD; otherwise it is asked for twice on the
+terminal without echo. It is redacted from the printed export information,
+but kept in the file written by --info-file.
+The key is derived from the password with encryption.kdf from the global config:
+scrypt (the default, tuned by encryption.scrypt_work_factor) or argon2id (tuned by
+encryption.argon2_time, encryption.argon2_memory_mb and encryption.argon2_threads).
+The export information records the parameters, so importers need no settings.
+
+Importers that exchange keys are recorded as hosts according to the trust_policy
+in ~/.dsp-global/config.yaml (manual, tofu or open; default tofu). Under manual,
+new importers are parked as untrusted and cannot download until you run
+'dsp host trust <host>', unless --trust-new is given.
+
+Importers present their local certificate as a TLS client certificate, which
+is pinned to their host entry at key exchange. A pinned certificate must belong
+to a trusted host and, under --user, to the host named as the user. --mtls
+refuses importers that do not present a pinned certificate, so only hosts that
+exchanged keys before can download.
+
+Under --user, each user is the name or alias of a trusted host, or a host
+group, and every download is encrypted for the host keys of the user asking
+for it, so each user gets their own encrypted copy. The export refuses to
+start if a user has no registered key, unless --allow-plaintext is given, in
+which case the bundle is served protected by TLS only. --to encrypts every
+download for the same hosts instead.
+
+Credentials and tokens are compared in constant time. A client that fails
+authentication 5 times in a row is refused with 429 Too Many Requests for a
+second, twice as long after each further failure (up to 5 minutes), until it
+authenticates. After network.ban_after failures in a row (default 20) it is
+banned for network.ban_duration (default 1h). Each client may hold at most
+network.max_client_connections connections open (default 8); further ones are
+closed. Bans and refused connections are recorded in the audit log.
+
+Under --user, a user counts as having downloaded the bundle once a download
+completes; the export stops when all users have.
+
+--noise serves over a Noise channel instead of TLS: importers connect with
+'dsp import --noise' and both sides prove they hold the age keys recorded in
+each other's hosts store, so no certificates are involved. Only trusted hosts
+can complete the handshake, so --noise implies --mtls.
+
+Without --port, the server listens on the first free port of network.port_range
+(default 8080-8089), or any free port if the range is taken. network.bind_address
+limits the interfaces it listens on, and network.external_host is the host name
+given to importers in the export information. --bind and --advertise override
+them for one export. The export information also lists the LAN addresses (IPv4
+and IPv6) of this machine, which importers try in order when the host name does
+not resolve.
+
+Downloads are compressed on the wire with the first encoding of --compression
+(default zstd,gzip) that the importer accepts. Bundle contents are compressed
+already, but the zip structure and metadata of text-heavy bundles shrink
+further, which helps on slow links. --compression none sends them as is.
+
+Importers that import into an existing repository send the hashes of the
+contents they already have, and get a delta of the bundle without them.
+
+--metrics serves Prometheus metrics (bytes served, downloads, authentication
+failures, refused connections and active transfers) at /metrics on a separate
+plain HTTP address.
+Bind it to a loopback or management address, as it needs no credentials.
+
+--bundle-latest creates the bundle to export from the current repository (or
+--repo): the changes since the last bundle exported this way, or between the
+latest two snapshots the first time. The bundle is saved in <dsp-dir>/bundles.
+
+--files serves the snapshots and bundles of the repository (or --repo)
+read-only instead of one bundle, for peers that fetch only what they need.
+The files are listed with their sizes and SHA-256 in a manifest signed with
+this host's signing key, served at /manifest; only those files can be fetched,
+from /files/<path>, and requests may ask for byte ranges. The same password or
+users and TLS protect them, but they are not encrypted otherwise and there is
+no download limit: the export runs until it is stopped.
+
+/bundles lists just the bundles, with their ID, size, parent bundle and
+creation time, so pull clients and dashboards can see what is available
+without downloading anything. ?since=<id> lists the bundles after that ID and
+?limit=<n> at most n of them (default 100); when more follow, "next" is the ID
+to pass as since for the next page. ?repo=<name> fails unless it names the
+exported repository. The listing is signed with the signing key like a status
+response, in the X-DSP-Signature header.
+
+--detach runs the export in the background once it has started and printed the
+export information, so no terminal has to stay open for the transfer window.
+The export information is also written to <global-dir>/run/export-<time>.json
+(or --info-file) and output goes to a log next to it. 'dsp export status' shows
+running exports and their transfers, and 'dsp export stop' stops one.
+
+Each completed download of a bundle is recorded in a receipt signed with this
+host's signing key: the bundle ID and SHA-256, the bytes sent and their
+SHA-256, the importer and the time. Receipts are kept in <data-dir>/receipts
+of the repository holding the bundle, or in the global directory for bundles
+kept elsewhere, and 'dsp history' lists them.
 
 Examples:
   # Export with password authentication and encryption
   dsp export -p "secret123" -f bundle.zip bundle.json
 
-  # Export with user authentication (no encryption)
-  dsp export -u "user1,user2" -f bundle.zip bundle.json
+  # Export to the hosts laptop and field-team, encrypted for each of them
+  dsp export -u "laptop,field-team" bundle.zip
 
   # Export with download limit
-  dsp export -p "secret123" -n 5 -f bundle.zip bundle.json`,
+  dsp export -p "secret123" -n 5 -f bundle.zip bundle.json
+
+  # Encrypt for the public keys of a host group instead of the password
+  dsp export -p "secret123" -n 2 --to field-team bundle.zip
+
+  # Bundle the latest changes and export them in one step
+  dsp export -p "secret123" -n 1 --bundle-latest
+
+  # Serve the snapshots and bundles of a repository
+  dsp export -u "user1" --files --repo my-repo
+
+  # Prompt for the password instead of giving it on the command line
+  dsp export -n 1 bundle.zip
+
+  # Export in the background, then follow and stop it
+  dsp export -p "secret123" -n 3 --detach bundle.zip
+  dsp export status
+  dsp export stop`,
 	Flags: []cli.Flag{
 		&cli.StringFlag{
 			Name:    "password",
 			Aliases: []string{"p"},
-			Usage:   "Password for authentication (mutually exclusive with -u)",
+			Usage:   "Password for authentication (mutually exclusive with -u); prefer a prompt, --password-stdin or DSP_PASSWORD",
+		},
+		&cli.BoolFlag{
+			Name:  "password-stdin",
+			Usage: "Read the password from the first line of standard input",
 		},
 		&cli.StringFlag{
 			Name:    "user",
@@ -117,13 +288,71 @@ Examples:
 		},
 		&cli.IntFlag{
 			Name:  "port",
-			Usage: "Port to use (default: from config)",
+			Usage: "Port to use (default: first free port of network.port_range in the global config)",
+		},
+		&cli.StringFlag{
+			Name:  "bind",
+			Usage: "IP address to listen on, such as 192.168.1.10, 0.0.0.0 or :: (default: network.bind_address, or all interfaces)",
+		},
+		&cli.StringFlag{
+			Name:  "advertise",
+			Usage: "Host name or address given to importers (default: network.external_host, or the hostname)",
+		},
+		&cli.StringFlag{
+			Name:  "metrics",
+			Usage: "Serve Prometheus metrics over plain HTTP on this address, such as 127.0.0.1:9464",
 		},
 		&cli.IntFlag{
-			Name:     "number",
-			Aliases:  []string{"n"},
-			Usage:    "Number of allowed downloads (required)",
-			Required: true,
+			Name:    "number",
+			Aliases: []string{"n"},
+			Usage:   "Number of allowed downloads (required)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "to",
+			Usage: "Encrypt for this host, alias or host group (can be repeated)",
+		},
+		&cli.BoolFlag{
+			Name:  "allow-plaintext",
+			Usage: "Serve a --user export unencrypted if a user has no registered host key",
+		},
+		&cli.BoolFlag{
+			Name:  "trust-new",
+			Usage: "Trust hosts met for the first time even under a manual trust policy",
+		},
+		&cli.BoolFlag{
+			Name:  "mtls",
+			Usage: "Only serve importers presenting the client certificate pinned for a trusted host at key exchange",
+		},
+		&cli.BoolFlag{
+			Name:  "noise",
+			Usage: "Serve over a Noise channel keyed by host identities instead of TLS (only trusted hosts can connect)",
+		},
+		&cli.BoolFlag{
+			Name:  "bundle-latest",
+			Usage: "Create a bundle of the changes since the last export and export it",
+		},
+		&cli.BoolFlag{
+			Name:  "files",
+			Usage: "Serve the snapshots and bundles of the repository read-only instead of one bundle",
+		},
+		&cli.StringFlag{
+			Name:    "repo",
+			Aliases: []string{"r"},
+			Usage:   "Repository to bundle with --bundle-latest or serve with --files (default: nearest repository)",
+		},
+		&cli.BoolFlag{
+			Name:    "detach",
+			Aliases: []string{"d"},
+			Usage:   "Run the export in the background once it has started",
+		},
+		&cli.StringFlag{
+			Name:  "info-file",
+			Usage: "Also write the export information to this file",
+		},
+		&cli.StringFlag{
+			Name:  "compression",
+			Usage: "Encodings downloads may be compressed with when the importer accepts them, preferred first, or none",
+			Value: strings.Join(protocol.Encodings, ","),
 		},
 		&cli.DurationFlag{
 			Name:    "timeout",
@@ -132,27 +361,95 @@ Examples:
 			Value:   time.Hour,
 		},
 	},
+	Subcommands: []*cli.Command{
+		statusCommand,
+		stopCommand,
+	},
 	Action: func(c *cli.Context) error {
 		// Validate arguments
-		if c.NArg() != 1 {
+		bundleLatest := c.Bool("bundle-latest")
+		serveFiles := c.Bool("files")
+		switch {
+		case serveFiles && (bundleLatest || c.NArg() != 0):
+			return fmt.Errorf("--files serves the repository's files; do not give a bundle")
+		case serveFiles && len(c.StringSlice("to")) > 0:
+			return fmt.Errorf("--files cannot be combined with --to; files are protected by TLS only")
+		case bundleLatest && c.NArg() != 0:
+			return fmt.Errorf("--bundle-latest creates the bundle; do not give a bundle file")
+		case !serveFiles && !bundleLatest && c.NArg() != 1:
 			return fmt.Errorf("expected one bundle file argument")
 		}
 
-		// Validate auth options
-		password := c.String("password")
+		// Checked here rather than with Required, which would apply to the subcommands
+		if !serveFiles && !c.IsSet("number") {
+			return fmt.Errorf("required flag \"number\" not set")
+		}
+
+		// Validate auth options. Without --user, the password comes from -p,
+		// --password-stdin, DSP_PASSWORD or a prompt, in that order.
 		users := c.String("user")
-		if password != "" && users != "" {
+		if users != "" && (c.IsSet("password") || c.Bool("password-stdin")) {
 			return fmt.Errorf("cannot use both password and user authentication")
 		}
-		if password == "" && users == "" {
-			return fmt.Errorf("must specify either password or user authentication")
+		var password string
+		if users == "" {
+			opts := secret.Options{Flag: c.String("password"), Stdin: c.Bool("password-stdin"), Prompt: "Export password", Confirm: true}
+			if isDetached() {
+				opts = secret.Options{Flag: os.Getenv(detachedPasswordEnv)}
+			}
+			var err error
+			if password, err = secret.Password(opts); err != nil {
+				return err
+			}
+			if password == "" {
+				return fmt.Errorf("must specify either password or user authentication")
+			}
+		}
+		encodings, err := protocol.ParseEncodings(c.String("compression"))
+		if err != nil {
+			return fmt.Errorf("invalid --compression: %w", err)
 		}
 
-		// Load and validate bundle
-		bundlePath := c.Args().First()
-		b, err := bundle.Load(bundlePath)
+		// Start again in the background
+		if c.Bool("detach") && !isDetached() {
+			return runDetached(password)
+		}
+
+		// Resolve encryption recipients
+		var recipientKeys []string
+		if targets := c.StringSlice("to"); len(targets) > 0 {
+			hostManager, err := hostpkg.NewManager()
+			if err != nil {
+				return fmt.Errorf("failed to create host manager: %w", err)
+			}
+			recipientKeys, err = hostManager.RecipientKeys(targets)
+			if err != nil {
+				return fmt.Errorf("failed to resolve recipients: %w", err)
+			}
+		}
+
+		// Under user auth, encrypt each download for the host key of the user
+		// asking for it. Files are served in ranges and are not encrypted.
+		var userKeys map[string][]string
+		if users := c.String("user"); users != "" && len(recipientKeys) == 0 && !serveFiles {
+			userKeys, err = resolveUserKeys(splitAndTrim(users, ","))
+			if err != nil {
+				if !c.Bool("allow-plaintext") {
+					return fmt.Errorf("%w; exchange keys with the user's host first, or pass --allow-plaintext to serve the bundle unencrypted", err)
+				}
+				fmt.Fprintf(os.Stderr, "Warning: %v; the bundle is served unencrypted\n", err)
+				userKeys = nil
+			}
+		}
+
+		// Load the trust policy and certificate warning period
+		globalConfig, err := config.LoadGlobal()
 		if err != nil {
-			return fmt.Errorf("failed to load bundle: %w", err)
+			return err
+		}
+		kdf, err := kdfParams(globalConfig)
+		if err != nil {
+			return err
 		}
 
 		// Get certificate from key manager
@@ -171,10 +468,71 @@ Examples:
 		if err != nil {
 			return fmt.Errorf("failed to get certificate fingerprint: %w", err)
 		}
+		certRotations, err := keyManager.CertRotations()
+		if err != nil {
+			return err
+		}
+		signingKey, err := keyManager.GetSigningPublicKey()
+		if err != nil {
+			return err
+		}
+		signingKeyFingerprint, err := crypto.SigningKeyFingerprint(signingKey)
+		if err != nil {
+			return fmt.Errorf("invalid signing public key: %w", err)
+		}
+
+		// Create the bundle, or load and validate the one given. With --files
+		// the repository's files are listed and signed instead.
+		var latest *latestBundle
+		var files *fileExport
+		var b *bundle.Bundle
+		var bundleHash string
+		bundlePath := c.Args().First()
+		var servedPath string
+		if serveFiles {
+			files, err = newFileExport(keyManager, c.String("repo"), globalConfig.SecureDelete)
+			if err != nil {
+				return err
+			}
+			defer files.close()
+			bundlePath = files.dir
+			servedPath = files.dir
+		} else {
+			if bundleLatest {
+				latest, err = createLatestBundle(c.Context, c.String("repo"))
+				if err != nil {
+					return err
+				}
+				bundlePath = latest.path
+			}
+			b, err = bundle.Load(c.Context, bundlePath)
+			if err != nil {
+				return fmt.Errorf("failed to load bundle: %w", err)
+			}
+			// A bundle sealed with encrypt_at_rest is served from a
+			// decrypted copy
+			plainPath, cleanup, err := bundle.Plain(bundlePath, globalConfig.SecureDelete)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt bundle: %w", err)
+			}
+			defer cleanup()
+			servedPath = plainPath
+			bundleHash, err = utils.HashFile(servedPath, "sha256")
+			if err != nil {
+				return fmt.Errorf("failed to hash bundle: %w", err)
+			}
+		}
+		var receiptDir string
+		if !serveFiles {
+			if receiptDir, err = receiptDataDir(bundlePath); err != nil {
+				return err
+			}
+		}
 
 		// Create export server
 		server := &ExportServer{
-			bundlePath: bundlePath,
+			bundlePath: servedPath,
+			storedPath: bundlePath,
 			outputPath: c.String("file"),
 			auth: &ExportAuth{
 				Method:     "password",
@@ -185,59 +543,105 @@ Examples:
 			done:            make(chan struct{}),
 			encrypted:       password != "", // Enable encryption only for password auth
 			certFingerprint: fingerprint,
+			signingKey:      string(signingKey),
+			bundleHash:      bundleHash,
+			encodings:       encodings,
+			recipientKeys:   recipientKeys,
+			userKeys:        userKeys,
+			trustPolicy:     globalConfig.GetTrustPolicy(),
+			trustNew:        c.Bool("trust-new"),
+			certWarningDays: globalConfig.GetCertExpiryWarningDays(),
+			secureDelete:    globalConfig.SecureDelete,
+			kdf:             kdf,
+			mtls:            c.Bool("mtls"),
+			noise:           c.Bool("noise"),
+			started:         time.Now(),
+			transfers:       make(map[int]*control.Transfer),
+			files:           files,
+			receiptDir:      receiptDir,
 		}
+		server.metrics = server.newMetrics()
+		server.failures.banAfter = globalConfig.GetBanAfter()
+		server.failures.banDuration = globalConfig.GetBanDuration()
 
 		// Set up authentication
 		if password != "" {
 			server.auth.Method = "password"
 			server.auth.Password = password
-			// Generate tokens for each allowed download
-			if err := server.generateTokens(c.Int("number")); err != nil {
+			// Generate tokens for each allowed download. Files are served as
+			// they are, so they can be fetched in ranges.
+			if serveFiles {
+				server.encrypted = false
+			} else if err := server.generateTokens(c.Int("number")); err != nil {
 				return fmt.Errorf("failed to generate security tokens: %w", err)
 			}
 		} else {
 			server.auth.Method = "user"
 			server.auth.Users = splitAndTrim(users, ",")
-			server.encrypted = false // No encryption for user auth
+			server.encrypted = false // No password encryption for user auth
 		}
-
-		// Start server
-		port := c.Int("port")
-		if port == 0 {
-			// TODO: Get port from config
-			port = 8080
+		if len(recipientKeys) > 0 {
+			server.encrypted = false // Host keys replace password encryption
 		}
 
-		// Create TLS config
-		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			MinVersion:   tls.VersionTLS12,
+		// Create TLS config. Noise channels replace TLS.
+		var tlsConfig *tls.Config
+		if !server.noise {
+			tlsConfig = &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS12,
+				// Client certificates are self-signed; they are checked against
+				// the fingerprints pinned in the hosts store
+				ClientAuth: tls.RequestClientCert,
+			}
 		}
 
-		// Create listener with TLS
-		listener, err := tls.Listen("tcp", fmt.Sprintf(":%d", port), tlsConfig)
+		// Start server on --port, or the first free port of the configured range
+		bindAddress := globalConfig.GetBindAddress()
+		if c.IsSet("bind") {
+			bindAddress = c.String("bind")
+			if net.ParseIP(bindAddress) == nil {
+				return fmt.Errorf("invalid bind address: %s is not an IP address", bindAddress)
+			}
+		}
+		firstPort, lastPort := globalConfig.GetPortRange()
+		listener, err := listen(bindAddress, c.Int("port"), firstPort, lastPort)
 		if err != nil {
 			return fmt.Errorf("failed to start server: %w", err)
 		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		if limit := globalConfig.GetMaxClientConnections(); limit > 0 {
+			listener = server.limitConnections(listener, limit)
+		}
+		if server.noise {
+			if listener, err = server.noiseListener(keyManager, listener); err != nil {
+				return err
+			}
+		} else {
+			listener = tls.NewListener(listener, tlsConfig)
+		}
 		server.listener = listener
 
 		// Set up HTTP server
 		mux := http.NewServeMux()
-		mux.HandleFunc("/download", server.handleDownload)
-		mux.HandleFunc("/status", server.handleStatus)
-		mux.HandleFunc("/key-exchange", server.handleKeyExchange)
+		if serveFiles {
+			mux.HandleFunc(protocol.ManifestPath, server.handleManifest)
+			mux.HandleFunc(protocol.FilesPath, server.handleFile)
+			mux.HandleFunc(protocol.CatalogPath, server.handleCatalog)
+		} else {
+			mux.HandleFunc("/download", server.handleDownload)
+			mux.HandleFunc("/status", server.handleStatus)
+			mux.HandleFunc("/key-exchange", server.handleKeyExchange)
+		}
+		mux.HandleFunc("/capabilities", server.handleCapabilities)
 
 		server.server = &http.Server{
-			Handler: mux,
+			Handler: withProtocolVersion(server.withLockout(server.withClientCert(mux))),
+			// Requests end with the command, so handlers stop when it is interrupted
+			BaseContext: func(net.Listener) context.Context { return c.Context },
+			ConnContext: withNoiseConn,
 		}
 
-		// Start server in background
-		go func() {
-			if err := server.server.Serve(listener); err != nil && err != http.ErrServerClosed {
-				fmt.Printf("Server error: %v\n", err)
-			}
-		}()
-
 		// Sign the export info
 		keyManager, err = crypto.NewKeyManager()
 		if err != nil {
@@ -245,20 +649,44 @@ Examples:
 		}
 
 		// Get host information
-		hostname, err := os.Hostname()
+		externalHost := globalConfig.GetExternalHost()
+		if c.IsSet("advertise") {
+			externalHost = c.String("advertise")
+		}
+		hostname, err := advertisedHost(externalHost, bindAddress)
+		if err != nil {
+			return err
+		}
+		addresses, err := lanAddresses(bindAddress)
 		if err != nil {
-			return fmt.Errorf("failed to get hostname: %w", err)
+			return err
 		}
 
 		// Create export info
 		info := ExportInfo{
 			Host:            hostname,
 			Port:            port,
-			BundleID:        b.ID,
+			Addresses:       addresses,
 			Auth:            server.auth.Method,
 			Expires:         time.Now().Add(c.Duration("timeout")).Format(time.RFC3339),
 			Encrypted:       server.encrypted,
+			KeyEncrypted:    server.keyEncrypted(),
 			CertFingerprint: server.certFingerprint, // Include certificate fingerprint
+			ProtocolVersion: protocol.Version,
+			Files:           serveFiles,
+			CertRotations:   certRotations,
+
+			SigningKeyFingerprint: signingKeyFingerprint,
+		}
+		if b != nil {
+			info.BundleID = b.ID
+		}
+		if server.noise {
+			info.Transport = transportNoise
+		}
+
+		if server.encrypted && len(recipientKeys) == 0 {
+			info.KDF = server.kdf
 		}
 
 		if server.auth.Method == "password" {
@@ -278,25 +706,95 @@ Examples:
 			return fmt.Errorf("failed to sign export info: %w", err)
 		}
 		info.Signature = signature
+		server.exportInfo = info
+
+		// Start server in background
+		go func() {
+			if err := server.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				fmt.Printf("Server error: %v\n", err)
+			}
+		}()
+
+		// Open the control socket for 'dsp ctl'
+		ctl, err := control.Listen(fmt.Sprintf("export-%d", os.Getpid()), server.controlHandlers())
+		if err != nil {
+			server.shutdown()
+			return err
+		}
+		defer ctl.Close()
+		go ctl.Serve()
+
+		// Expose metrics for monitoring
+		if addr := c.String("metrics"); addr != "" {
+			metricsServer, err := server.serveMetrics(addr)
+			if err != nil {
+				server.shutdown()
+				return err
+			}
+			defer metricsServer.Close()
+		}
 
-		// Print export information
+		// Remember the export so the next --bundle-latest continues from it
+		if latest != nil {
+			if err := latest.recordExport(); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+			fmt.Printf("Created bundle %s: %d changes\n", bundlePath, len(b.Changes))
+		}
+
+		// Print export information. The information file keeps the password
+		// for scripts; the terminal and logs do not.
 		infoJSON, err := json.MarshalIndent(info, "", "  ")
 		if err != nil {
 			return fmt.Errorf("failed to marshal export info: %w", err)
 		}
-		fmt.Printf("Export information:\n%s\n", string(infoJSON))
-		fmt.Printf("\nServer running on port %d. Press Ctrl+C to stop.\n", port)
-
-		// Wait for server to finish
-		<-server.done
+		printedJSON, err := printableInfo(info)
+		if err != nil {
+			return err
+		}
+		infoFile := c.String("info-file")
+		if isDetached() {
+			infoFile = os.Getenv(infoFileEnv)
+			defer utils.RemoveTemp(infoFile, globalConfig.SecureDelete)
+		}
+		if infoFile != "" {
+			if err := config.WriteFileAtomic(infoFile, append(infoJSON, '\n'), 0600); err != nil {
+				server.shutdown()
+				return fmt.Errorf("failed to write export information: %w", err)
+			}
+		}
+		fmt.Printf("Export information:\n%s\n", printedJSON)
+		fmt.Printf("\nServer listening on %s. Press Ctrl+C to stop.\n", listener.Addr())
+
+		// Wait for server to finish, or stop it when interrupted
+		select {
+		case <-server.done:
+		case <-c.Context.Done():
+			server.shutdown()
+			fmt.Println("Export stopped")
+		}
 		return nil
 	},
 }
 
+// printableInfo returns the export information to print, with the password
+// redacted
+func printableInfo(info ExportInfo) ([]byte, error) {
+	if info.Password != "" {
+		info.Password = secret.Redacted
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal export info: %w", err)
+	}
+	return data, nil
+}
+
 // handleDownload handles bundle download requests
 func (s *ExportServer) handleDownload(w http.ResponseWriter, r *http.Request) {
 	// Check authentication first
 	if !s.authenticateRequest(r) {
+		s.authFailed(r, "invalid credentials")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -307,13 +805,45 @@ func (s *ExportServer) handleDownload(w http.ResponseWriter, r *http.Request) {
 		clientIP = r.RemoteAddr
 	}
 
-	// For password auth, verify token
+	// Under a manual trust policy only trusted hosts may download
+	if !s.allowed(clientIP) {
+		http.Error(w, fmt.Sprintf("Host %s is not trusted by the exporter", clientIP), http.StatusForbidden)
+		return
+	}
+
+	// For password auth, verify token. It is spent only once the download
+	// completed, so an importer can retry a download that failed.
+	var token string
+	var spent bool
 	if s.auth.Method == "password" {
-		token := r.Header.Get("X-One-Time-Token")
-		if err := s.verifyToken(token, clientIP); err != nil {
+		token = r.Header.Get("X-One-Time-Token")
+		info, err := s.verifyToken(token, clientIP)
+		if err != nil {
+			s.authFailed(r, err.Error())
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
+		defer func() { s.releaseToken(info, spent) }()
+	}
+
+	// An importer that posts the hashes it already has gets a delta bundle
+	// without those contents
+	bundlePath, bundleHash := s.bundlePath, s.bundleHash
+	if r.Method == http.MethodPost {
+		deltaPath, omitted, err := s.deltaBundle(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if omitted > 0 {
+			defer utils.RemoveTemp(deltaPath, s.secureDelete)
+			if bundleHash, err = utils.HashFile(deltaPath, "sha256"); err != nil {
+				http.Error(w, "Failed to hash bundle", http.StatusInternalServerError)
+				return
+			}
+			bundlePath = deltaPath
+			w.Header().Set(protocol.DeltaHeader, strconv.Itoa(omitted))
+		}
 	}
 
 	// Check download limits
@@ -326,65 +856,76 @@ func (s *ExportServer) handleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 	s.downloads++
 	s.mu.Unlock()
+	s.metrics.downloads.Inc()
+
+	// A download that did not complete does not count against the limit
+	defer func() {
+		if !spent {
+			s.mu.Lock()
+			s.downloads--
+			s.mu.Unlock()
+		}
+	}()
 
-	// For user auth, mark user as downloaded
-	if s.auth.Method == "user" {
-		user := r.Header.Get("X-User")
-		s.mu.Lock()
-		s.auth.Downloaded[user] = true
-		s.mu.Unlock()
-	}
+	// Track the download for 'dsp ctl transfers'
+	started := time.Now()
+	w, done := s.startTransfer(w, clientIP)
+	defer done()
+
+	user := r.Header.Get("X-User")
 
 	// Verify bundle exists
-	if _, err := os.Stat(s.bundlePath); os.IsNotExist(err) {
+	if _, err := os.Stat(bundlePath); os.IsNotExist(err) {
 		http.Error(w, "Bundle not found", http.StatusNotFound)
 		return
 	}
 
-	// If using password auth, encrypt the bundle
-	if s.auth.Method == "password" && s.encrypted {
-		// Read the bundle file
-		bundleData, err := os.ReadFile(s.bundlePath)
+	// If encrypting for host keys, encrypt the bundle for all of them, or
+	// for the keys of the requesting user
+	var servedHash string
+	var served int64
+	var serveErr error
+	if keys := s.recipientsFor(user); len(keys) > 0 {
+		bundleData, err := os.ReadFile(bundlePath)
 		if err != nil {
 			http.Error(w, "Failed to read bundle", http.StatusInternalServerError)
 			return
 		}
+		defer utils.Wipe(bundleData)
 
-		// Verify bundle integrity before encryption
-		b, err := bundle.LoadFromBytes(bundleData)
+		encryptedData, err := crypto.EncryptForPublicKeys(bundleData, keys)
 		if err != nil {
-			http.Error(w, "Invalid bundle format", http.StatusInternalServerError)
+			http.Error(w, "Failed to encrypt bundle", http.StatusInternalServerError)
 			return
 		}
-		if err := b.Verify(); err != nil {
-			http.Error(w, "Bundle verification failed", http.StatusInternalServerError)
+
+		servedHash, served, serveErr = s.serveBytes(w, r, encryptedData)
+	} else if s.auth.Method == "password" && s.encrypted {
+		// If using password auth, encrypt the bundle
+		// Read the bundle file
+		bundleData, err := os.ReadFile(bundlePath)
+		if err != nil {
+			http.Error(w, "Failed to read bundle", http.StatusInternalServerError)
 			return
 		}
+		defer utils.Wipe(bundleData)
 
-		// Create multiple recipients for each token
-		var recipients []age.Recipient
-		for _, tokenID := range s.auth.TokenPool {
-			token := s.auth.Tokens[tokenID]
-			if !token.Used {
-				// Create a recipient for each valid token
-				combinedKey := s.auth.Password + token.Token
-				recipient, err := age.NewScryptRecipient(combinedKey)
-				if err != nil {
-					http.Error(w, "Failed to create recipient", http.StatusInternalServerError)
-					return
-				}
-				recipients = append(recipients, recipient)
-			}
+		// Verify bundle integrity before encryption
+		if _, err := bundle.Load(r.Context(), bundlePath); err != nil {
+			http.Error(w, "Bundle verification failed", http.StatusInternalServerError)
+			return
 		}
 
-		if len(recipients) == 0 {
-			http.Error(w, "No valid tokens available", http.StatusInternalServerError)
+		// Encrypt for the password and the requesting client's token, the
+		// key it derives on its side
+		recipient, err := s.kdf.Recipient(s.auth.Password + token)
+		if err != nil {
+			http.Error(w, "Failed to create recipient", http.StatusInternalServerError)
 			return
 		}
 
-		// Create an encrypted writer with all recipients
 		var buf bytes.Buffer
-		encWriter, err := age.Encrypt(&buf, recipients...)
+		encWriter, err := age.Encrypt(&buf, recipient)
 		if err != nil {
 			http.Error(w, "Failed to create encrypted writer", http.StatusInternalServerError)
 			return
@@ -404,21 +945,11 @@ func (s *ExportServer) handleDownload(w http.ResponseWriter, r *http.Request) {
 
 		encryptedData := buf.Bytes()
 
-		// Set content type and serve encrypted data
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(encryptedData)))
-		w.Write(encryptedData)
-
-		// Mark the used token as used
-		token := r.Header.Get("X-One-Time-Token")
-		s.auth.mu.Lock()
-		if tokenInfo, exists := s.auth.Tokens[token]; exists {
-			tokenInfo.Used = true
-		}
-		s.auth.mu.Unlock()
+		// Serve encrypted data
+		servedHash, served, serveErr = s.serveBytes(w, r, encryptedData)
 	} else {
 		// For user auth, serve the file as-is
-		file, err := os.Open(s.bundlePath)
+		file, err := os.Open(bundlePath)
 		if err != nil {
 			http.Error(w, "Failed to open bundle", http.StatusInternalServerError)
 			return
@@ -432,9 +963,29 @@ func (s *ExportServer) handleDownload(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
-		http.ServeContent(w, r, filepath.Base(s.bundlePath), fileInfo.ModTime(), file)
+		servedHash, served = bundleHash, fileInfo.Size()
+		serveErr = s.serve(w, r, file, fileInfo.Size(), bundleHash)
+	}
+
+	// Both sides keep a receipt of a completed download. Under user auth,
+	// the user has downloaded the bundle once the download completed.
+	if serveErr == nil {
+		spent = true
+		if s.auth.Method == "user" {
+			s.mu.Lock()
+			s.auth.Downloaded[user] = true
+			s.mu.Unlock()
+		}
+		s.writeReceipt(clientIP, user, servedHash, served, started)
+		importer := clientIP
+		if user != "" {
+			importer = fmt.Sprintf("%s (%s)", user, clientIP)
+		}
+		notify.Send(notify.Event{
+			Event:   config.EventBundleExported,
+			Subject: s.exportInfo.BundleID,
+			Detail:  fmt.Sprintf("downloaded by %s", importer),
+		})
 	}
 
 	// Check if we should shutdown
@@ -458,10 +1009,95 @@ func (s *ExportServer) handleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// kdfParams returns the key derivation parameters of password encryption
+// from the global configuration
+func kdfParams(cfg *config.GlobalConfig) (*crypto.KDFParams, error) {
+	params := &crypto.KDFParams{
+		Algorithm:  cfg.GetKDF(),
+		WorkFactor: cfg.Encryption.ScryptWorkFactor,
+		Time:       uint32(cfg.Encryption.Argon2Time),
+		MemoryMB:   uint32(cfg.Encryption.Argon2MemoryMB),
+		Threads:    uint8(cfg.Encryption.Argon2Threads),
+	}
+	if err := params.Validate(); err != nil {
+		return nil, exitcode.ConfigError(fmt.Errorf("invalid encryption settings: %w", err))
+	}
+	resolved := params.Resolved()
+	return &resolved, nil
+}
+
+// deltaBundle reads the hashes an importer posted and writes a delta of the
+// bundle without those contents to a temporary file. It returns the file and
+// the number of contents left out; with none left out there is no file.
+func (s *ExportServer) deltaBundle(r *http.Request) (string, int, error) {
+	var request protocol.DeltaRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxDeltaRequestSize)).Decode(&request); err != nil {
+		return "", 0, fmt.Errorf("invalid delta request: %w", err)
+	}
+	if len(request.Have) == 0 {
+		return "", 0, nil
+	}
+	have := make(map[string]bool, len(request.Have))
+	for _, hash := range request.Have {
+		have[hash] = true
+	}
+
+	tmp, err := os.CreateTemp("", "dsp-delta-*.zip")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create delta bundle: %w", err)
+	}
+	tmp.Close()
+	omitted, err := bundle.MakeDelta(r.Context(), s.bundlePath, tmp.Name(), have)
+	if err != nil || omitted == 0 {
+		utils.RemoveTemp(tmp.Name(), s.secureDelete)
+		return "", 0, err
+	}
+	return tmp.Name(), omitted, nil
+}
+
+// serveBytes serves a download held in memory. It returns the SHA-256 and
+// size of the bytes served.
+func (s *ExportServer) serveBytes(w http.ResponseWriter, r *http.Request, data []byte) (string, int64, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	return hash, int64(len(data)), s.serve(w, r, bytes.NewReader(data), int64(len(data)), hash)
+}
+
+// serve writes a download of size bytes with their SHA-256, so the importer
+// can detect a corrupted or truncated transfer. The body is compressed with
+// the first of the server's encodings the importer accepts; the hash and
+// size are those of the uncompressed bytes. It returns an error if the
+// download did not complete.
+func (s *ExportServer) serve(w http.ResponseWriter, r *http.Request, body io.Reader, size int64, hash string) error {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.Header().Set(protocol.ContentHashHeader, hash)
+
+	encoding := protocol.ChooseEncoding(r.Header.Get("Accept-Encoding"), s.encodings)
+	if encoding == "" {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+		_, err := io.Copy(w, body)
+		return err
+	}
+
+	encoder, err := protocol.NewEncoder(w, encoding)
+	if err != nil {
+		http.Error(w, "Failed to compress bundle", http.StatusInternalServerError)
+		return err
+	}
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Set(protocol.ContentSizeHeader, fmt.Sprintf("%d", size))
+	if _, err := io.Copy(encoder, body); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
 // handleStatus handles status requests
 func (s *ExportServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 	// Check password authentication first
 	if !s.authenticateRequest(r) {
+		s.authFailed(r, "invalid credentials")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -486,19 +1122,44 @@ func (s *ExportServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Create status response
+	// Create status response. It is signed, so importers can trust the
+	// addresses, certificate and token it gives.
 	status := struct {
-		Downloads    int      `json:"downloads"`
-		MaxDownloads int      `json:"max_downloads"`
-		AuthMethod   string   `json:"auth_method"`
-		Users        []string `json:"users,omitempty"`
-		Downloaded   []string `json:"downloaded,omitempty"`
-		Token        string   `json:"token,omitempty"`
-		TokenExpiry  string   `json:"token_expiry,omitempty"`
+		Host            string            `json:"host"`
+		Port            int               `json:"port"`
+		Addresses       []string          `json:"addresses,omitempty"`
+		BundleID        string            `json:"bundle_id"`
+		Expires         string            `json:"expires"`
+		CertFingerprint string            `json:"cert_fingerprint"`
+		SigningKey      string            `json:"signing_key"`
+		Downloads       int               `json:"downloads"`
+		MaxDownloads    int               `json:"max_downloads"`
+		AuthMethod      string            `json:"auth_method"`
+		Users           []string          `json:"users,omitempty"`
+		Downloaded      []string          `json:"downloaded,omitempty"`
+		Token           string            `json:"token,omitempty"`
+		TokenExpiry     string            `json:"token_expiry,omitempty"`
+		KeyEncrypted    bool              `json:"key_encrypted,omitempty"`
+		KDF             *crypto.KDFParams `json:"kdf,omitempty"`
+
+		// Rotations of the exporter's certificate, so importers that pinned
+		// an older one can follow them
+		CertRotations []crypto.CertRotation `json:"cert_rotations,omitempty"`
 	}{
-		Downloads:    s.downloads,
-		MaxDownloads: s.maxDownloads,
-		AuthMethod:   s.auth.Method,
+		Host:            s.exportInfo.Host,
+		Port:            s.exportInfo.Port,
+		Addresses:       s.exportInfo.Addresses,
+		BundleID:        s.exportInfo.BundleID,
+		Expires:         s.exportInfo.Expires,
+		CertFingerprint: s.certFingerprint,
+		SigningKey:      s.signingKey,
+		Downloads:       s.downloads,
+		MaxDownloads:    s.maxDownloads,
+		AuthMethod:      s.auth.Method,
+		KeyEncrypted:    s.keyEncrypted(),
+		KDF:             s.exportInfo.KDF,
+
+		CertRotations: s.exportInfo.CertRotations,
 	}
 
 	if s.auth.Method == "user" {
@@ -513,45 +1174,231 @@ func (s *ExportServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 		status.TokenExpiry = s.auth.Tokens[token].Expiry.Format(time.RFC3339)
 	}
 
+	body, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, "Failed to encode status", http.StatusInternalServerError)
+		return
+	}
+	keyManager, err := crypto.NewKeyManager()
+	if err != nil {
+		http.Error(w, "Failed to get key manager", http.StatusInternalServerError)
+		return
+	}
+	signature, err := keyManager.SignData(body)
+	if err != nil {
+		http.Error(w, "Failed to sign status", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(status)
+	w.Header().Set(protocol.SignatureHeader, signature)
+	w.Write(body)
+}
+
+// authFailed counts and audits a request refused for bad credentials
+func (s *ExportServer) authFailed(r *http.Request, reason string) {
+	s.clientFailed(requestIP(r), fmt.Sprintf("%s %s: %s", r.Method, r.URL.Path, reason))
 }
 
-// authenticateRequest authenticates the request
+// clientFailed counts and audits a failed authentication of a client,
+// locking it out or banning it after repeated failures
+func (s *ExportServer) clientFailed(clientIP, detail string) {
+	s.metrics.authFailures.Inc()
+
+	lockout, banned := s.failures.record(clientIP)
+	if banned {
+		audit.Record(audit.Event{
+			Type:    audit.ClientBanned,
+			Subject: clientIP,
+			Outcome: "banned",
+			Detail:  fmt.Sprintf("banned for %s after %d failed attempts", lockout, s.failures.banAfter),
+		})
+		fmt.Fprintf(os.Stderr, "Warning: banned %s for %s after %d failed attempts\n", clientIP, lockout, s.failures.banAfter)
+	} else if lockout > 0 {
+		detail = fmt.Sprintf("%s; locked out for %s", detail, lockout)
+	}
+	audit.Record(audit.Event{
+		Type:    audit.AuthFailure,
+		Subject: clientIP,
+		Outcome: "refused",
+		Detail:  detail,
+	})
+}
+
+// authenticateRequest authenticates the request. Credentials are compared
+// in constant time; downloads are accounted for by handleDownload.
 func (s *ExportServer) authenticateRequest(r *http.Request) bool {
+	authorized := false
 	if s.auth.Method == "password" {
 		// Password authentication
 		password := r.Header.Get("X-Password")
-		return password == s.auth.Password
-	} else {
-		// User authentication
-		user := r.Header.Get("X-User")
-		if user == "" {
-			return false
-		}
-
-		// Check if user is authorized
-		authorized := false
+		authorized = subtle.ConstantTimeCompare([]byte(password), []byte(s.auth.Password)) == 1
+	} else if user := r.Header.Get("X-User"); user != "" {
+		// User authentication, comparing with every user
 		for _, u := range s.auth.Users {
-			if u == user {
+			if subtle.ConstantTimeCompare([]byte(user), []byte(u)) == 1 {
 				authorized = true
-				break
 			}
 		}
-		if !authorized {
-			return false
+	}
+
+	if authorized {
+		s.failures.reset(requestIP(r))
+	}
+	return authorized
+}
+
+// handleCapabilities reports the protocol version and features supported by this server
+func (s *ExportServer) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(protocol.Local())
+}
+
+// withClientCert checks the client certificates of requests. A certificate
+// pinned for a host must belong to a trusted host and, under user auth, to
+// the user the request names. With --mtls, requests without a pinned
+// certificate are refused. Capabilities and key exchanges, which pin the
+// certificate, are exempt.
+func (s *ExportServer) withClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/capabilities" && r.URL.Path != "/key-exchange" {
+			if err := s.checkClientCert(r); err != nil {
+				s.authFailed(r, err.Error())
+				http.Error(w, "Client certificate refused", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkClientCert checks the client certificate of a request, if any. On a
+// Noise channel the importer's host key takes the place of the certificate.
+func (s *ExportServer) checkClientCert(r *http.Request) error {
+	var peer *hostpkg.Host
+	conn, isNoise := r.Context().Value(noiseConnKey{}).(*noise.Conn)
+	if isNoise || (r.TLS != nil && len(r.TLS.PeerCertificates) > 0) {
+		hostManager, err := hostpkg.NewManager()
+		if err != nil {
+			return fmt.Errorf("failed to get host manager: %w", err)
+		}
+		if isNoise {
+			peer, _ = hostManager.HostByX25519Key(conn.RemoteStatic())
+		} else {
+			peer, _ = hostManager.HostByClientCert(hostpkg.CertFingerprint(r.TLS.PeerCertificates[0]))
 		}
+	}
+	if peer == nil {
+		if s.mtls || isNoise {
+			return fmt.Errorf("no client certificate pinned for a host")
+		}
+		return nil
+	}
+
+	if !peer.Trusted {
+		return fmt.Errorf("client certificate of untrusted host %s", peer.Name)
+	}
+	if user := r.Header.Get("X-User"); s.auth.Method == "user" && user != peer.Name && user != peer.Alias {
+		return fmt.Errorf("client certificate of host %s presented for user %s", peer.Name, user)
+	}
+	return nil
+}
 
-		// Mark user as downloaded
-		s.auth.Downloaded[user] = true
+// withProtocolVersion stamps every response with the protocol version and
+// rejects clients speaking no version this server speaks
+func withProtocolVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protocol.SetHeader(w.Header(), protocol.Version)
+
+		// Capabilities must always be reachable so clients can discover the mismatch themselves
+		if r.URL.Path != "/capabilities" {
+			clientVersion, err := protocol.ParseVersion(r.Header.Get(protocol.VersionHeader))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Clients that do not send their oldest version speak only one
+			clientMinVersion := clientVersion
+			if value := r.Header.Get(protocol.MinVersionHeader); value != "" {
+				if clientMinVersion, err = protocol.ParseVersion(value); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if err := protocol.CheckClientVersion(clientVersion, clientMinVersion); err != nil {
+				http.Error(w, err.Error(), http.StatusUpgradeRequired)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowed reports whether a client may download under the trust policy.
+// Only a manual policy restricts downloads, to trusted hosts.
+func (s *ExportServer) allowed(clientIP string) bool {
+	if s.trustPolicy != config.TrustPolicyManual {
 		return true
 	}
+
+	hostManager, err := hostpkg.NewManager()
+	if err != nil {
+		return false
+	}
+	h, err := hostManager.GetHost(clientIP)
+	if err != nil {
+		return s.trustNew
+	}
+	return h.Trusted
 }
 
 // shutdown gracefully shuts down the server
 func (s *ExportServer) shutdown() {
-	close(s.done)
-	s.server.Close()
+	s.stopOnce.Do(func() {
+		close(s.done)
+		s.server.Close()
+	})
+}
+
+// resolveUserKeys returns the host public keys of each user, a user being
+// the name or alias of a trusted host, or a host group
+func resolveUserKeys(users []string) (map[string][]string, error) {
+	hostManager, err := hostpkg.NewManager()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create host manager: %w", err)
+	}
+	keys := make(map[string][]string, len(users))
+	for _, user := range users {
+		userKeys, err := hostManager.RecipientKeys([]string{user})
+		if err != nil {
+			return nil, fmt.Errorf("user %s has no registered key: %w", user, err)
+		}
+		keys[user] = userKeys
+	}
+	return keys, nil
+}
+
+// recipientsFor returns the host public keys a download by a user is
+// encrypted for, or nil if it is not encrypted for host keys
+func (s *ExportServer) recipientsFor(user string) []string {
+	if len(s.recipientKeys) > 0 {
+		return s.recipientKeys
+	}
+	if s.auth.Method == "user" {
+		return s.userKeys[user]
+	}
+	return nil
+}
+
+// keyEncrypted reports whether downloads are encrypted for host keys
+func (s *ExportServer) keyEncrypted() bool {
+	return len(s.recipientKeys) > 0 || len(s.userKeys) > 0
 }
 
 // splitAndTrim splits a string and trims each part
@@ -572,6 +1419,7 @@ func (s *ExportServer) handleKeyExchange(w http.ResponseWriter, r *http.Request)
 
 	// Check password authentication first
 	if !s.authenticateRequest(r) {
+		s.authFailed(r, "invalid credentials")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -591,7 +1439,8 @@ func (s *ExportServer) handleKeyExchange(w http.ResponseWriter, r *http.Request)
 
 	// Read importer's public key from request
 	var keyExchange struct {
-		PublicKey string `json:"public_key"`
+		PublicKey     string                `json:"public_key"`
+		CertRotations []crypto.CertRotation `json:"cert_rotations,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&keyExchange); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -617,40 +1466,34 @@ func (s *ExportServer) handleKeyExchange(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Check if host already exists
-	existingHost, err := hostManager.GetHost(clientIP)
+	// Record the importer according to the trust policy
+	importer, err := hostManager.RecordPeer(clientIP, keyExchange.PublicKey, clientIP, s.exportInfo.Port, s.trustPolicy, s.trustNew)
 	if err != nil {
-		// Host doesn't exist, create new one
-		existingHost = &hostpkg.Host{
-			Name:      clientIP,
-			PublicKey: keyExchange.PublicKey,
-			Trusted:   true, // Start trusted by default
-			AddedAt:   time.Now(),
-			LastUsed:  time.Now(),
-			IPAddress: clientIP,
-			LastPort:  s.exportInfo.Port,
-		}
-		if err := hostManager.AddHost(existingHost); err != nil {
-			http.Error(w, "Failed to add host", http.StatusInternalServerError)
-			return
-		}
-	} else {
-		// Update existing host
-		existingHost.PublicKey = keyExchange.PublicKey
-		existingHost.LastUsed = time.Now()
-		existingHost.IPAddress = clientIP
-		existingHost.LastPort = s.exportInfo.Port
-		existingHost.Trusted = true // Ensure host is trusted
-		if err := hostManager.UpdateHost(existingHost); err != nil {
-			http.Error(w, "Failed to update host", http.StatusInternalServerError)
+		auditKeyExchange(clientIP, "refused", err.Error())
+		fmt.Printf("Refused key exchange from %s: %v\n", clientIP, err)
+		http.Error(w, "Host key changed; key exchange refused", http.StatusForbidden)
+		return
+	}
+	if !importer.Trusted {
+		auditKeyExchange(clientIP, "untrusted", fmt.Sprintf("importer key %s recorded under trust policy %s", keyExchange.PublicKey, s.trustPolicy))
+		fmt.Printf("Host %s is not trusted (trust policy: %s); run 'dsp host trust %s' to allow it\n", clientIP, s.trustPolicy, clientIP)
+		http.Error(w, "Host is not trusted by the exporter", http.StatusForbidden)
+		return
+	}
+	auditKeyExchange(clientIP, "trusted", fmt.Sprintf("importer key %s", keyExchange.PublicKey))
+
+	// Pin the certificate the importer presented, for mutual TLS
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		fingerprint := hostpkg.CertFingerprint(r.TLS.PeerCertificates[0])
+		if err := hostManager.PinClientCert(importer.Name, fingerprint, s.trustPolicy, keyExchange.CertRotations); err != nil {
+			auditKeyExchange(clientIP, "refused", err.Error())
+			fmt.Printf("Refused key exchange from %s: %v\n", clientIP, err)
+			http.Error(w, "Client certificate changed; key exchange refused", http.StatusForbidden)
 			return
 		}
 	}
-
-	// Add importer as a recipient
-	if err := keyManager.AddRecipient(clientIP, keyExchange.PublicKey); err != nil {
-		http.Error(w, "Failed to add importer as recipient", http.StatusInternalServerError)
-		return
+	if warning := importer.CertWarning(s.certWarningDays); warning != "" {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
 	}
 
 	// Update export info with both keys
@@ -677,6 +1520,16 @@ func (s *ExportServer) handleKeyExchange(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(response)
 }
 
+// auditKeyExchange records the outcome of a key exchange with an importer
+func auditKeyExchange(clientIP, outcome, detail string) {
+	audit.Record(audit.Event{
+		Type:    audit.KeyExchange,
+		Subject: clientIP,
+		Outcome: outcome,
+		Detail:  detail,
+	})
+}
+
 // generateTokens generates a pool of one-time tokens
 func (s *ExportServer) generateTokens(count int) error {
 	s.auth.mu.Lock()
@@ -744,32 +1597,59 @@ func (s *ExportServer) assignToken(clientIP string) (string, error) {
 		ClientIP:   clientIP,
 		AssignedAt: time.Now(),
 	}
+	audit.Record(audit.Event{
+		Type:    audit.TokenIssued,
+		Subject: clientIP,
+		Detail:  fmt.Sprintf("one-time token for bundle %s, expires %s", s.exportInfo.BundleID, s.auth.Tokens[token].Expiry.Format(time.RFC3339)),
+	})
 
 	return token, nil
 }
 
-// verifyToken verifies a token is valid and marks it as used
-func (s *ExportServer) verifyToken(token, clientIP string) error {
+// verifyToken verifies a token is valid and reserves it for a download,
+// which must release it with releaseToken
+func (s *ExportServer) verifyToken(token, clientIP string) (*TokenInfo, error) {
 	s.auth.mu.Lock()
 	defer s.auth.mu.Unlock()
 
-	info, exists := s.auth.Tokens[token]
-	if !exists {
-		return fmt.Errorf("invalid token")
+	// Compare with every token in constant time rather than look it up
+	var info *TokenInfo
+	for _, candidate := range s.auth.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate.Token)) == 1 {
+			info = candidate
+		}
+	}
+	if info == nil {
+		return nil, fmt.Errorf("invalid token")
 	}
 
 	if info.Used {
-		return fmt.Errorf("token already used")
+		return nil, fmt.Errorf("token already used")
+	}
+
+	if info.InUse {
+		return nil, fmt.Errorf("token already in use")
 	}
 
 	if time.Now().After(info.Expiry) {
-		return fmt.Errorf("token expired")
+		return nil, fmt.Errorf("token expired")
 	}
 
 	if info.ClientIP != clientIP {
-		return fmt.Errorf("token assigned to different client")
+		return nil, fmt.Errorf("token assigned to different client")
 	}
 
-	info.Used = true
-	return nil
+	info.InUse = true
+	return info, nil
+}
+
+// releaseToken ends a download with a token reserved by verifyToken. The
+// token is spent if the download completed, and may be used again if not.
+func (s *ExportServer) releaseToken(info *TokenInfo, spent bool) {
+	s.auth.mu.Lock()
+	defer s.auth.mu.Unlock()
+	info.InUse = false
+	if spent {
+		info.Used = true
+	}
 }
@@ -0,0 +1,192 @@
+package exportcmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/control"
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+)
+
+// writeTestBundle saves a small valid bundle archive and returns its path
+func writeTestBundle(t *testing.T) string {
+	t.Helper()
+	b := &bundle.Bundle{
+		ID:             "test-bundle",
+		CreatedAt:      time.Now(),
+		CreatedBy:      "test",
+		IsInitial:      true,
+		TargetSnapshot: "target",
+		Changes: []bundle.Change{
+			{Path: "/repo/a.txt", Type: "add", Hash: "hash-a", Size: 1},
+		},
+	}
+	b.Repository.Name = "repo"
+	b.Repository.DSPDir = ".dsp"
+	b.Repository.DataDir = "data"
+	b.Repository.Config.HashAlgorithm = "sha256"
+	b.Repository.Config.CompressionLevel = 3
+	b.Repository.TrackingConfig = &snapshot.TrackingConfig{}
+
+	path := filepath.Join(t.TempDir(), "bundle.zip")
+	if err := b.Save(context.Background(), path); err != nil {
+		t.Fatalf("save bundle: %v", err)
+	}
+	return path
+}
+
+// newPasswordServer returns an export server for a password-protected,
+// encrypted download of the bundle at path, with one token per download. It
+// signs status responses with a key in a temporary global directory and
+// writes receipts to a temporary directory.
+func newPasswordServer(t *testing.T, path string, downloads int, kdf *crypto.KDFParams) *ExportServer {
+	t.Helper()
+	t.Setenv(config.GlobalDirEnv, t.TempDir())
+	keyManager, err := crypto.NewKeyManager()
+	if err != nil {
+		t.Fatalf("key manager: %v", err)
+	}
+	if err := keyManager.GenerateSigningKeyPair(); err != nil {
+		t.Fatalf("generate signing key: %v", err)
+	}
+
+	s := &ExportServer{
+		bundlePath: path,
+		auth: &ExportAuth{
+			Method:     "password",
+			Password:   "secret",
+			Downloaded: make(map[string]bool),
+			Tokens:     make(map[string]*TokenInfo),
+		},
+		maxDownloads: downloads,
+		done:         make(chan struct{}),
+		encrypted:    true,
+		kdf:          kdf,
+		server:       &http.Server{},
+		started:      time.Now(),
+		transfers:    make(map[int]*control.Transfer),
+		receiptDir:   t.TempDir(),
+	}
+	s.metrics = s.newMetrics()
+	if err := s.generateTokens(downloads); err != nil {
+		t.Fatalf("generate tokens: %v", err)
+	}
+	return s
+}
+
+// fetchStatus requests a one-time token from the server
+func fetchStatus(t *testing.T, url string) string {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url+"/status", nil)
+	req.Header.Set("X-Password", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("status returned %d: %s", resp.StatusCode, body)
+	}
+	var status struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	return status.Token
+}
+
+// download fetches the bundle with a token, returning the status and body
+func download(t *testing.T, url, token string) (int, []byte) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url+"/download", nil)
+	req.Header.Set("X-Password", "secret")
+	req.Header.Set("X-One-Time-Token", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read download: %v", err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestPasswordDownloadRoundTrip(t *testing.T) {
+	kdfs := map[string]*crypto.KDFParams{
+		"scrypt":   {Algorithm: crypto.KDFScrypt, WorkFactor: 10},
+		"argon2id": {Algorithm: crypto.KDFArgon2id, Time: 1, MemoryMB: 8, Threads: 1},
+	}
+	for name, kdf := range kdfs {
+		t.Run(name, func(t *testing.T) {
+			path := writeTestBundle(t)
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Several tokens are issued, as with 'dsp export -n 2'
+			s := newPasswordServer(t, path, 2, kdf)
+			mux := http.NewServeMux()
+			mux.HandleFunc("/status", s.handleStatus)
+			mux.HandleFunc("/download", s.handleDownload)
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+
+			token := fetchStatus(t, ts.URL)
+			code, body := download(t, ts.URL, token)
+			if code != http.StatusOK {
+				t.Fatalf("download returned %d: %s", code, body)
+			}
+			got, err := crypto.DecryptWithKDF(body, "secret"+token, kdf)
+			if err != nil {
+				t.Fatalf("decrypt download: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("decrypted download differs from the bundle")
+			}
+
+			// The token is spent once the download completed
+			if code, body := download(t, ts.URL, token); code != http.StatusUnauthorized {
+				t.Fatalf("second download with the same token returned %d: %s", code, body)
+			}
+		})
+	}
+}
+
+func TestFailedDownloadKeepsToken(t *testing.T) {
+	path := writeTestBundle(t)
+	s := newPasswordServer(t, path, 1, &crypto.KDFParams{Algorithm: crypto.KDFScrypt, WorkFactor: 10})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/download", s.handleDownload)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	token := fetchStatus(t, ts.URL)
+
+	// A download that fails before the body is written leaves the token
+	// usable for a retry
+	s.bundlePath = filepath.Join(t.TempDir(), "missing.zip")
+	if code, _ := download(t, ts.URL, token); code != http.StatusNotFound {
+		t.Fatalf("download of a missing bundle returned %d", code)
+	}
+	s.bundlePath = path
+	if code, body := download(t, ts.URL, token); code != http.StatusOK {
+		t.Fatalf("retried download returned %d: %s", code, body)
+	}
+}
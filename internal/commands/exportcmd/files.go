@@ -0,0 +1,385 @@
+package exportcmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/internal/protocol"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// fileExportDirs are the directories of the DSP directory a file export
+// serves
+var fileExportDirs = []string{"snapshots", "bundles"}
+
+// fileExport serves the snapshots and bundles of a repository read-only. The
+// files are listed once, when the export starts, in a signed manifest; files
+// created later are not served. Bundles sealed with encrypt_at_rest are
+// served from decrypted copies, which close removes.
+type fileExport struct {
+	dir      string                           // DSP directory
+	files    map[string]protocol.ManifestFile // By path
+	manifest []byte                           // Signed manifest, as served
+	name     string                           // Repository name
+	bundles  []protocol.CatalogBundle         // Bundles among the files, by ID
+	plain    map[string]string                // Decrypted copies of sealed bundles, by file
+	cleanups []func()                         // Remove the decrypted copies
+}
+
+// newFileExport lists and hashes the files of the repository (or the nearest
+// one) and signs the manifest with the signing key of keyManager. Decrypted
+// copies of sealed bundles are wiped when removed if secureDelete is set.
+func newFileExport(keyManager *crypto.KeyManager, repoFlag string, secureDelete bool) (_ *fileExport, err error) {
+	manager, err := repo.NewManager()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create repository manager: %w", err)
+	}
+	currentRepo, err := manager.GetCurrentRepo(repoFlag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repository context: %w", err)
+	}
+
+	export := &fileExport{
+		dir:   currentRepo.GetDSPDir(),
+		files: make(map[string]protocol.ManifestFile),
+		name:  currentRepo.Name,
+		plain: make(map[string]string),
+	}
+	defer func() {
+		if err != nil {
+			export.close()
+		}
+	}()
+	manifest := protocol.FileManifest{
+		Version:    protocol.FileManifestVersion,
+		Repository: currentRepo.Name,
+		CreatedAt:  time.Now().UTC(),
+		Files:      []protocol.ManifestFile{},
+	}
+	for _, name := range fileExportDirs {
+		root := filepath.Join(export.dir, name)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && path == root {
+					return nil
+				}
+				return err
+			}
+			// Skip hidden files, temporary files and anything but regular files
+			if strings.HasPrefix(d.Name(), ".") && path != root {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() || strings.HasSuffix(d.Name(), ".tmp") {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			source, err := export.decrypt(path, secureDelete)
+			if err != nil {
+				return err
+			}
+			sourceInfo, err := os.Stat(source)
+			if err != nil {
+				return err
+			}
+			hash, err := utils.HashFile(source, "sha256")
+			if err != nil {
+				return fmt.Errorf("failed to hash %s: %w", path, err)
+			}
+			rel, err := filepath.Rel(export.dir, path)
+			if err != nil {
+				return err
+			}
+			file := protocol.ManifestFile{
+				Path:    filepath.ToSlash(rel),
+				Size:    sourceInfo.Size(),
+				SHA256:  hash,
+				ModTime: info.ModTime().UTC(),
+			}
+			export.files[file.Path] = file
+			manifest.Files = append(manifest.Files, file)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", root, err)
+		}
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Path < manifest.Files[j].Path
+	})
+	export.bundles = catalogBundles(export.dir, manifest.Files)
+
+	// Sign the manifest
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	signature, err := keyManager.SignData(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign manifest: %w", err)
+	}
+	signer, err := keyManager.GetSigningPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	export.manifest, err = json.Marshal(protocol.SignedManifest{
+		Manifest:  data,
+		Signature: signature,
+		Signer:    string(signer),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	return export, nil
+}
+
+// decrypt decrypts the file at path if it is a sealed bundle and returns the
+// file to serve for it. Files are walked in lexical order, so a bundle is
+// decrypted before its parity file is met.
+func (e *fileExport) decrypt(path string, secureDelete bool) (string, error) {
+	if strings.HasSuffix(path, ".zip") {
+		plain, cleanup, err := bundle.Plain(path, secureDelete)
+		if err != nil {
+			return "", fmt.Errorf("failed to decrypt %s: %w", path, err)
+		}
+		if plain != path {
+			e.plain[path] = plain
+			e.cleanups = append(e.cleanups, cleanup)
+		}
+	}
+	return e.source(path), nil
+}
+
+// source returns the file served for the file at path: a decrypted copy of a
+// sealed bundle or of its parity file, or the file itself
+func (e *fileExport) source(path string) string {
+	if strings.HasSuffix(path, bundle.ParitySuffix) {
+		if plain, ok := e.plain[strings.TrimSuffix(path, bundle.ParitySuffix)]; ok {
+			return plain + bundle.ParitySuffix
+		}
+	}
+	if plain, ok := e.plain[path]; ok {
+		return plain
+	}
+	return path
+}
+
+// close removes the decrypted copies of sealed bundles
+func (e *fileExport) close() {
+	for _, cleanup := range e.cleanups {
+		cleanup()
+	}
+	e.cleanups = nil
+}
+
+// catalogBundles returns the bundles among the files of a file export, in ID
+// order. Bundles whose metadata cannot be read are listed by file name.
+func catalogBundles(dir string, files []protocol.ManifestFile) []protocol.CatalogBundle {
+	var bundles []protocol.CatalogBundle
+	targets := make(map[string]string) // Bundle ID by target snapshot
+	sources := make(map[string]string) // Source snapshot by bundle ID
+	for _, file := range files {
+		name := strings.TrimPrefix(file.Path, "bundles/")
+		if name == file.Path || strings.Contains(name, "/") {
+			continue
+		}
+		entry := protocol.CatalogBundle{
+			Path:      file.Path,
+			Size:      file.Size,
+			SHA256:    file.SHA256,
+			CreatedAt: file.ModTime,
+		}
+		switch {
+		case strings.HasSuffix(name, ".zip.age"):
+			entry.ID = strings.TrimSuffix(name, ".zip.age")
+			entry.Encrypted = true
+		case strings.HasSuffix(name, ".zip"):
+			entry.ID = strings.TrimSuffix(name, ".zip")
+			r, err := bundle.OpenReader(filepath.Join(dir, filepath.FromSlash(file.Path)))
+			if err != nil {
+				break
+			}
+			b := r.Bundle
+			r.Close()
+			entry.ID = b.ID
+			entry.CreatedAt = b.CreatedAt.UTC()
+			// The latest bundle reaching a snapshot is the parent of those
+			// starting from it
+			if prev, ok := targets[b.TargetSnapshot]; !ok || prev < b.ID {
+				targets[b.TargetSnapshot] = b.ID
+			}
+			if b.SourceSnapshot != "" {
+				sources[b.ID] = b.SourceSnapshot
+			}
+		default:
+			continue
+		}
+		bundles = append(bundles, entry)
+	}
+
+	for i := range bundles {
+		if source, ok := sources[bundles[i].ID]; ok {
+			bundles[i].Parent = targets[source]
+		}
+	}
+	sort.Slice(bundles, func(i, j int) bool {
+		return bundles[i].ID < bundles[j].ID
+	})
+	return bundles
+}
+
+// checkFileAccess authenticates a request to a file export and applies the
+// trust policy. It reports whether the request may continue; if not, the
+// response has been written.
+func (s *ExportServer) checkFileAccess(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if !s.authenticateRequest(r) {
+		s.authFailed(r, "invalid credentials")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	if !s.allowed(clientIP) {
+		http.Error(w, fmt.Sprintf("Host %s is not trusted by the exporter", clientIP), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// handleManifest serves the signed manifest of a file export
+func (s *ExportServer) handleManifest(w http.ResponseWriter, r *http.Request) {
+	if !s.checkFileAccess(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s.files.manifest)
+}
+
+// handleFile serves a file listed in the manifest of a file export. Requests
+// may ask for byte ranges; the ETag is the SHA-256 of the whole file.
+func (s *ExportServer) handleFile(w http.ResponseWriter, r *http.Request) {
+	if !s.checkFileAccess(w, r) {
+		return
+	}
+	entry, ok := s.files.files[strings.TrimPrefix(r.URL.Path, protocol.FilesPath)]
+	if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	path := filepath.Join(s.files.dir, filepath.FromSlash(entry.Path))
+	stored, err := os.Stat(path)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	file, err := os.Open(s.files.source(path))
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Failed to get file info", http.StatusInternalServerError)
+		return
+	}
+	// Files are not served once they no longer match the manifest
+	if info.Size() != entry.Size || !stored.ModTime().Equal(entry.ModTime) {
+		http.Error(w, "File changed since the manifest was signed", http.StatusGone)
+		return
+	}
+
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	w, done := s.startTransfer(w, clientIP)
+	defer done()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+entry.SHA256+`"`)
+	http.ServeContent(w, r, "", entry.ModTime, file)
+}
+
+// handleCatalog serves the bundles of a file export after the ID given as
+// since, at most limit of them, in a signed response. repo, if given, must
+// name the exported repository.
+func (s *ExportServer) handleCatalog(w http.ResponseWriter, r *http.Request) {
+	if !s.checkFileAccess(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	if repoName := query.Get("repo"); repoName != "" && repoName != s.files.name {
+		http.Error(w, fmt.Sprintf("Repository %s is not exported", repoName), http.StatusNotFound)
+		return
+	}
+	limit := protocol.DefaultCatalogLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, protocol.MaxCatalogLimit)
+	}
+
+	since := query.Get("since")
+	bundles := s.files.bundles
+	start := sort.Search(len(bundles), func(i int) bool { return bundles[i].ID > since })
+	catalog := protocol.BundleCatalog{
+		Repository: s.files.name,
+		Bundles:    []protocol.CatalogBundle{},
+	}
+	for _, b := range bundles[start:] {
+		if len(catalog.Bundles) == limit {
+			catalog.Next = catalog.Bundles[limit-1].ID
+			break
+		}
+		catalog.Bundles = append(catalog.Bundles, b)
+	}
+
+	body, err := json.Marshal(catalog)
+	if err != nil {
+		http.Error(w, "Failed to encode catalog", http.StatusInternalServerError)
+		return
+	}
+	keyManager, err := crypto.NewKeyManager()
+	if err != nil {
+		http.Error(w, "Failed to get key manager", http.StatusInternalServerError)
+		return
+	}
+	signature, err := keyManager.SignData(body)
+	if err != nil {
+		http.Error(w, "Failed to sign catalog", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(protocol.SignatureHeader, signature)
+	w.Write(body)
+}
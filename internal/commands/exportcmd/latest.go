@@ -0,0 +1,151 @@
+package exportcmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/ledger"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"gopkg.in/yaml.v3"
+)
+
+// lastExportFileName records the latest bundle made by --bundle-latest
+const lastExportFileName = "last-export.yaml"
+
+// lastExport is the bundle most recently created and exported by --bundle-latest
+type lastExport struct {
+	BundleID       string    `yaml:"bundle_id"`
+	TargetSnapshot string    `yaml:"target_snapshot"`
+	ExportedAt     time.Time `yaml:"exported_at"`
+}
+
+// latestBundle is a bundle created for --bundle-latest
+type latestBundle struct {
+	path     string
+	dspDir   string
+	bundle   *bundle.Bundle
+	targetID string
+}
+
+// createLatestBundle creates a bundle of the changes since the last bundle
+// exported with --bundle-latest, or between the latest two snapshots if that
+// snapshot is gone. A repository with a single snapshot gets an initial bundle.
+func createLatestBundle(ctx context.Context, repoFlag string) (*latestBundle, error) {
+	manager, err := repo.NewManager()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create repository manager: %w", err)
+	}
+	currentRepo, err := manager.GetCurrentRepo(repoFlag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repository context: %w", err)
+	}
+	dspDir := currentRepo.GetDSPDir()
+
+	// Pick the source and target snapshots
+	entries, err := snapshot.List(dspDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no snapshots found; run 'dsp snapshot' first")
+	}
+	target := entries[len(entries)-1].ID
+	source := ""
+	if len(entries) > 1 {
+		source = entries[len(entries)-2].ID
+	}
+	last, err := loadLastExport(dspDir)
+	if err != nil {
+		return nil, err
+	}
+	if last != nil {
+		if last.TargetSnapshot == target {
+			return nil, fmt.Errorf("no new snapshots since bundle %s was exported; run 'dsp snapshot' first", last.BundleID)
+		}
+		for _, entry := range entries {
+			if entry.ID == last.TargetSnapshot {
+				source = entry.ID
+				break
+			}
+		}
+	}
+
+	// Create the bundle
+	sourcePath := ""
+	if source != "" {
+		sourcePath = snapshot.FilePath(dspDir, source)
+	}
+	b, err := bundle.NewForPaths(ctx, sourcePath, snapshot.FilePath(dspDir, target), nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bundle: %w", err)
+	}
+	defer b.Close()
+
+	// Save it in the bundles directory, recording it in the repository lineage
+	bundlesDir := filepath.Join(dspDir, "bundles")
+	if err := os.MkdirAll(bundlesDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create bundles directory: %w", err)
+	}
+	lineage, err := ledger.LoadLineage(dspDir)
+	if err != nil {
+		return nil, err
+	}
+	b.Lineage = lineage.Stamp(b.ID, b.Repository.Name)
+	outputPath := filepath.Join(bundlesDir, fmt.Sprintf("%s.zip", b.ID))
+	if err := b.Save(ctx, outputPath); err != nil {
+		return nil, fmt.Errorf("failed to save bundle: %w", err)
+	}
+	if err := lineage.Save(dspDir); err != nil {
+		return nil, err
+	}
+	repoConfig, err := config.NewWithRepo(currentRepo.Path, currentRepo.DSPDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load repository configuration: %w", err)
+	}
+	if repoConfig.EncryptAtRest {
+		if err := bundle.Seal(outputPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return &latestBundle{path: outputPath, dspDir: dspDir, bundle: b, targetID: target}, nil
+}
+
+// recordExport remembers the bundle as the latest exported one
+func (l *latestBundle) recordExport() error {
+	data, err := yaml.Marshal(lastExport{
+		BundleID:       l.bundle.ID,
+		TargetSnapshot: l.targetID,
+		ExportedAt:     time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal last export: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(l.dspDir, lastExportFileName), data, 0644); err != nil {
+		return fmt.Errorf("failed to write last export: %w", err)
+	}
+	return nil
+}
+
+// loadLastExport returns the last bundle exported with --bundle-latest, or
+// nil if there is none
+func loadLastExport(dspDir string) (*lastExport, error) {
+	data, err := os.ReadFile(filepath.Join(dspDir, lastExportFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read last export: %w", err)
+	}
+	last := &lastExport{}
+	if err := yaml.Unmarshal(data, last); err != nil {
+		return nil, fmt.Errorf("failed to parse last export: %w", err)
+	}
+	return last, nil
+}
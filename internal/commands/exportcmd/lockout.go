@@ -0,0 +1,219 @@
+package exportcmd
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/audit"
+)
+
+// Clients failing authentication this many times in a row are locked out,
+// for lockoutBase at first and twice as long after each further failure, up
+// to lockoutMax. Failures are forgotten once a client has been quiet for
+// lockoutMax and is no longer locked out.
+const (
+	lockoutThreshold = 5
+	lockoutBase      = time.Second
+	lockoutMax       = 5 * time.Minute
+)
+
+// authFailures tracks consecutive authentication failures by client address.
+// Clients reaching banAfter failures are banned for banDuration.
+type authFailures struct {
+	mu          sync.Mutex
+	clients     map[string]*clientFailures
+	banAfter    int // 0 for no bans
+	banDuration time.Duration
+}
+
+// clientFailures are the failures of one client
+type clientFailures struct {
+	count  int
+	last   time.Time // Time of the last failure
+	until  time.Time // End of the lockout or ban
+	banned bool
+}
+
+// expired reports whether the failures of a client no longer count: its ban
+// is over, or it is not locked out and has not failed for lockoutMax
+func (c *clientFailures) expired(now time.Time) bool {
+	if now.Before(c.until) {
+		return false
+	}
+	return c.banned || now.Sub(c.last) >= lockoutMax
+}
+
+// record counts a failure of a client and returns how long it is locked out
+// for, or 0 if it is not, and whether it is banned
+func (f *authFailures) record(clientIP string) (time.Duration, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if f.clients == nil {
+		f.clients = make(map[string]*clientFailures)
+	}
+	// Forget the clients whose failures expired, so the map only holds
+	// those failing recently or still banned
+	for ip, client := range f.clients {
+		if client.expired(now) {
+			delete(f.clients, ip)
+		}
+	}
+	client := f.clients[clientIP]
+	if client == nil {
+		client = &clientFailures{}
+		f.clients[clientIP] = client
+	}
+	client.count++
+	client.last = now
+	if f.banAfter > 0 && client.count >= f.banAfter {
+		client.until = now.Add(f.banDuration)
+		client.banned = true
+		return f.banDuration, true
+	}
+	if client.count < lockoutThreshold {
+		return 0, false
+	}
+	lockout := lockoutMax
+	if shift := client.count - lockoutThreshold; shift < 32 {
+		lockout = min(lockoutBase<<shift, lockoutMax)
+	}
+	client.until = now.Add(lockout)
+	return lockout, false
+}
+
+// lockedOut returns how much longer a client is locked out or banned for,
+// or 0 if it is not, and whether it is banned
+func (f *authFailures) lockedOut(clientIP string) (time.Duration, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if client := f.clients[clientIP]; client != nil {
+		if remaining := time.Until(client.until); remaining > 0 {
+			return remaining, client.banned
+		}
+	}
+	return 0, false
+}
+
+// reset forgets the failures of a client once it authenticates
+func (f *authFailures) reset(clientIP string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.clients, clientIP)
+}
+
+// withLockout refuses requests from clients locked out or banned after
+// repeated authentication failures
+func (s *ExportServer) withLockout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Capabilities need no credentials
+		if r.URL.Path != "/capabilities" {
+			if remaining, banned := s.failures.lockedOut(requestIP(r)); remaining > 0 {
+				seconds := int(math.Ceil(remaining.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				if banned {
+					http.Error(w, fmt.Sprintf("Banned after repeated failed attempts, try again in %s", remaining.Round(time.Second)), http.StatusForbidden)
+				} else {
+					http.Error(w, fmt.Sprintf("Too many failed attempts, try again in %d seconds", seconds), http.StatusTooManyRequests)
+				}
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestIP returns the address of the client of a request
+func requestIP(r *http.Request) string {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return clientIP
+}
+
+// limitListener closes connections from clients that already hold limit
+// connections open
+type limitListener struct {
+	net.Listener
+	limit   int
+	refused func(clientIP string)
+	mu      sync.Mutex
+	open    map[string]int
+}
+
+// limitConnections caps the connections each client may hold open to the
+// server at limit. It wraps the TCP listener, below TLS or Noise.
+func (s *ExportServer) limitConnections(listener net.Listener, limit int) net.Listener {
+	return &limitListener{
+		Listener: listener,
+		limit:    limit,
+		open:     make(map[string]int),
+		refused: func(clientIP string) {
+			s.metrics.connectionsRefused.Inc()
+			audit.Record(audit.Event{
+				Type:    audit.ConnectionLimit,
+				Subject: clientIP,
+				Outcome: "refused",
+				Detail:  fmt.Sprintf("more than %d connections", limit),
+			})
+		},
+	}
+}
+
+// Accept returns the next connection of a client below the limit
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			clientIP = conn.RemoteAddr().String()
+		}
+
+		l.mu.Lock()
+		if l.open[clientIP] >= l.limit {
+			l.mu.Unlock()
+			conn.Close()
+			l.refused(clientIP)
+			continue
+		}
+		l.open[clientIP]++
+		l.mu.Unlock()
+		return &limitConn{Conn: conn, listener: l, clientIP: clientIP}, nil
+	}
+}
+
+// release counts a connection of a client as closed
+func (l *limitListener) release(clientIP string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.open[clientIP]--
+	if l.open[clientIP] <= 0 {
+		delete(l.open, clientIP)
+	}
+}
+
+// limitConn is a connection counted by a limitListener
+type limitConn struct {
+	net.Conn
+	listener  *limitListener
+	clientIP  string
+	closeOnce sync.Once
+}
+
+// Close closes the connection and releases its place
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { c.listener.release(c.clientIP) })
+	return err
+}
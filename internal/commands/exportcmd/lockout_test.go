@@ -0,0 +1,36 @@
+package exportcmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthFailuresExpire(t *testing.T) {
+	f := &authFailures{banAfter: 3, banDuration: time.Hour}
+	for i := 0; i < 3; i++ {
+		f.record("10.0.0.1")
+	}
+	if remaining, banned := f.lockedOut("10.0.0.1"); remaining == 0 || !banned {
+		t.Fatalf("client not banned after 3 failures")
+	}
+
+	// Once the ban is over, a single failure does not ban the client again
+	f.clients["10.0.0.1"].until = time.Now().Add(-time.Second)
+	if lockout, banned := f.record("10.0.0.1"); lockout != 0 || banned {
+		t.Fatalf("failure after the ban: locked out for %s, banned %v", lockout, banned)
+	}
+	if count := f.clients["10.0.0.1"].count; count != 1 {
+		t.Fatalf("failures counted after the ban: %d, want 1", count)
+	}
+
+	// Clients quiet for lockoutMax are forgotten
+	f.record("10.0.0.2")
+	f.clients["10.0.0.2"].last = time.Now().Add(-lockoutMax)
+	f.record("10.0.0.3")
+	if _, ok := f.clients["10.0.0.2"]; ok {
+		t.Fatalf("expired client kept")
+	}
+	if len(f.clients) != 2 {
+		t.Fatalf("tracking %d clients, want 2", len(f.clients))
+	}
+}
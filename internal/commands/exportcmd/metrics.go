@@ -0,0 +1,65 @@
+package exportcmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/metrics"
+)
+
+// exportMetrics are the metrics an export serves with --metrics
+type exportMetrics struct {
+	registry     *metrics.Registry
+	bytesServed  *metrics.Counter
+	downloads    *metrics.Counter
+	authFailures *metrics.Counter
+
+	connectionsRefused *metrics.Counter
+}
+
+// newMetrics registers the metrics of an export server
+func (s *ExportServer) newMetrics() *exportMetrics {
+	registry := metrics.NewRegistry()
+	m := &exportMetrics{
+		registry:     registry,
+		bytesServed:  registry.Counter("dsp_export_bytes_served_total", "Bytes of bundle data sent to importers."),
+		downloads:    registry.Counter("dsp_export_downloads_total", "Downloads started."),
+		authFailures: registry.Counter("dsp_export_auth_failures_total", "Requests refused for bad credentials or tokens."),
+
+		connectionsRefused: registry.Counter("dsp_export_connections_refused_total", "Connections refused for exceeding the per-client limit."),
+	}
+	registry.GaugeFunc("dsp_export_active_transfers", "Downloads in progress.", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(len(s.transfers))
+	})
+	registry.GaugeFunc("dsp_export_max_downloads", "Downloads allowed before the export stops (0 for no limit).", func() float64 {
+		return float64(s.maxDownloads)
+	})
+	registry.GaugeFunc("dsp_export_start_time_seconds", "Start time of the export since the Unix epoch.", func() float64 {
+		return float64(s.started.Unix())
+	})
+	return m
+}
+
+// serveMetrics serves /metrics over plain HTTP on addr, apart from the
+// bundle server so scrapers need no credentials
+func (s *ExportServer) serveMetrics(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start metrics server: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.registry.Handler())
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go server.Serve(listener)
+
+	fmt.Printf("Metrics available at http://%s/metrics\n", listener.Addr())
+	return server, nil
+}
@@ -0,0 +1,75 @@
+package exportcmd
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/crypto"
+	hostpkg "github.com/Mattddixo/dsp/internal/host"
+	"github.com/Mattddixo/dsp/internal/noise"
+)
+
+// transportNoise is the transport of exports served over Noise channels
+const transportNoise = "noise"
+
+// noiseConnKey is the context key of the Noise channel a request came in on
+type noiseConnKey struct{}
+
+// withNoiseConn records the Noise channel of a connection in the context of
+// its requests, so handlers can tell which host sent them
+func withNoiseConn(ctx context.Context, conn net.Conn) context.Context {
+	if nc, ok := conn.(*noise.Conn); ok {
+		return context.WithValue(ctx, noiseConnKey{}, nc)
+	}
+	return ctx
+}
+
+// noiseListener secures the connections of listener with Noise channels
+// keyed by this host's age key. Only trusted hosts complete the handshake.
+func (s *ExportServer) noiseListener(keyManager *crypto.KeyManager, listener net.Listener) (net.Listener, error) {
+	private, err := keyManager.X25519PrivateKey()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	static, err := noise.NewKeyPair(private)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return noise.NewListener(listener, static, s.authorizeNoisePeer), nil
+}
+
+// authorizeNoisePeer accepts the static keys of trusted hosts. Clients
+// locked out or banned after repeated failures are refused before their key
+// is looked up, and refused keys count as failures of the client's address.
+func (s *ExportServer) authorizeNoisePeer(addr net.Addr, remote []byte) error {
+	clientIP, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		clientIP = addr.String()
+	}
+	if remaining, banned := s.failures.lockedOut(clientIP); remaining > 0 {
+		if banned {
+			return fmt.Errorf("%s is banned after repeated failed attempts for another %s", clientIP, remaining.Round(time.Second))
+		}
+		return fmt.Errorf("%s is locked out after repeated failed attempts for another %s", clientIP, remaining.Round(time.Second))
+	}
+
+	hostManager, err := hostpkg.NewManager()
+	if err != nil {
+		return fmt.Errorf("failed to get host manager: %w", err)
+	}
+	peer, err := hostManager.HostByX25519Key(remote)
+	if err == nil && !peer.Trusted {
+		err = fmt.Errorf("host %s is not trusted", peer.Name)
+	}
+	if err != nil {
+		s.clientFailed(clientIP, fmt.Sprintf("noise handshake with key %s: %v", hex.EncodeToString(remote), err))
+		return err
+	}
+	s.failures.reset(clientIP)
+	return nil
+}
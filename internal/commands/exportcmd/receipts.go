@@ -0,0 +1,56 @@
+package exportcmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	hostpkg "github.com/Mattddixo/dsp/internal/host"
+	"github.com/Mattddixo/dsp/internal/receipt"
+	"github.com/Mattddixo/dsp/internal/repo"
+)
+
+// receiptDataDir returns the data directory receipts of a bundle's downloads
+// are written to: that of the repository whose bundles directory holds the
+// bundle, or the global DSP directory for bundles kept elsewhere
+func receiptDataDir(bundlePath string) (string, error) {
+	if abs, err := filepath.Abs(bundlePath); err == nil {
+		dspDir := filepath.Dir(filepath.Dir(abs))
+		if manager, err := repo.NewManager(); err == nil {
+			if r, err := manager.GetRepository(filepath.Dir(dspDir)); err == nil && r.GetDSPDir() == dspDir {
+				cfg, err := config.NewWithRepo(r.Path, r.DSPDir)
+				if err != nil {
+					return "", fmt.Errorf("failed to load repository config: %w", err)
+				}
+				return cfg.DataDirIn(r.Path), nil
+			}
+		}
+	}
+	return config.GlobalDir()
+}
+
+// writeReceipt records a completed download of the bundle. Receipts never
+// fail the download; a failure to write one is reported on stderr.
+func (s *ExportServer) writeReceipt(clientIP, user, transferHash string, size int64, started time.Time) {
+	r := &receipt.Receipt{
+		Direction:    receipt.Sent,
+		BundleID:     s.exportInfo.BundleID,
+		BundleHash:   s.bundleHash,
+		TransferHash: transferHash,
+		Bytes:        size,
+		Peer:         clientIP,
+		PeerUser:     user,
+		Started:      started,
+		Completed:    time.Now(),
+	}
+	if hostManager, err := hostpkg.NewManager(); err == nil {
+		if h, err := hostManager.GetHost(clientIP); err == nil {
+			r.PeerHost = h.Name
+		}
+	}
+	if err := receipt.Write(s.receiptDir, r); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write receipt: %v\n", err)
+	}
+}
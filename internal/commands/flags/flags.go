@@ -52,3 +52,9 @@ var DryRunFlag = &cli.BoolFlag{
 	Aliases: []string{"n"},
 	Usage:   "Show what would be done without making changes",
 }
+
+// NoHooksFlag skips repository hooks for the operation
+var NoHooksFlag = &cli.BoolFlag{
+	Name:  "no-hooks",
+	Usage: "Do not run repository hooks (scripts in <dsp-dir>/hooks)",
+}
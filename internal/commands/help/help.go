@@ -26,11 +26,9 @@ USAGE:
      {{join .Names ", "}}{{"\t"}}{{.Usage}}{{end}}
 {{end}}{{end}}
 
-{{if .VisibleFlags}}OPTIONS:{{range .VisibleFlagCategories}}
-{{if .Name}}
-   {{.Name}}:{{end}}{{range .VisibleFlags}}
+{{if .VisibleFlags}}GLOBAL OPTIONS:{{range .VisibleFlags}}
    {{.String}}{{end}}
-{{end}}{{end}}
+{{end}}
 
 {{if .Copyright}}COPYRIGHT:
    {{.Copyright}}{{end}}
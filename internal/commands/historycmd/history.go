@@ -2,17 +2,39 @@ package historycmd
 
 import (
 	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/Mattddixo/dsp/internal/commands/common"
+	"github.com/Mattddixo/dsp/config"
 	"github.com/Mattddixo/dsp/internal/commands/flags"
+	"github.com/Mattddixo/dsp/internal/ledger"
+	"github.com/Mattddixo/dsp/internal/receipt"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/snapshot"
 	"github.com/urfave/cli/v2"
 )
 
 var Command = &cli.Command{
 	Name:  "history",
-	Usage: "Show the history of snapshots",
+	Usage: "Show the history of snapshots and applied bundles",
 	Description: `Show the history of snapshots in the repository.
-This will display a list of all snapshots with their timestamps and messages.`,
+This will display a list of all snapshots with their timestamps and messages,
+together with the bundles applied to the repository (from <dsp-dir>/applied.yaml)
+and the receipts of bundles exported from and imported into it (from
+<data-dir>/receipts), newest first.
+
+Receipts are signed by the host that wrote them when the transfer completed.
+Their signatures are checked when they are shown; with --full the hashes and
+the signing key fingerprint are shown as well.
+
+Examples:
+  # Show history
+  dsp history
+
+  # Include the files changed by each snapshot
+  dsp history --full`,
 	Flags: []cli.Flag{
 		flags.VerboseFlag,
 		flags.QuietFlag,
@@ -22,19 +44,34 @@ This will display a list of all snapshots with their timestamps and messages.`,
 			Usage:   "Show full history including file changes",
 			Value:   false,
 		},
+		&cli.StringFlag{
+			Name:    "repo",
+			Aliases: []string{"r"},
+			Usage:   "Path to the repository (default: nearest repository)",
+		},
 	},
 	Action: func(c *cli.Context) error {
-		// Get config - will be used when implementing history logic
-		cfg, err := common.GetConfig(c)
-		if err != nil {
-			return fmt.Errorf("failed to get config: %w", err)
-		}
-		_ = cfg // TODO: Use cfg when implementing history logic
-
 		verbose := c.Bool("verbose")
 		quiet := c.Bool("quiet")
 		full := c.Bool("full")
 
+		if quiet {
+			return nil
+		}
+
+		// Create repository manager
+		manager, err := repo.NewManager()
+		if err != nil {
+			return fmt.Errorf("failed to create repository manager: %w", err)
+		}
+
+		// Get current repository context
+		currentRepo, err := manager.GetCurrentRepo(c.String("repo"))
+		if err != nil {
+			return fmt.Errorf("failed to get repository context: %w", err)
+		}
+		dspDir := filepath.Join(currentRepo.Path, currentRepo.DSPDir)
+
 		if verbose {
 			fmt.Println("Reading snapshot history...")
 			if full {
@@ -42,17 +79,175 @@ This will display a list of all snapshots with their timestamps and messages.`,
 			}
 		}
 
-		// TODO: Implement history logic using cfg
-		// This would involve:
-		// 1. Reading the snapshots directory
-		// 2. Reading metadata for each snapshot
-		// 3. Displaying history information
-		// 4. Optionally showing file changes
+		// Collect snapshots
+		entries, err := snapshot.List(dspDir)
+		if err != nil {
+			return fmt.Errorf("failed to list snapshots: %w", err)
+		}
+		var events []event
+		for i, entry := range entries {
+			snap := entry.Snapshot
+			ev := event{
+				time: snap.Timestamp,
+				kind: "snapshot",
+				text: fmt.Sprintf("%s  %s (%s, %d files)", entry.ID, snap.Message, snap.User, snap.Stats.TotalFiles),
+			}
+			if full {
+				var prev *snapshot.Snapshot
+				if i > 0 {
+					prev = entries[i-1].Snapshot
+				}
+				ev.details = fileChanges(prev, snap, currentRepo.Path)
+			}
+			events = append(events, ev)
+		}
 
-		if !quiet {
-			fmt.Println("History functionality not yet implemented")
+		// Collect applied bundles
+		applied, err := ledger.Load(dspDir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range applied.Entries {
+			kind := "apply"
+			if entry.Result == ledger.ResultUndone {
+				kind = "undo"
+			}
+			events = append(events, event{
+				time: entry.AppliedAt,
+				kind: kind,
+				text: describeApply(entry),
+			})
+		}
+
+		// Collect transfer receipts
+		repoConfig, err := config.NewWithRepo(currentRepo.Path, currentRepo.DSPDir)
+		if err != nil {
+			return fmt.Errorf("failed to load repository configuration: %w", err)
+		}
+		receipts, err := receipt.List(repoConfig.DataDirIn(currentRepo.Path))
+		if err != nil {
+			return err
+		}
+		for _, r := range receipts {
+			text, details := describeReceipt(r)
+			ev := event{time: r.Completed, kind: r.Direction, text: text}
+			if full {
+				ev.details = details
+			}
+			events = append(events, ev)
+		}
+
+		if len(events) == 0 {
+			fmt.Println("No history yet")
+			return nil
+		}
+
+		// Print newest first
+		sort.SliceStable(events, func(i, j int) bool { return events[i].time.After(events[j].time) })
+		for _, ev := range events {
+			fmt.Printf("%s  %-8s  %s\n", ev.time.Local().Format("2006-01-02 15:04:05"), ev.kind, ev.text)
+			for _, line := range ev.details {
+				fmt.Printf("    %s\n", line)
+			}
 		}
 
 		return nil
 	},
 }
+
+// event is a single line in the history
+type event struct {
+	time    time.Time
+	kind    string
+	text    string
+	details []string
+}
+
+// describeApply returns the history text for a ledger entry
+func describeApply(entry ledger.Entry) string {
+	if entry.Result == ledger.ResultUndone {
+		return fmt.Sprintf("bundle %s undone by %s (%d files restored)", entry.BundleID, entry.AppliedBy, entry.Applied)
+	}
+
+	text := fmt.Sprintf("bundle %s", entry.BundleID)
+	if entry.SourceRepo != "" {
+		text += " from " + entry.SourceRepo
+	}
+	text += fmt.Sprintf(" by %s: %s (%d applied", entry.AppliedBy, entry.Result, entry.Applied)
+	if entry.Conflicts > 0 {
+		text += fmt.Sprintf(", %d conflicts", entry.Conflicts)
+	}
+	if entry.Deferred > 0 {
+		text += fmt.Sprintf(", %d deferred", entry.Deferred)
+	}
+	if entry.Failed > 0 {
+		text += fmt.Sprintf(", %d failed", entry.Failed)
+	}
+	return text + ")"
+}
+
+// describeReceipt returns the history text of a transfer receipt and the
+// details shown with --full
+func describeReceipt(r *receipt.Receipt) (string, []string) {
+	peer := r.Peer
+	if r.PeerHost != "" && r.PeerHost != r.Peer {
+		peer = fmt.Sprintf("%s (%s)", r.PeerHost, r.Peer)
+	}
+	if r.PeerUser != "" {
+		peer = r.PeerUser + "@" + peer
+	}
+	direction := "to"
+	if r.Direction == receipt.Received {
+		direction = "from"
+	}
+
+	fingerprint, err := r.Verify()
+	signature := "signed"
+	if r.Signature == "" {
+		signature = "unsigned"
+	} else if err != nil {
+		signature = "INVALID SIGNATURE"
+	}
+	text := fmt.Sprintf("bundle %s %s %s by %s (%d bytes, %s)", r.BundleID, direction, peer, r.User, r.Bytes, signature)
+
+	details := []string{
+		"bundle sha256:   " + r.BundleHash,
+		"transfer sha256: " + r.TransferHash,
+	}
+	if r.PeerCert != "" {
+		details = append(details, "peer cert:       "+r.PeerCert)
+	}
+	switch {
+	case fingerprint != "":
+		details = append(details, "signing key:     "+fingerprint)
+	case r.Signature != "":
+		details = append(details, "signature:       "+err.Error())
+	}
+	details = append(details, "receipt:         "+r.Path())
+	return text, details
+}
+
+// fileChanges lists the files changed between two snapshots. A nil previous
+// snapshot lists every file as added.
+func fileChanges(prev, snap *snapshot.Snapshot, repoRoot string) []string {
+	relative := func(path string) string {
+		rel, err := filepath.Rel(repoRoot, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return path
+		}
+		return filepath.ToSlash(rel)
+	}
+
+	var lines []string
+	for _, c := range snapshot.Compare(prev, snap) {
+		switch {
+		case c.Old == nil:
+			lines = append(lines, "A "+relative(c.Path()))
+		case c.New == nil:
+			lines = append(lines, "D "+relative(c.Path()))
+		default:
+			lines = append(lines, "M "+relative(c.Path()))
+		}
+	}
+	return lines
+}
@@ -0,0 +1,303 @@
+package hostcmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/internal/host"
+	"github.com/urfave/cli/v2"
+)
+
+// Conflict policies for host import
+const (
+	conflictAsk     = "ask"
+	conflictKeep    = "keep"
+	conflictReplace = "replace"
+)
+
+var exportCommand = &cli.Command{
+	Name:      "export",
+	Usage:     "Export hosts to a signed archive",
+	ArgsUsage: "[host|group...]",
+	Description: `Export known hosts and groups to a tar archive signed with this machine's
+signing key, so another machine can inherit them with 'dsp host import'.
+The archive holds public and signing keys, certificate fingerprints, tags,
+aliases and trust; it holds no private keys.
+
+With no arguments every host and group is exported.
+
+Examples:
+  # Export everything
+  dsp host export --output hosts.tar
+
+  # Export one group
+  dsp host export --output field-team.tar field-team`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Archive file path",
+			Value:   "hosts.tar",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		manager, err := host.NewManager()
+		if err != nil {
+			return fmt.Errorf("failed to create host manager: %w", err)
+		}
+
+		archive, err := manager.NewArchive(c.Args().Slice())
+		if err != nil {
+			return fmt.Errorf("failed to collect hosts: %w", err)
+		}
+		if len(archive.Hosts) == 0 {
+			return fmt.Errorf("no hosts to export")
+		}
+
+		keyManager, err := crypto.NewKeyManager()
+		if err != nil {
+			return fmt.Errorf("failed to create key manager: %w", err)
+		}
+
+		output := c.String("output")
+		if err := host.WriteArchive(output, archive, keyManager); err != nil {
+			return err
+		}
+
+		signer, err := keyManager.GetSigningPublicKey()
+		if err != nil {
+			return err
+		}
+		fingerprint, err := crypto.SigningKeyFingerprint(signer)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Exported %d hosts and %d groups to %s\n", len(archive.Hosts), len(archive.Groups), output)
+		fmt.Printf("Signed by key %s\n", fingerprint)
+		return nil
+	},
+}
+
+var importCommand = &cli.Command{
+	Name:      "import",
+	Usage:     "Import hosts from a signed archive",
+	ArgsUsage: "<archive>",
+	Description: `Import hosts and groups from an archive written by 'dsp host export'.
+
+The archive signature is verified and the fingerprint of the signing key is
+shown for confirmation; compare it with the one printed by the export. New
+hosts are added as they were on the exporting machine, including trust.
+Hosts that already exist with the same key get any new tags, and fill in a
+missing alias, description, signing key or certificate. Hosts whose key,
+signing key or certificate differs are conflicts: you are asked whether to
+replace each one, unless --on-conflict says otherwise. Groups are created or
+extended.
+
+Examples:
+  # Import on a new machine
+  dsp host import hosts.tar
+
+  # Import without prompts, keeping local entries on conflict
+  dsp host import --yes --on-conflict keep hosts.tar`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "yes",
+			Aliases: []string{"y"},
+			Usage:   "Accept the archive signer without asking",
+		},
+		&cli.StringFlag{
+			Name:  "on-conflict",
+			Usage: "What to do when a host's key differs: ask, keep or replace",
+			Value: conflictAsk,
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return fmt.Errorf("expected exactly one archive argument")
+		}
+		policy := c.String("on-conflict")
+		if policy != conflictAsk && policy != conflictKeep && policy != conflictReplace {
+			return fmt.Errorf("invalid --on-conflict value %q: use ask, keep or replace", policy)
+		}
+
+		archive, fingerprint, err := host.ReadArchive(c.Args().First())
+		if err != nil {
+			return err
+		}
+
+		manager, err := host.NewManager()
+		if err != nil {
+			return fmt.Errorf("failed to create host manager: %w", err)
+		}
+
+		// Confirm the signer
+		reader := bufio.NewReader(os.Stdin)
+		fmt.Printf("Archive from %s, created %s\n", archive.CreatedBy, archive.CreatedAt.Local().Format("2006-01-02 15:04:05"))
+		fmt.Printf("Signed by key %s\n", fingerprint)
+		fmt.Printf("Contains %d hosts and %d groups\n", len(archive.Hosts), len(archive.Groups))
+		if !c.Bool("yes") && !confirm(reader, "Import hosts from this archive?") {
+			return fmt.Errorf("import cancelled")
+		}
+
+		// Merge hosts
+		var added, updated, replaced, kept int
+		for _, h := range archive.Hosts {
+			outcome, err := importHost(manager, h, policy, reader)
+			if err != nil {
+				return err
+			}
+			switch outcome {
+			case "added":
+				added++
+			case "updated":
+				updated++
+			case "replaced":
+				replaced++
+			case "kept":
+				kept++
+			}
+		}
+
+		// Merge groups, limited to hosts that exist here
+		for _, g := range archive.Groups {
+			var members []string
+			for _, member := range g.Members {
+				if _, err := manager.GetHost(member); err == nil {
+					members = append(members, member)
+				}
+			}
+			if _, err := manager.GetGroup(g.Name); err == nil {
+				if len(members) > 0 {
+					if err := manager.AddToGroup(g.Name, members); err != nil {
+						return fmt.Errorf("failed to update group %s: %w", g.Name, err)
+					}
+				}
+				continue
+			}
+			if _, err := manager.CreateGroup(g.Name, members); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: skipped group %s: %v\n", g.Name, err)
+			}
+		}
+
+		fmt.Printf("Imported hosts: %d added, %d updated, %d replaced, %d kept\n", added, updated, replaced, kept)
+		return nil
+	},
+}
+
+// importHost merges one archived host and returns what happened to it
+func importHost(manager *host.Manager, h *host.Host, policy string, reader *bufio.Reader) (string, error) {
+	existing, err := manager.GetHost(h.Name)
+	if err != nil {
+		// Aliases must stay unique
+		if h.Alias != "" {
+			if _, err := manager.GetHostByAlias(h.Alias); err == nil {
+				fmt.Fprintf(os.Stderr, "Warning: alias %s of host %s is already in use; importing without it\n", h.Alias, h.Name)
+				h.Alias = ""
+			}
+		}
+		if err := manager.AddHost(h); err != nil {
+			return "", fmt.Errorf("failed to add host %s: %w", h.Name, err)
+		}
+		return "added", nil
+	}
+
+	if hostConflict(existing, h) {
+		replace := policy == conflictReplace
+		if policy == conflictAsk {
+			fmt.Printf("\nHost %s differs from the local entry:\n", h.Name)
+			fmt.Printf("  local key:    %s\n", host.NormalizeKey(existing.PublicKey))
+			fmt.Printf("  archived key: %s\n", host.NormalizeKey(h.PublicKey))
+			if existing.CertInfo != nil && h.CertInfo != nil && existing.CertInfo.Fingerprint != h.CertInfo.Fingerprint {
+				fmt.Printf("  local certificate:    %s\n", existing.CertInfo.Fingerprint)
+				fmt.Printf("  archived certificate: %s\n", h.CertInfo.Fingerprint)
+			}
+			replace = confirm(reader, "Replace the local entry?")
+		}
+		if !replace {
+			return "kept", nil
+		}
+
+		// Keep the local alias if the archived one is taken by another host
+		if h.Alias != "" {
+			if other, err := manager.GetHostByAlias(h.Alias); err == nil && other.Name != h.Name {
+				h.Alias = existing.Alias
+			}
+		}
+		h.AddedAt = existing.AddedAt
+		if err := manager.UpdateHost(h); err != nil {
+			return "", fmt.Errorf("failed to replace host %s: %w", h.Name, err)
+		}
+		return "replaced", nil
+	}
+
+	// Same host: merge tags and fill in missing details
+	changed := false
+	for _, tag := range h.Tags {
+		found := false
+		for _, t := range existing.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			existing.Tags = append(existing.Tags, tag)
+			changed = true
+		}
+	}
+	if existing.Description == "" && h.Description != "" {
+		existing.Description = h.Description
+		changed = true
+	}
+	if existing.Alias == "" && h.Alias != "" {
+		if _, err := manager.GetHostByAlias(h.Alias); err != nil {
+			existing.Alias = h.Alias
+			changed = true
+		}
+	}
+	if existing.CertInfo == nil && h.CertInfo != nil {
+		existing.CertInfo = h.CertInfo
+		changed = true
+	}
+	if existing.ClientCert == "" && h.ClientCert != "" {
+		existing.ClientCert = h.ClientCert
+		changed = true
+	}
+	if existing.SigningKey == "" && h.SigningKey != "" {
+		existing.SigningKey = h.SigningKey
+		changed = true
+	}
+	if !changed {
+		return "unchanged", nil
+	}
+	if err := manager.UpdateHost(existing); err != nil {
+		return "", fmt.Errorf("failed to update host %s: %w", h.Name, err)
+	}
+	return "updated", nil
+}
+
+// hostConflict reports whether an archived host has a different key or
+// certificate than the local entry of the same name
+func hostConflict(local, archived *host.Host) bool {
+	if host.NormalizeKey(local.PublicKey) != host.NormalizeKey(archived.PublicKey) {
+		return true
+	}
+	if local.SigningKey != "" && archived.SigningKey != "" &&
+		strings.TrimSpace(local.SigningKey) != strings.TrimSpace(archived.SigningKey) {
+		return true
+	}
+	return local.CertInfo != nil && archived.CertInfo != nil &&
+		local.CertInfo.Fingerprint != archived.CertInfo.Fingerprint
+}
+
+// confirm asks a yes/no question, defaulting to no
+func confirm(reader *bufio.Reader, question string) bool {
+	fmt.Printf("%s (y/N) ", question)
+	response, _ := reader.ReadString('\n')
+	response = strings.TrimSpace(strings.ToLower(response))
+	return response == "y" || response == "yes"
+}
@@ -0,0 +1,87 @@
+package hostcmd
+
+import (
+	"fmt"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/host"
+	"github.com/urfave/cli/v2"
+)
+
+var checkCommand = &cli.Command{
+	Name:  "check",
+	Usage: "Check hosts for expiring certificates, stale entries and bad keys",
+	Description: `Check every known host and report:
+
+  - pinned certificates that have expired or expire within --days
+  - hosts that have not been used for --stale-days
+  - hosts without a public key, or with a key that cannot be parsed
+
+Expired certificates and invalid keys are errors; the rest are warnings.
+The command fails if any error is found, so it can be run from cron or CI.
+
+The default for --days is cert_expiry_warning_days from the global
+configuration (~/.dsp-global/config.yaml), which export and import also use
+to warn about expiring certificates.
+
+Examples:
+  # Check all hosts
+  dsp host check
+
+  # Warn about certificates expiring within two weeks, ignore stale hosts
+  dsp host check --days 14 --stale-days 0`,
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "days",
+			Usage: "Warn about certificates expiring within this many days (default from global config)",
+		},
+		&cli.IntFlag{
+			Name:  "stale-days",
+			Usage: "Warn about hosts not used for this many days (0 disables)",
+			Value: config.DefaultStaleHostDays,
+		},
+	},
+	Action: func(c *cli.Context) error {
+		globalConfig, err := config.LoadGlobal()
+		if err != nil {
+			return err
+		}
+		days := globalConfig.GetCertExpiryWarningDays()
+		if c.IsSet("days") {
+			days = c.Int("days")
+		}
+
+		manager, err := host.NewManager()
+		if err != nil {
+			return fmt.Errorf("failed to create host manager: %w", err)
+		}
+
+		hosts := manager.ListHosts()
+		if len(hosts) == 0 {
+			fmt.Println("No hosts found.")
+			return nil
+		}
+
+		issues := manager.Check(host.CheckOptions{
+			ExpiryDays: days,
+			StaleDays:  c.Int("stale-days"),
+		})
+		if len(issues) == 0 {
+			fmt.Printf("Checked %d hosts: no problems found\n", len(hosts))
+			return nil
+		}
+
+		errors := 0
+		for _, issue := range issues {
+			if issue.Severity == host.SeverityError {
+				errors++
+			}
+			fmt.Printf("%-7s %s: %s\n", issue.Severity, issue.Host, issue.Message)
+		}
+		fmt.Printf("\nChecked %d hosts: %d errors, %d warnings\n", len(hosts), errors, len(issues)-errors)
+		if errors > 0 {
+			return fmt.Errorf("host check found %d errors", errors)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,193 @@
+package hostcmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/commands/flags"
+	"github.com/Mattddixo/dsp/internal/host"
+	"github.com/urfave/cli/v2"
+)
+
+var groupCommand = &cli.Command{
+	Name:  "group",
+	Usage: "Manage host groups",
+	Description: `Manage named groups of hosts.
+
+A group can be used anywhere a host is expected: to encrypt a bundle for every
+member (dsp bundle --to <group>, dsp export --to <group>) or to trust, untrust,
+tag or untag all members at once. Groups are stored in the hosts directory
+under groups/.
+
+Examples:
+  # Create a group
+  dsp host group create field-team alice bob
+
+  # Add and remove members
+  dsp host group add field-team carol
+  dsp host group remove field-team bob
+
+  # Trust every member of a group
+  dsp host trust field-team`,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "create",
+			Usage:     "Create a group",
+			ArgsUsage: "<group> [host...]",
+			Action: func(c *cli.Context) error {
+				if c.NArg() < 1 {
+					return fmt.Errorf("expected a group name and optional hosts")
+				}
+
+				manager, err := host.NewManager()
+				if err != nil {
+					return fmt.Errorf("failed to create host manager: %w", err)
+				}
+
+				group, err := manager.CreateGroup(c.Args().First(), c.Args().Tail())
+				if err != nil {
+					return fmt.Errorf("failed to create group: %w", err)
+				}
+
+				fmt.Printf("Created group '%s' with %d hosts\n", group.Name, len(group.Members))
+				return nil
+			},
+		},
+		{
+			Name:      "delete",
+			Usage:     "Delete a group (its hosts are kept)",
+			ArgsUsage: "<group>",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return fmt.Errorf("expected exactly one group argument")
+				}
+
+				manager, err := host.NewManager()
+				if err != nil {
+					return fmt.Errorf("failed to create host manager: %w", err)
+				}
+
+				if err := manager.DeleteGroup(c.Args().First()); err != nil {
+					return fmt.Errorf("failed to delete group: %w", err)
+				}
+
+				fmt.Printf("Deleted group '%s'\n", c.Args().First())
+				return nil
+			},
+		},
+		{
+			Name:      "add",
+			Usage:     "Add hosts to a group",
+			ArgsUsage: "<group> <host...>",
+			Action: func(c *cli.Context) error {
+				if c.NArg() < 2 {
+					return fmt.Errorf("expected group name and at least one host")
+				}
+
+				manager, err := host.NewManager()
+				if err != nil {
+					return fmt.Errorf("failed to create host manager: %w", err)
+				}
+
+				if err := manager.AddToGroup(c.Args().First(), c.Args().Tail()); err != nil {
+					return fmt.Errorf("failed to add hosts to group: %w", err)
+				}
+
+				fmt.Printf("Added hosts to group '%s': %s\n", c.Args().First(), strings.Join(c.Args().Tail(), ", "))
+				return nil
+			},
+		},
+		{
+			Name:      "remove",
+			Usage:     "Remove hosts from a group",
+			ArgsUsage: "<group> <host...>",
+			Action: func(c *cli.Context) error {
+				if c.NArg() < 2 {
+					return fmt.Errorf("expected group name and at least one host")
+				}
+
+				manager, err := host.NewManager()
+				if err != nil {
+					return fmt.Errorf("failed to create host manager: %w", err)
+				}
+
+				if err := manager.RemoveFromGroup(c.Args().First(), c.Args().Tail()); err != nil {
+					return fmt.Errorf("failed to remove hosts from group: %w", err)
+				}
+
+				fmt.Printf("Removed hosts from group '%s': %s\n", c.Args().First(), strings.Join(c.Args().Tail(), ", "))
+				return nil
+			},
+		},
+		{
+			Name:  "list",
+			Usage: "List all groups",
+			Flags: []cli.Flag{
+				flags.QuietFlag,
+			},
+			Action: func(c *cli.Context) error {
+				manager, err := host.NewManager()
+				if err != nil {
+					return fmt.Errorf("failed to create host manager: %w", err)
+				}
+
+				groups := manager.ListGroups()
+				if len(groups) == 0 {
+					fmt.Println("No groups found.")
+					return nil
+				}
+				if c.Bool("quiet") {
+					return nil
+				}
+
+				fmt.Println("Groups:")
+				for _, group := range groups {
+					fmt.Printf("  %s (%d hosts)", group.Name, len(group.Members))
+					if len(group.Members) > 0 {
+						fmt.Printf(": %s", strings.Join(group.Members, ", "))
+					}
+					fmt.Println()
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "show",
+			Usage:     "Show the hosts in a group",
+			ArgsUsage: "<group>",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return fmt.Errorf("expected exactly one group argument")
+				}
+
+				manager, err := host.NewManager()
+				if err != nil {
+					return fmt.Errorf("failed to create host manager: %w", err)
+				}
+
+				group, err := manager.GetGroup(c.Args().First())
+				if err != nil {
+					return fmt.Errorf("group not found: %w", err)
+				}
+
+				fmt.Printf("Group: %s\n", group.Name)
+				fmt.Printf("Created: %s\n", group.CreatedAt.Format(time.RFC3339))
+				fmt.Printf("Hosts: %d\n", len(group.Members))
+				for _, member := range group.Members {
+					h, err := manager.GetHost(member)
+					if err != nil {
+						fmt.Printf("  %s (removed)\n", member)
+						continue
+					}
+					trusted := "untrusted"
+					if h.Trusted {
+						trusted = "trusted"
+					}
+					fmt.Printf("  %s (%s)\n", h.Name, trusted)
+				}
+				return nil
+			},
+		},
+	},
+}
@@ -2,10 +2,13 @@ package hostcmd
 
 import (
 	"fmt"
+	"os"
 	"strings"
 	"time"
 
+	"github.com/Mattddixo/dsp/internal/audit"
 	"github.com/Mattddixo/dsp/internal/commands/flags"
+	"github.com/Mattddixo/dsp/internal/crypto"
 	"github.com/Mattddixo/dsp/internal/host"
 	"github.com/urfave/cli/v2"
 )
@@ -17,7 +20,9 @@ var Command = &cli.Command{
 
 A host represents a system that can receive encrypted bundles. Each host has a public key
 that is used to encrypt bundles for that host. Hosts can be tagged and aliased for easy
-reference.
+reference. Hosts can also be collected into named groups; wherever a host
+name is accepted by trust, untrust, tag and untag, a group name applies the
+operation to every member.
 
 Commands:
   add           Add a new host
@@ -30,6 +35,10 @@ Commands:
   tag           Add tags to a host
   untag         Remove tags from a host
   alias         Set an alias for a host
+  group         Manage host groups
+  export        Export hosts to a signed archive
+  import        Import hosts from a signed archive
+  check         Check for expiring certificates, stale hosts and bad keys
 
 Examples:
   # Add a new host
@@ -50,6 +59,14 @@ Examples:
   # Trust a host
   dsp host trust "Alice's Laptop"
 
+  # Group hosts and tag the whole group
+  dsp host group create field-team alice bob
+  dsp host tag field-team field
+
+  # Copy the known hosts to a new machine
+  dsp host export --output hosts.tar
+  dsp host import hosts.tar
+
 For more information about a specific command, use:
   dsp host <command> --help`,
 	Subcommands: []*cli.Command{
@@ -59,7 +76,9 @@ For more information about a specific command, use:
 			Description: `Add a new host to the system.
 
 This command adds a new host with their public key. The host can then be used
-as a recipient for encrypted bundles.`,
+as a recipient for encrypted bundles. The host's signing public key (the
+signing.pub file in their ~/.dsp-global/keys/private) can be recorded with
+--signing-key.`,
 			Flags: []cli.Flag{
 				&cli.StringFlag{
 					Name:     "name",
@@ -71,6 +90,10 @@ as a recipient for encrypted bundles.`,
 					Usage:    "Public key of the host",
 					Required: true,
 				},
+				&cli.StringFlag{
+					Name:  "signing-key",
+					Usage: "Path to the host's signing public key (PEM)",
+				},
 				&cli.StringFlag{
 					Name:  "description",
 					Usage: "Description of the host",
@@ -105,11 +128,24 @@ as a recipient for encrypted bundles.`,
 					AddedAt:     time.Now(),
 					LastUsed:    time.Now(),
 				}
+				if path := c.String("signing-key"); path != "" {
+					data, err := os.ReadFile(path)
+					if err != nil {
+						return fmt.Errorf("failed to read signing key: %w", err)
+					}
+					if _, err := crypto.SigningKeyFingerprint(data); err != nil {
+						return fmt.Errorf("invalid signing key: %w", err)
+					}
+					h.SigningKey = string(data)
+				}
 
 				if err := manager.AddHost(h); err != nil {
 					return fmt.Errorf("failed to add host: %w", err)
 				}
 
+				if h.Trusted {
+					audit.Record(audit.Event{Type: audit.TrustChange, Subject: h.Name, Outcome: "trusted", Detail: "added with --trust"})
+				}
 				fmt.Printf("Added host '%s' successfully!\n", h.Name)
 				return nil
 			},
@@ -217,9 +253,23 @@ their public key, tags, and usage history.`,
 					fmt.Printf("Description: %s\n", h.Description)
 				}
 				fmt.Printf("Public Key: %s\n", h.PublicKey)
+				if h.SigningKey != "" {
+					if fingerprint, err := crypto.SigningKeyFingerprint([]byte(h.SigningKey)); err == nil {
+						fmt.Printf("Signing Key: %s\n", fingerprint)
+					}
+				}
+				if h.CertInfo != nil {
+					fmt.Printf("Certificate: %s (valid until %s)\n", h.CertInfo.Fingerprint, h.CertInfo.ValidTo.Format(time.RFC3339))
+				}
+				if h.ClientCert != "" {
+					fmt.Printf("Client Certificate: %s\n", h.ClientCert)
+				}
 				if len(h.Tags) > 0 {
 					fmt.Printf("Tags: %s\n", strings.Join(h.Tags, ", "))
 				}
+				if groups := manager.GroupsOf(h.Name); len(groups) > 0 {
+					fmt.Printf("Groups: %s\n", strings.Join(groups, ", "))
+				}
 				fmt.Printf("Trusted: %v\n", h.Trusted)
 				fmt.Printf("Added: %s\n", h.AddedAt.Format(time.RFC3339))
 				fmt.Printf("Last Used: %s\n", h.LastUsed.Format(time.RFC3339))
@@ -264,20 +314,23 @@ After removal, you will no longer be able to encrypt bundles for this host.`,
 					return fmt.Errorf("failed to remove host: %w", err)
 				}
 
+				audit.Record(audit.Event{Type: audit.TrustChange, Subject: h.Name, Outcome: "removed"})
 				fmt.Printf("Removed host '%s' successfully!\n", h.Name)
 				return nil
 			},
 		},
 		{
 			Name:  "trust",
-			Usage: "Trust a host",
+			Usage: "Trust hosts",
 			Description: `Mark a host as trusted.
 
 Trusted hosts are considered safe for receiving encrypted bundles.
-This is a security measure to prevent accidental sharing with untrusted hosts.`,
+This is a security measure to prevent accidental sharing with untrusted hosts.
+Give several hosts, or a group, to trust them all.`,
+			ArgsUsage: "<host|group>...",
 			Action: func(c *cli.Context) error {
-				if c.NArg() != 1 {
-					return fmt.Errorf("expected exactly one host argument")
+				if c.NArg() < 1 {
+					return fmt.Errorf("expected at least one host or group argument")
 				}
 
 				manager, err := host.NewManager()
@@ -285,35 +338,38 @@ This is a security measure to prevent accidental sharing with untrusted hosts.`,
 					return fmt.Errorf("failed to create host manager: %w", err)
 				}
 
-				// Try to get host by name or alias
-				h, err := manager.GetHost(c.Args().Get(0))
+				// Resolve hosts, aliases and groups
+				hosts, err := manager.Resolve(c.Args().Slice())
 				if err != nil {
-					// Try alias if name not found
-					h, err = manager.GetHostByAlias(c.Args().Get(0))
-					if err != nil {
-						return fmt.Errorf("host not found: %w", err)
-					}
+					return fmt.Errorf("host not found: %w", err)
 				}
 
-				h.Trusted = true
-				if err := manager.UpdateHost(h); err != nil {
-					return fmt.Errorf("failed to update host: %w", err)
+				for _, h := range hosts {
+					err := manager.Modify(h.Name, func(h *host.Host) error {
+						h.Trusted = true
+						return nil
+					})
+					if err != nil {
+						return fmt.Errorf("failed to update host: %w", err)
+					}
+					audit.Record(audit.Event{Type: audit.TrustChange, Subject: h.Name, Outcome: "trusted"})
+					fmt.Printf("Marked host '%s' as trusted\n", h.Name)
 				}
-
-				fmt.Printf("Marked host '%s' as trusted\n", h.Name)
 				return nil
 			},
 		},
 		{
 			Name:  "untrust",
-			Usage: "Untrust a host",
+			Usage: "Untrust hosts",
 			Description: `Mark a host as untrusted.
 
 Untrusted hosts will require explicit confirmation before encrypting bundles for them.
-This is a security measure to prevent accidental sharing with untrusted hosts.`,
+This is a security measure to prevent accidental sharing with untrusted hosts.
+Give several hosts, or a group, to untrust them all.`,
+			ArgsUsage: "<host|group>...",
 			Action: func(c *cli.Context) error {
-				if c.NArg() != 1 {
-					return fmt.Errorf("expected exactly one host argument")
+				if c.NArg() < 1 {
+					return fmt.Errorf("expected at least one host or group argument")
 				}
 
 				manager, err := host.NewManager()
@@ -321,22 +377,23 @@ This is a security measure to prevent accidental sharing with untrusted hosts.`,
 					return fmt.Errorf("failed to create host manager: %w", err)
 				}
 
-				// Try to get host by name or alias
-				h, err := manager.GetHost(c.Args().Get(0))
+				// Resolve hosts, aliases and groups
+				hosts, err := manager.Resolve(c.Args().Slice())
 				if err != nil {
-					// Try alias if name not found
-					h, err = manager.GetHostByAlias(c.Args().Get(0))
-					if err != nil {
-						return fmt.Errorf("host not found: %w", err)
-					}
+					return fmt.Errorf("host not found: %w", err)
 				}
 
-				h.Trusted = false
-				if err := manager.UpdateHost(h); err != nil {
-					return fmt.Errorf("failed to update host: %w", err)
+				for _, h := range hosts {
+					err := manager.Modify(h.Name, func(h *host.Host) error {
+						h.Trusted = false
+						return nil
+					})
+					if err != nil {
+						return fmt.Errorf("failed to update host: %w", err)
+					}
+					audit.Record(audit.Event{Type: audit.TrustChange, Subject: h.Name, Outcome: "untrusted"})
+					fmt.Printf("Marked host '%s' as untrusted\n", h.Name)
 				}
-
-				fmt.Printf("Marked host '%s' as untrusted\n", h.Name)
 				return nil
 			},
 		},
@@ -346,10 +403,11 @@ This is a security measure to prevent accidental sharing with untrusted hosts.`,
 			Description: `Add tags to a host.
 
 Tags can be used to organize and filter hosts. For example, you might tag
-hosts as "work" or "personal" to easily find them later.`,
+hosts as "work" or "personal" to easily find them later. Give a group name
+instead of a host to tag every member.`,
 			Action: func(c *cli.Context) error {
 				if c.NArg() < 2 {
-					return fmt.Errorf("expected host name and at least one tag")
+					return fmt.Errorf("expected host or group name and at least one tag")
 				}
 
 				manager, err := host.NewManager()
@@ -357,37 +415,37 @@ hosts as "work" or "personal" to easily find them later.`,
 					return fmt.Errorf("failed to create host manager: %w", err)
 				}
 
-				// Try to get host by name or alias
-				h, err := manager.GetHost(c.Args().Get(0))
+				// Resolve the host, or every host of a group
+				hosts, err := manager.Resolve([]string{c.Args().Get(0)})
 				if err != nil {
-					// Try alias if name not found
-					h, err = manager.GetHostByAlias(c.Args().Get(0))
-					if err != nil {
-						return fmt.Errorf("host not found: %w", err)
-					}
+					return fmt.Errorf("host not found: %w", err)
 				}
 
 				// Add new tags
 				newTags := c.Args().Tail()
-				for _, tag := range newTags {
-					// Check if tag already exists
-					found := false
-					for _, t := range h.Tags {
-						if t == tag {
-							found = true
-							break
+				for _, h := range hosts {
+					err := manager.Modify(h.Name, func(h *host.Host) error {
+						for _, tag := range newTags {
+							// Check if tag already exists
+							found := false
+							for _, t := range h.Tags {
+								if t == tag {
+									found = true
+									break
+								}
+							}
+							if !found {
+								h.Tags = append(h.Tags, tag)
+							}
 						}
+						return nil
+					})
+					if err != nil {
+						return fmt.Errorf("failed to update host: %w", err)
 					}
-					if !found {
-						h.Tags = append(h.Tags, tag)
-					}
-				}
 
-				if err := manager.UpdateHost(h); err != nil {
-					return fmt.Errorf("failed to update host: %w", err)
+					fmt.Printf("Added tags to host '%s': %s\n", h.Name, strings.Join(newTags, ", "))
 				}
-
-				fmt.Printf("Added tags to host '%s': %s\n", h.Name, strings.Join(newTags, ", "))
 				return nil
 			},
 		},
@@ -396,10 +454,10 @@ hosts as "work" or "personal" to easily find them later.`,
 			Usage: "Remove tags from a host",
 			Description: `Remove tags from a host.
 
-This command removes one or more tags from a host.`,
+This command removes one or more tags from a host, or from every member of a group.`,
 			Action: func(c *cli.Context) error {
 				if c.NArg() < 2 {
-					return fmt.Errorf("expected host name and at least one tag")
+					return fmt.Errorf("expected host or group name and at least one tag")
 				}
 
 				manager, err := host.NewManager()
@@ -407,38 +465,38 @@ This command removes one or more tags from a host.`,
 					return fmt.Errorf("failed to create host manager: %w", err)
 				}
 
-				// Try to get host by name or alias
-				h, err := manager.GetHost(c.Args().Get(0))
+				// Resolve the host, or every host of a group
+				hosts, err := manager.Resolve([]string{c.Args().Get(0)})
 				if err != nil {
-					// Try alias if name not found
-					h, err = manager.GetHostByAlias(c.Args().Get(0))
-					if err != nil {
-						return fmt.Errorf("host not found: %w", err)
-					}
+					return fmt.Errorf("host not found: %w", err)
 				}
 
 				// Remove tags
 				tagsToRemove := c.Args().Tail()
-				var newTags []string
-				for _, tag := range h.Tags {
-					keep := true
-					for _, remove := range tagsToRemove {
-						if tag == remove {
-							keep = false
-							break
+				for _, h := range hosts {
+					err := manager.Modify(h.Name, func(h *host.Host) error {
+						var newTags []string
+						for _, tag := range h.Tags {
+							keep := true
+							for _, remove := range tagsToRemove {
+								if tag == remove {
+									keep = false
+									break
+								}
+							}
+							if keep {
+								newTags = append(newTags, tag)
+							}
 						}
+						h.Tags = newTags
+						return nil
+					})
+					if err != nil {
+						return fmt.Errorf("failed to update host: %w", err)
 					}
-					if keep {
-						newTags = append(newTags, tag)
-					}
-				}
-				h.Tags = newTags
 
-				if err := manager.UpdateHost(h); err != nil {
-					return fmt.Errorf("failed to update host: %w", err)
+					fmt.Printf("Removed tags from host '%s': %s\n", h.Name, strings.Join(tagsToRemove, ", "))
 				}
-
-				fmt.Printf("Removed tags from host '%s': %s\n", h.Name, strings.Join(tagsToRemove, ", "))
 				return nil
 			},
 		},
@@ -469,19 +527,26 @@ For example, you might set "alice" as an alias for "Alice's Laptop".`,
 					}
 				}
 
-				// Check if alias is already used
-				if _, err := manager.GetHostByAlias(c.Args().Get(1)); err == nil {
-					return fmt.Errorf("alias '%s' is already in use", c.Args().Get(1))
-				}
-
-				h.Alias = c.Args().Get(1)
-				if err := manager.UpdateHost(h); err != nil {
+				alias := c.Args().Get(1)
+				err = manager.Modify(h.Name, func(h *host.Host) error {
+					// Check if alias is already used
+					if _, err := manager.GetHostByAlias(alias); err == nil {
+						return fmt.Errorf("alias '%s' is already in use", alias)
+					}
+					h.Alias = alias
+					return nil
+				})
+				if err != nil {
 					return fmt.Errorf("failed to update host: %w", err)
 				}
 
-				fmt.Printf("Set alias '%s' for host '%s'\n", h.Alias, h.Name)
+				fmt.Printf("Set alias '%s' for host '%s'\n", alias, h.Name)
 				return nil
 			},
 		},
+		groupCommand,
+		exportCommand,
+		importCommand,
+		checkCommand,
 	},
 }
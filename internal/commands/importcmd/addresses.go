@@ -0,0 +1,64 @@
+package importcmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/protocol"
+)
+
+// dialTimeout is how long to wait for each candidate address of an exporter
+const dialTimeout = 5 * time.Second
+
+// exporterAddresses lists the addresses to reach an exporter at, in order:
+// the address given on the command line, the host name the exporter
+// advertises, then its LAN addresses
+func exporterAddresses(host string, info *ExportInfo) []string {
+	_, port, err := net.SplitHostPort(host)
+	if err != nil || info.Port != 0 {
+		port = strconv.Itoa(info.Port)
+	}
+
+	candidates := []string{host}
+	if info.Host != "" {
+		candidates = append(candidates, net.JoinHostPort(info.Host, port))
+	}
+	for _, addr := range info.Addresses {
+		candidates = append(candidates, net.JoinHostPort(addr, port))
+	}
+
+	// Drop duplicates, keeping the first occurrence
+	seen := make(map[string]bool)
+	var unique []string
+	for _, addr := range candidates {
+		if !seen[addr] {
+			seen[addr] = true
+			unique = append(unique, addr)
+		}
+	}
+	return unique
+}
+
+// reachableAddress returns the first address that accepts a connection
+func reachableAddress(ctx context.Context, candidates []string) (string, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	var lastErr error
+	for _, addr := range candidates {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		conn.Close()
+		return addr, nil
+	}
+	err := fmt.Errorf("export server is not reachable at %s: %w", strings.Join(candidates, ", "), lastErr)
+	if ctx.Err() != nil {
+		return "", err
+	}
+	return "", protocol.NetworkError(err)
+}
@@ -0,0 +1,80 @@
+package importcmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/internal/eml"
+	hostpkg "github.com/Mattddixo/dsp/internal/host"
+	"github.com/Mattddixo/dsp/internal/protocol"
+)
+
+// readEMLBundle reassembles a bundle from the email messages written by
+// 'dsp bundle --format eml', decrypting it if it was encrypted for this host,
+// and saves it in dir. The messages must be signed by a trusted host, or by
+// any key if trustNew is set.
+func readEMLBundle(paths []string, dir string, trustNew bool) (string, error) {
+	payload, err := eml.Read(paths)
+	if err != nil {
+		return "", protocol.VerificationError(fmt.Errorf("failed to read bundle messages: %w", err))
+	}
+
+	// Check the signer against the host store
+	signer, err := signingHost(payload.Fingerprint)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case signer != nil && signer.Trusted:
+		fmt.Printf("Messages signed by %s\n", signer.Name)
+	case trustNew:
+		fmt.Fprintf(os.Stderr, "Warning: messages are signed by key %s, which is not a trusted host; importing because of --trust-new\n", payload.Fingerprint)
+	case signer != nil:
+		return "", protocol.AuthError(fmt.Errorf("messages are signed by %s, which is not trusted; run 'dsp host trust %s' or use --trust-new", signer.Name, signer.Name))
+	default:
+		return "", protocol.AuthError(fmt.Errorf("messages are signed by unknown key %s; add the sender as a host or use --trust-new", payload.Fingerprint))
+	}
+
+	// Decrypt copies encrypted with 'dsp bundle --to'
+	data := payload.Data
+	if strings.HasSuffix(payload.Name, ".age") {
+		keyManager, err := crypto.NewKeyManager()
+		if err != nil {
+			return "", fmt.Errorf("failed to create key manager: %w", err)
+		}
+		if data, err = keyManager.DecryptWithPrivateKey(data); err != nil {
+			return "", protocol.VerificationError(fmt.Errorf("failed to decrypt bundle: %w", err))
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create bundles directory: %w", err)
+	}
+	bundlePath := filepath.Join(dir, payload.BundleID+".zip")
+	if err := os.WriteFile(bundlePath, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to save bundle: %w", err)
+	}
+	return bundlePath, nil
+}
+
+// signingHost returns the known host with the signing key fingerprint, or
+// nil if there is none
+func signingHost(fingerprint string) (*hostpkg.Host, error) {
+	manager, err := hostpkg.NewManager()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create host manager: %w", err)
+	}
+	for _, h := range manager.ListHosts() {
+		if h.SigningKey == "" {
+			continue
+		}
+		fp, err := crypto.SigningKeyFingerprint([]byte(h.SigningKey))
+		if err == nil && fp == fingerprint {
+			return h, nil
+		}
+	}
+	return nil, nil
+}
@@ -2,6 +2,7 @@ package importcmd
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
@@ -12,14 +13,22 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/audit"
 	"github.com/Mattddixo/dsp/internal/bundle"
 	"github.com/Mattddixo/dsp/internal/crypto"
 	hostpkg "github.com/Mattddixo/dsp/internal/host"
+	"github.com/Mattddixo/dsp/internal/objects"
+	"github.com/Mattddixo/dsp/internal/protocol"
+	"github.com/Mattddixo/dsp/internal/receipt"
 	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/secret"
 	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/Mattddixo/dsp/pkg/utils"
 	"github.com/urfave/cli/v2"
 )
 
@@ -27,6 +36,7 @@ import (
 type ExportInfo struct {
 	Host            string   `json:"host"`
 	Port            int      `json:"port"`
+	Addresses       []string `json:"addresses,omitempty"` // LAN addresses of the exporter, tried in order
 	BundleID        string   `json:"bundle_id"`
 	Auth            string   `json:"auth_method"`
 	Users           []string `json:"users,omitempty"`
@@ -34,9 +44,21 @@ type ExportInfo struct {
 	Signature       string   `json:"signature"`
 	Expires         string   `json:"expires"`
 	Encrypted       bool     `json:"encrypted"`
-	Token           string   `json:"token,omitempty"`        // New field for assigned token
-	TokenExpiry     string   `json:"token_expiry,omitempty"` // New field for token expiry
+	KeyEncrypted    bool     `json:"key_encrypted,omitempty"` // Encrypted for our host key
+	Token           string   `json:"token,omitempty"`         // New field for assigned token
+	TokenExpiry     string   `json:"token_expiry,omitempty"`  // New field for token expiry
 	CertFingerprint string   `json:"cert_fingerprint"`
+	ProtocolVersion int      `json:"protocol_version,omitempty"`
+
+	// Key derivation of password encryption; exporters that do not send it
+	// use scrypt with age's default work factor
+	KDF *crypto.KDFParams `json:"kdf,omitempty"`
+
+	// Rotations of the exporter's certificate, to follow from a pinned one
+	CertRotations []crypto.CertRotation `json:"cert_rotations,omitempty"`
+
+	// Signing public key (PEM) the exporter signed the status response with
+	SigningKey string `json:"signing_key,omitempty"`
 }
 
 var Command = &cli.Command{
@@ -49,33 +71,116 @@ the source repository.
 
 Examples:
   # Import with password authentication
-  dsp import -h localhost -p "secret123" --repo my-repo --root /path/to/repo
+  dsp import -H localhost -p "secret123" --repo my-repo --root /path/to/repo
+
+  # Prompt for the password instead of giving it on the command line
+  dsp import -H localhost --repo my-repo --root /path/to/repo
 
   # Import with default repository setting
-  dsp import -h localhost -p "secret123" --repo my-repo --root /path/to/repo --default`,
+  dsp import -H localhost -p "secret123" --repo my-repo --root /path/to/repo --default
+
+  # Import from an export with user authentication, as host laptop
+  dsp import -H localhost -u laptop --repo my-repo --root /path/to/repo
+
+-u names this host to an export with user authentication ('dsp export -u')
+instead of a password: the name or alias the exporter knows this host by.
+The download is encrypted for this host's key and decrypted with it.
+
+Without -p, the password is read from the first line of standard input with
+--password-stdin, or from DSP_PASSWORD; otherwise it is asked for on the
+terminal without echo.
+
+The exporter is recorded as a host according to the trust_policy in
+~/.dsp-global/config.yaml (manual, tofu or open; default tofu). Under manual,
+a new exporter is parked as untrusted and the import stops until you run
+'dsp host trust <host>', unless --trust-new is given. Under tofu and manual,
+the exporter's certificate is pinned on first use.
+
+The download is compressed with zstd or gzip when the exporter offers one of
+the encodings given by --compression (default zstd,gzip); use
+--compression none on fast links or slow machines. --stats prints the bytes
+received, how much compression saved and the transfer rate.
+
+When --root is a repository that is already registered, the bundle is
+added to it for 'dsp apply' instead, and --repo is not needed. The importer
+then sends the hashes of the file versions and chunks it already has, from
+its object store and bundles, and an exporter that supports delta sync
+leaves those out of the download; they are filled in locally before the
+bundle is verified. Peers that sync often download little more than what
+changed. --no-delta downloads the whole bundle.
+
+The exporter signs the export information it answers with, and sends the
+public key it signed with. The signature is verified before the addresses,
+certificate fingerprint or token are used, and the key is checked against
+the one recorded for the exporter in the hosts store; a new exporter's key
+is recorded on first use, like its certificate. The export information
+printed by 'dsp export' shows the key's fingerprint for comparison.
+
+The exporter sends the SHA-256 of the bytes it serves with the download.
+The bundle is checked against it before it is decrypted or read, so a
+truncated or altered transfer is reported as such.
+
+Once the bundle is verified, a receipt of the download signed with this
+host's signing key is written to <data-dir>/receipts of the repository, with
+the exporter's address and certificate fingerprint. 'dsp history' lists it.
+
+Requests that fail on the network, or that the exporter fails with a server
+error, are retried network.retries times (default 3), waiting
+network.retry_delay (default 1s) before the first retry and twice as long
+before each next one.
+
+--noise connects over a Noise channel instead of TLS. Both sides prove
+they hold the age keys recorded in each other's hosts store, so no
+certificates are involved; the exporter must be a trusted host that
+exchanged keys with this one before, and must run 'dsp export --noise'.
+
+Bundles packaged with 'dsp bundle --format eml' are imported from their
+messages with --from-eml instead of --host and --password. Every part must
+be given; the messages must be signed by a trusted host (or use --trust-new),
+and bundles encrypted for this host are decrypted with its key.
+
+  dsp import --from-eml 20240102.zip.age.1-of-2.eml --from-eml 20240102.zip.age.2-of-2.eml \
+    --repo my-repo --root /path/to/repo
+
+Exit codes:
+  0  the import succeeded
+  1  any other error
+  3  network error: the exporter could not be reached, even after retries
+  4  authentication error: the password or token was refused, or a host is not trusted
+  5  verification error: a certificate, the export info or the bundle failed verification`,
 	Flags: []cli.Flag{
 		&cli.StringFlag{
-			Name:     "host",
-			Aliases:  []string{"H"},
-			Usage:    "Host address of the export server",
-			Required: true,
+			Name:    "host",
+			Aliases: []string{"H"},
+			Usage:   "Host address of the export server (host[:port]; the port defaults to the first of network.port_range)",
 		},
 		&cli.StringFlag{
-			Name:     "password",
-			Aliases:  []string{"p"},
-			Usage:    "Password for authentication",
-			Required: true,
+			Name:    "password",
+			Aliases: []string{"p"},
+			Usage:   "Password for authentication (mutually exclusive with -u); prefer a prompt, --password-stdin or DSP_PASSWORD",
 		},
 		&cli.StringFlag{
-			Name:     "repo",
-			Aliases:  []string{"r"},
-			Usage:    "Name for the new repository",
-			Required: true,
+			Name:    "user",
+			Aliases: []string{"u"},
+			Usage:   "User to authenticate as to an export with user authentication (mutually exclusive with -p)",
+		},
+		&cli.BoolFlag{
+			Name:  "password-stdin",
+			Usage: "Read the password from the first line of standard input",
+		},
+		&cli.StringSliceFlag{
+			Name:  "from-eml",
+			Usage: "Import from the email messages written by 'dsp bundle --format eml' instead of a server (can be repeated)",
+		},
+		&cli.StringFlag{
+			Name:    "repo",
+			Aliases: []string{"r"},
+			Usage:   "Name for the new repository",
 		},
 		&cli.StringFlag{
 			Name:     "root",
 			Aliases:  []string{"R"},
-			Usage:    "Root path for the new repository",
+			Usage:    "Root path for the new repository, or of an existing repository to import into",
 			Required: true,
 		},
 		&cli.BoolFlag{
@@ -83,14 +188,72 @@ Examples:
 			Aliases: []string{"D"},
 			Usage:   "Set as default repository",
 		},
+		&cli.BoolFlag{
+			Name:    "force",
+			Aliases: []string{"f"},
+			Usage:   "Register the new repository even if its name is taken or has disallowed characters",
+		},
+		&cli.BoolFlag{
+			Name:  "trust-new",
+			Usage: "Trust the exporter if it is a new host, even under a manual trust policy",
+		},
+		&cli.StringFlag{
+			Name:  "compression",
+			Usage: "Encodings to accept for the download, preferred first, or none",
+			Value: strings.Join(protocol.Encodings, ","),
+		},
+		&cli.BoolFlag{
+			Name:  "stats",
+			Usage: "Print the bytes received, the compression ratio and the transfer rate",
+		},
+		&cli.BoolFlag{
+			Name:  "no-delta",
+			Usage: "Download the whole bundle even into an existing repository",
+		},
+		&cli.BoolFlag{
+			Name:  "noise",
+			Usage: "Connect over a Noise channel keyed by host identities instead of TLS (the exporter must be a trusted host)",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		// Get command arguments
 		host := c.String("host")
-		password := c.String("password")
+		messages := c.StringSlice("from-eml")
+		switch {
+		case len(messages) > 0 && host != "":
+			return fmt.Errorf("--host and --from-eml cannot be combined")
+		case len(messages) == 0 && host == "":
+			return fmt.Errorf("--host is required unless --from-eml is given")
+		}
+
+		// The password comes from -p, --password-stdin, DSP_PASSWORD or a
+		// prompt, in that order. Exports with user authentication take -u
+		// instead.
+		var password string
+		user := c.String("user")
+		switch {
+		case user != "" && len(messages) > 0:
+			return fmt.Errorf("--user and --from-eml cannot be combined")
+		case user != "" && (c.String("password") != "" || c.Bool("password-stdin")):
+			return fmt.Errorf("--user and --password are mutually exclusive")
+		}
+		if len(messages) == 0 && user == "" {
+			var err error
+			password, err = secret.Password(secret.Options{Flag: c.String("password"), Stdin: c.Bool("password-stdin"), Prompt: "Password"})
+			if err != nil {
+				return err
+			}
+			if password == "" {
+				return fmt.Errorf("--password is required unless --from-eml is given (or use --password-stdin or DSP_PASSWORD)")
+			}
+		}
 		repoName := c.String("repo")
 		repoRoot := c.String("root")
 		setDefault := c.Bool("default")
+		encodings, err := protocol.ParseEncodings(c.String("compression"))
+		if err != nil {
+			return fmt.Errorf("invalid --compression: %w", err)
+		}
 
 		// Convert repository root to absolute path
 		absRepoRoot, err := filepath.Abs(repoRoot)
@@ -98,38 +261,119 @@ Examples:
 			return fmt.Errorf("failed to get absolute path: %w", err)
 		}
 
-		// Check if repository already exists
-		if repo.IsRepository(absRepoRoot) {
-			return fmt.Errorf("repository already exists at %s", absRepoRoot)
+		// Create repository manager
+		manager, err := repo.NewManager()
+		if err != nil {
+			return fmt.Errorf("failed to create repository manager: %w", err)
+		}
+
+		// Import into the registered repository at the root, or create one
+		existing, err := manager.GetRepository(absRepoRoot)
+		if err != nil {
+			if repo.IsRepository(absRepoRoot) {
+				return fmt.Errorf("repository already exists at %s", absRepoRoot)
+			}
+			if repoName == "" {
+				return fmt.Errorf("--repo is required to create a new repository")
+			}
+			existing = nil
+		}
+
+		globalConfig, err := config.LoadGlobal()
+		if err != nil {
+			return err
 		}
 
-		// Download bundle from server first to get DSP directory name
-		fmt.Printf("Downloading bundle from %s...\n", host)
 		tempDir, err := os.MkdirTemp("", "dsp-import-*")
 		if err != nil {
 			return fmt.Errorf("failed to create temp directory: %w", err)
 		}
-		defer os.RemoveAll(tempDir)
+		defer utils.RemoveTempDir(tempDir, globalConfig.SecureDelete)
+
+		// An existing repository receives the bundle directly, and only the
+		// contents it does not have yet are downloaded
+		downloadDir := tempDir
+		var store *bundle.ContentStore
+		seal := false
+		if existing != nil {
+			repoConfig, err := config.NewWithRepo(existing.Path, existing.DSPDir)
+			if err != nil {
+				return fmt.Errorf("failed to load repository config: %w", err)
+			}
+			downloadDir = existing.GetDSPDir()
+			seal = repoConfig.EncryptAtRest
+			if !c.Bool("no-delta") {
+				store = bundle.NewContentStore(repoConfig.HashAlgorithm, filepath.Join(downloadDir, "bundles"))
+				store.UseObjects(objects.ForRepo(existing.Path, repoConfig))
+				defer store.Close()
+			}
+		}
 
-		bundlePath, err := downloadBundle(host, password, tempDir)
-		if err != nil {
-			return fmt.Errorf("failed to download bundle: %w", err)
+		// Get the bundle first to learn the DSP directory name
+		var bundlePath string
+		var transfer *receipt.Receipt
+		if len(messages) > 0 {
+			fmt.Printf("Reading bundle from %d email messages...\n", len(messages))
+			bundlePath, err = readEMLBundle(messages, filepath.Join(downloadDir, "bundles"), c.Bool("trust-new"))
+			if err != nil {
+				return err
+			}
+		} else {
+			// An address without a port uses the first port of the configured range
+			if _, _, err := net.SplitHostPort(host); err != nil {
+				host = net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(globalConfig.GetDefaultPort()))
+			}
+
+			var peer *peerClient
+			if c.Bool("noise") {
+				if peer, err = noisePeer(host); err != nil {
+					return err
+				}
+			}
+
+			fmt.Printf("Downloading bundle from %s...\n", host)
+			bundlePath, transfer, err = downloadBundle(c.Context, host, password, downloadDir, globalConfig.GetTrustPolicy(), c.Bool("trust-new"), globalConfig.GetCertExpiryWarningDays(), transferOptions{
+				retry: protocol.RetryPolicy{
+					Retries: globalConfig.GetRetries(),
+					Delay:   globalConfig.GetRetryDelay(),
+				},
+				encodings:    encodings,
+				stats:        c.Bool("stats"),
+				store:        store,
+				peer:         peer,
+				user:         user,
+				secureDelete: globalConfig.SecureDelete,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to download bundle: %w", err)
+			}
 		}
 
 		// Load bundle to get DSP directory name
-		b, err := bundle.Load(bundlePath)
+		b, err := bundle.Load(c.Context, bundlePath)
 		if err != nil {
 			return fmt.Errorf("failed to load bundle: %w", err)
 		}
 
-		// Create repository manager
-		manager, err := repo.NewManager()
-		if err != nil {
-			return fmt.Errorf("failed to create repository manager: %w", err)
+		// Changes to an existing repository are applied like those of any
+		// other bundle
+		if existing != nil {
+			if seal {
+				if err := bundle.Seal(bundlePath); err != nil {
+					return err
+				}
+			}
+			writeReceipt(existing, transfer)
+			fmt.Printf("\nImport completed successfully!\n")
+			fmt.Printf("Repository: %s\n", existing.Name)
+			fmt.Printf("Bundle ID: %s\n", b.ID)
+			fmt.Printf("Changes: %d\n", len(b.Changes))
+			fmt.Printf("\nRun 'dsp apply -b %s' to apply them.\n", b.ID)
+			return nil
 		}
 
 		// Create new repository using DSP directory name from bundle
-		if err := manager.InitializeRepository(absRepoRoot, repoName, setDefault, b.Repository.DSPDir); err != nil {
+		if err := manager.InitializeRepository(absRepoRoot, repoName, setDefault, b.Repository.DSPDir, c.Bool("force")); err != nil {
 			return fmt.Errorf("failed to initialize repository: %w", err)
 		}
 
@@ -160,6 +404,7 @@ Examples:
 		if err := applyTrackedPaths(dspDirPath, b, absRepoRoot); err != nil {
 			return fmt.Errorf("failed to apply tracked paths: %w", err)
 		}
+		writeReceipt(currentRepo, transfer)
 
 		fmt.Printf("\nImport completed successfully!\n")
 		fmt.Printf("Repository: %s\n", repoName)
@@ -172,225 +417,462 @@ Examples:
 	},
 }
 
+// transferOptions control how the bundle is fetched from the exporter
+type transferOptions struct {
+	retry     protocol.RetryPolicy
+	encodings []string // Encodings accepted for the download, preferred first
+	stats     bool     // Print transfer statistics
+
+	// peer reaches the exporter over TLS, or over a Noise channel
+	peer *peerClient
+
+	// user authenticates to an export with user authentication instead of
+	// the password
+	user string
+
+	// secureDelete wipes the temporary files of the transfer before they
+	// are removed
+	secureDelete bool
+
+	// store holds the contents the importer already has. If it is set and
+	// the exporter supports it, only the missing contents are downloaded.
+	store *bundle.ContentStore
+}
+
 // downloadBundle downloads the bundle from the server
-func downloadBundle(host, password, dspDir string) (string, error) {
+func downloadBundle(ctx context.Context, host, password, dspDir, trustPolicy string, trustNew bool, certWarningDays int, opts transferOptions) (string, *receipt.Receipt, error) {
+	retry := opts.retry
 	// Create bundles directory
 	bundlesDir := filepath.Join(dspDir, "bundles")
 	if err := os.MkdirAll(bundlesDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create bundles directory: %w", err)
+		return "", nil, fmt.Errorf("failed to create bundles directory: %w", err)
+	}
+
+	// Negotiate protocol version before anything else so mismatches fail clearly
+	var caps *protocol.Capabilities
+	err := retry.Do(ctx, "capabilities request", func() (err error) {
+		caps, err = getCapabilities(ctx, host, opts.peer)
+		return err
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to negotiate protocol: %w", err)
 	}
+	version, err := protocol.NegotiateVersion(caps.Version, caps.MinVersion)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to negotiate protocol: %w", err)
+	}
+	if opts.peer == nil {
+		opts.peer = &peerClient{}
+	}
+	opts.peer.version = version
 
 	// Get export info from server
-	exportInfo, err := getExportInfo(host, password)
+	var exportInfo *ExportInfo
+	err = retry.Do(ctx, "status request", func() (err error) {
+		exportInfo, err = getExportInfo(ctx, host, password, opts.user, opts.peer, caps.Supports(protocol.FeatureSignedStatus))
+		return err
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to get export info: %w", err)
+		return "", nil, fmt.Errorf("failed to get export info: %w", err)
 	}
 
 	// Verify export info
-	if err := verifyExportInfo(exportInfo, password); err != nil {
-		return "", fmt.Errorf("invalid export info: %w", err)
+	if err := verifyExportInfo(exportInfo); err != nil {
+		return "", nil, protocol.VerificationError(fmt.Errorf("invalid export info: %w", err))
 	}
 
 	// For password auth, verify token
 	if exportInfo.Auth == "password" {
 		if exportInfo.Token == "" {
-			return "", fmt.Errorf("missing security token")
+			return "", nil, protocol.AuthError(fmt.Errorf("missing security token"))
 		}
 		expiry, err := time.Parse(time.RFC3339, exportInfo.TokenExpiry)
 		if err != nil {
-			return "", fmt.Errorf("invalid token expiry format: %w", err)
+			return "", nil, fmt.Errorf("invalid token expiry format: %w", err)
 		}
 		if time.Now().After(expiry) {
-			return "", fmt.Errorf("security token has expired")
+			return "", nil, protocol.AuthError(fmt.Errorf("security token has expired"))
 		}
 	}
 
+	// The advertised host name may not resolve, so try every address in turn
+	var addr string
+	err = retry.Do(ctx, "connection", func() (err error) {
+		addr, err = reachableAddress(ctx, exporterAddresses(host, exportInfo))
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
 	// Perform key exchange if this is a password-based transfer
-	if exportInfo.Auth == "password" {
-		if err := performKeyExchange(host, password, exportInfo); err != nil {
+	if exportInfo.Auth == "password" && caps.Supports(protocol.FeatureKeyExchange) {
+		err := retry.Do(ctx, "key exchange", func() error {
+			return performKeyExchange(ctx, host, addr, password, exportInfo, trustPolicy, trustNew, opts.peer)
+		})
+		if err != nil {
 			fmt.Printf("Warning: Key exchange failed: %v\n", err)
 			fmt.Println("Continuing with password-based transfer only...")
 		}
 	}
 
-	// Create TLS config
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true, // Required for self-signed certificates
-	}
-
-	// Create HTTPS client
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
-		},
-		Timeout: 30 * time.Minute,
-	}
+	client := opts.peer.httpClient(30 * time.Minute)
 
 	// Get host manager for certificate management
 	hostManager, err := hostpkg.NewManager()
 	if err != nil {
-		return "", fmt.Errorf("failed to create host manager: %w", err)
+		return "", nil, fmt.Errorf("failed to create host manager: %w", err)
 	}
 
-	// Get or create host entry
-	hostEntry, err := hostManager.GetHost(exportInfo.Host)
+	// Get or create the entry of the host dialed. The name the exporter
+	// reports is not trusted to pick which pinned keys are checked.
+	exporterName, _, err := net.SplitHostPort(host)
 	if err != nil {
-		// Create new host entry
+		exporterName = host
+	}
+	hostEntry, err := hostManager.FindHost(exporterName)
+	isNewHost := err != nil
+	if isNewHost {
+		// Create new host entry, trusted according to the policy
 		hostEntry = &hostpkg.Host{
-			Name:     exportInfo.Host,
-			Trusted:  true, // Start trusted by default
+			Name:     exporterName,
+			Trusted:  hostpkg.TrustsNewHost(trustPolicy, trustNew),
 			AddedAt:  time.Now(),
 			LastUsed: time.Now(),
 		}
 	}
 
-	// Create temporary file for download
-	tempFile, err := os.CreateTemp(bundlesDir, "bundle-*.tmp")
-	if err != nil {
-		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	// Refuse untrusted hosts unless the policy is open. New hosts are parked
+	// so they can be trusted with 'dsp host trust'.
+	if !hostEntry.Trusted && trustPolicy != config.TrustPolicyOpen {
+		if isNewHost {
+			if err := hostManager.AddHost(hostEntry); err != nil {
+				return "", nil, fmt.Errorf("failed to add host: %w", err)
+			}
+		}
+		return "", nil, protocol.AuthError(fmt.Errorf("host %s is not trusted; run 'dsp host trust %s' and import again, or pass --trust-new", hostEntry.Name, hostEntry.Name))
+	}
+	if warning := hostEntry.CertWarning(certWarningDays); warning != "" {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
 	}
-	tempPath := tempFile.Name()
-	defer func() {
-		tempFile.Close()
-		// Only remove temp file if we return an error
+
+	// Pin the exporter's signing key on first use, except under an open
+	// policy. getExportInfo checked it against any key already recorded.
+	if hostEntry.SigningKey == "" && exportInfo.SigningKey != "" && trustPolicy != config.TrustPolicyOpen {
+		hostEntry.SigningKey = exportInfo.SigningKey
+		if isNewHost {
+			err = hostManager.AddHost(hostEntry)
+		} else {
+			err = hostManager.UpdateHost(hostEntry)
+		}
 		if err != nil {
-			os.Remove(tempPath)
+			return "", nil, fmt.Errorf("failed to record signing key: %w", err)
 		}
-	}()
-
-	// Create URL with HTTPS
-	url := fmt.Sprintf("https://%s:%d/download", exportInfo.Host, exportInfo.Port)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		isNewHost = false
 	}
 
-	// Add authentication headers
-	req.Header.Set("X-Password", password)
-	if exportInfo.Auth == "password" {
-		req.Header.Set("X-One-Time-Token", exportInfo.Token)
-	} else {
-		// For user auth, use the password as the user identifier
-		// since we're using public key authentication
-		req.Header.Set("X-User", password)
+	// Ask for a delta bundle without the contents we already have
+	var deltaRequest []byte
+	if opts.store != nil && caps.Supports(protocol.FeatureDeltaSync) {
+		have := protocol.DeltaRequest{}
+		for hash := range opts.store.Hashes() {
+			have.Have = append(have.Have, hash)
+		}
+		if len(have.Have) > 0 {
+			if deltaRequest, err = json.Marshal(have); err != nil {
+				return "", nil, fmt.Errorf("failed to marshal delta request: %w", err)
+			}
+		}
+	}
+	var omitted string // Number of contents the exporter left out
+
+	// Receipt of the transfer, completed once the bundle is verified
+	transfer := &receipt.Receipt{
+		Direction: receipt.Received,
+		BundleID:  exportInfo.BundleID,
+		Peer:      addr,
+		PeerHost:  hostEntry.Name,
 	}
 
-	// Send request
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to download bundle: %w", err)
+	// Encrypted bundles are kept in memory, as the exporter serves them, so
+	// only the decrypted bundle is written to disk. Others are streamed to a
+	// temporary file that becomes the bundle.
+	encrypted := exportInfo.KeyEncrypted || exportInfo.Encrypted
+	var received bytes.Buffer
+	var tempFile *os.File
+	var tempPath string
+	if !encrypted {
+		tempFile, err = os.CreateTemp(bundlesDir, "bundle-*.tmp")
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to create temporary file: %w", err)
+		}
+		tempPath = tempFile.Name()
+		defer func() {
+			tempFile.Close()
+			// The temporary file is left behind only if the download failed
+			if _, err := os.Lstat(tempPath); err == nil {
+				utils.RemoveTemp(tempPath, opts.secureDelete)
+			}
+		}()
 	}
-	defer resp.Body.Close()
 
-	// Verify server certificate
-	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
-		cert := resp.TLS.PeerCertificates[0]
-		fingerprint := sha256.Sum256(cert.Raw)
-		fingerprintStr := hex.EncodeToString(fingerprint[:])
+	// Download the bundle, starting over if the connection fails
+	download := func() error {
+		out := io.Writer(&received)
+		if tempFile == nil {
+			received.Reset()
+		} else {
+			if err := tempFile.Truncate(0); err != nil {
+				return fmt.Errorf("failed to reset temporary file: %w", err)
+			}
+			if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to reset temporary file: %w", err)
+			}
+			out = tempFile
+		}
+
+		url := opts.peer.url(addr, "/download")
+		method, reqBody := http.MethodGet, io.Reader(nil)
+		if deltaRequest != nil {
+			method, reqBody = http.MethodPost, bytes.NewReader(deltaRequest)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		if deltaRequest != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		// Add authentication headers
+		opts.peer.setHeader(req.Header)
+		if exportInfo.Auth == "password" {
+			req.Header.Set("X-Password", password)
+			req.Header.Set("X-One-Time-Token", exportInfo.Token)
+		} else {
+			req.Header.Set("X-User", opts.user)
+		}
+		// Setting Accept-Encoding also stops the client from decompressing
+		// gzip by itself, so the bytes on the wire can be counted
+		if len(opts.encodings) > 0 {
+			req.Header.Set("Accept-Encoding", strings.Join(opts.encodings, ", "))
+		} else {
+			req.Header.Set("Accept-Encoding", protocol.EncodingIdentity)
+		}
+
+		// Send request
+		started := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			return requestError(ctx, "failed to download bundle", err)
+		}
+		defer resp.Body.Close()
+
+		// Verify server certificate. Over a Noise channel the handshake
+		// already proved the exporter holds its host key.
+		if !opts.peer.noiseChannel() {
+			if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+				return protocol.VerificationError(fmt.Errorf("no certificate received from server during download"))
+			}
+			cert := resp.TLS.PeerCertificates[0]
+			fingerprint := sha256.Sum256(cert.Raw)
+			fingerprintStr := hex.EncodeToString(fingerprint[:])
+
+			// Follow a rotation of the exporter's certificate, then verify
+			// against stored certificate if we have one
+			if hostEntry.FollowCertRotation(exportInfo.CertRotations, fingerprintStr, cert.NotBefore, cert.NotAfter) {
+				if err := hostManager.UpdateHost(hostEntry); err != nil {
+					return fmt.Errorf("failed to update host certificate info: %w", err)
+				}
+				audit.Record(audit.Event{Type: audit.CertRotation, Subject: hostEntry.Name, Outcome: "followed", Detail: "pinned " + fingerprintStr})
+				fmt.Fprintf(os.Stderr, "Host %s rotated its certificate; pinned the new one (%s)\n", hostEntry.Name, fingerprintStr)
+			}
+			if err := hostEntry.VerifyCertificate(fingerprintStr, cert.NotBefore, cert.NotAfter); err != nil {
+				return protocol.VerificationError(fmt.Errorf("certificate verification failed: %w", err))
+			}
 
-		// Verify against stored certificate if we have one
-		if err := hostEntry.VerifyCertificate(fingerprintStr, cert.NotBefore, cert.NotAfter); err != nil {
 			// If this is a new certificate, verify against export info
 			if hostEntry.CertInfo == nil {
 				if fingerprintStr != exportInfo.CertFingerprint {
-					return "", fmt.Errorf("certificate fingerprint mismatch with export info")
+					return protocol.VerificationError(fmt.Errorf("certificate fingerprint mismatch with export info"))
 				}
-				// Store the new certificate info
-				hostEntry.UpdateCertificate(fingerprintStr, cert.NotBefore, cert.NotAfter)
-				if err := hostManager.UpdateHost(hostEntry); err != nil {
-					return "", fmt.Errorf("failed to update host certificate info: %w", err)
+
+				// Pin the certificate on first use, except under an open policy
+				if trustPolicy != config.TrustPolicyOpen {
+					hostEntry.UpdateCertificate(fingerprintStr, cert.NotBefore, cert.NotAfter)
+					if isNewHost {
+						err = hostManager.AddHost(hostEntry)
+					} else {
+						err = hostManager.UpdateHost(hostEntry)
+					}
+					if err != nil {
+						return fmt.Errorf("failed to update host certificate info: %w", err)
+					}
+					isNewHost = false
 				}
-			} else {
-				// Certificate mismatch with stored certificate
-				return "", fmt.Errorf("certificate verification failed: %w", err)
 			}
+			transfer.PeerCert = fingerprintStr
 		}
-	} else {
-		return "", fmt.Errorf("no certificate received from server during download")
-	}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("server returned error: %s", resp.Status)
-	}
+		if err := checkResponseVersion(resp); err != nil {
+			return err
+		}
+		transfer.Started = started
 
-	// Download with progress tracking
-	contentLength := resp.ContentLength
-	var downloaded int64
-	buf := make([]byte, 32*1024) // 32KB buffer
+		if resp.StatusCode != http.StatusOK {
+			return protocol.StatusError(resp)
+		}
+		omitted = resp.Header.Get(protocol.DeltaHeader)
 
-	for {
-		nr, err := resp.Body.Read(buf)
-		if nr > 0 {
-			nw, err := tempFile.Write(buf[:nr])
-			if err != nil {
-				return "", fmt.Errorf("failed to write bundle data: %w", err)
+		// Servers that support it send the hash of the exact bytes they serve
+		wantHash := resp.Header.Get(protocol.ContentHashHeader)
+		if wantHash == "" && caps.Supports(protocol.FeatureContentHash) {
+			return protocol.VerificationError(fmt.Errorf("server did not send the hash of the bundle"))
+		}
+
+		// Decompress the body if the server compressed it. Compressed
+		// downloads carry their uncompressed size separately.
+		encoding := resp.Header.Get("Content-Encoding")
+		wire := &countingReader{r: resp.Body}
+		body, err := protocol.NewDecoder(wire, encoding)
+		if err != nil {
+			return protocol.VerificationError(fmt.Errorf("failed to read bundle data: %w", err))
+		}
+		defer body.Close()
+		contentLength := resp.ContentLength
+		if encoding != "" {
+			contentLength, _ = strconv.ParseInt(resp.Header.Get(protocol.ContentSizeHeader), 10, 64)
+		}
+
+		// Download with progress tracking, hashing the bytes as they arrive
+		var downloaded int64
+		hasher := sha256.New()
+		buf := make([]byte, 32*1024) // 32KB buffer
+
+		for {
+			nr, err := body.Read(buf)
+			if nr > 0 {
+				nw, err := out.Write(buf[:nr])
+				if err != nil {
+					return fmt.Errorf("failed to write bundle data: %w", err)
+				}
+				if nr != nw {
+					return fmt.Errorf("short write: %d != %d", nr, nw)
+				}
+				hasher.Write(buf[:nr])
+				downloaded += int64(nw)
+				if contentLength > 0 {
+					// Print progress
+					progress := float64(downloaded) / float64(contentLength) * 100
+					fmt.Printf("\rDownloading: %.1f%% (%s of %s)", progress, utils.FormatSize(downloaded), utils.FormatSize(contentLength))
+				}
 			}
-			if nr != nw {
-				return "", fmt.Errorf("short write: %d != %d", nr, nw)
+			if err == io.EOF {
+				break
 			}
-			downloaded += int64(nw)
-			if contentLength > 0 {
-				// Print progress
-				progress := float64(downloaded) / float64(contentLength) * 100
-				fmt.Printf("\rDownloading: %.1f%%", progress)
+			if err != nil {
+				if downloaded > 0 {
+					fmt.Println()
+				}
+				return requestError(ctx, "failed to read bundle data", err)
 			}
 		}
-		if err == io.EOF {
-			break
+		fmt.Println() // New line after progress
+
+		// Check the transfer before anything reads the bundle
+		if wantHash != "" {
+			if gotHash := hex.EncodeToString(hasher.Sum(nil)); !strings.EqualFold(gotHash, wantHash) {
+				return protocol.VerificationError(fmt.Errorf("downloaded bundle is corrupt: received %d bytes with SHA-256 %s, but the server sent %s", downloaded, gotHash, wantHash))
+			}
 		}
-		if err != nil {
-			return "", fmt.Errorf("failed to read bundle data: %w", err)
+
+		transfer.TransferHash = hex.EncodeToString(hasher.Sum(nil))
+		transfer.Bytes = downloaded
+
+		if opts.stats {
+			printTransferStats(encoding, wire.n, downloaded, time.Since(started))
 		}
+		return nil
 	}
-	fmt.Println() // New line after progress
-
-	// Close the temp file before reading it
-	if err := tempFile.Close(); err != nil {
-		return "", fmt.Errorf("failed to close temporary file: %w", err)
+	if err := retry.Do(ctx, "download", download); err != nil {
+		return "", nil, err
 	}
 
-	// Read the downloaded data
-	bundleData, err := os.ReadFile(tempPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to read downloaded bundle: %w", err)
+	bundlePath := filepath.Join(bundlesDir, fmt.Sprintf("%s.zip", exportInfo.BundleID))
+	if encrypted {
+		// Decrypt with the host's private key if the bundle was encrypted
+		// for it, otherwise with the password and token
+		var bundleData []byte
+		if exportInfo.KeyEncrypted {
+			keyManager, err := crypto.NewKeyManager()
+			if err != nil {
+				return "", nil, fmt.Errorf("failed to create key manager: %w", err)
+			}
+			bundleData, err = keyManager.DecryptWithPrivateKey(received.Bytes())
+			if err != nil {
+				return "", nil, protocol.VerificationError(fmt.Errorf("failed to decrypt bundle: %w", err))
+			}
+		} else {
+			bundleData, err = crypto.DecryptWithKDF(received.Bytes(), password+exportInfo.Token, exportInfo.KDF)
+			if err != nil {
+				return "", nil, protocol.VerificationError(fmt.Errorf("failed to decrypt bundle: %w", err))
+			}
+		}
+		err = os.WriteFile(bundlePath, bundleData, 0644)
+		utils.Wipe(bundleData)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to save bundle: %w", err)
+		}
+	} else {
+		if err := tempFile.Close(); err != nil {
+			return "", nil, fmt.Errorf("failed to close temporary file: %w", err)
+		}
+		if err := os.Rename(tempPath, bundlePath); err != nil {
+			return "", nil, fmt.Errorf("failed to save bundle: %w", err)
+		}
 	}
 
-	// If the bundle is encrypted (password auth), decrypt it
-	if exportInfo.Encrypted {
-		// Use combined key (password + token) for decryption
-		combinedKey := password + exportInfo.Token
-		decryptedData, err := crypto.DecryptWithPassphrase(bundleData, combinedKey)
-		if err != nil {
-			return "", fmt.Errorf("failed to decrypt bundle: %w", err)
+	// Fill in the contents a delta bundle left out from our own
+	if omitted != "" {
+		fmt.Printf("Received a delta bundle; filling in %s contents from this repository\n", omitted)
+		if err := bundle.CompleteDelta(ctx, bundlePath, opts.store); err != nil {
+			utils.RemoveTemp(bundlePath, opts.secureDelete)
+			return "", nil, fmt.Errorf("failed to complete delta bundle: %w; import again with --no-delta", err)
 		}
-		bundleData = decryptedData
 	}
 
 	// Verify bundle integrity
-	b, err := bundle.LoadFromBytes(bundleData)
-	if err != nil {
-		return "", fmt.Errorf("invalid bundle format: %w", err)
-	}
-	if err := b.Verify(); err != nil {
-		return "", fmt.Errorf("bundle verification failed: %w", err)
+	if _, err := bundle.Load(ctx, bundlePath); err != nil {
+		utils.RemoveTemp(bundlePath, opts.secureDelete)
+		return "", nil, protocol.VerificationError(fmt.Errorf("bundle verification failed: %w", err))
 	}
 
-	// Save bundle to final location
-	bundlePath := filepath.Join(bundlesDir, fmt.Sprintf("%s.json", exportInfo.BundleID))
-	if err := os.WriteFile(bundlePath, bundleData, 0644); err != nil {
-		return "", fmt.Errorf("failed to save bundle: %w", err)
+	transfer.Completed = time.Now()
+	if transfer.BundleHash, err = utils.HashFile(bundlePath, "sha256"); err != nil {
+		return "", nil, fmt.Errorf("failed to hash bundle: %w", err)
 	}
 
-	// Remove temporary file
-	if err := os.Remove(tempPath); err != nil {
-		fmt.Printf("Warning: failed to remove temporary file %s: %v\n", tempPath, err)
-	}
+	return bundlePath, transfer, nil
+}
 
-	return bundlePath, nil
+// writeReceipt records a completed download in the data directory of the
+// repository it was imported into. Receipts never fail the import; a
+// failure to write one is reported on stderr.
+func writeReceipt(r *repo.Repository, transfer *receipt.Receipt) {
+	if transfer == nil {
+		return
+	}
+	cfg, err := config.NewWithRepo(r.Path, r.DSPDir)
+	if err == nil {
+		err = receipt.Write(cfg.DataDirIn(r.Path), transfer)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write receipt: %v\n", err)
+	}
 }
 
 // performKeyExchange performs the key exchange handshake
-func performKeyExchange(host string, password string, exportInfo *ExportInfo) error {
+func performKeyExchange(ctx context.Context, host, addr, password string, exportInfo *ExportInfo, trustPolicy string, trustNew bool, peer *peerClient) error {
 	// Get our public key
 	keyManager, err := crypto.NewKeyManager()
 	if err != nil {
@@ -414,54 +896,49 @@ func performKeyExchange(host string, password string, exportInfo *ExportInfo) er
 		hostname = host // If no port, use the whole string as hostname
 	}
 
-	// Check if host already exists
-	existingHost, err := hostManager.GetHost(hostname)
+	// Prepare key exchange request
+	// Send the rotations of our certificate, so an exporter that pinned an
+	// older one as our client certificate follows them
+	certRotations, err := keyManager.CertRotations()
 	if err != nil {
-		// Host doesn't exist, create new one
-		existingHost = &hostpkg.Host{
-			Name:      hostname,
-			PublicKey: "",   // Will be set after exchange
-			Trusted:   true, // Start trusted by default
-			AddedAt:   time.Now(),
-			LastUsed:  time.Now(),
-		}
+		return err
 	}
-
-	// Prepare key exchange request
 	keyExchangeReq := struct {
-		PublicKey string `json:"public_key"`
+		PublicKey     string                `json:"public_key"`
+		CertRotations []crypto.CertRotation `json:"cert_rotations,omitempty"`
 	}{
-		PublicKey: publicKey,
+		PublicKey:     publicKey,
+		CertRotations: certRotations,
 	}
 
-	// Send key exchange request
-	url := fmt.Sprintf("http://%s:%d/key-exchange", exportInfo.Host, exportInfo.Port)
+	// Send key exchange request. The exporter pins the certificate we
+	// present as our client certificate.
+	url := peer.url(addr, "/key-exchange")
 	reqBody, err := json.Marshal(keyExchangeReq)
 	if err != nil {
 		return fmt.Errorf("failed to marshal key exchange request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBody))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
 	// Add password header
+	peer.setHeader(req.Header)
 	req.Header.Set("X-Password", password)
 	req.Header.Set("Content-Type", "application/json")
 
 	// Send request
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
+	client := peer.httpClient(30 * time.Second)
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send key exchange request: %w", err)
+		return requestError(ctx, "failed to send key exchange request", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("key exchange failed: %s", resp.Status)
+		return fmt.Errorf("key exchange failed: %w", protocol.StatusError(resp))
 	}
 
 	// Parse response
@@ -474,42 +951,51 @@ func performKeyExchange(host string, password string, exportInfo *ExportInfo) er
 		return fmt.Errorf("failed to parse key exchange response: %w", err)
 	}
 
-	// Update host information
-	existingHost.PublicKey = keyExchangeResp.PublicKey
-	existingHost.LastUsed = time.Now()
-	existingHost.IPAddress = exportInfo.Host
-	existingHost.LastPort = exportInfo.Port
-	existingHost.Trusted = true // Ensure host is trusted
-
-	// Save host information
-	if existingHost.AddedAt.IsZero() {
-		// New host
-		if err := hostManager.AddHost(existingHost); err != nil {
-			return fmt.Errorf("failed to add host: %w", err)
-		}
-		fmt.Printf("Added new host '%s'\n", hostname)
-	} else {
-		// Update existing host
-		if err := hostManager.UpdateHost(existingHost); err != nil {
-			return fmt.Errorf("failed to update host: %w", err)
-		}
-		fmt.Printf("Updated host '%s'\n", hostname)
+	// Record the exporter according to the trust policy
+	peerIP, peerPort, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(peerPort)
+	exporter, err := hostManager.RecordPeer(hostname, keyExchangeResp.PublicKey, peerIP, port, trustPolicy, trustNew)
+	if err != nil {
+		audit.Record(audit.Event{Type: audit.KeyExchange, Subject: hostname, Outcome: "refused", Detail: err.Error()})
+		return err
 	}
-
-	// Add exporter as a recipient in key manager
-	if err := keyManager.AddRecipient(hostname, keyExchangeResp.PublicKey); err != nil {
-		return fmt.Errorf("failed to add exporter as recipient: %w", err)
+	if !exporter.Trusted {
+		audit.Record(audit.Event{Type: audit.KeyExchange, Subject: hostname, Outcome: "untrusted",
+			Detail: fmt.Sprintf("exporter key %s recorded under trust policy %s", keyExchangeResp.PublicKey, trustPolicy)})
+		return protocol.AuthError(fmt.Errorf("host %s is not trusted (trust policy: %s); run 'dsp host trust %s' to use its key", hostname, trustPolicy, hostname))
 	}
 
+	audit.Record(audit.Event{Type: audit.KeyExchange, Subject: hostname, Outcome: "trusted",
+		Detail: fmt.Sprintf("exporter key %s", keyExchangeResp.PublicKey)})
 	fmt.Printf("Successfully exchanged keys with %s\n", hostname)
 	fmt.Printf("Key Exchange ID: %s\n", keyExchangeResp.KeyExchangeID)
-	fmt.Printf("Added %s as a recipient. Future transfers can use --user authentication.\n", hostname)
+	fmt.Printf("Recorded the key of host %s. Future transfers can use --user authentication.\n", hostname)
 
 	return nil
 }
 
-// getExportInfo gets the export information from the server
-func getExportInfo(host, password string) (*ExportInfo, error) {
+// clientTLSConfig returns the TLS configuration of requests to exporters.
+// Their self-signed certificates are checked against pinned fingerprints
+// rather than a CA. The local certificate is presented as the client
+// certificate, so exporters that pinned it can require mutual TLS.
+func clientTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+	if keyManager, err := crypto.NewKeyManager(); err == nil {
+		if cert, err := keyManager.GetCertificate(); err == nil {
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+	return tlsConfig
+}
+
+// getExportInfo gets the export information from the server, authenticating
+// as user if it is set and with the password otherwise.
+// Exporters that support it sign the response; the signature is verified and
+// the signing key checked against the one recorded for the host dialed before
+// any of it is used. Once a key is recorded, unsigned responses are refused.
+func getExportInfo(ctx context.Context, host, password, user string, peer *peerClient, signed bool) (*ExportInfo, error) {
 	// Parse host to get hostname and port
 	hostname, port, err := net.SplitHostPort(host)
 	if err != nil {
@@ -517,82 +1003,228 @@ func getExportInfo(host, password string) (*ExportInfo, error) {
 		port = "8080"
 	}
 
-	// Create custom TLS config that verifies the certificate
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true, // We'll verify the fingerprint manually
-	}
-
-	// Create HTTPS client
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
-		},
-	}
-
-	// Create URL with HTTPS
-	url := fmt.Sprintf("https://%s:%s/status", hostname, port)
-	req, err := http.NewRequest("GET", url, nil)
+	client := peer.httpClient(0)
+	url := peer.url(net.JoinHostPort(hostname, port), "/status")
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	// Add password header
-	req.Header.Set("X-Password", password)
+	// Add authentication header
+	peer.setHeader(req.Header)
+	if user != "" {
+		req.Header.Set("X-User", user)
+	} else {
+		req.Header.Set("X-Password", password)
+	}
 
 	// Send request
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to export server: %w", err)
+		return nil, requestError(ctx, "failed to connect to export server", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server returned error: %s", resp.Status)
+	if err := checkResponseVersion(resp); err != nil {
+		return nil, err
 	}
 
-	// Verify server certificate
-	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
-		cert := resp.TLS.PeerCertificates[0]
-		fingerprint := sha256.Sum256(cert.Raw)
-		fingerprintStr := hex.EncodeToString(fingerprint[:])
+	if resp.StatusCode != http.StatusOK {
+		return nil, protocol.StatusError(resp)
+	}
 
-		// Parse response to get expected fingerprint
-		var info ExportInfo
-		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
-			return nil, fmt.Errorf("failed to parse export info: %w", err)
+	// Parse response to get expected fingerprint
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxStatusSize))
+	if err != nil {
+		return nil, requestError(ctx, "failed to read export info", err)
+	}
+	var info ExportInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse export info: %w", err)
+	}
+	pinned, err := pinnedSigningKey(hostname)
+	if err != nil {
+		return nil, err
+	}
+	if signed || pinned != "" {
+		if err := verifyStatusSignature(&info, body, resp.Header.Get(protocol.SignatureHeader), hostname, pinned); err != nil {
+			return nil, protocol.VerificationError(err)
 		}
+	} else {
+		fmt.Fprintf(os.Stderr, "Warning: the exporter does not sign its export information\n")
+	}
 
-		// Verify fingerprint
-		if info.CertFingerprint != fingerprintStr {
-			return nil, fmt.Errorf("certificate fingerprint mismatch")
+	// Verify server certificate. Over a Noise channel the handshake
+	// already proved the exporter holds its host key.
+	if !peer.noiseChannel() {
+		if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+			return nil, protocol.VerificationError(fmt.Errorf("no certificate received from server"))
 		}
+		fingerprint := sha256.Sum256(resp.TLS.PeerCertificates[0].Raw)
+		if info.CertFingerprint != hex.EncodeToString(fingerprint[:]) {
+			return nil, protocol.VerificationError(fmt.Errorf("certificate fingerprint mismatch"))
+		}
+	}
 
-		// For password auth, verify we got a token
-		if info.Auth == "password" {
-			if info.Token == "" {
-				return nil, fmt.Errorf("server did not provide a token")
-			}
-			if info.TokenExpiry == "" {
-				return nil, fmt.Errorf("server did not provide token expiry")
-			}
-			// Verify token hasn't expired
-			expiry, err := time.Parse(time.RFC3339, info.TokenExpiry)
-			if err != nil {
-				return nil, fmt.Errorf("invalid token expiry format: %w", err)
-			}
-			if time.Now().After(expiry) {
-				return nil, fmt.Errorf("token has expired")
-			}
+	// For password auth, verify we got a token
+	if info.Auth == "password" {
+		if info.Token == "" {
+			return nil, fmt.Errorf("server did not provide a token")
+		}
+		if info.TokenExpiry == "" {
+			return nil, fmt.Errorf("server did not provide token expiry")
+		}
+		// Verify token hasn't expired
+		expiry, err := time.Parse(time.RFC3339, info.TokenExpiry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token expiry format: %w", err)
+		}
+		if time.Now().After(expiry) {
+			return nil, protocol.AuthError(fmt.Errorf("token has expired"))
 		}
+	}
+
+	return &info, nil
+}
+
+// getCapabilities asks the export server which protocol version and features it supports.
+// Servers that predate capability negotiation are treated as legacy peers.
+func getCapabilities(ctx context.Context, host string, peer *peerClient) (*protocol.Capabilities, error) {
+	// Parse host to get hostname and port
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+		port = "8080"
+	}
+
+	// The certificate is verified against the export info fingerprint later
+	client := peer.httpClient(30 * time.Second)
+	url := peer.url(net.JoinHostPort(hostname, port), "/capabilities")
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	peer.setHeader(req.Header)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, requestError(ctx, "failed to connect to export server", err)
+	}
+	defer resp.Body.Close()
+
+	// Older servers have no capabilities endpoint
+	if resp.StatusCode == http.StatusNotFound {
+		return protocol.Legacy(), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, protocol.StatusError(resp)
+	}
+
+	var caps protocol.Capabilities
+	if err := json.NewDecoder(resp.Body).Decode(&caps); err != nil {
+		return nil, fmt.Errorf("failed to parse server capabilities: %w", err)
+	}
+
+	return &caps, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
 
-		return &info, nil
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// printTransferStats prints the size of a download on the wire and once
+// decompressed, and how fast it arrived
+func printTransferStats(encoding string, wireBytes, bytes int64, elapsed time.Duration) {
+	if encoding == "" {
+		encoding = "none"
+	}
+	fmt.Printf("Transfer: %d bytes received, %d bytes of bundle (compression: %s", wireBytes, bytes, encoding)
+	if bytes > 0 && wireBytes != bytes {
+		fmt.Printf(", %.1f%% of the size", float64(wireBytes)/float64(bytes)*100)
 	}
+	fmt.Printf(") in %s", elapsed.Round(time.Millisecond))
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		fmt.Printf(", %.1f KiB/s", float64(wireBytes)/1024/seconds)
+	}
+	fmt.Println()
+}
 
-	return nil, fmt.Errorf("no certificate received from server")
+// requestError returns the error for a request that got no response. It is
+// a network error, and so retried, unless ctx was cancelled.
+func requestError(ctx context.Context, msg string, err error) error {
+	err = fmt.Errorf("%s: %w", msg, err)
+	if ctx.Err() != nil {
+		return err
+	}
+	return protocol.NetworkError(err)
+}
+
+// checkResponseVersion turns a protocol rejection from the server into a clear error
+func checkResponseVersion(resp *http.Response) error {
+	serverVersion, err := protocol.ParseVersion(resp.Header.Get(protocol.VersionHeader))
+	if err != nil {
+		return fmt.Errorf("server sent %w", err)
+	}
+	if resp.StatusCode == http.StatusUpgradeRequired {
+		return fmt.Errorf("protocol version mismatch: server speaks v%d, client v%d", serverVersion, protocol.Version)
+	}
+	return nil
+}
+
+// maxStatusSize bounds the status response read from an exporter
+const maxStatusSize = 1 << 20
+
+// pinnedSigningKey returns the signing key recorded for a host in the hosts
+// store, or "" if none is recorded
+func pinnedSigningKey(host string) (string, error) {
+	hostManager, err := hostpkg.NewManager()
+	if err != nil {
+		return "", fmt.Errorf("failed to create host manager: %w", err)
+	}
+	exporter, err := hostManager.FindHost(host)
+	if err != nil {
+		return "", nil
+	}
+	return exporter.SigningKey, nil
+}
+
+// verifyStatusSignature checks the signature of a status response with the
+// signing key it carries, and that key against pinned, the one recorded for
+// the host dialed, if there is one
+func verifyStatusSignature(info *ExportInfo, body []byte, signature, host, pinned string) error {
+	if signature == "" || info.SigningKey == "" {
+		if pinned != "" {
+			return fmt.Errorf("export information from host %s is not signed, but a signing key is recorded for it", host)
+		}
+		return fmt.Errorf("export information is not signed")
+	}
+	if err := crypto.VerifyData([]byte(info.SigningKey), body, signature); err != nil {
+		return fmt.Errorf("export information signature: %w", err)
+	}
+	fingerprint, err := crypto.SigningKeyFingerprint([]byte(info.SigningKey))
+	if err != nil {
+		return fmt.Errorf("invalid signing key in export information: %w", err)
+	}
+
+	if pinned != "" {
+		recorded, err := crypto.SigningKeyFingerprint([]byte(pinned))
+		if err != nil || recorded != fingerprint {
+			return fmt.Errorf("signing key of host %s (%s) does not match the one recorded for it; if it changed, run 'dsp host remove %s' and import again", host, fingerprint, host)
+		}
+	}
+	return nil
 }
 
 // verifyExportInfo verifies the export information
-func verifyExportInfo(info *ExportInfo, password string) error {
+func verifyExportInfo(info *ExportInfo) error {
 	// Check expiration
 	expires, err := time.Parse(time.RFC3339, info.Expires)
 	if err != nil {
@@ -602,16 +1234,16 @@ func verifyExportInfo(info *ExportInfo, password string) error {
 		return fmt.Errorf("export has expired")
 	}
 
-	// Verify authentication method
-	if info.Auth != "password" {
+	// Verify authentication method. User auth has no token; downloads are
+	// encrypted for the importer's host key instead.
+	switch info.Auth {
+	case "user":
+		return nil
+	case "password":
+	default:
 		return fmt.Errorf("unsupported authentication method: %s", info.Auth)
 	}
 
-	// Verify password
-	if info.Password != password {
-		return fmt.Errorf("invalid password")
-	}
-
 	// Verify token exists and hasn't expired
 	if info.Token == "" {
 		return fmt.Errorf("missing security token")
@@ -646,6 +1278,11 @@ func updateRepositoryConfig(dspDir string, b *bundle.Bundle) error {
 		return fmt.Errorf("failed to save config: %w", err)
 	}
 
+	// The sender's hash key is not part of the bundle
+	if cfg.HashAlgorithm == utils.KeyedBlake3 {
+		fmt.Fprintf(os.Stderr, "Warning: the repository uses keyed hashes; set the sender's key with 'dsp config hash-key --set <key>' before applying bundles\n")
+	}
+
 	return nil
 }
 
@@ -0,0 +1,104 @@
+package importcmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/crypto"
+	hostpkg "github.com/Mattddixo/dsp/internal/host"
+	"github.com/Mattddixo/dsp/internal/noise"
+	"github.com/Mattddixo/dsp/internal/protocol"
+)
+
+// peerClient makes requests to an exporter: over TLS, checking pinned
+// certificates, or over a Noise channel keyed by the host identities of
+// both sides. A nil peerClient uses TLS.
+type peerClient struct {
+	dialer  *noise.Dialer // Set for a Noise channel
+	version int           // Protocol version negotiated with the exporter, 0 before negotiation
+}
+
+// noiseChannel reports whether requests go over a Noise channel, which
+// proves the exporter's identity without certificates
+func (p *peerClient) noiseChannel() bool {
+	return p != nil && p.dialer != nil
+}
+
+// httpClient returns an HTTP client for requests to the exporter
+func (p *peerClient) httpClient(timeout time.Duration) *http.Client {
+	transport := &http.Transport{TLSClientConfig: clientTLSConfig()}
+	if p.noiseChannel() {
+		transport = &http.Transport{DialContext: p.dialer.DialContext}
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// setHeader adds the protocol version headers to a request: the negotiated
+// version, or the version of this build before negotiation
+func (p *peerClient) setHeader(h http.Header) {
+	version := protocol.Version
+	if p != nil && p.version != 0 {
+		version = p.version
+	}
+	protocol.SetHeader(h, version)
+}
+
+// url returns the URL of path on the exporter at addr
+func (p *peerClient) url(addr, path string) string {
+	scheme := "https"
+	if p.noiseChannel() {
+		// The channel encrypts and authenticates; HTTP runs inside it
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, addr, path)
+}
+
+// noisePeer returns a client reaching the exporter at host over a Noise
+// channel. The exporter must be a trusted host that exchanged keys before,
+// found by name, alias or last known address.
+func noisePeer(host string) (*peerClient, error) {
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+
+	hostManager, err := hostpkg.NewManager()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create host manager: %w", err)
+	}
+	exporter, err := hostManager.FindHost(hostname)
+	if err != nil {
+		for _, h := range hostManager.ListHosts() {
+			if h.IPAddress == hostname {
+				exporter, err = h, nil
+				break
+			}
+		}
+	}
+	if err != nil || exporter.PublicKey == "" {
+		return nil, protocol.AuthError(fmt.Errorf("--noise needs the key of %s; exchange keys with it over TLS first", hostname))
+	}
+	if !exporter.Trusted {
+		return nil, protocol.AuthError(fmt.Errorf("host %s is not trusted; run 'dsp host trust %s' to use --noise", exporter.Name, exporter.Name))
+	}
+	remote, err := crypto.X25519PublicKey(exporter.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the key of host %s: %w", exporter.Name, err)
+	}
+
+	keyManager, err := crypto.NewKeyManager()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key manager: %w", err)
+	}
+	private, err := keyManager.X25519PrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	static, err := noise.NewKeyPair(private)
+	if err != nil {
+		return nil, err
+	}
+	return &peerClient{dialer: &noise.Dialer{Static: static, Remote: remote}}, nil
+}
@@ -9,7 +9,10 @@ import (
 	"strings"
 
 	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/hooks"
 	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/Mattddixo/dsp/pkg/utils"
 	"github.com/urfave/cli/v2"
 )
 
@@ -34,8 +37,20 @@ Examples:
   # Initialize in a specific directory
   dsp init /path/to/directory
 
-Note: Each project should have its own DSP repository. Avoid initializing
-DSP in your home directory or in the DSP tool's source code directory.`,
+  # Initialize from a script, without prompts
+  dsp init --yes --name "my-project" --hash sha256 --compression 9 /path/to/directory
+
+Without --yes or any of --dsp-dir, --data-dir, --compression and --hash, init
+asks whether to customize the configuration. With them it does not ask, and
+settings not given keep their defaults.
+
+  # Initialize inside another repository anyway
+  dsp init --force /path/to/repo/subproject
+
+Note: Each project should have its own DSP repository. init refuses to
+initialize in your home directory, the filesystem root, system directories,
+the DSP tool's source code directory, and directories inside or containing
+another registered repository, unless --force is given.`,
 	Flags: []cli.Flag{
 		&cli.StringFlag{
 			Name:    "name",
@@ -47,6 +62,32 @@ DSP in your home directory or in the DSP tool's source code directory.`,
 			Aliases: []string{"d"},
 			Usage:   "Set as default repository",
 		},
+		&cli.BoolFlag{
+			Name:    "yes",
+			Aliases: []string{"y"},
+			Usage:   "Use the default configuration, changed only by the flags given, without asking",
+		},
+		&cli.BoolFlag{
+			Name:    "force",
+			Aliases: []string{"f"},
+			Usage:   "Initialize even in a dangerous location, such as the home directory or inside another repository, or with a name that is taken or has disallowed characters",
+		},
+		&cli.StringFlag{
+			Name:  "dsp-dir",
+			Usage: "Name of the DSP directory in the repository (default: .dsp)",
+		},
+		&cli.StringFlag{
+			Name:  "data-dir",
+			Usage: "Directory for DSP data, relative to the repository (default: data in the DSP directory)",
+		},
+		&cli.IntFlag{
+			Name:  "compression",
+			Usage: "Compression level for bundles, 1-9 (default: 6)",
+		},
+		&cli.StringFlag{
+			Name:  "hash",
+			Usage: "Hash algorithm: " + strings.Join(config.ValidHashAlgorithms, ", ") + " (default: blake3)",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		// Get target directory
@@ -61,6 +102,29 @@ DSP in your home directory or in the DSP tool's source code directory.`,
 			return fmt.Errorf("failed to get absolute path: %w", err)
 		}
 
+		manager, err := repo.NewManager()
+		if err != nil {
+			return fmt.Errorf("failed to create repository manager: %w", err)
+		}
+
+		// Refuse dangerous locations unless forced
+		if reason := checkLocation(absPath, manager); reason != "" {
+			if !c.Bool("force") {
+				return fmt.Errorf("refusing to initialize: %s; use --force to initialize anyway", reason)
+			}
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", reason)
+		}
+
+		// Use directory name as default name if not specified, and refuse
+		// names that are taken or not allowed before creating anything
+		name := c.String("name")
+		if name == "" {
+			name = filepath.Base(absPath)
+		}
+		if err := manager.CheckName(name, absPath); err != nil && !c.Bool("force") {
+			return fmt.Errorf("refusing to initialize: %w; use --force to use it anyway", err)
+		}
+
 		fmt.Printf("Initializing DSP repository in: %s\n", absPath)
 
 		// Create config.yaml
@@ -69,11 +133,21 @@ DSP in your home directory or in the DSP tool's source code directory.`,
 			return fmt.Errorf("failed to create default configuration: %w", err)
 		}
 
-		// Ask if user wants to customize the configuration
-		fmt.Print("\nWould you like to customize the configuration? (y/N) ")
+		// Apply the configuration given by flags
+		configured, err := applyFlags(c, cfg)
+		if err != nil {
+			return err
+		}
+
+		// Ask if user wants to customize the configuration, unless it was
+		// given on the command line
+		response := ""
 		reader := bufio.NewReader(os.Stdin)
-		response, _ := reader.ReadString('\n')
-		response = strings.TrimSpace(strings.ToLower(response))
+		if !c.Bool("yes") && !configured {
+			fmt.Print("\nWould you like to customize the configuration? (y/N) ")
+			response, _ = reader.ReadString('\n')
+			response = strings.TrimSpace(strings.ToLower(response))
+		}
 
 		if response == "y" || response == "yes" {
 			// Customize DSP directory
@@ -104,7 +178,7 @@ DSP in your home directory or in the DSP tool's source code directory.`,
 		}
 
 		// Create data directory
-		dataDir := filepath.Join(absPath, cfg.DataDir)
+		dataDir := cfg.DataDirIn(absPath)
 		if err := os.MkdirAll(dataDir, 0755); err != nil {
 			return fmt.Errorf("failed to create data directory: %w", err)
 		}
@@ -121,9 +195,13 @@ DSP in your home directory or in the DSP tool's source code directory.`,
 			return fmt.Errorf("failed to create bundles directory: %w", err)
 		}
 
+		// Create hooks directory
+		if err := os.MkdirAll(hooks.Dir(dspDir), 0755); err != nil {
+			return fmt.Errorf("failed to create hooks directory: %w", err)
+		}
+
 		// Create tracking.yaml
-		trackingPath := filepath.Join(dspDir, "tracking.yaml")
-		if err := os.WriteFile(trackingPath, []byte("paths: []\n"), 0644); err != nil {
+		if err := snapshot.SaveTrackingConfig(dspDir, &snapshot.TrackingConfig{Paths: []snapshot.TrackedPath{}}); err != nil {
 			return fmt.Errorf("failed to create tracking.yaml: %w", err)
 		}
 
@@ -133,30 +211,27 @@ DSP in your home directory or in the DSP tool's source code directory.`,
 			return fmt.Errorf("failed to save config.yaml: %w", err)
 		}
 
+		// Keyed hashes need a key of the repository
+		if cfg.HashAlgorithm == utils.KeyedBlake3 {
+			if _, err := config.GenerateHashKey(dspDir); err != nil {
+				return err
+			}
+		}
+
 		// Create .gitignore
 		gitignorePath := filepath.Join(dspDir, ".gitignore")
 		gitignoreContent := `# DSP data files
 data/
 snapshots/
 bundles/
+hash.key
 `
 		if err := os.WriteFile(gitignorePath, []byte(gitignoreContent), 0644); err != nil {
 			return fmt.Errorf("failed to create .gitignore: %w", err)
 		}
 
 		// Register repository with manager
-		manager, err := repo.NewManager()
-		if err != nil {
-			return fmt.Errorf("failed to create repository manager: %w", err)
-		}
-
-		// Use directory name as default name if not specified
-		name := c.String("name")
-		if name == "" {
-			name = filepath.Base(absPath)
-		}
-
-		if err := manager.InitializeRepository(absPath, name, c.Bool("default"), cfg.DSPDir); err != nil {
+		if err := manager.InitializeRepository(absPath, name, c.Bool("default"), cfg.DSPDir, c.Bool("force")); err != nil {
 			return fmt.Errorf("failed to initialize repository: %w", err)
 		}
 
@@ -174,3 +249,38 @@ bundles/
 		return nil
 	},
 }
+
+// applyFlags sets the configuration given by flags. It reports whether any
+// was given.
+func applyFlags(c *cli.Context, cfg *config.Config) (bool, error) {
+	configured := false
+	if c.IsSet("dsp-dir") {
+		dspDir := filepath.Clean(filepath.FromSlash(c.String("dsp-dir")))
+		if c.String("dsp-dir") == "" || dspDir == "." || filepath.IsAbs(dspDir) || dspDir == ".." || strings.HasPrefix(dspDir, ".."+string(filepath.Separator)) {
+			return false, fmt.Errorf("invalid --dsp-dir %q: must be a directory inside the repository", c.String("dsp-dir"))
+		}
+		// The default data directory moves along with the DSP directory
+		if !c.IsSet("data-dir") && cfg.DataDir == filepath.Join(cfg.DSPDir, "data") {
+			cfg.DataDir = filepath.Join(dspDir, "data")
+		}
+		cfg.DSPDir = dspDir
+		configured = true
+	}
+	settings := []struct {
+		flag, key string
+	}{
+		{"data-dir", "data_dir"},
+		{"compression", "compression_level"},
+		{"hash", "hash_algorithm"},
+	}
+	for _, s := range settings {
+		if !c.IsSet(s.flag) {
+			continue
+		}
+		if err := cfg.Set(s.key, fmt.Sprint(c.Value(s.flag))); err != nil {
+			return false, fmt.Errorf("invalid --%s: %w", s.flag, err)
+		}
+		configured = true
+	}
+	return configured, nil
+}
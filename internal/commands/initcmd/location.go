@@ -0,0 +1,111 @@
+package initcmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// sourceModule is the module path of DSP's own source tree
+const sourceModule = "github.com/Mattddixo/dsp"
+
+// checkLocation returns why path is a dangerous place for a repository, or
+// "" if it is not: a home directory or filesystem root, a system directory,
+// DSP's own source tree, or a directory inside or around a registered
+// repository.
+func checkLocation(path string, manager *repo.Manager) string {
+	if home, err := os.UserHomeDir(); err == nil && samePath(path, home) {
+		return fmt.Sprintf("%s is your home directory", path)
+	}
+	if filepath.Dir(path) == path {
+		return fmt.Sprintf("%s is the root of the filesystem", path)
+	}
+	trees, dirs := systemDirs()
+	for _, dir := range trees {
+		if samePath(path, dir) || utils.Within(path, dir) {
+			return fmt.Sprintf("%s is a system directory", path)
+		}
+	}
+	for _, dir := range dirs {
+		if samePath(path, dir) {
+			return fmt.Sprintf("%s is a system directory", path)
+		}
+	}
+	if root := sourceRoot(path); root != "" {
+		return fmt.Sprintf("%s is inside the DSP source tree at %s", path, root)
+	}
+	for _, r := range manager.Repos {
+		switch {
+		case samePath(path, r.Path):
+			return ""
+		case utils.Within(path, r.Path):
+			return fmt.Sprintf("%s is inside the repository %s at %s, and their snapshots would overlap", path, r.Name, r.Path)
+		case utils.Within(r.Path, path):
+			return fmt.Sprintf("%s contains the repository %s at %s, and their snapshots would overlap", path, r.Name, r.Path)
+		}
+	}
+	return ""
+}
+
+// systemDirs returns the operating system directories no repository should
+// be created in: whole trees, and directories whose subdirectories commonly
+// hold user projects
+func systemDirs() (trees, dirs []string) {
+	switch runtime.GOOS {
+	case "windows":
+		for _, env := range []string{"SystemRoot", "ProgramFiles", "ProgramFiles(x86)"} {
+			if dir := os.Getenv(env); dir != "" {
+				trees = append(trees, dir)
+			}
+		}
+		if dir := os.Getenv("ProgramData"); dir != "" {
+			dirs = append(dirs, dir)
+		}
+		return trees, dirs
+	case "darwin":
+		return []string{"/System", "/bin", "/sbin", "/dev", "/etc"},
+			[]string{"/Library", "/Applications", "/usr", "/var", "/private", "/Volumes", "/opt"}
+	default:
+		return []string{"/bin", "/boot", "/dev", "/etc", "/lib", "/lib32", "/lib64", "/proc", "/run", "/sbin", "/sys"},
+			[]string{"/usr", "/var", "/opt", "/srv", "/mnt", "/media", "/tmp"}
+	}
+}
+
+// sourceRoot returns the directory of DSP's own source tree that path is in,
+// or "" if it is not in one
+func sourceRoot(path string) string {
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if file, err := os.Open(filepath.Join(dir, "go.mod")); err == nil {
+			module := ""
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				if fields := strings.Fields(scanner.Text()); len(fields) == 2 && fields[0] == "module" {
+					module = strings.Trim(fields[1], `"`)
+					break
+				}
+			}
+			file.Close()
+			if module == sourceModule {
+				return dir
+			}
+		}
+		if filepath.Dir(dir) == dir {
+			return ""
+		}
+	}
+}
+
+// samePath reports whether two absolute paths name the same directory
+func samePath(a, b string) bool {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
@@ -0,0 +1,274 @@
+package logcmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/ledger"
+	"github.com/Mattddixo/dsp/internal/receipt"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/Mattddixo/dsp/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+// shortHash is how many characters of a hash are shown without --full
+const shortHash = 12
+
+var Command = &cli.Command{
+	Name:      "log",
+	Usage:     "Show the history of a file",
+	ArgsUsage: "<path>",
+	Description: `Show the history of one file across snapshots and bundles, newest first:
+
+  added, modified, deleted  the snapshots in which the file appeared, changed
+                            or disappeared, with their message and author,
+                            and the size and hash of the new version
+  bundle                    bundles in <dsp-dir>/bundles that carry a change
+                            to the file, and who created them
+  received                  receipts of those bundles imported into the
+                            repository, and who sent them
+  apply                     applies of those bundles, and who ran them
+
+This answers questions such as "when did this config change, and who synced
+it here?". The path is relative to the current directory, or to the
+repository root if it is not inside the repository.
+
+Examples:
+  # Show when a config file changed and which bundles carried it
+  dsp log configs/app.yaml
+
+  # Show full hashes
+  dsp log --full configs/app.yaml`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "full",
+			Aliases: []string{"f"},
+			Usage:   "Show full hashes",
+		},
+		&cli.StringFlag{
+			Name:    "repo",
+			Aliases: []string{"r"},
+			Usage:   "Path to the repository (default: nearest repository)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return fmt.Errorf("expected one file path")
+		}
+
+		// Create repository manager
+		manager, err := repo.NewManager()
+		if err != nil {
+			return fmt.Errorf("failed to create repository manager: %w", err)
+		}
+
+		// Get current repository context
+		currentRepo, err := manager.GetCurrentRepo(c.String("repo"))
+		if err != nil {
+			return fmt.Errorf("failed to get repository context: %w", err)
+		}
+		dspDir := filepath.Join(currentRepo.Path, currentRepo.DSPDir)
+		path, err := resolvePath(c.Args().First(), currentRepo.Path)
+		if err != nil {
+			return err
+		}
+		hashes := func(hash string) string {
+			if !c.Bool("full") && len(hash) > shortHash {
+				return hash[:shortHash]
+			}
+			return hash
+		}
+
+		// Collect the snapshots that changed the file
+		entries, err := snapshot.List(dspDir)
+		if err != nil {
+			return fmt.Errorf("failed to list snapshots: %w", err)
+		}
+		events := fileChanges(entries, path, hashes)
+
+		// Collect the bundles that carried it, and their transfers and applies
+		carried, err := bundlesCarrying(filepath.Join(dspDir, "bundles"), path, hashes)
+		if err != nil {
+			return err
+		}
+		for _, ev := range carried {
+			events = append(events, ev)
+		}
+		if len(carried) > 0 {
+			repoConfig, err := config.NewWithRepo(currentRepo.Path, currentRepo.DSPDir)
+			if err != nil {
+				return fmt.Errorf("failed to load repository configuration: %w", err)
+			}
+			receipts, err := receipt.List(repoConfig.DataDirIn(currentRepo.Path))
+			if err != nil {
+				return err
+			}
+			for _, r := range receipts {
+				if _, ok := carried[r.BundleID]; ok && r.Direction == receipt.Received {
+					events = append(events, event{
+						time: r.Completed,
+						kind: "received",
+						text: fmt.Sprintf("bundle %s from %s by %s", r.BundleID, describePeer(r), r.User),
+					})
+				}
+			}
+
+			applied, err := ledger.Load(dspDir)
+			if err != nil {
+				return err
+			}
+			for _, entry := range applied.Entries {
+				if _, ok := carried[entry.BundleID]; !ok {
+					continue
+				}
+				kind := "apply"
+				if entry.Result == ledger.ResultUndone {
+					kind = "undo"
+				}
+				text := fmt.Sprintf("bundle %s", entry.BundleID)
+				if entry.SourceRepo != "" {
+					text += " from " + entry.SourceRepo
+				}
+				events = append(events, event{
+					time: entry.AppliedAt,
+					kind: kind,
+					text: fmt.Sprintf("%s by %s: %s", text, entry.AppliedBy, entry.Result),
+				})
+			}
+		}
+
+		rel := utils.RelativePath(currentRepo.Path, path)
+		if len(events) == 0 {
+			return fmt.Errorf("%s has no history: it is in no snapshot or bundle", rel)
+		}
+
+		// Print newest first
+		fmt.Printf("History of %s\n\n", rel)
+		sort.SliceStable(events, func(i, j int) bool { return events[i].time.After(events[j].time) })
+		for _, ev := range events {
+			fmt.Printf("%s  %-8s  %s\n", ev.time.Local().Format("2006-01-02 15:04:05"), ev.kind, ev.text)
+		}
+		return nil
+	},
+}
+
+// event is a single line in the history of a file
+type event struct {
+	time time.Time
+	kind string
+	text string
+}
+
+// resolvePath returns the absolute path of a file argument: relative to the
+// current directory if that is inside the repository, otherwise relative to
+// the repository root
+func resolvePath(arg, root string) (string, error) {
+	if filepath.IsAbs(arg) {
+		return filepath.Clean(arg), nil
+	}
+	abs, err := filepath.Abs(arg)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", arg, err)
+	}
+	if rel, err := filepath.Rel(root, abs); err == nil && !strings.HasPrefix(rel, "..") {
+		return abs, nil
+	}
+	return filepath.Join(root, arg), nil
+}
+
+// fileChanges returns the snapshots, oldest first, in which a file was
+// added, modified or deleted
+func fileChanges(entries []snapshot.Entry, path string, hashes func(string) string) []event {
+	var events []event
+	var prev *snapshot.File
+	for _, entry := range entries {
+		snap := entry.Snapshot
+		var current *snapshot.File
+		for i := range snap.Files {
+			if snap.Files[i].Path == path {
+				current = &snap.Files[i]
+				break
+			}
+		}
+
+		var kind string
+		switch {
+		case prev == nil && current != nil:
+			kind = "added"
+		case prev != nil && current == nil:
+			kind = "deleted"
+		case prev != nil && !snapshot.SameContent(*prev, *current):
+			kind = "modified"
+		}
+		prev = current
+		if kind == "" {
+			continue
+		}
+
+		text := fmt.Sprintf("snapshot %s  %s (%s)", entry.ID, snap.Message, snap.User)
+		if current != nil {
+			text += fmt.Sprintf(", %d bytes, %s", current.Size, hashes(current.Hash))
+		}
+		events = append(events, event{time: snap.Timestamp, kind: kind, text: text})
+	}
+	return events
+}
+
+// bundlesCarrying returns the bundles in a directory that carry a change to
+// a file, as events by bundle ID. Encrypted bundles cannot be read and are
+// left out.
+func bundlesCarrying(dir, path string, hashes func(string) string) (map[string]event, error) {
+	carried := make(map[string]event)
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return carried, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundles directory: %w", err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".zip") {
+			continue
+		}
+		r, err := bundle.OpenReader(filepath.Join(dir, file.Name()))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping bundle %s: %v\n", file.Name(), err)
+			continue
+		}
+		b := r.Bundle
+		r.Close()
+
+		for _, change := range b.Changes {
+			if change.Path != path {
+				continue
+			}
+			text := fmt.Sprintf("bundle %s from %s by %s: %s", b.ID, b.Repository.Name, b.CreatedBy, change.Type)
+			if change.Type != "delete" {
+				text += fmt.Sprintf(", %d bytes, %s", change.Size, hashes(change.Hash))
+			}
+			carried[b.ID] = event{time: b.CreatedAt, kind: "bundle", text: text}
+			break
+		}
+	}
+	return carried, nil
+}
+
+// describePeer returns who sent a received bundle
+func describePeer(r *receipt.Receipt) string {
+	peer := r.Peer
+	if r.PeerHost != "" && r.PeerHost != r.Peer {
+		peer = fmt.Sprintf("%s (%s)", r.PeerHost, r.Peer)
+	}
+	if r.PeerUser != "" {
+		peer = r.PeerUser + "@" + peer
+	}
+	return peer
+}
@@ -0,0 +1,281 @@
+package migratehashcmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/chunk"
+	"github.com/Mattddixo/dsp/internal/objects"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/Mattddixo/dsp/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+var Command = &cli.Command{
+	Name:  "migrate-hash",
+	Usage: "Change the hash algorithm of a repository without breaking comparisons",
+	Description: `Change the hash algorithm of a repository and re-hash its latest snapshot.
+
+Hashes of different algorithms never match, so changing hash_algorithm with
+'dsp config set' makes the next snapshot report every tracked file as
+modified. migrate-hash instead re-hashes the files of the latest snapshot
+under the new algorithm and saves the result as a new snapshot, which records
+each file's hash under both algorithms. Diffs and bundles between an older
+snapshot and the migrated one compare through the old hashes during this
+transition, and later snapshots compare with the new ones. The repository
+config is updated last, atomically.
+
+The content of each file is read from the working tree if it still matches
+the snapshot, or else from the object store or the bundles of the repository.
+If some content is not available the migration stops without changing
+anything; take a snapshot first so the latest one matches the working tree.
+
+--objects also stores the contents held for the latest snapshot under their
+new hashes, so diffs and bundles can read them right away. Contents under the
+old hashes are kept for older snapshots until the store prunes them.
+
+Peers syncing the repository should migrate to the same algorithm, as bundles
+are applied with the algorithm of the repository that made them.
+
+Examples:
+  # Move from blake3 to sha256
+  dsp migrate-hash --to sha256
+
+  # Also re-key the object store
+  dsp migrate-hash --to blake3-keyed --objects`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "to",
+			Usage:    "Hash algorithm to migrate to (" + strings.Join(config.ValidHashAlgorithms, ", ") + ")",
+			Required: true,
+		},
+		&cli.BoolFlag{
+			Name:  "objects",
+			Usage: "Also store the contents of the latest snapshot under their new hashes",
+		},
+		&cli.StringFlag{
+			Name:    "repo",
+			Aliases: []string{"r"},
+			Usage:   "Path to the repository (default: nearest repository)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		// Get current repository context
+		manager, err := repo.NewManager()
+		if err != nil {
+			return fmt.Errorf("failed to create repository manager: %w", err)
+		}
+		currentRepo, err := manager.GetCurrentRepo(c.String("repo"))
+		if err != nil {
+			return fmt.Errorf("failed to get repository context: %w", err)
+		}
+		dspDir := currentRepo.GetDSPDir()
+
+		// The environment would override the migrated setting
+		if env := os.Getenv("DSP_HASH_ALGORITHM"); env != "" {
+			return fmt.Errorf("DSP_HASH_ALGORITHM is set to %s; unset it before migrating", env)
+		}
+		repoConfig, err := config.NewWithRepo(currentRepo.Path, currentRepo.DSPDir)
+		if err != nil {
+			return fmt.Errorf("failed to load repository configuration: %w", err)
+		}
+		configPath := filepath.Join(dspDir, "config.yaml")
+		fileConfig, err := config.LoadFile(configPath)
+		if err != nil {
+			return err
+		}
+		from, to := repoConfig.HashAlgorithm, c.String("to")
+		if from == to {
+			return fmt.Errorf("repository '%s' already uses %s", currentRepo.Name, to)
+		}
+		if err := fileConfig.Set("hash_algorithm", to); err != nil {
+			return err
+		}
+		newConfig := *repoConfig
+		newConfig.HashAlgorithm = to
+
+		// Keyed hashes need a key; a keyed source algorithm keeps using its own
+		if to == utils.KeyedBlake3 {
+			key, err := config.LoadHashKey(dspDir)
+			if err != nil {
+				return err
+			}
+			if key == nil {
+				if _, err := config.GenerateHashKey(dspDir); err != nil {
+					return err
+				}
+				fmt.Printf("Generated a hash key in %s; peers syncing this repository need it too (see 'dsp config hash-key')\n", config.HashKeyPath(dspDir))
+			}
+		}
+
+		// Re-hash the latest snapshot
+		var migrated *snapshot.Snapshot
+		latestID, latest, err := snapshot.LoadLatest(dspDir)
+		if err == nil {
+			store := bundle.NewContentStore(from, filepath.Join(dspDir, "bundles"))
+			store.UseObjects(objects.ForRepo(currentRepo.Path, repoConfig))
+			defer store.Close()
+
+			fmt.Printf("Re-hashing %d files of snapshot %s with %s...\n", len(latest.Files), latestID, to)
+			migrated, err = rehash(latest, from, to, store)
+			if err != nil {
+				return err
+			}
+			if err := os.Mkdir(snapshot.Dir(dspDir, migrated.ID), 0755); err != nil {
+				return fmt.Errorf("failed to create snapshot directory: %w", err)
+			}
+			if err := migrated.Save(snapshot.FilePath(dspDir, migrated.ID)); err != nil {
+				os.RemoveAll(snapshot.Dir(dspDir, migrated.ID))
+				return fmt.Errorf("failed to save snapshot: %w", err)
+			}
+		}
+
+		// Switch the repository over
+		if err := fileConfig.Save(configPath); err != nil {
+			if migrated != nil {
+				os.RemoveAll(snapshot.Dir(dspDir, migrated.ID))
+			}
+			return fmt.Errorf("failed to update repository configuration: %w", err)
+		}
+
+		fmt.Printf("Migrated repository '%s' from %s to %s\n", currentRepo.Name, from, to)
+		if migrated == nil {
+			fmt.Println("The repository has no snapshots to re-hash")
+			return nil
+		}
+		fmt.Printf("Created snapshot %s with the new hashes\n", migrated.ID)
+
+		// Store the contents under their new hashes
+		if c.Bool("objects") {
+			oldStore := objects.ForRepo(currentRepo.Path, repoConfig)
+			newStore := objects.ForRepo(currentRepo.Path, &newConfig)
+			if oldStore == nil || newStore == nil {
+				fmt.Println("The object store is disabled; nothing to re-key")
+				return nil
+			}
+			stored := 0
+			for _, f := range migrated.Files {
+				if f.IsSymlink || !oldStore.Has(f.PreviousHash) {
+					continue
+				}
+				data, err := oldStore.Get(f.PreviousHash)
+				if err == nil {
+					_, err = newStore.Put(f.Hash, data, repoConfig.CompressionLevel)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: failed to re-key content of %s: %v\n", f.Path, err)
+					continue
+				}
+				stored++
+			}
+			fmt.Printf("Stored %d contents under their new hashes\n", stored)
+		}
+		return nil
+	},
+}
+
+// rehash returns a copy of snap with every file hashed and chunked with the
+// algorithm to, keeping the hashes under from as previous hashes. It fails
+// if the content of any file cannot be found.
+func rehash(snap *snapshot.Snapshot, from, to string, store *bundle.ContentStore) (*snapshot.Snapshot, error) {
+	now := time.Now()
+	migrated := *snap
+	migrated.ID = snapshot.NewID(now)
+	migrated.Timestamp = now
+	migrated.User = config.CurrentUser()
+	migrated.Message = fmt.Sprintf("Migrated hashes from %s to %s (snapshot %s)", from, to, snap.ID)
+	migrated.PreviousHashAlgorithm = from
+	migrated.Files = make([]snapshot.File, len(snap.Files))
+
+	var missing []string
+	for i, f := range snap.Files {
+		var hash string
+		var chunks []chunk.Chunk
+		var err error
+		if f.IsSymlink {
+			hash, err = utils.HashReader(strings.NewReader(f.SymlinkTarget), to)
+		} else {
+			hash, chunks, err = rehashFile(f, from, to, store)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to re-hash %s: %w", f.Path, err)
+		}
+		if hash == "" {
+			missing = append(missing, f.Path)
+			continue
+		}
+		f.PreviousHash = f.Hash
+		f.Hash = hash
+		f.Chunks = chunks
+		migrated.Files[i] = f
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("the content of %d files of snapshot %s is not available (%s); take a snapshot first so it matches the working tree",
+			len(missing), snap.ID, strings.Join(missing[:min(len(missing), 3)], ", "))
+	}
+	return &migrated, nil
+}
+
+// rehashFile hashes the content a snapshot recorded for a file with the
+// algorithm to. The content is read from the working tree if it still has
+// the recorded hash, or else from store. It returns an empty hash if the
+// content is not available.
+func rehashFile(f snapshot.File, from, to string, store *bundle.ContentStore) (string, []chunk.Chunk, error) {
+	if info, err := os.Stat(f.Path); err == nil && info.Mode().IsRegular() && info.Size() == f.Size {
+		file, err := os.Open(f.Path)
+		if err != nil {
+			return "", nil, err
+		}
+		oldHash, hash, chunks, err := hashBoth(file, f.Size, from, to)
+		file.Close()
+		if err != nil {
+			return "", nil, err
+		}
+		if oldHash == f.Hash {
+			return hash, chunks, nil
+		}
+	}
+
+	data, ok := store.FindHash(f.Hash)
+	if !ok {
+		return "", nil, nil
+	}
+	oldHash, hash, chunks, err := hashBoth(bytes.NewReader(data), int64(len(data)), from, to)
+	if err != nil || oldHash != f.Hash {
+		return "", nil, err
+	}
+	return hash, chunks, nil
+}
+
+// hashBoth hashes content with both algorithms in one read, splitting it
+// into chunks hashed with to if it is large enough
+func hashBoth(r io.Reader, size int64, from, to string) (string, string, []chunk.Chunk, error) {
+	oldHasher, err := utils.GetHasher(from)
+	if err != nil {
+		return "", "", nil, err
+	}
+	newHasher, err := utils.GetHasher(to)
+	if err != nil {
+		return "", "", nil, err
+	}
+	r = io.TeeReader(r, io.MultiWriter(oldHasher, newHasher))
+
+	var chunks []chunk.Chunk
+	if size >= chunk.Threshold {
+		chunks, err = chunk.Split(r, to, nil)
+	} else {
+		_, err = io.Copy(io.Discard, r)
+	}
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to read content: %w", err)
+	}
+	return fmt.Sprintf("%x", oldHasher.Sum(nil)), fmt.Sprintf("%x", newHasher.Sum(nil)), chunks, nil
+}
@@ -0,0 +1,196 @@
+package notifycmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/notify"
+	"github.com/urfave/cli/v2"
+)
+
+var Command = &cli.Command{
+	Name:  "notify",
+	Usage: "Manage notifications of snapshots, exports, applies and conflicts",
+	Description: `Tell other tools about what DSP does on this machine, such as a chat room or a
+ticketing system. Notification targets are kept in the global configuration
+and are told about these events:
+
+  snapshot-created   a snapshot was taken
+  bundle-exported    an importer finished downloading a bundle from 'dsp export',
+                     or 'dsp push' uploaded one
+  bundle-applied     a bundle was applied
+  conflict-detected  applying a bundle left changes that conflict with local edits
+
+A command target is run through the shell with the event as JSON on stdin and
+in DSP_EVENT, DSP_REPO_NAME, DSP_SUBJECT (the snapshot or bundle ID) and
+DSP_DETAIL. A webhook target is posted the same JSON. Webhook posts that fail,
+for example while the machine is offline, are queued and sent before the next
+notification once the network is back, or with 'dsp notify flush'.
+
+Notifications never fail the operation they are about; failures are warnings.
+
+Examples:
+  # Post every event to a chat webhook
+  dsp notify add --name chat --webhook https://chat.example.com/hooks/dsp
+
+  # Open a ticket when an apply conflicts
+  dsp notify add --name tickets --event conflict-detected --command 'ticket-new --stdin'
+
+  # Check that a target works
+  dsp notify test chat`,
+	Subcommands: []*cli.Command{
+		{
+			Name:  "add",
+			Usage: "Add a notification target",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "name",
+					Usage:    "Name of the target",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "command",
+					Usage: "Command to run through the shell, with the event as JSON on stdin",
+				},
+				&cli.StringFlag{
+					Name:  "webhook",
+					Usage: "http or https URL to post the event to as JSON",
+				},
+				&cli.StringSliceFlag{
+					Name:  "event",
+					Usage: "Event to notify about (comma-separated or repeated; default: all)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				target := config.NotifyTarget{
+					Name:    c.String("name"),
+					Command: c.String("command"),
+					Webhook: c.String("webhook"),
+				}
+				for _, value := range c.StringSlice("event") {
+					for _, event := range strings.Split(value, ",") {
+						if event = strings.TrimSpace(event); event != "" {
+							target.Events = append(target.Events, event)
+						}
+					}
+				}
+
+				cfg, err := config.LoadGlobalFile()
+				if err != nil {
+					return err
+				}
+				if err := cfg.AddNotifyTarget(target); err != nil {
+					return fmt.Errorf("failed to add notification target: %w", err)
+				}
+				if err := cfg.Save(); err != nil {
+					return err
+				}
+				fmt.Printf("Added notification target '%s'\n", target.Name)
+				return nil
+			},
+		},
+		{
+			Name:  "list",
+			Usage: "List notification targets",
+			Action: func(c *cli.Context) error {
+				cfg, err := config.LoadGlobal()
+				if err != nil {
+					return err
+				}
+				if len(cfg.Notifications) == 0 {
+					fmt.Println("No notification targets.")
+					return nil
+				}
+				queued, err := notify.Pending()
+				if err != nil {
+					return err
+				}
+
+				for i, target := range cfg.Notifications {
+					if i > 0 {
+						fmt.Println()
+					}
+					fmt.Printf("Name: %s\n", target.Name)
+					if target.Command != "" {
+						fmt.Printf("Command: %s\n", target.Command)
+					} else {
+						fmt.Printf("Webhook: %s\n", target.Webhook)
+					}
+					events := "all"
+					if len(target.Events) > 0 {
+						events = strings.Join(target.Events, ", ")
+					}
+					fmt.Printf("Events: %s\n", events)
+					if n := queued[target.Name]; n > 0 {
+						fmt.Printf("Queued: %d\n", n)
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "remove",
+			Usage:     "Remove a notification target",
+			ArgsUsage: "<name>",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return fmt.Errorf("expected the name of a notification target")
+				}
+				cfg, err := config.LoadGlobalFile()
+				if err != nil {
+					return err
+				}
+				if !cfg.RemoveNotifyTarget(c.Args().First()) {
+					return fmt.Errorf("notification target %s not found", c.Args().First())
+				}
+				if err := cfg.Save(); err != nil {
+					return err
+				}
+				fmt.Printf("Removed notification target '%s'\n", c.Args().First())
+				return nil
+			},
+		},
+		{
+			Name:      "test",
+			Usage:     "Send a test event to a notification target",
+			ArgsUsage: "<name>",
+			Description: `Send a test event to a notification target right away. The event is
+"test"; a failure is reported and not queued.`,
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return fmt.Errorf("expected the name of a notification target")
+				}
+				cfg, err := config.LoadGlobal()
+				if err != nil {
+					return err
+				}
+				target, ok := cfg.FindNotifyTarget(c.Args().First())
+				if !ok {
+					return fmt.Errorf("notification target %s not found", c.Args().First())
+				}
+				if err := notify.Deliver(target, notify.Event{Event: "test", Detail: "test notification from 'dsp notify test'"}); err != nil {
+					return fmt.Errorf("notification %s failed: %w", target.Name, err)
+				}
+				fmt.Printf("Notified '%s'\n", target.Name)
+				return nil
+			},
+		},
+		{
+			Name:  "flush",
+			Usage: "Send the queued webhook posts",
+			Action: func(c *cli.Context) error {
+				sent, queued, err := notify.Flush()
+				if err != nil {
+					return fmt.Errorf("failed to send queued notifications: %w", err)
+				}
+				fmt.Printf("Sent %d queued notifications", sent)
+				if queued > 0 {
+					fmt.Printf(", %d still queued", queued)
+				}
+				fmt.Println()
+				return nil
+			},
+		},
+	},
+}
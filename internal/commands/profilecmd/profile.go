@@ -0,0 +1,120 @@
+package profilecmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/urfave/cli/v2"
+)
+
+var Command = &cli.Command{
+	Name:  "profile",
+	Usage: "Switch between separate global contexts",
+	Description: `Manage profiles: separate global DSP directories, each with its own keys,
+known hosts, trust settings and registered repositories. Use one profile per
+disconnected network (work, personal, site-A) to keep their trust stores and
+repository lists apart.
+
+The default profile is ~/.dsp-global; other profiles live in
+~/.dsp-profiles/<name>. The active profile applies to every later command.
+A single command can use another profile with 'dsp --profile <name> ...' or
+DSP_PROFILE; --global-dir and DSP_GLOBAL_DIR override profiles altogether.
+
+Examples:
+  # Create a profile and switch to it
+  dsp profile create --use site-a
+
+  # Switch back to the default profile
+  dsp profile use default
+
+  # List profiles
+  dsp profile list
+
+  # Run one command in another profile
+  dsp --profile site-a host list`,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "create",
+			Usage:     "Create a profile",
+			ArgsUsage: "<name>",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "use",
+					Usage: "Switch to the new profile",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return fmt.Errorf("expected exactly one profile name")
+				}
+				name := c.Args().First()
+
+				dir, err := config.CreateProfile(name)
+				if err != nil {
+					return fmt.Errorf("failed to create profile: %w", err)
+				}
+				fmt.Printf("Created profile '%s' at %s\n", name, dir)
+
+				if c.Bool("use") {
+					if err := config.UseProfile(name); err != nil {
+						return err
+					}
+					fmt.Printf("Switched to profile '%s'\n", name)
+				}
+				fmt.Println("Run 'dsp crypto init' in the profile to generate its keys.")
+				return nil
+			},
+		},
+		{
+			Name:      "use",
+			Usage:     "Switch to a profile",
+			ArgsUsage: "<name>",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return fmt.Errorf("expected exactly one profile name")
+				}
+				name := c.Args().First()
+
+				if err := config.UseProfile(name); err != nil {
+					return err
+				}
+				fmt.Printf("Switched to profile '%s'\n", name)
+				if os.Getenv(config.GlobalDirEnv) != "" {
+					fmt.Fprintf(os.Stderr, "Warning: %s is set and overrides the profile\n", config.GlobalDirEnv)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "list",
+			Usage: "List profiles",
+			Action: func(c *cli.Context) error {
+				profiles, err := config.ListProfiles()
+				if err != nil {
+					return err
+				}
+				active, err := config.ActiveProfile()
+				if err != nil {
+					return err
+				}
+
+				for _, name := range profiles {
+					marker := " "
+					if name == active {
+						marker = "*"
+					}
+					dir, err := config.ProfileDir(name)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("%s %-16s %s\n", marker, name, dir)
+				}
+				if dir := os.Getenv(config.GlobalDirEnv); dir != "" {
+					fmt.Printf("\n%s is set: using %s instead of the active profile\n", config.GlobalDirEnv, dir)
+				}
+				return nil
+			},
+		},
+	},
+}
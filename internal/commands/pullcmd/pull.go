@@ -0,0 +1,271 @@
+package pullcmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/ledger"
+	"github.com/Mattddixo/dsp/internal/protocol"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/transport"
+	"github.com/urfave/cli/v2"
+)
+
+var Command = &cli.Command{
+	Name:  "pull",
+	Usage: "Download new bundles from a drop location",
+	Description: `Download the bundles at a drop location that this repository has neither
+received nor applied into <dsp-dir>/bundles. Apply them with 'dsp apply -b'.
+Bundles encrypted with 'dsp bundle --to' (.zip.age) are downloaded as well;
+decrypt them with 'dsp crypto decrypt'.
+
+Locations are given as for 'dsp push': sftp://[user@]host[:port]/path,
+webdavs://[user@]host[:port]/path, file:///path or a directory path. SFTP
+locations use the system sftp client, so keys, agents, ~/.ssh/config and known
+hosts apply as for ssh. WebDAV passwords are read from DSP_WEBDAV_PASSWORD.
+
+Bundles pushed with 'dsp push' have a manifest, and downloads that do not
+match its size and SHA-256 are rejected (exit code 5). Bundles copied to the
+location by other means are downloaded with a warning. Bundles with a parity
+file ('dsp bundle --parity') are repaired with it first if they were damaged
+at the location, and the parity file is kept next to the bundle.
+
+With --watch the location is polled until interrupted, which turns a directory
+on a shared network drive into a dead drop between sites.
+
+Examples:
+  # Download new bundles
+  dsp pull --via sftp://sync@gateway.example.com/srv/dsp/field-team
+
+  # See what would be downloaded
+  dsp pull --via /media/usb/dsp --dry-run
+
+  # Poll a drop directory on a shared drive every minute
+  dsp pull --via file:///mnt/shared/dsp-drop --watch 1m`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "via",
+			Usage:    "Drop location: sftp://[user@]host[:port]/path, webdavs://[user@]host[:port]/path, file:///path or a directory",
+			Required: true,
+		},
+		&cli.DurationFlag{
+			Name:  "watch",
+			Usage: "Keep polling the location at this interval (e.g. 30s, 5m) until interrupted",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "List the bundles that would be downloaded without downloading them",
+		},
+		&cli.StringFlag{
+			Name:    "repo",
+			Aliases: []string{"r"},
+			Usage:   "Path to the repository (default: nearest repository)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		interval := c.Duration("watch")
+		if interval < 0 {
+			return fmt.Errorf("--watch interval must be positive")
+		}
+		if interval > 0 && c.Bool("dry-run") {
+			return fmt.Errorf("--watch cannot be combined with --dry-run")
+		}
+
+		location, err := transport.Open(c.String("via"))
+		if err != nil {
+			return err
+		}
+
+		// Create repository manager
+		manager, err := repo.NewManager()
+		if err != nil {
+			return fmt.Errorf("failed to create repository manager: %w", err)
+		}
+
+		// Get current repository context
+		currentRepo, err := manager.GetCurrentRepo(c.String("repo"))
+		if err != nil {
+			return fmt.Errorf("failed to get repository context: %w", err)
+		}
+		dspDir := currentRepo.GetDSPDir()
+		repoConfig, err := config.NewWithRepo(currentRepo.Path, currentRepo.DSPDir)
+		if err != nil {
+			return fmt.Errorf("failed to load repository configuration: %w", err)
+		}
+		seal := repoConfig.EncryptAtRest
+
+		if interval == 0 {
+			return pull(c, location, dspDir, seal, false)
+		}
+
+		// Poll until interrupted. A failed poll, such as an unmounted share,
+		// is reported and tried again at the next one.
+		fmt.Printf("Watching %s every %s; press Ctrl+C to stop\n", location, interval)
+		for {
+			if err := pull(c, location, dspDir, seal, true); err != nil {
+				if c.Context.Err() != nil {
+					return nil
+				}
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+			select {
+			case <-c.Context.Done():
+				return nil
+			case <-time.After(interval):
+			}
+		}
+	},
+}
+
+// pull downloads the bundles at the location that the repository has neither
+// received nor applied, sealing them if seal is set (encrypt_at_rest). When
+// watching, nothing is printed if there are none.
+func pull(c *cli.Context, location transport.Transport, dspDir string, seal, watching bool) error {
+	bundlesDir := filepath.Join(dspDir, "bundles")
+	applied, err := ledger.Load(dspDir)
+	if err != nil {
+		return err
+	}
+
+	// Find the bundles not received or applied yet
+	names, err := location.List(c.Context)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	manifests := make(map[string]bool)
+	parity := make(map[string]bool)
+	for _, name := range names {
+		if transport.IsManifest(name) {
+			manifests[strings.TrimSuffix(name, transport.ManifestSuffix)] = true
+		}
+		if strings.HasSuffix(name, bundle.ParitySuffix) {
+			parity[strings.TrimSuffix(name, bundle.ParitySuffix)] = true
+		}
+	}
+	var wanted []string
+	for _, name := range names {
+		id, ok := bundleID(name)
+		if !ok || applied.IsApplied(id) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(bundlesDir, name)); err == nil {
+			continue
+		}
+		wanted = append(wanted, name)
+	}
+	if len(wanted) == 0 {
+		if !watching {
+			fmt.Printf("No new bundles at %s\n", location)
+		}
+		return nil
+	}
+	if c.Bool("dry-run") {
+		fmt.Printf("Would download %d bundles from %s:\n", len(wanted), location)
+		for _, name := range wanted {
+			fmt.Printf("  %s\n", name)
+		}
+		return nil
+	}
+
+	// Download each one under a temporary name, checking it against its
+	// manifest before it is moved into place
+	if err := os.MkdirAll(bundlesDir, 0755); err != nil {
+		return fmt.Errorf("failed to create bundles directory: %w", err)
+	}
+	var pulled []string
+	for _, name := range wanted {
+		dest := filepath.Join(bundlesDir, name)
+		if !manifests[name] {
+			fmt.Fprintf(os.Stderr, "Warning: %s has no manifest; its checksum cannot be verified\n", name)
+		}
+		if err := download(c, location, name, dest, manifests[name], parity[name], seal); err != nil {
+			return fmt.Errorf("failed to pull %s: %w", name, err)
+		}
+		pulled = append(pulled, dest)
+		fmt.Printf("Pulled %s\n", name)
+	}
+
+	fmt.Printf("\nDownloaded %d bundles from %s. Apply them in order with:\n", len(pulled), location)
+	for _, p := range pulled {
+		if strings.HasSuffix(p, ".age") {
+			fmt.Printf("  dsp crypto decrypt %s\n", p)
+			p = strings.TrimSuffix(p, ".age")
+		}
+		fmt.Printf("  dsp apply -b %s\n", p)
+	}
+	return nil
+}
+
+// download fetches one bundle to dest, verifying it against its manifest
+// if it has one. A bundle with a parity file is repaired with it first, and
+// the parity file is kept next to it. With seal a plain bundle is encrypted
+// at rest once verified.
+func download(c *cli.Context, location transport.Transport, name, dest string, hasManifest, hasParity, seal bool) error {
+	var manifest *transport.Manifest
+	if hasManifest {
+		var err error
+		if manifest, err = transport.GetManifest(c.Context, location, name); err != nil {
+			return err
+		}
+	}
+
+	tmp := dest + ".part"
+	defer os.Remove(tmp)
+	if err := location.Get(c.Context, name, tmp); err != nil {
+		return err
+	}
+	if hasParity {
+		defer os.Remove(tmp + bundle.ParitySuffix)
+		if err := location.Get(c.Context, name+bundle.ParitySuffix, tmp+bundle.ParitySuffix); err != nil {
+			return err
+		}
+		repaired, err := bundle.RepairWithParity(tmp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to check %s against its parity file: %v\n", name, err)
+		} else if repaired > 0 {
+			fmt.Printf("Repaired %d damaged blocks of %s with its parity file\n", repaired, name)
+		}
+	}
+	if manifest != nil {
+		if err := manifest.Verify(tmp); err != nil {
+			return protocol.VerificationError(err)
+		}
+	}
+	if strings.HasSuffix(name, ".zip") {
+		if _, err := bundle.Load(c.Context, tmp); err != nil {
+			return fmt.Errorf("downloaded file is not a valid bundle: %w", err)
+		}
+		if seal {
+			if err := bundle.Seal(tmp); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return fmt.Errorf("failed to save bundle: %w", err)
+	}
+	if hasParity {
+		if err := os.Rename(tmp+bundle.ParitySuffix, dest+bundle.ParitySuffix); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to save parity file of %s: %v\n", name, err)
+		}
+	}
+	return nil
+}
+
+// bundleID returns the bundle ID of a bundle file name, and false for files
+// that are not bundles
+func bundleID(name string) (string, bool) {
+	for _, suffix := range []string{".zip.age", ".zip"} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), true
+		}
+	}
+	return "", false
+}
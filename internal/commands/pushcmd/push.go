@@ -0,0 +1,184 @@
+package pushcmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/notify"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/transport"
+	"github.com/urfave/cli/v2"
+)
+
+var Command = &cli.Command{
+	Name:      "push",
+	Usage:     "Upload bundles to a drop location",
+	ArgsUsage: "[bundle...]",
+	Description: `Upload bundles to a drop location that other sites pull from with
+'dsp pull', without running 'dsp export'. Without arguments the newest bundle
+in <dsp-dir>/bundles is pushed.
+
+Locations:
+  sftp://[user@]host[:port]/path   A directory on an SSH server (scp:// works too).
+                                   /~/path is relative to the home directory.
+  webdavs://[user@]host[:port]/path
+                                   A WebDAV share over HTTPS (webdav:// for plain HTTP).
+                                   Set the password in DSP_WEBDAV_PASSWORD.
+  file:///path, or a plain path    A local directory, such as removable media.
+
+SFTP locations use the system sftp client in batch mode, so keys, agents,
+~/.ssh/config and known hosts apply as for ssh. Passwords are not prompted
+for; set up key authentication first. Files are uploaded under a hidden
+name and renamed when complete, so a pull never sees a partial bundle.
+
+WebDAV uploads are conditional: a new file is only created if it does not
+exist yet, and an existing one is only replaced if nobody changed it since it
+was looked up. The size of the stored file, and its SHA-256 on servers that
+keep checksums (OC-Checksum, as on ownCloud and Nextcloud), are checked after
+each upload.
+
+Each bundle is accompanied by <bundle>.manifest.json with its size, SHA-256,
+the pushing host and the time, which 'dsp pull' checks downloads against.
+Parity files written with 'dsp bundle --parity' are pushed along with their
+bundles.
+A directory on a shared network drive works as a dead drop: sites push into
+it and peers poll it with 'dsp pull --watch'.
+
+Examples:
+  # Push the newest bundle
+  dsp push --via sftp://sync@gateway.example.com/srv/dsp/field-team
+
+  # Push bundles and their encrypted copies
+  dsp push --via sftp://gateway/~/drop bundles/20240102.zip bundles/20240102.zip.age
+
+  # Push to a USB drive
+  dsp push --via /media/usb/dsp
+
+  # Push to a drop directory on a shared drive
+  dsp push --via file:///mnt/shared/dsp-drop`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "via",
+			Usage:    "Drop location: sftp://[user@]host[:port]/path, webdavs://[user@]host[:port]/path, file:///path or a directory",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    "repo",
+			Aliases: []string{"r"},
+			Usage:   "Path to the repository (default: nearest repository)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		location, err := transport.Open(c.String("via"))
+		if err != nil {
+			return err
+		}
+
+		// Pick the bundles to push
+		paths := c.Args().Slice()
+		if len(paths) == 0 {
+			newest, err := newestBundle(c.String("repo"))
+			if err != nil {
+				return err
+			}
+			paths = []string{newest}
+		}
+		for _, p := range paths {
+			if info, err := os.Stat(p); err != nil || !info.Mode().IsRegular() {
+				return fmt.Errorf("bundle %s is not a readable file", p)
+			}
+		}
+
+		globalConfig, err := config.LoadGlobal()
+		if err != nil {
+			return err
+		}
+
+		// Upload each with its manifest. The manifest goes first, so a reader
+		// that sees the bundle can always check it.
+		for _, p := range paths {
+			if err := pushBundle(c.Context, location, p, globalConfig.SecureDelete); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// pushBundle uploads a bundle, its manifest and its parity file. A bundle
+// sealed with encrypt_at_rest is uploaded as its plain archive; encrypted
+// copies for other hosts (.age) are uploaded as they are.
+func pushBundle(ctx context.Context, location transport.Transport, p string, secureDelete bool) error {
+	name := filepath.Base(p)
+	source := p
+	if strings.HasSuffix(name, ".zip") {
+		plain, cleanup, err := bundle.Plain(p, secureDelete)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", name, err)
+		}
+		defer cleanup()
+		source = plain
+	}
+
+	manifest, err := transport.NewManifest(source, name)
+	if err != nil {
+		return err
+	}
+	if err := transport.PutManifest(ctx, location, manifest); err != nil {
+		return fmt.Errorf("failed to push manifest of %s: %w", name, err)
+	}
+	if err := location.Put(ctx, source, name); err != nil {
+		return fmt.Errorf("failed to push %s: %w", name, err)
+	}
+	fmt.Printf("Pushed %s to %s\n", name, location)
+	notify.Send(notify.Event{
+		Event:   config.EventBundleExported,
+		Subject: strings.TrimSuffix(strings.TrimSuffix(name, ".age"), ".zip"),
+		Detail:  fmt.Sprintf("pushed to %s", location),
+	})
+
+	// Parity files travel with their bundles
+	if _, err := os.Stat(source + bundle.ParitySuffix); err == nil {
+		if err := location.Put(ctx, source+bundle.ParitySuffix, name+bundle.ParitySuffix); err != nil {
+			return fmt.Errorf("failed to push parity of %s: %w", name, err)
+		}
+		fmt.Printf("Pushed %s to %s\n", name+bundle.ParitySuffix, location)
+	}
+	return nil
+}
+
+// newestBundle returns the path of the newest bundle of the repository.
+// Bundle names start with their creation time, so the last name is newest.
+func newestBundle(repoFlag string) (string, error) {
+	manager, err := repo.NewManager()
+	if err != nil {
+		return "", fmt.Errorf("failed to create repository manager: %w", err)
+	}
+	currentRepo, err := manager.GetCurrentRepo(repoFlag)
+	if err != nil {
+		return "", fmt.Errorf("failed to get repository context: %w", err)
+	}
+
+	bundlesDir := filepath.Join(currentRepo.GetDSPDir(), "bundles")
+	entries, err := os.ReadDir(bundlesDir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read bundles directory: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), ".zip") {
+			names = append(names, entry.Name())
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no bundles found in %s; run 'dsp bundle' first", bundlesDir)
+	}
+	sort.Strings(names)
+	return filepath.Join(bundlesDir, names[len(names)-1]), nil
+}
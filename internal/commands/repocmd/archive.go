@@ -0,0 +1,413 @@
+package repocmd
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/hooks"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/Mattddixo/dsp/pkg/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// archiveFormatVersion is the version of the repository archive layout
+const archiveFormatVersion = 1
+
+// archiveManifestName is the name of the manifest entry inside an archive
+const archiveManifestName = "manifest.json"
+
+// ArchiveManifest describes the contents of a repository archive
+type ArchiveManifest struct {
+	FormatVersion int                `json:"format_version"`
+	Name          string             `json:"name"`          // Repository name at archive time
+	OriginalPath  string             `json:"original_path"` // Repository root at archive time
+	DSPDir        string             `json:"dsp_dir"`       // DSP directory name relative to the root
+	DataDir       string             `json:"data_dir"`      // Data directory relative to the root
+	CreatedAt     time.Time          `json:"created_at"`
+	CreatedBy     string             `json:"created_by"`
+	Files         []ArchiveFileEntry `json:"files"`
+}
+
+// ArchiveFileEntry describes a single file stored in an archive
+type ArchiveFileEntry struct {
+	Path string `json:"path"` // Slash-separated path relative to the repository root
+	Size int64  `json:"size"`
+	Hash string `json:"hash"` // SHA-256 of the file content
+}
+
+// archiveRepository packs a repository's DSP metadata into a single compressed archive
+func archiveRepository(manager *repo.Manager, repoArg, archivePath string) error {
+	currentRepo, err := manager.GetRepository(repoArg)
+	if err != nil {
+		return fmt.Errorf("failed to get repository: %w", err)
+	}
+
+	dspDir := currentRepo.GetDSPDir()
+	repoConfig, err := loadRepoConfig(dspDir)
+	if err != nil {
+		return err
+	}
+
+	// Default archive name is based on the repository name and current time
+	if archivePath == "" {
+		archivePath = fmt.Sprintf("%s-%s.zip", currentRepo.Name, time.Now().Format("20060102-150405"))
+	}
+	absArchivePath, err := filepath.Abs(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	// Refuse to write the archive into the directories being archived
+	if inside, _ := snapshot.IsPathInRepository(absArchivePath, dspDir); inside {
+		return fmt.Errorf("archive cannot be written inside the DSP directory %s", dspDir)
+	}
+
+	// Collect directories to archive: the DSP directory, plus the data directory
+	// when it lives inside the repository but outside the DSP directory
+	roots := []string{dspDir}
+	dataDir := filepath.Join(currentRepo.Path, repoConfig.DataDir)
+	if !filepath.IsAbs(repoConfig.DataDir) {
+		inDsp, _ := snapshot.IsPathInRepository(dataDir, dspDir)
+		inRepo, _ := snapshot.IsPathInRepository(dataDir, currentRepo.Path)
+		if !inDsp && inRepo {
+			if _, err := os.Stat(dataDir); err == nil {
+				roots = append(roots, dataDir)
+			}
+		}
+	}
+
+	manifest := ArchiveManifest{
+		FormatVersion: archiveFormatVersion,
+		Name:          currentRepo.Name,
+		OriginalPath:  currentRepo.Path,
+		DSPDir:        currentRepo.DSPDir,
+		DataDir:       repoConfig.DataDir,
+		CreatedAt:     time.Now(),
+		CreatedBy:     config.CurrentUser(),
+	}
+
+	// Gather files to archive
+	var files []string
+	for _, root := range roots {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to scan %s: %w", root, err)
+		}
+	}
+
+	// Create archive
+	zw, err := utils.NewZipWriter(absArchivePath, manifest.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %w", err)
+	}
+	defer zw.Close()
+
+	for _, path := range files {
+		relPath, err := filepath.Rel(currentRepo.Path, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
+		entry, err := addFileToArchive(zw, path, filepath.ToSlash(relPath))
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, *entry)
+	}
+
+	// Write manifest last so it reflects every stored file
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal archive manifest: %w", err)
+	}
+	if err := zw.WriteEntry(archiveManifestName, zip.Deflate, manifestData); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	if err := zw.Commit(); err != nil {
+		return fmt.Errorf("failed to finalize archive: %w", err)
+	}
+
+	fmt.Printf("Archived repository '%s' to %s\n", currentRepo.Name, absArchivePath)
+	fmt.Printf("  Files: %d\n", len(manifest.Files))
+	fmt.Printf("Restore it with: dsp repo restore-archive %s <new-root>\n", absArchivePath)
+	return nil
+}
+
+// addFileToArchive compresses a single file into the archive and returns its manifest entry
+func addFileToArchive(zw *utils.ZipWriter, path, name string) (*ArchiveFileEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive header: %w", err)
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hash while copying so the file is only read once
+	hasher, err := utils.GetHasher("sha256")
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(io.MultiWriter(w, hasher), file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to archive %s: %w", path, err)
+	}
+
+	return &ArchiveFileEntry{
+		Path: name,
+		Size: size,
+		Hash: fmt.Sprintf("%x", hasher.Sum(nil)),
+	}, nil
+}
+
+// restoreArchive unpacks a repository archive into a new root and registers it.
+// Hook scripts in the archive run on the next snapshot or apply, so they are
+// only restored with withHooks.
+func restoreArchive(ctx context.Context, manager *repo.Manager, archivePath, newRoot, name string, force, withHooks bool) error {
+	absRoot, err := filepath.Abs(newRoot)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer zr.Close()
+
+	// Read manifest
+	manifest, err := readArchiveManifest(&zr.Reader)
+	if err != nil {
+		return err
+	}
+	if manifest.FormatVersion > archiveFormatVersion {
+		return fmt.Errorf("archive format version %d is newer than supported version %d", manifest.FormatVersion, archiveFormatVersion)
+	}
+
+	if name == "" {
+		name = manifest.Name
+	}
+	if err := manager.CheckName(name, absRoot); err != nil && !force {
+		return fmt.Errorf("%w. Provide a different name: dsp repo restore-archive <archive> <new-root> <name>, or use --force to use it anyway", err)
+	}
+
+	// The DSP directory name comes from the archive, so it must not point
+	// outside the new root
+	if err := checkDSPDirName(manifest.DSPDir); err != nil {
+		return err
+	}
+
+	// Refuse to overwrite an existing DSP directory, or anything else the
+	// archive restores
+	dspDir := filepath.Join(absRoot, manifest.DSPDir)
+	expected := make(map[string]ArchiveFileEntry, len(manifest.Files))
+	tops := map[string]bool{manifest.DSPDir: true}
+	for _, f := range manifest.Files {
+		expected[f.Path] = f
+		tops[strings.SplitN(f.Path, "/", 2)[0]] = true
+	}
+	for top := range tops {
+		if _, err := os.Lstat(filepath.Join(absRoot, top)); err == nil {
+			if top == manifest.DSPDir {
+				return fmt.Errorf("DSP directory already exists at %s", dspDir)
+			}
+			return fmt.Errorf("%s already exists in %s", top, absRoot)
+		}
+	}
+
+	// Extract into a staging directory in the new root, so a corrupted
+	// archive leaves nothing behind, and move the files into place once
+	// every hash is verified
+	_, statErr := os.Stat(absRoot)
+	if err := os.MkdirAll(absRoot, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", absRoot, err)
+	}
+	if os.IsNotExist(statErr) {
+		// Remove the new root again if the restore fails; it is empty then
+		defer os.Remove(absRoot)
+	}
+	staging, err := os.MkdirTemp(absRoot, ".dsp-restore-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	// Extract the archive, within the extraction limits, and verify each
+	// file listed in the manifest
+	if err := utils.ExtractZipArchive(ctx, archivePath, staging, utils.ExtractOptions{}); err != nil {
+		return fmt.Errorf("failed to extract archive: %w", err)
+	}
+	if err := os.Remove(filepath.Join(staging, archiveManifestName)); err != nil {
+		return fmt.Errorf("failed to remove extracted manifest: %w", err)
+	}
+	hooksPrefix := manifest.DSPDir + "/" + hooks.DirName + "/"
+	restored, skippedHooks := 0, 0
+	err = filepath.Walk(staging, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(staging, path)
+		if err != nil {
+			return err
+		}
+		entry, ok := expected[filepath.ToSlash(rel)]
+		if !ok {
+			return fmt.Errorf("archive contains unexpected file %s", filepath.ToSlash(rel))
+		}
+		if err := verifyArchiveFile(path, entry); err != nil {
+			return err
+		}
+		delete(expected, entry.Path)
+		if !withHooks && strings.HasPrefix(entry.Path, hooksPrefix) {
+			skippedHooks++
+			return nil
+		}
+		restored++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(expected) > 0 {
+		return fmt.Errorf("archive is incomplete: %d files listed in the manifest are missing", len(expected))
+	}
+	if skippedHooks > 0 {
+		if err := os.RemoveAll(filepath.Join(staging, manifest.DSPDir, hooks.DirName)); err != nil {
+			return fmt.Errorf("failed to leave out hooks: %w", err)
+		}
+	}
+
+	// Move the verified files into place
+	for top := range tops {
+		if _, err := os.Lstat(filepath.Join(staging, top)); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(filepath.Join(staging, top), filepath.Join(absRoot, top)); err != nil {
+			return fmt.Errorf("failed to move %s into place: %w", top, err)
+		}
+	}
+
+	// Point tracked paths at the new root
+	trackingConfig, err := snapshot.LoadTrackingConfig(dspDir)
+	if err != nil {
+		return fmt.Errorf("failed to load restored tracking config: %w", err)
+	}
+	rebased := snapshot.RebaseTrackedPaths(trackingConfig, manifest.OriginalPath, absRoot)
+	if err := snapshot.SaveTrackingConfig(dspDir, trackingConfig); err != nil {
+		return fmt.Errorf("failed to save tracking config: %w", err)
+	}
+
+	// Register the restored repository
+	if err := manager.AddRepository(dspDir, name, false, force); err != nil {
+		return fmt.Errorf("failed to register restored repository: %w", err)
+	}
+
+	fmt.Printf("Restored repository '%s' to %s\n", name, absRoot)
+	fmt.Printf("  Files restored: %d\n", restored)
+	fmt.Printf("  Tracked paths rebased: %d\n", rebased)
+	fmt.Printf("  Archived from: %s (%s)\n", manifest.OriginalPath, manifest.CreatedAt.Format("2006-01-02 15:04:05"))
+	if skippedHooks > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: left out %d hook scripts from the archive, as they would run on the next snapshot or apply; review them and copy them to %s, or restore with --with-hooks\n",
+			skippedHooks, hooks.Dir(dspDir))
+	}
+	return nil
+}
+
+// checkDSPDirName checks that the DSP directory name of an archive is a
+// single path component
+func checkDSPDirName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) ||
+		filepath.VolumeName(name) != "" || filepath.Clean(name) != name {
+		return fmt.Errorf("archive names an invalid DSP directory %q", name)
+	}
+	return nil
+}
+
+// readArchiveManifest reads and parses the manifest entry of an archive
+func readArchiveManifest(zr *zip.Reader) (*ArchiveManifest, error) {
+	for _, f := range zr.File {
+		if f.Name != archiveManifestName {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open archive manifest: %w", err)
+		}
+		defer rc.Close()
+
+		var manifest ArchiveManifest
+		if err := json.NewDecoder(rc).Decode(&manifest); err != nil {
+			return nil, fmt.Errorf("failed to parse archive manifest: %w", err)
+		}
+		return &manifest, nil
+	}
+	return nil, fmt.Errorf("archive has no %s; it was not created by 'dsp repo archive'", archiveManifestName)
+}
+
+// verifyArchiveFile checks an extracted file against its manifest entry
+func verifyArchiveFile(path string, entry ArchiveFileEntry) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", entry.Path, err)
+	}
+	defer file.Close()
+
+	hasher, err := utils.GetHasher("sha256")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(hasher, file); err != nil {
+		return fmt.Errorf("failed to read %s: %w", entry.Path, err)
+	}
+	if hash := fmt.Sprintf("%x", hasher.Sum(nil)); hash != entry.Hash {
+		return fmt.Errorf("hash mismatch for %s: archive is corrupted", entry.Path)
+	}
+	return nil
+}
+
+// loadRepoConfig reads the config.yaml from a DSP directory
+func loadRepoConfig(dspDir string) (*config.Config, error) {
+	configPath := filepath.Join(dspDir, "config.yaml")
+	configData, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository config: %w", err)
+	}
+
+	var repoConfig config.Config
+	if err := yaml.Unmarshal(configData, &repoConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse repository config: %w", err)
+	}
+	return &repoConfig, nil
+}
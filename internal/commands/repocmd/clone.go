@@ -0,0 +1,124 @@
+package repocmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// cloneRepository copies a repository definition (configuration, tracking and
+// latest snapshot) to a new root and registers the copy with the manager
+func cloneRepository(manager *repo.Manager, sourceArg, destPath, name string, force bool) error {
+	sourceRepo, err := manager.GetRepository(sourceArg)
+	if err != nil {
+		return fmt.Errorf("failed to get source repository: %w", err)
+	}
+
+	absDest, err := filepath.Abs(destPath)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	if absDest == sourceRepo.Path {
+		return fmt.Errorf("destination is the source repository root: %s", absDest)
+	}
+
+	// Use the destination directory name if no name is given
+	if name == "" {
+		name = filepath.Base(absDest)
+	}
+	if err := manager.CheckName(name, absDest); err != nil && !force {
+		return fmt.Errorf("%w. Provide a different name: dsp repo clone <source> <dest> <name>, or use --force to use it anyway", err)
+	}
+	for _, r := range manager.Repos {
+		if r.Path == absDest {
+			return fmt.Errorf("destination is already registered as repository '%s'", r.Name)
+		}
+	}
+
+	srcDspDir := sourceRepo.GetDSPDir()
+	dstDspDir := filepath.Join(absDest, sourceRepo.DSPDir)
+	if _, err := os.Stat(dstDspDir); err == nil {
+		return fmt.Errorf("DSP directory already exists at %s", dstDspDir)
+	}
+
+	repoConfig, err := loadRepoConfig(srcDspDir)
+	if err != nil {
+		return err
+	}
+
+	// Create directory structure
+	for _, dir := range []string{
+		dstDspDir,
+		filepath.Join(dstDspDir, "snapshots"),
+		filepath.Join(dstDspDir, "bundles"),
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+	if !filepath.IsAbs(repoConfig.DataDir) {
+		if err := os.MkdirAll(filepath.Join(absDest, repoConfig.DataDir), 0755); err != nil {
+			return fmt.Errorf("failed to create data directory: %w", err)
+		}
+	}
+
+	// Copy configuration files as-is
+	for _, name := range []string{"config.yaml", ".gitignore"} {
+		src := filepath.Join(srcDspDir, name)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := utils.CopyFile(src, filepath.Join(dstDspDir, name)); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", name, err)
+		}
+	}
+
+	// Copy tracking configuration with paths rewritten for the new root
+	trackingConfig, err := snapshot.LoadTrackingConfig(srcDspDir)
+	if err != nil {
+		return fmt.Errorf("failed to load tracking config: %w", err)
+	}
+	rebased := snapshot.RebaseTrackedPaths(trackingConfig, sourceRepo.Path, absDest)
+	trackingConfig.State = snapshot.RepositoryState{LastModified: time.Now()}
+	if err := snapshot.SaveTrackingConfig(dstDspDir, trackingConfig); err != nil {
+		return fmt.Errorf("failed to save tracking config: %w", err)
+	}
+
+	// Copy the latest snapshot so the clone starts from the same baseline
+	snapshotID, latest, err := snapshot.LoadLatest(srcDspDir)
+	if err != nil {
+		snapshotID = ""
+	} else {
+		latest.RebasePaths(sourceRepo.Path, absDest)
+		snapshotDir := filepath.Join(dstDspDir, "snapshots", snapshotID)
+		if err := os.MkdirAll(snapshotDir, 0755); err != nil {
+			return fmt.Errorf("failed to create snapshot directory: %w", err)
+		}
+		if err := latest.Save(filepath.Join(snapshotDir, "snapshot.json")); err != nil {
+			return fmt.Errorf("failed to copy latest snapshot: %w", err)
+		}
+	}
+
+	// Register the clone
+	if err := manager.InitializeRepository(absDest, name, false, sourceRepo.DSPDir, force); err != nil {
+		return fmt.Errorf("failed to register cloned repository: %w", err)
+	}
+
+	fmt.Printf("Cloned repository '%s' to '%s' at %s\n", sourceRepo.Name, name, absDest)
+	fmt.Printf("  Tracked paths: %d (%d rewritten for the new root)\n", len(trackingConfig.Paths), rebased)
+	if snapshotID != "" {
+		fmt.Printf("  Baseline snapshot: %s\n", snapshotID)
+	} else {
+		fmt.Printf("  No snapshots to copy\n")
+	}
+	if outside := len(trackingConfig.Paths) - rebased; outside > 0 {
+		fmt.Printf("Note: %d tracked paths are outside the source root and were kept unchanged.\n", outside)
+	}
+	return nil
+}
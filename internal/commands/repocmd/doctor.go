@@ -0,0 +1,308 @@
+package repocmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"gopkg.in/yaml.v3"
+)
+
+// doctorIssue describes a single problem found by the health check
+type doctorIssue struct {
+	Severity string // "error" or "warning"
+	Subject  string // What the issue is about (repository name, key file, ...)
+	Problem  string // What is wrong
+	Fix      string // Suggested fix
+}
+
+// doctorReport collects issues found by the health check
+type doctorReport struct {
+	issues []doctorIssue
+	checks int
+}
+
+// errorf records an error-level issue
+func (r *doctorReport) errorf(subject, fix, format string, args ...interface{}) {
+	r.issues = append(r.issues, doctorIssue{
+		Severity: "error",
+		Subject:  subject,
+		Problem:  fmt.Sprintf(format, args...),
+		Fix:      fix,
+	})
+}
+
+// warnf records a warning-level issue
+func (r *doctorReport) warnf(subject, fix, format string, args ...interface{}) {
+	r.issues = append(r.issues, doctorIssue{
+		Severity: "warning",
+		Subject:  subject,
+		Problem:  fmt.Sprintf(format, args...),
+		Fix:      fix,
+	})
+}
+
+// runDoctor validates the global repository registry, each repository's
+// metadata and the local key material, and prints suggested fixes
+func runDoctor(manager *repo.Manager, verbose, quiet bool) error {
+	report := &doctorReport{}
+
+	if !quiet {
+		fmt.Printf("Checking %d registered repositories (%s)...\n", len(manager.Repos), manager.ConfigPath)
+	}
+
+	// Check global registry references
+	checkRegistry(manager, report)
+
+	// Check each registered repository
+	for i := range manager.Repos {
+		r := &manager.Repos[i]
+		if verbose && !quiet {
+			fmt.Printf("  - %s (%s)\n", r.Name, r.Path)
+		}
+		checkRepository(r, report)
+	}
+
+	// Check key material
+	if !quiet {
+		fmt.Println("Checking key material...")
+	}
+	checkKeys(report)
+
+	// Print report
+	errors, warnings := 0, 0
+	for _, issue := range report.issues {
+		if issue.Severity == "error" {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+
+	if len(report.issues) == 0 {
+		if !quiet {
+			fmt.Printf("\nAll %d checks passed. No problems found.\n", report.checks)
+		}
+		return nil
+	}
+
+	fmt.Printf("\nFound %d errors and %d warnings:\n", errors, warnings)
+	for _, issue := range report.issues {
+		fmt.Printf("\n[%s] %s: %s\n", strings.ToUpper(issue.Severity), issue.Subject, issue.Problem)
+		if issue.Fix != "" {
+			fmt.Printf("  Suggested fix: %s\n", issue.Fix)
+		}
+	}
+
+	if errors > 0 {
+		return fmt.Errorf("health check found %d errors", errors)
+	}
+	return nil
+}
+
+// checkRegistry validates default/working references and duplicate entries in repos.yaml
+func checkRegistry(manager *repo.Manager, report *doctorReport) {
+	seenNames := make(map[string]bool)
+	seenPaths := make(map[string]bool)
+	for _, r := range manager.Repos {
+		report.checks++
+		if seenNames[r.Name] {
+			report.errorf("registry", "rename one of them with 'dsp repo rename <repo> <new-name>'",
+				"repository name '%s' is registered more than once", r.Name)
+		}
+		if seenPaths[r.Path] {
+			report.errorf("registry", "remove the duplicate with 'dsp repo remove <repo>'",
+				"repository path %s is registered more than once", r.Path)
+		}
+		seenNames[r.Name] = true
+		seenPaths[r.Path] = true
+	}
+
+	report.checks++
+	if manager.DefaultRepo != "" && !seenPaths[manager.DefaultRepo] {
+		report.errorf("registry", "run 'dsp repo unset-default' or set a new default with 'dsp repo set-default <repo>'",
+			"default repository %s is not registered", manager.DefaultRepo)
+	}
+
+	report.checks++
+	if manager.WorkingRepo != "" && !seenPaths[manager.WorkingRepo] {
+		report.errorf("registry", "run 'dsp use --unset' or select a repository with 'dsp use <repo>'",
+			"working repository %s is not registered", manager.WorkingRepo)
+	}
+}
+
+// checkRepository validates a single registered repository
+func checkRepository(r *repo.Repository, report *doctorReport) {
+	subject := fmt.Sprintf("repository '%s'", r.Name)
+
+	// Repository root must exist
+	report.checks++
+	if info, err := os.Stat(r.Path); err != nil || !info.IsDir() {
+		report.errorf(subject, fmt.Sprintf("restore the directory or unregister it with 'dsp repo remove %s'", r.Name),
+			"repository root %s does not exist", r.Path)
+		return
+	}
+
+	// DSP directory must exist
+	dspDir := r.GetDSPDir()
+	report.checks++
+	if info, err := os.Stat(dspDir); err != nil || !info.IsDir() {
+		report.errorf(subject, fmt.Sprintf("re-add the repository with 'dsp repo add %s <dsp-dir>' or unregister it", r.Name),
+			"DSP directory %s does not exist", dspDir)
+		return
+	}
+
+	// config.yaml must parse and agree with the registry
+	report.checks++
+	configPath := filepath.Join(dspDir, "config.yaml")
+	var repoConfig config.Config
+	if data, err := os.ReadFile(configPath); err != nil {
+		report.errorf(subject, "run 'dsp init' in the repository root to recreate the configuration",
+			"cannot read %s: %v", configPath, err)
+	} else if err := yaml.Unmarshal(data, &repoConfig); err != nil {
+		report.errorf(subject, "fix the YAML syntax in config.yaml",
+			"cannot parse %s: %v", configPath, err)
+	} else if repoConfig.DSPDir != "" && filepath.Clean(repoConfig.DSPDir) != filepath.Clean(r.DSPDir) {
+		report.errorf(subject, fmt.Sprintf("set dsp_dir to '%s' in config.yaml or re-add the repository", r.DSPDir),
+			"config.yaml declares DSP directory '%s' but the registry uses '%s'", repoConfig.DSPDir, r.DSPDir)
+	}
+
+	// tracking.yaml must exist and parse
+	report.checks++
+	trackingPath := filepath.Join(dspDir, "tracking.yaml")
+	var trackingConfig *snapshot.TrackingConfig
+	if _, err := os.Stat(trackingPath); err != nil {
+		report.errorf(subject, "run 'dsp init' in the repository root to recreate the tracking configuration",
+			"tracking configuration %s is missing", trackingPath)
+	} else if tc, err := snapshot.LoadTrackingConfig(dspDir); err != nil {
+		report.errorf(subject, "fix the YAML syntax in tracking.yaml", "%v", err)
+	} else {
+		trackingConfig = tc
+	}
+
+	if trackingConfig != nil {
+		report.checks++
+		if snapshot.IsRepositoryClosed(trackingConfig) {
+			report.warnf(subject, fmt.Sprintf("reopen it with 'dsp repo reopen %s'", r.Name),
+				"repository is registered but marked as closed")
+		}
+
+		for _, p := range trackingConfig.Paths {
+			report.checks++
+			if _, err := os.Stat(p.Path); os.IsNotExist(err) {
+				report.warnf(subject, fmt.Sprintf("restore it or stop tracking it with 'dsp untrack --path %s'", p.Path),
+					"tracked path %s does not exist", p.Path)
+			}
+		}
+	}
+
+	checkSnapshots(subject, dspDir, report)
+	checkBundles(subject, dspDir, report)
+}
+
+// checkSnapshots looks for snapshot directories that have no readable snapshot
+func checkSnapshots(subject, dspDir string, report *doctorReport) {
+	snapshotsDir := filepath.Join(dspDir, "snapshots")
+	entries, err := os.ReadDir(snapshotsDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			report.warnf(subject, "", "cannot read snapshots directory: %v", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		report.checks++
+		entryPath := filepath.Join(snapshotsDir, entry.Name())
+		if !entry.IsDir() {
+			report.warnf(subject, fmt.Sprintf("remove %s", entryPath),
+				"unexpected file in snapshots directory: %s", entry.Name())
+			continue
+		}
+		if _, err := snapshot.Load(filepath.Join(entryPath, "snapshot.json")); err != nil {
+			report.warnf(subject, fmt.Sprintf("remove the orphaned directory %s", entryPath),
+				"snapshot %s has no readable snapshot.json", entry.Name())
+		}
+	}
+}
+
+// checkBundles looks for leftover temporary files and unreadable bundle archives
+func checkBundles(subject, dspDir string, report *doctorReport) {
+	bundlesDir := filepath.Join(dspDir, "bundles")
+	entries, err := os.ReadDir(bundlesDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			report.warnf(subject, "", "cannot read bundles directory: %v", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		report.checks++
+		entryPath := filepath.Join(bundlesDir, entry.Name())
+		switch filepath.Ext(entry.Name()) {
+		case ".tmp":
+			if strings.Contains(entry.Name(), ".plain-") {
+				report.warnf(subject, fmt.Sprintf("remove %s", entryPath),
+					"leftover decrypted copy %s of a sealed bundle", entry.Name())
+				continue
+			}
+			report.warnf(subject, fmt.Sprintf("remove %s", entryPath),
+				"leftover temporary download %s", entry.Name())
+		case ".zip":
+			// Bundles sealed with encrypt_at_rest are decrypted to be read
+			r, err := bundle.OpenReader(entryPath)
+			if err != nil {
+				report.warnf(subject, fmt.Sprintf("remove or re-create %s", entryPath),
+					"bundle %s is not a readable archive: %v", entry.Name(), err)
+				continue
+			}
+			r.Close()
+		}
+	}
+}
+
+// checkKeys verifies that key material exists and is not placeholder content
+func checkKeys(report *doctorReport) {
+	keyManager, err := crypto.NewKeyManager()
+	if err != nil {
+		report.checks++
+		report.errorf("keys", "check permissions on the global DSP directory", "cannot open key store: %v", err)
+		return
+	}
+
+	keyFiles := []struct {
+		name string
+		path string
+	}{
+		{"age private key", keyManager.GetPrivateKeyPath()},
+		{"age public key", keyManager.GetPublicKeyPath()},
+		{"signing private key", keyManager.GetSigningKeyPath()},
+		{"signing public key", keyManager.GetSigningPublicKeyPath()},
+		{"TLS certificate", keyManager.GetCertificatePath()},
+		{"TLS certificate key", keyManager.GetCertificateKeyPath()},
+	}
+
+	for _, kf := range keyFiles {
+		report.checks++
+		data, err := os.ReadFile(kf.path)
+		if err != nil {
+			report.errorf("keys", "run 'dsp crypto init' to generate missing keys",
+				"%s is missing (%s)", kf.name, kf.path)
+			continue
+		}
+		if strings.Contains(string(data), "placeholder") || len(strings.TrimSpace(string(data))) == 0 {
+			report.errorf("keys", fmt.Sprintf("delete %s and run 'dsp crypto init' to generate a real key", kf.path),
+				"%s contains placeholder content", kf.name)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package repocmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/audit"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/urfave/cli/v2"
+)
+
+// closeCommand marks a repository closed while keeping it registered
+var closeCommand = &cli.Command{
+	Name:  "close",
+	Usage: "Mark a repository closed, optionally after a final snapshot and archive bundle",
+	Description: `Mark a repository closed. A closed repository stays registered and keeps its
+snapshots and bundles, but no longer accepts new tracked paths. Who closed it,
+when and why are recorded in its tracking state and in the audit log.
+
+With --snapshot a final snapshot is taken first. With --bundle a bundle of
+every file of the latest snapshot is written to <dsp-dir>/bundles as well, for
+archiving the repository's last state.
+
+Examples:
+  # Close a finished project
+  dsp repo close -m "survey complete" field-work
+
+  # Take a final snapshot and archive bundle, then close
+  dsp repo close --snapshot --bundle -m "handed over" field-work
+
+  # Reopen it later
+  dsp repo reopen field-work`,
+	ArgsUsage: "<repo>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "message",
+			Aliases: []string{"m"},
+			Usage:   "Why the repository is closed",
+		},
+		&cli.BoolFlag{
+			Name:  "snapshot",
+			Usage: "Take a final snapshot before closing",
+		},
+		&cli.BoolFlag{
+			Name:  "bundle",
+			Usage: "Write a bundle of every file of the latest snapshot before closing",
+		},
+	},
+	BashComplete: completeRepos,
+	Action:       closeRepo,
+}
+
+// reopenCommand reopens a closed repository
+var reopenCommand = &cli.Command{
+	Name:         "reopen",
+	Usage:        "Reopen a closed repository",
+	ArgsUsage:    "<repo>",
+	BashComplete: completeRepos,
+	Action:       reopenRepo,
+}
+
+// closeRepo takes the final snapshot and bundle asked for, then marks the
+// repository closed
+func closeRepo(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected exactly one repository argument")
+	}
+	manager, err := repo.NewManager()
+	if err != nil {
+		return fmt.Errorf("failed to create repository manager: %w", err)
+	}
+	currentRepo, err := manager.GetRepository(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("failed to get repository: %w", err)
+	}
+	dspDir := currentRepo.GetDSPDir()
+
+	trackingConfig, err := snapshot.LoadTrackingConfig(dspDir)
+	if err != nil {
+		return fmt.Errorf("failed to load tracking config: %w", err)
+	}
+	if snapshot.IsRepositoryClosed(trackingConfig) {
+		return fmt.Errorf("repository '%s' is already closed (by %s at %s)", currentRepo.Name,
+			trackingConfig.State.ClosedBy, trackingConfig.State.ClosedAt.Format("2006-01-02 15:04:05"))
+	}
+
+	reason := c.String("message")
+	message := "Final snapshot before closing"
+	if reason != "" {
+		message += ": " + reason
+	}
+
+	// The final snapshot and bundle are made by the snapshot and bundle
+	// commands, so hooks, the content store and lineage all apply
+	if c.Bool("snapshot") {
+		if err := c.App.RunContext(c.Context, []string{c.App.Name, "snapshot", "--repo", currentRepo.Path, "--message", message}); err != nil {
+			return fmt.Errorf("failed to take final snapshot: %w", err)
+		}
+	}
+	finalSnapshot := ""
+	if c.Bool("snapshot") || c.Bool("bundle") {
+		_, latest, err := snapshot.LoadLatest(dspDir)
+		if err != nil {
+			return fmt.Errorf("failed to load latest snapshot: %w", err)
+		}
+		finalSnapshot = latest.ID
+	}
+	finalBundle := ""
+	if c.Bool("bundle") {
+		finalBundle = filepath.Join(dspDir, "bundles", fmt.Sprintf("final-%s.zip", time.Now().Format("20060102150405")))
+		description := "Archive of " + currentRepo.Name + " at closing"
+		if reason != "" {
+			description += ": " + reason
+		}
+		if err := c.App.RunContext(c.Context, []string{c.App.Name, "bundle", "--repo", currentRepo.Path,
+			"--full", "--target", finalSnapshot, "--output", finalBundle, "--description", description}); err != nil {
+			return fmt.Errorf("failed to write archive bundle: %w", err)
+		}
+	}
+
+	// Reload the tracking config, which the snapshot may have changed
+	trackingConfig, err = snapshot.LoadTrackingConfig(dspDir)
+	if err != nil {
+		return fmt.Errorf("failed to load tracking config: %w", err)
+	}
+	if err := snapshot.CloseRepository(trackingConfig, config.CurrentUser(), reason); err != nil {
+		return err
+	}
+	if c.Bool("snapshot") {
+		trackingConfig.State.FinalSnapshot = finalSnapshot
+	}
+	trackingConfig.State.FinalBundle = finalBundle
+	if err := snapshot.SaveTrackingConfig(dspDir, trackingConfig); err != nil {
+		return fmt.Errorf("failed to save tracking config: %w", err)
+	}
+
+	detail := "closed at " + currentRepo.Path
+	if reason != "" {
+		detail += ": " + reason
+	}
+	audit.Record(audit.Event{Type: audit.RepoLifecycle, Subject: currentRepo.Name, Outcome: "closed", Detail: detail})
+
+	fmt.Printf("\nClosed repository '%s' (%s)\n", currentRepo.Name, currentRepo.Path)
+	if c.Bool("snapshot") {
+		fmt.Printf("  Final snapshot: %s\n", finalSnapshot)
+	}
+	if finalBundle != "" {
+		fmt.Printf("  Archive bundle: %s (snapshot %s)\n", finalBundle, finalSnapshot)
+	}
+	fmt.Printf("Reopen it with: dsp repo reopen %s\n", currentRepo.Name)
+	return nil
+}
+
+// reopenRepo marks a closed repository open again, keeping the record of
+// its close
+func reopenRepo(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected exactly one repository argument")
+	}
+	manager, err := repo.NewManager()
+	if err != nil {
+		return fmt.Errorf("failed to create repository manager: %w", err)
+	}
+	currentRepo, err := manager.GetRepository(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("failed to get repository: %w (re-add removed repositories with 'dsp repo add')", err)
+	}
+	dspDir := currentRepo.GetDSPDir()
+
+	trackingConfig, err := snapshot.LoadTrackingConfig(dspDir)
+	if err != nil {
+		return fmt.Errorf("failed to load tracking config: %w", err)
+	}
+	if err := snapshot.ReopenRepository(trackingConfig, config.CurrentUser()); err != nil {
+		return fmt.Errorf("cannot reopen '%s': %w", currentRepo.Name, err)
+	}
+	if err := snapshot.SaveTrackingConfig(dspDir, trackingConfig); err != nil {
+		return fmt.Errorf("failed to save tracking config: %w", err)
+	}
+
+	audit.Record(audit.Event{Type: audit.RepoLifecycle, Subject: currentRepo.Name, Outcome: "reopened", Detail: "reopened at " + currentRepo.Path})
+
+	fmt.Printf("Reopened repository '%s' (%s)\n", currentRepo.Name, currentRepo.Path)
+	fmt.Printf("  It was closed by %s at %s\n", trackingConfig.State.ClosedBy, trackingConfig.State.ClosedAt.Format("2006-01-02 15:04:05"))
+	return nil
+}
+
+// printCloseDetails prints why a closed repository was closed and what was
+// kept of its last state
+func printCloseDetails(state snapshot.RepositoryState) {
+	if state.CloseReason != "" {
+		fmt.Printf("  Close Reason: %s\n", state.CloseReason)
+	}
+	if state.FinalSnapshot != "" {
+		fmt.Printf("  Final Snapshot: %s\n", state.FinalSnapshot)
+	}
+	if state.FinalBundle != "" {
+		fmt.Printf("  Archive Bundle: %s\n", state.FinalBundle)
+	}
+}
+
+// printReopenDetails prints when an open repository was last reopened
+func printReopenDetails(state snapshot.RepositoryState) {
+	if state.ReopenedAt.IsZero() {
+		return
+	}
+	fmt.Printf("  Reopened At: %s by %s (closed %s by %s)\n", state.ReopenedAt.Format("2006-01-02 15:04:05"), state.ReopenedBy,
+		state.ClosedAt.Format("2006-01-02 15:04:05"), state.ClosedBy)
+}
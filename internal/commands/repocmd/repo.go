@@ -3,7 +3,6 @@ package repocmd
 import (
 	"bufio"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,6 +10,7 @@ import (
 	"github.com/Mattddixo/dsp/config"
 	"github.com/Mattddixo/dsp/internal/repo"
 	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/Mattddixo/dsp/pkg/utils"
 	"github.com/urfave/cli/v2"
 	"gopkg.in/yaml.v3"
 )
@@ -24,324 +24,536 @@ A DSP repository consists of a directory containing your files and a DSP directo
 (by default named .dsp) that stores tracking information, snapshots, and bundles. Requires dsp init to be run first.
 
 Repository Management:
-  dsp repo --add <name> <dsp-dir>     # Re-open a closed repository
-  dsp repo --move <repo> <path>       # Move a repository to a new location
-  dsp repo --set-default <repo>       # Set a repository as the default
-  dsp repo --unset-default            # Remove the default repository setting
+  dsp repo add <name> <dsp-dir>       # Re-open a closed repository
+  dsp repo move <repo> <path>         # Move a repository to a new location
+  dsp repo rename <repo> <new-name>   # Rename a repository
+  dsp repo remove <repo>              # Stop managing a repository
+  dsp repo close <repo>               # Mark a repository closed
+  dsp repo reopen <repo>              # Reopen a closed repository
+  dsp repo set-default <repo>         # Set a repository as the default
+  dsp repo unset-default              # Remove the default repository setting
+  dsp repo clone <repo> <dest> [name] # Copy a repository definition to a new root
+  dsp repo archive <repo> [file]      # Pack DSP metadata and history into one archive
+  dsp repo restore-archive <file> <root> [name]
+                                      # Restore an archived repository under a new root
 
 Repository Information:
-  dsp repo --list                     # List all managed repositories
-  dsp repo --show <repo>              # Show detailed repository information
-  dsp repo --status <repo>            # Show repository tracking state
+  dsp repo list                       # List all managed repositories
+  dsp repo show <repo>                # Show detailed repository information
+  dsp repo status [repo]              # Show repository tracking state
+  dsp repo doctor                     # Check all repositories and keys for problems
 
 Examples:
   # Re-open a closed repository with DSP directory at .test
-  dsp repo -a my-repo .test
+  dsp repo add my-repo .test
 
   # Show status of repository named "test"
-  dsp repo --status test
+  dsp repo status test
 
   # Show status of repository at specific path
-  dsp repo --status /path/to/repo
+  dsp repo status /path/to/repo
 
-  # List all repositories with detailed information
-  dsp repo --list --verbose
+  # Rename a repository; names are letters, digits, '.', '_' and '-'
+  dsp repo rename old-name new-name
+
+  # Move a repository from a script, without confirmation
+  dsp repo move --yes my-repo /srv/my-repo
+
+  # Stand up an identical tracking setup under another root
+  dsp repo clone my-repo /srv/copy
+
+  # Archive a repository for cold storage and restore it elsewhere
+  dsp repo archive my-repo my-repo.zip
+  dsp repo restore-archive my-repo.zip /srv/restored
+
+  # Diagnose problems after inheriting a machine
+  dsp repo doctor
+
+Run 'dsp repo <command> -h' for the options of a command. The flag forms of
+these commands (dsp repo --list, dsp repo -m <repo> <path>, ...) still work
+but are deprecated and will be removed in the next release.
 
 Note: Repository arguments can be specified by either name or path.
       The DSP directory should contain config.yaml and tracking.yaml.`,
-	Flags: []cli.Flag{
-		&cli.BoolFlag{
-			Name:     "add",
-			Aliases:  []string{"a"},
-			Usage:    "Add a closed repository (requires name and DSP directory path)",
-			Category: "Repository Management",
-		},
-		&cli.BoolFlag{
-			Name:     "list",
-			Aliases:  []string{"l"},
-			Usage:    "List all managed repositories",
-			Category: "Repository Management",
+	Subcommands: subcommands,
+	Flags:       legacyFlags(),
+	Action:      legacyAction,
+}
+
+// subcommands are the actions of dsp repo
+var subcommands = []*cli.Command{
+	{
+		Name:      "add",
+		Usage:     "Add a closed repository",
+		ArgsUsage: "<name> <dsp-dir>",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "force",
+				Aliases: []string{"f"},
+				Usage:   "Allow a name that is taken or has disallowed characters",
+			},
 		},
-		&cli.BoolFlag{
-			Name:     "move",
-			Aliases:  []string{"m"},
-			Usage:    "Move a repository to a new location (requires repository and new path)",
-			Category: "Repository Management",
+		Action: addRepo,
+	},
+	{
+		Name:    "list",
+		Aliases: []string{"ls"},
+		Usage:   "List all managed repositories",
+		Action:  listRepos,
+	},
+	{
+		Name:      "move",
+		Usage:     "Move a repository to a new location",
+		ArgsUsage: "<repo> <new-path>",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "yes",
+				Aliases: []string{"y"},
+				Usage:   "Do not ask for confirmation",
+			},
 		},
-		&cli.BoolFlag{
-			Name:     "remove",
-			Aliases:  []string{"r"},
-			Usage:    "Remove a repository from management (does not delete files)",
-			Category: "Repository Management",
+		BashComplete: completeRepos,
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 2 {
+				return fmt.Errorf("expected exactly two arguments: repository name/path and new path\n" +
+					"Usage: dsp repo move <repo> <new-path>\n" +
+					"Examples:\n" +
+					"  dsp repo move test C:\\new\\path\n" +
+					"  dsp repo move C:\\old\\path C:\\new\\path\n\n" +
+					"Note: This will move the entire repository, including all files and DSP metadata.")
+			}
+			manager, err := repo.NewManager()
+			if err != nil {
+				return fmt.Errorf("failed to create repository manager: %w", err)
+			}
+			return moveRepository(manager, c.Args().Get(0), c.Args().Get(1), c.Bool("yes"))
 		},
-		&cli.BoolFlag{
-			Name:     "rename",
-			Aliases:  []string{"n"},
-			Usage:    "Rename a repository (requires old and new names)",
-			Category: "Repository Management",
+	},
+	{
+		Name:      "rename",
+		Usage:     "Rename a repository",
+		ArgsUsage: "<repo> <new-name>",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "force",
+				Aliases: []string{"f"},
+				Usage:   "Allow a name that is taken or has disallowed characters",
+			},
 		},
-		&cli.BoolFlag{
-			Name:     "set-default",
-			Aliases:  []string{"d"},
-			Usage:    "Set a repository as the default for commands",
-			Category: "Repository Management",
+		BashComplete: completeRepos,
+		Action:       renameRepo,
+	},
+	{
+		Name:         "remove",
+		Aliases:      []string{"rm"},
+		Usage:        "Remove a repository from management (does not delete files)",
+		ArgsUsage:    "<repo>",
+		BashComplete: completeRepos,
+		Action:       removeRepo,
+	},
+	closeCommand,
+	reopenCommand,
+	{
+		Name:         "set-default",
+		Usage:        "Set a repository as the default for commands",
+		ArgsUsage:    "<repo>",
+		BashComplete: completeRepos,
+		Action:       setDefault,
+	},
+	{
+		Name:   "unset-default",
+		Usage:  "Remove the default repository setting",
+		Action: unsetDefault,
+	},
+	{
+		Name:         "show",
+		Usage:        "Show detailed repository information including configuration and tracking",
+		ArgsUsage:    "<repo>",
+		BashComplete: completeRepos,
+		Action:       showRepo,
+	},
+	{
+		Name:         "status",
+		Usage:        "Show repository tracking state and file statistics",
+		ArgsUsage:    "[repo]",
+		BashComplete: completeRepos,
+		Action:       showStatus,
+	},
+	{
+		Name:      "clone",
+		Usage:     "Copy a repository's configuration, tracking and latest snapshot to a new root",
+		ArgsUsage: "<source> <dest> [name]",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "force",
+				Aliases: []string{"f"},
+				Usage:   "Allow a name that is taken or has disallowed characters",
+			},
 		},
-		&cli.BoolFlag{
-			Name:     "unset-default",
-			Aliases:  []string{"D"},
-			Usage:    "Remove the default repository setting",
-			Category: "Repository Management",
+		BashComplete: completeRepos,
+		Action: func(c *cli.Context) error {
+			if c.NArg() < 2 || c.NArg() > 3 {
+				return fmt.Errorf("expected source repository, destination root and optional name\nUsage: dsp repo clone <source> <dest> [name]")
+			}
+			manager, err := repo.NewManager()
+			if err != nil {
+				return fmt.Errorf("failed to create repository manager: %w", err)
+			}
+			return cloneRepository(manager, c.Args().Get(0), c.Args().Get(1), c.Args().Get(2), c.Bool("force"))
 		},
-		&cli.BoolFlag{
-			Name:     "show",
-			Aliases:  []string{"s"},
-			Usage:    "Show detailed repository information including configuration and tracking",
-			Category: "Repository Information",
+	},
+	{
+		Name:         "archive",
+		Usage:        "Pack a repository's DSP metadata, snapshots and bundles into a compressed archive",
+		ArgsUsage:    "<repo> [archive.zip]",
+		BashComplete: completeRepos,
+		Action: func(c *cli.Context) error {
+			if c.NArg() < 1 || c.NArg() > 2 {
+				return fmt.Errorf("expected repository and optional archive path\nUsage: dsp repo archive <repo> [archive.zip]")
+			}
+			manager, err := repo.NewManager()
+			if err != nil {
+				return fmt.Errorf("failed to create repository manager: %w", err)
+			}
+			return archiveRepository(manager, c.Args().Get(0), c.Args().Get(1))
 		},
-		&cli.BoolFlag{
-			Name:     "status",
-			Aliases:  []string{"t"},
-			Usage:    "Show repository tracking state and file statistics",
-			Category: "Repository Information",
+	},
+	{
+		Name:      "restore-archive",
+		Usage:     "Restore a repository from an archive",
+		ArgsUsage: "<archive.zip> <new-root> [name]",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "force",
+				Aliases: []string{"f"},
+				Usage:   "Allow a name that is taken or has disallowed characters",
+			},
+			&cli.BoolFlag{
+				Name:  "with-hooks",
+				Usage: "Also restore the hook scripts in the archive, which run on the next snapshot or apply",
+			},
 		},
-		&cli.StringFlag{
-			Name:        "repo",
-			Aliases:     []string{"R"},
-			Usage:       "Specify target repository by name or path",
-			Category:    "Options",
-			DefaultText: "nearest repository",
+		Action: func(c *cli.Context) error {
+			if c.NArg() < 2 || c.NArg() > 3 {
+				return fmt.Errorf("expected archive path, new root and optional name\nUsage: dsp repo restore-archive <archive.zip> <new-root> [name]")
+			}
+			manager, err := repo.NewManager()
+			if err != nil {
+				return fmt.Errorf("failed to create repository manager: %w", err)
+			}
+			return restoreArchive(c.Context, manager, c.Args().Get(0), c.Args().Get(1), c.Args().Get(2), c.Bool("force"), c.Bool("with-hooks"))
 		},
-		&cli.BoolFlag{
-			Name:     "verbose",
-			Aliases:  []string{"v"},
-			Usage:    "Show detailed information in listings",
-			Category: "Output Options",
+	},
+	{
+		Name:  "doctor",
+		Usage: "Check registered repositories and key material for problems and suggest fixes",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Aliases: []string{"v"},
+				Usage:   "Also show the checks that passed",
+			},
+			&cli.BoolFlag{
+				Name:    "quiet",
+				Aliases: []string{"q"},
+				Usage:   "Only show problems",
+			},
 		},
-		&cli.BoolFlag{
-			Name:     "quiet",
-			Aliases:  []string{"q"},
-			Usage:    "Suppress non-error messages",
-			Category: "Output Options",
+		Action: func(c *cli.Context) error {
+			if c.NArg() > 0 {
+				return fmt.Errorf("unexpected arguments with doctor")
+			}
+			manager, err := repo.NewManager()
+			if err != nil {
+				return fmt.Errorf("failed to create repository manager: %w", err)
+			}
+			return runDoctor(manager, c.Bool("verbose"), c.Bool("quiet"))
 		},
 	},
-	Action: func(c *cli.Context) error {
-		manager, err := repo.NewManager()
-		if err != nil {
-			return fmt.Errorf("failed to create repository manager: %w", err)
-		}
+}
 
-		// Count how many actions are requested
-		actionCount := 0
-		actions := []string{
-			"add", "list", "move", "remove", "rename",
-			"set-default", "unset-default", "show", "status",
+// legacyActions are the subcommands that had a deprecated action flag, with
+// its short alias
+var legacyActions = map[string]string{
+	"add":             "a",
+	"list":            "l",
+	"move":            "m",
+	"remove":          "r",
+	"rename":          "n",
+	"set-default":     "d",
+	"unset-default":   "D",
+	"show":            "s",
+	"status":          "t",
+	"clone":           "",
+	"archive":         "",
+	"restore-archive": "",
+	"doctor":          "",
+}
+
+// legacyFlags returns the hidden flags of the deprecated 'dsp repo --<action>'
+// form: one per action, and the options of the actions
+func legacyFlags() []cli.Flag {
+	var flags []cli.Flag
+	for _, sub := range subcommands {
+		short, ok := legacyActions[sub.Name]
+		if !ok {
+			continue
 		}
-		for _, action := range actions {
-			if c.Bool(action) {
-				actionCount++
-			}
+		flag := &cli.BoolFlag{Name: sub.Name, Hidden: true}
+		if short != "" {
+			flag.Aliases = []string{short}
 		}
+		flags = append(flags, flag)
+	}
+	return append(flags,
+		&cli.StringFlag{Name: "repo", Aliases: []string{"R"}, Hidden: true},
+		&cli.BoolFlag{Name: "yes", Aliases: []string{"y"}, Hidden: true},
+		&cli.BoolFlag{Name: "force", Aliases: []string{"f"}, Hidden: true},
+		&cli.BoolFlag{Name: "verbose", Aliases: []string{"v"}, Hidden: true},
+		&cli.BoolFlag{Name: "quiet", Aliases: []string{"q"}, Hidden: true},
+	)
+}
 
-		if actionCount == 0 {
-			return fmt.Errorf("no action specified. Use --add, --list, --move, --remove, --rename, --set-default, --unset-default, --show, or --status")
+// legacyAction runs the subcommand named by a deprecated action flag, or
+// shows help without one
+func legacyAction(c *cli.Context) error {
+	var action *cli.Command
+	for _, sub := range subcommands {
+		if _, ok := legacyActions[sub.Name]; !ok || !c.Bool(sub.Name) {
+			continue
 		}
-		if actionCount > 1 {
+		if action != nil {
 			return fmt.Errorf("only one action can be specified at a time")
 		}
+		action = sub
+	}
+	if action == nil {
+		if c.NArg() > 0 {
+			return fmt.Errorf("unknown repo command '%s'. Run 'dsp repo -h' for the list of commands", c.Args().First())
+		}
+		return cli.ShowSubcommandHelp(c)
+	}
 
-		// Handle add action
-		if c.Bool("add") {
-			if c.NArg() != 2 {
-				return fmt.Errorf("expected exactly two arguments: repository name and DSP directory path\nUsage: dsp repo -a <name> <dsp-dir>\nExamples:\n  dsp repo -a my-repo .test\n  dsp repo -a my-repo C:\\path\\to\\repo\\.test\n\nNote: The DSP directory should contain config.yaml and tracking.yaml")
-			}
-			name := c.Args().Get(0)
-			dspPath := c.Args().Get(1)
-
-			// Convert DSP path to absolute path
-			absDspPath, err := filepath.Abs(dspPath)
-			if err != nil {
-				return fmt.Errorf("failed to get absolute path: %w", err)
-			}
+	fmt.Fprintf(os.Stderr, "Warning: 'dsp repo --%s' is deprecated and will be removed in the next release; use 'dsp repo %s'\n", action.Name, action.Name)
+	return action.Action(c)
+}
 
-			// Get repository root (parent of DSP directory)
-			repoPath := filepath.Dir(absDspPath)
-			dspDirName := filepath.Base(absDspPath)
+// completeRepos completes the first argument with the names of the
+// registered repositories
+func completeRepos(c *cli.Context) {
+	if c.NArg() > 0 {
+		return
+	}
+	manager, err := repo.NewManager()
+	if err != nil {
+		return
+	}
+	for _, r := range manager.Repos {
+		fmt.Println(r.Name)
+	}
+}
 
-			// Check if DSP directory exists
-			dspInfo, err := os.Stat(absDspPath)
-			if err != nil {
-				if os.IsNotExist(err) {
-					return fmt.Errorf("DSP directory does not exist: %s", absDspPath)
-				}
-				return fmt.Errorf("failed to access DSP directory: %w", err)
-			}
-			if !dspInfo.IsDir() {
-				return fmt.Errorf("DSP directory path must be a directory: %s", absDspPath)
-			}
+// addRepo re-opens a closed repository under a name
+func addRepo(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("expected exactly two arguments: repository name and DSP directory path\nUsage: dsp repo add <name> <dsp-dir>\nExamples:\n  dsp repo add my-repo .test\n  dsp repo add my-repo C:\\path\\to\\repo\\.test\n\nNote: The DSP directory should contain config.yaml and tracking.yaml")
+	}
+	manager, err := repo.NewManager()
+	if err != nil {
+		return fmt.Errorf("failed to create repository manager: %w", err)
+	}
+	name := c.Args().Get(0)
+	dspPath := c.Args().Get(1)
 
-			// Verify config.yaml exists
-			configPath := filepath.Join(absDspPath, "config.yaml")
-			if _, err := os.Stat(configPath); os.IsNotExist(err) {
-				return fmt.Errorf("no DSP configuration found at %s. Please use 'dsp init' to create a new repository", absDspPath)
-			}
+	// Convert DSP path to absolute path
+	absDspPath, err := filepath.Abs(dspPath)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
 
-			// Verify tracking.yaml exists
-			trackingPath := filepath.Join(absDspPath, "tracking.yaml")
-			if _, err := os.Stat(trackingPath); os.IsNotExist(err) {
-				return fmt.Errorf("no tracking configuration found at %s. Please use 'dsp init' to create a new repository", absDspPath)
-			}
+	// Get repository root (parent of DSP directory)
+	repoPath := filepath.Dir(absDspPath)
+	dspDirName := filepath.Base(absDspPath)
 
-			fmt.Printf("Adding repository '%s' at %s (DSP directory: %s)...\n", name, repoPath, dspDirName)
-			if err := manager.AddRepository(absDspPath, name, false); err != nil {
-				// Provide more helpful error messages
-				switch {
-				case strings.Contains(err.Error(), "no DSP configuration found"):
-					return fmt.Errorf("no DSP configuration found at %s. Please use 'dsp init' to create a new repository", absDspPath)
-				case strings.Contains(err.Error(), "no tracking configuration found"):
-					return fmt.Errorf("no tracking configuration found at %s. Please use 'dsp init' to create a new repository", absDspPath)
-				case strings.Contains(err.Error(), "not in a closed state"):
-					return fmt.Errorf("repository at %s is not in a closed state. Please use 'dsp repo --remove' first if you want to re-add it", repoPath)
-				default:
-					return fmt.Errorf("failed to add repository: %w", err)
-				}
-			}
-			fmt.Printf("Successfully added repository: %s (%s)\n", name, repoPath)
-			return nil
+	// Check if DSP directory exists
+	dspInfo, err := os.Stat(absDspPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("DSP directory does not exist: %s", absDspPath)
 		}
+		return fmt.Errorf("failed to access DSP directory: %w", err)
+	}
+	if !dspInfo.IsDir() {
+		return fmt.Errorf("DSP directory path must be a directory: %s", absDspPath)
+	}
 
-		// Handle list action
-		if c.Bool("list") {
-			return listRepos(c)
-		}
+	// Verify config.yaml exists
+	configPath := filepath.Join(absDspPath, "config.yaml")
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		return fmt.Errorf("no DSP configuration found at %s. Please use 'dsp init' to create a new repository", absDspPath)
+	}
 
-		// Handle move action
-		if c.Bool("move") {
-			if c.NArg() != 2 {
-				return fmt.Errorf("expected exactly two arguments: repository name/path and new path\n" +
-					"Usage: dsp repo --move <repo> <new-path>\n" +
-					"Examples:\n" +
-					"  dsp repo --move test C:\\new\\path\n" +
-					"  dsp repo --move C:\\old\\path C:\\new\\path\n\n" +
-					"Note: This will move the entire repository, including all files and DSP metadata.")
-			}
+	// Verify tracking.yaml exists
+	trackingPath := filepath.Join(absDspPath, "tracking.yaml")
+	if _, err := os.Stat(trackingPath); os.IsNotExist(err) {
+		return fmt.Errorf("no tracking configuration found at %s. Please use 'dsp init' to create a new repository", absDspPath)
+	}
 
-			return moveRepository(manager, c.Args().Get(0), c.Args().Get(1))
+	fmt.Printf("Adding repository '%s' at %s (DSP directory: %s)...\n", name, repoPath, dspDirName)
+	if err := manager.AddRepository(absDspPath, name, false, c.Bool("force")); err != nil {
+		// Provide more helpful error messages
+		switch {
+		case strings.Contains(err.Error(), "no DSP configuration found"):
+			return fmt.Errorf("no DSP configuration found at %s. Please use 'dsp init' to create a new repository", absDspPath)
+		case strings.Contains(err.Error(), "no tracking configuration found"):
+			return fmt.Errorf("no tracking configuration found at %s. Please use 'dsp init' to create a new repository", absDspPath)
+		case strings.Contains(err.Error(), "not in a closed state"):
+			return fmt.Errorf("repository at %s is not in a closed state. Please use 'dsp repo remove' first if you want to re-add it", repoPath)
+		default:
+			return fmt.Errorf("failed to add repository: %w", err)
 		}
+	}
+	fmt.Printf("Successfully added repository: %s (%s)\n", name, repoPath)
+	return nil
+}
 
-		// Handle rename action
-		if c.Bool("rename") {
-			if c.NArg() != 2 {
-				return fmt.Errorf("expected exactly two arguments: old name and new name")
-			}
-
-			// Get current repository
-			currentRepo, err := manager.GetRepository(c.Args().Get(0))
-			if err != nil {
-				return fmt.Errorf("failed to get repository: %w", err)
-			}
-
-			newName := c.Args().Get(1)
+// renameRepo gives a repository a new, unique name
+func renameRepo(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("expected exactly two arguments: old name and new name")
+	}
+	manager, err := repo.NewManager()
+	if err != nil {
+		return fmt.Errorf("failed to create repository manager: %w", err)
+	}
 
-			// Find the repository in the manager's list
-			for i, repo := range manager.Repos {
-				if repo.Path == currentRepo.Path {
-					// Update only the name
-					manager.Repos[i].Name = newName
+	// Get current repository
+	currentRepo, err := manager.GetRepository(c.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("failed to get repository: %w", err)
+	}
 
-					// Save manager state
-					if err := manager.Save(); err != nil {
-						return fmt.Errorf("failed to save manager state: %w", err)
-					}
+	newName := c.Args().Get(1)
+	if newName == "" {
+		return fmt.Errorf("new name must not be empty")
+	}
+	if err := repo.ValidateName(newName); err != nil {
+		if !c.Bool("force") {
+			return fmt.Errorf("%w; use --force to use it anyway", err)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
 
-					fmt.Printf("Renamed repository from '%s' to '%s'\n", currentRepo.Name, newName)
-					return nil
-				}
+	// Update only the name, holding the repos.yaml lock, so the
+	// uniqueness check sees every other registration
+	err = manager.Update(func() error {
+		if other := manager.NameTaken(newName, currentRepo.Path); other != nil {
+			if !c.Bool("force") {
+				return fmt.Errorf("name '%s' is already used by the repository at %s; use --force to use it anyway", newName, other.Path)
 			}
-
-			return fmt.Errorf("repository not found: '%s'", currentRepo.Name)
+			fmt.Fprintf(os.Stderr, "Warning: name '%s' is also used by the repository at %s; refer to these repositories by path\n", newName, other.Path)
 		}
-
-		// Handle remove action
-		if c.Bool("remove") {
-			if c.NArg() != 1 {
-				return fmt.Errorf("expected exactly one repository argument")
+		for i, repo := range manager.Repos {
+			if repo.Path == currentRepo.Path {
+				manager.Repos[i].Name = newName
+				return nil
 			}
+		}
+		return fmt.Errorf("repository not found: '%s'", currentRepo.Name)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rename repository: %w", err)
+	}
 
-			// Get repository details before removal
-			repo, err := manager.GetRepository(c.Args().Get(0))
-			if err != nil {
-				return fmt.Errorf("failed to get repository: %w", err)
-			}
+	fmt.Printf("Renamed repository from '%s' to '%s'\n", currentRepo.Name, newName)
 
-			if err := manager.RemoveRepository(c.Args().Get(0)); err != nil {
-				return fmt.Errorf("failed to remove repository: %w", err)
-			}
+	// The default and working repositories are kept by path and
+	// follow the rename; a shell session pinned by name does not
+	if envRepo := os.Getenv(repo.RepoEnv); envRepo == currentRepo.Name {
+		fmt.Printf("Note: %s=%s in this shell refers to the old name; update it with: eval \"$(dsp use --print-env %s)\"\n", repo.RepoEnv, envRepo, newName)
+	}
+	return nil
+}
 
-			fmt.Printf("Removed repository: %s (%s)\n", repo.Name, repo.Path)
-			fmt.Println("Note: Repository files were not deleted")
-			return nil
-		}
+// removeRepo stops managing a repository, leaving its files
+func removeRepo(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected exactly one repository argument")
+	}
+	manager, err := repo.NewManager()
+	if err != nil {
+		return fmt.Errorf("failed to create repository manager: %w", err)
+	}
 
-		// Handle set-default action
-		if c.Bool("set-default") {
-			if c.Bool("unset-default") {
-				return fmt.Errorf("cannot use --set-default and --unset-default together")
-			}
-			if c.NArg() != 1 {
-				return fmt.Errorf("expected exactly one repository argument")
-			}
+	// Get repository details before removal
+	repo, err := manager.GetRepository(c.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("failed to get repository: %w", err)
+	}
 
-			repoArg := c.Args().Get(0)
-			if repoArg == "" {
-				// Handle unsetting default via empty string
-				if err := manager.SetDefault(""); err != nil {
-					return fmt.Errorf("failed to unset default repository: %w", err)
-				}
-				fmt.Println("Default repository setting removed")
-				return nil
-			}
+	if err := manager.RemoveRepository(c.Args().Get(0)); err != nil {
+		return fmt.Errorf("failed to remove repository: %w", err)
+	}
 
-			// Handle setting a default repository
-			if err := manager.SetDefault(repoArg); err != nil {
-				return fmt.Errorf("failed to set default repository: %w", err)
-			}
+	fmt.Printf("Removed repository: %s (%s)\n", repo.Name, repo.Path)
+	fmt.Println("Note: Repository files were not deleted")
+	return nil
+}
 
-			// Get repository details for confirmation
-			repo, err := manager.GetRepository(repoArg)
-			if err != nil {
-				return fmt.Errorf("failed to get repository: %w", err)
-			}
+// setDefault sets the default repository
+func setDefault(c *cli.Context) error {
+	if c.Bool("unset-default") {
+		return fmt.Errorf("cannot use --set-default and --unset-default together")
+	}
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected exactly one repository argument")
+	}
+	manager, err := repo.NewManager()
+	if err != nil {
+		return fmt.Errorf("failed to create repository manager: %w", err)
+	}
 
-			fmt.Printf("Set default repository to: %s (%s)\n", repo.Name, repo.Path)
-			return nil
+	repoArg := c.Args().Get(0)
+	if repoArg == "" {
+		// Handle unsetting default via empty string
+		if err := manager.SetDefault(""); err != nil {
+			return fmt.Errorf("failed to unset default repository: %w", err)
 		}
+		fmt.Println("Default repository setting removed")
+		return nil
+	}
 
-		// Handle unset-default action
-		if c.Bool("unset-default") {
-			if c.NArg() > 0 {
-				return fmt.Errorf("unexpected arguments with --unset-default")
-			}
+	// Handle setting a default repository
+	if err := manager.SetDefault(repoArg); err != nil {
+		return fmt.Errorf("failed to set default repository: %w", err)
+	}
 
-			if err := manager.SetDefault(""); err != nil {
-				return fmt.Errorf("failed to unset default repository: %w", err)
-			}
+	// Get repository details for confirmation
+	repo, err := manager.GetRepository(repoArg)
+	if err != nil {
+		return fmt.Errorf("failed to get repository: %w", err)
+	}
 
-			fmt.Println("Default repository setting removed")
-			return nil
-		}
+	fmt.Printf("Set default repository to: %s (%s)\n", repo.Name, repo.Path)
+	return nil
+}
 
-		// Handle show action
-		if c.Bool("show") {
-			return showRepo(c)
-		}
+// unsetDefault removes the default repository setting
+func unsetDefault(c *cli.Context) error {
+	if c.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments with unset-default")
+	}
+	manager, err := repo.NewManager()
+	if err != nil {
+		return fmt.Errorf("failed to create repository manager: %w", err)
+	}
 
-		// Handle status action
-		if c.Bool("status") {
-			return showStatus(c)
-		}
+	if err := manager.SetDefault(""); err != nil {
+		return fmt.Errorf("failed to unset default repository: %w", err)
+	}
 
-		return nil
-	},
+	fmt.Println("Default repository setting removed")
+	return nil
 }
 
 // Helper function to get repository status
@@ -475,11 +687,13 @@ func showRepo(c *cli.Context) error {
 		fmt.Printf("  Status: Closed\n")
 		fmt.Printf("  Closed At: %s\n", trackingConfig.State.ClosedAt.Format("2006-01-02 15:04:05"))
 		fmt.Printf("  Closed By: %s\n", trackingConfig.State.ClosedBy)
+		printCloseDetails(trackingConfig.State)
 	} else {
 		fmt.Printf("  Status: Active\n")
 		if !trackingConfig.State.LastModified.IsZero() {
 			fmt.Printf("  Last Modified: %s\n", trackingConfig.State.LastModified.Format("2006-01-02 15:04:05"))
 		}
+		printReopenDetails(trackingConfig.State)
 	}
 
 	// Print tracked paths
@@ -540,11 +754,13 @@ func showStatus(c *cli.Context) error {
 		fmt.Printf("\nTracking State: Closed\n")
 		fmt.Printf("  Closed At: %s\n", trackingConfig.State.ClosedAt.Format("2006-01-02 15:04:05"))
 		fmt.Printf("  Closed By: %s\n", trackingConfig.State.ClosedBy)
+		printCloseDetails(trackingConfig.State)
 	} else {
 		fmt.Printf("\nTracking State: Active\n")
 		if !trackingConfig.State.LastModified.IsZero() {
 			fmt.Printf("  Last Modified: %s\n", trackingConfig.State.LastModified.Format("2006-01-02 15:04:05"))
 		}
+		printReopenDetails(trackingConfig.State)
 	}
 
 	// Print tracked paths
@@ -573,7 +789,7 @@ func formatType(isDir bool) string {
 }
 
 // moveRepository handles the complete process of moving a repository
-func moveRepository(manager *repo.Manager, repoArg, newPath string) error {
+func moveRepository(manager *repo.Manager, repoArg, newPath string, yes bool) error {
 	// Get current repository by name or path
 	currentRepo, err := manager.GetRepository(repoArg)
 	if err != nil {
@@ -631,9 +847,9 @@ func moveRepository(manager *repo.Manager, repoArg, newPath string) error {
 
 	// Get absolute paths for both directories
 	srcDspDir := filepath.Join(currentRepo.Path, currentRepo.DSPDir)
-	srcDataDir := filepath.Join(currentRepo.Path, repoConfig.DataDir)
+	srcDataDir := repoConfig.DataDirIn(currentRepo.Path)
 	dstDspDir := filepath.Join(absNewPath, currentRepo.DSPDir)
-	dstDataDir := filepath.Join(absNewPath, repoConfig.DataDir)
+	dstDataDir := repoConfig.DataDirIn(absNewPath)
 
 	// Check if data directory is a subdirectory of DSP directory
 	isDataInDsp := false
@@ -641,6 +857,15 @@ func moveRepository(manager *repo.Manager, repoArg, newPath string) error {
 		isDataInDsp = true
 	}
 
+	// An absolute data directory setting moves along with the data directory
+	newDataDir := ""
+	if isDataInDsp && filepath.IsAbs(repoConfig.DataDir) {
+		if rel, err := filepath.Rel(srcDspDir, srcDataDir); err == nil {
+			newDataDir = filepath.Join(dstDspDir, rel)
+			dstDataDir = newDataDir
+		}
+	}
+
 	// Print what will be moved
 	fmt.Printf("\nMoving DSP repository '%s':\n", currentRepo.Name)
 	fmt.Printf("  From: %s\n", currentRepo.Path)
@@ -650,6 +875,10 @@ func moveRepository(manager *repo.Manager, repoArg, newPath string) error {
 	fmt.Printf("     - config.yaml (repository configuration)\n")
 	fmt.Printf("     - tracking.yaml (tracked files and state)\n")
 	fmt.Printf("     - .gitignore (if present)\n")
+	fmt.Printf("     Tracked paths under %s are rewritten to point under %s.\n", currentRepo.Path, absNewPath)
+	if newDataDir != "" {
+		fmt.Printf("     The data directory setting is rewritten to %s.\n", newDataDir)
+	}
 
 	if isDataInDsp {
 		fmt.Printf("  2. Data directory (%s) containing:\n", repoConfig.DataDir)
@@ -667,13 +896,15 @@ func moveRepository(manager *repo.Manager, repoArg, newPath string) error {
 	fmt.Println("      Only DSP's own files and directories will be moved.")
 	fmt.Println()
 
-	// Ask for confirmation
-	fmt.Print("Do you want to continue? (y/N) ")
-	reader := bufio.NewReader(os.Stdin)
-	response, _ := reader.ReadString('\n')
-	response = strings.TrimSpace(strings.ToLower(response))
-	if response != "y" && response != "yes" {
-		return fmt.Errorf("move operation cancelled")
+	// Ask for confirmation, unless given --yes
+	if !yes {
+		fmt.Print("Do you want to continue? (y/N) ")
+		reader := bufio.NewReader(os.Stdin)
+		response, _ := reader.ReadString('\n')
+		response = strings.TrimSpace(strings.ToLower(response))
+		if response != "y" && response != "yes" {
+			return fmt.Errorf("move operation cancelled")
+		}
 	}
 
 	// Create a temporary directory for the move operation
@@ -709,6 +940,25 @@ func moveRepository(manager *repo.Manager, repoArg, newPath string) error {
 		return fmt.Errorf("failed to copy DSP directory: missing tracking.yaml")
 	}
 
+	// Rewrite the tracked paths and data directory of the copy for the new
+	// location, so a failure leaves the repository where it was
+	trackingConfig, err := snapshot.LoadTrackingConfig(tempDspDir)
+	if err != nil {
+		return fmt.Errorf("failed to load tracking config: %w", err)
+	}
+	rebased := snapshot.RebaseTrackedPaths(trackingConfig, currentRepo.Path, absNewPath)
+	if rebased > 0 {
+		if err := snapshot.SaveTrackingConfig(tempDspDir, trackingConfig); err != nil {
+			return fmt.Errorf("failed to save tracking config: %w", err)
+		}
+	}
+	if newDataDir != "" {
+		repoConfig.DataDir = newDataDir
+		if err := repoConfig.Save(filepath.Join(tempDspDir, "config.yaml")); err != nil {
+			return fmt.Errorf("failed to save repository config: %w", err)
+		}
+	}
+
 	// 3. Move from temp to final destination
 	fmt.Printf("Moving to final location...\n")
 
@@ -762,8 +1012,8 @@ func moveRepository(manager *repo.Manager, repoArg, newPath string) error {
 		return fmt.Errorf("failed to update repository registration: %w", err)
 	}
 
-	// 5. Add repository at new location
-	if err := manager.AddRepository(dstDspDir, currentRepo.Name, currentRepo.IsDefault); err != nil {
+	// 5. Add repository at new location, under the name it already had
+	if err := manager.AddRepository(dstDspDir, currentRepo.Name, currentRepo.IsDefault, true); err != nil {
 		// If this fails, try to restore the original location
 		if restoreErr := os.Rename(dstDspDir, srcDspDir); restoreErr != nil {
 			fmt.Printf("Warning: Failed to restore DSP directory after registration error: %v\n", restoreErr)
@@ -774,7 +1024,7 @@ func moveRepository(manager *repo.Manager, repoArg, newPath string) error {
 			}
 		}
 		// Try to restore the original registration
-		_ = manager.AddRepository(srcDspDir, currentRepo.Name, currentRepo.IsDefault)
+		_ = manager.AddRepository(srcDspDir, currentRepo.Name, currentRepo.IsDefault, true)
 		return fmt.Errorf("failed to register repository at new location: %w", err)
 	}
 
@@ -786,8 +1036,28 @@ func moveRepository(manager *repo.Manager, repoArg, newPath string) error {
 		fmt.Printf("  - Data directory remains at: %s\n", srcDataDir)
 		fmt.Printf("    You may need to update the data directory path in the repository configuration.\n")
 	}
+	fmt.Printf("  - Tracked paths: %d (%d rewritten for the new location)\n", len(trackingConfig.Paths), rebased)
+	if newDataDir != "" {
+		fmt.Printf("  - Data directory setting: %s\n", newDataDir)
+	}
+
+	// Tracked paths that are not at the new location yet would be snapshotted
+	// as deleted
+	var missing []string
+	for _, p := range trackingConfig.Paths {
+		if _, err := os.Stat(p.Path); os.IsNotExist(err) {
+			missing = append(missing, p.Path)
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Printf("\nWarning: %d tracked paths do not exist:\n", len(missing))
+		for _, p := range missing {
+			fmt.Printf("  - %s\n", p)
+		}
+		fmt.Printf("Move the files there before the next snapshot, or untrack them with: dsp untrack <path>\n")
+	}
 	fmt.Printf("Note: Only DSP directories were moved. Other files in %s remain unchanged.\n", currentRepo.Path)
-	fmt.Printf("You can verify the move with: dsp repo -l\n")
+	fmt.Printf("You can verify the move with: dsp repo list\n")
 	return nil
 }
 
@@ -822,7 +1092,7 @@ func copyDir(src, dst string) error {
 			}
 		} else {
 			// Copy files
-			if err := copyFile(srcPath, dstPath); err != nil {
+			if err := utils.CopyFile(srcPath, dstPath); err != nil {
 				return fmt.Errorf("failed to copy file %s: %w", srcPath, err)
 			}
 		}
@@ -830,33 +1100,3 @@ func copyDir(src, dst string) error {
 
 	return nil
 }
-
-// copyFile copies a single file
-func copyFile(src, dst string) error {
-	// Open source file
-	srcFile, err := os.Open(src)
-	if err != nil {
-		return fmt.Errorf("failed to open source file: %w", err)
-	}
-	defer srcFile.Close()
-
-	// Get source file info
-	srcInfo, err := srcFile.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to get source file info: %w", err)
-	}
-
-	// Create destination file
-	dstFile, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, srcInfo.Mode())
-	if err != nil {
-		return fmt.Errorf("failed to create destination file: %w", err)
-	}
-	defer dstFile.Close()
-
-	// Copy file contents
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return fmt.Errorf("failed to copy file contents: %w", err)
-	}
-
-	return nil
-}
@@ -0,0 +1,142 @@
+// Package review lets a user page through a list of files and choose which
+// to include, one line-based command at a time, so it works in any terminal.
+package review
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// PageSize is the number of items shown at once
+const PageSize = 20
+
+// Item is a file offered for review
+type Item struct {
+	Label    string // Shown in the list, such as "M src/main.go"
+	Note     string // Shown after the label, such as "local changes"
+	Selected bool
+}
+
+// help lists the review commands
+const help = `Commands:
+  3, 1-5, 2 4 7   toggle items
+  a / n           select all / none
+  j / k           next / previous page
+  y               confirm
+  q               cancel`
+
+// Run shows items and reads commands from in until the user confirms or
+// cancels. It returns true if the user confirmed; the items then hold the
+// selection. End of input cancels.
+func Run(in io.Reader, out io.Writer, title string, items []Item) (bool, error) {
+	reader := bufio.NewReader(in)
+	page := 0
+	pages := (len(items) + PageSize - 1) / PageSize
+
+	fmt.Fprintf(out, "%s\n%s\n", title, help)
+	for {
+		showPage(out, items, page, pages)
+		fmt.Fprint(out, "> ")
+
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			if err == io.EOF {
+				fmt.Fprintln(out)
+				return false, nil
+			}
+			return false, fmt.Errorf("failed to read input: %w", err)
+		}
+
+		switch command := strings.ToLower(strings.TrimSpace(line)); command {
+		case "":
+		case "y", "yes":
+			return true, nil
+		case "q", "quit":
+			return false, nil
+		case "a":
+			setAll(items, true)
+		case "n":
+			setAll(items, false)
+		case "j":
+			if page < pages-1 {
+				page++
+			}
+		case "k":
+			if page > 0 {
+				page--
+			}
+		case "?", "h", "help":
+			fmt.Fprintln(out, help)
+		default:
+			if err := toggle(items, command); err != nil {
+				fmt.Fprintf(out, "%v\n", err)
+			}
+		}
+	}
+}
+
+// Selected returns the number of selected items
+func Selected(items []Item) int {
+	n := 0
+	for _, item := range items {
+		if item.Selected {
+			n++
+		}
+	}
+	return n
+}
+
+// showPage prints one page of items, numbered from 1
+func showPage(out io.Writer, items []Item, page, pages int) {
+	start := page * PageSize
+	end := min(start+PageSize, len(items))
+	fmt.Fprintln(out)
+	for i := start; i < end; i++ {
+		mark := " "
+		if items[i].Selected {
+			mark = "x"
+		}
+		line := fmt.Sprintf("[%s] %3d  %s", mark, i+1, items[i].Label)
+		if items[i].Note != "" {
+			line += "  (" + items[i].Note + ")"
+		}
+		fmt.Fprintln(out, line)
+	}
+	fmt.Fprintf(out, "Page %d/%d, %d of %d selected\n", page+1, max(pages, 1), Selected(items), len(items))
+}
+
+// setAll selects or deselects every item
+func setAll(items []Item, selected bool) {
+	for i := range items {
+		items[i].Selected = selected
+	}
+}
+
+// toggle flips the items named by numbers and ranges such as "2 4-6"
+func toggle(items []Item, command string) error {
+	var indexes []int
+	for _, field := range strings.FieldsFunc(command, func(r rune) bool { return r == ' ' || r == ',' }) {
+		first, last := field, field
+		if i := strings.Index(field, "-"); i > 0 {
+			first, last = field[:i], field[i+1:]
+		}
+		from, err1 := strconv.Atoi(first)
+		to, err2 := strconv.Atoi(last)
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("unknown command %q; enter ? for help", command)
+		}
+		if from < 1 || to > len(items) || from > to {
+			return fmt.Errorf("%s is not between 1 and %d", field, len(items))
+		}
+		for n := from; n <= to; n++ {
+			indexes = append(indexes, n-1)
+		}
+	}
+	for _, i := range indexes {
+		items[i].Selected = !items[i].Selected
+	}
+	return nil
+}
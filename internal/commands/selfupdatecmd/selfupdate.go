@@ -0,0 +1,165 @@
+package selfupdatecmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/internal/release"
+	"github.com/urfave/cli/v2"
+)
+
+var Command = &cli.Command{
+	Name:  "selfupdate",
+	Usage: "Replace this dsp binary with the one from a signed release bundle",
+	Description: `Update dsp on machines that cannot download it. A release bundle holds the
+binary for one platform and a manifest signed by the release key embedded in
+dsp; carry it over like any bundle, on removable media or over the same
+channel your exports use.
+
+The bundle's signature, platform and checksum are verified before anything is
+changed. The new binary is written next to the running one and renamed over
+it, so an interrupted update leaves the old binary in place. Updating to the
+same or an older version needs --force.
+
+Release bundles are made with 'dsp selfupdate pack' on the machine holding
+the release signing key, which prints the key to embed in release builds.
+
+Examples:
+  # Check a release bundle without installing it
+  dsp selfupdate --from dsp-v1.4.0-linux-amd64.zip --dry-run
+
+  # Install it
+  dsp selfupdate --from dsp-v1.4.0-linux-amd64.zip
+
+  # Make a release bundle of a build
+  dsp selfupdate pack --binary ./dsp --version v1.4.0 --os linux --arch amd64`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "from",
+			Usage: "Release bundle to update from",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Verify the release bundle and show the versions without installing",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "Install even if the bundle is not newer than this build",
+		},
+	},
+	Subcommands: []*cli.Command{
+		packCommand,
+	},
+	Action: func(c *cli.Context) error {
+		if c.String("from") == "" {
+			return fmt.Errorf("specify the release bundle with --from")
+		}
+		b, err := release.Open(c.String("from"))
+		if err != nil {
+			return err
+		}
+		defer b.Close()
+		if err := b.CheckPlatform(); err != nil {
+			return err
+		}
+
+		fmt.Printf("Release bundle verified (signed by release key %s)\n", b.Fingerprint)
+		fmt.Printf("  Current version: %s\n", release.Version)
+		fmt.Printf("  New version:     %s (%s/%s, %d bytes)\n", b.Manifest.Version, b.Manifest.OS, b.Manifest.Arch, b.Manifest.Size)
+
+		if release.CompareVersions(b.Manifest.Version, release.Version) <= 0 && !c.Bool("force") {
+			return fmt.Errorf("%s is not newer than %s; use --force to install it anyway", b.Manifest.Version, release.Version)
+		}
+		if c.Bool("dry-run") {
+			fmt.Println("Dry run: nothing installed")
+			return nil
+		}
+
+		exePath, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to locate the running executable: %w", err)
+		}
+		if resolved, err := filepath.EvalSymlinks(exePath); err == nil {
+			exePath = resolved
+		}
+		if err := b.Install(exePath); err != nil {
+			return err
+		}
+		fmt.Printf("Updated %s to %s\n", exePath, b.Manifest.Version)
+		return nil
+	},
+}
+
+// packCommand makes release bundles
+var packCommand = &cli.Command{
+	Name:  "pack",
+	Usage: "Make a release bundle of a dsp binary, signed with this host's signing key",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "binary",
+			Usage: "Binary to pack (default: this dsp)",
+		},
+		&cli.StringFlag{
+			Name:     "version",
+			Usage:    "Version of the binary, such as v1.4.0",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "os",
+			Usage: "Operating system the binary is built for",
+			Value: runtime.GOOS,
+		},
+		&cli.StringFlag{
+			Name:  "arch",
+			Usage: "Architecture the binary is built for",
+			Value: runtime.GOARCH,
+		},
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Release bundle to write (default: dsp-<version>-<os>-<arch>.zip)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		binary := c.String("binary")
+		if binary == "" {
+			exePath, err := os.Executable()
+			if err != nil {
+				return fmt.Errorf("failed to locate the running executable: %w", err)
+			}
+			binary = exePath
+		}
+		output := c.String("output")
+		if output == "" {
+			output = fmt.Sprintf("dsp-%s-%s-%s.zip", c.String("version"), c.String("os"), c.String("arch"))
+		}
+
+		keyManager, err := crypto.NewKeyManager()
+		if err != nil {
+			return fmt.Errorf("failed to create key manager: %w", err)
+		}
+		publicKey, err := keyManager.GetSigningPublicKey()
+		if err != nil {
+			return fmt.Errorf("no signing key to sign the release with (run 'dsp crypto init'): %w", err)
+		}
+		fingerprint, err := crypto.SigningKeyFingerprint(publicKey)
+		if err != nil {
+			return err
+		}
+
+		manifest, err := release.Pack(binary, c.String("version"), c.String("os"), c.String("arch"), output, keyManager)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote release bundle %s\n", output)
+		fmt.Printf("  Version: %s (%s/%s)\n", manifest.Version, manifest.OS, manifest.Arch)
+		fmt.Printf("  SHA-256: %s\n", manifest.SHA256)
+		fmt.Printf("  Signed by: %s\n", fingerprint)
+		fmt.Printf("\nRelease builds that accept this bundle embed the key with:\n")
+		fmt.Printf("  -ldflags \"-X github.com/Mattddixo/dsp/internal/release.publicKey=%s\"\n", release.EncodeKey(publicKey))
+		return nil
+	},
+}
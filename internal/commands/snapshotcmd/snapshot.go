@@ -1,12 +1,21 @@
 package snapshotcmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"time"
+	"strings"
 
 	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/atrest"
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/commands/flags"
+	"github.com/Mattddixo/dsp/internal/hooks"
+	"github.com/Mattddixo/dsp/internal/migrations"
+	"github.com/Mattddixo/dsp/internal/notify"
+	"github.com/Mattddixo/dsp/internal/objects"
 	"github.com/Mattddixo/dsp/internal/repo"
 	"github.com/Mattddixo/dsp/internal/snapshot"
 	"github.com/urfave/cli/v2"
@@ -20,6 +29,26 @@ This command captures the current state of all tracked files and stores it
 in the repository's snapshots directory. The snapshot can be used to track
 changes over time and create bundles for synchronization.
 
+Symlinks are recorded as links, with their target. If follow_symlinks is set
+in the repository config.yaml, the files and directories they point to are
+recorded instead.
+
+The contents of files not seen before are kept, compressed, in
+<data-dir>/objects, so diffs and bundles can read a snapshotted version after
+the file changes. The oldest contents are dropped once the store exceeds
+content_store_mb (default 1024 MiB); -1 disables the store.
+
+If auto_track is set in the repository config.yaml, files and directories that
+appeared in the repository root since the last snapshot are added to tracking
+first, limited to names matching auto_track_include, and reported.
+
+Files in tracked directories can be left out with max_file_size, skip_binary
+and only_extensions in the repository config.yaml; skipped files are listed
+and recorded in the snapshot. Explicitly tracked files are always kept.
+
+If keep_snapshots is set in the repository config.yaml, older snapshots beyond
+that count are removed after the new snapshot is saved.
+
 Examples:
   # Create a snapshot with a message
   dsp snapshot -m "Initial snapshot"
@@ -27,20 +56,35 @@ Examples:
   # Create a snapshot in a specific repository
   dsp snapshot -m "Update" --repo /path/to/repo
 
+  # Create a quick snapshot with an automatically generated message
+  dsp snapshot
+
+  # Change the message of the latest snapshot (files are not re-hashed)
+  dsp snapshot --amend -m "Better description"
+
+Hooks:
+  If <dsp-dir>/hooks/pre-snapshot exists it runs before the snapshot is taken;
+  a non-zero exit aborts the snapshot. <dsp-dir>/hooks/post-snapshot runs
+  afterwards with DSP_SNAPSHOT_ID set. Use --no-hooks to skip them.
+
 Note: This command works from any directory within the repository. If you
 have multiple repositories, use --repo to specify which one to use.`,
 	Flags: []cli.Flag{
 		&cli.StringFlag{
-			Name:     "message",
-			Aliases:  []string{"m"},
-			Usage:    "Message describing the snapshot",
-			Required: true,
+			Name:    "message",
+			Aliases: []string{"m"},
+			Usage:   "Message describing the snapshot (default: generated from the changes)",
+		},
+		&cli.BoolFlag{
+			Name:  "amend",
+			Usage: "Update the latest snapshot's message instead of creating a new snapshot",
 		},
 		&cli.StringFlag{
 			Name:    "repo",
 			Aliases: []string{"r"},
 			Usage:   "Path to the repository (default: nearest repository)",
 		},
+		flags.NoHooksFlag,
 	},
 	Action: func(c *cli.Context) error {
 		// Create repository manager
@@ -58,6 +102,16 @@ have multiple repositories, use --repo to specify which one to use.`,
 		// Get DSP directory path from repository
 		dspDir := currentRepo.GetDSPDir()
 
+		// Handle amend
+		if c.Bool("amend") {
+			return amendLatest(dspDir, currentRepo.Name, c.String("message"))
+		}
+
+		// Don't add to a history written by a newer dsp
+		if _, err := snapshot.List(dspDir); errors.Is(err, migrations.ErrNewerFormat) {
+			return err
+		}
+
 		// Load repository configuration
 		repoConfig, err := config.NewWithRepo(currentRepo.Path, currentRepo.DSPDir)
 		if err != nil {
@@ -70,34 +124,256 @@ have multiple repositories, use --repo to specify which one to use.`,
 			return fmt.Errorf("failed to load tracking configuration: %w", err)
 		}
 
+		// Track new entries of the repository root
+		if repoConfig.AutoTrack {
+			added, changed, err := snapshot.AutoTrack(trackingConfig, currentRepo.Path, repoConfig.AutoTrackInclude,
+				dspDir, repoConfig.DataDirIn(currentRepo.Path))
+			if err != nil {
+				return fmt.Errorf("failed to auto-track new paths: %w", err)
+			}
+			if changed {
+				if err := snapshot.SaveTrackingConfig(dspDir, trackingConfig); err != nil {
+					return fmt.Errorf("failed to save tracking configuration: %w", err)
+				}
+			}
+			if len(added) > 0 {
+				fmt.Printf("Auto-tracked %d new paths:\n", len(added))
+				for _, p := range added {
+					if p.IsDir {
+						fmt.Printf("  + %s/\n", p.Path)
+					} else {
+						fmt.Printf("  + %s\n", p.Path)
+					}
+				}
+			}
+		}
+
 		if len(trackingConfig.Paths) == 0 {
 			return fmt.Errorf("no paths are being tracked in repository '%s'", currentRepo.Name)
 		}
 
-		// Create snapshot directory using repository's snapshots path
-		timestamp := time.Now().Format("20060102-150405")
-		snapshotDir := filepath.Join(dspDir, "snapshots", timestamp)
-		if err := os.MkdirAll(snapshotDir, 0755); err != nil {
-			return fmt.Errorf("failed to create snapshot directory: %w", err)
+		// Run pre-snapshot hook
+		hookCtx := hooks.Context{
+			RepoName: currentRepo.Name,
+			RepoPath: currentRepo.Path,
+			DSPDir:   dspDir,
+			Disabled: c.Bool("no-hooks"),
+		}
+		if err := hooks.Run(hookCtx, hooks.PreSnapshot, map[string]string{
+			"SNAPSHOT_MESSAGE": c.String("message"),
+		}); err != nil {
+			return fmt.Errorf("snapshot aborted: %w", err)
 		}
 
 		// Create snapshot with repository configuration
-		snap, err := snapshot.CreateSnapshot(trackingConfig.Paths, os.Getenv("USERNAME"), c.String("message"), repoConfig)
+		snap, err := snapshot.CreateSnapshot(c.Context, trackingConfig.Paths, config.CurrentUser(), c.String("message"), repoConfig)
 		if err != nil {
 			return fmt.Errorf("failed to create snapshot: %w", err)
 		}
 
+		// Generate a message for quick snapshots
+		if snap.Message == "" {
+			snap.Message = autoMessage(dspDir, snap)
+		}
+
+		// Create snapshot directory named after the snapshot ID. Mkdir fails if
+		// the directory exists, so concurrent snapshots never overwrite each other.
+		if err := os.MkdirAll(filepath.Join(dspDir, "snapshots"), 0755); err != nil {
+			return fmt.Errorf("failed to create snapshots directory: %w", err)
+		}
+		if err := os.Mkdir(snapshot.Dir(dspDir, snap.ID), 0755); err != nil {
+			return fmt.Errorf("failed to create snapshot directory: %w", err)
+		}
+
 		// Save snapshot
-		if err := snap.Save(filepath.Join(snapshotDir, "snapshot.json")); err != nil {
+		if err := snap.Save(snapshot.FilePath(dspDir, snap.ID)); err != nil {
 			return fmt.Errorf("failed to save snapshot: %w", err)
 		}
 
-		fmt.Printf("Created snapshot in repository '%s': %s\n", currentRepo.Name, timestamp)
+		fmt.Printf("Created snapshot in repository '%s': %s\n", currentRepo.Name, snap.ID)
 		fmt.Printf("Message: %s\n", snap.Message)
 		fmt.Printf("Files: %d\n", len(snap.Files))
+		fmt.Printf("Directories: %d\n", len(snap.Dirs))
 		fmt.Printf("Total size: %d bytes\n", snap.Stats.TotalSize)
 		fmt.Printf("Hash algorithm: %s\n", repoConfig.HashAlgorithm)
+		if len(snap.Skipped) > 0 {
+			fmt.Printf("Skipped by file policy: %d files (%d bytes)\n", snap.Stats.SkippedFiles, snap.Stats.SkippedSize)
+			for i, f := range snap.Skipped {
+				if i == maxSkippedListed {
+					fmt.Printf("  ... and %d more (see the skipped list in the snapshot)\n", len(snap.Skipped)-i)
+					break
+				}
+				fmt.Printf("  %s (%d bytes): %s\n", f.Path, f.Size, f.Reason)
+			}
+		}
+
+		// Keep file contents so older versions can be read later
+		if store := objects.ForRepo(currentRepo.Path, repoConfig); store != nil {
+			storeContents(c.Context, store, snap, repoConfig.CompressionLevel)
+		}
+		if repoConfig.EncryptAtRest {
+			sealBundles(dspDir)
+		}
+
+		// Enforce the snapshot retention policy
+		removed, err := snapshot.Prune(dspDir, repoConfig.KeepSnapshots)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+		if len(removed) > 0 {
+			fmt.Printf("Removed %d old snapshots (keep_snapshots: %d)\n", len(removed), repoConfig.KeepSnapshots)
+		}
+
+		// Run post-snapshot hook
+		hooks.RunPost(hookCtx, hooks.PostSnapshot, map[string]string{
+			"SNAPSHOT_ID":      snap.ID,
+			"SNAPSHOT_MESSAGE": snap.Message,
+			"SNAPSHOT_FILES":   fmt.Sprintf("%d", len(snap.Files)),
+		})
+		notify.Send(notify.Event{
+			Event:      config.EventSnapshotCreated,
+			Repository: currentRepo.Name,
+			Subject:    snap.ID,
+			Detail:     fmt.Sprintf("%s (%d files)", snap.Message, len(snap.Files)),
+		})
 
 		return nil
 	},
 }
+
+// maxSkippedListed is how many files skipped by the file policy are listed
+const maxSkippedListed = 20
+
+// sealBundles encrypts the bundles and deferred bundle copies kept before
+// encrypt_at_rest was turned on
+func sealBundles(dspDir string) {
+	if err := atrest.CheckKey(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: bundles not encrypted: %v\n", err)
+		return
+	}
+	sealed := 0
+	for _, dir := range []string{"bundles", "deferred"} {
+		n, err := atrest.SealGlob(filepath.Join(dspDir, dir, "*.zip"), bundle.Seal)
+		sealed += n
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: bundles not encrypted: %v\n", err)
+			break
+		}
+	}
+	if sealed > 0 {
+		fmt.Printf("Encrypted %d bundles (encrypt_at_rest)\n", sealed)
+	}
+}
+
+// storeContents adds the contents of a snapshot's files that are not stored
+// yet, then drops the oldest contents if the store is over its quota
+func storeContents(ctx context.Context, store *objects.Store, snap *snapshot.Snapshot, compressionLevel int) {
+	// Encrypt contents stored before encrypt_at_rest was turned on
+	encrypted, err := store.EncryptExisting()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: file contents not stored: %v\n", err)
+		return
+	}
+	if encrypted > 0 {
+		fmt.Printf("Encrypted %d stored contents (encrypt_at_rest)\n", encrypted)
+	}
+
+	stored := 0
+	var added int64
+	keep := make(map[string]bool, len(snap.Files))
+	for _, f := range snap.Files {
+		if ctx.Err() != nil {
+			// Pruning now would drop contents the snapshot still needs
+			fmt.Fprintf(os.Stderr, "Warning: interrupted after storing %d file contents\n", stored)
+			return
+		}
+		if f.IsSymlink {
+			continue
+		}
+		keep[f.Hash] = true
+		size, err := store.PutFile(f.Path, f.Hash, compressionLevel)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to store content of %s: %v\n", f.Path, err)
+			continue
+		}
+		if size > 0 {
+			stored++
+			added += size
+		}
+	}
+	if stored > 0 {
+		fmt.Printf("Stored contents: %d files (%d bytes compressed)\n", stored, added)
+	}
+
+	removed, err := store.Prune(keep)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	if removed > 0 {
+		fmt.Printf("Removed %d stored contents over the content_store_mb limit\n", removed)
+	}
+}
+
+// amendLatest updates the message of the latest snapshot without re-hashing files
+func amendLatest(dspDir, repoName, message string) error {
+	if message == "" {
+		return fmt.Errorf("--amend requires a new message: dsp snapshot --amend -m \"message\"")
+	}
+
+	snapshotID, latest, err := snapshot.LoadLatest(dspDir)
+	if err != nil {
+		return fmt.Errorf("failed to load latest snapshot: %w", err)
+	}
+
+	oldMessage := latest.Message
+	latest.Message = message
+	if err := latest.Save(snapshot.FilePath(dspDir, snapshotID)); err != nil {
+		return fmt.Errorf("failed to save snapshot: %w", err)
+	}
+
+	fmt.Printf("Amended snapshot in repository '%s': %s\n", repoName, snapshotID)
+	fmt.Printf("Old message: %s\n", oldMessage)
+	fmt.Printf("New message: %s\n", message)
+	return nil
+}
+
+// autoMessage generates a snapshot message describing the changes since the
+// latest snapshot
+func autoMessage(dspDir string, snap *snapshot.Snapshot) string {
+	_, previous, err := snapshot.LoadLatest(dspDir)
+	if err != nil {
+		return fmt.Sprintf("Initial snapshot (%d files)", len(snap.Files))
+	}
+
+	previousFiles := make(map[string]string, len(previous.Files))
+	for _, f := range previous.Files {
+		previousFiles[f.Path] = f.Hash
+	}
+
+	added, modified := 0, 0
+	for _, f := range snap.Files {
+		hash, exists := previousFiles[f.Path]
+		if !exists {
+			added++
+		} else if hash != f.Hash {
+			modified++
+		}
+		delete(previousFiles, f.Path)
+	}
+	deleted := len(previousFiles)
+
+	var parts []string
+	if added > 0 {
+		parts = append(parts, fmt.Sprintf("%d added", added))
+	}
+	if modified > 0 {
+		parts = append(parts, fmt.Sprintf("%d modified", modified))
+	}
+	if deleted > 0 {
+		parts = append(parts, fmt.Sprintf("%d deleted", deleted))
+	}
+	if len(parts) == 0 {
+		return "Quick snapshot: no changes"
+	}
+	return "Quick snapshot: " + strings.Join(parts, ", ")
+}
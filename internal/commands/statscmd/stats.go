@@ -0,0 +1,348 @@
+package statscmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/objects"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/Mattddixo/dsp/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+var Command = &cli.Command{
+	Name:  "stats",
+	Usage: "Show repository statistics",
+	Description: `Show statistics of the repository, read from its snapshots, content
+store and bundles:
+
+- Tracked files and bytes in the latest snapshot
+- Snapshot count and how the tracked files grew over time
+- Deduplication in the content store: the bytes of all file versions in all
+  snapshots against the bytes of the distinct contents stored
+- Bundle count and sizes
+- The largest files in the latest snapshot
+- Churn hotspots: the files changed by the most snapshots
+
+The working tree is not scanned; take a snapshot first to include recent
+changes.
+
+Examples:
+  # Show statistics of the current repository
+  dsp stats
+
+  # Show the 20 largest files and hotspots, as JSON
+  dsp stats --top 20 --json`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "repo",
+			Aliases: []string{"r"},
+			Usage:   "Path to the repository (default: nearest repository)",
+		},
+		&cli.IntFlag{
+			Name:    "top",
+			Aliases: []string{"n"},
+			Usage:   "Number of largest files, hotspots and snapshots to list",
+			Value:   10,
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the statistics as JSON",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		top := c.Int("top")
+		if top < 0 {
+			return fmt.Errorf("--top must not be negative")
+		}
+
+		// Create repository manager
+		manager, err := repo.NewManager()
+		if err != nil {
+			return fmt.Errorf("failed to create repository manager: %w", err)
+		}
+
+		// Get current repository context
+		currentRepo, err := manager.GetCurrentRepo(c.String("repo"))
+		if err != nil {
+			return fmt.Errorf("failed to get repository context: %w", err)
+		}
+		dspDir := currentRepo.GetDSPDir()
+
+		// Load repository configuration
+		repoConfig, err := config.NewWithRepo(currentRepo.Path, currentRepo.DSPDir)
+		if err != nil {
+			return fmt.Errorf("failed to load repository configuration: %w", err)
+		}
+
+		// Read the snapshots; a repository without any is not an error
+		entries, err := snapshot.List(dspDir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		trackingConfig, err := snapshot.LoadTrackingConfig(dspDir)
+		if err != nil {
+			return fmt.Errorf("failed to load tracking configuration: %w", err)
+		}
+
+		r := &report{
+			Repository:   currentRepo.Name,
+			Path:         currentRepo.Path,
+			TrackedPaths: len(trackingConfig.Paths),
+			Snapshots:    make([]snapshotStats, 0, len(entries)),
+		}
+		r.addSnapshots(entries, currentRepo.Path, top)
+		if store := objects.ForRepo(currentRepo.Path, repoConfig); store != nil {
+			if r.Objects, err = objectUsage(store, entries); err != nil {
+				return err
+			}
+		}
+		if r.Bundles, err = bundleUsage(filepath.Join(dspDir, "bundles")); err != nil {
+			return err
+		}
+
+		if c.Bool("json") {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(r)
+		}
+		return r.print(top)
+	},
+}
+
+// report holds the statistics of a repository
+type report struct {
+	Repository   string          `json:"repository"`
+	Path         string          `json:"path"`
+	TrackedPaths int             `json:"tracked_paths"`
+	Files        int             `json:"files"` // In the latest snapshot
+	Bytes        int64           `json:"bytes"`
+	Snapshots    []snapshotStats `json:"snapshots"` // Oldest first
+	Objects      *objectStats    `json:"objects,omitempty"`
+	Bundles      bundleStats     `json:"bundles"`
+	Largest      []fileStats     `json:"largest_files"`
+	Hotspots     []churnStats    `json:"hotspots"`
+}
+
+// snapshotStats is the size of the tracked files in a snapshot
+type snapshotStats struct {
+	ID    string    `json:"id"`
+	Time  time.Time `json:"time"`
+	Files int       `json:"files"`
+	Bytes int64     `json:"bytes"`
+}
+
+// objectStats describes the content store. Referenced bytes count every
+// version of every file in every snapshot whose content is stored; unique
+// bytes count each stored content once.
+type objectStats struct {
+	Objects          int     `json:"objects"`
+	StoredBytes      int64   `json:"stored_bytes"` // Compressed, on disk
+	UniqueBytes      int64   `json:"unique_bytes"`
+	ReferencedBytes  int64   `json:"referenced_bytes"`
+	DedupRatio       float64 `json:"dedup_ratio"`       // Referenced to unique bytes
+	CompressionRatio float64 `json:"compression_ratio"` // Unique to stored bytes
+}
+
+// bundleStats describes the bundles kept in the repository
+type bundleStats struct {
+	Count        int    `json:"count"`
+	Bytes        int64  `json:"bytes"`
+	Largest      string `json:"largest,omitempty"`
+	LargestBytes int64  `json:"largest_bytes,omitempty"`
+}
+
+// fileStats is a file of the latest snapshot
+type fileStats struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// churnStats is a file with the number of snapshots that changed it
+type churnStats struct {
+	Path    string `json:"path"`
+	Changes int    `json:"changes"`
+}
+
+// addSnapshots adds the growth, largest files and hotspots of the snapshots
+func (r *report) addSnapshots(entries []snapshot.Entry, repoRoot string, top int) {
+	churn := make(map[string]int)
+	var prev *snapshot.Snapshot
+	for _, e := range entries {
+		s := snapshotStats{ID: e.ID, Time: e.Snapshot.Timestamp, Files: len(e.Snapshot.Files)}
+		for _, f := range e.Snapshot.Files {
+			s.Bytes += f.Size
+		}
+		r.Snapshots = append(r.Snapshots, s)
+
+		// Changes in the first snapshot only add the initial files
+		if prev != nil {
+			for _, change := range snapshot.Compare(prev, e.Snapshot) {
+				churn[change.Path()]++
+			}
+		}
+		prev = e.Snapshot
+	}
+	if prev == nil {
+		return
+	}
+	latest := r.Snapshots[len(r.Snapshots)-1]
+	r.Files, r.Bytes = latest.Files, latest.Bytes
+
+	r.Largest = make([]fileStats, 0, len(prev.Files))
+	for _, f := range prev.Files {
+		r.Largest = append(r.Largest, fileStats{Path: utils.RelativePath(repoRoot, f.Path), Size: f.Size})
+	}
+	sort.SliceStable(r.Largest, func(i, j int) bool { return r.Largest[i].Size > r.Largest[j].Size })
+	if len(r.Largest) > top {
+		r.Largest = r.Largest[:top]
+	}
+
+	r.Hotspots = make([]churnStats, 0, len(churn))
+	for path, changes := range churn {
+		r.Hotspots = append(r.Hotspots, churnStats{Path: utils.RelativePath(repoRoot, path), Changes: changes})
+	}
+	sort.Slice(r.Hotspots, func(i, j int) bool {
+		if r.Hotspots[i].Changes != r.Hotspots[j].Changes {
+			return r.Hotspots[i].Changes > r.Hotspots[j].Changes
+		}
+		return r.Hotspots[i].Path < r.Hotspots[j].Path
+	})
+	if len(r.Hotspots) > top {
+		r.Hotspots = r.Hotspots[:top]
+	}
+}
+
+// objectUsage measures the deduplication and compression of the content store
+func objectUsage(store *objects.Store, entries []snapshot.Entry) (*objectStats, error) {
+	sizes, err := store.Sizes()
+	if err != nil {
+		return nil, err
+	}
+	stats := &objectStats{Objects: len(sizes)}
+	for _, size := range sizes {
+		stats.StoredBytes += size
+	}
+
+	unique := make(map[string]bool)
+	for _, e := range entries {
+		for _, f := range e.Snapshot.Files {
+			if _, ok := sizes[f.Hash]; !ok {
+				continue
+			}
+			stats.ReferencedBytes += f.Size
+			if !unique[f.Hash] {
+				unique[f.Hash] = true
+				stats.UniqueBytes += f.Size
+			}
+		}
+	}
+	if stats.UniqueBytes > 0 {
+		stats.DedupRatio = float64(stats.ReferencedBytes) / float64(stats.UniqueBytes)
+	}
+	if stats.StoredBytes > 0 {
+		stats.CompressionRatio = float64(stats.UniqueBytes) / float64(stats.StoredBytes)
+	}
+	return stats, nil
+}
+
+// bundleUsage measures the bundle archives in dir
+func bundleUsage(dir string) (bundleStats, error) {
+	var stats bundleStats
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return stats, nil
+		}
+		return stats, fmt.Errorf("failed to read bundles directory: %w", err)
+	}
+	for _, entry := range dirEntries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".zip" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		stats.Count++
+		stats.Bytes += info.Size()
+		if info.Size() > stats.LargestBytes {
+			stats.Largest, stats.LargestBytes = entry.Name(), info.Size()
+		}
+	}
+	return stats, nil
+}
+
+// print shows the statistics as text
+func (r *report) print(top int) error {
+	fmt.Printf("Repository: %s (%s)\n", r.Repository, r.Path)
+	fmt.Printf("Tracked paths: %d\n", r.TrackedPaths)
+	fmt.Printf("Tracked files: %d (%s)\n", r.Files, utils.FormatSize(r.Bytes))
+
+	fmt.Printf("Snapshots: %d\n", len(r.Snapshots))
+	if len(r.Snapshots) > 1 {
+		first, latest := r.Snapshots[0], r.Snapshots[len(r.Snapshots)-1]
+		fmt.Printf("Growth since %s: %+d files, %s\n", first.Time.Local().Format("2006-01-02"),
+			latest.Files-first.Files, formatDelta(latest.Bytes-first.Bytes))
+	}
+	if len(r.Snapshots) > 0 && top > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  TIME\tSNAPSHOT\tFILES\tSIZE")
+		shown := r.Snapshots
+		if len(shown) > top {
+			shown = shown[len(shown)-top:]
+		}
+		for _, s := range shown {
+			fmt.Fprintf(w, "  %s\t%s\t%d\t%s\n", s.Time.Local().Format("2006-01-02 15:04:05"), s.ID, s.Files, utils.FormatSize(s.Bytes))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if o := r.Objects; o != nil {
+		fmt.Printf("Content store: %d objects, %s stored\n", o.Objects, utils.FormatSize(o.StoredBytes))
+		fmt.Printf("  Deduplication: %.2fx (%s of file versions in %s of distinct contents)\n",
+			o.DedupRatio, utils.FormatSize(o.ReferencedBytes), utils.FormatSize(o.UniqueBytes))
+		fmt.Printf("  Compression: %.2fx\n", o.CompressionRatio)
+	} else {
+		fmt.Println("Content store: disabled")
+	}
+
+	fmt.Printf("Bundles: %d (%s)\n", r.Bundles.Count, utils.FormatSize(r.Bundles.Bytes))
+	if r.Bundles.Count > 0 {
+		fmt.Printf("  Largest: %s (%s)\n", r.Bundles.Largest, utils.FormatSize(r.Bundles.LargestBytes))
+	}
+
+	if len(r.Largest) > 0 {
+		fmt.Println("Largest files:")
+		for _, f := range r.Largest {
+			fmt.Printf("  %10s  %s\n", utils.FormatSize(f.Size), f.Path)
+		}
+	}
+	if len(r.Hotspots) > 0 {
+		fmt.Println("Churn hotspots:")
+		for _, h := range r.Hotspots {
+			fmt.Printf("  %4d  %s\n", h.Changes, h.Path)
+		}
+	}
+	return nil
+}
+
+// formatDelta formats a change in size with its sign
+func formatDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + utils.FormatSize(-delta)
+	}
+	return "+" + utils.FormatSize(delta)
+}
@@ -1,10 +1,19 @@
 package statuscmd
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
 
-	"github.com/Mattddixo/dsp/internal/commands/common"
+	"github.com/Mattddixo/dsp/config"
 	"github.com/Mattddixo/dsp/internal/commands/flags"
+	"github.com/Mattddixo/dsp/internal/commands/review"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/Mattddixo/dsp/pkg/utils"
 	"github.com/urfave/cli/v2"
 )
 
@@ -16,37 +25,236 @@ This will display information about the current state, including:
 - Number of snapshots
 - Latest snapshot
 - Tracked files
-- Pending changes`,
+- Pending changes
+
+Files whose size and modification time are unchanged since the last status,
+diff or snapshot are not hashed again; their hashes are kept in
+<dsp-dir>/hash-cache.json.
+
+With --interactive, the added and modified files in tracked directories are
+listed for review. Files deselected there are added as exclude patterns to
+their tracked directory, so later snapshots leave them out.
+
+Examples:
+  # Show the status of the current repository
+  dsp status
+
+  # Choose which changed files to keep tracking
+  dsp status --interactive`,
 	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "repo",
+			Aliases: []string{"r"},
+			Usage:   "Path to the repository (default: nearest repository)",
+		},
+		&cli.BoolFlag{
+			Name:    "interactive",
+			Aliases: []string{"i"},
+			Usage:   "Review changed files and exclude the ones deselected",
+		},
 		flags.VerboseFlag,
 		flags.QuietFlag,
 	},
 	Action: func(c *cli.Context) error {
-		// Get config - will be used when implementing status logic
-		cfg, err := common.GetConfig(c)
+		verbose := c.Bool("verbose")
+		quiet := c.Bool("quiet")
+
+		// Create repository manager
+		manager, err := repo.NewManager()
 		if err != nil {
-			return fmt.Errorf("failed to get config: %w", err)
+			return fmt.Errorf("failed to create repository manager: %w", err)
 		}
-		_ = cfg // TODO: Use cfg when implementing status logic
 
-		verbose := c.Bool("verbose")
-		quiet := c.Bool("quiet")
+		// Get current repository context
+		currentRepo, err := manager.GetCurrentRepo(c.String("repo"))
+		if err != nil {
+			return fmt.Errorf("failed to get repository context: %w", err)
+		}
+		dspDir := currentRepo.GetDSPDir()
 
-		if verbose {
-			fmt.Println("Checking repository status...")
+		// Load repository configuration
+		repoConfig, err := config.NewWithRepo(currentRepo.Path, currentRepo.DSPDir)
+		if err != nil {
+			return fmt.Errorf("failed to load repository configuration: %w", err)
+		}
+
+		// Load tracking configuration
+		trackingConfig, err := snapshot.LoadTrackingConfig(dspDir)
+		if err != nil {
+			return fmt.Errorf("failed to load tracking configuration: %w", err)
 		}
 
-		// TODO: Implement status logic
-		// This would involve:
-		// 1. Reading the snapshots directory
-		// 2. Reading the tracking configuration
-		// 3. Comparing current state with latest snapshot
-		// 4. Displaying status information
+		// Read the snapshots; a repository without any is not an error
+		entries, err := snapshot.List(dspDir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		// Compare the latest snapshot with the working tree
+		var changes []change
+		if len(trackingConfig.Paths) > 0 {
+			if verbose {
+				fmt.Println("Checking repository status...")
+			}
+			current, cache, err := snapshot.ScanWorkingState(c.Context, dspDir, trackingConfig.Paths, config.CurrentUser(), repoConfig)
+			if err != nil {
+				return fmt.Errorf("failed to read the working tree: %w", err)
+			}
+			if verbose {
+				fmt.Printf("Hashed %d files, %d unchanged since the last scan\n", cache.Hashed, cache.Reused)
+			}
+			var latest *snapshot.Snapshot
+			if len(entries) > 0 {
+				latest = entries[len(entries)-1].Snapshot
+			}
+			changes = compare(latest, current)
+		}
 
 		if !quiet {
-			fmt.Println("Status functionality not yet implemented")
+			fmt.Printf("Repository: %s (%s)\n", currentRepo.Name, currentRepo.Path)
+			if snapshot.IsRepositoryClosed(trackingConfig) {
+				fmt.Printf("State: closed by %s\n", trackingConfig.State.ClosedBy)
+			}
+			fmt.Printf("Snapshots: %d\n", len(entries))
+			if len(entries) > 0 {
+				latest := entries[len(entries)-1]
+				fmt.Printf("Latest snapshot: %s (%s)\n", latest.ID, latest.Snapshot.Message)
+			}
+			fmt.Printf("Tracked paths: %d\n", len(trackingConfig.Paths))
+			if verbose {
+				for _, p := range trackingConfig.Paths {
+					fmt.Printf("  %s\n", p.Path)
+				}
+			}
+			if len(changes) == 0 {
+				fmt.Println("No pending changes")
+			} else {
+				fmt.Printf("Pending changes: %d\n", len(changes))
+				if !c.Bool("interactive") {
+					for _, ch := range changes {
+						fmt.Printf("  %s %s\n", ch.symbol, utils.RelativePath(currentRepo.Path, ch.path))
+					}
+				}
+			}
 		}
 
+		// Review changed files and exclude the deselected ones
+		if c.Bool("interactive") {
+			return reviewExcludes(dspDir, currentRepo.Path, trackingConfig, changes)
+		}
 		return nil
 	},
 }
+
+// change is a file that differs between the latest snapshot and the working tree
+type change struct {
+	symbol string // "+", "M" or "-"
+	path   string
+}
+
+// compare lists the files added, modified and deleted since the latest
+// snapshot, sorted by path. Without a latest snapshot every file is added.
+func compare(latest, current *snapshot.Snapshot) []change {
+	var changes []change
+	for _, c := range snapshot.Compare(latest, current) {
+		switch {
+		case c.Old == nil:
+			changes = append(changes, change{symbol: "+", path: c.New.Path})
+		case c.New == nil:
+			changes = append(changes, change{symbol: "-", path: c.Old.Path})
+		default:
+			changes = append(changes, change{symbol: "M", path: c.New.Path})
+		}
+	}
+	return changes
+}
+
+// reviewExcludes lets the user deselect added and modified files in tracked
+// directories, then excludes the deselected files from their directory
+func reviewExcludes(dspDir, repoPath string, trackingConfig *snapshot.TrackingConfig, changes []change) error {
+	var candidates []change
+	var items []review.Item
+	for _, ch := range changes {
+		if ch.symbol == "-" || trackedDir(trackingConfig, ch.path) == "" {
+			continue
+		}
+		candidates = append(candidates, ch)
+		items = append(items, review.Item{
+			Label:    fmt.Sprintf("%s %s", ch.symbol, utils.RelativePath(repoPath, ch.path)),
+			Selected: true,
+		})
+	}
+	if len(items) == 0 {
+		fmt.Println("No changed files in tracked directories to review")
+		return nil
+	}
+
+	title := "Deselect files to exclude them from future snapshots."
+	confirmed, err := review.Run(os.Stdin, os.Stdout, title, items)
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		fmt.Println("Cancelled; tracking is unchanged")
+		return nil
+	}
+
+	// Add an exclude pattern for each deselected file
+	excluded := 0
+	for i, ch := range candidates {
+		if items[i].Selected {
+			continue
+		}
+		dir := trackedDir(trackingConfig, ch.path)
+		rel, err := filepath.Rel(dir, ch.path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
+		if err := snapshot.AddExcludePatterns(trackingConfig, []string{dir}, []string{escapePattern(rel)}); err != nil {
+			return fmt.Errorf("failed to exclude %s: %w", ch.path, err)
+		}
+		excluded++
+	}
+	if excluded == 0 {
+		fmt.Println("No files deselected; tracking is unchanged")
+		return nil
+	}
+
+	if err := snapshot.SaveTrackingConfig(dspDir, trackingConfig); err != nil {
+		return fmt.Errorf("failed to save tracking configuration: %w", err)
+	}
+	fmt.Printf("Excluded %d files from future snapshots\n", excluded)
+	return nil
+}
+
+// trackedDir returns the innermost tracked directory containing path, or ""
+func trackedDir(trackingConfig *snapshot.TrackingConfig, path string) string {
+	best := ""
+	for _, p := range trackingConfig.Paths {
+		if !p.IsDir || len(p.Path) <= len(best) {
+			continue
+		}
+		if strings.HasPrefix(path, p.Path+string(filepath.Separator)) {
+			best = p.Path
+		}
+	}
+	return best
+}
+
+// escapePattern makes a relative path an exclude pattern matching only
+// itself. filepath.Match has no escape character on Windows, where special
+// characters are put in brackets instead.
+func escapePattern(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		switch {
+		case filepath.Separator == '\\' && (r == '*' || r == '?' || r == '['):
+			b.WriteString("[" + string(r) + "]")
+		case filepath.Separator != '\\' && strings.ContainsRune(`*?[]\`, r):
+			b.WriteString(`\` + string(r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,336 @@
+package synccmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/ledger"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// side is one repository taking part in a sync
+type side struct {
+	name     string // Repository name as recorded in bundles
+	root     string
+	dspDir   string
+	latestID string
+	latest   *snapshot.Snapshot
+	ledger   *ledger.Ledger
+}
+
+// pathChange is a file one side is missing
+type pathChange struct {
+	key    string // Path relative to the repository root, or absolute if outside it
+	status byte   // 'A', 'M' or 'D'
+}
+
+// direction describes what one side is missing from the other
+type direction struct {
+	from, to *side
+	baseID   string // Snapshot of from last applied by to, empty if none
+	changes  []pathChange
+	bundles  []string // Existing bundles of from that cover the changes, in order
+}
+
+// loadSide loads the state of a repository
+func loadSide(root, dspDir string) (*side, error) {
+	s := &side{
+		name:   filepath.Base(root),
+		root:   root,
+		dspDir: dspDir,
+	}
+
+	// Latest snapshot, if any
+	if entries, err := snapshot.List(dspDir); err == nil && len(entries) > 0 {
+		last := entries[len(entries)-1]
+		s.latestID, s.latest = last.ID, last.Snapshot
+	}
+
+	l, err := ledger.Load(dspDir)
+	if err != nil {
+		return nil, err
+	}
+	s.ledger = l
+	return s, nil
+}
+
+// resolvePeer finds the other repository by registered name or path. The
+// path may be a repository root or its DSP directory, such as a repository
+// on removable media that is not registered locally.
+func resolvePeer(manager *repo.Manager, arg string) (root, dspDir string, err error) {
+	if r, err := manager.GetRepository(arg); err == nil {
+		return r.Path, filepath.Join(r.Path, r.DSPDir), nil
+	}
+
+	absPath, err := filepath.Abs(arg)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	if repo.IsRepository(absPath) {
+		return filepath.Dir(absPath), absPath, nil
+	}
+	if dspDir := filepath.Join(absPath, ".dsp"); repo.IsRepository(dspDir) {
+		return absPath, dspDir, nil
+	}
+	return "", "", fmt.Errorf("repository not found: '%s' is not a registered repository, a repository root or a DSP directory", arg)
+}
+
+// key returns the path used to compare files between repositories
+func (s *side) key(path string) string {
+	rel, err := filepath.Rel(s.root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// files returns the hashes of a snapshot's files by key
+func (s *side) files(snap *snapshot.Snapshot) map[string]string {
+	files := make(map[string]string)
+	if snap != nil {
+		for _, f := range snap.Files {
+			files[s.key(f.Path)] = f.Hash
+		}
+	}
+	return files
+}
+
+// lastSync returns the snapshot of from that to last applied, or ""
+func lastSync(to *side, fromName string) string {
+	return to.ledger.LastTarget(fromName)
+}
+
+// missing computes what to is missing from from
+func missing(from, to *side) *direction {
+	d := &direction{from: from, to: to}
+
+	// The base is the last snapshot of from that to applied. Failing that,
+	// the last snapshot of to that from applied is what both sides shared.
+	baseFiles := make(map[string]string)
+	if id := lastSync(to, from.name); id != "" {
+		if snap, err := snapshot.Load(snapshot.FilePath(from.dspDir, id)); err == nil {
+			d.baseID, baseFiles = id, from.files(snap)
+		}
+	} else if id := lastSync(from, to.name); id != "" {
+		if snap, err := snapshot.Load(snapshot.FilePath(to.dspDir, id)); err == nil {
+			baseFiles = to.files(snap)
+		}
+	}
+
+	fromFiles := from.files(from.latest)
+	toFiles := to.files(to.latest)
+
+	keys := make(map[string]bool)
+	for k := range baseFiles {
+		keys[k] = true
+	}
+	for k := range fromFiles {
+		keys[k] = true
+	}
+
+	for k := range keys {
+		baseHash, fromHash := baseFiles[k], fromFiles[k]
+		if baseHash == fromHash || toFiles[k] == fromHash {
+			// Unchanged on from, or to already has the same content
+			continue
+		}
+		status := byte('M')
+		switch {
+		case baseHash == "":
+			status = 'A'
+		case fromHash == "":
+			status = 'D'
+		}
+		d.changes = append(d.changes, pathChange{key: k, status: status})
+	}
+	sort.Slice(d.changes, func(i, j int) bool { return d.changes[i].key < d.changes[j].key })
+
+	if len(d.changes) > 0 && d.baseID != "" {
+		d.bundles = bundleChain(from, to, d.baseID)
+	}
+	return d
+}
+
+// bundleChain returns existing bundles of from that lead from the base
+// snapshot to its latest snapshot without having been applied by to
+func bundleChain(from, to *side, baseID string) []string {
+	matches, _ := filepath.Glob(filepath.Join(from.dspDir, "bundles", "*.zip"))
+	bySource := make(map[string][]*bundle.Bundle)
+	files := make(map[string]string)
+	for _, path := range matches {
+		r, err := bundle.OpenReader(path)
+		if err != nil {
+			continue
+		}
+		b := r.Bundle
+		r.Close()
+		if len(b.SelectedPaths) > 0 || b.Redacted != nil || to.ledger.IsApplied(b.ID) {
+			continue // Partial and redacted bundles do not cover everything
+		}
+		bySource[b.SourceSnapshot] = append(bySource[b.SourceSnapshot], b)
+		files[b.ID] = path
+	}
+
+	// Follow bundles from the base, preferring the one that reaches furthest
+	var chain []string
+	current := baseID
+	for current != from.latestID {
+		candidates := bySource[current]
+		if len(candidates) == 0 {
+			return nil
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].TargetSnapshot > candidates[j].TargetSnapshot })
+		next := candidates[0]
+		chain = append(chain, files[next.ID])
+		current = next.TargetSnapshot
+		if len(chain) > len(matches) {
+			return nil
+		}
+	}
+	return chain
+}
+
+// conflicts returns the keys both sides are missing from each other, which
+// means both changed them
+func conflicts(a, b *direction) []string {
+	inB := make(map[string]bool)
+	for _, change := range b.changes {
+		inB[change.key] = true
+	}
+	var keys []string
+	for _, change := range a.changes {
+		if inB[change.key] {
+			keys = append(keys, change.key)
+		}
+	}
+	return keys
+}
+
+// printDirection prints what one side is missing and how to fix it
+func printDirection(d *direction, conflicted map[string]bool, verbose bool) {
+	if d.from.latest == nil {
+		fmt.Printf("%s has no snapshots; nothing to send to %s\n", d.from.name, d.to.name)
+		return
+	}
+	if len(d.changes) == 0 {
+		fmt.Printf("%s has everything from %s\n", d.to.name, d.from.name)
+		return
+	}
+
+	fmt.Printf("%s is missing %d changes from %s:\n", d.to.name, len(d.changes), d.from.name)
+	for i, change := range d.changes {
+		if !verbose && i == 20 {
+			fmt.Printf("  ... and %d more (use --verbose to list all)\n", len(d.changes)-i)
+			break
+		}
+		marker := " "
+		if conflicted[change.key] {
+			marker = "!"
+		}
+		fmt.Printf("  %c%s %s\n", change.status, marker, change.key)
+	}
+
+	switch {
+	case len(d.bundles) > 0:
+		fmt.Printf("  -> on %s, apply the existing bundles in order:\n", d.to.name)
+		for _, path := range d.bundles {
+			fmt.Printf("       dsp apply -b %s\n", path)
+		}
+	case d.baseID != "":
+		fmt.Printf("  -> on %s: dsp bundle --source %s\n", d.from.name, d.baseID)
+		fmt.Printf("  -> on %s: dsp apply -b <bundle>\n", d.to.name)
+	default:
+		fmt.Printf("  -> %s has never applied a bundle from %s; create a bundle on %s covering these files\n",
+			d.to.name, d.from.name, d.from.name)
+	}
+}
+
+// bundleStatus is the plan for one received bundle
+type bundleStatus struct {
+	path      string
+	bundle    *bundle.Bundle
+	applied   bool
+	gap       string   // Expected source snapshot if the bundle does not continue the chain
+	conflicts []string // Paths changed locally that the bundle also changes
+	mergeable []string // Conflicting text files that apply will try to merge
+}
+
+// planBundles checks received bundles against the local repository
+func planBundles(local *side, paths []string, hashAlgorithm string) ([]bundleStatus, error) {
+	var statuses []bundleStatus
+	expected := make(map[string]string) // Next source snapshot by source repository
+
+	for _, path := range paths {
+		r, err := bundle.OpenReader(path)
+		if err != nil {
+			return nil, err
+		}
+		b := r.Bundle
+		r.Close()
+
+		status := bundleStatus{path: path, bundle: b, applied: local.ledger.IsApplied(b.ID)}
+
+		// Check the bundle continues what was applied or planned before
+		next, ok := expected[b.Repository.Name]
+		if !ok {
+			next = lastSync(local, b.Repository.Name)
+		}
+		if !status.applied && !b.IsInitial && next != "" && b.SourceSnapshot != next {
+			status.gap = next
+		}
+		if !status.applied {
+			expected[b.Repository.Name] = b.TargetSnapshot
+		}
+
+		// Check local files against the version the bundle was made from
+		if !status.applied {
+			for _, change := range b.Changes {
+				if change.IsDir {
+					continue
+				}
+				current := ""
+				if _, err := os.Lstat(change.Path); err == nil {
+					current, _ = utils.HashPath(change.Path, hashAlgorithm)
+				}
+				if !localConflict(change, current) {
+					continue
+				}
+				if change.Type == "modify" && change.BaseContentHash != "" {
+					status.mergeable = append(status.mergeable, local.key(change.Path))
+				} else {
+					status.conflicts = append(status.conflicts, local.key(change.Path))
+				}
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// localConflict reports whether a local file differs from what a change expects
+func localConflict(change bundle.Change, current string) bool {
+	switch change.Type {
+	case "add":
+		return current != "" && current != change.Hash
+	case "delete":
+		if change.BaseHash != "" {
+			// A merged delete records the version it removes as its base
+			return current != "" && current != change.BaseHash
+		}
+		return current != "" && current != change.Hash
+	default:
+		if current == change.Hash {
+			return false
+		}
+		if change.BaseHash != "" {
+			return current != change.BaseHash
+		}
+		return false
+	}
+}
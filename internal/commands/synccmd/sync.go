@@ -0,0 +1,213 @@
+package synccmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/commands/flags"
+	"github.com/Mattddixo/dsp/internal/repo"
+	"github.com/urfave/cli/v2"
+)
+
+var Command = &cli.Command{
+	Name:  "sync",
+	Usage: "Plan synchronization between repositories",
+	Description: `Plan how to bring two copies of a repository in sync.
+
+Use 'dsp sync plan' to see what each side is missing before an exchange.`,
+	Subcommands: []*cli.Command{
+		planCommand,
+	},
+}
+
+var planCommand = &cli.Command{
+	Name:  "plan",
+	Usage: "Show what each side is missing without changing anything",
+	Description: `Compare the current repository with another repository, or with a chain of
+received bundles, and print a plan: bundles to create, bundles to apply and
+conflicts to resolve. Nothing is modified.
+
+Sync history comes from each repository's applied ledger (<dsp-dir>/applied.yaml):
+the last bundle a repository applied from the other marks what they share.
+Comparisons use the latest snapshot on each side, so take a snapshot first to
+include recent edits.
+
+Examples:
+  # Compare with another repository, by name or path (e.g. on removable media)
+  dsp sync plan --with /media/usb/project
+
+  # Check received bundles before applying them
+  dsp sync plan -b 20240101120000.zip -b 20240102090000.zip`,
+	Flags: []cli.Flag{
+		flags.VerboseFlag,
+		&cli.StringFlag{
+			Name:    "with",
+			Aliases: []string{"w"},
+			Usage:   "Other repository: registered name, repository root or DSP directory",
+		},
+		&cli.StringSliceFlag{
+			Name:    "bundle",
+			Aliases: []string{"b"},
+			Usage:   "Received bundle to check, in order (can be repeated)",
+		},
+		&cli.StringFlag{
+			Name:    "repo",
+			Aliases: []string{"r"},
+			Usage:   "Path to the repository (default: nearest repository)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		verbose := c.Bool("verbose")
+		peer := c.String("with")
+		bundles := c.StringSlice("bundle")
+
+		if (peer == "") == (len(bundles) == 0) {
+			return fmt.Errorf("specify either --with <repository> or one or more --bundle files")
+		}
+
+		// Create repository manager
+		manager, err := repo.NewManager()
+		if err != nil {
+			return fmt.Errorf("failed to create repository manager: %w", err)
+		}
+
+		// Get current repository context
+		currentRepo, err := manager.GetCurrentRepo(c.String("repo"))
+		if err != nil {
+			return fmt.Errorf("failed to get repository context: %w", err)
+		}
+		local, err := loadSide(currentRepo.Path, filepath.Join(currentRepo.Path, currentRepo.DSPDir))
+		if err != nil {
+			return err
+		}
+
+		if peer != "" {
+			return planWithRepo(manager, local, peer, verbose)
+		}
+
+		hashAlgorithm := config.DefaultHashAlgorithm
+		if repoConfig, err := config.NewWithRepo(currentRepo.Path, currentRepo.DSPDir); err == nil {
+			hashAlgorithm = repoConfig.HashAlgorithm
+		}
+		return planWithBundles(local, bundles, hashAlgorithm)
+	},
+}
+
+// planWithRepo prints the plan between the local repository and another one
+func planWithRepo(manager *repo.Manager, local *side, peer string, verbose bool) error {
+	root, dspDir, err := resolvePeer(manager, peer)
+	if err != nil {
+		return err
+	}
+	if root == local.root {
+		return fmt.Errorf("cannot plan a sync of a repository with itself")
+	}
+	other, err := loadSide(root, dspDir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Sync plan: %s (%s) <-> %s (%s)\n\n", local.name, local.root, other.name, other.root)
+
+	toOther := missing(local, other)
+	toLocal := missing(other, local)
+
+	conflicted := make(map[string]bool)
+	keys := conflicts(toOther, toLocal)
+	for _, key := range keys {
+		conflicted[key] = true
+	}
+
+	printDirection(toOther, conflicted, verbose)
+	fmt.Println()
+	printDirection(toLocal, conflicted, verbose)
+
+	if len(keys) > 0 {
+		fmt.Printf("\n%d files changed on both sides (marked !):\n", len(keys))
+		for _, key := range keys {
+			fmt.Printf("  ! %s\n", key)
+		}
+		fmt.Println("  -> text files are merged on apply; review the others before exchanging")
+	}
+
+	if len(toOther.changes) == 0 && len(toLocal.changes) == 0 {
+		fmt.Println("\nRepositories are in sync")
+	}
+	return nil
+}
+
+// planWithBundles prints the plan for applying received bundles
+func planWithBundles(local *side, paths []string, hashAlgorithm string) error {
+	statuses, err := planBundles(local, paths, hashAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Sync plan for %s (%s)\n\n", local.name, local.root)
+
+	toApply := 0
+	for _, status := range statuses {
+		b := status.bundle
+		fmt.Printf("Bundle %s from %s (%d changes): ", b.ID, b.Repository.Name, len(b.Changes))
+		switch {
+		case status.applied:
+			fmt.Println("already applied, skip")
+			continue
+		case status.gap != "":
+			fmt.Printf("missing earlier bundles (expected a bundle starting at snapshot %s)\n", status.gap)
+		default:
+			fmt.Println("apply")
+		}
+		toApply++
+
+		for _, key := range status.mergeable {
+			fmt.Printf("  M! %s (changed locally, will be merged)\n", key)
+		}
+		for _, key := range status.conflicts {
+			fmt.Printf("  !  %s (changed locally, will be deferred unless --force)\n", key)
+		}
+	}
+
+	if toApply > 0 {
+		fmt.Println("\nTo apply:")
+		for _, status := range statuses {
+			if !status.applied {
+				fmt.Printf("  dsp apply -b %s\n", status.path)
+			}
+		}
+	}
+
+	// Report local snapshots that have not been bundled
+	fmt.Println()
+	if local.latest == nil {
+		fmt.Printf("%s has no snapshots to send\n", local.name)
+		return nil
+	}
+	lastTarget := ""
+	matches, _ := filepath.Glob(filepath.Join(local.dspDir, "bundles", "*.zip"))
+	var newest *bundle.Bundle
+	for _, path := range matches {
+		r, err := bundle.OpenReader(path)
+		if err != nil {
+			continue
+		}
+		if newest == nil || r.Bundle.CreatedAt.After(newest.CreatedAt) {
+			newest = r.Bundle
+		}
+		r.Close()
+	}
+	if newest != nil {
+		lastTarget = newest.TargetSnapshot
+	}
+	switch {
+	case lastTarget == local.latestID:
+		fmt.Println("Local changes: latest snapshot is already bundled")
+	case lastTarget == "":
+		fmt.Println("Local changes: no bundles created yet -> dsp bundle")
+	default:
+		fmt.Printf("Local changes: snapshot %s is not bundled -> dsp bundle --source %s\n", local.latestID, lastTarget)
+	}
+	return nil
+}
@@ -14,22 +14,34 @@ import (
 )
 
 var Command = &cli.Command{
-	Name:  "track",
-	Usage: "Track files or directories [--path PATH [PATH...]] [--exclude PATTERN...]",
+	Name:      "track",
+	Usage:     "Track files or directories [PATH...] [--path PATH...] [--exclude PATTERN...]",
+	ArgsUsage: "[PATH...]",
 	Description: `Add files or directories to the tracking configuration.
 This command adds the specified paths to the repository's tracking configuration.
-The paths can be relative to the current directory or absolute paths.
+The paths can be relative to the current directory or absolute paths, and are
+given as arguments or with --path.
+
+Directories are always tracked with everything below them. Glob patterns
+(*, ? and [...]) are expanded by dsp, so they work the same on every platform;
+quote them to keep the shell from expanding them first. A pattern matches
+names in its own directory only, unless --recursive is given, in which case
+its last element is also matched in every directory below.
 
 Usage Examples:
   # Track a file
-  dsp track --path file.txt
+  dsp track file.txt
 
   # Track a directory
-  dsp track --path directory/
+  dsp track directory/
+
+  # Track multiple paths
+  dsp track dir1/ dir2/ dir3/
+  dsp track --path file1.txt --path dir/
 
-  # Track multiple paths with a single --path flag
-  dsp track --path dir1/ dir2/ dir3/
-  dsp track -p file1.txt file2.txt dir/
+  # Track the Go files in src/, or in src/ and all directories below it
+  dsp track "src/*.go"
+  dsp track --recursive "src/*.go"
 
   # Track paths and exclude certain files/patterns
   dsp track --path my_project/ --exclude "*.log" --exclude "temp/*"
@@ -85,7 +97,12 @@ Exclude Patterns:
 		&cli.StringSliceFlag{
 			Name:    "path",
 			Aliases: []string{"p"},
-			Usage:   "Path(s) to track (can specify multiple paths)",
+			Usage:   "Path or glob pattern to track (can be repeated)",
+		},
+		&cli.BoolFlag{
+			Name:    "recursive",
+			Aliases: []string{"R"},
+			Usage:   "Match glob patterns in every directory below the pattern's directory",
 		},
 		&cli.StringSliceFlag{
 			Name:    "exclude",
@@ -99,12 +116,12 @@ Exclude Patterns:
 		// Get exclude patterns if any
 		excludes := c.StringSlice("exclude")
 
-		// Get paths from the --path flag
-		paths := c.StringSlice("path")
+		// Get paths from the arguments and the --path flag
+		paths := append(c.Args().Slice(), c.StringSlice("path")...)
 
 		// If no paths specified and not listing, show usage
 		if len(paths) == 0 && !c.Bool("list") {
-			return fmt.Errorf("no paths specified. Usage: dsp track --path PATH [--path PATH...] [--exclude PATTERN...]")
+			return fmt.Errorf("no paths specified. Usage: dsp track PATH... [--exclude PATTERN...]")
 		}
 
 		// Create repository manager
@@ -122,6 +139,12 @@ Exclude Patterns:
 		// Get DSP directory path from repository config
 		dspDir := filepath.Join(currentRepo.Path, currentRepo.DSPDir)
 
+		// Expand glob patterns
+		paths, err = expandPaths(paths, c.Bool("recursive"), dspDir)
+		if err != nil {
+			return err
+		}
+
 		// Load tracking configuration
 		trackingConfig, err := snapshot.LoadTrackingConfig(dspDir)
 		if err != nil {
@@ -130,7 +153,7 @@ Exclude Patterns:
 
 		// Check if repository is closed
 		if snapshot.IsRepositoryClosed(trackingConfig) {
-			return fmt.Errorf("repository is closed. Please re-add it using 'dsp repo add' before tracking files")
+			return fmt.Errorf("repository is closed. Reopen it with 'dsp repo reopen' before tracking files")
 		}
 
 		// Handle list flag
@@ -325,17 +348,91 @@ Exclude Patterns:
 	},
 }
 
-func formatSize(size int64) string {
-	const unit = 1024
-	if size < unit {
-		return fmt.Sprintf("%d B", size)
+// expandPaths expands the glob patterns among paths. Patterns must match at
+// least one path. With recursive, the last element of a pattern is also
+// matched in every directory below the pattern's directory, except in
+// dspDir.
+func expandPaths(paths []string, recursive bool, dspDir string) ([]string, error) {
+	var expanded []string
+	seen := make(map[string]bool)
+	add := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			expanded = append(expanded, p)
+		}
+	}
+
+	for _, path := range paths {
+		if !isGlob(path) {
+			add(path)
+			continue
+		}
+
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", path, err)
+		}
+		if recursive {
+			more, err := globBelow(path, dspDir)
+			if err != nil {
+				return nil, err
+			}
+			matches = append(matches, more...)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no paths match %s", path)
+		}
+		for _, match := range matches {
+			add(match)
+		}
+	}
+	return expanded, nil
+}
+
+// sameDir reports whether two paths name the same directory
+func sameDir(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// isGlob reports whether a path contains glob pattern characters
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// globBelow matches the last element of a pattern in every directory below
+// the pattern's directory, which may itself be a pattern. The skip directory
+// is not searched.
+func globBelow(pattern, skip string) ([]string, error) {
+	dirs, err := filepath.Glob(filepath.Dir(pattern))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
 	}
-	div, exp := int64(unit), 0
-	for n := size / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
+	name := filepath.Base(pattern)
+
+	var matches []string
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == dir {
+				return nil
+			}
+			if d.IsDir() && sameDir(path, skip) {
+				return filepath.SkipDir
+			}
+			if ok, _ := filepath.Match(name, d.Name()); ok && filepath.Dir(path) != dir {
+				matches = append(matches, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to search %s: %w", dir, err)
+		}
 	}
-	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+	return matches, nil
 }
 
 func formatType(isDir bool) string {
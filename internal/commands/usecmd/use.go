@@ -2,6 +2,9 @@ package usecmd
 
 import (
 	"fmt"
+	"os"
+	"runtime"
+	"strings"
 
 	"github.com/Mattddixo/dsp/internal/repo"
 	"github.com/urfave/cli/v2"
@@ -14,6 +17,11 @@ var Command = &cli.Command{
 This command sets the repository that will be used by default for all DSP commands
 unless explicitly overridden with the --repo flag.
 
+The working repository is shared by every terminal. To pin a repository for one
+shell session instead, set the DSP_REPO environment variable to its name or
+path; it takes priority over the working repository and is overridden only by
+--repo. 'dsp use --print-env' prints the command that sets it.
+
 The repository can be specified by either its name or its path. If a name is used,
 it must match exactly with a repository name from 'dsp repo list'.
 
@@ -30,6 +38,12 @@ Examples:
   # Clear working repository
   dsp use --unset
 
+  # Pin a repository for this shell session only
+  eval "$(dsp use --print-env field-work)"
+
+  # Stop pinning a repository in this shell session
+  eval "$(dsp use --print-env --unset)"
+
   # List available repositories
   dsp repo list`,
 	Flags: []cli.Flag{
@@ -43,6 +57,11 @@ Examples:
 			Aliases: []string{"u"},
 			Usage:   "Clear working repository",
 		},
+		&cli.BoolFlag{
+			Name:    "print-env",
+			Aliases: []string{"e"},
+			Usage:   "Print the shell command that pins the repository for this session through DSP_REPO, instead of setting it for all",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		// Create repository manager
@@ -51,8 +70,21 @@ Examples:
 			return fmt.Errorf("failed to create repository manager: %w", err)
 		}
 
+		// Handle --print-env flag
+		if c.Bool("print-env") {
+			return printEnv(c, manager)
+		}
+
 		// Handle --current flag
 		if c.Bool("current") {
+			if envRepo := os.Getenv(repo.RepoEnv); envRepo != "" {
+				r, err := manager.GetRepository(envRepo)
+				if err != nil {
+					return fmt.Errorf("invalid %s: %w", repo.RepoEnv, err)
+				}
+				fmt.Printf("Current working repository: %s (%s), pinned by %s\n", r.Name, r.Path, repo.RepoEnv)
+				return nil
+			}
 			repo, err := manager.GetWorkingRepo()
 			if err != nil {
 				fmt.Println("No working repository set")
@@ -83,12 +115,45 @@ Examples:
 		}
 
 		// Get repository details for confirmation
-		repo, err := manager.GetWorkingRepo()
+		working, err := manager.GetWorkingRepo()
 		if err != nil {
 			return fmt.Errorf("failed to get working repository: %w", err)
 		}
 
-		fmt.Printf("Set working repository to: %s (%s)\n", repo.Name, repo.Path)
+		fmt.Printf("Set working repository to: %s (%s)\n", working.Name, working.Path)
+		if envRepo := os.Getenv(repo.RepoEnv); envRepo != "" {
+			fmt.Printf("Note: %s=%s still takes priority in this shell session\n", repo.RepoEnv, envRepo)
+		}
 		return nil
 	},
 }
+
+// printEnv prints the shell command that sets DSP_REPO to the given
+// repository, or to the current one, or that unsets it with --unset
+func printEnv(c *cli.Context, manager *repo.Manager) error {
+	powershell := runtime.GOOS == "windows"
+	if c.Bool("unset") {
+		if powershell {
+			fmt.Printf("Remove-Item Env:%s -ErrorAction SilentlyContinue\n", repo.RepoEnv)
+		} else {
+			fmt.Printf("unset %s\n", repo.RepoEnv)
+		}
+		return nil
+	}
+
+	if c.NArg() > 1 {
+		return fmt.Errorf("expected at most one repository argument")
+	}
+	r, err := manager.GetCurrentRepo(c.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("failed to get repository: %w", err)
+	}
+	quoted := "'" + strings.ReplaceAll(r.Path, "'", `'\''`) + "'"
+	if powershell {
+		quoted = "'" + strings.ReplaceAll(r.Path, "'", "''") + "'"
+		fmt.Printf("$env:%s = %s\n", repo.RepoEnv, quoted)
+	} else {
+		fmt.Printf("export %s=%s\n", repo.RepoEnv, quoted)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package versioncmd
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/Mattddixo/dsp/internal/bundle"
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/internal/migrations"
+	"github.com/Mattddixo/dsp/internal/protocol"
+	"github.com/Mattddixo/dsp/internal/release"
+	"github.com/Mattddixo/dsp/internal/snapshot"
+	"github.com/urfave/cli/v2"
+)
+
+var Command = &cli.Command{
+	Name:  "version",
+	Usage: "Show the version of dsp and check for a newer release",
+	Description: `Show the version of this build of dsp: its commit and build date, the bundle
+and snapshot formats it reads, the transfer protocol it speaks and the release
+key it trusts for 'dsp selfupdate'. Bundles and snapshots written in a newer
+format than listed are refused with a request to upgrade.
+
+With --check, look up the latest published release (this needs internet
+access). Air-gapped machines are updated from a signed release bundle with
+'dsp selfupdate --from <bundle>' instead.
+
+Examples:
+  # Show the version
+  dsp version
+
+  # Check whether a newer release is available
+  dsp version --check`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "check",
+			Usage: "Look up the latest published release",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		commit, date := release.BuildInfo()
+		fmt.Printf("dsp %s\n", release.Version)
+		fmt.Printf("  Commit: %s\n", commit)
+		fmt.Printf("  Built: %s\n", date)
+		fmt.Printf("  Platform: %s/%s (%s)\n", runtime.GOOS, runtime.GOARCH, runtime.Version())
+		fmt.Printf("  Bundle format: %d (reads 0-%d)\n", bundle.FormatVersion, bundle.FormatVersion)
+		fmt.Printf("  Snapshot format: %d (reads 0-%d)\n", snapshot.FormatVersion, snapshot.FormatVersion)
+		fmt.Printf("  Config formats: tracking %d, repos %d, hosts %d (older ones are upgraded on read)\n",
+			migrations.TrackingVersion, migrations.ReposVersion, migrations.HostVersion)
+		fmt.Printf("  Protocol: %d (talks to %d and later)\n", protocol.Version, protocol.MinVersion)
+		if key := release.PublicKey(); key != nil {
+			fingerprint, err := crypto.SigningKeyFingerprint(key)
+			if err != nil {
+				return fmt.Errorf("invalid embedded release key: %w", err)
+			}
+			fmt.Printf("  Release key: %s\n", fingerprint)
+		} else {
+			fmt.Printf("  Release key: none (this build cannot update itself)\n")
+		}
+
+		if !c.Bool("check") {
+			return nil
+		}
+		latest, err := release.Latest(c.Context)
+		if err != nil {
+			return err
+		}
+		switch release.CompareVersions(release.Version, latest) {
+		case -1:
+			fmt.Printf("\nA newer release is available: %s\n", latest)
+			fmt.Printf("Install it with 'go install github.com/Mattddixo/dsp/cmd/dsp@%s', or carry its\n", latest)
+			fmt.Printf("release bundle to this machine and run 'dsp selfupdate --from <bundle>'.\n")
+		case 0:
+			fmt.Printf("\ndsp is up to date (latest release: %s)\n", latest)
+		default:
+			fmt.Printf("\nThis build is newer than the latest release (%s)\n", latest)
+		}
+		return nil
+	},
+}
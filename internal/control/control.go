@@ -0,0 +1,251 @@
+// Package control implements the local control socket of long-running DSP
+// commands, such as 'dsp export', and the client used by 'dsp ctl'.
+//
+// Each running command listens on a Unix domain socket in the run directory
+// of the global DSP directory, named after the command and its process ID.
+// Windows 10 and later support Unix domain sockets as well, so the same
+// transport is used there instead of named pipes. Requests and responses are
+// single JSON lines.
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+)
+
+// RunDir is the directory of control sockets in the global DSP directory
+const RunDir = "run"
+
+// socketExt is the file extension of control sockets
+const socketExt = ".sock"
+
+// Commands understood by control sockets
+const (
+	CommandStatus          = "status"
+	CommandListTransfers   = "list-active-transfers"
+	CommandTriggerSnapshot = "trigger-snapshot"
+	CommandStop            = "stop"
+)
+
+// Status describes a running command
+type Status struct {
+	Command      string    `json:"command"`
+	PID          int       `json:"pid"`
+	Started      time.Time `json:"started"`
+	Address      string    `json:"address,omitempty"`
+	Bundle       string    `json:"bundle,omitempty"`
+	Downloads    int       `json:"downloads"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Expires      string    `json:"expires,omitempty"`
+}
+
+// Transfer describes a transfer in progress
+type Transfer struct {
+	ID      int       `json:"id"`
+	Client  string    `json:"client"`
+	Started time.Time `json:"started"`
+	Bytes   int64     `json:"bytes"`
+}
+
+// Request is a command sent to a control socket
+type Request struct {
+	Command string `json:"command"`
+}
+
+// Response is the reply of a control socket
+type Response struct {
+	OK    bool            `json:"ok"`
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// Handler answers a control command. The result is sent as JSON.
+type Handler func() (interface{}, error)
+
+// Server is the control socket of a running command
+type Server struct {
+	listener net.Listener
+	path     string
+	handlers map[string]Handler
+	inFlight sync.WaitGroup // Requests being answered
+	once     sync.Once
+}
+
+// SocketPath returns the path of the control socket with the given name
+func SocketPath(name string) (string, error) {
+	globalDir, err := config.GlobalDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(globalDir, RunDir, name+socketExt), nil
+}
+
+// Listen opens the control socket of a command. A socket left behind by a
+// process that is no longer running is replaced.
+func Listen(name string, handlers map[string]Handler) (*Server, error) {
+	path, err := SocketPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the user may control their commands
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create run directory: %w", err)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("control socket %s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale control socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open control socket: %w", err)
+	}
+	return &Server{listener: listener, path: path, handlers: handlers}, nil
+}
+
+// Path returns the path of the control socket
+func (s *Server) Path() string {
+	return s.path
+}
+
+// Serve answers requests until the server is closed
+func (s *Server) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle answers the requests of one connection
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		if err := s.answer(scanner.Bytes(), encoder); err != nil {
+			return
+		}
+	}
+}
+
+// answer handles a single request line
+func (s *Server) answer(line []byte, encoder *json.Encoder) error {
+	s.inFlight.Add(1)
+	defer s.inFlight.Done()
+
+	var req Request
+	var resp Response
+	if err := json.Unmarshal(line, &req); err != nil {
+		resp.Error = fmt.Sprintf("invalid request: %v", err)
+	} else if handler, ok := s.handlers[req.Command]; !ok {
+		resp.Error = fmt.Sprintf("unsupported command: %s", req.Command)
+	} else if result, err := handler(); err != nil {
+		resp.Error = err.Error()
+	} else if data, err := json.Marshal(result); err != nil {
+		resp.Error = fmt.Sprintf("failed to encode result: %v", err)
+	} else {
+		resp.OK = true
+		resp.Data = data
+	}
+	return encoder.Encode(resp)
+}
+
+// Close stops the server and removes its socket. Requests being answered,
+// such as the stop command that led to Close, are finished first.
+func (s *Server) Close() error {
+	var err error
+	s.once.Do(func() {
+		err = s.listener.Close()
+		os.Remove(s.path)
+		s.inFlight.Wait()
+	})
+	return err
+}
+
+// List returns the names of the control sockets that answer, removing
+// sockets left behind by processes that are no longer running
+func List() ([]string, error) {
+	dir, err := SocketPath("")
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Dir(dir)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read run directory: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), socketExt) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err != nil {
+			os.Remove(path)
+			continue
+		}
+		conn.Close()
+		names = append(names, strings.TrimSuffix(entry.Name(), socketExt))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Call sends a command to the named control socket and decodes the result
+// into result, which may be nil
+func Call(name, command string, result interface{}) error {
+	path, err := SocketPath(name)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", name, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if err := json.NewEncoder(conn).Encode(Request{Command: command}); err != nil {
+		return fmt.Errorf("failed to send command: %w", err)
+	}
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if !resp.OK {
+		return fmt.Errorf("%s: %s", name, resp.Error)
+	}
+	if result != nil && len(resp.Data) > 0 {
+		if err := json.Unmarshal(resp.Data, result); err != nil {
+			return fmt.Errorf("failed to parse response: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// CertRotation records that the local certificate replaced an older one.
+// It is signed with the key of the replaced certificate, so a peer that
+// pinned the old certificate can follow the rotation without trusting
+// anything new.
+type CertRotation struct {
+	OldFingerprint string    `json:"old_fingerprint"`
+	OldCert        string    `json:"old_cert"` // Base64 DER of the replaced certificate
+	NewFingerprint string    `json:"new_fingerprint"`
+	RotatedAt      time.Time `json:"rotated_at"`
+	Signature      string    `json:"signature"` // ECDSA over the rotation, by the replaced certificate's key
+}
+
+// message returns the bytes the rotation's signature covers
+func (r *CertRotation) message() []byte {
+	msg := fmt.Sprintf("dsp-cert-rotation/v1\n%s\n%s\n%s", r.OldFingerprint, r.NewFingerprint, r.RotatedAt.UTC().Format(time.RFC3339))
+	sum := sha256.Sum256([]byte(msg))
+	return sum[:]
+}
+
+// verify checks that the rotation was signed by the certificate it replaces
+func (r *CertRotation) verify() error {
+	der, err := base64.StdEncoding.DecodeString(r.OldCert)
+	if err != nil {
+		return fmt.Errorf("invalid certificate in rotation: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("invalid certificate in rotation: %w", err)
+	}
+	if sum := sha256.Sum256(cert.Raw); hex.EncodeToString(sum[:]) != r.OldFingerprint {
+		return fmt.Errorf("certificate in rotation does not match its fingerprint")
+	}
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("certificate in rotation does not have an ECDSA key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid rotation signature: %w", err)
+	}
+	if !ecdsa.VerifyASN1(pub, r.message(), sig) {
+		return fmt.Errorf("invalid rotation signature")
+	}
+	return nil
+}
+
+// VerifyCertRotation checks that a chain of rotations leads from the pinned
+// certificate fingerprint to the presented one, each rotation signed by the
+// certificate it replaced
+func VerifyCertRotation(chain []CertRotation, pinned, presented string) error {
+	fingerprint := pinned
+	for steps := 0; fingerprint != presented; steps++ {
+		if steps == len(chain) {
+			return fmt.Errorf("no certificate rotation leads from the pinned certificate")
+		}
+		var next *CertRotation
+		for i := range chain {
+			if chain[i].OldFingerprint == fingerprint {
+				next = &chain[i]
+				break
+			}
+		}
+		if next == nil {
+			return fmt.Errorf("no certificate rotation leads from the pinned certificate")
+		}
+		if err := next.verify(); err != nil {
+			return err
+		}
+		fingerprint = next.NewFingerprint
+	}
+	return nil
+}
+
+// certRotationsPath is the file the rotations of the local certificate are
+// recorded in, oldest first
+func (m *KeyManager) certRotationsPath() string {
+	return filepath.Join(m.keyDir, "dsp-local.rotations.json")
+}
+
+// CertRotations returns the rotations of the local certificate, oldest
+// first. Peers are sent them, so they can follow the rotations.
+func (m *KeyManager) CertRotations() ([]CertRotation, error) {
+	data, err := os.ReadFile(m.certRotationsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate rotations: %w", err)
+	}
+	var rotations []CertRotation
+	if err := json.Unmarshal(data, &rotations); err != nil {
+		return nil, fmt.Errorf("failed to parse certificate rotations: %w", err)
+	}
+	return rotations, nil
+}
+
+// RotateCertificate replaces the local certificate with a new one for the
+// current hostname and the extra subject alternative names sans. The
+// rotation is signed with the old certificate's key and recorded, so peers
+// that pinned the old certificate accept the new one.
+func (m *KeyManager) RotateCertificate(sans []string) (*CertRotation, error) {
+	unlock, err := config.LockGlobal(config.KeysLock)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	oldCertPEM, err := os.ReadFile(m.certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate: %w", err)
+	}
+	oldKeyPEM, err := os.ReadFile(m.certKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate key: %w", err)
+	}
+	defer utils.Wipe(oldKeyPEM)
+
+	certBlock, _ := pem.Decode(oldCertPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("failed to decode certificate PEM")
+	}
+	keyBlock, _ := pem.Decode(oldKeyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("failed to decode certificate key PEM")
+	}
+	defer utils.Wipe(keyBlock.Bytes)
+	parsedKey, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate key: %w", err)
+	}
+	oldKey, ok := parsedKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("certificate key is not an ECDSA key")
+	}
+
+	// Put the old certificate back if the new one cannot be written whole
+	if err := m.generateLocalCertificate(sans...); err != nil {
+		os.WriteFile(m.certPath, oldCertPEM, 0644)
+		os.WriteFile(m.certKeyPath, oldKeyPEM, 0600)
+		return nil, fmt.Errorf("failed to generate certificate: %w", err)
+	}
+	newFingerprint, err := m.GetCertificateFingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	oldSum := sha256.Sum256(certBlock.Bytes)
+	rotation := CertRotation{
+		OldFingerprint: hex.EncodeToString(oldSum[:]),
+		OldCert:        base64.StdEncoding.EncodeToString(certBlock.Bytes),
+		NewFingerprint: newFingerprint,
+		RotatedAt:      time.Now().UTC().Truncate(time.Second),
+	}
+	sig, err := ecdsa.SignASN1(rand.Reader, oldKey, rotation.message())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate rotation: %w", err)
+	}
+	rotation.Signature = base64.StdEncoding.EncodeToString(sig)
+
+	rotations, err := m.CertRotations()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(append(rotations, rotation), "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal certificate rotations: %w", err)
+	}
+	if err := os.WriteFile(m.certRotationsPath(), data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to record certificate rotation: %w", err)
+	}
+	return &rotation, nil
+}
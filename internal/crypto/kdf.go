@@ -0,0 +1,274 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/Mattddixo/dsp/pkg/utils"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Key derivation functions for passphrase encryption
+const (
+	KDFScrypt   = "scrypt"   // age's own scrypt recipient
+	KDFArgon2id = "argon2id" // Argon2id recipient stanzas in age files
+)
+
+// ValidKDFs lists the key derivation functions passphrases can use
+var ValidKDFs = []string{KDFScrypt, KDFArgon2id}
+
+// Default and largest work factors. Importers refuse parameters above the
+// limits, so a peer cannot make them spend unbounded time or memory. Both
+// maxima use 4 GiB of memory.
+const (
+	DefaultScryptWorkFactor = 18 // log2 of the scrypt cost, as age uses
+	MaxScryptWorkFactor     = 22 // The most age decrypts by default
+
+	DefaultArgon2Time     = 3  // Passes over memory
+	DefaultArgon2MemoryMB = 64 // Memory in MiB
+	DefaultArgon2Threads  = 4
+	MaxArgon2Time         = 64
+	MaxArgon2MemoryMB     = 4096
+)
+
+// argon2Stanza is the type of the recipient stanzas of Argon2id passphrases
+const argon2Stanza = "argon2id"
+
+// argon2Label separates Argon2id keys of DSP files from keys derived from
+// the same passphrase for other uses
+const argon2Label = "dsp.argon2id/v1"
+
+// KDFParams are the key derivation function and work factors of a
+// passphrase-encrypted file. Exporters record them in export info so
+// importers derive keys the same way.
+type KDFParams struct {
+	Algorithm  string `json:"algorithm"`
+	WorkFactor int    `json:"work_factor,omitempty"` // log2 of the scrypt cost
+	Time       uint32 `json:"time,omitempty"`        // Argon2id passes
+	MemoryMB   uint32 `json:"memory_mb,omitempty"`   // Argon2id memory in MiB
+	Threads    uint8  `json:"threads,omitempty"`     // Argon2id parallelism
+}
+
+// Resolved returns the parameters with defaults filled in. Nil parameters
+// are those of exporters that did not record any: scrypt with age's
+// default work factor.
+func (p *KDFParams) Resolved() KDFParams {
+	var r KDFParams
+	if p != nil {
+		r = *p
+	}
+	if r.Algorithm == "" {
+		r.Algorithm = KDFScrypt
+	}
+	switch r.Algorithm {
+	case KDFScrypt:
+		if r.WorkFactor == 0 {
+			r.WorkFactor = DefaultScryptWorkFactor
+		}
+		r.Time, r.MemoryMB, r.Threads = 0, 0, 0
+	case KDFArgon2id:
+		if r.Time == 0 {
+			r.Time = DefaultArgon2Time
+		}
+		if r.MemoryMB == 0 {
+			r.MemoryMB = DefaultArgon2MemoryMB
+		}
+		if r.Threads == 0 {
+			r.Threads = DefaultArgon2Threads
+		}
+		r.WorkFactor = 0
+	}
+	return r
+}
+
+// Validate checks the parameters, after defaults, against the limits
+func (p *KDFParams) Validate() error {
+	r := p.Resolved()
+	switch r.Algorithm {
+	case KDFScrypt:
+		if r.WorkFactor < 1 || r.WorkFactor > MaxScryptWorkFactor {
+			return fmt.Errorf("scrypt work factor must be between 1 and %d", MaxScryptWorkFactor)
+		}
+	case KDFArgon2id:
+		if r.Time > MaxArgon2Time {
+			return fmt.Errorf("argon2id time must be at most %d", MaxArgon2Time)
+		}
+		if r.MemoryMB > MaxArgon2MemoryMB {
+			return fmt.Errorf("argon2id memory must be at most %d MiB", MaxArgon2MemoryMB)
+		}
+	default:
+		return fmt.Errorf("unknown key derivation function %q, must be one of: %s", r.Algorithm, strings.Join(ValidKDFs, ", "))
+	}
+	return nil
+}
+
+// Recipient returns an age recipient encrypting for passphrase with these
+// parameters. Unlike scrypt recipients, several Argon2id recipients can
+// share a file.
+func (p *KDFParams) Recipient(passphrase string) (age.Recipient, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	r := p.Resolved()
+	if r.Algorithm == KDFArgon2id {
+		return &argon2Recipient{passphrase: passphrase, params: r}, nil
+	}
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	recipient.SetWorkFactor(r.WorkFactor)
+	return recipient, nil
+}
+
+// Identity returns an age identity decrypting files encrypted for
+// passphrase with these parameters, refusing costlier ones
+func (p *KDFParams) Identity(passphrase string) (age.Identity, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	r := p.Resolved()
+	if r.Algorithm == KDFArgon2id {
+		return &argon2Identity{passphrase: passphrase, max: r}, nil
+	}
+	return age.NewScryptIdentity(passphrase)
+}
+
+// EncryptWithKDF encrypts data for each passphrase with the given
+// parameters (nil for scrypt defaults)
+func EncryptWithKDF(data []byte, passphrases []string, params *KDFParams) ([]byte, error) {
+	var recipients []age.Recipient
+	for _, passphrase := range passphrases {
+		recipient, err := params.Recipient(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create recipient: %w", err)
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create encrypt writer: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to write data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finalize encryption: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// DecryptWithKDF decrypts data encrypted for passphrase with the given
+// parameters (nil for scrypt defaults)
+func DecryptWithKDF(data []byte, passphrase string, params *KDFParams) ([]byte, error) {
+	identity, err := params.Identity(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create identity: %w", err)
+	}
+	r, err := age.Decrypt(bytes.NewReader(data), identity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decrypt reader: %w", err)
+	}
+	decrypted, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read decrypted data: %w", err)
+	}
+	return decrypted, nil
+}
+
+// argon2Recipient wraps file keys with a key derived from a passphrase with
+// Argon2id. Its stanza records the salt and parameters:
+//
+//	-> argon2id <salt> <time> <memory KiB> <threads>
+//	<file key sealed with ChaCha20-Poly1305>
+type argon2Recipient struct {
+	passphrase string
+	params     KDFParams
+}
+
+func (r *argon2Recipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	memory := r.params.MemoryMB * 1024
+	key := argon2Key(r.passphrase, salt, r.params.Time, memory, r.params.Threads)
+	defer utils.Wipe(key)
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	body := aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil)
+	return []*age.Stanza{{
+		Type: argon2Stanza,
+		Args: []string{
+			base64.RawStdEncoding.EncodeToString(salt),
+			strconv.FormatUint(uint64(r.params.Time), 10),
+			strconv.FormatUint(uint64(memory), 10),
+			strconv.FormatUint(uint64(r.params.Threads), 10),
+		},
+		Body: body,
+	}}, nil
+}
+
+// argon2Identity unwraps file keys of argon2Recipient stanzas whose
+// parameters do not exceed max
+type argon2Identity struct {
+	passphrase string
+	max        KDFParams
+}
+
+func (i *argon2Identity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		if s.Type != argon2Stanza {
+			continue
+		}
+		if len(s.Args) != 4 {
+			return nil, fmt.Errorf("invalid argon2id recipient block")
+		}
+		salt, err := base64.RawStdEncoding.Strict().DecodeString(s.Args[0])
+		if err != nil || len(salt) != 16 {
+			return nil, fmt.Errorf("invalid argon2id salt")
+		}
+		passes, err1 := strconv.ParseUint(s.Args[1], 10, 32)
+		memory, err2 := strconv.ParseUint(s.Args[2], 10, 32)
+		threads, err3 := strconv.ParseUint(s.Args[3], 10, 8)
+		if err1 != nil || err2 != nil || err3 != nil || passes == 0 || memory == 0 || threads == 0 {
+			return nil, fmt.Errorf("invalid argon2id parameters")
+		}
+		if passes > uint64(i.max.Time) || memory > uint64(i.max.MemoryMB)*1024 {
+			return nil, fmt.Errorf("argon2id parameters exceed the expected work factor")
+		}
+
+		key := argon2Key(i.passphrase, salt, uint32(passes), uint32(memory), uint8(threads))
+		aead, err := chacha20poly1305.New(key)
+		utils.Wipe(key)
+		if err != nil {
+			return nil, err
+		}
+		fileKey, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), s.Body, nil)
+		if err != nil {
+			// Sealed for another passphrase, such as another token's
+			continue
+		}
+		return fileKey, nil
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+// argon2Key derives a ChaCha20-Poly1305 key from a passphrase. memory is
+// in KiB.
+func argon2Key(passphrase string, salt []byte, passes, memory uint32, threads uint8) []byte {
+	labeled := append([]byte(argon2Label), salt...)
+	return argon2.IDKey([]byte(passphrase), labeled, passes, memory, threads, chacha20poly1305.KeySize)
+}
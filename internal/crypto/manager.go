@@ -19,25 +19,21 @@ import (
 	"strings"
 	"time"
 
-	"gopkg.in/yaml.v3"
+	"github.com/Mattddixo/dsp/config"
 )
 
 // NewKeyManager creates a new key manager
 func NewKeyManager() (*KeyManager, error) {
-	// Get user's home directory
-	homeDir, err := os.UserHomeDir()
+	// Set up global directory and all required subdirectories
+	keyDir, err := config.GlobalDir()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get home directory: %w", err)
+		return nil, err
 	}
-
-	// Set up global directory and all required subdirectories
-	keyDir := filepath.Join(homeDir, ".dsp-global")
 	requiredDirs := []string{
-		keyDir,                                                // Base directory
-		filepath.Join(keyDir, "keys"),                         // Keys directory
-		filepath.Join(keyDir, "keys", "private"),              // Private keys directory
-		filepath.Join(keyDir, "keys", "public"),               // Public keys directory
-		filepath.Join(keyDir, "keys", "public", "recipients"), // Recipients directory
+		keyDir,                                   // Base directory
+		filepath.Join(keyDir, "keys"),            // Keys directory
+		filepath.Join(keyDir, "keys", "private"), // Private keys directory
+		filepath.Join(keyDir, "keys", "public"),  // Public keys directory
 	}
 
 	// Create all required directories with appropriate permissions
@@ -59,20 +55,18 @@ func NewKeyManager() (*KeyManager, error) {
 		certKeyPath: filepath.Join(keyDir, "dsp-local.key"),
 	}
 
-	// Load existing config or create new one
-	if err := km.loadConfig(); err != nil {
-		// If config doesn't exist, create empty one
-		km.Config = RecipientsConfig{Recipients: []Recipient{}}
-		if err := km.saveConfig(); err != nil {
-			return nil, fmt.Errorf("failed to create initial config: %w", err)
-		}
-	}
-
 	return km, nil
 }
 
-// InitializeKeys generates new age keys and a local certificate
+// InitializeKeys generates new age keys and a local certificate. It holds
+// the keys lock, so concurrent runs do not generate competing keys.
 func (m *KeyManager) InitializeKeys() error {
+	unlock, err := config.LockGlobal(config.KeysLock)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Generate age key pair if it doesn't exist
 	if _, err := os.Stat(m.GetPrivateKeyPath()); os.IsNotExist(err) {
 		if err := m.GenerateKeyPair(); err != nil {
@@ -123,8 +117,9 @@ func (m *KeyManager) generateAgeKeys() error {
 	return nil
 }
 
-// generateLocalCertificate generates a self-signed certificate for local LAN use
-func (m *KeyManager) generateLocalCertificate() error {
+// generateLocalCertificate generates a self-signed certificate for local LAN
+// use. sans are extra subject alternative names: IP addresses or DNS names.
+func (m *KeyManager) generateLocalCertificate(sans ...string) error {
 	// Get hostname for certificate
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -162,6 +157,13 @@ func (m *KeyManager) generateLocalCertificate() error {
 			"*.local", // Allow .local domain
 		},
 	}
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, san)
+		}
+	}
 
 	// Create certificate
 	certDER, err := x509.CreateCertificate(
@@ -205,6 +207,16 @@ func (m *KeyManager) GetCertificate() (tls.Certificate, error) {
 	return tls.LoadX509KeyPair(m.certPath, m.certKeyPath)
 }
 
+// GetCertificatePath returns the path to the local certificate
+func (m *KeyManager) GetCertificatePath() string {
+	return m.certPath
+}
+
+// GetCertificateKeyPath returns the path to the local certificate private key
+func (m *KeyManager) GetCertificateKeyPath() string {
+	return m.certKeyPath
+}
+
 // GetCertificateFingerprint returns the SHA-256 fingerprint of the local certificate
 func (m *KeyManager) GetCertificateFingerprint() (string, error) {
 	certPEM, err := os.ReadFile(m.certPath)
@@ -253,101 +265,6 @@ func (m *KeyManager) VerifyCertificate(cert *x509.Certificate) error {
 	return nil
 }
 
-// loadConfig loads the recipients configuration
-func (m *KeyManager) loadConfig() error {
-	configPath := filepath.Join(m.keyDir, "keys", "recipients.yaml")
-
-	// If config doesn't exist, create empty one
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		m.Config = RecipientsConfig{Recipients: []Recipient{}}
-		return m.saveConfig()
-	}
-
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return fmt.Errorf("failed to read config: %w", err)
-	}
-
-	if err := yaml.Unmarshal(data, &m.Config); err != nil {
-		return fmt.Errorf("failed to parse config: %w", err)
-	}
-
-	return nil
-}
-
-// saveConfig saves the recipients configuration
-func (m *KeyManager) saveConfig() error {
-	data, err := yaml.Marshal(m.Config)
-	if err != nil {
-		return fmt.Errorf("failed to marshal config: %w", err)
-	}
-
-	configPath := filepath.Join(m.keyDir, "keys", "recipients.yaml")
-	if err := os.WriteFile(configPath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write config: %w", err)
-	}
-
-	return nil
-}
-
-// AddRecipient adds a new recipient
-func (m *KeyManager) AddRecipient(name, publicKey string) error {
-	// Generate a unique key ID
-	keyID := fmt.Sprintf("%s-%d", name, time.Now().Unix())
-
-	// Save the public key file
-	keyPath := filepath.Join(m.keyDir, "keys", "public", "recipients", keyID+".pub")
-	if err := os.WriteFile(keyPath, []byte(publicKey), 0644); err != nil {
-		return fmt.Errorf("failed to save public key: %w", err)
-	}
-
-	// Add to config
-	recipient := Recipient{
-		Name:    name,
-		KeyID:   keyID,
-		Key:     publicKey,
-		Added:   time.Now(),
-		Trusted: true, // Default to trusted
-	}
-	m.Config.Recipients = append(m.Config.Recipients, recipient)
-
-	return m.saveConfig()
-}
-
-// GetRecipient gets a recipient by name
-func (m *KeyManager) GetRecipient(name string) (*Recipient, error) {
-	for _, r := range m.Config.Recipients {
-		if r.Name == name {
-			return &r, nil
-		}
-	}
-	return nil, fmt.Errorf("recipient not found: %s", name)
-}
-
-// ListRecipients lists all known recipients
-func (m *KeyManager) ListRecipients() []Recipient {
-	return m.Config.Recipients
-}
-
-// RemoveRecipient removes a recipient
-func (m *KeyManager) RemoveRecipient(name string) error {
-	// Find and remove from config
-	for i, r := range m.Config.Recipients {
-		if r.Name == name {
-			// Remove the key file
-			keyPath := filepath.Join(m.keyDir, "keys", "public", "recipients", r.KeyID+".pub")
-			if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
-				return fmt.Errorf("failed to remove key file: %w", err)
-			}
-
-			// Remove from config
-			m.Config.Recipients = append(m.Config.Recipients[:i], m.Config.Recipients[i+1:]...)
-			return m.saveConfig()
-		}
-	}
-	return fmt.Errorf("recipient not found: %s", name)
-}
-
 // GetPrivateKeyPath returns the path to the private key
 func (m *KeyManager) GetPrivateKeyPath() string {
 	return filepath.Join(m.keyDir, "keys", "private", "age.key")
@@ -4,17 +4,21 @@ import (
 	"bytes"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"filippo.io/age"
+	"github.com/Mattddixo/dsp/pkg/utils"
 )
 
 // GenerateKeyPair generates a new age key pair
@@ -81,62 +85,11 @@ func (m *KeyManager) GetPublicKey() (string, error) {
 	return string(data), nil
 }
 
-// EncryptWithPublicKey encrypts data for a recipient
-func (m *KeyManager) EncryptWithPublicKey(recipientName string, data []byte) ([]byte, error) {
-	recipient, err := m.GetRecipient(recipientName)
-	if err != nil {
-		return nil, err
-	}
-
-	// Parse the recipient's public key
-	r, err := age.ParseX25519Recipient(recipient.Key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse recipient key: %w", err)
-	}
-
-	// Create an encrypted writer
-	var buf bytes.Buffer
-	w, err := age.Encrypt(&buf, r)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create encrypted writer: %w", err)
-	}
-
-	// Write the data
-	if _, err := w.Write(data); err != nil {
-		return nil, fmt.Errorf("failed to write data: %w", err)
-	}
-
-	// Close the writer to finalize encryption
-	if err := w.Close(); err != nil {
-		return nil, fmt.Errorf("failed to finalize encryption: %w", err)
-	}
-
-	return buf.Bytes(), nil
-}
-
 // DecryptWithPrivateKey decrypts data using the private key
 func (m *KeyManager) DecryptWithPrivateKey(data []byte) ([]byte, error) {
-	privateKeyPath := m.GetPrivateKeyPath()
-	if _, err := os.Stat(privateKeyPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("private key not found at %s", privateKeyPath)
-	}
-
-	// Read and parse the private key
-	identityFile, err := os.Open(privateKeyPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open private key: %w", err)
-	}
-	defer identityFile.Close()
-
-	identity, err := age.ParseIdentities(identityFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse private key: %w", err)
-	}
-
-	// Create a reader for the encrypted data
-	r, err := age.Decrypt(bytes.NewReader(data), identity...)
+	r, err := m.DecryptStreamWithPrivateKey(bytes.NewReader(data))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create decrypted reader: %w", err)
+		return nil, err
 	}
 
 	// Read the decrypted data
@@ -199,48 +152,6 @@ func (m *KeyManager) DecryptWithPassphrase(passphrase string, data []byte) ([]by
 	return decrypted, nil
 }
 
-// EncryptWithMultipleRecipients encrypts data for multiple recipients
-func (m *KeyManager) EncryptWithMultipleRecipients(recipientNames []string, data []byte) ([]byte, error) {
-	if len(recipientNames) == 0 {
-		return nil, fmt.Errorf("no recipients specified")
-	}
-
-	// Parse all recipient keys
-	var recipients []age.Recipient
-	for _, name := range recipientNames {
-		recipient, err := m.GetRecipient(name)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get recipient %s: %w", name, err)
-		}
-
-		// Parse the recipient's public key
-		r, err := age.ParseX25519Recipient(recipient.Key)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse recipient key for %s: %w", name, err)
-		}
-		recipients = append(recipients, r)
-	}
-
-	// Create an encrypted writer with all recipients
-	var buf bytes.Buffer
-	w, err := age.Encrypt(&buf, recipients...)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create encrypted writer: %w", err)
-	}
-
-	// Write the data
-	if _, err := w.Write(data); err != nil {
-		return nil, fmt.Errorf("failed to write data: %w", err)
-	}
-
-	// Close the writer to finalize encryption
-	if err := w.Close(); err != nil {
-		return nil, fmt.Errorf("failed to finalize encryption: %w", err)
-	}
-
-	return buf.Bytes(), nil
-}
-
 // GenerateSigningKeyPair generates a new ed25519 key pair for signing
 func (m *KeyManager) GenerateSigningKeyPair() error {
 	// Generate new key pair
@@ -317,18 +228,32 @@ func (m *KeyManager) GenerateSigningKeyPair() error {
 
 // SignExportInfo signs the export information using the private key
 func (m *KeyManager) SignExportInfo(info interface{}) (string, error) {
+	// Marshal the info to JSON
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal info: %w", err)
+	}
+
+	return m.SignData(infoJSON)
+}
+
+// SignData signs data with the signing private key and returns the signature
+// as a base64 string
+func (m *KeyManager) SignData(data []byte) (string, error) {
 	// Read signing private key
 	privateKeyPath := m.GetSigningKeyPath()
 	privateKeyData, err := os.ReadFile(privateKeyPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to read signing key: %w", err)
 	}
+	defer utils.Wipe(privateKeyData)
 
 	// Parse PEM block
 	block, _ := pem.Decode(privateKeyData)
 	if block == nil {
 		return "", fmt.Errorf("failed to decode PEM block")
 	}
+	defer utils.Wipe(block.Bytes)
 
 	// Parse private key
 	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
@@ -341,31 +266,46 @@ func (m *KeyManager) SignExportInfo(info interface{}) (string, error) {
 	if !ok {
 		return "", fmt.Errorf("signing key is not an ed25519 key")
 	}
-
-	// Marshal the info to JSON
-	infoJSON, err := json.Marshal(info)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal info: %w", err)
-	}
+	defer utils.Wipe(ed25519Key)
 
 	// Create a signature using ed25519
-	signature := ed25519.Sign(ed25519Key, infoJSON)
+	signature := ed25519.Sign(ed25519Key, data)
 
 	// Return the signature as a base64 string
 	return base64.StdEncoding.EncodeToString(signature), nil
 }
 
+// GetSigningPublicKey returns the signing public key in PEM format
+func (m *KeyManager) GetSigningPublicKey() ([]byte, error) {
+	data, err := os.ReadFile(m.GetSigningPublicKeyPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing public key: %w", err)
+	}
+	return data, nil
+}
+
 // VerifyExportInfo verifies the signature of export information
 func (m *KeyManager) VerifyExportInfo(info interface{}, signature string) error {
 	// Get the signing public key
-	publicKeyPath := m.GetSigningPublicKeyPath()
-	publicKeyData, err := os.ReadFile(publicKeyPath)
+	publicKeyData, err := m.GetSigningPublicKey()
+	if err != nil {
+		return err
+	}
+
+	// Marshal the info to JSON
+	infoJSON, err := json.Marshal(info)
 	if err != nil {
-		return fmt.Errorf("failed to read signing public key: %w", err)
+		return fmt.Errorf("failed to marshal info: %w", err)
 	}
 
+	return VerifyData(publicKeyData, infoJSON, signature)
+}
+
+// VerifyData verifies a base64 signature of data against a signing public
+// key in PEM format
+func VerifyData(publicKeyPEM, data []byte, signature string) error {
 	// Parse PEM block
-	block, _ := pem.Decode(publicKeyData)
+	block, _ := pem.Decode(publicKeyPEM)
 	if block == nil {
 		return fmt.Errorf("failed to decode PEM block")
 	}
@@ -382,12 +322,6 @@ func (m *KeyManager) VerifyExportInfo(info interface{}, signature string) error
 		return fmt.Errorf("signing public key is not an ed25519 key")
 	}
 
-	// Marshal the info to JSON
-	infoJSON, err := json.Marshal(info)
-	if err != nil {
-		return fmt.Errorf("failed to marshal info: %w", err)
-	}
-
 	// Decode the signature
 	sig, err := base64.StdEncoding.DecodeString(signature)
 	if err != nil {
@@ -395,28 +329,67 @@ func (m *KeyManager) VerifyExportInfo(info interface{}, signature string) error
 	}
 
 	// Verify the signature using ed25519
-	if !ed25519.Verify(ed25519Key, infoJSON, sig) {
+	if !ed25519.Verify(ed25519Key, data, sig) {
 		return fmt.Errorf("invalid signature")
 	}
 
 	return nil
 }
 
-// EncryptWithPassphrase encrypts data using a passphrase
+// SigningKeyFingerprint returns the SHA-256 fingerprint of a signing public
+// key in PEM format
+func SigningKeyFingerprint(publicKeyPEM []byte) (string, error) {
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil {
+		return "", fmt.Errorf("failed to decode PEM block")
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// EncryptWithPassphrase encrypts data using a passphrase, with scrypt and
+// age's default work factor
 func EncryptWithPassphrase(data []byte, passphrase string) ([]byte, error) {
-	// Create a new age recipient from the passphrase
-	recipient, err := age.NewScryptRecipient(passphrase)
+	return EncryptWithKDF(data, []string{passphrase}, nil)
+}
+
+// DecryptWithPassphrase decrypts data encrypted by EncryptWithPassphrase
+func DecryptWithPassphrase(data []byte, passphrase string) ([]byte, error) {
+	return DecryptWithKDF(data, passphrase, nil)
+}
+
+// ParsePublicKeys parses age public keys. A key may be given as printed by
+// 'dsp crypto export-key', including its comment line.
+func ParsePublicKeys(publicKeys []string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, key := range publicKeys {
+		parsed, err := age.ParseRecipients(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse recipient key: %w", err)
+		}
+		recipients = append(recipients, parsed...)
+	}
+	return recipients, nil
+}
+
+// EncryptForPublicKeys encrypts data so that any of the given age public keys
+// can decrypt it
+func EncryptForPublicKeys(data []byte, publicKeys []string) ([]byte, error) {
+	if len(publicKeys) == 0 {
+		return nil, fmt.Errorf("no recipients specified")
+	}
+
+	// Parse all recipient keys
+	recipients, err := ParsePublicKeys(publicKeys)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create recipient: %w", err)
+		return nil, err
 	}
 
-	// Create a buffer to hold the encrypted data
+	// Create an encrypted writer with all recipients
 	var buf bytes.Buffer
-
-	// Create an age writer
-	w, err := age.Encrypt(&buf, recipient)
+	w, err := age.Encrypt(&buf, recipients...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create encrypt writer: %w", err)
+		return nil, fmt.Errorf("failed to create encrypted writer: %w", err)
 	}
 
 	// Write the data
@@ -432,28 +405,67 @@ func EncryptWithPassphrase(data []byte, passphrase string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// DecryptWithPassphrase decrypts data using a passphrase
-func DecryptWithPassphrase(data []byte, passphrase string) ([]byte, error) {
-	// Create a new age identity from the passphrase
-	identity, err := age.NewScryptIdentity(passphrase)
+// ageHeader starts every binary age-encrypted file
+const ageHeader = "age-encryption.org/v1\n"
+
+// IsEncrypted reports whether data is age-encrypted
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ageHeader))
+}
+
+// EncryptForSelf encrypts data for this host's own age key, so only this
+// host can read it back with DecryptWithPrivateKey
+func (m *KeyManager) EncryptForSelf(data []byte) ([]byte, error) {
+	publicKey, err := m.GetPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("no local age key to encrypt with (run 'dsp crypto init'): %w", err)
+	}
+	return EncryptForPublicKeys(data, []string{publicKey})
+}
+
+// EncryptStreamForSelf returns a writer that encrypts what is written to it
+// for this host's own age key and writes it to w. Closing the writer
+// finishes the encryption; it does not close w.
+func (m *KeyManager) EncryptStreamForSelf(w io.Writer) (io.WriteCloser, error) {
+	publicKey, err := m.GetPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("no local age key to encrypt with (run 'dsp crypto init'): %w", err)
+	}
+	recipients, err := ParsePublicKeys([]string{publicKey})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create identity: %w", err)
+		return nil, err
+	}
+	encrypted, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create encrypted writer: %w", err)
 	}
+	return encrypted, nil
+}
 
-	// Create a reader from the encrypted data
-	r := bytes.NewReader(data)
+// DecryptStreamWithPrivateKey returns a reader of the data encrypted in r
+// for this host's age key
+func (m *KeyManager) DecryptStreamWithPrivateKey(r io.Reader) (io.Reader, error) {
+	privateKeyPath := m.GetPrivateKeyPath()
+	if _, err := os.Stat(privateKeyPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("private key not found at %s", privateKeyPath)
+	}
 
-	// Create an age reader
-	decrypted, err := age.Decrypt(r, identity)
+	// Read and parse the private key
+	keyData, err := os.ReadFile(privateKeyPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create decrypt reader: %w", err)
+		return nil, fmt.Errorf("failed to open private key: %w", err)
 	}
+	defer utils.Wipe(keyData)
 
-	// Read the decrypted data
-	decryptedData, err := io.ReadAll(decrypted)
+	identity, err := age.ParseIdentities(bytes.NewReader(keyData))
 	if err != nil {
-		return nil, fmt.Errorf("failed to read decrypted data: %w", err)
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
 	}
 
-	return decryptedData, nil
+	// Create a reader for the encrypted data
+	decrypted, err := age.Decrypt(r, identity...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decrypted reader: %w", err)
+	}
+	return decrypted, nil
 }
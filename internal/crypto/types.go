@@ -2,29 +2,13 @@ package crypto
 
 import "time"
 
-// Recipient represents a person who can receive encrypted bundles
-type Recipient struct {
-	Name    string    `yaml:"name"`
-	KeyID   string    `yaml:"key_id"`
-	Key     string    `yaml:"key"` // The actual public key
-	Added   time.Time `yaml:"added"`
-	Notes   string    `yaml:"notes,omitempty"`
-	Trusted bool      `yaml:"trusted"`
-}
-
-// RecipientsConfig holds the configuration for known recipients
-type RecipientsConfig struct {
-	Recipients []Recipient `yaml:"recipients"`
-}
-
 // KeyManager manages cryptographic keys and certificates
 type KeyManager struct {
 	keyDir      string
 	privateKey  string
 	publicKey   string
-	certPath    string           // Path to the local certificate
-	certKeyPath string           // Path to the certificate private key
-	Config      RecipientsConfig // Configuration for recipients
+	certPath    string // Path to the local certificate
+	certKeyPath string // Path to the certificate private key
 }
 
 // EncryptionMethod specifies how a bundle is encrypted
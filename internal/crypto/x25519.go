@@ -0,0 +1,132 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// age encodes X25519 keys in bech32 with these human-readable parts
+const (
+	agePublicHRP  = "age"
+	agePrivateHRP = "age-secret-key-"
+)
+
+// X25519PublicKey returns the raw X25519 key of an age public key, as
+// printed by 'dsp crypto export-key' or stored in the hosts store
+func X25519PublicKey(publicKey string) ([]byte, error) {
+	key := strings.TrimSpace(lastKeyLine(publicKey))
+	return decodeAgeKey(key, agePublicHRP)
+}
+
+// X25519PrivateKey returns the raw X25519 key of the local age identity.
+// Peer channels use it as their static key, so hosts are identified by the
+// same keys they encrypt bundles for.
+func (m *KeyManager) X25519PrivateKey() ([]byte, error) {
+	data, err := os.ReadFile(m.GetPrivateKeyPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	defer utils.Wipe(data)
+	return decodeAgeKey(lastKeyLine(string(data)), agePrivateHRP)
+}
+
+// lastKeyLine returns the last line of a key file that is not a comment
+func lastKeyLine(data string) string {
+	var key string
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			key = line
+		}
+	}
+	return key
+}
+
+// decodeAgeKey decodes a 32-byte key in age's bech32 encoding
+func decodeAgeKey(key, hrp string) ([]byte, error) {
+	gotHRP, data, err := bech32Decode(strings.ToLower(key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid age key: %w", err)
+	}
+	if gotHRP != hrp {
+		return nil, fmt.Errorf("invalid age key: expected a %q key, got %q", hrp, gotHRP)
+	}
+	if len(data) != 32 {
+		return nil, fmt.Errorf("invalid age key: %d bytes, expected 32", len(data))
+	}
+	return data, nil
+}
+
+// bech32Charset is the alphabet of bech32 data characters
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32Decode decodes a lowercase bech32 string, checking its checksum.
+// Unlike BIP 173 it accepts strings of any length, as age does.
+func bech32Decode(s string) (string, []byte, error) {
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return "", nil, fmt.Errorf("malformed bech32 string")
+	}
+	hrp := s[:sep]
+	var values []byte
+	for _, c := range []byte(s[sep+1:]) {
+		v := strings.IndexByte(bech32Charset, c)
+		if v < 0 {
+			return "", nil, fmt.Errorf("invalid bech32 character %q", c)
+		}
+		values = append(values, byte(v))
+	}
+	if bech32Polymod(append(bech32ExpandHRP(hrp), values...)) != 1 {
+		return "", nil, fmt.Errorf("invalid bech32 checksum")
+	}
+
+	// Regroup the 5-bit values without the checksum into bytes
+	var out bytes.Buffer
+	acc, bits := 0, 0
+	for _, v := range values[:len(values)-6] {
+		acc = acc<<5 | int(v)
+		bits += 5
+		for bits >= 8 {
+			bits -= 8
+			out.WriteByte(byte(acc >> bits))
+		}
+		acc &= 1<<bits - 1
+	}
+	if bits >= 5 || acc != 0 {
+		return "", nil, fmt.Errorf("invalid bech32 padding")
+	}
+	return hrp, out.Bytes(), nil
+}
+
+func bech32ExpandHRP(hrp string) []byte {
+	out := make([]byte, 0, 2*len(hrp)+1)
+	for _, c := range []byte(hrp) {
+		out = append(out, c>>5)
+	}
+	out = append(out, 0)
+	for _, c := range []byte(hrp) {
+		out = append(out, c&31)
+	}
+	return out
+}
+
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
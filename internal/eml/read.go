@@ -0,0 +1,199 @@
+package eml
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/Mattddixo/dsp/internal/audit"
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// maxTextPartSize bounds the parts of a message other than the payload
+const maxTextPartSize = 64 << 10
+
+// Payload is a file reassembled from messages
+type Payload struct {
+	BundleID    string
+	Name        string // Name of the packaged file, such as <id>.zip or <id>.zip.age
+	Data        []byte
+	Signer      []byte // Signing public key of the sender (PEM)
+	Fingerprint string // Fingerprint of the signing key
+}
+
+// message is one parsed and verified message
+type message struct {
+	info   partInfo
+	signer []byte
+	chunk  []byte
+}
+
+// Read reassembles a file from the messages at paths. Every message must be
+// signed by the same key and every part must be present; each part and the
+// reassembled file are checked against their hashes. The caller should
+// check that the signer is trusted before using the payload.
+func Read(paths []string) (*Payload, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no messages given")
+	}
+
+	var first *message
+	var fingerprint string
+	chunks := make(map[int][]byte)
+	for _, path := range paths {
+		m, err := readMessage(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		fp, err := crypto.SigningKeyFingerprint(m.signer)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		if first == nil {
+			first, fingerprint = m, fp
+		} else {
+			switch {
+			case fp != fingerprint:
+				return nil, fmt.Errorf("%s is signed by key %s, other parts by %s", path, fp, fingerprint)
+			case m.info.BundleID != first.info.BundleID || m.info.File != first.info.File:
+				return nil, fmt.Errorf("%s belongs to %s, not %s", path, m.info.File, first.info.File)
+			case m.info.SHA256 != first.info.SHA256 || m.info.Parts != first.info.Parts || m.info.Size != first.info.Size:
+				return nil, fmt.Errorf("%s belongs to a different packaging of %s", path, m.info.File)
+			}
+		}
+		// The same part may arrive twice; the copies match their hash
+		chunks[m.info.Part] = m.chunk
+	}
+
+	// Reassemble the file
+	var missing []string
+	for part := 1; part <= first.info.Parts; part++ {
+		if _, ok := chunks[part]; !ok {
+			missing = append(missing, fmt.Sprint(part))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing parts %s of %d for %s", strings.Join(missing, ", "), first.info.Parts, first.info.File)
+	}
+	data := make([]byte, 0, first.info.Size)
+	for part := 1; part <= first.info.Parts; part++ {
+		data = append(data, chunks[part]...)
+	}
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != first.info.Size || !strings.EqualFold(hex.EncodeToString(sum[:]), first.info.SHA256) {
+		return nil, fmt.Errorf("reassembled %s does not match its hash", first.info.File)
+	}
+	audit.Record(audit.Event{Type: audit.SignatureVerified, Subject: first.info.File, Detail: fmt.Sprintf("bundle messages signed by key %s", fingerprint)})
+
+	return &Payload{
+		BundleID:    first.info.BundleID,
+		Name:        first.info.File,
+		Data:        data,
+		Signer:      first.signer,
+		Fingerprint: fingerprint,
+	}, nil
+}
+
+// readMessage parses one message and verifies its signature and part hash
+func readMessage(path string) (*message, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open message: %w", err)
+	}
+	defer file.Close()
+
+	msg, err := mail.ReadMessage(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message: %w", err)
+	}
+	if msg.Header.Get(BundleIDHeader) == "" {
+		return nil, fmt.Errorf("not a DSP bundle message: no %s header", BundleIDHeader)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" || params["boundary"] == "" {
+		return nil, fmt.Errorf("not a DSP bundle message: unexpected content type")
+	}
+
+	// Collect the attachments by file name
+	attachments := make(map[string][]byte)
+	var chunkName string
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message: %w", err)
+		}
+		name := part.FileName()
+		if name == "" {
+			continue
+		}
+		var body io.Reader = part
+		if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+			body = base64.NewDecoder(base64.StdEncoding, part)
+		}
+		switch name {
+		case partInfoFile, signatureFile, signerFile:
+			body = io.LimitReader(body, maxTextPartSize)
+		default:
+			chunkName = name
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read attachment %s: %w", name, err)
+		}
+		attachments[name] = data
+	}
+	for _, name := range []string{partInfoFile, signatureFile, signerFile} {
+		if _, ok := attachments[name]; !ok {
+			return nil, fmt.Errorf("not a DSP bundle message: missing %s", name)
+		}
+	}
+
+	// Verify the signature before trusting anything in the description. Mail
+	// systems may change line endings, so the description is compared with
+	// the line endings it was signed with.
+	description := bytes.ReplaceAll(attachments[partInfoFile], []byte("\r\n"), []byte("\n"))
+	signer := attachments[signerFile]
+	if err := crypto.VerifyData(signer, description, strings.TrimSpace(string(attachments[signatureFile]))); err != nil {
+		audit.Record(audit.Event{Type: audit.SignatureRejected, Subject: path, Detail: "bundle message: " + err.Error()})
+		return nil, fmt.Errorf("signature verification failed: %w", err)
+	}
+
+	var info partInfo
+	if err := json.Unmarshal(description, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse part description: %w", err)
+	}
+	if info.Version > formatVersion {
+		return nil, fmt.Errorf("message format version %d is newer than supported version %d", info.Version, formatVersion)
+	}
+	// Names become file names on the receiving side
+	if utils.CheckFileName(info.BundleID) != nil || utils.CheckFileName(info.File) != nil {
+		return nil, fmt.Errorf("invalid bundle name in part description")
+	}
+	if info.Parts < 1 || info.Part < 1 || info.Part > info.Parts {
+		return nil, fmt.Errorf("invalid part %d of %d", info.Part, info.Parts)
+	}
+	if chunkName != info.File {
+		return nil, fmt.Errorf("attachment %q does not match part description %q", chunkName, info.File)
+	}
+	chunk := attachments[chunkName]
+	sum := sha256.Sum256(chunk)
+	if int64(len(chunk)) != info.PartSize || !strings.EqualFold(hex.EncodeToString(sum[:]), info.PartSHA256) {
+		return nil, fmt.Errorf("part %d of %s does not match its hash", info.Part, info.File)
+	}
+	return &message{info: info, signer: signer, chunk: chunk}, nil
+}
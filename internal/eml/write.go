@@ -0,0 +1,263 @@
+// Package eml packages bundles as MIME email messages, so they can travel
+// over store-and-forward links such as email or satellite messaging.
+//
+// A bundle (or its encrypted copy) is split across as many messages as the
+// size cap requires. Each message carries a plain text note for people, a
+// JSON description of its part, a signature over that description, the
+// signing public key of the sender and the part itself as an attachment.
+// Read checks every signature and hash before reassembling the bundle.
+package eml
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/crypto"
+)
+
+// Header names identifying DSP messages
+const (
+	BundleIDHeader = "X-DSP-Bundle-ID"
+	PartHeader     = "X-DSP-Part"
+)
+
+// Names of the attachments of a message besides the part itself
+const (
+	partInfoFile  = "dsp-part.json"
+	signatureFile = "dsp-part.sig"
+	signerFile    = "signer.pem"
+)
+
+// formatVersion is the version of the part description
+const formatVersion = 1
+
+// messageOverhead is the room left in each message for headers, the note,
+// the part description, the signature and the signer key, besides the
+// addresses
+const messageOverhead = 4 << 10
+
+// MinMessageSize is the smallest size cap accepted
+const MinMessageSize = 16 << 10
+
+// Options control how messages are written
+type Options struct {
+	From    string   // From address; defaults to dsp@<hostname>
+	To      []string // To addresses; may be empty
+	MaxSize int64    // Largest message size in bytes; 0 means no limit
+}
+
+// partInfo describes one message of a packaged file. It is what the sender
+// signs.
+type partInfo struct {
+	Version    int       `json:"version"`
+	BundleID   string    `json:"bundle_id"`
+	File       string    `json:"file"`   // Name of the packaged file
+	Size       int64     `json:"size"`   // Size of the whole file
+	SHA256     string    `json:"sha256"` // Hash of the whole file
+	Part       int       `json:"part"`   // 1-based
+	Parts      int       `json:"parts"`
+	PartSize   int64     `json:"part_size"`
+	PartSHA256 string    `json:"part_sha256"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Write packages the file at path as messages in dir, signed with the
+// signing key of keyManager, and returns their paths. A single message is
+// named <file>.eml; split files are named <file>.<part>-of-<parts>.eml.
+func Write(keyManager *crypto.KeyManager, path, bundleID, dir string, opts Options) ([]string, error) {
+	if opts.MaxSize != 0 && opts.MaxSize < MinMessageSize {
+		return nil, fmt.Errorf("message size cap must be at least %d bytes", MinMessageSize)
+	}
+	signer, err := keyManager.GetSigningPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if opts.From == "" {
+		hostname, _ := os.Hostname()
+		if hostname == "" {
+			hostname = "localhost"
+		}
+		opts.From = "dsp@" + hostname
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+
+	// Base64 turns every 3 bytes into 4, plus a line break every 76
+	// characters
+	chunkSize := info.Size()
+	if opts.MaxSize > 0 {
+		overhead := int64(messageOverhead + len(opts.From) + len(strings.Join(opts.To, ", ")))
+		chunkSize = (opts.MaxSize - overhead) / 78 * 57
+	}
+	parts := 1
+	if info.Size() > chunkSize {
+		parts = int((info.Size() + chunkSize - 1) / chunkSize)
+	}
+
+	name := filepath.Base(path)
+	created := time.Now().UTC()
+	var written []string
+	for part := 1; part <= parts; part++ {
+		offset := int64(part-1) * chunkSize
+		chunk := make([]byte, min(chunkSize, info.Size()-offset))
+		if _, err := file.ReadAt(chunk, offset); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		partHash := sha256.Sum256(chunk)
+		pi := partInfo{
+			Version:    formatVersion,
+			BundleID:   bundleID,
+			File:       name,
+			Size:       info.Size(),
+			SHA256:     hex.EncodeToString(hasher.Sum(nil)),
+			Part:       part,
+			Parts:      parts,
+			PartSize:   int64(len(chunk)),
+			PartSHA256: hex.EncodeToString(partHash[:]),
+			CreatedAt:  created,
+		}
+		description, err := json.MarshalIndent(pi, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal part description: %w", err)
+		}
+		signature, err := keyManager.SignData(description)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign part description: %w", err)
+		}
+
+		message, err := buildMessage(pi, description, signature, signer, chunk, opts)
+		if err != nil {
+			return nil, err
+		}
+		messagePath := filepath.Join(dir, name+".eml")
+		if parts > 1 {
+			messagePath = filepath.Join(dir, fmt.Sprintf("%s.%d-of-%d.eml", name, part, parts))
+		}
+		if err := os.WriteFile(messagePath, message, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", messagePath, err)
+		}
+		written = append(written, messagePath)
+	}
+	return written, nil
+}
+
+// buildMessage returns the MIME message for one part
+func buildMessage(pi partInfo, description []byte, signature string, signer, chunk []byte, opts Options) ([]byte, error) {
+	var buf bytes.Buffer
+	body := multipart.NewWriter(&buf)
+
+	// Message headers. Lines end in CRLF as RFC 5322 requires.
+	headers := []string{
+		"From: " + opts.From,
+	}
+	if len(opts.To) > 0 {
+		headers = append(headers, "To: "+strings.Join(opts.To, ", "))
+	}
+	headers = append(headers,
+		fmt.Sprintf("Subject: DSP bundle %s (part %d of %d)", pi.BundleID, pi.Part, pi.Parts),
+		"Date: "+pi.CreatedAt.Format(time.RFC1123Z),
+		fmt.Sprintf("Message-ID: <%s.%d-of-%d@%s>", pi.BundleID, pi.Part, pi.Parts, domainOf(opts.From)),
+		"MIME-Version: 1.0",
+		BundleIDHeader+": "+pi.BundleID,
+		fmt.Sprintf("%s: %d/%d", PartHeader, pi.Part, pi.Parts),
+		"Content-Type: multipart/mixed; boundary="+body.Boundary(),
+	)
+	var message bytes.Buffer
+	for _, h := range headers {
+		message.WriteString(h + "\r\n")
+	}
+	message.WriteString("\r\n")
+
+	// Note for people reading the mailbox
+	note := fmt.Sprintf("This message carries part %d of %d of DSP bundle %s (%s, %d bytes).\r\n"+
+		"Save all parts and run 'dsp import --from-eml' on them to import the bundle.\r\n",
+		pi.Part, pi.Parts, pi.BundleID, pi.File, pi.Size)
+	if err := writePart(body, "text/plain; charset=us-ascii", "", []byte(note), false); err != nil {
+		return nil, err
+	}
+	if err := writePart(body, "application/json", partInfoFile, description, false); err != nil {
+		return nil, err
+	}
+	if err := writePart(body, "text/plain; charset=us-ascii", signatureFile, []byte(signature), false); err != nil {
+		return nil, err
+	}
+	if err := writePart(body, "application/x-pem-file", signerFile, signer, false); err != nil {
+		return nil, err
+	}
+	if err := writePart(body, "application/octet-stream", pi.File, chunk, true); err != nil {
+		return nil, err
+	}
+	if err := body.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write message: %w", err)
+	}
+	message.Write(buf.Bytes())
+	return message.Bytes(), nil
+}
+
+// domainOf returns the domain of an address such as dsp@example.com or
+// Field Team <dsp@example.com>
+func domainOf(address string) string {
+	_, domain, found := strings.Cut(address, "@")
+	domain = strings.TrimRight(domain, "> ")
+	if !found || domain == "" {
+		return "dsp.invalid"
+	}
+	return domain
+}
+
+// writePart writes one body part, as an attachment if it has a file name.
+// Binary parts are base64 encoded; text parts are normalized to CRLF.
+func writePart(body *multipart.Writer, contentType, fileName string, data []byte, binary bool) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	if fileName != "" {
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	}
+	if binary {
+		header.Set("Content-Transfer-Encoding", "base64")
+	} else {
+		header.Set("Content-Transfer-Encoding", "7bit")
+	}
+	w, err := body.CreatePart(header)
+	if err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	if binary {
+		encoded := base64.StdEncoding.EncodeToString(data)
+		for len(encoded) > 76 {
+			io.WriteString(w, encoded[:76]+"\r\n")
+			encoded = encoded[76:]
+		}
+		_, err = io.WriteString(w, encoded+"\r\n")
+	} else {
+		text := strings.ReplaceAll(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n", "\r\n")
+		_, err = io.WriteString(w, text)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Package exitcode defines the exit codes of dsp, so scripts can tell kinds
+// of failure apart, and the errors that carry a code up to main.
+//
+// An error is classified by wrapping it where its kind is known, with the
+// helpers below or those of the protocol package for transfer errors. The
+// exit code is that of the outermost classified error it wraps; errors that
+// are not classified exit with Failure.
+package exitcode
+
+import "errors"
+
+// Exit codes
+const (
+	Success      = 0
+	Failure      = 1 // Any error not classified below
+	Network      = 3 // A peer could not be reached or failed temporarily; worth retrying
+	Auth         = 4 // A peer refused the credentials or does not trust this host
+	Verification = 5 // A certificate, signature, checksum or bundle check failed
+	Config       = 6 // No usable repository or configuration
+	Conflicts    = 7 // The command finished, but conflicts with local edits remain
+	Partial      = 8 // Some of the work was done and some failed
+)
+
+// Coder is an error that chooses its exit code
+type Coder interface {
+	error
+	ExitCode() int
+}
+
+// Error is an error with an exit code
+type Error struct {
+	Code int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the exit code of the error
+func (e *Error) ExitCode() int {
+	return e.Code
+}
+
+// ConfigError marks err as a configuration error
+func ConfigError(err error) error {
+	return &Error{Code: Config, Err: err}
+}
+
+// ConflictsError marks err as reporting conflicts left to resolve
+func ConflictsError(err error) error {
+	return &Error{Code: Conflicts, Err: err}
+}
+
+// PartialError marks err as reporting work that was only partly done
+func PartialError(err error) error {
+	return &Error{Code: Partial, Err: err}
+}
+
+// Code returns the exit code for err: Success for nil, the code of the
+// outermost classified error it wraps, or Failure
+func Code(err error) int {
+	if err == nil {
+		return Success
+	}
+	var coder Coder
+	if errors.As(err, &coder) {
+		return coder.ExitCode()
+	}
+	return Failure
+}
@@ -0,0 +1,107 @@
+package hooks
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+)
+
+// Hook names that DSP runs during repository operations
+const (
+	PreSnapshot  = "pre-snapshot"
+	PostSnapshot = "post-snapshot"
+	PostBundle   = "post-bundle"
+	PreApply     = "pre-apply"
+	PostApply    = "post-apply"
+)
+
+// DirName is the name of the hooks directory inside the DSP directory
+const DirName = "hooks"
+
+// Context describes the repository a hook runs for
+type Context struct {
+	RepoName string // Name of the repository
+	RepoPath string // Absolute path to the repository root
+	DSPDir   string // Absolute path to the DSP directory
+	Disabled bool   // Skip all hooks (set by --no-hooks)
+}
+
+// Dir returns the hooks directory for a DSP directory
+func Dir(dspDir string) string {
+	return filepath.Join(dspDir, DirName)
+}
+
+// Find returns the path of the executable script for a hook, or an empty
+// string if the hook is not installed
+func Find(dspDir, name string) string {
+	candidates := []string{name}
+	if runtime.GOOS == "windows" {
+		candidates = append(candidates, name+".exe", name+".bat", name+".cmd")
+	}
+
+	for _, candidate := range candidates {
+		path := filepath.Join(Dir(dspDir), candidate)
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		// On Unix the script must be executable
+		if runtime.GOOS != "windows" && info.Mode()&0111 == 0 {
+			fmt.Fprintf(os.Stderr, "Warning: hook %s is not executable and will be skipped (chmod +x %s)\n", name, path)
+			return ""
+		}
+		return path
+	}
+	return ""
+}
+
+// Run executes a hook if it is installed. The hook runs in the repository
+// root with DSP_* environment variables describing the operation. Extra
+// variables are passed as DSP_<KEY>=value.
+func Run(ctx Context, name string, vars map[string]string) error {
+	if ctx.Disabled {
+		return nil
+	}
+
+	path := Find(ctx.DSPDir, name)
+	if path == "" {
+		return nil
+	}
+
+	cmd := exec.Command(path)
+	cmd.Dir = ctx.RepoPath
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"DSP_HOOK="+name,
+		"DSP_REPO_NAME="+ctx.RepoName,
+		"DSP_REPO_PATH="+ctx.RepoPath,
+		"DSP_DIR="+ctx.DSPDir,
+	)
+
+	// Add operation-specific variables in a stable order
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("DSP_%s=%s", key, vars[key]))
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook failed: %w", name, err)
+	}
+	return nil
+}
+
+// RunPost executes a post-operation hook. Failures are reported as warnings
+// because the operation has already completed.
+func RunPost(ctx Context, name string, vars map[string]string) {
+	if err := Run(ctx, name, vars); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+}
@@ -0,0 +1,201 @@
+package host
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/audit"
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/internal/protocol"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// Files in a host archive
+const (
+	archiveHostsFile     = "hosts.json" // Archive contents
+	archiveSignerFile    = "signer.pem" // Signing public key of the exporting machine
+	archiveSignatureFile = "hosts.sig"  // Signature of hosts.json
+	archiveVersion       = 1
+	maxArchiveFileSize   = 16 << 20
+)
+
+// Archive is a portable copy of known hosts and groups, used to bootstrap
+// the trust network of another machine
+type Archive struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by"` // Hostname of the exporting machine
+	Hosts     []*Host   `json:"hosts"`
+	Groups    []*Group  `json:"groups,omitempty"`
+}
+
+// NewArchive collects hosts and the groups they belong to. With no targets
+// every host and group is included; otherwise targets name hosts, aliases or
+// groups as for Resolve.
+func (m *Manager) NewArchive(targets []string) (*Archive, error) {
+	archive := &Archive{Version: archiveVersion, CreatedAt: time.Now()}
+	if hostname, err := os.Hostname(); err == nil {
+		archive.CreatedBy = hostname
+	}
+
+	if len(targets) == 0 {
+		archive.Hosts = m.ListHosts()
+		archive.Groups = m.ListGroups()
+		return archive, nil
+	}
+
+	hosts, err := m.Resolve(targets)
+	if err != nil {
+		return nil, err
+	}
+	archive.Hosts = hosts
+
+	// Include selected groups, limited to the selected hosts
+	selected := make(map[string]bool)
+	for _, h := range hosts {
+		selected[h.Name] = true
+	}
+	for _, target := range targets {
+		group, err := m.GetGroup(target)
+		if err != nil {
+			continue
+		}
+		g := &Group{Name: group.Name, CreatedAt: group.CreatedAt}
+		for _, member := range group.Members {
+			if selected[member] {
+				g.Members = append(g.Members, member)
+			}
+		}
+		archive.Groups = append(archive.Groups, g)
+	}
+	return archive, nil
+}
+
+// WriteArchive writes a host archive as a tar file signed with the signing
+// key of the key manager
+func WriteArchive(path string, archive *Archive, keyManager *crypto.KeyManager) error {
+	data, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal hosts: %w", err)
+	}
+
+	signature, err := keyManager.SignData(data)
+	if err != nil {
+		return fmt.Errorf("failed to sign hosts: %w", err)
+	}
+	signer, err := keyManager.GetSigningPublicKey()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %w", err)
+	}
+	defer file.Close()
+
+	tw := tar.NewWriter(file)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{archiveHostsFile, data},
+		{archiveSignerFile, signer},
+		{archiveSignatureFile, []byte(signature)},
+	} {
+		header := &tar.Header{
+			Name:    entry.name,
+			Mode:    0644,
+			Size:    int64(len(entry.data)),
+			ModTime: archive.CreatedAt,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write archive: %w", err)
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			return fmt.Errorf("failed to write archive: %w", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return file.Close()
+}
+
+// ReadArchive reads a host archive and verifies its signature. It returns
+// the archive and the fingerprint of the key that signed it, which the
+// caller should confirm before trusting the contents.
+func ReadArchive(path string) (*Archive, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer file.Close()
+
+	// Read the archive files
+	files := make(map[string][]byte)
+	tr := tar.NewReader(file)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read archive: %w", err)
+		}
+		switch header.Name {
+		case archiveHostsFile, archiveSignerFile, archiveSignatureFile:
+		default:
+			continue // Ignore unknown files
+		}
+		if header.Size > maxArchiveFileSize {
+			return nil, "", fmt.Errorf("archive file %s is too large", header.Name)
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxArchiveFileSize))
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read archive: %w", err)
+		}
+		files[header.Name] = data
+	}
+	for _, name := range []string{archiveHostsFile, archiveSignerFile, archiveSignatureFile} {
+		if _, ok := files[name]; !ok {
+			return nil, "", fmt.Errorf("not a host archive: missing %s", name)
+		}
+	}
+
+	// Verify the signature before parsing anything
+	if err := crypto.VerifyData(files[archiveSignerFile], files[archiveHostsFile], string(files[archiveSignatureFile])); err != nil {
+		audit.Record(audit.Event{Type: audit.SignatureRejected, Subject: path, Detail: "host archive: " + err.Error()})
+		return nil, "", protocol.VerificationError(fmt.Errorf("archive signature verification failed: %w", err))
+	}
+	fingerprint, err := crypto.SigningKeyFingerprint(files[archiveSignerFile])
+	if err != nil {
+		return nil, "", err
+	}
+	audit.Record(audit.Event{Type: audit.SignatureVerified, Subject: path, Detail: "host archive signed by key " + fingerprint})
+
+	var archive Archive
+	if err := json.Unmarshal(files[archiveHostsFile], &archive); err != nil {
+		return nil, "", fmt.Errorf("failed to parse archive hosts: %w", err)
+	}
+	if archive.Version > archiveVersion {
+		return nil, "", fmt.Errorf("archive version %d is newer than supported version %d", archive.Version, archiveVersion)
+	}
+
+	// Names become file names, so reject anything that could escape the hosts directory
+	for _, h := range archive.Hosts {
+		if utils.CheckFileName(h.Name) != nil {
+			return nil, "", fmt.Errorf("archive contains an invalid host name %q", h.Name)
+		}
+	}
+	for _, g := range archive.Groups {
+		if utils.CheckFileName(g.Name) != nil {
+			return nil, "", fmt.Errorf("archive contains an invalid group name %q", g.Name)
+		}
+	}
+	return &archive, fingerprint, nil
+}
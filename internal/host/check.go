@@ -0,0 +1,85 @@
+package host
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/crypto"
+)
+
+// Check severities
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Issue is a problem found with a host
+type Issue struct {
+	Host     string
+	Severity string
+	Message  string
+}
+
+// CheckOptions controls what Check reports
+type CheckOptions struct {
+	ExpiryDays int // Warn about certificates expiring within this many days
+	StaleDays  int // Warn about hosts not used for this many days (0 disables)
+}
+
+// CertWarning returns a warning if the pinned certificate of a host has
+// expired or expires within the given number of days, or ""
+func (h *Host) CertWarning(days int) string {
+	if h.CertInfo == nil {
+		return ""
+	}
+	now := time.Now()
+	if now.After(h.CertInfo.ValidTo) {
+		return fmt.Sprintf("pinned certificate of host %s expired on %s", h.Name, h.CertInfo.ValidTo.Format("2006-01-02"))
+	}
+	if now.AddDate(0, 0, days).After(h.CertInfo.ValidTo) {
+		left := int(h.CertInfo.ValidTo.Sub(now).Hours() / 24)
+		return fmt.Sprintf("pinned certificate of host %s expires in %d days (%s)", h.Name, left, h.CertInfo.ValidTo.Format("2006-01-02"))
+	}
+	return ""
+}
+
+// Check looks for expired or expiring certificates, stale hosts and missing
+// or invalid keys. Issues are sorted by host.
+func (m *Manager) Check(opts CheckOptions) []Issue {
+	var issues []Issue
+	add := func(h *Host, severity, format string, args ...interface{}) {
+		issues = append(issues, Issue{Host: h.Name, Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for _, h := range m.ListHosts() {
+		// Certificate expiry
+		if h.CertInfo != nil {
+			if time.Now().After(h.CertInfo.ValidTo) {
+				add(h, SeverityError, "pinned certificate expired on %s", h.CertInfo.ValidTo.Format("2006-01-02"))
+			} else if h.CertWarning(opts.ExpiryDays) != "" {
+				add(h, SeverityWarning, "pinned certificate expires on %s", h.CertInfo.ValidTo.Format("2006-01-02"))
+			}
+		}
+
+		// Stale hosts
+		if opts.StaleDays > 0 && !h.LastUsed.IsZero() && time.Since(h.LastUsed) > time.Duration(opts.StaleDays)*24*time.Hour {
+			add(h, SeverityWarning, "not used since %s", h.LastUsed.Format("2006-01-02"))
+		}
+
+		// Keys
+		if NormalizeKey(h.PublicKey) == "" {
+			add(h, SeverityWarning, "no public key")
+		} else if _, err := crypto.ParsePublicKeys([]string{h.PublicKey}); err != nil {
+			add(h, SeverityError, "invalid public key: %v", err)
+		}
+		if h.SigningKey != "" {
+			if _, err := crypto.SigningKeyFingerprint([]byte(h.SigningKey)); err != nil {
+				add(h, SeverityError, "invalid signing key: %v", err)
+			}
+		}
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].Host < issues[j].Host })
+	return issues
+}
@@ -0,0 +1,60 @@
+package host
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/crypto"
+)
+
+// CertFingerprint returns the fingerprint hosts pin certificates by: the
+// SHA-256 of the DER certificate, in hex
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// HostByClientCert returns the host whose pinned client certificate has the
+// given fingerprint
+func (m *Manager) HostByClientCert(fingerprint string) (*Host, error) {
+	for _, h := range m.hosts {
+		if h.ClientCert != "" && h.ClientCert == fingerprint {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("no host with client certificate %s", fingerprint)
+}
+
+// PinClientCert records the client certificate a host presented during a
+// key exchange. A different certificate than the one pinned is refused
+// unless the host's rotations lead to it from the pinned one, or the trust
+// policy is open.
+func (m *Manager) PinClientCert(name, fingerprint, policy string, rotations []crypto.CertRotation) error {
+	return m.Modify(name, func(h *Host) error {
+		if h.ClientCert != "" && h.ClientCert != fingerprint && policy != config.TrustPolicyOpen &&
+			crypto.VerifyCertRotation(rotations, h.ClientCert, fingerprint) != nil {
+			return fmt.Errorf("client certificate of host %s has changed; if this is expected, run 'dsp host remove %s' and exchange keys again", name, name)
+		}
+		h.ClientCert = fingerprint
+		return nil
+	})
+}
+
+// FollowCertRotation re-pins the certificate of a host that rotated it: if
+// the presented fingerprint differs from the pinned one and the host's
+// rotations lead from the pinned certificate to it, the presented one is
+// pinned instead. It reports whether the pin changed.
+func (h *Host) FollowCertRotation(rotations []crypto.CertRotation, fingerprint string, validFrom, validTo time.Time) bool {
+	if h.CertInfo == nil || h.CertInfo.Fingerprint == fingerprint || len(rotations) == 0 {
+		return false
+	}
+	if crypto.VerifyCertRotation(rotations, h.CertInfo.Fingerprint, fingerprint) != nil {
+		return false
+	}
+	h.UpdateCertificate(fingerprint, validFrom, validTo)
+	return true
+}
@@ -0,0 +1,306 @@
+package host
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/crypto"
+)
+
+// groupsDirName is the directory next to the host files that holds groups
+const groupsDirName = "groups"
+
+// Group is a named set of hosts
+type Group struct {
+	Name      string    `json:"name"`
+	Members   []string  `json:"members"` // Host names
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Has reports whether a host is a member of the group
+func (g *Group) Has(name string) bool {
+	for _, member := range g.Members {
+		if member == name {
+			return true
+		}
+	}
+	return false
+}
+
+// groupsDir returns the groups directory
+func (m *Manager) groupsDir() string {
+	return filepath.Join(m.configDir, groupsDirName)
+}
+
+// loadGroups loads all groups from the groups directory
+func (m *Manager) loadGroups() error {
+	entries, err := os.ReadDir(m.groupsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read groups directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(m.groupsDir(), entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read group file %s: %w", entry.Name(), err)
+		}
+
+		var group Group
+		if err := json.Unmarshal(data, &group); err != nil {
+			return fmt.Errorf("failed to parse group file %s: %w", entry.Name(), err)
+		}
+
+		m.groups[group.Name] = &group
+	}
+
+	return nil
+}
+
+// saveGroup saves a group to disk
+func (m *Manager) saveGroup(group *Group) error {
+	if err := os.MkdirAll(m.groupsDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create groups directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(group, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal group: %w", err)
+	}
+
+	groupPath := filepath.Join(m.groupsDir(), group.Name+".json")
+	if err := config.WriteFileAtomic(groupPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write group file: %w", err)
+	}
+
+	return nil
+}
+
+// CreateGroup creates a group of existing hosts
+func (m *Manager) CreateGroup(name string, members []string) (*Group, error) {
+	unlock, err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if _, exists := m.groups[name]; exists {
+		return nil, fmt.Errorf("group %s already exists", name)
+	}
+	if _, exists := m.hosts[name]; exists {
+		return nil, fmt.Errorf("a host named %s already exists", name)
+	}
+
+	group := &Group{Name: name, CreatedAt: time.Now()}
+	for _, member := range members {
+		h, err := m.FindHost(member)
+		if err != nil {
+			return nil, err
+		}
+		if !group.Has(h.Name) {
+			group.Members = append(group.Members, h.Name)
+		}
+	}
+
+	if err := m.saveGroup(group); err != nil {
+		return nil, err
+	}
+
+	m.groups[name] = group
+	return group, nil
+}
+
+// DeleteGroup deletes a group. Its hosts are kept.
+func (m *Manager) DeleteGroup(name string) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, exists := m.groups[name]; !exists {
+		return fmt.Errorf("group %s does not exist", name)
+	}
+
+	if err := os.Remove(filepath.Join(m.groupsDir(), name+".json")); err != nil {
+		return fmt.Errorf("failed to remove group file: %w", err)
+	}
+
+	delete(m.groups, name)
+	return nil
+}
+
+// AddToGroup adds hosts to a group
+func (m *Manager) AddToGroup(name string, members []string) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	group, err := m.GetGroup(name)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		h, err := m.FindHost(member)
+		if err != nil {
+			return err
+		}
+		if !group.Has(h.Name) {
+			group.Members = append(group.Members, h.Name)
+		}
+	}
+
+	return m.saveGroup(group)
+}
+
+// RemoveFromGroup removes hosts from a group
+func (m *Manager) RemoveFromGroup(name string, members []string) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	group, err := m.GetGroup(name)
+	if err != nil {
+		return err
+	}
+
+	remove := make(map[string]bool)
+	for _, member := range members {
+		// Accept aliases, and names of hosts that no longer exist
+		if h, err := m.FindHost(member); err == nil {
+			member = h.Name
+		}
+		if !group.Has(member) {
+			return fmt.Errorf("host %s is not a member of group %s", member, name)
+		}
+		remove[member] = true
+	}
+
+	var kept []string
+	for _, member := range group.Members {
+		if !remove[member] {
+			kept = append(kept, member)
+		}
+	}
+	group.Members = kept
+
+	return m.saveGroup(group)
+}
+
+// GetGroup retrieves a group by name
+func (m *Manager) GetGroup(name string) (*Group, error) {
+	group, exists := m.groups[name]
+	if !exists {
+		return nil, fmt.Errorf("group %s does not exist", name)
+	}
+	return group, nil
+}
+
+// ListGroups returns all groups sorted by name
+func (m *Manager) ListGroups() []*Group {
+	groups := make([]*Group, 0, len(m.groups))
+	for _, group := range m.groups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
+}
+
+// GroupHosts returns the hosts of a group. Members that were removed as hosts
+// are skipped.
+func (m *Manager) GroupHosts(name string) ([]*Host, error) {
+	group, err := m.GetGroup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []*Host
+	for _, member := range group.Members {
+		if h, exists := m.hosts[member]; exists {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts, nil
+}
+
+// GroupsOf returns the names of the groups a host belongs to
+func (m *Manager) GroupsOf(name string) []string {
+	var names []string
+	for _, group := range m.ListGroups() {
+		if group.Has(name) {
+			names = append(names, group.Name)
+		}
+	}
+	return names
+}
+
+// Resolve returns the hosts named by each target, which may be a host name,
+// an alias or a group name. Each host is returned once.
+func (m *Manager) Resolve(targets []string) ([]*Host, error) {
+	var hosts []*Host
+	seen := make(map[string]bool)
+	add := func(h *Host) {
+		if !seen[h.Name] {
+			seen[h.Name] = true
+			hosts = append(hosts, h)
+		}
+	}
+
+	for _, target := range targets {
+		if h, err := m.FindHost(target); err == nil {
+			add(h)
+			continue
+		}
+		members, err := m.GroupHosts(target)
+		if err != nil {
+			return nil, fmt.Errorf("no host, alias or group named %s", target)
+		}
+		if len(members) == 0 {
+			return nil, fmt.Errorf("group %s has no hosts", target)
+		}
+		for _, h := range members {
+			add(h)
+		}
+	}
+	return hosts, nil
+}
+
+// RecipientKeys returns the public keys to encrypt for the given hosts and
+// groups. Every host must be trusted and have a valid key.
+func (m *Manager) RecipientKeys(targets []string) ([]string, error) {
+	hosts, err := m.Resolve(targets)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, h := range hosts {
+		if !h.Trusted {
+			return nil, fmt.Errorf("host %s is not trusted; run 'dsp host trust %s' first", h.Name, h.Name)
+		}
+		if h.PublicKey == "" {
+			return nil, fmt.Errorf("host %s has no public key", h.Name)
+		}
+		if _, err := crypto.ParsePublicKeys([]string{h.PublicKey}); err != nil {
+			return nil, fmt.Errorf("host %s: %w", h.Name, err)
+		}
+		keys = append(keys, h.PublicKey)
+	}
+	return keys, nil
+}
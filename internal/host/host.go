@@ -6,16 +6,24 @@ import (
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/migrations"
 )
 
-// Host represents a known host in the system
+// Host represents a known host in the system. The host store is the single
+// registry of identities: the age key used to encrypt for a host, its signing
+// key, pinned certificate, trust and alias all live here.
 type Host struct {
+	FormatVersion int `json:"format_version,omitempty"` // Format of the host file
+
 	// Basic Info
-	Name      string    `json:"name"`       // User-friendly name (e.g., "Alice's Laptop")
-	PublicKey string    `json:"public_key"` // Their age public key
-	AddedAt   time.Time `json:"added_at"`   // When we first connected
-	LastUsed  time.Time `json:"last_used"`  // Last successful transfer
-	Trusted   bool      `json:"trusted"`    // Whether we trust this host
+	Name       string    `json:"name"`                  // User-friendly name (e.g., "Alice's Laptop")
+	PublicKey  string    `json:"public_key"`            // Their age public key
+	SigningKey string    `json:"signing_key,omitempty"` // Their signing public key (PEM)
+	AddedAt    time.Time `json:"added_at"`              // When we first connected
+	LastUsed   time.Time `json:"last_used"`             // Last successful transfer
+	Trusted    bool      `json:"trusted"`               // Whether we trust this host
 
 	// Additional Info
 	Description string   `json:"description,omitempty"` // Optional description
@@ -26,6 +34,10 @@ type Host struct {
 
 	// Certificate Info (new fields, all optional for backward compatibility)
 	CertInfo *CertificateInfo `json:"cert_info,omitempty"` // Certificate information
+
+	// ClientCert is the fingerprint of the certificate the host presents as
+	// a TLS client, pinned during key exchange for mutual TLS
+	ClientCert string `json:"client_cert,omitempty"`
 }
 
 // CertificateInfo holds information about a host's certificate
@@ -73,23 +85,25 @@ func (h *Host) VerifyCertificate(fingerprint string, validFrom, validTo time.Tim
 	return nil
 }
 
-// Manager handles host management operations
+// Manager handles host management operations. Changes are made under the
+// hosts lock in the global directory, so several dsp processes can share the
+// host store; a single Manager must not be used from several goroutines.
 type Manager struct {
 	configDir string
-	hosts     map[string]*Host // Map of host name to host
+	hosts     map[string]*Host  // Map of host name to host
+	groups    map[string]*Group // Map of group name to group
+	lockDepth int               // Nesting depth of lock
+	unlock    func()            // Releases the hosts lock
 }
 
 // NewManager creates a new host manager
 func NewManager() (*Manager, error) {
-	// Get user's home directory
-	home, err := os.UserHomeDir()
+	// Use the global DSP directory
+	globalDir, err := config.GlobalDir()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get home directory: %w", err)
+		return nil, err
 	}
 
-	// Use default global directory
-	globalDir := filepath.Join(home, ".dsp-global")
-
 	// Create hosts directory if it doesn't exist
 	hostsDir := filepath.Join(globalDir, "hosts")
 	if err := os.MkdirAll(hostsDir, 0755); err != nil {
@@ -99,16 +113,59 @@ func NewManager() (*Manager, error) {
 	manager := &Manager{
 		configDir: hostsDir,
 		hosts:     make(map[string]*Host),
+		groups:    make(map[string]*Group),
 	}
 
 	// Load existing hosts
-	if err := manager.loadHosts(); err != nil {
-		return nil, fmt.Errorf("failed to load hosts: %w", err)
+	if err := manager.reload(); err != nil {
+		return nil, err
+	}
+	if err := manager.migrateRecipients(globalDir); err != nil {
+		return nil, fmt.Errorf("failed to migrate recipients: %w", err)
 	}
 
 	return manager, nil
 }
 
+// reload replaces the hosts and groups in memory with those on disk
+func (m *Manager) reload() error {
+	m.hosts = make(map[string]*Host)
+	m.groups = make(map[string]*Group)
+	if err := m.loadHosts(); err != nil {
+		return fmt.Errorf("failed to load hosts: %w", err)
+	}
+	if err := m.loadGroups(); err != nil {
+		return fmt.Errorf("failed to load host groups: %w", err)
+	}
+	return nil
+}
+
+// lock takes the hosts lock and reloads hosts and groups, so that a change
+// made while holding it starts from the latest state on disk. Nested calls
+// share the lock. The returned function releases it.
+func (m *Manager) lock() (func(), error) {
+	if m.lockDepth == 0 {
+		unlock, err := config.LockGlobal(config.HostsLock)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.reload(); err != nil {
+			unlock()
+			return nil, err
+		}
+		m.unlock = unlock
+	}
+	m.lockDepth++
+
+	return func() {
+		m.lockDepth--
+		if m.lockDepth == 0 {
+			m.unlock()
+			m.unlock = nil
+		}
+	}, nil
+}
+
 // loadHosts loads all hosts from the hosts directory
 func (m *Manager) loadHosts() error {
 	// Read hosts directory
@@ -131,8 +188,21 @@ func (m *Manager) loadHosts() error {
 
 		var host Host
 		if err := json.Unmarshal(data, &host); err != nil {
+			if err := migrations.Host.Check(migrations.Host.Version(data), hostPath); err != nil {
+				return err
+			}
 			return fmt.Errorf("failed to parse host file %s: %w", entry.Name(), err)
 		}
+		upgraded, changed, err := migrations.Host.Upgrade(host.FormatVersion, data, hostPath)
+		if err != nil {
+			return err
+		}
+		if changed {
+			host = Host{}
+			if err := json.Unmarshal(upgraded, &host); err != nil {
+				return fmt.Errorf("failed to parse upgraded host file %s: %w", entry.Name(), err)
+			}
+		}
 
 		m.hosts[host.Name] = &host
 	}
@@ -143,6 +213,7 @@ func (m *Manager) loadHosts() error {
 // saveHost saves a host to disk
 func (m *Manager) saveHost(host *Host) error {
 	// Marshal host to JSON
+	host.FormatVersion = migrations.HostVersion
 	data, err := json.MarshalIndent(host, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal host: %w", err)
@@ -152,7 +223,7 @@ func (m *Manager) saveHost(host *Host) error {
 	hostPath := filepath.Join(m.configDir, host.Name+".json")
 
 	// Write host file
-	if err := os.WriteFile(hostPath, data, 0644); err != nil {
+	if err := config.WriteFileAtomic(hostPath, data, 0644); err != nil {
 		return fmt.Errorf("failed to write host file: %w", err)
 	}
 
@@ -161,9 +232,18 @@ func (m *Manager) saveHost(host *Host) error {
 
 // AddHost adds a new host
 func (m *Manager) AddHost(host *Host) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	if _, exists := m.hosts[host.Name]; exists {
 		return fmt.Errorf("host with name %s already exists", host.Name)
 	}
+	if _, exists := m.groups[host.Name]; exists {
+		return fmt.Errorf("a group named %s already exists", host.Name)
+	}
 
 	host.AddedAt = time.Now()
 	host.LastUsed = time.Now()
@@ -178,6 +258,12 @@ func (m *Manager) AddHost(host *Host) error {
 
 // UpdateHost updates an existing host
 func (m *Manager) UpdateHost(host *Host) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	if _, exists := m.hosts[host.Name]; !exists {
 		return fmt.Errorf("host %s does not exist", host.Name)
 	}
@@ -194,6 +280,12 @@ func (m *Manager) UpdateHost(host *Host) error {
 
 // RemoveHost removes a host
 func (m *Manager) RemoveHost(name string) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	if _, exists := m.hosts[name]; !exists {
 		return fmt.Errorf("host %s does not exist", name)
 	}
@@ -204,6 +296,15 @@ func (m *Manager) RemoveHost(name string) error {
 	}
 
 	delete(m.hosts, name)
+
+	// Drop the host from its groups
+	for _, group := range m.groups {
+		if group.Has(name) {
+			if err := m.RemoveFromGroup(group.Name, []string{name}); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -226,6 +327,17 @@ func (m *Manager) GetHostByAlias(alias string) (*Host, error) {
 	return nil, fmt.Errorf("no host found with alias %s", alias)
 }
 
+// FindHost retrieves a host by name or alias
+func (m *Manager) FindHost(nameOrAlias string) (*Host, error) {
+	if host, exists := m.hosts[nameOrAlias]; exists {
+		return host, nil
+	}
+	if host, err := m.GetHostByAlias(nameOrAlias); err == nil {
+		return host, nil
+	}
+	return nil, fmt.Errorf("host %s does not exist", nameOrAlias)
+}
+
 // GetHostByTag retrieves hosts by tag
 func (m *Manager) GetHostByTag(tag string) []*Host {
 	var hosts []*Host
@@ -251,11 +363,27 @@ func (m *Manager) ListHosts() []*Host {
 
 // UpdateLastUsed updates the LastUsed timestamp for a host
 func (m *Manager) UpdateLastUsed(name string) error {
-	host, err := m.GetHost(name)
+	return m.Modify(name, func(host *Host) error {
+		host.LastUsed = time.Now()
+		return nil
+	})
+}
+
+// Modify applies fn to the latest version of a host on disk and saves it,
+// holding the hosts lock so concurrent changes are not lost
+func (m *Manager) Modify(name string, fn func(*Host) error) error {
+	unlock, err := m.lock()
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	host.LastUsed = time.Now()
+	host, err := m.GetHost(name)
+	if err != nil {
+		return err
+	}
+	if err := fn(host); err != nil {
+		return err
+	}
 	return m.UpdateHost(host)
 }
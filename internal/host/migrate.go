@@ -0,0 +1,109 @@
+package host
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Mattddixo/dsp/pkg/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// legacyRecipientsFile is the recipients store that the crypto package kept
+// next to the keys before recipients were merged into the host registry
+var legacyRecipientsFile = filepath.Join("keys", "recipients.yaml")
+
+// legacyRecipient is an entry of the legacy recipients store
+type legacyRecipient struct {
+	Name    string    `yaml:"name"`
+	Key     string    `yaml:"key"`
+	Added   time.Time `yaml:"added"`
+	Notes   string    `yaml:"notes,omitempty"`
+	Trusted bool      `yaml:"trusted"`
+}
+
+// migrateRecipients folds the legacy recipients store into the host
+// registry. Recipients become hosts; a recipient whose name is already a
+// host fills in a missing key but never replaces one. The legacy file is
+// renamed afterwards so the migration runs once.
+func (m *Manager) migrateRecipients(globalDir string) error {
+	path := filepath.Join(globalDir, legacyRecipientsFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	// Another process may be migrating the same file
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read recipients file: %w", err)
+	}
+
+	var legacy struct {
+		Recipients []legacyRecipient `yaml:"recipients"`
+	}
+	if err := yaml.Unmarshal(data, &legacy); err != nil {
+		return fmt.Errorf("failed to parse recipients file: %w", err)
+	}
+
+	// Recipients were appended, so a later entry of the same name wins
+	recipients := make(map[string]legacyRecipient)
+	var names []string
+	for _, r := range legacy.Recipients {
+		if _, seen := recipients[r.Name]; !seen {
+			names = append(names, r.Name)
+		}
+		recipients[r.Name] = r
+	}
+
+	for _, name := range names {
+		r := recipients[name]
+		if utils.CheckFileName(name) != nil || NormalizeKey(r.Key) == "" {
+			fmt.Fprintf(os.Stderr, "Warning: skipped recipient %q: invalid name or empty key\n", name)
+			continue
+		}
+		if _, exists := m.groups[name]; exists {
+			fmt.Fprintf(os.Stderr, "Warning: skipped recipient %s: a group has the same name\n", name)
+			continue
+		}
+
+		if h, exists := m.hosts[name]; exists {
+			if NormalizeKey(h.PublicKey) == "" {
+				h.PublicKey = r.Key
+				if err := m.saveHost(h); err != nil {
+					return err
+				}
+			} else if NormalizeKey(h.PublicKey) != NormalizeKey(r.Key) {
+				fmt.Fprintf(os.Stderr, "Warning: recipient %s has a different key than host %s; keeping the host key\n", name, name)
+			}
+			continue
+		}
+
+		h := &Host{
+			Name:        name,
+			PublicKey:   r.Key,
+			Trusted:     r.Trusted,
+			Description: r.Notes,
+			AddedAt:     r.Added,
+			LastUsed:    r.Added,
+		}
+		if err := m.saveHost(h); err != nil {
+			return err
+		}
+		m.hosts[name] = h
+	}
+
+	if err := os.Rename(path, path+".migrated"); err != nil {
+		return fmt.Errorf("failed to retire recipients file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package host
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/crypto"
+)
+
+// TrustsNewHost reports whether a host met for the first time is trusted
+// under a trust policy. trustNew overrides a manual policy.
+func TrustsNewHost(policy string, trustNew bool) bool {
+	return trustNew || policy != config.TrustPolicyManual
+}
+
+// RecordPeer records the public key a peer presented during a key exchange,
+// applying the trust policy. New hosts are trusted unless the policy is
+// manual; a changed key is refused unless the policy is open.
+func (m *Manager) RecordPeer(name, publicKey, ipAddress string, port int, policy string, trustNew bool) (*Host, error) {
+	unlock, err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	h, err := m.GetHost(name)
+	if err != nil {
+		h = &Host{
+			Name:      name,
+			PublicKey: publicKey,
+			Trusted:   TrustsNewHost(policy, trustNew),
+			IPAddress: ipAddress,
+			LastPort:  port,
+		}
+		if err := m.AddHost(h); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+
+	if h.PublicKey != "" && NormalizeKey(h.PublicKey) != NormalizeKey(publicKey) {
+		if policy != config.TrustPolicyOpen {
+			return nil, fmt.Errorf("public key of host %s has changed; if this is expected, run 'dsp host remove %s' and exchange keys again", name, name)
+		}
+	}
+
+	h.PublicKey = publicKey
+	h.IPAddress = ipAddress
+	h.LastPort = port
+	if policy == config.TrustPolicyOpen {
+		h.Trusted = true
+	}
+	if err := m.UpdateHost(h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// NormalizeKey drops comment lines from a public key as printed by
+// 'dsp crypto export-key'
+func NormalizeKey(key string) string {
+	var lines []string
+	for _, line := range strings.Split(key, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, " ")
+}
+
+// HostByX25519Key returns the host whose age key is the raw X25519 key
+// a peer proved it holds on a Noise channel
+func (m *Manager) HostByX25519Key(key []byte) (*Host, error) {
+	for _, h := range m.hosts {
+		if h.PublicKey == "" {
+			continue
+		}
+		if hostKey, err := crypto.X25519PublicKey(h.PublicKey); err == nil && bytes.Equal(hostKey, key) {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("no host with the presented key")
+}
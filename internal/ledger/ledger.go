@@ -0,0 +1,134 @@
+package ledger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileName is the ledger file in the DSP directory
+const FileName = "applied.yaml"
+
+// Apply results
+const (
+	ResultApplied   = "applied"   // All changes applied
+	ResultPartial   = "partial"   // Some changes deferred
+	ResultConflicts = "conflicts" // Applied with merge conflicts left to resolve
+	ResultFailed    = "failed"    // Some changes could not be applied
+	ResultUndone    = "undone"    // A previous apply was undone
+)
+
+// Entry records one application of a bundle
+type Entry struct {
+	BundleID       string    `yaml:"bundle_id"`
+	SourceRepo     string    `yaml:"source_repo,omitempty"`
+	SourceSnapshot string    `yaml:"source_snapshot,omitempty"`
+	TargetSnapshot string    `yaml:"target_snapshot,omitempty"`
+	AppliedAt      time.Time `yaml:"applied_at"`
+	AppliedBy      string    `yaml:"applied_by"`
+	Result         string    `yaml:"result"`
+	Applied        int       `yaml:"applied,omitempty"`   // Changes written, including merges
+	Conflicts      int       `yaml:"conflicts,omitempty"` // Files left with conflict markers
+	Deferred       int       `yaml:"deferred,omitempty"`  // Changes deferred for later
+	Failed         int       `yaml:"failed,omitempty"`
+}
+
+// Ledger lists the bundles applied to a repository, oldest first
+type Ledger struct {
+	Entries []Entry `yaml:"entries"`
+}
+
+// Path returns the ledger path for a DSP directory
+func Path(dspDir string) string {
+	return filepath.Join(dspDir, FileName)
+}
+
+// Load loads the ledger from the DSP directory. A missing ledger is empty.
+func Load(dspDir string) (*Ledger, error) {
+	data, err := os.ReadFile(Path(dspDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Ledger{}, nil
+		}
+		return nil, fmt.Errorf("failed to read applied ledger: %w", err)
+	}
+
+	var l Ledger
+	if err := yaml.Unmarshal(data, &l); err != nil {
+		return nil, fmt.Errorf("failed to parse applied ledger: %w", err)
+	}
+	return &l, nil
+}
+
+// Save writes the ledger to the DSP directory
+func (l *Ledger) Save(dspDir string) error {
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("failed to marshal applied ledger: %w", err)
+	}
+
+	// Write to a temporary file and rename so the ledger is never truncated
+	tmp := Path(dspDir) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write applied ledger: %w", err)
+	}
+	if err := os.Rename(tmp, Path(dspDir)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write applied ledger: %w", err)
+	}
+	return nil
+}
+
+// Record appends an entry
+func (l *Ledger) Record(entry Entry) {
+	if entry.AppliedAt.IsZero() {
+		entry.AppliedAt = time.Now()
+	}
+	l.Entries = append(l.Entries, entry)
+}
+
+// Last returns the most recent entry for a bundle, or nil if it was never applied
+func (l *Ledger) Last(bundleID string) *Entry {
+	for i := len(l.Entries) - 1; i >= 0; i-- {
+		if l.Entries[i].BundleID == bundleID {
+			return &l.Entries[i]
+		}
+	}
+	return nil
+}
+
+// IsApplied reports whether a bundle has been applied and not undone since.
+// Failed applies do not count.
+func (l *Ledger) IsApplied(bundleID string) bool {
+	last := l.Last(bundleID)
+	return last != nil && last.Result != ResultUndone && last.Result != ResultFailed
+}
+
+// LastTarget returns the target snapshot of the last bundle applied from a
+// repository, or "" if none was applied
+func (l *Ledger) LastTarget(sourceRepo string) string {
+	for i := len(l.Entries) - 1; i >= 0; i-- {
+		entry := l.Entries[i]
+		if entry.SourceRepo == sourceRepo && l.IsApplied(entry.BundleID) {
+			return entry.TargetSnapshot
+		}
+	}
+	return ""
+}
+
+// AppliedIDs returns the bundles currently applied, in the order they were
+// first applied
+func (l *Ledger) AppliedIDs() []string {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, entry := range l.Entries {
+		if !seen[entry.BundleID] && l.IsApplied(entry.BundleID) {
+			seen[entry.BundleID] = true
+			ids = append(ids, entry.BundleID)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,158 @@
+package ledger
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LineageFileName is the lineage file in the DSP directory
+const LineageFileName = "lineage.yaml"
+
+// ClockEntry is what a repository has seen of one peer's history
+type ClockEntry struct {
+	Name       string `yaml:"name,omitempty" json:"name,omitempty"` // Repository name of the peer
+	Count      int    `yaml:"count" json:"count"`                   // Bundles created by the peer
+	LastBundle string `yaml:"last_bundle" json:"last_bundle"`       // Latest of those bundles
+}
+
+// Lineage is a vector clock over the bundles created by each peer. A
+// repository's lineage counts its own bundles and the bundles it applied from
+// others; bundles carry the sender's lineage so the receiver can tell whether
+// the sender's history includes its own.
+type Lineage struct {
+	PeerID string                `yaml:"peer_id" json:"peer_id"`
+	Clock  map[string]ClockEntry `yaml:"clock" json:"clock"`
+}
+
+// Relation describes how a bundle's lineage relates to a repository's
+type Relation int
+
+const (
+	// FastForward means the bundle extends everything the repository has seen
+	FastForward Relation = iota
+	// Stale means the repository has already seen everything in the bundle
+	Stale
+	// Diverged means both sides have history the other has not seen
+	Diverged
+)
+
+// LineagePath returns the lineage path for a DSP directory
+func LineagePath(dspDir string) string {
+	return filepath.Join(dspDir, LineageFileName)
+}
+
+// LoadLineage loads the lineage of a repository, assigning a new peer ID if
+// the repository does not have one yet. Call Save to keep a new ID.
+func LoadLineage(dspDir string) (*Lineage, error) {
+	l := &Lineage{}
+	data, err := os.ReadFile(LineagePath(dspDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read lineage: %w", err)
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(data, l); err != nil {
+			return nil, fmt.Errorf("failed to parse lineage: %w", err)
+		}
+	}
+
+	if l.PeerID == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, fmt.Errorf("failed to generate peer ID: %w", err)
+		}
+		l.PeerID = hex.EncodeToString(id)
+	}
+	if l.Clock == nil {
+		l.Clock = make(map[string]ClockEntry)
+	}
+	return l, nil
+}
+
+// Save writes the lineage to the DSP directory
+func (l *Lineage) Save(dspDir string) error {
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lineage: %w", err)
+	}
+	if err := os.WriteFile(LineagePath(dspDir), data, 0644); err != nil {
+		return fmt.Errorf("failed to write lineage: %w", err)
+	}
+	return nil
+}
+
+// Stamp records a new bundle created by this repository and returns the
+// lineage to embed in it
+func (l *Lineage) Stamp(bundleID, repoName string) *Lineage {
+	own := l.Clock[l.PeerID]
+	own.Name = repoName
+	own.Count++
+	own.LastBundle = bundleID
+	l.Clock[l.PeerID] = own
+	return l.Copy()
+}
+
+// Copy returns a deep copy of the lineage
+func (l *Lineage) Copy() *Lineage {
+	c := &Lineage{PeerID: l.PeerID, Clock: make(map[string]ClockEntry, len(l.Clock))}
+	for peer, entry := range l.Clock {
+		c.Clock[peer] = entry
+	}
+	return c
+}
+
+// Compare relates a bundle's lineage to this repository's. For divergence it
+// also returns the peers this repository has seen more of than the sender.
+func (l *Lineage) Compare(bundle *Lineage) (Relation, []string) {
+	var ahead, behind []string
+	for peer, entry := range bundle.Clock {
+		if entry.Count > l.Clock[peer].Count {
+			ahead = append(ahead, peer)
+		}
+	}
+	for peer, entry := range l.Clock {
+		if entry.Count > bundle.Clock[peer].Count {
+			behind = append(behind, peer)
+		}
+	}
+	sort.Strings(behind)
+
+	switch {
+	case len(behind) > 0 && len(ahead) > 0:
+		return Diverged, behind
+	case len(ahead) == 0:
+		return Stale, nil
+	default:
+		return FastForward, nil
+	}
+}
+
+// Merge records a bundle's lineage after it was applied
+func (l *Lineage) Merge(bundle *Lineage) {
+	for peer, entry := range bundle.Clock {
+		if peer == l.PeerID {
+			continue // Our own history is only advanced by our bundles
+		}
+		if entry.Count > l.Clock[peer].Count {
+			l.Clock[peer] = entry
+		}
+	}
+}
+
+// Describe returns a readable list of peers
+func (l *Lineage) Describe(peers []string) string {
+	names := make([]string, len(peers))
+	for i, peer := range peers {
+		names[i] = peer
+		if entry, ok := l.Clock[peer]; ok && entry.Name != "" {
+			names[i] = fmt.Sprintf("%s (%s)", entry.Name, peer)
+		}
+	}
+	return strings.Join(names, ", ")
+}
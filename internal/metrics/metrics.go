@@ -0,0 +1,104 @@
+// Package metrics exposes counters and gauges of long-running DSP commands
+// in the Prometheus text format, without depending on a client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric types of the text format
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+)
+
+// metric is a registered metric and how to read its value
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value func() float64
+}
+
+// Registry holds the metrics of a command
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*metric
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*metric)}
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	value int64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.value, 1)
+}
+
+// Add adds n to the counter
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// Counter registers a counter. Counter names end in _total by convention.
+func (r *Registry) Counter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(name, help, typeCounter, func() float64 { return float64(c.Value()) })
+	return c
+}
+
+// GaugeFunc registers a gauge whose value is read when metrics are scraped
+func (r *Registry) GaugeFunc(name, help string, value func() float64) {
+	r.register(name, help, typeGauge, value)
+}
+
+// register adds a metric, replacing one of the same name
+func (r *Registry) register(name, help, kind string, value func() float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics[name] = &metric{name: name, help: help, kind: kind, value: value}
+}
+
+// WriteText writes all metrics in the Prometheus text format, sorted by name
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := make([]*metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.mu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+
+	for _, m := range metrics {
+		value := strconv.FormatFloat(m.value(), 'f', -1, 64)
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", m.name, m.help, m.name, m.kind, m.name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the metrics for Prometheus to scrape
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
@@ -0,0 +1,194 @@
+// Package migrations versions DSP's on-disk files. Every snapshot, tracking
+// config, repository registry, host file and bundle records the format it
+// was written in. Files in an older format are upgraded when they are read,
+// one version at a time, and written back in the current format the next
+// time they are saved. Files in a newer format are refused with an error
+// asking for a newer dsp, rather than misread.
+//
+// Changing an on-disk format means raising its version below and adding a
+// Step that upgrades a document of the previous version.
+package migrations
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Mattddixo/dsp/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Current format versions written by this build
+const (
+	SnapshotVersion = 1
+	TrackingVersion = 1
+	ReposVersion    = 1
+	HostVersion     = 1
+	BundleVersion   = 2
+)
+
+// ErrNewerFormat is returned for files written in a newer format than this
+// build reads
+var ErrNewerFormat = errors.New("written in a newer format than this build of dsp supports")
+
+// Step upgrades a decoded document from one format version to the next
+type Step func(doc map[string]interface{}) error
+
+// Kind describes a kind of versioned file
+type Kind struct {
+	Name    string // As shown in errors
+	Key     string // Field holding the format version
+	Current int    // Format version written by this build
+	YAML    bool   // Whether files of this kind are YAML rather than JSON
+
+	// Upgrades from each older version to the next. A nil step means the
+	// versions differ only in the version field.
+	steps map[int]Step
+}
+
+// Kinds of versioned files
+var (
+	Snapshot = &Kind{
+		Name:    "snapshot",
+		Key:     "format_version",
+		Current: SnapshotVersion,
+		steps:   map[int]Step{0: nil},
+	}
+	Tracking = &Kind{
+		Name:    "tracking config",
+		Key:     "format_version",
+		Current: TrackingVersion,
+		YAML:    true,
+		steps:   map[int]Step{0: nil},
+	}
+	Repos = &Kind{
+		Name:    "repository registry",
+		Key:     "format_version",
+		Current: ReposVersion,
+		YAML:    true,
+		steps:   map[int]Step{0: reposV1},
+	}
+	Host = &Kind{
+		Name:    "host file",
+		Key:     "format_version",
+		Current: HostVersion,
+		steps:   map[int]Step{0: nil},
+	}
+
+	// Bundles have no steps: the bundle package reads the archive layouts
+	// of older formats as they are, since bundles are never rewritten
+	Bundle = &Kind{
+		Name:    "bundle",
+		Key:     "format",
+		Current: BundleVersion,
+	}
+)
+
+// Check returns an error wrapping ErrNewerFormat if version is newer than
+// this build reads. name identifies the file in the error.
+func (k *Kind) Check(version int, name string) error {
+	if version > k.Current {
+		return fmt.Errorf("%s %s was %w (format %d, this build reads up to %d); upgrade dsp to read it",
+			k.Name, name, ErrNewerFormat, version, k.Current)
+	}
+	return nil
+}
+
+// Upgrade returns data, a file of this kind whose recorded format is
+// version, upgraded to the current format. It reports whether data had to
+// be changed; callers decode it again if so.
+func (k *Kind) Upgrade(version int, data []byte, name string) ([]byte, bool, error) {
+	if err := k.Check(version, name); err != nil {
+		return nil, false, err
+	}
+
+	var pending []Step
+	for v := version; v < k.Current; v++ {
+		step, ok := k.steps[v]
+		if !ok {
+			break
+		}
+		if step != nil {
+			pending = append(pending, step)
+		}
+	}
+	if len(pending) == 0 {
+		return data, false, nil
+	}
+
+	doc, err := k.decode(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to parse %s %s for upgrade: %w", k.Name, name, err)
+	}
+	for _, step := range pending {
+		if err := step(doc); err != nil {
+			return nil, false, fmt.Errorf("failed to upgrade %s %s from format %d: %w", k.Name, name, version, err)
+		}
+	}
+	doc[k.Key] = k.Current
+
+	upgraded, err := k.encode(doc)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode upgraded %s %s: %w", k.Name, name, err)
+	}
+	return upgraded, true, nil
+}
+
+// Version returns the format version recorded in data, or 0 if it records
+// none or cannot be parsed
+func (k *Kind) Version(data []byte) int {
+	var doc map[string]interface{}
+	if k.YAML {
+		if yaml.Unmarshal(data, &doc) != nil {
+			return 0
+		}
+	} else if json.Unmarshal(data, &doc) != nil {
+		return 0
+	}
+	switch v := doc[k.Key].(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	}
+	return 0
+}
+
+// decode decodes a document into generic values. JSON numbers are kept as
+// json.Number so sizes and inodes keep their precision.
+func (k *Kind) decode(data []byte) (map[string]interface{}, error) {
+	doc := make(map[string]interface{})
+	if k.YAML {
+		err := yaml.Unmarshal(data, &doc)
+		return doc, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&doc)
+	return doc, err
+}
+
+// encode encodes a document decoded by decode
+func (k *Kind) encode(doc map[string]interface{}) ([]byte, error) {
+	if k.YAML {
+		return yaml.Marshal(doc)
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// reposV1 gives repositories registered without a DSP directory the default
+// one, which GetDSPDir otherwise resolves to the repository root
+func reposV1(doc map[string]interface{}) error {
+	repos, _ := doc["repos"].([]interface{})
+	for _, r := range repos {
+		repo, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if dir, _ := repo["dsp_dir"].(string); dir == "" {
+			repo["dsp_dir"] = config.DefaultDataDir
+		}
+	}
+	return nil
+}
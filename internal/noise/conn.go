@@ -0,0 +1,277 @@
+package noise
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Authorizer decides whether a responder accepts an initiator's static key,
+// sent from the network address addr
+type Authorizer func(addr net.Addr, remote []byte) error
+
+// Conn is a connection secured by a Noise IK handshake. The handshake runs
+// on the first Read or Write, or when Handshake is called.
+type Conn struct {
+	conn      net.Conn
+	initiator bool
+	static    KeyPair
+	remote    []byte // The peer's static key: known to initiators, learned by responders
+	authorize Authorizer
+
+	handshakeMu  sync.Mutex
+	handshakeErr error
+	handshaked   bool
+
+	readMu  sync.Mutex
+	recv    *cipherState
+	pending []byte // Decrypted bytes not read yet
+
+	writeMu sync.Mutex
+	send    *cipherState
+}
+
+// Client returns the initiator side of a channel over conn to the peer
+// whose static key is remote
+func Client(conn net.Conn, static KeyPair, remote []byte) *Conn {
+	return &Conn{conn: conn, initiator: true, static: static, remote: remote}
+}
+
+// Server returns the responder side of a channel over conn. authorize is
+// called with the initiator's static key before the handshake completes.
+func Server(conn net.Conn, static KeyPair, authorize Authorizer) *Conn {
+	return &Conn{conn: conn, static: static, authorize: authorize}
+}
+
+// Handshake runs the handshake if it has not run yet
+func (c *Conn) Handshake() error {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	if c.handshaked {
+		return c.handshakeErr
+	}
+	c.handshaked = true
+	if c.initiator {
+		c.handshakeErr = c.clientHandshake()
+	} else {
+		c.handshakeErr = c.serverHandshake()
+	}
+	return c.handshakeErr
+}
+
+func (c *Conn) clientHandshake() error {
+	h := newInitiator(c.static, c.remote)
+	msg, err := h.writeMessage()
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(c.conn, msg); err != nil {
+		return err
+	}
+	reply, err := readFrame(c.conn)
+	if err == io.EOF {
+		// Responders close the connection on keys they do not accept
+		return fmt.Errorf("%w: the peer closed the connection; it may not know this host's key", ErrHandshake)
+	}
+	if err != nil {
+		return err
+	}
+	if err := h.readMessage(reply); err != nil {
+		return fmt.Errorf("%w: the peer does not hold the expected key", ErrHandshake)
+	}
+	c.send, c.recv = h.s.split()
+	return nil
+}
+
+func (c *Conn) serverHandshake() error {
+	h := newResponder(c.static)
+	msg, err := readFrame(c.conn)
+	if err != nil {
+		return err
+	}
+	if err := h.readMessage(msg); err != nil {
+		return fmt.Errorf("%w: the peer did not encrypt for this host's key", ErrHandshake)
+	}
+	if c.authorize != nil {
+		if err := c.authorize(c.conn.RemoteAddr(), h.rs); err != nil {
+			return err
+		}
+	}
+	c.remote = h.rs
+	reply, err := h.writeMessage()
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(c.conn, reply); err != nil {
+		return err
+	}
+	c.recv, c.send = h.s.split()
+	return nil
+}
+
+// RemoteStatic returns the peer's static key, once the handshake has run
+func (c *Conn) RemoteStatic() []byte {
+	if c.Handshake() != nil {
+		return nil
+	}
+	return c.remote
+}
+
+// Read reads decrypted data from the connection
+func (c *Conn) Read(p []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		msg, err := readFrame(c.conn)
+		if err != nil {
+			return 0, err
+		}
+		if c.pending, err = c.recv.decrypt(nil, msg); err != nil {
+			return 0, errors.New("noise: message failed to authenticate")
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write encrypts and writes data to the connection
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > maxPayloadSize {
+			chunk = chunk[:maxPayloadSize]
+		}
+		msg, err := c.send.encrypt(nil, chunk)
+		if err != nil {
+			return written, err
+		}
+		if err := writeFrame(c.conn, msg); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// LocalAddr returns the local network address
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the connection
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the connection
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// readFrame reads one length-prefixed message
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeFrame writes one length-prefixed message
+func writeFrame(w io.Writer, msg []byte) error {
+	if len(msg) > maxMessageSize {
+		return fmt.Errorf("noise: message of %d bytes is too large", len(msg))
+	}
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+	_, err := w.Write(frame)
+	return err
+}
+
+// Listener accepts connections and secures them as the responder
+type Listener struct {
+	net.Listener
+	static    KeyPair
+	authorize Authorizer
+}
+
+// NewListener returns a listener securing the connections of inner with a
+// Noise handshake. The handshake runs when a connection is first used, so
+// a slow peer does not hold up Accept.
+func NewListener(inner net.Listener, static KeyPair, authorize Authorizer) *Listener {
+	return &Listener{Listener: inner, static: static, authorize: authorize}
+}
+
+// Accept waits for the next connection
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Server(conn, l.static, l.authorize), nil
+}
+
+// Dialer dials peers and secures the connections as the initiator
+type Dialer struct {
+	Static KeyPair
+	Remote []byte // The peer's static key
+}
+
+// DialContext connects to addr and runs the handshake
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	secured := Client(conn, d.Static, d.Remote)
+	if err := secured.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return secured, nil
+}
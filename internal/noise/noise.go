@@ -0,0 +1,307 @@
+// Package noise is an encrypted channel between peers that know each
+// other's static X25519 keys, as an alternative to TLS for transfers. It
+// runs the Noise IK handshake (Noise_IK_25519_ChaChaPoly_BLAKE2s): the
+// initiator knows the responder's key up front, and the responder learns and
+// authorizes the initiator's key during the handshake. No certificates are
+// involved; peers are identified by the age keys in the hosts store.
+//
+// Messages are framed with a 2-byte big-endian length, as the Noise
+// specification suggests for stream transports.
+package noise
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// protocolName names the handshake pattern and primitives
+const protocolName = "Noise_IK_25519_ChaChaPoly_BLAKE2s"
+
+// prologue binds handshakes to DSP, so they cannot be replayed into other
+// protocols using the same keys
+const prologue = "dsp-transfer/1"
+
+// Sizes of keys, tags and messages
+const (
+	keySize        = 32
+	tagSize        = 16
+	maxMessageSize = 65535
+	maxPayloadSize = maxMessageSize - tagSize
+)
+
+// ErrHandshake is returned for handshake messages that fail to decrypt,
+// which is what a peer with another key than the one expected sends
+var ErrHandshake = errors.New("noise handshake failed")
+
+// KeyPair is a static or ephemeral X25519 key pair
+type KeyPair struct {
+	Private []byte
+	Public  []byte
+}
+
+// NewKeyPair returns the key pair of an X25519 private key
+func NewKeyPair(private []byte) (KeyPair, error) {
+	if len(private) != keySize {
+		return KeyPair{}, fmt.Errorf("invalid X25519 private key")
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return KeyPair{}, err
+	}
+	return KeyPair{Private: private, Public: public}, nil
+}
+
+// generateKeyPair returns a new random key pair
+func generateKeyPair() (KeyPair, error) {
+	private := make([]byte, keySize)
+	if _, err := rand.Read(private); err != nil {
+		return KeyPair{}, err
+	}
+	return NewKeyPair(private)
+}
+
+// cipherState encrypts with a key and a counter nonce
+type cipherState struct {
+	key   []byte
+	nonce uint64
+}
+
+func (c *cipherState) encrypt(ad, plaintext []byte) ([]byte, error) {
+	if c.key == nil {
+		return plaintext, nil
+	}
+	aead, err := chacha20poly1305.New(c.key)
+	if err != nil {
+		return nil, err
+	}
+	out := aead.Seal(nil, c.nextNonce(), plaintext, ad)
+	return out, nil
+}
+
+func (c *cipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	if c.key == nil {
+		return ciphertext, nil
+	}
+	aead, err := chacha20poly1305.New(c.key)
+	if err != nil {
+		return nil, err
+	}
+	out, err := aead.Open(nil, c.nextNonce(), ciphertext, ad)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	return out, nil
+}
+
+// nextNonce returns the nonce for the next message: 32 zero bits and the
+// little-endian counter
+func (c *cipherState) nextNonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], c.nonce)
+	c.nonce++
+	return nonce
+}
+
+// symmetricState is the chaining key and handshake hash of a handshake
+type symmetricState struct {
+	cipherState
+	ck []byte
+	h  []byte
+}
+
+func newSymmetricState() *symmetricState {
+	h := blake2s.Sum256([]byte(protocolName))
+	s := &symmetricState{ck: h[:], h: h[:]}
+	s.mixHash([]byte(prologue))
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h, _ := blake2s.New256(nil)
+	h.Write(s.h)
+	h.Write(data)
+	s.h = h.Sum(nil)
+}
+
+func (s *symmetricState) mixKey(ikm []byte) {
+	var key []byte
+	s.ck, key = hkdf(s.ck, ikm)
+	s.cipherState = cipherState{key: key}
+}
+
+// mixDH mixes the shared secret of a private and a public key into the key
+func (s *symmetricState) mixDH(private, public []byte) error {
+	shared, err := curve25519.X25519(private, public)
+	if err != nil {
+		return ErrHandshake
+	}
+	s.mixKey(shared)
+	return nil
+}
+
+func (s *symmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext, err := s.encrypt(s.h, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.decrypt(s.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the cipher states of the initiator's and the responder's
+// messages after the handshake
+func (s *symmetricState) split() (*cipherState, *cipherState) {
+	k1, k2 := hkdf(s.ck, nil)
+	return &cipherState{key: k1}, &cipherState{key: k2}
+}
+
+// hkdf is the HKDF of the Noise specification with BLAKE2s, returning two
+// outputs
+func hkdf(ck, ikm []byte) ([]byte, []byte) {
+	newHash := func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}
+	mac := hmac.New(newHash, ck)
+	mac.Write(ikm)
+	tempKey := mac.Sum(nil)
+
+	mac = hmac.New(newHash, tempKey)
+	mac.Write([]byte{1})
+	out1 := mac.Sum(nil)
+
+	mac = hmac.New(newHash, tempKey)
+	mac.Write(out1)
+	mac.Write([]byte{2})
+	out2 := mac.Sum(nil)
+	return out1, out2
+}
+
+// initiatorHandshake runs the initiator's side of IK: it sends
+// e, es, s, ss and reads e, ee, se
+type initiatorHandshake struct {
+	s   *symmetricState
+	e   KeyPair
+	key KeyPair // Our static key
+	rs  []byte  // The responder's static key
+}
+
+func newInitiator(static KeyPair, remote []byte) *initiatorHandshake {
+	s := newSymmetricState()
+	s.mixHash(remote)
+	return &initiatorHandshake{s: s, key: static, rs: remote}
+}
+
+func (h *initiatorHandshake) writeMessage() ([]byte, error) {
+	var err error
+	if h.e, err = generateKeyPair(); err != nil {
+		return nil, err
+	}
+	msg := append([]byte(nil), h.e.Public...)
+	h.s.mixHash(h.e.Public)
+	if err := h.s.mixDH(h.e.Private, h.rs); err != nil {
+		return nil, err
+	}
+	static, err := h.s.encryptAndHash(h.key.Public)
+	if err != nil {
+		return nil, err
+	}
+	msg = append(msg, static...)
+	if err := h.s.mixDH(h.key.Private, h.rs); err != nil {
+		return nil, err
+	}
+	payload, err := h.s.encryptAndHash(nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(msg, payload...), nil
+}
+
+func (h *initiatorHandshake) readMessage(msg []byte) error {
+	if len(msg) != keySize+tagSize {
+		return ErrHandshake
+	}
+	re := msg[:keySize]
+	h.s.mixHash(re)
+	if err := h.s.mixDH(h.e.Private, re); err != nil {
+		return err
+	}
+	if err := h.s.mixDH(h.key.Private, re); err != nil {
+		return err
+	}
+	_, err := h.s.decryptAndHash(msg[keySize:])
+	return err
+}
+
+// responderHandshake runs the responder's side of IK: it reads
+// e, es, s, ss and sends e, ee, se
+type responderHandshake struct {
+	s   *symmetricState
+	key KeyPair // Our static key
+	re  []byte  // The initiator's ephemeral key
+	rs  []byte  // The initiator's static key, learned from its message
+}
+
+func newResponder(static KeyPair) *responderHandshake {
+	s := newSymmetricState()
+	s.mixHash(static.Public)
+	return &responderHandshake{s: s, key: static}
+}
+
+func (h *responderHandshake) readMessage(msg []byte) error {
+	if len(msg) != keySize+keySize+tagSize+tagSize {
+		return ErrHandshake
+	}
+	h.re = msg[:keySize]
+	h.s.mixHash(h.re)
+	if err := h.s.mixDH(h.key.Private, h.re); err != nil {
+		return err
+	}
+	rs, err := h.s.decryptAndHash(msg[keySize : 2*keySize+tagSize])
+	if err != nil {
+		return err
+	}
+	h.rs = rs
+	if err := h.s.mixDH(h.key.Private, h.rs); err != nil {
+		return err
+	}
+	_, err = h.s.decryptAndHash(msg[2*keySize+tagSize:])
+	return err
+}
+
+func (h *responderHandshake) writeMessage() ([]byte, error) {
+	e, err := generateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	msg := append([]byte(nil), e.Public...)
+	h.s.mixHash(e.Public)
+	if err := h.s.mixDH(e.Private, h.re); err != nil {
+		return nil, err
+	}
+	if err := h.s.mixDH(e.Private, h.rs); err != nil {
+		return nil, err
+	}
+	payload, err := h.s.encryptAndHash(nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(msg, payload...), nil
+}
@@ -0,0 +1,191 @@
+package noise
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// pipe returns the two ends of a connection between a client holding
+// clientKey and a server holding serverKey. The client expects the server to
+// hold remote.
+func pipe(t *testing.T, clientKey, serverKey KeyPair, remote []byte, authorize Authorizer) (*Conn, *Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return Client(a, clientKey, remote), Server(b, serverKey, authorize)
+}
+
+// handshake runs both sides of the handshake and returns their errors. The
+// server's connection is closed when its side fails, as listeners do.
+func handshake(client, server *Conn) (clientErr, serverErr error) {
+	done := make(chan error, 1)
+	go func() {
+		err := server.Handshake()
+		if err != nil {
+			server.Close()
+		}
+		done <- err
+	}()
+	clientErr = client.Handshake()
+	if clientErr != nil {
+		client.Close()
+	}
+	return clientErr, <-done
+}
+
+func keyPair(t *testing.T) KeyPair {
+	t.Helper()
+	key, err := generateKeyPair()
+	if err != nil {
+		t.Fatalf("generate key pair: %v", err)
+	}
+	return key
+}
+
+func TestRoundTrip(t *testing.T) {
+	clientKey, serverKey := keyPair(t), keyPair(t)
+	var authorized []byte
+	client, server := pipe(t, clientKey, serverKey, serverKey.Public, func(_ net.Addr, remote []byte) error {
+		authorized = remote
+		return nil
+	})
+
+	if clientErr, serverErr := handshake(client, server); clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", clientErr, serverErr)
+	}
+	if !bytes.Equal(authorized, clientKey.Public) {
+		t.Fatalf("authorizer saw %x, want the client's key", authorized)
+	}
+	if !bytes.Equal(server.RemoteStatic(), clientKey.Public) {
+		t.Fatalf("server learned %x, want the client's key", server.RemoteStatic())
+	}
+	if !bytes.Equal(client.RemoteStatic(), serverKey.Public) {
+		t.Fatalf("client has %x, want the server's key", client.RemoteStatic())
+	}
+
+	// Both directions, in turn
+	for _, m := range []struct {
+		from, to *Conn
+		data     string
+	}{
+		{client, server, "request"},
+		{server, client, "response"},
+		{client, server, "second request"},
+	} {
+		errs := make(chan error, 1)
+		go func() {
+			_, err := m.from.Write([]byte(m.data))
+			errs <- err
+		}()
+		got := make([]byte, len(m.data))
+		if _, err := io.ReadFull(m.to, got); err != nil {
+			t.Fatalf("read %q: %v", m.data, err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatalf("write %q: %v", m.data, err)
+		}
+		if string(got) != m.data {
+			t.Fatalf("read %q, want %q", got, m.data)
+		}
+	}
+}
+
+func TestWrongResponderKey(t *testing.T) {
+	clientKey, serverKey, otherKey := keyPair(t), keyPair(t), keyPair(t)
+	client, server := pipe(t, clientKey, serverKey, otherKey.Public, nil)
+
+	clientErr, serverErr := handshake(client, server)
+	if !errors.Is(serverErr, ErrHandshake) {
+		t.Fatalf("server: got %v, want ErrHandshake", serverErr)
+	}
+	if !errors.Is(clientErr, ErrHandshake) {
+		t.Fatalf("client: got %v, want ErrHandshake", clientErr)
+	}
+}
+
+func TestAuthorizerRefusal(t *testing.T) {
+	clientKey, serverKey := keyPair(t), keyPair(t)
+	refused := errors.New("unknown host")
+	client, server := pipe(t, clientKey, serverKey, serverKey.Public, func(net.Addr, []byte) error {
+		return refused
+	})
+
+	clientErr, serverErr := handshake(client, server)
+	if !errors.Is(serverErr, refused) {
+		t.Fatalf("server: got %v, want the authorizer's error", serverErr)
+	}
+	if !errors.Is(clientErr, ErrHandshake) {
+		t.Fatalf("client: got %v, want ErrHandshake", clientErr)
+	}
+	if server.RemoteStatic() != nil {
+		t.Fatalf("refused server reports a remote key")
+	}
+	if _, err := server.Read(make([]byte, 1)); !errors.Is(err, refused) {
+		t.Fatalf("read after refusal: got %v, want the authorizer's error", err)
+	}
+}
+
+func TestTamperedFrame(t *testing.T) {
+	clientKey, serverKey := keyPair(t), keyPair(t)
+	client, server := pipe(t, clientKey, serverKey, serverKey.Public, nil)
+	if clientErr, serverErr := handshake(client, server); clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", clientErr, serverErr)
+	}
+
+	// Encrypt as Write does, then flip a bit of the ciphertext on the wire
+	msg, err := client.send.encrypt(nil, []byte("transfer 100 files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg[0] ^= 1
+	go writeFrame(client.conn, msg)
+
+	if _, err := server.Read(make([]byte, 64)); err == nil {
+		t.Fatalf("tampered frame was accepted")
+	}
+}
+
+func TestLargeWrite(t *testing.T) {
+	clientKey, serverKey := keyPair(t), keyPair(t)
+	client, server := pipe(t, clientKey, serverKey, serverKey.Public, nil)
+	if clientErr, serverErr := handshake(client, server); clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", clientErr, serverErr)
+	}
+
+	data := make([]byte, 2*maxPayloadSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := client.Write(data)
+		done <- result{n, err}
+	}()
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if r := <-done; r.err != nil || r.n != len(data) {
+		t.Fatalf("write: wrote %d of %d, %v", r.n, len(data), r.err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("large write arrived altered")
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	if err := writeFrame(io.Discard, make([]byte, maxMessageSize+1)); err == nil {
+		t.Fatalf("oversized frame was written")
+	}
+}
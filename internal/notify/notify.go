@@ -0,0 +1,338 @@
+// Package notify tells the notification targets of the global configuration
+// about snapshots, exports, applies and conflicts: commands are run with the
+// event on stdin, webhooks are posted the event as JSON.
+//
+// Machines running DSP are often offline. Webhook posts that fail are queued
+// in the global DSP directory (notify/pending.jsonl) and sent before the next
+// notification, or by 'dsp notify flush', once the network is back.
+package notify
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/release"
+)
+
+// Time limits of a delivery
+const (
+	commandTimeout = 30 * time.Second
+	webhookTimeout = 10 * time.Second
+)
+
+// maxPending is how many undelivered webhook posts are kept; the oldest are
+// dropped beyond it
+const maxPending = 500
+
+// Event is what a notification target is told
+type Event struct {
+	Event      string    `json:"event"` // One of config.NotifyEvents
+	Time       time.Time `json:"time"`
+	Host       string    `json:"host"` // Machine the event happened on
+	User       string    `json:"user"`
+	Repository string    `json:"repository,omitempty"`
+	Subject    string    `json:"subject,omitempty"` // Snapshot or bundle ID
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// pending is a queued webhook post
+type pending struct {
+	Target string          `json:"target"`
+	Event  json.RawMessage `json:"event"`
+}
+
+// Send tells the targets subscribed to an event about it, filling in the
+// time, host and user. Notifying never fails the operation notified about;
+// failures are reported on stderr.
+func Send(e Event) {
+	cfg, err := config.LoadGlobal()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to send notifications: %v\n", err)
+		return
+	}
+	var targets []*config.NotifyTarget
+	for i := range cfg.Notifications {
+		if cfg.Notifications[i].Wants(e.Event) {
+			targets = append(targets, &cfg.Notifications[i])
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	payload, err := payload(e)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to send notifications: %v\n", err)
+		return
+	}
+
+	var queue []pending
+	flushed := false
+	for _, target := range targets {
+		if target.Command != "" {
+			if err := runCommand(target, e, payload); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: notification %s failed: %v\n", target.Name, err)
+			}
+			continue
+		}
+		// Earlier posts go first, so webhooks see events in order
+		if !flushed {
+			if _, _, err := flush(cfg); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to send queued notifications: %v\n", err)
+			}
+			flushed = true
+		}
+		if err := post(target, payload); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: notification %s failed, queued for later: %v\n", target.Name, err)
+			queue = append(queue, pending{Target: target.Name, Event: payload})
+		}
+	}
+	if len(queue) > 0 {
+		if err := enqueue(queue); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to queue notifications: %v\n", err)
+		}
+	}
+}
+
+// Deliver tells one target about an event right away, without queueing it
+// if that fails
+func Deliver(target *config.NotifyTarget, e Event) error {
+	payload, err := payload(e)
+	if err != nil {
+		return err
+	}
+	if target.Command != "" {
+		return runCommand(target, e, payload)
+	}
+	return post(target, payload)
+}
+
+// Flush sends the queued webhook posts and returns how many were sent and
+// how many are still queued. Posts to targets that no longer exist are
+// dropped.
+func Flush() (int, int, error) {
+	cfg, err := config.LoadGlobal()
+	if err != nil {
+		return 0, 0, err
+	}
+	return flush(cfg)
+}
+
+// payload fills in the event and encodes it
+func payload(e Event) ([]byte, error) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	if e.Host == "" {
+		e.Host, _ = os.Hostname()
+	}
+	if e.User == "" {
+		e.User = config.CurrentUser()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal notification: %w", err)
+	}
+	return data, nil
+}
+
+// runCommand runs the command of a target through the shell, with the event
+// on stdin and in DSP_* environment variables
+func runCommand(target *config.NotifyTarget, e Event, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", target.Command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", target.Command)
+	}
+	cmd.Stdin = bytes.NewReader(payload)
+	// Keep the output of the command notified about clean
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"DSP_EVENT="+e.Event,
+		"DSP_REPO_NAME="+e.Repository,
+		"DSP_SUBJECT="+e.Subject,
+		"DSP_DETAIL="+e.Detail,
+	)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("command failed: %w", err)
+	}
+	return nil
+}
+
+// post posts an event to the webhook of a target
+func post(target *config.NotifyTarget, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.Webhook, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "dsp/"+release.Version)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// pendingPath returns the file queued webhook posts are kept in
+func pendingPath() (string, error) {
+	globalDir, err := config.GlobalDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(globalDir, "notify", "pending.jsonl"), nil
+}
+
+// flush sends the queued webhook posts, keeping those that fail again
+func flush(cfg *config.GlobalConfig) (int, int, error) {
+	unlock, err := config.LockGlobal(config.NotifyLock)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlock()
+
+	queue, err := readPending()
+	if err != nil || len(queue) == 0 {
+		return 0, 0, err
+	}
+	var kept []pending
+	sent := 0
+	failed := make(map[string]bool) // Targets still unreachable
+	for _, p := range queue {
+		target, ok := cfg.FindNotifyTarget(p.Target)
+		if !ok || target.Webhook == "" {
+			continue
+		}
+		if !failed[p.Target] {
+			if err := post(target, p.Event); err == nil {
+				sent++
+				continue
+			}
+			failed[p.Target] = true
+		}
+		kept = append(kept, p)
+	}
+	return sent, len(kept), writePending(kept)
+}
+
+// enqueue adds webhook posts to the queue
+func enqueue(posts []pending) error {
+	unlock, err := config.LockGlobal(config.NotifyLock)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	queue, err := readPending()
+	if err != nil {
+		return err
+	}
+	return writePending(append(queue, posts...))
+}
+
+// readPending returns the queued webhook posts, oldest first
+func readPending() ([]pending, error) {
+	path, err := pendingPath()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queued notifications: %w", err)
+	}
+	defer file.Close()
+
+	var queue []pending
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var p pending
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			continue // Skip damaged lines
+		}
+		queue = append(queue, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read queued notifications: %w", err)
+	}
+	return queue, nil
+}
+
+// writePending replaces the queue, dropping the oldest posts beyond
+// maxPending
+func writePending(queue []pending) error {
+	path, err := pendingPath()
+	if err != nil {
+		return err
+	}
+	if len(queue) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to clear queued notifications: %w", err)
+		}
+		return nil
+	}
+	if len(queue) > maxPending {
+		queue = queue[len(queue)-maxPending:]
+	}
+
+	var buf bytes.Buffer
+	for _, p := range queue {
+		line, err := json.Marshal(p)
+		if err != nil {
+			return fmt.Errorf("failed to marshal queued notification: %w", err)
+		}
+		buf.Write(append(line, '\n'))
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create notify directory: %w", err)
+	}
+	if err := config.WriteFileAtomic(path, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write queued notifications: %w", err)
+	}
+	return nil
+}
+
+// Pending returns how many webhook posts are queued, by target
+func Pending() (map[string]int, error) {
+	unlock, err := config.LockGlobal(config.NotifyLock)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	queue, err := readPending()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, p := range queue {
+		counts[p.Target]++
+	}
+	return counts, nil
+}
@@ -0,0 +1,349 @@
+// Package objects keeps the contents of snapshotted files in the repository's
+// data directory. Snapshots only record hashes; the store lets diffs, merges
+// and bundles read a file version after the working tree has moved on.
+//
+// Contents are zstd compressed, like bundle contents, and addressed by the
+// file hash: <data_dir>/objects/<first two hash characters>/<hash>. With
+// encrypt_at_rest they are also encrypted with the local age key; encrypted
+// and plain contents are told apart by their header, so a store can hold
+// both while the setting changes.
+package objects
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// DirName is the store directory in the data directory
+const DirName = "objects"
+
+// encryptedMarker is written in the store once every content in it is
+// encrypted, so the sweep of older plain contents runs once
+const encryptedMarker = ".encrypted"
+
+// Store is a content-addressed store of compressed file contents
+type Store struct {
+	dir           string
+	hashAlgorithm string
+	quota         int64
+	encrypt       bool               // Encrypt new contents with the local age key
+	keys          *crypto.KeyManager // Loaded on first use
+}
+
+// ForRepo returns the store of the repository at repoPath, or nil if the
+// repository config disables it
+func ForRepo(repoPath string, cfg *config.Config) *Store {
+	quota := cfg.GetContentStoreQuota()
+	if quota <= 0 {
+		return nil
+	}
+	return &Store{
+		dir:           filepath.Join(cfg.DataDirIn(repoPath), DirName),
+		hashAlgorithm: cfg.HashAlgorithm,
+		quota:         quota,
+		encrypt:       cfg.EncryptAtRest,
+	}
+}
+
+// keyManager returns the key manager holding the local age key
+func (s *Store) keyManager() (*crypto.KeyManager, error) {
+	if s.keys == nil {
+		keys, err := crypto.NewKeyManager()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create key manager: %w", err)
+		}
+		s.keys = keys
+	}
+	return s.keys, nil
+}
+
+// path returns the location of an object
+func (s *Store) path(hash string) string {
+	if len(hash) < 2 {
+		return filepath.Join(s.dir, hash)
+	}
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// Has reports whether the store holds the content with this hash
+func (s *Store) Has(hash string) bool {
+	_, err := os.Stat(s.path(hash))
+	return err == nil
+}
+
+// GetRaw returns the compressed content with this hash
+func (s *Store) GetRaw(hash string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stored content: %w", err)
+	}
+	if crypto.IsEncrypted(data) {
+		keys, err := s.keyManager()
+		if err != nil {
+			return nil, err
+		}
+		if data, err = keys.DecryptWithPrivateKey(data); err != nil {
+			return nil, fmt.Errorf("failed to decrypt stored content: %w", err)
+		}
+	}
+	return data, nil
+}
+
+// Get returns the content with this hash, verified against the hash
+func (s *Store) Get(hash string) ([]byte, error) {
+	raw, err := s.GetRaw(hash)
+	if err != nil {
+		return nil, err
+	}
+	data, err := utils.Decompress(raw)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := utils.HashReader(bytes.NewReader(data), s.hashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	if actual != hash {
+		return nil, fmt.Errorf("stored content does not match hash %s", hash)
+	}
+	return data, nil
+}
+
+// PutFile stores the content of a file if it still has the given hash. It
+// returns the compressed size added, 0 if the content was already stored,
+// the file changed or it is larger than the quota.
+func (s *Store) PutFile(path, hash string, compressionLevel int) (int64, error) {
+	if s.Has(hash) {
+		return 0, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat file: %w", err)
+	}
+	if info.Size() > s.quota {
+		return 0, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read file: %w", err)
+	}
+	// Skip files changed since they were hashed
+	if actual, err := utils.HashReader(bytes.NewReader(data), s.hashAlgorithm); err != nil || actual != hash {
+		return 0, err
+	}
+	return s.put(hash, data, compressionLevel)
+}
+
+// Put stores content with the given hash, which must match it. It returns
+// the compressed size added, 0 if the content was already stored or it is
+// larger than the quota.
+func (s *Store) Put(hash string, data []byte, compressionLevel int) (int64, error) {
+	if s.Has(hash) || int64(len(data)) > s.quota {
+		return 0, nil
+	}
+	actual, err := utils.HashReader(bytes.NewReader(data), s.hashAlgorithm)
+	if err != nil {
+		return 0, err
+	}
+	if actual != hash {
+		return 0, fmt.Errorf("content does not match hash %s", hash)
+	}
+	return s.put(hash, data, compressionLevel)
+}
+
+// put compresses and stores content already checked against its hash
+func (s *Store) put(hash string, data []byte, compressionLevel int) (int64, error) {
+	compressed, err := utils.Compress(data, compressionLevel)
+	if err != nil {
+		return 0, err
+	}
+	if compressed, err = s.seal(compressed); err != nil {
+		return 0, err
+	}
+
+	target := s.path(hash)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create content store: %w", err)
+	}
+	if err := config.WriteFileAtomic(target, compressed, 0644); err != nil {
+		return 0, fmt.Errorf("failed to store content: %w", err)
+	}
+	return int64(len(compressed)), nil
+}
+
+// seal encrypts compressed content if the store encrypts new contents. A
+// store holding plain contents loses its encrypted marker.
+func (s *Store) seal(compressed []byte) ([]byte, error) {
+	if !s.encrypt {
+		os.Remove(filepath.Join(s.dir, encryptedMarker))
+		return compressed, nil
+	}
+	keys, err := s.keyManager()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := keys.EncryptForSelf(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt content: %w", err)
+	}
+	return sealed, nil
+}
+
+// EncryptExisting checks that the local age key is available and encrypts
+// the contents stored before encrypt_at_rest was turned on. It does nothing
+// if the store does not encrypt, and returns the number of contents
+// encrypted.
+func (s *Store) EncryptExisting() (int, error) {
+	marker := filepath.Join(s.dir, encryptedMarker)
+	if !s.encrypt {
+		return 0, nil
+	}
+	keys, err := s.keyManager()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := keys.GetPublicKey(); err != nil {
+		return 0, fmt.Errorf("encrypt_at_rest needs the local age key (run 'dsp crypto init'): %w", err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		return 0, nil
+	}
+	hashes, err := s.Hashes()
+	if err != nil {
+		return 0, err
+	}
+
+	encrypted := 0
+	for _, hash := range hashes {
+		path := s.path(hash)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return encrypted, fmt.Errorf("failed to read stored content: %w", err)
+		}
+		if crypto.IsEncrypted(data) {
+			continue
+		}
+		sealed, err := s.seal(data)
+		if err != nil {
+			return encrypted, err
+		}
+		if err := config.WriteFileAtomic(path, sealed, 0644); err != nil {
+			return encrypted, fmt.Errorf("failed to store content: %w", err)
+		}
+		encrypted++
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return encrypted, fmt.Errorf("failed to create content store: %w", err)
+	}
+	if err := os.WriteFile(marker, nil, 0644); err != nil {
+		return encrypted, fmt.Errorf("failed to mark content store encrypted: %w", err)
+	}
+	return encrypted, nil
+}
+
+// object is a stored content found when enforcing the quota
+type object struct {
+	path  string
+	hash  string
+	size  int64
+	mtime int64
+}
+
+// Prune removes the oldest objects until the store fits its quota. Objects
+// whose hashes are in keep are removed last. It returns the number of
+// objects removed.
+func (s *Store) Prune(keep map[string]bool) (int, error) {
+	var all []object
+	var total int64
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+			all = append(all, object{path: path, hash: info.Name(), size: info.Size(), mtime: info.ModTime().UnixNano()})
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read content store: %w", err)
+	}
+	if total <= s.quota {
+		return 0, nil
+	}
+
+	// Oldest first, objects to keep after all others
+	sort.Slice(all, func(i, j int) bool {
+		if keep[all[i].hash] != keep[all[j].hash] {
+			return !keep[all[i].hash]
+		}
+		return all[i].mtime < all[j].mtime
+	})
+	removed := 0
+	for _, o := range all {
+		if total <= s.quota {
+			break
+		}
+		if err := os.Remove(o.path); err != nil {
+			return removed, fmt.Errorf("failed to remove stored content: %w", err)
+		}
+		total -= o.size
+		removed++
+	}
+	return removed, nil
+}
+
+// Hashes returns the hashes of all stored contents
+func (s *Store) Hashes() ([]string, error) {
+	var hashes []string
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+			hashes = append(hashes, info.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content store: %w", err)
+	}
+	return hashes, nil
+}
+
+// Sizes returns the compressed size of each stored content by hash
+func (s *Store) Sizes() (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+			sizes[info.Name()] = info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content store: %w", err)
+	}
+	return sizes, nil
+}
@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Transfer encodings for downloads, negotiated with Accept-Encoding and
+// Content-Encoding like any HTTP compression
+const (
+	EncodingZstd     = "zstd"
+	EncodingGzip     = "gzip"
+	EncodingIdentity = "identity"
+)
+
+// Encodings are the compressed encodings this build speaks, preferred first
+var Encodings = []string{EncodingZstd, EncodingGzip}
+
+// ContentSizeHeader carries the size of a compressed download before
+// compression, as Content-Length then gives the size on the wire
+const ContentSizeHeader = "X-DSP-Content-Size"
+
+// ParseEncodings parses a comma-separated list of encodings, such as
+// "zstd,gzip". "none" or an empty list disables compression.
+func ParseEncodings(value string) ([]string, error) {
+	var encodings []string
+	for _, e := range strings.Split(value, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		switch e {
+		case "", "none", EncodingIdentity:
+			continue
+		case EncodingZstd, EncodingGzip:
+			encodings = append(encodings, e)
+		default:
+			return nil, fmt.Errorf("unsupported encoding %q, must be %s or none", e, strings.Join(Encodings, ", "))
+		}
+	}
+	return encodings, nil
+}
+
+// ChooseEncoding returns the encoding to compress a response with: the first
+// of offered that the Accept-Encoding value allows, or "" to send it as is
+func ChooseEncoding(acceptEncoding string, offered []string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		accepted[name] = true
+		// q=0 means the encoding is not acceptable
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(value, 64); err == nil && q == 0 {
+				accepted[name] = false
+			}
+		}
+	}
+	for _, e := range offered {
+		if accepted[e] {
+			return e
+		}
+	}
+	return ""
+}
+
+// NewEncoder returns a writer compressing to w with the given encoding. It
+// must be closed to flush the compressed stream.
+func NewEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodingZstd:
+		return zstd.NewWriter(w)
+	case EncodingGzip:
+		return gzip.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// NewDecoder returns a reader decompressing r with the given encoding. An
+// empty encoding or identity reads r as is.
+func NewDecoder(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(encoding) {
+	case "", EncodingIdentity:
+		return io.NopCloser(r), nil
+	case EncodingZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case EncodingGzip:
+		return gzip.NewReader(r)
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Mattddixo/dsp/internal/exitcode"
+)
+
+// ErrorKind classifies a failed transfer so callers, and scripts through the
+// exit code, can tell a flaky network from refused credentials or a bad bundle
+type ErrorKind int
+
+const (
+	// KindNetwork means the peer could not be reached, the connection broke or
+	// the peer failed temporarily. These errors are retried.
+	KindNetwork ErrorKind = iota + 1
+	// KindAuth means the peer refused the credentials or does not trust us
+	KindAuth
+	// KindVerification means a certificate, signature or bundle check failed
+	KindVerification
+)
+
+// Exit codes of commands that fail with a transfer error
+const (
+	ExitNetwork      = exitcode.Network
+	ExitAuth         = exitcode.Auth
+	ExitVerification = exitcode.Verification
+)
+
+// String returns the name of the kind
+func (k ErrorKind) String() string {
+	switch k {
+	case KindNetwork:
+		return "network"
+	case KindAuth:
+		return "authentication"
+	case KindVerification:
+		return "verification"
+	}
+	return "unknown"
+}
+
+// Error is a transfer error of a known kind
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the exit code for the kind of error
+func (e *Error) ExitCode() int {
+	switch e.Kind {
+	case KindNetwork:
+		return ExitNetwork
+	case KindAuth:
+		return ExitAuth
+	case KindVerification:
+		return ExitVerification
+	}
+	return 1
+}
+
+// NetworkError marks err as a network error
+func NetworkError(err error) error {
+	return &Error{Kind: KindNetwork, Err: err}
+}
+
+// AuthError marks err as an authentication error
+func AuthError(err error) error {
+	return &Error{Kind: KindAuth, Err: err}
+}
+
+// VerificationError marks err as a verification error
+func VerificationError(err error) error {
+	return &Error{Kind: KindVerification, Err: err}
+}
+
+// KindOf returns the kind of the transfer error wrapped in err, or 0 if err
+// is not a transfer error
+func KindOf(err error) ErrorKind {
+	var transferErr *Error
+	if errors.As(err, &transferErr) {
+		return transferErr.Kind
+	}
+	return 0
+}
+
+// StatusError returns the error for an unexpected response status. Refused
+// credentials are authentication errors; server failures and overload are
+// network errors, as they may pass.
+func StatusError(resp *http.Response) error {
+	err := fmt.Errorf("server returned error: %s", resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return AuthError(err)
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests:
+		return NetworkError(err)
+	}
+	return err
+}
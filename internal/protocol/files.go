@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Paths served by a file export
+const (
+	ManifestPath = "/manifest"
+	FilesPath    = "/files/"
+	CatalogPath  = "/bundles"
+)
+
+// Catalog limits: the number of bundles listed per response when the request
+// does not ask for fewer
+const (
+	DefaultCatalogLimit = 100
+	MaxCatalogLimit     = 1000
+)
+
+// FileManifestVersion is the version of the file manifest format
+const FileManifestVersion = 1
+
+// FileManifest lists the files a file export serves. Only these files can be
+// fetched, each from FilesPath followed by its path, and requests for them
+// may ask for byte ranges.
+type FileManifest struct {
+	Version    int            `json:"version"`
+	Repository string         `json:"repository"`
+	CreatedAt  time.Time      `json:"created_at"`
+	Files      []ManifestFile `json:"files"`
+}
+
+// ManifestFile is one file of a file export
+type ManifestFile struct {
+	Path    string    `json:"path"` // Slash-separated, relative to the DSP directory
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// SignedManifest is the response to ManifestPath. Signature is made over the
+// exact bytes of Manifest with the exporter's signing key, whose public key
+// Signer holds in PEM format.
+type SignedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+	Signer    string          `json:"signer"`
+}
+
+// BundleCatalog is the response to CatalogPath: the bundles of a file export
+// in ID order, after the ID the request gave as since. When more bundles
+// follow, Next is the ID to ask for the next page with. The response is
+// signed like a status response, with the signature in SignatureHeader.
+type BundleCatalog struct {
+	Repository string          `json:"repository"`
+	Bundles    []CatalogBundle `json:"bundles"`
+	Next       string          `json:"next,omitempty"`
+}
+
+// CatalogBundle is one bundle of a catalog. Parent is the bundle of the
+// export whose target snapshot this bundle starts from, if there is one;
+// encrypted bundles have no readable metadata, so they have no parent and
+// CreatedAt is their modification time.
+type CatalogBundle struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"` // As in the manifest
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Parent    string    `json:"parent,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Encrypted bool      `json:"encrypted,omitempty"`
+}
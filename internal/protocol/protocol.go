@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Protocol version information
+const (
+	// Version is the transfer protocol version spoken by this build
+	Version = 1
+
+	// MinVersion is the oldest protocol version this build can talk to
+	MinVersion = 1
+
+	// VersionHeader carries the protocol version on every request and
+	// response: the version negotiated with the server on requests, and the
+	// version the server speaks on responses
+	VersionHeader = "X-DSP-Protocol-Version"
+
+	// MinVersionHeader carries the oldest protocol version a peer accepts
+	MinVersionHeader = "X-DSP-Protocol-Min-Version"
+
+	// ContentHashHeader carries the hex SHA-256 of the exact bytes of a
+	// download, so importers can check them before decrypting
+	ContentHashHeader = "X-DSP-Content-SHA256"
+
+	// DeltaHeader is set on a download that leaves out contents the importer
+	// already has, to the number of contents left out
+	DeltaHeader = "X-DSP-Delta"
+
+	// SignatureHeader carries the exporter's signature of a status response
+	// body, made with the signing key the body carries
+	SignatureHeader = "X-DSP-Signature"
+
+	// LegacyVersion is assumed for peers that do not send a version header
+	LegacyVersion = 1
+)
+
+// Feature names that can be negotiated between exporter and importer
+const (
+	FeatureKeyExchange  = "key-exchange"
+	FeatureOneTimeToken = "one-time-token"
+	FeatureEncryption   = "encryption"
+	FeatureContentHash  = "content-hash"
+	FeatureDeltaSync    = "delta-sync"
+	FeatureFiles        = "files"
+	FeatureSignedStatus = "signed-status"
+	FeatureCatalog      = "bundle-catalog"
+)
+
+// DeltaRequest is the body of a POST to /download. It lists the hashes of the
+// file versions and chunks the importer already has, which the exporter may
+// leave out of the bundle it sends.
+type DeltaRequest struct {
+	Have []string `json:"have"`
+}
+
+// Capabilities describes what a peer supports
+type Capabilities struct {
+	Version    int      `json:"version"`     // Protocol version spoken by the peer
+	MinVersion int      `json:"min_version"` // Oldest protocol version the peer accepts
+	Features   []string `json:"features"`    // Optional features the peer supports
+}
+
+// Local returns the capabilities of this build
+func Local() *Capabilities {
+	return &Capabilities{
+		Version:    Version,
+		MinVersion: MinVersion,
+		Features: []string{
+			FeatureKeyExchange,
+			FeatureOneTimeToken,
+			FeatureEncryption,
+			FeatureContentHash,
+			FeatureDeltaSync,
+			FeatureFiles,
+			FeatureSignedStatus,
+			FeatureCatalog,
+		},
+	}
+}
+
+// Legacy returns the capabilities assumed for peers that predate negotiation
+func Legacy() *Capabilities {
+	return &Capabilities{
+		Version:    LegacyVersion,
+		MinVersion: LegacyVersion,
+		Features: []string{
+			FeatureKeyExchange,
+			FeatureOneTimeToken,
+			FeatureEncryption,
+		},
+	}
+}
+
+// Supports checks if the peer supports a feature
+func (c *Capabilities) Supports(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate returns the features supported by both peers
+func (c *Capabilities) Negotiate(remote *Capabilities) []string {
+	var common []string
+	for _, f := range c.Features {
+		if remote.Supports(f) {
+			common = append(common, f)
+		}
+	}
+	return common
+}
+
+// ParseVersion parses a protocol version header value.
+// An empty value is treated as a legacy peer.
+func ParseVersion(value string) (int, error) {
+	if value == "" {
+		return LegacyVersion, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid protocol version: %q", value)
+	}
+	return version, nil
+}
+
+// NegotiateVersion returns the protocol version to speak with a peer that
+// speaks versions minVersion to version: the newest version both speak. It
+// fails if the ranges do not overlap.
+func NegotiateVersion(version, minVersion int) (int, error) {
+	if Version < minVersion || version < MinVersion {
+		return 0, fmt.Errorf("protocol version mismatch: server speaks v%d to v%d, client v%d to v%d", minVersion, version, MinVersion, Version)
+	}
+	return min(version, Version), nil
+}
+
+// CheckClientVersion verifies that a client speaking versions minVersion to
+// version can be served
+func CheckClientVersion(version, minVersion int) error {
+	if Version < minVersion || version < MinVersion {
+		return fmt.Errorf("protocol version mismatch: server speaks v%d to v%d, client v%d to v%d", MinVersion, Version, minVersion, version)
+	}
+	return nil
+}
+
+// SetHeader adds the protocol version headers to an HTTP header set: the
+// given version, and the oldest version this build accepts
+func SetHeader(h http.Header, version int) {
+	h.Set(VersionHeader, strconv.Itoa(version))
+	h.Set(MinVersionHeader, strconv.Itoa(MinVersion))
+}
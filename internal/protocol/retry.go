@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// MaxRetryDelay caps the wait between two attempts
+const MaxRetryDelay = 30 * time.Second
+
+// RetryPolicy decides how often a transfer request failing with a network
+// error is tried again. The wait starts at Delay and doubles after each
+// attempt, up to MaxRetryDelay.
+type RetryPolicy struct {
+	Retries int           // Attempts after the first; 0 disables retries
+	Delay   time.Duration // Wait before the first retry
+}
+
+// Do runs op until it succeeds, fails with an error other than a network
+// error, runs out of retries or ctx is cancelled. what names the operation
+// in the warning printed before each retry.
+func (p RetryPolicy) Do(ctx context.Context, what string, op func() error) error {
+	delay := p.Delay
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || KindOf(err) != KindNetwork || attempt > p.Retries || ctx.Err() != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "Warning: %s failed: %v; retrying in %s (%d of %d)\n", what, err, delay, attempt, p.Retries)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay = min(delay*2, MaxRetryDelay)
+	}
+}
@@ -0,0 +1,155 @@
+// Package receipt keeps signed receipts of completed bundle transfers. Both
+// sides of an export and import write one into their data directory, so
+// teams that only meet through transfers keep a verifiable record of which
+// bundle went where and when.
+package receipt
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/crypto"
+)
+
+// DirName is the receipts directory in a data directory
+const DirName = "receipts"
+
+// Transfer directions
+const (
+	Sent     = "sent"
+	Received = "received"
+)
+
+// Receipt records a completed bundle transfer
+type Receipt struct {
+	Direction    string    `json:"direction"` // Sent or Received
+	BundleID     string    `json:"bundle_id"`
+	BundleHash   string    `json:"bundle_hash"`   // SHA-256 of the bundle file on this side
+	TransferHash string    `json:"transfer_hash"` // SHA-256 of the bytes transferred, which differ from the bundle when encrypted or a delta
+	Bytes        int64     `json:"bytes"`         // Bytes transferred, before transfer compression
+	Peer         string    `json:"peer"`          // Address of the other side
+	PeerHost     string    `json:"peer_host,omitempty"`
+	PeerUser     string    `json:"peer_user,omitempty"`
+	PeerCert     string    `json:"peer_cert,omitempty"` // Certificate fingerprint of the exporter, on receipts of imports
+	Started      time.Time `json:"started"`
+	Completed    time.Time `json:"completed"`
+	User         string    `json:"user"` // Local user that ran the transfer
+
+	// Signing public key (PEM) and its signature over the rest of the
+	// receipt. Unsigned receipts are written when the host has no signing key.
+	SignerKey string `json:"signer_key,omitempty"`
+	Signature string `json:"signature,omitempty"`
+
+	// File the receipt was read from
+	path string
+}
+
+// Sign signs the receipt with the host's signing key
+func (r *Receipt) Sign(keyManager *crypto.KeyManager) error {
+	publicKey, err := keyManager.GetSigningPublicKey()
+	if err != nil {
+		return err
+	}
+	r.SignerKey = string(publicKey)
+	r.Signature = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to marshal receipt: %w", err)
+	}
+	r.Signature, err = keyManager.SignData(data)
+	return err
+}
+
+// Verify checks the signature of the receipt against the key it carries and
+// returns the fingerprint of that key
+func (r *Receipt) Verify() (string, error) {
+	if r.Signature == "" {
+		return "", fmt.Errorf("receipt is not signed")
+	}
+	unsigned := *r
+	unsigned.Signature = ""
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal receipt: %w", err)
+	}
+	if err := crypto.VerifyData([]byte(r.SignerKey), data, r.Signature); err != nil {
+		return "", err
+	}
+	return crypto.SigningKeyFingerprint([]byte(r.SignerKey))
+}
+
+// Path returns the file the receipt was read from or written to
+func (r *Receipt) Path() string {
+	return r.path
+}
+
+// Write signs the receipt and saves it in the receipts directory of dataDir.
+// If the host has no signing key the receipt is saved unsigned, with a
+// warning.
+func Write(dataDir string, r *Receipt) error {
+	if r.User == "" {
+		r.User = config.CurrentUser()
+	}
+	keyManager, err := crypto.NewKeyManager()
+	if err == nil {
+		err = r.Sign(keyManager)
+	}
+	if err != nil {
+		r.SignerKey, r.Signature = "", ""
+		fmt.Fprintf(os.Stderr, "Warning: receipt of bundle %s is not signed: %v\n", r.BundleID, err)
+	}
+
+	dir := filepath.Join(dataDir, DirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create receipts directory: %w", err)
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal receipt: %w", err)
+	}
+	name := fmt.Sprintf("%s-%s-%s.json", r.Completed.UTC().Format("20060102150405.000000"), r.BundleID, r.Direction)
+	r.path = filepath.Join(dir, name)
+	if err := os.WriteFile(r.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write receipt: %w", err)
+	}
+	return nil
+}
+
+// List reads the receipts in the receipts directory of dataDir, oldest
+// first. A missing directory has no receipts.
+func List(dataDir string) ([]*Receipt, error) {
+	dir := filepath.Join(dataDir, DirName)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read receipts directory: %w", err)
+	}
+
+	var receipts []*Receipt
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read receipt: %w", err)
+		}
+		var r Receipt
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, fmt.Errorf("failed to parse receipt %s: %w", entry.Name(), err)
+		}
+		r.path = path
+		receipts = append(receipts, &r)
+	}
+	sort.SliceStable(receipts, func(i, j int) bool { return receipts[i].Completed.Before(receipts[j].Completed) })
+	return receipts, nil
+}
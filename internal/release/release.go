@@ -0,0 +1,420 @@
+// Package release identifies this build of DSP and handles signed release
+// bundles, which carry a new binary to machines that cannot download one.
+//
+// A release bundle is a zip archive holding the binary, a manifest.json
+// describing it and manifest.sig, the signature of the manifest by the
+// release signing key. The public half of that key is embedded in release
+// builds; builds without it cannot update themselves.
+package release
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/crypto"
+	"github.com/Mattddixo/dsp/internal/protocol"
+)
+
+// Version is the version of this build. Release builds set it with
+//
+//	-ldflags "-X github.com/Mattddixo/dsp/internal/release.Version=v1.2.3"
+var Version = "dev"
+
+// Commit and BuildDate identify the source and time of this build. Release
+// builds set them with -X like Version; other builds fall back to the VCS
+// information the Go toolchain records, if any.
+var (
+	Commit    = ""
+	BuildDate = ""
+)
+
+// publicKey is the release signing public key, as base64 of its PEM. Release
+// builds set it with
+//
+//	-ldflags "-X github.com/Mattddixo/dsp/internal/release.publicKey=<base64>"
+//
+// as printed by 'dsp selfupdate pack'.
+var publicKey = ""
+
+// LatestURL is where 'dsp version --check' looks up the latest release
+const LatestURL = "https://api.github.com/repos/Mattddixo/dsp/releases/latest"
+
+// Names of the entries of a release bundle
+const (
+	manifestName  = "manifest.json"
+	signatureName = "manifest.sig"
+)
+
+// Manifest describes the binary in a release bundle
+type Manifest struct {
+	Version string    `json:"version"`
+	OS      string    `json:"os"`
+	Arch    string    `json:"arch"`
+	Binary  string    `json:"binary"` // Name of the binary entry
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	Created time.Time `json:"created"`
+}
+
+// PublicKey returns the embedded release signing public key in PEM format,
+// or nil if this build has none
+func PublicKey() []byte {
+	if publicKey == "" {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// BuildInfo returns the commit and build date of this build, "unknown" for
+// either that is not known. The commit is marked "-dirty" if it was built
+// from a modified tree.
+func BuildInfo() (commit, date string) {
+	commit, date = Commit, BuildDate
+	if info, ok := debug.ReadBuildInfo(); ok && (commit == "" || date == "") {
+		settings := make(map[string]string)
+		for _, s := range info.Settings {
+			settings[s.Key] = s.Value
+		}
+		if commit == "" && settings["vcs.revision"] != "" {
+			commit = settings["vcs.revision"]
+			if settings["vcs.modified"] == "true" {
+				commit += "-dirty"
+			}
+		}
+		if date == "" {
+			date = settings["vcs.time"]
+		}
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return commit, date
+}
+
+// EncodeKey returns a signing public key in the form publicKey is set in
+func EncodeKey(publicKeyPEM []byte) string {
+	return base64.StdEncoding.EncodeToString(publicKeyPEM)
+}
+
+// Pack writes a release bundle of the binary to outPath, signed with the
+// signing key of keyManager
+func Pack(binaryPath, version, goos, goarch, outPath string, keyManager *crypto.KeyManager) (*Manifest, error) {
+	data, err := os.ReadFile(binaryPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read binary: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	binary := "dsp"
+	if goos == "windows" {
+		binary = "dsp.exe"
+	}
+	manifest := &Manifest{
+		Version: version,
+		OS:      goos,
+		Arch:    goarch,
+		Binary:  binary,
+		Size:    int64(len(data)),
+		SHA256:  hex.EncodeToString(sum[:]),
+		Created: time.Now().UTC(),
+	}
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	signature, err := keyManager.SignData(manifestData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign manifest: %w", err)
+	}
+
+	file, err := os.Create(outPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create release bundle: %w", err)
+	}
+	defer file.Close()
+	w := zip.NewWriter(file)
+	entries := []struct {
+		name string
+		data []byte
+	}{
+		{manifestName, manifestData},
+		{signatureName, []byte(signature)},
+		{binary, data},
+	}
+	for _, e := range entries {
+		header := &zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: manifest.Created}
+		header.SetMode(0755)
+		entry, err := w.CreateHeader(header)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add %s: %w", e.name, err)
+		}
+		if _, err := entry.Write(e.data); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", e.name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish release bundle: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to write release bundle: %w", err)
+	}
+	return manifest, nil
+}
+
+// Bundle is an opened release bundle whose manifest signature verified
+type Bundle struct {
+	Manifest    *Manifest
+	Fingerprint string // Of the key that signed the manifest
+	reader      *zip.ReadCloser
+	binary      *zip.File
+}
+
+// Open opens a release bundle and verifies its manifest against the
+// embedded release key
+func Open(path string) (*Bundle, error) {
+	key := PublicKey()
+	if key == nil {
+		return nil, fmt.Errorf("this build of dsp has no release key embedded and cannot verify release bundles")
+	}
+	return OpenWithKey(path, key)
+}
+
+// OpenWithKey opens a release bundle and verifies its manifest against the
+// given signing public key
+func OpenWithKey(path string, publicKeyPEM []byte) (*Bundle, error) {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open release bundle: %w", err)
+	}
+	b := &Bundle{reader: reader}
+	if err := b.verify(publicKeyPEM); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// verify checks the manifest signature and finds the binary
+func (b *Bundle) verify(publicKeyPEM []byte) error {
+	manifestData, err := b.read(manifestName)
+	if err != nil {
+		return err
+	}
+	signature, err := b.read(signatureName)
+	if err != nil {
+		return err
+	}
+	if err := crypto.VerifyData(publicKeyPEM, manifestData, strings.TrimSpace(string(signature))); err != nil {
+		return protocol.VerificationError(fmt.Errorf("release bundle is not signed by the release key: %w", err))
+	}
+	if b.Fingerprint, err = crypto.SigningKeyFingerprint(publicKeyPEM); err != nil {
+		return err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return fmt.Errorf("failed to parse release manifest: %w", err)
+	}
+	b.Manifest = &manifest
+	for _, f := range b.reader.File {
+		if f.Name == manifest.Binary {
+			b.binary = f
+		}
+	}
+	if b.binary == nil || manifest.Binary == manifestName || manifest.Binary == signatureName {
+		return fmt.Errorf("release bundle has no binary %q", manifest.Binary)
+	}
+	return nil
+}
+
+// read returns the contents of a small entry of the bundle
+func (b *Bundle) read(name string) ([]byte, error) {
+	for _, f := range b.reader.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", name, err)
+		}
+		defer rc.Close()
+		return io.ReadAll(io.LimitReader(rc, 1<<20))
+	}
+	return nil, fmt.Errorf("release bundle has no %s", name)
+}
+
+// Close closes the bundle
+func (b *Bundle) Close() error {
+	return b.reader.Close()
+}
+
+// CheckPlatform returns an error if the bundle's binary is not for this
+// operating system and architecture
+func (b *Bundle) CheckPlatform() error {
+	if b.Manifest.OS != runtime.GOOS || b.Manifest.Arch != runtime.GOARCH {
+		return fmt.Errorf("release bundle is for %s/%s, this machine is %s/%s",
+			b.Manifest.OS, b.Manifest.Arch, runtime.GOOS, runtime.GOARCH)
+	}
+	return nil
+}
+
+// Install replaces the executable at exePath with the bundle's binary. The
+// binary is written next to it and checked against the manifest first, then
+// renamed over it, so the executable is never left half-written. Windows
+// cannot replace a running executable, so there it is moved aside to
+// <exe>.old first.
+func (b *Bundle) Install(exePath string) error {
+	info, err := os.Stat(exePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat executable: %w", err)
+	}
+
+	rc, err := b.binary.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open binary: %w", err)
+	}
+	defer rc.Close()
+
+	temp, err := os.CreateTemp(filepath.Dir(exePath), ".dsp-update-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file next to %s: %w", exePath, err)
+	}
+	tempPath := temp.Name()
+	defer os.Remove(tempPath)
+
+	// Copy at most one byte more than the manifest allows, so a binary
+	// inflating past its recorded size is refused without filling the disk
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(temp, hasher), io.LimitReader(rc, b.Manifest.Size+1))
+	if err == nil && size > b.Manifest.Size {
+		temp.Close()
+		return protocol.VerificationError(fmt.Errorf("binary in release bundle is larger than the %d bytes its manifest records", b.Manifest.Size))
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write new binary: %w", err)
+	}
+	if size != b.Manifest.Size || hex.EncodeToString(hasher.Sum(nil)) != b.Manifest.SHA256 {
+		return protocol.VerificationError(fmt.Errorf("binary in release bundle does not match its manifest"))
+	}
+	if err := os.Chmod(tempPath, info.Mode().Perm()|0755); err != nil {
+		return fmt.Errorf("failed to make new binary executable: %w", err)
+	}
+
+	if runtime.GOOS == "windows" {
+		old := exePath + ".old"
+		os.Remove(old)
+		if err := os.Rename(exePath, old); err != nil {
+			return fmt.Errorf("failed to move current executable aside: %w", err)
+		}
+		if err := os.Rename(tempPath, exePath); err != nil {
+			os.Rename(old, exePath)
+			return fmt.Errorf("failed to install new executable: %w", err)
+		}
+		return nil
+	}
+	if err := os.Rename(tempPath, exePath); err != nil {
+		return fmt.Errorf("failed to install new executable: %w", err)
+	}
+	return nil
+}
+
+// CompareVersions compares two versions of the form v1.2.3, returning -1, 0
+// or 1. Versions that do not parse, such as "dev", are older than any that do.
+func CompareVersions(a, b string) int {
+	pa, okA := parseVersion(a)
+	pb, okB := parseVersion(b)
+	switch {
+	case !okA && !okB:
+		return 0
+	case !okA:
+		return -1
+	case !okB:
+		return 1
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			if pa[i] < pb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// parseVersion parses the major, minor and patch numbers of a version,
+// ignoring any pre-release or build suffix
+func parseVersion(v string) ([3]int, bool) {
+	var parts [3]int
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	fields := strings.Split(v, ".")
+	if len(fields) == 0 || len(fields) > 3 {
+		return parts, false
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
+
+// Latest looks up the version of the latest published release
+func Latest(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, LatestURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the latest release: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to look up the latest release: %s", resp.Status)
+	}
+	var latest struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&latest); err != nil {
+		return "", fmt.Errorf("failed to parse the latest release: %w", err)
+	}
+	if latest.TagName == "" {
+		return "", fmt.Errorf("latest release has no version")
+	}
+	return latest.TagName, nil
+}
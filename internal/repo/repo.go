@@ -1,12 +1,16 @@
 package repo
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"time"
+	"regexp"
+	"strings"
 
 	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/exitcode"
+	"github.com/Mattddixo/dsp/internal/migrations"
 	"github.com/Mattddixo/dsp/internal/snapshot"
 	"gopkg.in/yaml.v3"
 )
@@ -21,6 +25,8 @@ type Repository struct {
 
 // Manager handles multiple DSP repositories
 type Manager struct {
+	FormatVersion int `yaml:"format_version"` // Format of repos.yaml
+
 	Repos       []Repository `yaml:"repos"`
 	DefaultRepo string       `yaml:"default_repo"`
 	WorkingRepo string       `yaml:"working_repo"` // New field for working repository
@@ -29,14 +35,11 @@ type Manager struct {
 
 // NewManager creates a new repository manager
 func NewManager() (*Manager, error) {
-	// Get user's home directory
-	home, err := os.UserHomeDir()
+	// Create the global DSP directory
+	globalDir, err := config.GlobalDir()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user home directory: %w", err)
+		return nil, err
 	}
-
-	// Create .dsp-global directory in user's home
-	globalDir := filepath.Join(home, ".dsp-global")
 	if err := os.MkdirAll(globalDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create global DSP directory: %w", err)
 	}
@@ -48,7 +51,7 @@ func NewManager() (*Manager, error) {
 
 	// Load existing config if it exists
 	if err := manager.Load(); err != nil {
-		return nil, fmt.Errorf("failed to load repository config: %w", err)
+		return nil, exitcode.ConfigError(fmt.Errorf("failed to load repository config: %w", err))
 	}
 
 	return manager, nil
@@ -56,6 +59,11 @@ func NewManager() (*Manager, error) {
 
 // Load loads the repository configuration
 func (m *Manager) Load() error {
+	m.FormatVersion = 0
+	m.Repos = nil
+	m.DefaultRepo = ""
+	m.WorkingRepo = ""
+
 	// If config doesn't exist, create empty config
 	if _, err := os.Stat(m.ConfigPath); os.IsNotExist(err) {
 		m.Repos = []Repository{}
@@ -68,10 +76,23 @@ func (m *Manager) Load() error {
 		return fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	// Parse YAML
+	// Parse YAML, upgrading older formats
 	if err := yaml.Unmarshal(data, m); err != nil {
+		if err := migrations.Repos.Check(migrations.Repos.Version(data), m.ConfigPath); err != nil {
+			return err
+		}
 		return fmt.Errorf("failed to parse config file: %w", err)
 	}
+	upgraded, changed, err := migrations.Repos.Upgrade(m.FormatVersion, data, m.ConfigPath)
+	if err != nil {
+		return err
+	}
+	if changed {
+		m.Repos = nil
+		if err := yaml.Unmarshal(upgraded, m); err != nil {
+			return fmt.Errorf("failed to parse upgraded config file: %w", err)
+		}
+	}
 
 	return nil
 }
@@ -79,21 +100,59 @@ func (m *Manager) Load() error {
 // Save saves the repository configuration
 func (m *Manager) Save() error {
 	// Marshal to YAML
+	m.FormatVersion = migrations.ReposVersion
 	data, err := yaml.Marshal(m)
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
 
 	// Write to file
-	if err := os.WriteFile(m.ConfigPath, data, 0644); err != nil {
+	if err := config.WriteFileAtomic(m.ConfigPath, data, 0644); err != nil {
 		return fmt.Errorf("failed to write config file: %w", err)
 	}
 
 	return nil
 }
 
-// InitializeRepository initializes a new repository
-func (m *Manager) InitializeRepository(path string, name string, isDefault bool, dspDir string) error {
+// lock takes the repos.yaml lock and reloads the configuration, so that a
+// change made while holding it starts from the latest state on disk
+func (m *Manager) lock() (func(), error) {
+	unlock, err := config.LockGlobal(config.ReposLock)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Load(); err != nil {
+		unlock()
+		return nil, fmt.Errorf("failed to reload repository config: %w", err)
+	}
+	return unlock, nil
+}
+
+// Update reloads the configuration, applies fn and saves the result while
+// holding the repos.yaml lock, so concurrent dsp processes do not lose
+// each other's changes
+func (m *Manager) Update(fn func() error) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := fn(); err != nil {
+		return err
+	}
+	return m.Save()
+}
+
+// InitializeRepository initializes a new repository. A name that is taken or
+// not allowed is refused unless force is set.
+func (m *Manager) InitializeRepository(path string, name string, isDefault bool, dspDir string, force bool) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Convert to absolute path
 	absPath, err := filepath.Abs(path)
 	if err != nil {
@@ -106,6 +165,9 @@ func (m *Manager) InitializeRepository(path string, name string, isDefault bool,
 			return fmt.Errorf("repository already registered at %s", absPath)
 		}
 	}
+	if err := m.checkName(name, absPath, force); err != nil {
+		return err
+	}
 
 	// Add new repository
 	repo := Repository{
@@ -129,8 +191,15 @@ func (m *Manager) InitializeRepository(path string, name string, isDefault bool,
 	return nil
 }
 
-// AddRepository adds a previously closed repository
-func (m *Manager) AddRepository(path string, name string, isDefault bool) error {
+// AddRepository adds a previously closed repository. A name that is taken or
+// not allowed is refused unless force is set.
+func (m *Manager) AddRepository(path string, name string, isDefault bool, force bool) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Convert DSP directory path to absolute path
 	absPath, err := filepath.Abs(path)
 	if err != nil {
@@ -149,6 +218,9 @@ func (m *Manager) AddRepository(path string, name string, isDefault bool) error
 			return fmt.Errorf("repository already registered at %s", repoRoot)
 		}
 	}
+	if err := m.checkName(name, repoRoot, force); err != nil {
+		return err
+	}
 
 	// Load repository config from the DSP directory
 	configPath := filepath.Join(absPath, "config.yaml")
@@ -186,10 +258,8 @@ func (m *Manager) AddRepository(path string, name string, isDefault bool) error
 
 	// If repository was closed, reopen it
 	if snapshot.IsRepositoryClosed(trackingConfig) {
-		// Reopen the repository by clearing the closed state
-		trackingConfig.State = snapshot.RepositoryState{
-			IsClosed:     false,
-			LastModified: time.Now(),
+		if err := snapshot.ReopenRepository(trackingConfig, config.CurrentUser()); err != nil {
+			return fmt.Errorf("failed to reopen repository: %w", err)
 		}
 		if err := snapshot.SaveTrackingConfig(absPath, trackingConfig); err != nil {
 			return fmt.Errorf("failed to reopen repository: %w", err)
@@ -221,6 +291,12 @@ func (m *Manager) AddRepository(path string, name string, isDefault bool) error
 
 // RemoveRepository removes a repository by name or path
 func (m *Manager) RemoveRepository(repoArg string) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// First try to find repository by name
 	var targetRepo *Repository
 	for i, repo := range m.Repos {
@@ -305,12 +381,11 @@ func (m *Manager) closeRepositoryTrackingWithInfo(repoPath, dspDir string) error
 		return fmt.Errorf("failed to load tracking config: %w", err)
 	}
 
-	// Mark repository as closed
-	trackingConfig.State = snapshot.RepositoryState{
-		IsClosed:     true,
-		ClosedAt:     time.Now(),
-		ClosedBy:     os.Getenv("USERNAME"), // Use current user
-		LastModified: time.Now(),
+	// Mark repository as closed, unless it was closed explicitly before
+	if !snapshot.IsRepositoryClosed(trackingConfig) {
+		if err := snapshot.CloseRepository(trackingConfig, config.CurrentUser(), "removed from management"); err != nil {
+			return err
+		}
 	}
 
 	// Save tracking config
@@ -334,6 +409,12 @@ func (m *Manager) closeRepositoryTracking(repoPath string) error {
 
 // SetDefault sets or unsets the default repository
 func (m *Manager) SetDefault(repoArg string) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// If empty string is provided, unset the default
 	if repoArg == "" {
 		// Clear default flag for all repositories
@@ -423,6 +504,66 @@ func (m *Manager) GetRepository(repoArg string) (*Repository, error) {
 	return nil, fmt.Errorf("repository not found: '%s' (tried as both name and path). Use 'dsp repo list' to see available repositories", repoArg)
 }
 
+// namePattern is what repository names are made of: letters, digits, dots,
+// underscores and dashes, starting with a letter or digit, so they can never
+// be mistaken for paths
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// maxNameLength is the longest repository name allowed
+const maxNameLength = 64
+
+// ValidateName checks that name is an allowed repository name
+func ValidateName(name string) error {
+	if len(name) > maxNameLength {
+		return fmt.Errorf("repository name '%s' is longer than %d characters", name, maxNameLength)
+	}
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("repository name '%s' may only contain letters, digits, '.', '_' and '-', and must start with a letter or digit", name)
+	}
+	return nil
+}
+
+// NameTaken returns the repository other than the one at path that is named
+// name, or nil
+func (m *Manager) NameTaken(name, path string) *Repository {
+	for i, repo := range m.Repos {
+		if repo.Name == name && repo.Path != path {
+			return &m.Repos[i]
+		}
+	}
+	return nil
+}
+
+// CheckName returns why the repository at path cannot be registered under
+// name, or nil: the name is not allowed or is used by another repository
+func (m *Manager) CheckName(name, path string) error {
+	var problems []string
+	if err := ValidateName(name); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if other := m.NameTaken(name, path); other != nil {
+		problems = append(problems, fmt.Sprintf("name '%s' is already used by the repository at %s", name, other.Path))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// checkName refuses to register the repository at path under a name
+// CheckName objects to. With force, it warns instead.
+func (m *Manager) checkName(name, path string, force bool) error {
+	err := m.CheckName(name, path)
+	if err == nil {
+		return nil
+	}
+	if !force {
+		return fmt.Errorf("%w; use --force to use it anyway", err)
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	return nil
+}
+
 // GetDefaultRepository gets the default repository
 func (m *Manager) GetDefaultRepository() (*Repository, error) {
 	if m.DefaultRepo == "" {
@@ -432,19 +573,42 @@ func (m *Manager) GetDefaultRepository() (*Repository, error) {
 	return m.GetRepository(m.DefaultRepo)
 }
 
-// GetCurrentRepo gets the current repository context based on flags and working repo
+// RepoEnv names the environment variable that pins the repository of a shell
+// session, overriding the working repository set by 'dsp use'
+const RepoEnv = "DSP_REPO"
+
+// GetCurrentRepo gets the current repository context based on flags, $DSP_REPO
+// and working repo. Its errors are configuration errors.
 func (m *Manager) GetCurrentRepo(repoFlag string) (*Repository, error) {
+	r, err := m.currentRepo(repoFlag)
+	if err != nil {
+		return nil, exitcode.ConfigError(err)
+	}
+	return r, nil
+}
+
+// currentRepo resolves the current repository for GetCurrentRepo
+func (m *Manager) currentRepo(repoFlag string) (*Repository, error) {
 	// If repo flag is set, use that (highest priority)
 	if repoFlag != "" {
 		return m.GetRepository(repoFlag)
 	}
 
-	// If working repo is set, use that (second priority)
+	// If the shell session pins a repository, use that (second priority)
+	if envRepo := os.Getenv(RepoEnv); envRepo != "" {
+		r, err := m.GetRepository(envRepo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", RepoEnv, err)
+		}
+		return r, nil
+	}
+
+	// If working repo is set, use that (third priority)
 	if m.WorkingRepo != "" {
 		return m.GetWorkingRepo()
 	}
 
-	// If default repo is set, use that (third priority)
+	// If default repo is set, use that (fourth priority)
 	if m.DefaultRepo != "" {
 		return m.GetDefaultRepository()
 	}
@@ -465,13 +629,14 @@ func (m *Manager) GetCurrentRepo(repoFlag string) (*Repository, error) {
 	// If we get here, we have no valid repository context
 	return nil, fmt.Errorf("no repository context available:\n" +
 		"  - No --repo flag specified\n" +
+		"  - No " + RepoEnv + " environment variable set\n" +
 		"  - No working repository set (use 'dsp use <repo>' to set one)\n" +
-		"  - No default repository set (use 'dsp repo --set-default <repo>' to set one)\n" +
+		"  - No default repository set (use 'dsp repo set-default <repo>' to set one)\n" +
 		"  - Not in a repository root directory\n" +
 		"\nTo resolve this, either:\n" +
 		"  1. Use --repo flag to specify a repository\n" +
 		"  2. Set a working repository with 'dsp use <repo>'\n" +
-		"  3. Set a default repository with 'dsp repo --set-default <repo>'\n" +
+		"  3. Set a default repository with 'dsp repo set-default <repo>'\n" +
 		"  4. Change to a repository root directory")
 }
 
@@ -515,6 +680,12 @@ func IsRepository(path string) bool {
 
 // SetWorkingRepo sets the working repository
 func (m *Manager) SetWorkingRepo(repoArg string) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// First try to find repository by name
 	for _, repo := range m.Repos {
 		if repo.Name == repoArg {
@@ -551,6 +722,12 @@ func (m *Manager) GetWorkingRepo() (*Repository, error) {
 
 // ClearWorkingRepo clears the working repository
 func (m *Manager) ClearWorkingRepo() error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	m.WorkingRepo = ""
 	return m.Save()
 }
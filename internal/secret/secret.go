@@ -0,0 +1,112 @@
+// Package secret reads passwords without requiring them on the command line,
+// where other users can see them in the process list and they end up in shell
+// history: from standard input, the environment or a hidden terminal prompt.
+package secret
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// EnvPassword is the environment variable a password is read from when it
+// is not given by a flag or on standard input
+const EnvPassword = "DSP_PASSWORD"
+
+// Redacted replaces secrets in output
+const Redacted = "[redacted]"
+
+// Options say where a password may come from
+type Options struct {
+	Flag    string // Value of --password, if given
+	Stdin   bool   // --password-stdin: read the first line of standard input
+	Prompt  string // Prompt shown when asking on the terminal
+	Confirm bool   // Ask twice when prompting, for passwords being set
+}
+
+// Password returns the password from the flag, standard input, the
+// environment or a hidden prompt, in that order. It prompts only when
+// standard input is a terminal, and returns "" if no source gave one.
+func Password(opts Options) (string, error) {
+	if opts.Flag != "" {
+		return opts.Flag, nil
+	}
+	if opts.Stdin {
+		password, err := readLine(os.Stdin)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("failed to read password from standard input: %w", err)
+		}
+		if password == "" {
+			return "", fmt.Errorf("no password on standard input")
+		}
+		return password, nil
+	}
+	if password := os.Getenv(EnvPassword); password != "" {
+		return password, nil
+	}
+	if !isTerminal(os.Stdin) {
+		return "", nil
+	}
+
+	password, err := prompt(opts.Prompt + ": ")
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return "", fmt.Errorf("empty password")
+	}
+	if opts.Confirm {
+		again, err := prompt("Confirm " + strings.ToLower(opts.Prompt[:1]) + opts.Prompt[1:] + ": ")
+		if err != nil {
+			return "", err
+		}
+		if again != password {
+			return "", fmt.Errorf("passwords do not match")
+		}
+	}
+	return password, nil
+}
+
+// prompt asks for a line on the terminal without echoing it. The prompt
+// goes to standard error, so standard output can still be redirected.
+func prompt(text string) (string, error) {
+	fmt.Fprint(os.Stderr, text)
+	password, err := readHidden(os.Stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	return password, nil
+}
+
+// readLine reads one line a byte at a time, so nothing after it is
+// consumed, and returns it without the line ending
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	var b [1]byte
+	for {
+		n, err := r.Read(b[:])
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			return strings.TrimSuffix(string(line), "\r"), err
+		}
+	}
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
+
+// Redact replaces every occurrence of the secrets in s
+func Redact(s string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, Redacted)
+		}
+	}
+	return s
+}
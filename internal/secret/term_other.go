@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+
+package secret
+
+import (
+	"fmt"
+	"os"
+)
+
+// isTerminal reports whether f is a terminal; prompts are not supported on
+// this platform, so it never is
+func isTerminal(f *os.File) bool {
+	return false
+}
+
+// readHidden is not supported on this platform
+func readHidden(f *os.File) (string, error) {
+	return "", fmt.Errorf("password prompts are not supported on this platform")
+}
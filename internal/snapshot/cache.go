@@ -0,0 +1,141 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/chunk"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// HashCacheFileName is the cache of working tree file hashes in the DSP directory
+const HashCacheFileName = "hash-cache.json"
+
+// racyWindow is how long after a file's modification time its hash is not
+// cached. A file changed again within the same timestamp tick keeps its size
+// and modification time, so a hash taken that soon could go stale unnoticed.
+const racyWindow = 2 * time.Second
+
+// cachedHash is the hash of a file with a given size and modification time
+type cachedHash struct {
+	Size    int64         `json:"size"`
+	ModTime int64         `json:"mtime"` // Unix nanoseconds
+	Hash    string        `json:"hash"`
+	Chunks  []chunk.Chunk `json:"chunks,omitempty"`
+}
+
+// HashCache holds the hashes of files by path, so a scan of the working tree
+// only hashes files whose size or modification time changed
+type HashCache struct {
+	Algorithm string                `json:"algorithm"`
+	Files     map[string]cachedHash `json:"files"`
+
+	Hashed int `json:"-"` // Files hashed by the current scan
+	Reused int `json:"-"` // Files whose cached hash was reused
+
+	started time.Time             // When the current scan started
+	seen    map[string]cachedHash // Entries of files found by the current scan
+}
+
+// LoadHashCache loads the hash cache of a DSP directory. A missing or
+// unreadable cache, or one made with another hash algorithm or hash key,
+// starts empty.
+func LoadHashCache(dspDir, algorithm string) *HashCache {
+	// Keyed hashes change with the key
+	if algorithm == utils.KeyedBlake3 {
+		algorithm += ":" + utils.HashKeyID()
+	}
+
+	cache := &HashCache{}
+	if data, err := os.ReadFile(filepath.Join(dspDir, HashCacheFileName)); err == nil {
+		json.Unmarshal(data, cache)
+	}
+	if cache.Algorithm != algorithm || cache.Files == nil {
+		cache.Algorithm = algorithm
+		cache.Files = make(map[string]cachedHash)
+	}
+	return cache
+}
+
+// Seed adds the files of a snapshot not in the cache yet
+func (c *HashCache) Seed(snap *Snapshot) {
+	for _, f := range snap.Files {
+		if _, exists := c.Files[f.Path]; exists || f.IsSymlink {
+			continue
+		}
+		// The snapshot was taken when it was started, so the same window applies
+		if !f.ModifiedTime.Before(snap.Timestamp.Add(-racyWindow)) {
+			continue
+		}
+		c.Files[f.Path] = cachedHash{Size: f.Size, ModTime: f.ModifiedTime.UnixNano(), Hash: f.Hash, Chunks: f.Chunks}
+	}
+}
+
+// reuseHash returns the cached hash of an unchanged file, if the snapshot
+// is taken with a hash cache
+func (s *Snapshot) reuseHash(path string, info os.FileInfo) (cachedHash, bool) {
+	if s.cache == nil {
+		return cachedHash{}, false
+	}
+	return s.cache.lookup(path, info)
+}
+
+// lookup returns the cached hash of a file if its size and modification time
+// are unchanged
+func (c *HashCache) lookup(path string, info os.FileInfo) (cachedHash, bool) {
+	entry, ok := c.Files[path]
+	if !ok || entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano() {
+		return cachedHash{}, false
+	}
+	c.seen[path] = entry
+	c.Reused++
+	return entry, true
+}
+
+// store records the hash of a file found by the current scan
+func (c *HashCache) store(path string, info os.FileInfo, hash string, chunks []chunk.Chunk) {
+	c.Hashed++
+	if !info.ModTime().Before(c.started.Add(-racyWindow)) {
+		return
+	}
+	c.seen[path] = cachedHash{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Hash: hash, Chunks: chunks}
+}
+
+// Save writes the entries of the files found by the current scan, dropping
+// files that are gone
+func (c *HashCache) Save(dspDir string) error {
+	c.Files = c.seen
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to marshal hash cache: %w", err)
+	}
+	if err := config.WriteFileAtomic(filepath.Join(dspDir, HashCacheFileName), data, 0644); err != nil {
+		return fmt.Errorf("failed to write hash cache: %w", err)
+	}
+	return nil
+}
+
+// ScanWorkingState returns a snapshot of the current state of the tracked
+// paths, for comparison rather than saving. Hashes are reused from the hash
+// cache, seeded from the latest snapshot, for files whose size and
+// modification time did not change; the cache is updated afterwards.
+func ScanWorkingState(ctx context.Context, dspDir string, trackedPaths []TrackedPath, user string, cfg *config.Config) (*Snapshot, *HashCache, error) {
+	cache := LoadHashCache(dspDir, cfg.HashAlgorithm)
+	if _, latest, err := LoadLatest(dspDir); err == nil {
+		cache.Seed(latest)
+	}
+
+	snap, err := createSnapshot(ctx, trackedPaths, user, "", cfg, cache)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cache.Save(dspDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	return snap, cache, nil
+}
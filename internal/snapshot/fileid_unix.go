@@ -0,0 +1,19 @@
+//go:build !windows
+
+package snapshot
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileIdentity returns the device and inode of a file, its number of hard
+// links and the bytes allocated on disk. ok is false if the platform does not
+// report them.
+func fileIdentity(info os.FileInfo) (id fileID, links uint64, allocated int64, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, 0, 0, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, uint64(stat.Nlink), int64(stat.Blocks) * 512, true
+}
@@ -0,0 +1,133 @@
+package snapshot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/internal/migrations"
+)
+
+// idTimeFormat is the timestamp part of a snapshot ID. IDs created before
+// sub-second precision use "20060102-150405" and are still accepted.
+const idTimeFormat = "20060102-150405.000000"
+
+// Entry is a snapshot stored in a DSP directory
+type Entry struct {
+	ID       string    // Directory name under snapshots/
+	Snapshot *Snapshot // Parsed snapshot.json
+}
+
+// NewID returns a new snapshot ID. IDs sort chronologically and include a
+// random suffix so snapshots taken at the same instant do not collide.
+func NewID(t time.Time) string {
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		// Fall back to the nanosecond part of the timestamp
+		return fmt.Sprintf("%s-%06d", t.Format(idTimeFormat), t.Nanosecond()%1000000)
+	}
+	return fmt.Sprintf("%s-%s", t.Format(idTimeFormat), hex.EncodeToString(suffix))
+}
+
+// Dir returns the directory for a snapshot ID
+func Dir(dspDir, id string) string {
+	return filepath.Join(dspDir, "snapshots", id)
+}
+
+// FilePath returns the path of snapshot.json for a snapshot ID
+func FilePath(dspDir, id string) string {
+	return filepath.Join(Dir(dspDir, id), "snapshot.json")
+}
+
+// List returns all readable snapshots in a DSP directory, oldest first
+func List(dspDir string) ([]Entry, error) {
+	snapshotsDir := filepath.Join(dspDir, "snapshots")
+	dirEntries, err := os.ReadDir(snapshotsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshots directory: %w", err)
+	}
+
+	var entries []Entry
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() {
+			continue
+		}
+		snap, err := Load(FilePath(dspDir, dirEntry.Name()))
+		if errors.Is(err, migrations.ErrNewerFormat) {
+			// Skipping it would silently work from an older history
+			return nil, err
+		}
+		if err != nil {
+			continue // Skip invalid snapshots
+		}
+		entries = append(entries, Entry{ID: dirEntry.Name(), Snapshot: snap})
+	}
+
+	// Order by recorded timestamp, then by ID for snapshots taken at the same time
+	sort.SliceStable(entries, func(i, j int) bool {
+		ti, tj := entries[i].Snapshot.Timestamp, entries[j].Snapshot.Timestamp
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+
+	return entries, nil
+}
+
+// Resolve finds the snapshot ID matching ref, which may be a full ID or a
+// unique prefix of one
+func Resolve(dspDir, ref string) (string, error) {
+	if ref == "" {
+		return "", fmt.Errorf("no snapshot ID given")
+	}
+
+	// Exact match
+	if _, err := os.Stat(FilePath(dspDir, ref)); err == nil {
+		return ref, nil
+	}
+
+	// Prefix match
+	dirEntries, err := os.ReadDir(filepath.Join(dspDir, "snapshots"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read snapshots directory: %w", err)
+	}
+
+	var matches []string
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() && strings.HasPrefix(dirEntry.Name(), ref) {
+			if _, err := os.Stat(FilePath(dspDir, dirEntry.Name())); err == nil {
+				matches = append(matches, dirEntry.Name())
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("snapshot not found: %s", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		sort.Strings(matches)
+		return "", fmt.Errorf("snapshot ID '%s' is ambiguous, it matches: %s", ref, strings.Join(matches, ", "))
+	}
+}
+
+// LoadByID loads a snapshot by full ID or unique prefix and returns its full ID
+func LoadByID(dspDir, ref string) (string, *Snapshot, error) {
+	id, err := Resolve(dspDir, ref)
+	if err != nil {
+		return "", nil, err
+	}
+	snap, err := Load(FilePath(dspDir, id))
+	if err != nil {
+		return "", nil, err
+	}
+	return id, snap, nil
+}
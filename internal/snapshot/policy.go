@@ -0,0 +1,92 @@
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// Reasons the size and type policy leaves a file out of a snapshot
+const (
+	SkipTooLarge  = "larger than max_file_size"
+	SkipBinary    = "binary file (skip_binary)"
+	SkipExtension = "extension not in only_extensions"
+)
+
+// SkippedFile is a file the size and type policy left out of a snapshot
+type SkippedFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+}
+
+// binarySample is how much of a file is read to tell binary from text
+const binarySample = 8000
+
+// skipReason returns why the policy in cfg leaves a regular file out of a
+// snapshot, or "" to keep it
+func skipReason(path string, info os.FileInfo, cfg *config.Config) (string, error) {
+	if max := cfg.GetMaxFileSize(); max > 0 && info.Size() > max {
+		return SkipTooLarge, nil
+	}
+	if len(cfg.OnlyExtensions) > 0 && !hasExtension(path, cfg.OnlyExtensions) {
+		return SkipExtension, nil
+	}
+	if cfg.SkipBinary {
+		binary, err := isBinaryFile(path)
+		if err != nil {
+			return "", err
+		}
+		if binary {
+			return SkipBinary, nil
+		}
+	}
+	return "", nil
+}
+
+// hasExtension reports whether a path ends in one of the extensions, given
+// with or without the dot and compared case-insensitively
+func hasExtension(path string, extensions []string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range extensions {
+		if ext == "."+strings.ToLower(strings.TrimPrefix(e, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBinaryFile reports whether the start of a file looks binary
+func isBinaryFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	sample := make([]byte, binarySample)
+	n, err := io.ReadFull(file, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, fmt.Errorf("failed to read file: %w", err)
+	}
+	sample = sample[:n]
+
+	// Drop a character cut off by the end of the sample
+	if n == binarySample {
+		for i := 1; i < utf8.UTFMax && i <= n; i++ {
+			if utf8.RuneStart(sample[n-i]) {
+				if !utf8.FullRune(sample[n-i:]) {
+					sample = sample[:n-i]
+				}
+				break
+			}
+		}
+	}
+	return utils.IsBinary(sample), nil
+}
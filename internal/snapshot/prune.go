@@ -0,0 +1,27 @@
+package snapshot
+
+import (
+	"fmt"
+	"os"
+)
+
+// Prune removes all but the newest keep snapshots and returns the IDs it
+// removed, oldest first. A keep of 0 or less removes nothing.
+func Prune(dspDir string, keep int) ([]string, error) {
+	if keep <= 0 {
+		return nil, nil
+	}
+	entries, err := List(dspDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for i := 0; i < len(entries)-keep; i++ {
+		if err := os.RemoveAll(Dir(dspDir, entries[i].ID)); err != nil {
+			return removed, fmt.Errorf("failed to remove snapshot %s: %w", entries[i].ID, err)
+		}
+		removed = append(removed, entries[i].ID)
+	}
+	return removed, nil
+}
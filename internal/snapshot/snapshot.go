@@ -1,33 +1,74 @@
 package snapshot
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/Mattddixo/dsp/config"
+	"github.com/Mattddixo/dsp/internal/chunk"
+	"github.com/Mattddixo/dsp/internal/migrations"
 	"github.com/Mattddixo/dsp/pkg/utils"
 )
 
+// FormatVersion is the current snapshot file format. Older snapshots are
+// upgraded when loaded; newer ones are refused rather than misread.
+const FormatVersion = migrations.SnapshotVersion
+
 // Snapshot represents a snapshot of tracked files
 type Snapshot struct {
-	ID        string    `json:"id"`
-	Timestamp time.Time `json:"timestamp"`
-	Files     []File    `json:"files"`
-	User      string    `json:"user"`
-	Message   string    `json:"message"`
-	Stats     Stats     `json:"stats"`
+	// File format version (0 for snapshots written before versioning)
+	Format int `json:"format_version,omitempty"`
+
+	ID        string      `json:"id"`
+	Timestamp time.Time   `json:"timestamp"`
+	Files     []File      `json:"files"`
+	Dirs      []Directory `json:"dirs"` // nil for snapshots taken before directories were recorded
+	User      string      `json:"user"`
+	Message   string      `json:"message"`
+	Stats     Stats       `json:"stats"`
+
+	// Files in tracked directories left out by the size and type policy
+	Skipped []SkippedFile `json:"skipped,omitempty"`
+
+	// Algorithm of the files' PreviousHash, in a snapshot made by
+	// 'dsp migrate-hash'
+	PreviousHashAlgorithm string `json:"previous_hash_algorithm,omitempty"`
+
+	// Merkle digest of each directory by path, and of the whole snapshot
+	// under "". Missing in snapshots taken before they were recorded.
+	Tree map[string]string `json:"tree,omitempty"`
+
+	// First path seen for each hard-linked file while the snapshot is taken
+	hardlinks map[fileID]string
+
+	// Hashes to reuse for unchanged files, when scanning the working state
+	cache *HashCache
+}
+
+// fileID identifies a file on disk, shared by all its hard links
+type fileID struct {
+	dev uint64
+	ino uint64
 }
 
 // Stats represents statistics about the snapshot
 type Stats struct {
 	TotalFiles     int   `json:"total_files"`
 	TotalSize      int64 `json:"total_size"`
+	TotalDirs      int   `json:"total_dirs"`
 	SymlinkCount   int   `json:"symlink_count"`
+	HardlinkCount  int   `json:"hardlink_count"`
+	SparseFiles    int   `json:"sparse_files"`
 	RegularFiles   int   `json:"regular_files"`
 	ExcludedFiles  int   `json:"excluded_files"`
+	SkippedFiles   int   `json:"skipped_files,omitempty"`
+	SkippedSize    int64 `json:"skipped_size,omitempty"`
 	ProcessingTime int64 `json:"processing_time_ms"`
 }
 
@@ -40,24 +81,70 @@ type File struct {
 	IsSymlink     bool      `json:"is_symlink"`
 	SymlinkTarget string    `json:"symlink_target,omitempty"`
 	ChangeType    string    `json:"change_type,omitempty"` // "added", "modified", "unchanged"
+	LinkTo        string    `json:"link_to,omitempty"`     // Earlier path this file is a hard link of
+	Sparse        bool      `json:"sparse,omitempty"`      // Fewer bytes allocated on disk than the file size
+
+	// Content-defined chunks of files of at least chunk.Threshold bytes
+	Chunks []chunk.Chunk `json:"chunks,omitempty"`
+
+	// Hash under the previous hash algorithm, in a snapshot made by
+	// 'dsp migrate-hash', so it still compares with older snapshots
+	PreviousHash string `json:"previous_hash,omitempty"`
 }
 
-// CreateSnapshot creates a new snapshot of tracked files
-func CreateSnapshot(trackedPaths []TrackedPath, user, message string, cfg *config.Config) (*Snapshot, error) {
+// SameContent reports whether two versions of a file have the same content,
+// also across a hash migration
+func SameContent(a, b File) bool {
+	return a.Hash == b.Hash ||
+		(a.PreviousHash != "" && a.PreviousHash == b.Hash) ||
+		(b.PreviousHash != "" && b.PreviousHash == a.Hash)
+}
+
+// Directory represents a directory below a tracked path. Directories are
+// recorded so that empty ones survive a sync and removed ones are removed on
+// apply.
+type Directory struct {
+	Path string      `json:"path"`
+	Mode os.FileMode `json:"mode"` // Permission bits
+}
+
+// RecordsDirs reports whether the snapshot records directories
+func (s *Snapshot) RecordsDirs() bool {
+	return s.Dirs != nil
+}
+
+// CreateSnapshot creates a new snapshot of tracked files. It stops with the
+// context's error if ctx is cancelled.
+func CreateSnapshot(ctx context.Context, trackedPaths []TrackedPath, user, message string, cfg *config.Config) (*Snapshot, error) {
+	return createSnapshot(ctx, trackedPaths, user, message, cfg, nil)
+}
+
+// createSnapshot creates a snapshot, reusing hashes from cache if it is not nil
+func createSnapshot(ctx context.Context, trackedPaths []TrackedPath, user, message string, cfg *config.Config, cache *HashCache) (*Snapshot, error) {
 	startTime := time.Now()
+	if cache != nil {
+		cache.started = startTime
+		cache.seen = make(map[string]cachedHash)
+	}
 
 	snapshot := &Snapshot{
-		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
-		Timestamp: time.Now(),
+		ID:        NewID(startTime),
+		Timestamp: startTime,
 		User:      user,
 		Message:   message,
 		Files:     make([]File, 0),
+		Dirs:      make([]Directory, 0),
 		Stats:     Stats{},
+		hardlinks: make(map[fileID]string),
+		cache:     cache,
 	}
 
 	// Process each tracked path
 	for _, path := range trackedPaths {
-		if err := processPath(path, snapshot, cfg); err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := processPath(ctx, path, snapshot, cfg); err != nil {
 			return nil, fmt.Errorf("failed to process path %s: %w", path.Path, err)
 		}
 	}
@@ -69,9 +156,9 @@ func CreateSnapshot(trackedPaths []TrackedPath, user, message string, cfg *confi
 }
 
 // processPath processes a path and adds its files to the snapshot
-func processPath(path TrackedPath, snapshot *Snapshot, cfg *config.Config) error {
-	// Check if path exists
-	info, err := os.Stat(path.Path)
+func processPath(ctx context.Context, path TrackedPath, snapshot *Snapshot, cfg *config.Config) error {
+	// Check if path exists, without following a symlink
+	info, err := os.Lstat(path.Path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Skip non-existent paths
@@ -79,54 +166,41 @@ func processPath(path TrackedPath, snapshot *Snapshot, cfg *config.Config) error
 		}
 		return fmt.Errorf("failed to stat path: %w", err)
 	}
+	info = followSymlink(path.Path, info, cfg)
 
 	if !info.IsDir() {
 		// Process single file
-		hash, err := utils.HashFile(path.Path, cfg.HashAlgorithm)
-		if err != nil {
-			return fmt.Errorf("failed to hash file: %w", err)
-		}
-
-		// Get symlink info if it's a symlink
-		var isSymlink bool
-		var symlinkTarget string
-		if info.Mode()&os.ModeSymlink != 0 {
-			isSymlink = true
-			symlinkTarget, err = os.Readlink(path.Path)
-			if err != nil {
-				return fmt.Errorf("failed to read symlink: %w", err)
-			}
-		}
+		return addFile(snapshot, path.Path, info, cfg)
+	}
 
-		// Add file to snapshot
-		snapshot.Files = append(snapshot.Files, File{
-			Path:          path.Path,
-			Hash:          hash,
-			Size:          info.Size(),
-			ModifiedTime:  info.ModTime(),
-			IsSymlink:     isSymlink,
-			SymlinkTarget: symlinkTarget,
-		})
+	// Process directory
+	return walkDir(ctx, path, path.Path, snapshot, cfg, make(map[string]bool))
+}
 
-		// Update stats
-		snapshot.Stats.TotalFiles++
-		snapshot.Stats.TotalSize += info.Size()
-		if isSymlink {
-			snapshot.Stats.SymlinkCount++
-		} else {
-			snapshot.Stats.RegularFiles++
+// walkDir adds the directories and files below dir to the snapshot. When
+// symlinks are followed, linked directories are walked as well; visited holds
+// the real paths already walked so link cycles end.
+func walkDir(ctx context.Context, path TrackedPath, dir string, snapshot *Snapshot, cfg *config.Config, visited map[string]bool) error {
+	dir = filepath.Clean(dir)
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		if visited[real] {
+			return nil
 		}
-		return nil
+		visited[real] = true
 	}
 
-	// Process directory
-	return filepath.Walk(path.Path, func(filePath string, info os.FileInfo, err error) error {
+	// The trailing separator makes Walk descend into dir if it is a symlink
+	return filepath.Walk(dir+string(filepath.Separator), func(filePath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		filePath = filepath.Clean(filePath)
 
 		// Skip the root directory itself
-		if filePath == path.Path {
+		if filePath == dir {
 			return nil
 		}
 
@@ -151,53 +225,153 @@ func processPath(path TrackedPath, snapshot *Snapshot, cfg *config.Config) error
 			}
 		}
 
-		// Skip if it's a directory (we'll process its contents)
+		// Follow symlinks if configured
+		isLink := info.Mode()&os.ModeSymlink != 0
+		info = followSymlink(filePath, info, cfg)
+
+		// Record the directory; its contents are processed as the walk continues
 		if info.IsDir() {
+			snapshot.Dirs = append(snapshot.Dirs, Directory{Path: filePath, Mode: info.Mode().Perm()})
+			snapshot.Stats.TotalDirs++
+			if isLink {
+				return walkDir(ctx, path, filePath, snapshot, cfg, visited)
+			}
 			return nil
 		}
 
-		// Process file using repository's hash algorithm
-		hash, err := utils.HashFile(filePath, cfg.HashAlgorithm)
-		if err != nil {
-			return fmt.Errorf("failed to hash file: %w", err)
-		}
-
-		// Get symlink info if it's a symlink
-		var isSymlink bool
-		var symlinkTarget string
-		if info.Mode()&os.ModeSymlink != 0 {
-			isSymlink = true
-			symlinkTarget, err = os.Readlink(filePath)
+		// Leave out files the size and type policy rejects
+		if info.Mode().IsRegular() {
+			reason, err := skipReason(filePath, info, cfg)
 			if err != nil {
-				return fmt.Errorf("failed to read symlink: %w", err)
+				return err
+			}
+			if reason != "" {
+				snapshot.Skipped = append(snapshot.Skipped, SkippedFile{Path: filePath, Size: info.Size(), Reason: reason})
+				snapshot.Stats.SkippedFiles++
+				snapshot.Stats.SkippedSize += info.Size()
+				return nil
 			}
 		}
 
-		// Add file to snapshot
-		snapshot.Files = append(snapshot.Files, File{
-			Path:          filePath,
-			Hash:          hash,
-			Size:          info.Size(),
-			ModifiedTime:  info.ModTime(),
-			IsSymlink:     isSymlink,
-			SymlinkTarget: symlinkTarget,
-		})
+		return addFile(snapshot, filePath, info, cfg)
+	})
+}
 
-		// Update stats
-		snapshot.Stats.TotalFiles++
-		snapshot.Stats.TotalSize += info.Size()
-		if isSymlink {
-			snapshot.Stats.SymlinkCount++
-		} else {
-			snapshot.Stats.RegularFiles++
+// followSymlink returns the file info of what a symlink points to if the
+// configuration follows symlinks. Other paths, and links whose target is
+// missing, keep their own info and are recorded as they are.
+func followSymlink(path string, info os.FileInfo, cfg *config.Config) os.FileInfo {
+	if info.Mode()&os.ModeSymlink == 0 || !cfg.FollowSymlinks {
+		return info
+	}
+	if target, err := os.Stat(path); err == nil {
+		return target
+	}
+	return info
+}
+
+// addFile adds a file or symlink to the snapshot. Symlinks are hashed by
+// their target, not the content they point to.
+func addFile(snapshot *Snapshot, filePath string, info os.FileInfo, cfg *config.Config) error {
+	// Get symlink info if it's a symlink
+	var isSymlink bool
+	var symlinkTarget string
+	var hash string
+	var chunks []chunk.Chunk
+	var reused bool
+	var err error
+	if info.Mode()&os.ModeSymlink != 0 {
+		isSymlink = true
+		symlinkTarget, err = os.Readlink(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink: %w", err)
+		}
+		hash, err = utils.HashReader(strings.NewReader(symlinkTarget), cfg.HashAlgorithm)
+	} else if cached, ok := snapshot.reuseHash(filePath, info); ok {
+		// Reuse the hash of an unchanged file
+		hash, chunks = cached.Hash, cached.Chunks
+		reused = true
+	} else if info.Size() >= chunk.Threshold {
+		// Split large files into chunks while hashing them
+		hash, chunks, err = hashChunks(filePath, cfg.HashAlgorithm)
+	} else {
+		// Process file using repository's hash algorithm
+		hash, err = utils.HashFile(filePath, cfg.HashAlgorithm)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to hash file: %w", err)
+	}
+	if snapshot.cache != nil && !isSymlink && !reused {
+		snapshot.cache.store(filePath, info, hash, chunks)
+	}
+
+	// Detect hard links and sparse files
+	var linkTo string
+	var sparse bool
+	if id, links, allocated, ok := fileIdentity(info); ok && !isSymlink {
+		sparse = allocated < info.Size()
+		if links > 1 {
+			if first, seen := snapshot.hardlinks[id]; seen {
+				linkTo = first
+			} else {
+				snapshot.hardlinks[id] = filePath
+			}
 		}
+	}
 
-		return nil
+	// Add file to snapshot
+	snapshot.Files = append(snapshot.Files, File{
+		Path:          filePath,
+		Hash:          hash,
+		Size:          info.Size(),
+		ModifiedTime:  info.ModTime(),
+		IsSymlink:     isSymlink,
+		SymlinkTarget: symlinkTarget,
+		LinkTo:        linkTo,
+		Sparse:        sparse,
+		Chunks:        chunks,
 	})
+
+	// Update stats
+	snapshot.Stats.TotalFiles++
+	snapshot.Stats.TotalSize += info.Size()
+	if isSymlink {
+		snapshot.Stats.SymlinkCount++
+	} else {
+		snapshot.Stats.RegularFiles++
+	}
+	if linkTo != "" {
+		snapshot.Stats.HardlinkCount++
+	}
+	if sparse {
+		snapshot.Stats.SparseFiles++
+	}
+	return nil
+}
+
+// hashChunks hashes a file and splits it into chunks in a single read
+func hashChunks(path, algorithm string) (string, []chunk.Chunk, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	hasher, err := utils.GetHasher(algorithm)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create hasher: %w", err)
+	}
+	chunks, err := chunk.Split(io.TeeReader(file, hasher), algorithm, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), chunks, nil
 }
 
-// Save saves the snapshot to a file
+// Save saves the snapshot to a file, recording its directory digests
 func (s *Snapshot) Save(path string) error {
+	s.BuildTree()
+	s.Format = FormatVersion
 	data, err := json.MarshalIndent(s, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal snapshot: %w", err)
@@ -217,10 +391,63 @@ func Load(path string) (*Snapshot, error) {
 		return nil, fmt.Errorf("failed to read snapshot file: %w", err)
 	}
 
+	name := filepath.Base(filepath.Dir(path))
 	var snapshot Snapshot
 	if err := json.Unmarshal(data, &snapshot); err != nil {
+		// A newer format may not parse as this one
+		if err := migrations.Snapshot.Check(migrations.Snapshot.Version(data), name); err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("failed to unmarshal snapshot: %w", err)
 	}
+	upgraded, changed, err := migrations.Snapshot.Upgrade(snapshot.Format, data, name)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		snapshot = Snapshot{}
+		if err := json.Unmarshal(upgraded, &snapshot); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal upgraded snapshot: %w", err)
+		}
+	}
 
 	return &snapshot, nil
 }
+
+// LoadLatest loads the most recent snapshot in a DSP directory and returns its ID
+func LoadLatest(dspDir string) (string, *Snapshot, error) {
+	entries, err := List(dspDir)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(entries) == 0 {
+		return "", nil, fmt.Errorf("no snapshots found")
+	}
+
+	latest := entries[len(entries)-1]
+	return latest.ID, latest.Snapshot, nil
+}
+
+// RebasePaths rewrites file and directory paths under oldRoot so they point
+// to the same relative location under newRoot. Returns the number of
+// rewritten files.
+func (s *Snapshot) RebasePaths(oldRoot, newRoot string) int {
+	rebased := 0
+	for i, f := range s.Files {
+		relPath, err := filepath.Rel(oldRoot, f.Path)
+		if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			continue
+		}
+		s.Files[i].Path = filepath.Join(newRoot, relPath)
+		rebased++
+	}
+	for i, d := range s.Dirs {
+		relPath, err := filepath.Rel(oldRoot, d.Path)
+		if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			continue
+		}
+		s.Dirs[i].Path = filepath.Join(newRoot, relPath)
+	}
+	s.Tree = nil
+	return rebased
+}
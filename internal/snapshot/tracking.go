@@ -7,6 +7,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Mattddixo/dsp/internal/migrations"
+	"github.com/Mattddixo/dsp/pkg/utils"
 	"gopkg.in/yaml.v3"
 )
 
@@ -41,18 +43,30 @@ type Change struct {
 	Details   string    `yaml:"details,omitempty"`
 }
 
-// RepositoryState represents the current state of a repository
+// RepositoryState represents the current state of a repository. The details
+// of the last close are kept after the repository is reopened.
 type RepositoryState struct {
-	IsClosed     bool      `yaml:"is_closed"`               // Whether the repository is closed
-	ClosedAt     time.Time `yaml:"closed_at,omitempty"`     // When the repository was closed
-	ClosedBy     string    `yaml:"closed_by,omitempty"`     // Who closed the repository
-	LastModified time.Time `yaml:"last_modified,omitempty"` // Last modification time
+	IsClosed      bool      `yaml:"is_closed"`                // Whether the repository is closed
+	ClosedAt      time.Time `yaml:"closed_at,omitempty"`      // When the repository was closed
+	ClosedBy      string    `yaml:"closed_by,omitempty"`      // Who closed the repository
+	CloseReason   string    `yaml:"close_reason,omitempty"`   // Why the repository was closed
+	FinalSnapshot string    `yaml:"final_snapshot,omitempty"` // Snapshot taken when closing
+	FinalBundle   string    `yaml:"final_bundle,omitempty"`   // Archive bundle written when closing
+	ReopenedAt    time.Time `yaml:"reopened_at,omitempty"`    // When the repository was last reopened
+	ReopenedBy    string    `yaml:"reopened_by,omitempty"`    // Who last reopened the repository
+	LastModified  time.Time `yaml:"last_modified,omitempty"`  // Last modification time
 }
 
 // TrackingConfig holds the configuration for tracked paths
 type TrackingConfig struct {
+	FormatVersion int `yaml:"format_version"` // Format of tracking.yaml
+
 	State RepositoryState `yaml:"state"` // Repository state information
 	Paths []TrackedPath   `yaml:"paths"`
+
+	// Names in the repository root that auto-track has already considered,
+	// so paths untracked since are not added again
+	AutoTracked []string `yaml:"auto_tracked,omitempty"`
 }
 
 // LoadTrackingConfig loads the tracking configuration from the DSP directory
@@ -71,8 +85,21 @@ func LoadTrackingConfig(dspDir string) (*TrackingConfig, error) {
 
 	var config TrackingConfig
 	if err := yaml.Unmarshal(data, &config); err != nil {
+		if err := migrations.Tracking.Check(migrations.Tracking.Version(data), configPath); err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("failed to parse tracking config: %w", err)
 	}
+	upgraded, changed, err := migrations.Tracking.Upgrade(config.FormatVersion, data, configPath)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		config = TrackingConfig{}
+		if err := yaml.Unmarshal(upgraded, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse upgraded tracking config: %w", err)
+		}
+	}
 
 	return &config, nil
 }
@@ -92,6 +119,7 @@ func SaveTrackingConfig(dspDir string, config *TrackingConfig) error {
 	}
 
 	// Convert to YAML
+	config.FormatVersion = migrations.TrackingVersion
 	data, err := yaml.Marshal(config)
 	if err != nil {
 		return fmt.Errorf("failed to marshal tracking config: %w", err)
@@ -194,11 +222,15 @@ func AddChange(config *TrackingConfig, path string, changeType string, username
 }
 
 // CloseRepository marks a repository as closed
-func CloseRepository(config *TrackingConfig, username string) error {
+func CloseRepository(config *TrackingConfig, username, reason string) error {
+	if config.State.IsClosed {
+		return fmt.Errorf("repository is already closed")
+	}
 	config.State = RepositoryState{
 		IsClosed:     true,
 		ClosedAt:     time.Now(),
 		ClosedBy:     username,
+		CloseReason:  reason,
 		LastModified: time.Now(),
 	}
 	return nil
@@ -211,10 +243,10 @@ func ReopenRepository(config *TrackingConfig, username string) error {
 	}
 
 	// Keep the closed history but mark as reopened
-	config.State = RepositoryState{
-		IsClosed:     false,
-		LastModified: time.Now(),
-	}
+	config.State.IsClosed = false
+	config.State.ReopenedAt = time.Now()
+	config.State.ReopenedBy = username
+	config.State.LastModified = time.Now()
 	return nil
 }
 
@@ -336,6 +368,22 @@ func AddExcludePatterns(config *TrackingConfig, paths []string, patterns []strin
 	return nil
 }
 
+// RebaseTrackedPaths rewrites tracked paths that live under oldRoot so they
+// point to the same relative location under newRoot. Paths outside oldRoot
+// are left untouched. Returns the number of rewritten paths.
+func RebaseTrackedPaths(config *TrackingConfig, oldRoot, newRoot string) int {
+	rebased := 0
+	for i, p := range config.Paths {
+		relPath, err := filepath.Rel(oldRoot, p.Path)
+		if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			continue
+		}
+		config.Paths[i].Path = filepath.Join(newRoot, relPath)
+		rebased++
+	}
+	return rebased
+}
+
 // IsPathInRepository checks if a path is within the repository root
 func IsPathInRepository(path, repoRoot string) (bool, error) {
 	// Convert both paths to absolute
@@ -348,12 +396,85 @@ func IsPathInRepository(path, repoRoot string) (bool, error) {
 		return false, fmt.Errorf("failed to get absolute repository root: %w", err)
 	}
 
-	// Check if path is within repository
-	relPath, err := filepath.Rel(absRepoRoot, absPath)
+	return utils.Within(absPath, absRepoRoot), nil
+}
+
+// AutoTrack adds the entries of the repository root that auto-track has not
+// considered yet and that match one of the include patterns, as matched by
+// filepath.Match against the entry name. Without patterns every entry not
+// starting with a dot matches. The skip paths, such as the DSP directory,
+// and entries that are tracked, inside a tracked path or hold one are left
+// out. It returns the paths added and whether the configuration changed.
+func AutoTrack(config *TrackingConfig, repoRoot string, include []string, skip ...string) ([]TrackedPath, bool, error) {
+	entries, err := os.ReadDir(repoRoot)
 	if err != nil {
-		return false, fmt.Errorf("failed to get relative path: %w", err)
+		return nil, false, fmt.Errorf("failed to read repository root: %w", err)
+	}
+
+	considered := make(map[string]bool, len(config.AutoTracked))
+	for _, name := range config.AutoTracked {
+		considered[name] = true
 	}
 
-	// If path starts with "..", it's outside the repository
-	return !strings.HasPrefix(relPath, ".."), nil
+	var added []TrackedPath
+	changed := false
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(repoRoot, name)
+		if considered[name] || !autoTrackMatch(name, include) || isAnyOf(path, skip) {
+			continue
+		}
+		considered[name] = true
+		config.AutoTracked = append(config.AutoTracked, name)
+		changed = true
+
+		if overlapsTracked(config, path) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		tracked := TrackedPath{Path: path, IsDir: info.IsDir()}
+		if err := AddTrackedPathWithExcludes(config, tracked); err != nil {
+			return added, changed, fmt.Errorf("failed to track %s: %w", path, err)
+		}
+		added = append(added, tracked)
+	}
+	return added, changed, nil
+}
+
+// autoTrackMatch reports whether a root entry name matches the auto-track
+// include patterns
+func autoTrackMatch(name string, include []string) bool {
+	if len(include) == 0 {
+		return !strings.HasPrefix(name, ".")
+	}
+	for _, pattern := range include {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isAnyOf reports whether path is one of paths
+func isAnyOf(path string, paths []string) bool {
+	for _, p := range paths {
+		if filepath.Clean(p) == path {
+			return true
+		}
+	}
+	return false
+}
+
+// overlapsTracked reports whether path is tracked, inside a tracked path or
+// holds one
+func overlapsTracked(config *TrackingConfig, path string) bool {
+	for _, tracked := range config.Paths {
+		if utils.Within(path, tracked.Path) || utils.Within(tracked.Path, path) {
+			return true
+		}
+	}
+	return false
 }
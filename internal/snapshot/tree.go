@@ -0,0 +1,276 @@
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// Kinds of entries in a directory listing
+const (
+	FileEntry = "file"
+	DirEntry  = "dir"
+)
+
+// TreeEntry is an entry in the listing of a directory. A directory's digest
+// is the SHA-256 of its sorted listing, so equal digests mean equal contents
+// all the way down.
+type TreeEntry struct {
+	Kind   string `json:"kind"`   // FileEntry or DirEntry
+	Name   string `json:"name"`   // Base name; the full path for filesystem roots
+	Digest string `json:"digest"` // Content hash of a file, digest of a directory
+}
+
+// Proof shows that a file with a given hash is part of a snapshot, by the
+// listings of each directory from the file's up to the top of the tree. It
+// can be checked against the snapshot's root digest without the snapshot.
+type Proof struct {
+	Path     string        `json:"path"`
+	Hash     string        `json:"hash"`
+	Listings [][]TreeEntry `json:"listings"`
+}
+
+// FileChange is a file that differs between two snapshots. Old is nil for
+// added files and New is nil for deleted ones.
+type FileChange struct {
+	Old *File
+	New *File
+}
+
+// Path returns the path of the changed file
+func (c FileChange) Path() string {
+	if c.New != nil {
+		return c.New.Path
+	}
+	return c.Old.Path
+}
+
+// BuildTree computes the digest of every directory holding tracked files or
+// directories, up to the filesystem roots. The digests are kept under their
+// directory's path in Tree; the root digest covering the whole snapshot is
+// kept under "".
+func (s *Snapshot) BuildTree() {
+	digests, _ := s.listings()
+	s.Tree = digests
+}
+
+// Root returns the digest of the whole snapshot
+func (s *Snapshot) Root() string {
+	return s.tree()[""]
+}
+
+// tree returns the directory digests, computing them for snapshots taken
+// before they were recorded
+func (s *Snapshot) tree() map[string]string {
+	if s.Tree == nil {
+		s.BuildTree()
+	}
+	return s.Tree
+}
+
+// listings returns the digest and the sorted listing of every directory
+func (s *Snapshot) listings() (map[string]string, map[string][]TreeEntry) {
+	listings := make(map[string][]TreeEntry)
+	for _, f := range s.Files {
+		dir := parentDir(f.Path)
+		listings[dir] = append(listings[dir], TreeEntry{Kind: FileEntry, Name: entryName(f.Path), Digest: f.Hash})
+	}
+	for _, d := range s.Dirs {
+		if _, ok := listings[d.Path]; !ok {
+			listings[d.Path] = nil
+		}
+	}
+
+	// Add the missing ancestors and order the directories deepest first, so
+	// each digest is known before its parent's listing is hashed
+	depths := make(map[string]int, len(listings))
+	var depth func(dir string) int
+	depth = func(dir string) int {
+		if dir == "" {
+			return 0
+		}
+		if d, ok := depths[dir]; ok {
+			return d
+		}
+		d := depth(parentDir(dir)) + 1
+		depths[dir] = d
+		return d
+	}
+	dirs := make([]string, 0, len(listings))
+	for dir := range listings {
+		depth(dir)
+	}
+	for dir := range depths {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return depths[dirs[i]] > depths[dirs[j]] })
+
+	digests := make(map[string]string, len(dirs)+1)
+	for _, dir := range dirs {
+		digest := listingDigest(listings[dir])
+		digests[dir] = digest
+		parent := parentDir(dir)
+		listings[parent] = append(listings[parent], TreeEntry{Kind: DirEntry, Name: entryName(dir), Digest: digest})
+	}
+	digests[""] = listingDigest(listings[""])
+	return digests, listings
+}
+
+// listingDigest sorts a directory listing and returns its digest
+func listingDigest(listing []TreeEntry) string {
+	sort.Slice(listing, func(i, j int) bool {
+		if listing[i].Name != listing[j].Name {
+			return listing[i].Name < listing[j].Name
+		}
+		return listing[i].Kind < listing[j].Kind
+	})
+	hasher := sha256.New()
+	for _, e := range listing {
+		fmt.Fprintf(hasher, "%s\x00%s\x00%s\n", e.Kind, e.Name, e.Digest)
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// parentDir returns the directory holding path in the tree. Filesystem roots
+// are held by the top of the tree, "".
+func parentDir(path string) string {
+	dir := filepath.Dir(path)
+	if dir == path {
+		return ""
+	}
+	return dir
+}
+
+// entryName returns the name of path in its parent's listing
+func entryName(path string) string {
+	if parentDir(path) == "" {
+		return path
+	}
+	return filepath.Base(path)
+}
+
+// Compare lists the files added, modified and deleted from old to new,
+// sorted by path. Directories whose digests are equal in both snapshots are
+// skipped without looking at their files. A nil old snapshot lists every
+// file as added.
+func Compare(old, new *Snapshot) []FileChange {
+	if old == nil {
+		old = &Snapshot{}
+	}
+	oldFiles, oldDirs := old.index()
+	newFiles, newDirs := new.index()
+	oldTree, newTree := old.tree(), new.tree()
+
+	var changes []FileChange
+	var walk func(dir string)
+	walk = func(dir string) {
+		if digest, ok := oldTree[dir]; ok && digest == newTree[dir] {
+			return
+		}
+
+		previous := make(map[string]*File, len(oldFiles[dir]))
+		for _, f := range oldFiles[dir] {
+			previous[f.Path] = f
+		}
+		for _, f := range newFiles[dir] {
+			if p, ok := previous[f.Path]; !ok {
+				changes = append(changes, FileChange{New: f})
+			} else if !SameContent(*p, *f) {
+				changes = append(changes, FileChange{Old: p, New: f})
+			}
+			delete(previous, f.Path)
+		}
+		for _, f := range previous {
+			changes = append(changes, FileChange{Old: f})
+		}
+
+		seen := make(map[string]bool)
+		for _, subdirs := range [][]string{oldDirs[dir], newDirs[dir]} {
+			for _, sub := range subdirs {
+				if !seen[sub] {
+					seen[sub] = true
+					walk(sub)
+				}
+			}
+		}
+	}
+	walk("")
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path() < changes[j].Path() })
+	return changes
+}
+
+// index returns the files and subdirectories of each directory in the tree
+func (s *Snapshot) index() (map[string][]*File, map[string][]string) {
+	files := make(map[string][]*File)
+	for i := range s.Files {
+		dir := parentDir(s.Files[i].Path)
+		files[dir] = append(files[dir], &s.Files[i])
+	}
+	dirs := make(map[string][]string)
+	for dir := range s.tree() {
+		if dir != "" {
+			parent := parentDir(dir)
+			dirs[parent] = append(dirs[parent], dir)
+		}
+	}
+	return files, dirs
+}
+
+// Prove returns a proof that the file at path is part of the snapshot
+func (s *Snapshot) Prove(path string) (*Proof, error) {
+	var file *File
+	for i := range s.Files {
+		if s.Files[i].Path == path {
+			file = &s.Files[i]
+			break
+		}
+	}
+	if file == nil {
+		return nil, fmt.Errorf("file %s is not in snapshot %s", path, s.ID)
+	}
+
+	_, listings := s.listings()
+	proof := &Proof{Path: file.Path, Hash: file.Hash}
+	for dir := parentDir(path); ; dir = parentDir(dir) {
+		proof.Listings = append(proof.Listings, listings[dir])
+		if dir == "" {
+			break
+		}
+	}
+	return proof, nil
+}
+
+// Verify checks that the proof leads from its file up to the given root
+// digest
+func (p *Proof) Verify(root string) error {
+	kind, name, digest := FileEntry, entryName(p.Path), p.Hash
+	dir := parentDir(p.Path)
+	for i, listing := range p.Listings {
+		found := false
+		for _, e := range listing {
+			if e.Kind == kind && e.Name == name && e.Digest == digest {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("listing of %q does not hold %s with digest %s", dir, name, digest)
+		}
+
+		kind, name, digest = DirEntry, entryName(dir), listingDigest(listing)
+		if dir == "" {
+			if i != len(p.Listings)-1 {
+				return fmt.Errorf("proof has more listings than %s has parent directories", p.Path)
+			}
+			if digest != root {
+				return fmt.Errorf("proof of %s leads to root %s, not %s", p.Path, digest, root)
+			}
+			return nil
+		}
+		dir = parentDir(dir)
+	}
+	return fmt.Errorf("proof of %s stops before the root", p.Path)
+}
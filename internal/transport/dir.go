@@ -0,0 +1,71 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// dirTransport is a drop location in a local directory, such as removable
+// media or a network share
+type dirTransport struct {
+	dir string
+}
+
+func newDirTransport(dir string) (*dirTransport, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no directory given")
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", dir, err)
+	}
+	return &dirTransport{dir: absDir}, nil
+}
+
+func (t *dirTransport) String() string {
+	return t.dir
+}
+
+func (t *dirTransport) Put(ctx context.Context, localPath, name string) error {
+	if err := utils.CheckFileName(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", t.dir, err)
+	}
+	part := filepath.Join(t.dir, "."+name+partSuffix)
+	if err := utils.CopyFileContext(ctx, localPath, part); err != nil {
+		os.Remove(part)
+		return err
+	}
+	if err := os.Rename(part, filepath.Join(t.dir, name)); err != nil {
+		os.Remove(part)
+		return fmt.Errorf("failed to publish %s: %w", name, err)
+	}
+	return nil
+}
+
+func (t *dirTransport) Get(ctx context.Context, name, localPath string) error {
+	if err := utils.CheckFileName(name); err != nil {
+		return err
+	}
+	return utils.CopyFileContext(ctx, filepath.Join(t.dir, name), localPath)
+}
+
+func (t *dirTransport) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", t.dir, err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	return visible(names), nil
+}
@@ -0,0 +1,122 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// ManifestSuffix is appended to a file name to name its manifest
+const ManifestSuffix = ".manifest.json"
+
+// Manifest describes a file at a drop location, so readers can check that
+// what they downloaded is what was pushed. Manifests are uploaded before
+// their file, so a file that is visible has its manifest in place.
+type Manifest struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	PushedBy string    `json:"pushed_by,omitempty"`
+	PushedAt time.Time `json:"pushed_at"`
+}
+
+// ManifestName returns the name of the manifest of the file name
+func ManifestName(name string) string {
+	return name + ManifestSuffix
+}
+
+// IsManifest reports whether name is the name of a manifest
+func IsManifest(name string) bool {
+	return strings.HasSuffix(name, ManifestSuffix)
+}
+
+// NewManifest describes the local file to be pushed as name
+func NewManifest(localPath, name string) (*Manifest, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", localPath, err)
+	}
+	hash, err := utils.HashFile(localPath, "sha256")
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash %s: %w", localPath, err)
+	}
+	hostname, _ := os.Hostname()
+	return &Manifest{
+		Name:     name,
+		Size:     info.Size(),
+		SHA256:   hash,
+		PushedBy: hostname,
+		PushedAt: time.Now().UTC(),
+	}, nil
+}
+
+// PutManifest uploads a manifest next to its file
+func PutManifest(ctx context.Context, t Transport, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	tmp, err := os.CreateTemp("", "dsp-manifest-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return t.Put(ctx, tmp.Name(), ManifestName(m.Name))
+}
+
+// GetManifest downloads the manifest of the file name
+func GetManifest(ctx context.Context, t Transport, name string) (*Manifest, error) {
+	tmp, err := os.CreateTemp("", "dsp-manifest-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create manifest: %w", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := t.Get(ctx, ManifestName(name), tmp.Name()); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest for %s: %w", name, err)
+	}
+	if m.Name != name {
+		return nil, fmt.Errorf("manifest for %s describes %s", name, m.Name)
+	}
+	return &m, nil
+}
+
+// Verify checks that the local file matches the manifest
+func (m *Manifest) Verify(localPath string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", localPath, err)
+	}
+	if info.Size() != m.Size {
+		return fmt.Errorf("size mismatch for %s: got %d bytes, manifest says %d", m.Name, info.Size(), m.Size)
+	}
+	hash, err := utils.HashFile(localPath, "sha256")
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %w", localPath, err)
+	}
+	if !strings.EqualFold(hash, m.SHA256) {
+		return fmt.Errorf("checksum mismatch for %s: got %s, manifest says %s", m.Name, hash, m.SHA256)
+	}
+	return nil
+}
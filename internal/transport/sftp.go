@@ -0,0 +1,169 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// sftpTransport is a drop location on an SSH server. It runs the system sftp
+// client in batch mode, so the user's SSH configuration, keys and agent and
+// the known hosts file apply as for any other ssh connection.
+type sftpTransport struct {
+	location string
+	target   string // [user@]host passed to sftp
+	port     string
+	dir      string // Remote directory; relative paths start in the home directory
+}
+
+func newSFTPTransport(u *url.URL) (*sftpTransport, error) {
+	host := u.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("invalid location %s: no host", u.Redacted())
+	}
+	// A host or user starting with - would be read by sftp as an option
+	if strings.HasPrefix(host, "-") {
+		return nil, fmt.Errorf("invalid location %s: host cannot start with -", u.Redacted())
+	}
+	if u.User != nil {
+		if strings.HasPrefix(u.User.Username(), "-") {
+			return nil, fmt.Errorf("invalid location %s: user cannot start with -", u.Redacted())
+		}
+		if _, hasPassword := u.User.Password(); hasPassword {
+			return nil, fmt.Errorf("invalid location %s: passwords are not accepted in the URL; use an SSH key or agent", u.Redacted())
+		}
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	target := host
+	if u.User != nil && u.User.Username() != "" {
+		target = u.User.Username() + "@" + host
+	}
+
+	// Control characters such as newlines would end the batch command the
+	// directory is part of
+	dir := u.Path
+	if hasControl(dir) {
+		return nil, fmt.Errorf("invalid location %s: path contains control characters", u.Redacted())
+	}
+	switch {
+	case dir == "" || dir == "/~" || dir == "/~/":
+		dir = "."
+	case strings.HasPrefix(dir, "/~/"):
+		dir = strings.TrimPrefix(dir, "/~/")
+	}
+
+	location := "sftp://" + target
+	if u.Port() != "" {
+		location += ":" + u.Port()
+	}
+	return &sftpTransport{
+		location: location + u.Path,
+		target:   target,
+		port:     u.Port(),
+		dir:      path.Clean(dir),
+	}, nil
+}
+
+func (t *sftpTransport) String() string {
+	return t.location
+}
+
+func (t *sftpTransport) Put(ctx context.Context, localPath, name string) error {
+	if err := utils.CheckFileName(name); err != nil {
+		return err
+	}
+	part := path.Join(t.dir, "."+name+partSuffix)
+	final := path.Join(t.dir, name)
+
+	// Upload under a hidden name, then rename it into place. Commands
+	// starting with - may fail, such as creating a directory that exists.
+	_, err := t.run(ctx, "upload "+name,
+		"-mkdir "+quote(t.dir),
+		"put "+quote(localPath)+" "+quote(part),
+		"-rm "+quote(final),
+		"rename "+quote(part)+" "+quote(final),
+	)
+	if err != nil {
+		t.run(ctx, "cleanup", "-rm "+quote(part))
+	}
+	return err
+}
+
+func (t *sftpTransport) Get(ctx context.Context, name, localPath string) error {
+	if err := utils.CheckFileName(name); err != nil {
+		return err
+	}
+	_, err := t.run(ctx, "download "+name, "get "+quote(path.Join(t.dir, name))+" "+quote(localPath))
+	return err
+}
+
+func (t *sftpTransport) List(ctx context.Context) ([]string, error) {
+	output, err := t.run(ctx, "listing", "ls -1 "+quote(t.dir))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		// Batch mode echoes each command after the prompt
+		if line == "" || strings.HasPrefix(line, "sftp>") {
+			continue
+		}
+		names = append(names, path.Base(line))
+	}
+	return visible(names), nil
+}
+
+// run runs sftp commands in batch mode and returns their output. Batch mode
+// stops at the first failing command that does not start with -.
+func (t *sftpTransport) run(ctx context.Context, what string, commands ...string) (string, error) {
+	args := []string{"-b", "-", "-o", "BatchMode=yes"}
+	if t.port != "" {
+		args = append(args, "-P", t.port)
+	}
+	args = append(args, "--", t.target)
+
+	for _, command := range commands {
+		if hasControl(command) {
+			return "", fmt.Errorf("sftp %s on %s failed: paths cannot contain control characters", what, t.location)
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, "sftp", args...)
+	cmd.Stdin = strings.NewReader(strings.Join(commands, "\n") + "\n")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if detail := strings.TrimSpace(stderr.String()); detail != "" {
+			return "", fmt.Errorf("sftp %s on %s failed: %s", what, t.location, detail)
+		}
+		return "", fmt.Errorf("sftp %s on %s failed: %w", what, t.location, err)
+	}
+	return stdout.String(), nil
+}
+
+// quote quotes an argument of an sftp batch command. Quoting cannot protect
+// control characters, which run refuses.
+func quote(arg string) string {
+	arg = strings.ReplaceAll(arg, `\`, `\\`)
+	arg = strings.ReplaceAll(arg, `"`, `\"`)
+	return `"` + arg + `"`
+}
+
+// hasControl reports whether a string contains control characters
+func hasControl(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
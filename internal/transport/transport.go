@@ -0,0 +1,65 @@
+// Package transport moves bundle files to and from drop locations that sites
+// push to and pull from, such as a directory on removable media, a directory
+// on an SSH server or a WebDAV share.
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Transport stores files at a drop location
+type Transport interface {
+	// Put uploads the local file as name. Readers of the location never see
+	// a partial file.
+	Put(ctx context.Context, localPath, name string) error
+	// Get downloads the file name to localPath
+	Get(ctx context.Context, name, localPath string) error
+	// List returns the names of the files at the location
+	List(ctx context.Context) ([]string, error)
+	// String returns the location for messages
+	String() string
+}
+
+// partSuffix marks files that are still being uploaded
+const partSuffix = ".part"
+
+// Open returns the transport for a location: sftp://[user@]host[:port]/path
+// (scp:// is accepted as an alias), webdavs://[user@]host[:port]/path
+// (webdav:// for plain HTTP), file:///path or a plain local path. Remote
+// SFTP paths starting with /~/ are relative to the home directory.
+func Open(location string) (Transport, error) {
+	scheme, _, hasScheme := strings.Cut(location, "://")
+	if !hasScheme {
+		return newDirTransport(location)
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid location %s: %w", location, err)
+	}
+	switch strings.ToLower(scheme) {
+	case "file":
+		return newDirTransport(u.Path)
+	case "sftp", "scp":
+		return newSFTPTransport(u)
+	case "webdav", "dav":
+		return newWebDAVTransport(u, false)
+	case "webdavs", "davs":
+		return newWebDAVTransport(u, true)
+	}
+	return nil, fmt.Errorf("unsupported location %s: use sftp://, webdavs://, file:// or a directory path", location)
+}
+
+// visible drops files that are still being uploaded from a listing
+func visible(names []string) []string {
+	var files []string
+	for _, name := range names {
+		if !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, partSuffix) {
+			files = append(files, name)
+		}
+	}
+	return files
+}
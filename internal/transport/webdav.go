@@ -0,0 +1,312 @@
+package transport
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Mattddixo/dsp/internal/protocol"
+	"github.com/Mattddixo/dsp/pkg/utils"
+)
+
+// webdavPasswordEnv holds the WebDAV password when the location names only
+// the user, so it does not have to appear in the URL
+const webdavPasswordEnv = "DSP_WEBDAV_PASSWORD"
+
+// checksumHeader carries a file's checksum on ownCloud and Nextcloud, which
+// check it on upload and return it on download
+const checksumHeader = "OC-Checksum"
+
+// webdavTransport is a drop location on a WebDAV share. Servers commit a PUT
+// only when the upload completes, so files are uploaded in place.
+type webdavTransport struct {
+	location string
+	base     *url.URL // Collection URL, ending in /
+	user     string
+	password string
+	client   *http.Client
+}
+
+func newWebDAVTransport(u *url.URL, secure bool) (*webdavTransport, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid location %s: no host", u.Redacted())
+	}
+	base := *u
+	base.Scheme = "http"
+	if secure {
+		base.Scheme = "https"
+	}
+	base.User = nil
+	base.RawQuery, base.Fragment = "", ""
+	base.Path = strings.TrimSuffix(u.Path, "/") + "/"
+	base.RawPath = ""
+
+	t := &webdavTransport{
+		location: base.Scheme + "://" + base.Host + base.Path,
+		base:     &base,
+		client:   &http.Client{},
+	}
+	if u.User != nil {
+		t.user = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			t.password = password
+		} else {
+			t.password = os.Getenv(webdavPasswordEnv)
+		}
+	}
+	return t, nil
+}
+
+func (t *webdavTransport) String() string {
+	return t.location
+}
+
+func (t *webdavTransport) Put(ctx context.Context, localPath, name string) error {
+	if err := utils.CheckFileName(name); err != nil {
+		return err
+	}
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", localPath, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", localPath, err)
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return fmt.Errorf("failed to hash %s: %w", localPath, err)
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read %s: %w", localPath, err)
+	}
+
+	if err := t.mkcol(ctx); err != nil {
+		return err
+	}
+
+	// Only create the file if it does not exist, or only replace the version
+	// seen just now, so concurrent pushes of the same name cannot silently
+	// overwrite each other
+	existing, err := t.head(ctx, name)
+	if err != nil {
+		return err
+	}
+	req, err := t.request(ctx, http.MethodPut, name, utils.ContextReader(ctx, file))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(checksumHeader, "SHA256:"+sum)
+	if existing == nil {
+		req.Header.Set("If-None-Match", "*")
+	} else if etag := existing.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+	resp, err := t.do(req, "upload "+name)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return fmt.Errorf("%s was changed on %s by another client during the upload; push again", name, t.location)
+	case resp.StatusCode >= 300:
+		return t.statusError("upload "+name, resp)
+	}
+
+	// Check what the server stored
+	stored, err := t.head(ctx, name)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return fmt.Errorf("%s is missing on %s after the upload", name, t.location)
+	}
+	return verifyStored(name, stored, info.Size(), sum)
+}
+
+func (t *webdavTransport) Get(ctx context.Context, name, localPath string) error {
+	if err := utils.CheckFileName(name); err != nil {
+		return err
+	}
+	req, err := t.request(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.do(req, "download "+name)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return t.statusError("download "+name, resp)
+	}
+
+	out, err := os.Create(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", localPath, err)
+	}
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hasher), resp.Body)
+	if err != nil {
+		out.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", localPath, err)
+	}
+	return verifyStored(name, resp, size, hex.EncodeToString(hasher.Sum(nil)))
+}
+
+func (t *webdavTransport) List(ctx context.Context) ([]string, error) {
+	body := strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>` +
+		`<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/></d:prop></d:propfind>`)
+	req, err := t.request(ctx, "PROPFIND", "", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := t.do(req, "listing")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, t.statusError("listing", resp)
+	}
+
+	var result struct {
+		Responses []struct {
+			Href       string    `xml:"href"`
+			Collection *struct{} `xml:"propstat>prop>resourcetype>collection"`
+		} `xml:"response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid listing from %s: %w", t.location, err)
+	}
+	var names []string
+	for _, r := range result.Responses {
+		if r.Collection != nil {
+			continue // The collection itself, or a subdirectory
+		}
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		names = append(names, path.Base(href.Path))
+	}
+	return visible(names), nil
+}
+
+// mkcol creates the collection. It is fine if it exists already.
+func (t *webdavTransport) mkcol(ctx context.Context) error {
+	req, err := t.request(ctx, "MKCOL", "", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.do(req, "directory creation")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusMethodNotAllowed:
+		return nil
+	case http.StatusConflict:
+		return fmt.Errorf("failed to create %s: its parent directory does not exist", t.location)
+	}
+	return t.statusError("directory creation", resp)
+}
+
+// head returns the response to a HEAD request for name, or nil if it does
+// not exist
+func (t *webdavTransport) head(ctx context.Context, name string) (*http.Response, error) {
+	req, err := t.request(ctx, http.MethodHead, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.do(req, "lookup of "+name)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode >= 300:
+		return nil, t.statusError("lookup of "+name, resp)
+	}
+	return resp, nil
+}
+
+// request builds a request for name in the collection, or the collection
+// itself if name is empty
+func (t *webdavTransport) request(ctx context.Context, method, name string, body io.Reader) (*http.Request, error) {
+	target := t.base.JoinPath(name)
+	if name == "" {
+		target = t.base
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if t.user != "" {
+		req.SetBasicAuth(t.user, t.password)
+	}
+	return req, nil
+}
+
+// do sends a request, reporting failures to reach the server
+func (t *webdavTransport) do(req *http.Request, what string) (*http.Response, error) {
+	resp, err := t.client.Do(req)
+	if err != nil {
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("webdav %s on %s failed: %w", what, t.location, err)
+	}
+	return resp, nil
+}
+
+// statusError describes an unexpected response
+func (t *webdavTransport) statusError(what string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		hint := ""
+		if t.user != "" && t.password == "" {
+			hint = fmt.Sprintf("; set %s", webdavPasswordEnv)
+		}
+		return fmt.Errorf("webdav %s on %s was refused: %s%s", what, t.location, resp.Status, hint)
+	}
+	return fmt.Errorf("webdav %s on %s failed: %s", what, t.location, resp.Status)
+}
+
+// verifyStored checks a file's size and SHA-256 against the length and
+// checksum of a response, where the server sends them
+func verifyStored(name string, resp *http.Response, size int64, sum string) error {
+	if resp.ContentLength >= 0 && resp.ContentLength != size {
+		return protocol.VerificationError(fmt.Errorf("size mismatch for %s: %d bytes locally, %d on the server", name, size, resp.ContentLength))
+	}
+	for _, checksum := range strings.Fields(resp.Header.Get(checksumHeader)) {
+		algorithm, value, ok := strings.Cut(checksum, ":")
+		if ok && strings.EqualFold(algorithm, "SHA256") && !strings.EqualFold(value, sum) {
+			return protocol.VerificationError(fmt.Errorf("checksum mismatch for %s: %s locally, %s on the server", name, sum, value))
+		}
+	}
+	return nil
+}
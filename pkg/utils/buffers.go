@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the size of the buffers used to stream file contents
+const copyBufferSize = 256 << 10
+
+// copyBuffers holds buffers for CopyBuffered, so streaming many files does
+// not allocate a buffer for each
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// CopyBuffered copies src to dst like io.Copy, always through a pooled
+// buffer rather than one allocated for the copy
+func CopyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	// Hide ReadFrom and WriteTo, which would bring their own buffers
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
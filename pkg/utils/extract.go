@@ -0,0 +1,284 @@
+package utils
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Default extraction limits, used when ExtractOptions leaves a limit at 0
+const (
+	DefaultMaxExtractFiles     = 100000
+	DefaultMaxExtractFileSize  = 4 << 30  // 4 GiB
+	DefaultMaxExtractTotalSize = 16 << 30 // 16 GiB
+)
+
+// ExtractOptions limits what ExtractZipArchive writes. Archives may come from
+// other machines, so every entry is checked before anything is written.
+type ExtractOptions struct {
+	MaxFiles     int   // Most entries to extract (0: DefaultMaxExtractFiles)
+	MaxFileSize  int64 // Largest decompressed entry (0: DefaultMaxExtractFileSize)
+	MaxTotalSize int64 // Most decompressed bytes in all (0: DefaultMaxExtractTotalSize)
+
+	// AllowSymlinks extracts symlink entries as links. Their targets must stay
+	// inside the destination directory. Otherwise symlink entries are an error.
+	AllowSymlinks bool
+}
+
+// ExtractZipArchive extracts a zip archive to the given directory. Entries
+// that would be written outside destDir, such as "../x" or absolute paths,
+// and archives over the limits of opts are rejected. Extraction stops when
+// ctx is cancelled; files already extracted are left in place.
+func ExtractZipArchive(ctx context.Context, zipPath, destDir string, opts ExtractOptions) error {
+	maxFiles := opts.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = DefaultMaxExtractFiles
+	}
+	maxFileSize := opts.MaxFileSize
+	if maxFileSize <= 0 {
+		maxFileSize = DefaultMaxExtractFileSize
+	}
+	maxTotalSize := opts.MaxTotalSize
+	if maxTotalSize <= 0 {
+		maxTotalSize = DefaultMaxExtractTotalSize
+	}
+
+	// Open zip file
+	reader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return fmt.Errorf("failed to open zip file: %w", err)
+	}
+	defer reader.Close()
+
+	if len(reader.File) > maxFiles {
+		return fmt.Errorf("zip archive has %d entries, more than the limit of %d", len(reader.File), maxFiles)
+	}
+
+	destDir, err = filepath.Abs(destDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve destination: %w", err)
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return fmt.Errorf("failed to create destination: %w", err)
+	}
+
+	// Check names and declared sizes before writing anything
+	var declared uint64
+	for _, file := range reader.File {
+		path, err := extractPath(destDir, file.Name)
+		if err != nil {
+			return err
+		}
+		if file.Mode()&os.ModeSymlink != 0 {
+			if !opts.AllowSymlinks {
+				return fmt.Errorf("zip entry %s is a symlink, which is not allowed", file.Name)
+			}
+			if _, err := symlinkTarget(destDir, path, file); err != nil {
+				return err
+			}
+		}
+		if file.UncompressedSize64 > uint64(maxFileSize) {
+			return fmt.Errorf("zip entry %s is %d bytes, more than the limit of %d", file.Name, file.UncompressedSize64, maxFileSize)
+		}
+		declared += file.UncompressedSize64
+	}
+	if declared > uint64(maxTotalSize) {
+		return fmt.Errorf("zip archive holds %d bytes, more than the limit of %d", declared, maxTotalSize)
+	}
+
+	// Extract each file. Sizes are counted again while writing, as the
+	// declared sizes cannot be trusted.
+	var total int64
+	for _, file := range reader.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path, _ := extractPath(destDir, file.Name)
+
+		// Create directory if needed
+		if file.FileInfo().IsDir() {
+			if err := mkdirInside(destDir, path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Create parent directories
+		if err := mkdirInside(destDir, filepath.Dir(path)); err != nil {
+			return err
+		}
+
+		if file.Mode()&os.ModeSymlink != 0 {
+			target, err := symlinkTarget(destDir, path, file)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, path); err != nil {
+				return fmt.Errorf("failed to create symlink: %w", err)
+			}
+			continue
+		}
+
+		limit := min(maxFileSize, maxTotalSize-total)
+		written, err := extractFile(ctx, path, file, limit)
+		if err != nil {
+			return err
+		}
+		total += written
+	}
+
+	return nil
+}
+
+// extractPath returns where an entry is extracted, or an error if its name
+// would place it outside destDir
+func extractPath(destDir, name string) (string, error) {
+	if name == "" || strings.Contains(name, "\\") || strings.HasPrefix(name, "/") || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("zip entry %q has an unsafe name", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("zip entry %q escapes the destination directory", name)
+		}
+	}
+	path := filepath.Join(destDir, filepath.FromSlash(name))
+	if !Within(path, destDir) {
+		return "", fmt.Errorf("zip entry %q escapes the destination directory", name)
+	}
+	return path, nil
+}
+
+// mkdirInside creates dir, refusing to follow symlinks that lead out of destDir
+func mkdirInside(destDir, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	realDest, err := filepath.EvalSymlinks(destDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve destination: %w", err)
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve directory: %w", err)
+	}
+	if !Within(realDir, realDest) {
+		return fmt.Errorf("directory %s leads outside the destination directory", dir)
+	}
+	return nil
+}
+
+// symlinkTarget returns the target of a symlink entry, or an error if it
+// leads outside destDir. The target is resolved through the links already on
+// disk, so a chain of links cannot step out of destDir.
+func symlinkTarget(destDir, path string, file *zip.File) (string, error) {
+	src, err := file.Open()
+	if err != nil {
+		return "", fmt.Errorf("failed to open zip entry: %w", err)
+	}
+	defer src.Close()
+	target, err := io.ReadAll(io.LimitReader(src, 4096))
+	if err != nil {
+		return "", fmt.Errorf("failed to read symlink %s: %w", file.Name, err)
+	}
+
+	resolved := string(target)
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Dir(path) + string(filepath.Separator) + resolved
+	}
+	if resolved, err = ResolveExisting(resolved); err != nil {
+		return "", fmt.Errorf("failed to resolve symlink %s: %w", file.Name, err)
+	}
+	realDest, err := filepath.EvalSymlinks(destDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve destination: %w", err)
+	}
+	if !Within(resolved, realDest) {
+		return "", fmt.Errorf("zip entry %s links outside the destination directory", file.Name)
+	}
+	return string(target), nil
+}
+
+// ResolveExisting resolves the symlinks in the longest existing prefix of a
+// path, leaving the components that do not exist yet as they are. The path
+// is not cleaned first, so .. after a symlink leads up from where the link
+// points, as the filesystem would follow it.
+func ResolveExisting(path string) (string, error) {
+	sep := string(filepath.Separator)
+	components := strings.Split(path, sep)
+	for i := len(components); i > 0; i-- {
+		prefix := strings.Join(components[:i], sep)
+		if prefix == "" {
+			prefix = sep
+		}
+		resolved, err := filepath.EvalSymlinks(prefix)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, components[i:]...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return filepath.Clean(path), nil
+}
+
+// extractFile writes one entry, failing once more than limit bytes are
+// decompressed. It returns the bytes written.
+func extractFile(ctx context.Context, path string, file *zip.File, limit int64) (int64, error) {
+	src, err := file.Open()
+	if err != nil {
+		return 0, fmt.Errorf("failed to open zip entry: %w", err)
+	}
+	defer src.Close()
+
+	// Keep the permission bits, without set-id or world-writable bits
+	mode := file.Mode().Perm() & 0755
+	if mode == 0 {
+		mode = 0644
+	}
+	// Replace rather than write through an existing symlink
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(path); err != nil {
+			return 0, fmt.Errorf("failed to replace symlink %s: %w", path, err)
+		}
+	}
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file: %w", err)
+	}
+	defer dst.Close()
+
+	written, err := io.Copy(dst, &contextReader{ctx: ctx, r: io.LimitReader(src, limit+1)})
+	if err != nil {
+		return written, fmt.Errorf("failed to extract %s: %w", file.Name, err)
+	}
+	if written > limit {
+		return written, fmt.Errorf("zip entry %s decompresses past the size limit", file.Name)
+	}
+	if err := dst.Close(); err != nil {
+		return written, fmt.Errorf("failed to write %s: %w", file.Name, err)
+	}
+	return written, nil
+}
+
+// ContextReader returns a reader of r that stops reading once ctx is
+// cancelled
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+// contextReader stops reading once its context is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
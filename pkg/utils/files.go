@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// CheckFileName checks that a name, such as one read from a bundle, a
+// message or a remote listing, is a single file name that is safe to join
+// to a directory
+func CheckFileName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || name != path.Base(name) {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	return nil
+}
+
+// CopyFile copies the file src to dst, with the permissions of src
+func CopyFile(src, dst string) error {
+	return CopyFileContext(context.Background(), src, dst)
+}
+
+// CopyFileContext copies the file src to dst, with the permissions of src,
+// stopping when ctx is cancelled
+func CopyFileContext(ctx context.Context, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", src, err)
+	}
+	if err := WriteFileFrom(dst, &contextReader{ctx: ctx, r: in}, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	return nil
+}
+
+// WriteFileFrom writes what r holds to the file dst, creating it with perm
+// if it does not exist
+func WriteFileFrom(dst string, r io.Reader, perm os.FileMode) error {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := CopyBuffered(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dst, err)
+	}
+	return nil
+}
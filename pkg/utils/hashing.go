@@ -7,10 +7,48 @@ import (
 	"hash"
 	"io"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/zeebo/blake3"
 )
 
+// KeyedBlake3 is BLAKE3 keyed with a secret of the repository, so hashes
+// cannot be compared with those of known files by anyone without the key
+const KeyedBlake3 = "blake3-keyed"
+
+// HashKeySize is the size of the key of KeyedBlake3
+const HashKeySize = 32
+
+var (
+	hashKeyMu sync.RWMutex
+	hashKey   []byte
+)
+
+// SetHashKey sets the key used by KeyedBlake3. A process works with the key
+// of one repository at a time.
+func SetHashKey(key []byte) error {
+	if len(key) != HashKeySize {
+		return fmt.Errorf("hash key must be %d bytes, not %d", HashKeySize, len(key))
+	}
+	hashKeyMu.Lock()
+	defer hashKeyMu.Unlock()
+	hashKey = append([]byte(nil), key...)
+	return nil
+}
+
+// HashKeyID identifies the key set with SetHashKey without revealing it, or
+// returns "" if there is none
+func HashKeyID() string {
+	hashKeyMu.RLock()
+	defer hashKeyMu.RUnlock()
+	if hashKey == nil {
+		return ""
+	}
+	sum := blake3.Sum256(append([]byte("dsp hash key id "), hashKey...))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
 // HashFile computes the hash of a file using the specified algorithm
 func HashFile(path string, algorithm string) (string, error) {
 	// Open the file
@@ -27,7 +65,7 @@ func HashFile(path string, algorithm string) (string, error) {
 	}
 
 	// Copy the file into the hasher
-	if _, err := io.Copy(hasher, file); err != nil {
+	if _, err := CopyBuffered(hasher, file); err != nil {
 		return "", fmt.Errorf("failed to hash file: %w", err)
 	}
 
@@ -36,6 +74,25 @@ func HashFile(path string, algorithm string) (string, error) {
 	return fmt.Sprintf("%x", hash), nil
 }
 
+// HashPath computes the hash of a path without following symlinks. A symlink
+// is hashed by its target, so dangling links and links to directories can be
+// hashed too; any other path is hashed by its content.
+func HashPath(path string, algorithm string) (string, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file: %w", err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return HashFile(path, algorithm)
+	}
+
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read symlink: %w", err)
+	}
+	return HashReader(strings.NewReader(target), algorithm)
+}
+
 // HashReader computes the hash of a reader using the specified algorithm
 func HashReader(reader io.Reader, algorithm string) (string, error) {
 	// Create the hasher
@@ -45,7 +102,7 @@ func HashReader(reader io.Reader, algorithm string) (string, error) {
 	}
 
 	// Copy the reader into the hasher
-	if _, err := io.Copy(hasher, reader); err != nil {
+	if _, err := CopyBuffered(hasher, reader); err != nil {
 		return "", fmt.Errorf("failed to hash reader: %w", err)
 	}
 
@@ -59,6 +116,17 @@ func GetHasher(algorithm string) (hash.Hash, error) {
 	switch algorithm {
 	case "blake3":
 		return blake3.New(), nil
+	case KeyedBlake3:
+		hashKeyMu.RLock()
+		defer hashKeyMu.RUnlock()
+		if hashKey == nil {
+			return nil, fmt.Errorf("%s needs the repository's hash key; set it with 'dsp config hash-key --set'", KeyedBlake3)
+		}
+		hasher, err := blake3.NewKeyed(hashKey)
+		if err != nil {
+			return nil, err
+		}
+		return hasher, nil
 	case "sha256":
 		return sha256.New(), nil
 	case "sha512":
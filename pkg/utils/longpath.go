@@ -0,0 +1,5 @@
+package utils
+
+// WindowsMaxPath is the length from which Windows refuses ordinary paths
+// unless they are written with the \\?\ prefix
+const WindowsMaxPath = 260
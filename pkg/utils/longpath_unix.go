@@ -0,0 +1,8 @@
+//go:build !windows
+
+package utils
+
+// LongPath returns path unchanged; only Windows limits path lengths
+func LongPath(path string) string {
+	return path
+}
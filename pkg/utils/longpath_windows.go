@@ -0,0 +1,24 @@
+//go:build windows
+
+package utils
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// LongPath returns an absolute path of WindowsMaxPath characters or more with
+// the \\?\ prefix, which lifts the length limit. Such paths are not
+// normalized by Windows, so the path is cleaned first. Shorter, relative and
+// already prefixed paths are returned unchanged.
+func LongPath(path string) string {
+	if len(path) < WindowsMaxPath || !filepath.IsAbs(path) || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	path = filepath.Clean(path)
+	if strings.HasPrefix(path, `\\`) {
+		// \\server\share\... becomes \\?\UNC\server\share\...
+		return `\\?\UNC\` + path[2:]
+	}
+	return `\\?\` + path
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ValidatePathPattern checks a pattern for MatchPathPattern
+func ValidatePathPattern(pattern string) error {
+	if strings.Contains(pattern, "\\") {
+		return fmt.Errorf("pattern %s: use forward slashes (/) instead of backslashes (\\)", pattern)
+	}
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("pattern %s: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// MatchPathPattern reports whether a slash-separated relative path, or one
+// of its parent directories, matches a pattern. Segments match as with
+// path.Match, and a ** segment matches any number of segments.
+func MatchPathPattern(pattern, rel string) bool {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		if matchSegments(patternParts, parts[:i+1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments reports whether the segments of a path match those of a
+// pattern
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], name[0]); !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
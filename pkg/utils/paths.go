@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Within reports whether path is dir or below it. Both are compared as
+// given, so callers resolve symlinks or make them absolute first if needed.
+func Within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// RelativePath returns path relative to root, with forward slashes, for
+// display. Paths outside root are returned as they are.
+func RelativePath(root, path string) string {
+	if !Within(path, root) {
+		return path
+	}
+	rel, _ := filepath.Rel(root, path)
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,219 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxDiffEdits caps the number of line insertions and deletions UnifiedDiff
+// will compute. Larger diffs are reported as too large to display.
+const MaxDiffEdits = 2000
+
+// IsBinary reports whether data looks like binary rather than text
+func IsBinary(data []byte) bool {
+	sample := data
+	if len(sample) > 8000 {
+		sample = sample[:8000]
+	}
+	if bytes.IndexByte(sample, 0) >= 0 {
+		return true
+	}
+	return !utf8.Valid(sample)
+}
+
+// diffEdit is a single line of an edit script
+type diffEdit struct {
+	op   byte // ' ' (equal), '-' (delete) or '+' (insert)
+	text string
+}
+
+// UnifiedDiff returns a unified diff between two texts with the given number
+// of context lines. It returns an empty string if the texts are equal.
+func UnifiedDiff(oldLabel, newLabel, oldText, newText string, context int) (string, error) {
+	if oldText == newText {
+		return "", nil
+	}
+
+	a := splitLines(oldText)
+	b := splitLines(newText)
+	edits, err := myersDiff(a, b)
+	if err != nil {
+		return "", err
+	}
+
+	// Line positions before each edit
+	aPos := make([]int, len(edits)+1)
+	bPos := make([]int, len(edits)+1)
+	for i, e := range edits {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if e.op != '+' {
+			aPos[i+1]++
+		}
+		if e.op != '-' {
+			bPos[i+1]++
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", oldLabel, newLabel)
+
+	i := 0
+	for i < len(edits) {
+		// Find the next change
+		for i < len(edits) && edits[i].op == ' ' {
+			i++
+		}
+		if i == len(edits) {
+			break
+		}
+
+		// Extend the hunk while changes are close together
+		lastChange := i
+		j := i
+		for j < len(edits) {
+			if edits[j].op != ' ' {
+				lastChange = j
+				j++
+				continue
+			}
+			k := j
+			for k < len(edits) && edits[k].op == ' ' {
+				k++
+			}
+			if k == len(edits) || k-j > 2*context {
+				break
+			}
+			j = k
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := lastChange + 1 + context
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		// Write hunk header and lines
+		aLen, bLen := aPos[end]-aPos[start], bPos[end]-bPos[start]
+		aStart, bStart := aPos[start]+1, bPos[start]+1
+		if aLen == 0 {
+			aStart--
+		}
+		if bLen == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, e := range edits[start:end] {
+			sb.WriteByte(e.op)
+			sb.WriteString(e.text)
+			if !strings.HasSuffix(e.text, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = end
+	}
+
+	return sb.String(), nil
+}
+
+// splitLines splits text into lines, keeping line endings
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// myersDiff computes the shortest edit script between two line slices
+// using Myers' O((N+M)D) algorithm
+func myersDiff(a, b []string) ([]diffEdit, error) {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil, nil
+	}
+
+	// v[offset+k] is the furthest x reached on diagonal k
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		if d > MaxDiffEdits {
+			return nil, fmt.Errorf("diff is too large to display (more than %d changed lines)", MaxDiffEdits)
+		}
+
+		// Keep the diagonals reachable in this round for backtracking
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	// Backtrack through the trace to build the edit script
+	var edits []diffEdit
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		saved := trace[d]
+		at := func(k int) int { return saved[k+d+1] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			edits = append(edits, diffEdit{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			edits = append(edits, diffEdit{'+', b[y-1]})
+		} else {
+			edits = append(edits, diffEdit{'-', a[x-1]})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		edits = append(edits, diffEdit{' ', a[x-1]})
+		x--
+		y--
+	}
+
+	// Reverse into forward order
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits, nil
+}
@@ -0,0 +1,171 @@
+package utils
+
+import "strings"
+
+// Conflict marker lines written by Merge3
+const (
+	ConflictStart = "<<<<<<<"
+	ConflictSep   = "======="
+	ConflictEnd   = ">>>>>>>"
+)
+
+// mergeHunk replaces lines [start, end) of the base with lines
+type mergeHunk struct {
+	start, end int
+	lines      []string
+}
+
+// Merge3 merges two texts derived from a common base. Changes made on only
+// one side are taken as is; overlapping changes that differ are written with
+// conflict markers labelled oursLabel and theirsLabel. It returns the merged
+// text and the number of conflicting regions.
+func Merge3(base, ours, theirs, oursLabel, theirsLabel string) (string, int, error) {
+	// Trivial cases
+	switch {
+	case ours == theirs:
+		return ours, 0, nil
+	case base == ours:
+		return theirs, 0, nil
+	case base == theirs:
+		return ours, 0, nil
+	}
+
+	baseLines := splitLines(base)
+	oursHunks, err := diffHunks(baseLines, splitLines(ours))
+	if err != nil {
+		return "", 0, err
+	}
+	theirsHunks, err := diffHunks(baseLines, splitLines(theirs))
+	if err != nil {
+		return "", 0, err
+	}
+
+	var sb strings.Builder
+	conflicts := 0
+	pos := 0
+	i, j := 0, 0
+	for i < len(oursHunks) || j < len(theirsHunks) {
+		// Start a region with the hunk that begins first
+		var regionOurs, regionTheirs []mergeHunk
+		var start, end int
+		if j >= len(theirsHunks) || (i < len(oursHunks) && oursHunks[i].start <= theirsHunks[j].start) {
+			start, end = oursHunks[i].start, oursHunks[i].end
+			regionOurs = append(regionOurs, oursHunks[i])
+			i++
+		} else {
+			start, end = theirsHunks[j].start, theirsHunks[j].end
+			regionTheirs = append(regionTheirs, theirsHunks[j])
+			j++
+		}
+
+		// Extend the region with hunks that overlap or touch it
+		for {
+			if i < len(oursHunks) && oursHunks[i].start <= end {
+				regionOurs = append(regionOurs, oursHunks[i])
+				end = max(end, oursHunks[i].end)
+				i++
+				continue
+			}
+			if j < len(theirsHunks) && theirsHunks[j].start <= end {
+				regionTheirs = append(regionTheirs, theirsHunks[j])
+				end = max(end, theirsHunks[j].end)
+				j++
+				continue
+			}
+			break
+		}
+
+		// Copy unchanged lines before the region
+		for _, line := range baseLines[pos:start] {
+			sb.WriteString(line)
+		}
+		pos = end
+
+		oursText := applyHunks(baseLines, start, end, regionOurs)
+		theirsText := applyHunks(baseLines, start, end, regionTheirs)
+		switch {
+		case len(regionTheirs) == 0:
+			sb.WriteString(oursText)
+		case len(regionOurs) == 0:
+			sb.WriteString(theirsText)
+		case oursText == theirsText:
+			sb.WriteString(oursText)
+		default:
+			conflicts++
+			sb.WriteString(ConflictStart + " " + oursLabel + "\n")
+			writeTerminated(&sb, oursText)
+			sb.WriteString(ConflictSep + "\n")
+			writeTerminated(&sb, theirsText)
+			sb.WriteString(ConflictEnd + " " + theirsLabel + "\n")
+		}
+	}
+
+	// Copy the remaining unchanged lines
+	for _, line := range baseLines[pos:] {
+		sb.WriteString(line)
+	}
+
+	return sb.String(), conflicts, nil
+}
+
+// diffHunks returns the changes from a to b as hunks over a
+func diffHunks(a, b []string) ([]mergeHunk, error) {
+	edits, err := myersDiff(a, b)
+	if err != nil {
+		return nil, err
+	}
+
+	var hunks []mergeHunk
+	var current *mergeHunk
+	pos := 0
+	for _, e := range edits {
+		if e.op == ' ' {
+			if current != nil {
+				hunks = append(hunks, *current)
+				current = nil
+			}
+			pos++
+			continue
+		}
+		if current == nil {
+			current = &mergeHunk{start: pos, end: pos}
+		}
+		if e.op == '-' {
+			pos++
+			current.end = pos
+		} else {
+			current.lines = append(current.lines, e.text)
+		}
+	}
+	if current != nil {
+		hunks = append(hunks, *current)
+	}
+	return hunks, nil
+}
+
+// applyHunks returns base lines [start, end) with the hunks applied
+func applyHunks(base []string, start, end int, hunks []mergeHunk) string {
+	var sb strings.Builder
+	pos := start
+	for _, h := range hunks {
+		for _, line := range base[pos:h.start] {
+			sb.WriteString(line)
+		}
+		for _, line := range h.lines {
+			sb.WriteString(line)
+		}
+		pos = h.end
+	}
+	for _, line := range base[pos:end] {
+		sb.WriteString(line)
+	}
+	return sb.String()
+}
+
+// writeTerminated writes text, adding a final newline if it is missing
+func writeTerminated(sb *strings.Builder, text string) {
+	sb.WriteString(text)
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		sb.WriteString("\n")
+	}
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Wipe overwrites b with zeros. It is for buffers that held keys,
+// passphrases or decrypted data, once they are no longer needed; copies a
+// library or the runtime made of them are out of its reach.
+func Wipe(b []byte) {
+	clear(b)
+}
+
+// SecureRemove overwrites a file with zeros, flushes it to disk and removes
+// it. The overwrite does not reach copies the file system keeps elsewhere,
+// as copy-on-write file systems and SSDs do.
+func SecureRemove(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() && info.Size() > 0 {
+		if err := overwrite(path, info.Size()); err != nil {
+			return fmt.Errorf("failed to wipe %s: %w", path, err)
+		}
+	}
+	return os.Remove(path)
+}
+
+// SecureRemoveAll removes a directory like os.RemoveAll, wiping the files in
+// it with SecureRemove first
+func SecureRemoveAll(dir string) error {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			return SecureRemove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// RemoveTemp removes a temporary file, wiping it first if wipe is set
+func RemoveTemp(path string, wipe bool) error {
+	if wipe {
+		return SecureRemove(path)
+	}
+	return os.Remove(path)
+}
+
+// RemoveTempDir removes a temporary directory, wiping its files first if
+// wipe is set
+func RemoveTempDir(dir string, wipe bool) error {
+	if wipe {
+		return SecureRemoveAll(dir)
+	}
+	return os.RemoveAll(dir)
+}
+
+// overwrite writes size zeros over the start of a file and syncs it
+func overwrite(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zeros := make([]byte, copyBufferSize)
+	for written := int64(0); written < size; {
+		n := int64(len(zeros))
+		if size-written < n {
+			n = size - written
+		}
+		if _, err := f.Write(zeros[:n]); err != nil {
+			return err
+		}
+		written += n
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Zip record signatures and sizes
+var (
+	localHeaderSig = []byte("PK\x03\x04")
+	descriptorSig  = []byte("PK\x07\x08")
+)
+
+const (
+	localHeaderLen  = 30
+	descriptorLen   = 16 // Signature, CRC-32 and 32-bit sizes
+	descriptor64Len = 24 // Signature, CRC-32 and 64-bit sizes
+)
+
+// RecoveredEntry is an entry found in a possibly damaged zip archive. Its
+// data is only checked when it is read.
+type RecoveredEntry struct {
+	Name   string
+	Method uint16
+	CRC32  uint32
+	open   func() (io.ReadCloser, error)
+}
+
+// Open returns a reader for the decompressed data of the entry
+func (e *RecoveredEntry) Open() (io.ReadCloser, error) {
+	return e.open()
+}
+
+// Check reads the whole entry and compares it with its CRC-32. The data is
+// also written to w, if not nil.
+func (e *RecoveredEntry) Check(w io.Writer) error {
+	rc, err := e.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	crc := crc32.NewIEEE()
+	var dst io.Writer = crc
+	if w != nil {
+		dst = io.MultiWriter(crc, w)
+	}
+	_, err = CopyBuffered(dst, rc)
+	if errors.Is(err, zip.ErrChecksum) || err == nil && crc.Sum32() != e.CRC32 {
+		return fmt.Errorf("checksum mismatch")
+	}
+	if err != nil {
+		return fmt.Errorf("unreadable data: %w", err)
+	}
+	return nil
+}
+
+// RecoveredZip is a zip archive opened for recovery. If its central
+// directory cannot be read, its entries are found by scanning the archive
+// for local file headers instead; entries whose end cannot be found, such
+// as the last one of a truncated archive, are reported in Truncated.
+type RecoveredZip struct {
+	Entries   []*RecoveredEntry
+	Scanned   bool     // Entries were found by scanning the archive
+	Truncated []string // Entries found by scanning whose data is cut off
+	file      *os.File
+}
+
+// OpenRecoveredZip opens the zip archive at path for recovery
+func OpenRecoveredZip(path string) (*RecoveredZip, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat archive: %w", err)
+	}
+
+	z := &RecoveredZip{file: file}
+	if zr, err := zip.NewReader(file, info.Size()); err == nil {
+		for _, f := range zr.File {
+			z.Entries = append(z.Entries, &RecoveredEntry{
+				Name:   f.Name,
+				Method: f.Method,
+				CRC32:  f.CRC32,
+				open:   f.Open,
+			})
+		}
+		return z, nil
+	}
+
+	z.Scanned = true
+	if err := z.scan(info.Size()); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return z, nil
+}
+
+// Close closes the archive
+func (z *RecoveredZip) Close() error {
+	return z.file.Close()
+}
+
+// scan finds entries from their local file headers
+func (z *RecoveredZip) scan(size int64) error {
+	seen := make(map[string]bool)
+	for pos := int64(0); pos < size; {
+		start, ok, err := findSignature(z.file, pos, size, localHeaderSig)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+
+		var header [localHeaderLen]byte
+		if _, err := z.file.ReadAt(header[:], start); err != nil {
+			break // Cut off
+		}
+		flags := binary.LittleEndian.Uint16(header[6:])
+		method := binary.LittleEndian.Uint16(header[8:])
+		crc := binary.LittleEndian.Uint32(header[14:])
+		compressedSize := int64(binary.LittleEndian.Uint32(header[18:]))
+		nameLen := int64(binary.LittleEndian.Uint16(header[26:]))
+		extraLen := int64(binary.LittleEndian.Uint16(header[28:]))
+		dataStart := start + localHeaderLen + nameLen + extraLen
+		if dataStart > size {
+			break
+		}
+		name := make([]byte, nameLen)
+		if _, err := z.file.ReadAt(name, start+localHeaderLen); err != nil {
+			break
+		}
+
+		// Entries written in one pass record their sizes and CRC in a data
+		// descriptor after the data
+		end := dataStart + compressedSize
+		next := end
+		if flags&0x8 != 0 {
+			var found bool
+			end, crc, next, found, err = findDescriptor(z.file, dataStart, size)
+			if err != nil {
+				return err
+			}
+			if !found {
+				z.Truncated = append(z.Truncated, string(name))
+				break
+			}
+		} else if end > size {
+			z.Truncated = append(z.Truncated, string(name))
+			break
+		}
+
+		if !seen[string(name)] {
+			seen[string(name)] = true
+			section := io.NewSectionReader(z.file, dataStart, end-dataStart)
+			z.Entries = append(z.Entries, &RecoveredEntry{
+				Name:   string(name),
+				Method: method,
+				CRC32:  crc,
+				open: func() (io.ReadCloser, error) {
+					return openSection(section, method)
+				},
+			})
+		}
+		pos = next
+	}
+	return nil
+}
+
+// openSection returns a reader decompressing entry data
+func openSection(section *io.SectionReader, method uint16) (io.ReadCloser, error) {
+	section = io.NewSectionReader(section, 0, section.Size())
+	switch method {
+	case zip.Store:
+		return io.NopCloser(section), nil
+	case zip.Deflate:
+		return flate.NewReader(section), nil
+	}
+	return nil, fmt.Errorf("unsupported compression method %d", method)
+}
+
+// findSignature returns the offset of the first occurrence of sig at or after
+// pos, reading the archive a block at a time
+func findSignature(r io.ReaderAt, pos, size int64, sig []byte) (int64, bool, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	block := *buf
+	for ; pos < size; pos += int64(len(block) - len(sig) + 1) {
+		n, err := r.ReadAt(block, pos)
+		if err != nil && err != io.EOF {
+			return 0, false, fmt.Errorf("failed to read archive: %w", err)
+		}
+		if i := bytes.Index(block[:n], sig); i >= 0 {
+			return pos + int64(i), true, nil
+		}
+		if n < len(block) {
+			break
+		}
+	}
+	return 0, false, nil
+}
+
+// findDescriptor finds the data descriptor ending the data that starts at
+// start. A descriptor is recognised by its signature followed by a
+// compressed size equal to its distance from start. It returns the end of
+// the data, the recorded CRC-32 and the offset after the descriptor.
+func findDescriptor(r io.ReaderAt, start, size int64) (end int64, crc uint32, next int64, found bool, err error) {
+	for pos := start; pos < size; {
+		at, ok, err := findSignature(r, pos, size, descriptorSig)
+		if err != nil || !ok {
+			return 0, 0, 0, false, err
+		}
+		var desc [descriptor64Len]byte
+		n, _ := r.ReadAt(desc[:], at)
+		length := at - start
+		switch {
+		case n >= descriptorLen && int64(binary.LittleEndian.Uint32(desc[8:])) == length:
+			return at, binary.LittleEndian.Uint32(desc[4:]), at + descriptorLen, true, nil
+		case n >= descriptor64Len && int64(binary.LittleEndian.Uint64(desc[8:])) == length:
+			return at, binary.LittleEndian.Uint32(desc[4:]), at + descriptor64Len, true, nil
+		}
+		pos = at + 1
+	}
+	return 0, 0, 0, false, nil
+}
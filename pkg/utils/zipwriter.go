@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ZipWriter writes a zip archive in a single pass. Entries are streamed to a
+// temporary file next to the destination, which replaces the destination when
+// the archive is committed, so readers never see a partial archive.
+type ZipWriter struct {
+	path     string
+	file     *os.File
+	zw       *zip.Writer
+	modified time.Time       // Modification time of entries made with Create
+	names    map[string]bool // Entries written so far
+	closed   bool
+}
+
+// NewZipWriter starts an archive to be saved at path. Entries made with
+// Create are stamped with modified.
+func NewZipWriter(path string, modified time.Time) (*ZipWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), ".dsp-zip-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	return &ZipWriter{
+		path:     path,
+		file:     file,
+		zw:       zip.NewWriter(file),
+		modified: modified,
+		names:    make(map[string]bool),
+	}, nil
+}
+
+// Has reports whether an entry with this name was written
+func (w *ZipWriter) Has(name string) bool {
+	return w.names[name]
+}
+
+// Create starts an entry with the given compression method, zip.Store or
+// zip.Deflate. The entry must be written before the next one is created.
+func (w *ZipWriter) Create(name string, method uint16) (io.Writer, error) {
+	return w.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: w.modified})
+}
+
+// CreateHeader starts an entry described by header
+func (w *ZipWriter) CreateHeader(header *zip.FileHeader) (io.Writer, error) {
+	if w.names[header.Name] {
+		return nil, fmt.Errorf("duplicate zip entry %s", header.Name)
+	}
+	entry, err := w.zw.CreateHeader(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zip entry: %w", err)
+	}
+	w.names[header.Name] = true
+	return entry, nil
+}
+
+// WriteEntry writes a whole entry
+func (w *ZipWriter) WriteEntry(name string, method uint16, data []byte) error {
+	entry, err := w.Create(name, method)
+	if err != nil {
+		return err
+	}
+	if _, err := entry.Write(data); err != nil {
+		return fmt.Errorf("failed to write zip entry %s: %w", name, err)
+	}
+	return nil
+}
+
+// Commit finishes the archive and moves it to its destination
+func (w *ZipWriter) Commit() error {
+	if w.closed {
+		return fmt.Errorf("archive already closed")
+	}
+	w.closed = true
+	defer os.Remove(w.file.Name())
+
+	if err := w.zw.Close(); err != nil {
+		w.file.Close()
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close archive: %w", err)
+	}
+	if err := os.Rename(w.file.Name(), w.path); err != nil {
+		return fmt.Errorf("failed to save archive: %w", err)
+	}
+	return nil
+}
+
+// Close discards the archive if it was not committed. It is safe to defer
+// Close right after NewZipWriter.
+func (w *ZipWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}